@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/DataDog/datadog-go/statsd"
 
@@ -11,7 +12,15 @@ import (
 )
 
 func main() {
-	statsdClient, _ := statsd.New("")
+	// The statsd client is configured here, by the application embedding
+	// go-httpbin, and handed to the observer; the httpbin package itself
+	// never talks to statsd. Without STATSD_ADDR, the client finds the agent
+	// via the DD_AGENT_HOST environment variable.
+	var statsdAddr string
+	if host := os.Getenv("STATSD_ADDR"); host != "" {
+		statsdAddr = host + ":8125"
+	}
+	statsdClient, _ := statsd.New(statsdAddr)
 
 	app := httpbin.New(
 		httpbin.WithObserver(datadogObserver(statsdClient)),
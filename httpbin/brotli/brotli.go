@@ -0,0 +1,308 @@
+// Package brotli provides a streaming implementation of a Brotli decoder, as
+// defined in RFC 7932.
+//
+// For more info, see:
+// https://www.rfc-editor.org/rfc/rfc7932
+package brotli
+
+import (
+	_ "embed" // for the static dictionary
+)
+
+// dictionary is the static dictionary of RFC 7932 appendix A, which
+// compressed streams may refer to as if it preceded their data.
+//
+//go:embed dictionary.bin
+var dictionary []byte
+
+// dictionarySizeBits gives, for each word length, the base 2 logarithm of
+// the number of dictionary words of that length, RFC 7932 section 8.
+var dictionarySizeBits = [25]uint{
+	0, 0, 0, 0, 10, 10, 11, 11, 10, 10, 10, 10, 10,
+	9, 9, 8, 7, 7, 8, 7, 7, 6, 6, 5, 5,
+}
+
+// dictionaryOffsets gives, for each word length, the offset of the first
+// word of that length in the dictionary.
+var dictionaryOffsets = func() [25]int {
+	var offsets [25]int
+	for length := 5; length < len(offsets); length++ {
+		offsets[length] = offsets[length-1] + (length-1)<<dictionarySizeBits[length-1]
+	}
+	return offsets
+}()
+
+// Ways in which a transform may change the case of a word
+const (
+	uppercaseNone = iota
+	uppercaseFirst
+	uppercaseAll
+)
+
+// transform describes how a dictionary word is turned into the bytes it
+// stands for: the word loses its first omitFirst or last omitLast bytes,
+// may have its case changed, and is then wrapped in prefix and suffix.
+type transform struct {
+	prefix    string
+	omitFirst int
+	omitLast  int
+	uppercase int
+	suffix    string
+}
+
+// apply appends the transformed word to dst.
+func (t *transform) apply(dst, word []byte) []byte {
+	dst = append(dst, t.prefix...)
+	if t.omitFirst >= len(word) {
+		word = nil
+	} else {
+		word = word[t.omitFirst:]
+	}
+	if t.omitLast >= len(word) {
+		word = nil
+	} else {
+		word = word[:len(word)-t.omitLast]
+	}
+	start := len(dst)
+	dst = append(dst, word...)
+	switch t.uppercase {
+	case uppercaseFirst:
+		toUpper(dst[start:], 0)
+	case uppercaseAll:
+		for i := start; i < len(dst); {
+			i += toUpper(dst[start:], i-start)
+		}
+	}
+	return append(dst, t.suffix...)
+}
+
+// toUpper changes the case of the character at word[pos] the simplistic way
+// RFC 7932 section 8 prescribes, returning the length of the character.
+func toUpper(word []byte, pos int) int {
+	switch c := word[pos]; {
+	case c < 0xC0:
+		if c >= 'a' && c <= 'z' {
+			word[pos] ^= 32
+		}
+		return 1
+	case c < 0xE0:
+		if pos+1 < len(word) {
+			word[pos+1] ^= 32
+		}
+		return 2
+	default:
+		if pos+2 < len(word) {
+			word[pos+2] ^= 5
+		}
+		return 3
+	}
+}
+
+// transforms are the word transformations of RFC 7932 appendix B, indexed
+// by transform ID.
+var transforms = [...]transform{
+	{},
+	{suffix: " "},
+	{prefix: " ", suffix: " "},
+	{omitFirst: 1},
+	{uppercase: uppercaseFirst, suffix: " "},
+	{suffix: " the "},
+	{prefix: " "},
+	{prefix: "s ", suffix: " "},
+	{suffix: " of "},
+	{uppercase: uppercaseFirst},
+	{suffix: " and "},
+	{omitFirst: 2},
+	{omitLast: 1},
+	{prefix: ", ", suffix: " "},
+	{suffix: ", "},
+	{prefix: " ", uppercase: uppercaseFirst, suffix: " "},
+	{suffix: " in "},
+	{suffix: " to "},
+	{prefix: "e ", suffix: " "},
+	{suffix: "\""},
+	{suffix: "."},
+	{suffix: "\">"},
+	{suffix: "\n"},
+	{omitLast: 3},
+	{suffix: "]"},
+	{suffix: " for "},
+	{omitFirst: 3},
+	{omitLast: 2},
+	{suffix: " a "},
+	{suffix: " that "},
+	{prefix: " ", uppercase: uppercaseFirst},
+	{suffix: ". "},
+	{prefix: "."},
+	{prefix: " ", suffix: ", "},
+	{omitFirst: 4},
+	{suffix: " with "},
+	{suffix: "'"},
+	{suffix: " from "},
+	{suffix: " by "},
+	{omitFirst: 5},
+	{omitFirst: 6},
+	{prefix: " the "},
+	{omitLast: 4},
+	{suffix: ". The "},
+	{uppercase: uppercaseAll},
+	{suffix: " on "},
+	{suffix: " as "},
+	{suffix: " is "},
+	{omitLast: 7},
+	{omitLast: 1, suffix: "ing "},
+	{suffix: "\n\t"},
+	{suffix: ":"},
+	{prefix: " ", suffix: ". "},
+	{suffix: "ed "},
+	{omitFirst: 9},
+	{omitFirst: 7},
+	{omitLast: 6},
+	{suffix: "("},
+	{uppercase: uppercaseFirst, suffix: ", "},
+	{omitLast: 8},
+	{suffix: " at "},
+	{suffix: "ly "},
+	{prefix: " the ", suffix: " of "},
+	{omitLast: 5},
+	{omitLast: 9},
+	{prefix: " ", uppercase: uppercaseFirst, suffix: ", "},
+	{uppercase: uppercaseFirst, suffix: "\""},
+	{prefix: ".", suffix: "("},
+	{uppercase: uppercaseAll, suffix: " "},
+	{uppercase: uppercaseFirst, suffix: "\">"},
+	{suffix: "=\""},
+	{prefix: " ", suffix: "."},
+	{prefix: ".com/"},
+	{prefix: " the ", suffix: " of the "},
+	{uppercase: uppercaseFirst, suffix: "'"},
+	{suffix: ". This "},
+	{suffix: ","},
+	{prefix: ".", suffix: " "},
+	{uppercase: uppercaseFirst, suffix: "("},
+	{uppercase: uppercaseFirst, suffix: "."},
+	{suffix: " not "},
+	{prefix: " ", suffix: "=\""},
+	{suffix: "er "},
+	{prefix: " ", uppercase: uppercaseAll, suffix: " "},
+	{suffix: "al "},
+	{prefix: " ", uppercase: uppercaseAll},
+	{suffix: "='"},
+	{uppercase: uppercaseAll, suffix: "\""},
+	{uppercase: uppercaseFirst, suffix: ". "},
+	{prefix: " ", suffix: "("},
+	{suffix: "ful "},
+	{prefix: " ", uppercase: uppercaseFirst, suffix: ". "},
+	{suffix: "ive "},
+	{suffix: "less "},
+	{uppercase: uppercaseAll, suffix: "'"},
+	{suffix: "est "},
+	{prefix: " ", uppercase: uppercaseFirst, suffix: "."},
+	{uppercase: uppercaseAll, suffix: "\">"},
+	{prefix: " ", suffix: "='"},
+	{uppercase: uppercaseFirst, suffix: ","},
+	{suffix: "ize "},
+	{uppercase: uppercaseAll, suffix: "."},
+	{prefix: "\xc2\xa0"},
+	{prefix: " ", suffix: ","},
+	{uppercase: uppercaseFirst, suffix: "=\""},
+	{uppercase: uppercaseAll, suffix: "=\""},
+	{suffix: "ous "},
+	{uppercase: uppercaseAll, suffix: ", "},
+	{uppercase: uppercaseFirst, suffix: "='"},
+	{prefix: " ", uppercase: uppercaseFirst, suffix: ","},
+	{prefix: " ", uppercase: uppercaseAll, suffix: "=\""},
+	{prefix: " ", uppercase: uppercaseAll, suffix: ", "},
+	{uppercase: uppercaseAll, suffix: ","},
+	{uppercase: uppercaseAll, suffix: "("},
+	{uppercase: uppercaseAll, suffix: ". "},
+	{prefix: " ", uppercase: uppercaseAll, suffix: "."},
+	{uppercase: uppercaseAll, suffix: "='"},
+	{prefix: " ", uppercase: uppercaseAll, suffix: ". "},
+	{prefix: " ", uppercase: uppercaseFirst, suffix: "=\""},
+	{prefix: " ", uppercase: uppercaseAll, suffix: "='"},
+	{prefix: " ", uppercase: uppercaseFirst, suffix: "='"},
+}
+
+// Literal context modes, RFC 7932 section 7.1
+const (
+	contextLSB6 = iota
+	contextMSB6
+	contextUTF8
+	contextSigned
+)
+
+// literalContext returns the context ID of a literal following the bytes
+// p2 and p1, in that order, in the given context mode.
+func literalContext(mode uint8, p1, p2 byte) int {
+	switch mode {
+	case contextLSB6:
+		return int(p1 & 0x3F)
+	case contextMSB6:
+		return int(p1 >> 2)
+	case contextUTF8:
+		return int(utf8ContextLow[p1] | utf8ContextHigh[p2])
+	default:
+		return int(signedContext[p1]<<3 | signedContext[p2])
+	}
+}
+
+// Context lookup tables for the UTF8 and signed context modes, RFC 7932
+// section 7.1. A UTF8 context is utf8ContextLow[p1] | utf8ContextHigh[p2], and a
+// signed context is signedContext[p1]<<3 | signedContext[p2].
+var utf8ContextLow = [256]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 4, 0, 0, 4, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	8, 12, 16, 12, 12, 20, 12, 16, 24, 28, 12, 12, 32, 12, 36, 12,
+	44, 44, 44, 44, 44, 44, 44, 44, 44, 44, 32, 32, 24, 40, 28, 12,
+	12, 48, 52, 52, 52, 48, 52, 52, 52, 48, 52, 52, 52, 52, 52, 48,
+	52, 52, 52, 52, 52, 48, 52, 52, 52, 52, 52, 24, 12, 28, 12, 12,
+	12, 56, 60, 60, 60, 56, 60, 60, 60, 56, 60, 60, 60, 60, 60, 56,
+	60, 60, 60, 60, 60, 56, 60, 60, 60, 60, 60, 24, 12, 28, 12, 0,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+}
+
+var utf8ContextHigh = [256]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1,
+	1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1,
+	1, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 1, 1, 1, 1, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+}
+
+var signedContext = [256]uint8{
+	0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 7,
+}
@@ -0,0 +1,884 @@
+package brotli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	// Decoded data is returned by Read in chunks of at most about this size,
+	// which bounds the memory used beyond the window regardless of how long
+	// a meta-block is
+	chunkSize = 32 << 10
+
+	maxCodeLength          = 15
+	literalAlphabetSize    = 256
+	commandAlphabetSize    = 704
+	blockCountAlphabetSize = 26
+	codeLengthCodes        = 18
+)
+
+var errTrailingData = errors.New("brotli: unexpected data after end of stream")
+
+func corrupt(format string, args ...interface{}) error {
+	return fmt.Errorf("brotli: corrupt input: "+format, args...)
+}
+
+// codeLengthOrder is the order in which the code lengths of the code length
+// alphabet are given, RFC 7932 section 3.5.
+var codeLengthOrder = [codeLengthCodes]uint8{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// lengthCode is the base value and number of extra bits of a symbol
+// representing a block count, insert length or copy length.
+type lengthCode struct {
+	base  int
+	extra uint
+}
+
+// RFC 7932 section 6
+var blockCountCodes = [blockCountAlphabetSize]lengthCode{
+	{1, 2}, {5, 2}, {9, 2}, {13, 2}, {17, 3}, {25, 3}, {33, 3}, {41, 3},
+	{49, 4}, {65, 4}, {81, 4}, {97, 4}, {113, 5}, {145, 5}, {177, 5}, {209, 5},
+	{241, 6}, {305, 6}, {369, 7}, {497, 8}, {753, 9}, {1265, 10}, {2289, 11}, {4337, 12},
+	{8433, 13}, {16625, 24},
+}
+
+// RFC 7932 section 5
+var (
+	insertLengthCodes = [24]lengthCode{
+		{0, 0}, {1, 0}, {2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 1}, {8, 1},
+		{10, 2}, {14, 2}, {18, 3}, {26, 3}, {34, 4}, {50, 4}, {66, 5}, {98, 5},
+		{130, 6}, {194, 7}, {322, 8}, {578, 9}, {1090, 10}, {2114, 12}, {6210, 14}, {22594, 24},
+	}
+	copyLengthCodes = [24]lengthCode{
+		{2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0}, {8, 0}, {9, 0},
+		{10, 1}, {12, 1}, {14, 2}, {18, 2}, {22, 3}, {30, 3}, {38, 4}, {54, 4},
+		{70, 5}, {102, 5}, {134, 6}, {198, 7}, {326, 8}, {582, 9}, {1094, 10}, {2118, 24},
+	}
+
+	// The first insert and copy length codes of each group of 64 command
+	// codes. Commands in the first two groups reuse the last distance.
+	commandInsertCodes = [11]int{0, 0, 0, 0, 8, 8, 0, 16, 8, 16, 16}
+	commandCopyCodes   = [11]int{0, 8, 0, 8, 0, 8, 16, 0, 16, 8, 16}
+)
+
+// Distance codes below 16 refer to one of the last four distances, plus an
+// offset, RFC 7932 section 4.
+var (
+	distanceRingIndex  = [16]int{0, 1, 2, 3, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 1}
+	distanceRingOffset = [16]int{0, 0, 0, 0, -1, 1, -2, 2, -3, 3, -1, 1, -2, 2, -3, 3}
+)
+
+// Reader states
+const (
+	stateMetaBlockHeader = iota
+	stateUncompressed
+	stateCompressed
+	stateDone
+)
+
+// Phases of decoding a command in a compressed meta-block
+const (
+	phaseCommand = iota
+	phaseInsert
+	phaseCopy
+)
+
+// Reader is an io.Reader that decompresses a brotli stream read from an
+// underlying reader.
+type Reader struct {
+	br  bitReader
+	err error
+
+	windowSize int
+	// hist holds the decoded data that copies may still refer to, ending
+	// with the pending bytes not yet returned by Read
+	hist    []byte
+	pending int
+	// total number of bytes decoded
+	pos int64
+	// the last four distances, most recent first
+	dists [4]int
+
+	state int
+	// Per meta-block state
+	last          bool
+	remaining     int
+	literals      blockCategory
+	commands      blockCategory
+	distances     blockCategory
+	contextModes  []uint8
+	literalMap    []uint8
+	distanceMap   []uint8
+	literalCodes  []*prefixCode
+	commandCodes  []*prefixCode
+	distanceCodes []*prefixCode
+	postfix       uint
+	direct        int
+
+	// The command being decoded, which may span calls to Read
+	phase            int
+	insertLeft       int
+	copyLen          int
+	copyLeft         int
+	copyDist         int
+	implicitDistance bool
+
+	// Scratch space for transformed dictionary words
+	word []byte
+}
+
+// NewReader returns a new Reader that decompresses the data read from r. It
+// reads the stream header, and returns an error if it is invalid.
+func NewReader(r io.Reader) (*Reader, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	z := &Reader{
+		br:    bitReader{r: br},
+		dists: [4]int{4, 11, 15, 16},
+	}
+	wbits, err := z.readWindowBits()
+	if err != nil {
+		return nil, err
+	}
+	z.windowSize = 1<<wbits - 16
+	return z, nil
+}
+
+// readWindowBits reads the stream header, RFC 7932 section 9.1.
+func (z *Reader) readWindowBits() (uint, error) {
+	var wbits uint
+	if z.br.readBits(1) == 0 {
+		wbits = 16
+	} else if n := z.br.readBits(3); n != 0 {
+		wbits = 17 + uint(n)
+	} else if n := z.br.readBits(3); n == 1 {
+		return 0, corrupt("invalid window size")
+	} else if n != 0 {
+		wbits = 8 + uint(n)
+	} else {
+		wbits = 17
+	}
+	return wbits, z.br.err
+}
+
+// Read reads decompressed data into p, decoding up to a chunk at a time.
+func (z *Reader) Read(p []byte) (int, error) {
+	for z.pending == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		if z.err = z.step(); z.err != nil {
+			// whatever was decoded alongside an error is not to be trusted
+			z.pending = 0
+		}
+	}
+	n := copy(p, z.hist[len(z.hist)-z.pending:])
+	z.pending -= n
+	return n, nil
+}
+
+// step decodes the next chunk of data, moving on to the next meta-block if
+// the current one is complete.
+func (z *Reader) step() error {
+	z.trimHistory()
+	var err error
+	switch z.state {
+	case stateMetaBlockHeader:
+		err = z.readMetaBlockHeader()
+	case stateUncompressed:
+		for z.remaining > 0 && z.pending < chunkSize {
+			z.emit(byte(z.br.readBits(8)))
+		}
+		if z.remaining == 0 {
+			z.endMetaBlock()
+		}
+	case stateCompressed:
+		err = z.decodeCommands()
+	case stateDone:
+		return z.finish()
+	}
+	if err == nil {
+		err = z.br.err
+	}
+	return err
+}
+
+// trimHistory discards the decoded data that is out of reach of future
+// copies, once it has been returned by Read.
+func (z *Reader) trimHistory() {
+	if z.pending == 0 && len(z.hist) > 2*z.windowSize {
+		n := copy(z.hist, z.hist[len(z.hist)-z.windowSize:])
+		z.hist = z.hist[:n]
+	}
+}
+
+// finish checks that the stream ends cleanly after its last meta-block.
+func (z *Reader) finish() error {
+	if !z.br.alignToByte() {
+		return corrupt("non-zero padding after last meta-block")
+	}
+	if z.br.nbits > 0 {
+		return errTrailingData
+	}
+	if _, err := z.br.r.ReadByte(); err != io.EOF {
+		if err == nil {
+			err = errTrailingData
+		}
+		return err
+	}
+	return io.EOF
+}
+
+// endMetaBlock moves on from a complete meta-block.
+func (z *Reader) endMetaBlock() {
+	if z.last {
+		z.state = stateDone
+	} else {
+		z.state = stateMetaBlockHeader
+	}
+}
+
+// emit appends a decoded byte to the output.
+func (z *Reader) emit(b byte) {
+	z.hist = append(z.hist, b)
+	z.pending++
+	z.pos++
+	z.remaining--
+}
+
+// readMetaBlockHeader reads the header of the next meta-block, RFC 7932
+// section 9.2, skipping over any metadata.
+func (z *Reader) readMetaBlockHeader() error {
+	z.last = z.br.readBits(1) == 1
+	if z.last && z.br.readBits(1) == 1 {
+		// ISLASTEMPTY
+		z.state = stateDone
+		return nil
+	}
+
+	nibbles := uint(z.br.readBits(2))
+	if nibbles == 3 {
+		return z.skipMetadata()
+	}
+	nibbles += 4
+	length := int(z.br.readBits(4 * nibbles))
+	if nibbles > 4 && length>>(4*(nibbles-1)) == 0 {
+		return corrupt("meta-block length has a leading zero nibble")
+	}
+	z.remaining = length + 1
+
+	if !z.last && z.br.readBits(1) == 1 {
+		if !z.br.alignToByte() {
+			return corrupt("non-zero padding before uncompressed meta-block")
+		}
+		z.state = stateUncompressed
+		return nil
+	}
+	if err := z.readCompressedHeader(); err != nil {
+		return err
+	}
+	z.state = stateCompressed
+	z.phase = phaseCommand
+	return nil
+}
+
+// skipMetadata skips over the contents of a metadata meta-block.
+func (z *Reader) skipMetadata() error {
+	if z.br.readBits(1) != 0 {
+		return corrupt("reserved bit is set")
+	}
+	skipBytes := uint(z.br.readBits(2))
+	skipLen := 0
+	if skipBytes > 0 {
+		for i := uint(0); i < skipBytes; i++ {
+			b := int(z.br.readBits(8))
+			if i > 0 && i == skipBytes-1 && b == 0 {
+				return corrupt("metadata length has a leading zero byte")
+			}
+			skipLen |= b << (8 * i)
+		}
+		skipLen++
+	}
+	if !z.br.alignToByte() {
+		return corrupt("non-zero padding before metadata")
+	}
+	for i := 0; i < skipLen && z.br.err == nil; i++ {
+		z.br.readBits(8)
+	}
+	z.endMetaBlock()
+	return nil
+}
+
+// readCompressedHeader reads the rest of the header of a compressed
+// meta-block: the block types and counts, context modes and maps, and
+// prefix codes it uses.
+func (z *Reader) readCompressedHeader() error {
+	for _, c := range []*blockCategory{&z.literals, &z.commands, &z.distances} {
+		if err := z.readBlockCategory(c); err != nil {
+			return err
+		}
+	}
+
+	z.postfix = uint(z.br.readBits(2))
+	z.direct = int(z.br.readBits(4)) << z.postfix
+
+	z.contextModes = grow(z.contextModes, z.literals.types)
+	for i := range z.contextModes {
+		z.contextModes[i] = uint8(z.br.readBits(2))
+	}
+
+	var err error
+	literalTrees := z.readVarLenUint8() + 1
+	if z.literalMap, err = z.readContextMap(64*z.literals.types, literalTrees); err != nil {
+		return err
+	}
+	distanceTrees := z.readVarLenUint8() + 1
+	if z.distanceMap, err = z.readContextMap(4*z.distances.types, distanceTrees); err != nil {
+		return err
+	}
+
+	if z.literalCodes, err = z.readPrefixCodes(literalTrees, literalAlphabetSize); err != nil {
+		return err
+	}
+	if z.commandCodes, err = z.readPrefixCodes(z.commands.types, commandAlphabetSize); err != nil {
+		return err
+	}
+	distanceAlphabetSize := 16 + z.direct + 48<<z.postfix
+	z.distanceCodes, err = z.readPrefixCodes(distanceTrees, distanceAlphabetSize)
+	return err
+}
+
+// readVarLenUint8 reads a number in the range [0, 255], RFC 7932 section
+// 9.2.
+func (z *Reader) readVarLenUint8() int {
+	if z.br.readBits(1) == 0 {
+		return 0
+	}
+	n := uint(z.br.readBits(3))
+	if n == 0 {
+		return 1
+	}
+	return 1<<n + int(z.br.readBits(n))
+}
+
+// blockCategory tracks the block types and counts of one of the literal,
+// command and distance categories, RFC 7932 section 6.
+type blockCategory struct {
+	types     int
+	typeCode  *prefixCode
+	countCode *prefixCode
+	current   int
+	previous  int
+	// the number of symbols left in the current block
+	left int
+}
+
+func (z *Reader) readBlockCategory(c *blockCategory) error {
+	c.types = z.readVarLenUint8() + 1
+	c.current, c.previous = 0, 1
+	if c.types == 1 {
+		// a single block spans the whole meta-block
+		c.left = 1 << 30
+		return nil
+	}
+	var err error
+	if c.typeCode, err = z.readPrefixCode(c.types + 2); err != nil {
+		return err
+	}
+	if c.countCode, err = z.readPrefixCode(blockCountAlphabetSize); err != nil {
+		return err
+	}
+	c.left = z.readBlockCount(c.countCode)
+	return nil
+}
+
+func (z *Reader) readBlockCount(code *prefixCode) int {
+	bc := blockCountCodes[code.decode(&z.br)]
+	return bc.base + int(z.br.readBits(bc.extra))
+}
+
+// nextSymbol accounts for a symbol of the category about to be decoded,
+// switching to the next block if the current one is done, and returns the
+// current block type.
+func (z *Reader) nextSymbol(c *blockCategory) int {
+	if c.left == 0 {
+		t := c.typeCode.decode(&z.br)
+		switch t {
+		case 0:
+			t = c.previous
+		case 1:
+			t = (c.current + 1) % c.types
+		default:
+			t -= 2
+		}
+		c.previous, c.current = c.current, t
+		c.left = z.readBlockCount(c.countCode)
+	}
+	c.left--
+	return c.current
+}
+
+// readContextMap reads a context map of the given size mapping contexts to
+// one of trees prefix codes, RFC 7932 section 7.3.
+func (z *Reader) readContextMap(size, trees int) ([]uint8, error) {
+	m := make([]uint8, size)
+	if trees == 1 {
+		return m, nil
+	}
+
+	rleMax := 0
+	if z.br.readBits(1) == 1 {
+		rleMax = int(z.br.readBits(4)) + 1
+	}
+	code, err := z.readPrefixCode(trees + rleMax)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < size; {
+		switch sym := code.decode(&z.br); {
+		case sym == 0:
+			i++
+		case sym <= rleMax:
+			// a run of zeros, which m already holds
+			i += 1<<uint(sym) + int(z.br.readBits(uint(sym)))
+			if i > size {
+				return nil, corrupt("context map run exceeds its size")
+			}
+		default:
+			m[i] = uint8(sym - rleMax)
+			i++
+		}
+	}
+
+	if z.br.readBits(1) == 1 {
+		// inverse move-to-front transform
+		var mtf [256]uint8
+		for i := range mtf {
+			mtf[i] = uint8(i)
+		}
+		for i, index := range m {
+			value := mtf[index]
+			m[i] = value
+			copy(mtf[1:int(index)+1], mtf[:index])
+			mtf[0] = value
+		}
+	}
+	return m, nil
+}
+
+func (z *Reader) readPrefixCodes(n, alphabetSize int) ([]*prefixCode, error) {
+	codes := make([]*prefixCode, n)
+	for i := range codes {
+		var err error
+		if codes[i], err = z.readPrefixCode(alphabetSize); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// readPrefixCode reads the description of a simple or complex prefix code
+// over an alphabet of the given size, RFC 7932 sections 3.4 and 3.5.
+func (z *Reader) readPrefixCode(alphabetSize int) (*prefixCode, error) {
+	hskip := int(z.br.readBits(2))
+	if hskip == 1 {
+		return z.readSimplePrefixCode(alphabetSize)
+	}
+
+	var codeLengths [codeLengthCodes]uint8
+	space, codes := 32, 0
+	for i := hskip; i < codeLengthCodes && space > 0; i++ {
+		length := z.readCodeLengthCodeLength()
+		codeLengths[codeLengthOrder[i]] = length
+		if length != 0 {
+			space -= 32 >> length
+			codes++
+		}
+	}
+	if codes != 1 && space != 0 {
+		return nil, corrupt("invalid code length code")
+	}
+	codeLengthCode, err := newPrefixCode(codeLengths[:])
+	if err != nil {
+		return nil, err
+	}
+
+	lengths := make([]uint8, alphabetSize)
+	prevLength := uint8(8)
+	repeat, repeatLength := 0, uint8(0)
+	space = 1 << maxCodeLength
+	for sym := 0; sym < alphabetSize && space > 0; {
+		length := uint8(codeLengthCode.decode(&z.br))
+		if length < 16 {
+			repeat = 0
+			lengths[sym] = length
+			sym++
+			if length != 0 {
+				prevLength = length
+				space -= 1 << maxCodeLength >> length
+			}
+			continue
+		}
+
+		// 16 repeats the previous non-zero length and 17 repeats zero,
+		// with consecutive repeats combining into one longer run
+		extraBits, newLength := uint(2), prevLength
+		if length == 17 {
+			extraBits, newLength = 3, 0
+		}
+		if repeatLength != newLength {
+			repeat, repeatLength = 0, newLength
+		}
+		oldRepeat := repeat
+		if repeat > 0 {
+			repeat = (repeat - 2) << extraBits
+		}
+		repeat += int(z.br.readBits(extraBits)) + 3
+		delta := repeat - oldRepeat
+		if sym+delta > alphabetSize {
+			return nil, corrupt("code lengths exceed alphabet size")
+		}
+		for i := 0; i < delta; i++ {
+			lengths[sym] = newLength
+			sym++
+		}
+		if newLength != 0 {
+			space -= delta << maxCodeLength >> newLength
+		}
+	}
+	if space != 0 {
+		return nil, corrupt("invalid prefix code")
+	}
+	return newPrefixCode(lengths)
+}
+
+// readCodeLengthCodeLength reads one of the code lengths of the code length
+// alphabet, which are themselves encoded with a fixed variable length code.
+func (z *Reader) readCodeLengthCodeLength() uint8 {
+	switch z.br.readBits(2) {
+	case 0:
+		return 0
+	case 1:
+		return 4
+	case 2:
+		return 3
+	}
+	if z.br.readBits(1) == 0 {
+		return 2
+	}
+	if z.br.readBits(1) == 0 {
+		return 1
+	}
+	return 5
+}
+
+func (z *Reader) readSimplePrefixCode(alphabetSize int) (*prefixCode, error) {
+	n := int(z.br.readBits(2)) + 1
+	symbolBits := uint(bits.Len(uint(alphabetSize - 1)))
+	var symbols [4]int
+	for i := 0; i < n; i++ {
+		symbols[i] = int(z.br.readBits(symbolBits))
+		if symbols[i] >= alphabetSize {
+			return nil, corrupt("prefix code symbol exceeds alphabet size")
+		}
+		for j := 0; j < i; j++ {
+			if symbols[i] == symbols[j] {
+				return nil, corrupt("duplicate prefix code symbol")
+			}
+		}
+	}
+
+	var codeLengths []uint8
+	switch n {
+	case 1:
+		return &prefixCode{symbols: []uint16{uint16(symbols[0])}}, nil
+	case 2:
+		codeLengths = []uint8{1, 1}
+	case 3:
+		codeLengths = []uint8{1, 2, 2}
+	case 4:
+		if z.br.readBits(1) == 0 {
+			codeLengths = []uint8{2, 2, 2, 2}
+		} else {
+			codeLengths = []uint8{1, 2, 3, 3}
+		}
+	}
+	lengths := make([]uint8, alphabetSize)
+	for i, length := range codeLengths {
+		lengths[symbols[i]] = length
+	}
+	return newPrefixCode(lengths)
+}
+
+// prefixCode is a canonical prefix code, as described by the number of
+// codes of each length and the symbols ordered by code.
+type prefixCode struct {
+	counts  [maxCodeLength + 1]uint16
+	symbols []uint16
+}
+
+// newPrefixCode returns the canonical prefix code with the given code
+// lengths, indexed by symbol, which must describe a complete code unless
+// only one symbol has a non-zero length.
+func newPrefixCode(lengths []uint8) (*prefixCode, error) {
+	c := &prefixCode{}
+	for _, length := range lengths {
+		c.counts[length]++
+	}
+	n := len(lengths) - int(c.counts[0])
+	c.counts[0] = 0
+	if n == 0 {
+		return nil, corrupt("empty prefix code")
+	}
+	if n > 1 {
+		left := 1
+		for length := 1; length <= maxCodeLength; length++ {
+			left = left<<1 - int(c.counts[length])
+			if left < 0 {
+				return nil, corrupt("over-subscribed prefix code")
+			}
+		}
+		if left != 0 {
+			return nil, corrupt("incomplete prefix code")
+		}
+	}
+
+	var offsets [maxCodeLength + 2]int
+	for length := 1; length <= maxCodeLength; length++ {
+		offsets[length+1] = offsets[length] + int(c.counts[length])
+	}
+	c.symbols = make([]uint16, n)
+	for sym, length := range lengths {
+		if length != 0 {
+			c.symbols[offsets[length]] = uint16(sym)
+			offsets[length]++
+		}
+	}
+	return c, nil
+}
+
+// decode reads a symbol one bit at a time. Codes with a single symbol use
+// no bits at all.
+func (c *prefixCode) decode(br *bitReader) int {
+	if len(c.symbols) == 1 {
+		return int(c.symbols[0])
+	}
+	code, first, index := 0, 0, 0
+	for length := 1; length <= maxCodeLength; length++ {
+		code |= int(br.readBits(1))
+		count := int(c.counts[length])
+		if code-first < count {
+			return int(c.symbols[index+code-first])
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	// unreachable, since newPrefixCode only builds complete codes
+	return 0
+}
+
+// decodeCommands decodes the commands of a compressed meta-block, RFC 7932
+// section 9.3, until a chunk of data has been produced or the meta-block is
+// complete.
+func (z *Reader) decodeCommands() error {
+	for z.pending < chunkSize && z.br.err == nil {
+		switch z.phase {
+		case phaseCommand:
+			if z.remaining == 0 {
+				z.endMetaBlock()
+				return nil
+			}
+			if err := z.readCommand(); err != nil {
+				return err
+			}
+			z.phase = phaseInsert
+
+		case phaseInsert:
+			for z.insertLeft > 0 && z.pending < chunkSize {
+				z.insertLiteral()
+				z.insertLeft--
+			}
+			if z.insertLeft > 0 {
+				continue
+			}
+			if z.remaining == 0 {
+				// the copy is ignored when the inserted literals
+				// complete the meta-block
+				z.phase = phaseCommand
+				continue
+			}
+			if err := z.readDistance(); err != nil {
+				return err
+			}
+
+		case phaseCopy:
+			for z.copyLeft > 0 && z.pending < chunkSize {
+				z.emit(z.hist[len(z.hist)-z.copyDist])
+				z.copyLeft--
+			}
+			if z.copyLeft == 0 {
+				z.phase = phaseCommand
+			}
+		}
+	}
+	return nil
+}
+
+// readCommand reads the next insert-and-copy command.
+func (z *Reader) readCommand() error {
+	blockType := z.nextSymbol(&z.commands)
+	cmd := z.commandCodes[blockType].decode(&z.br)
+	group := cmd >> 6
+	insert := insertLengthCodes[commandInsertCodes[group]+cmd>>3&7]
+	cp := copyLengthCodes[commandCopyCodes[group]+cmd&7]
+	z.insertLeft = insert.base + int(z.br.readBits(insert.extra))
+	z.copyLen = cp.base + int(z.br.readBits(cp.extra))
+	z.implicitDistance = group < 2
+	if z.insertLeft > z.remaining {
+		return corrupt("insert length exceeds meta-block length")
+	}
+	return nil
+}
+
+func (z *Reader) insertLiteral() {
+	var p1, p2 byte
+	if n := len(z.hist); n > 1 {
+		p1, p2 = z.hist[n-1], z.hist[n-2]
+	} else if n == 1 {
+		p1 = z.hist[0]
+	}
+	blockType := z.nextSymbol(&z.literals)
+	context := literalContext(z.contextModes[blockType], p1, p2)
+	tree := z.literalMap[64*blockType+context]
+	z.emit(byte(z.literalCodes[tree].decode(&z.br)))
+}
+
+// readDistance reads the distance of the current command's copy, setting up
+// the copy or, for references beyond the window, copying the dictionary
+// word referred to.
+func (z *Reader) readDistance() error {
+	dist, push := z.dists[0], false
+	if !z.implicitDistance {
+		context := z.copyLen - 2
+		if context > 3 {
+			context = 3
+		}
+		blockType := z.nextSymbol(&z.distances)
+		tree := z.distanceMap[4*blockType+context]
+		dist, push = z.distance(z.distanceCodes[tree].decode(&z.br))
+		if dist <= 0 {
+			return corrupt("invalid distance")
+		}
+	}
+
+	maxDist := z.windowSize
+	if int64(maxDist) > z.pos {
+		maxDist = int(z.pos)
+	}
+	if dist > maxDist {
+		return z.copyDictionaryWord(dist - maxDist - 1)
+	}
+	if z.copyLen > z.remaining {
+		return corrupt("copy length exceeds meta-block length")
+	}
+	if push {
+		z.dists = [4]int{dist, z.dists[0], z.dists[1], z.dists[2]}
+	}
+	z.copyDist, z.copyLeft = dist, z.copyLen
+	z.phase = phaseCopy
+	return nil
+}
+
+// distance returns the distance that code stands for, reading any extra
+// bits it has, and whether it must be remembered as the last distance.
+func (z *Reader) distance(code int) (int, bool) {
+	switch {
+	case code < 16:
+		return z.dists[distanceRingIndex[code]] + distanceRingOffset[code], code != 0
+	case code < 16+z.direct:
+		return code - 15, true
+	}
+	code -= 16 + z.direct
+	extraBits := 1 + uint(code>>(z.postfix+1))
+	offset := (2+code>>z.postfix&1)<<extraBits - 4
+	extra := int(z.br.readBits(extraBits))
+	return (offset+extra)<<z.postfix + code&(1<<z.postfix-1) + z.direct + 1, true
+}
+
+// copyDictionaryWord emits the transformed dictionary word with the given ID
+// and the current command's copy length, RFC 7932 section 8.
+func (z *Reader) copyDictionaryWord(id int) error {
+	length := z.copyLen
+	if length < 4 || length >= len(dictionarySizeBits) {
+		return corrupt("invalid distance")
+	}
+	sizeBits := dictionarySizeBits[length]
+	index, t := id&(1<<sizeBits-1), id>>sizeBits
+	if t >= len(transforms) {
+		return corrupt("invalid dictionary word transform")
+	}
+	start := dictionaryOffsets[length] + index*length
+	z.word = transforms[t].apply(z.word[:0], dictionary[start:start+length])
+	if len(z.word) > z.remaining {
+		return corrupt("copy length exceeds meta-block length")
+	}
+	for _, b := range z.word {
+		z.emit(b)
+	}
+	z.phase = phaseCommand
+	return nil
+}
+
+// bitReader reads the bits of a brotli stream, least significant bit of
+// each byte first. Reading past the end of the input yields zero bits and
+// records io.ErrUnexpectedEOF, so that callers need only check for errors
+// at convenient points.
+type bitReader struct {
+	r     io.ByteReader
+	bits  uint64
+	nbits uint
+	err   error
+}
+
+// readBits reads n bits, at most 32, as a little-endian number.
+func (br *bitReader) readBits(n uint) uint32 {
+	for br.nbits < n {
+		b, err := br.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if br.err == nil {
+				br.err = err
+			}
+			b = 0
+		}
+		br.bits |= uint64(b) << br.nbits
+		br.nbits += 8
+	}
+	v := uint32(br.bits & (1<<n - 1))
+	br.bits >>= n
+	br.nbits -= n
+	return v
+}
+
+// alignToByte skips to the next byte boundary, reporting whether the bits
+// skipped were all zero.
+func (br *bitReader) alignToByte() bool {
+	return br.readBits(br.nbits%8) == 0
+}
+
+// grow returns b resized to n, reusing its storage if possible.
+func grow(b []uint8, n int) []uint8 {
+	if cap(b) >= n {
+		return b[:n]
+	}
+	return make([]uint8, n)
+}
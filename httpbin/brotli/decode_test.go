@@ -0,0 +1,245 @@
+package brotli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func decompress(t *testing.T, stream []byte) []byte {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// lcg returns a generator of pseudo-random numbers that is simple enough to
+// reproduce when generating test vectors with other tools.
+func lcg() func() uint32 {
+	x := uint32(1)
+	return func() uint32 {
+		x = x*1103515245 + 12345
+		return x >> 16
+	}
+}
+
+// prose returns n bytes of text made of words from the static dictionary,
+// which compresses to dictionary references and context modeled literals.
+func prose(n int) []byte {
+	words := []string{"the", "time", "people", "World", "information", "of", "and", "THE", "home", "page", "search", "free", "with", "about", "Contact", "business", "online", "should", "available"}
+	seps := []string{" ", " ", " ", ", ", ". ", "\n"}
+	next := lcg()
+	var b strings.Builder
+	for b.Len() < n {
+		b.WriteString(words[next()%uint32(len(words))])
+		b.WriteString(seps[next()%uint32(len(seps))])
+	}
+	return []byte(b.String()[:n])
+}
+
+// bases returns n pseudo-random letters from a four letter alphabet.
+func bases(n int) []byte {
+	b := make([]byte, n)
+	next := lcg()
+	for i := range b {
+		b[i] = "acgt"[next()&3]
+	}
+	return b
+}
+
+// noise returns n pseudo-random bytes, which do not compress.
+func noise(n int) []byte {
+	b := make([]byte, n)
+	next := lcg()
+	for i := range b {
+		b[i] = byte(next())
+	}
+	return b
+}
+
+func TestDictionary(t *testing.T) {
+	t.Parallel()
+	// RFC 7932 appendix A
+	const want = "20e42eb1b511c21806d4d227d07e5dd06877d8ce7b3a817f378f313653f35c70"
+	if sum := sha256.Sum256(dictionary); hex.EncodeToString(sum[:]) != want {
+		t.Fatalf("expected dictionary SHA-256 %s, got %x", want, sum)
+	}
+	if n := dictionaryOffsets[24] + 24<<dictionarySizeBits[24]; n != len(dictionary) {
+		t.Fatalf("expected word offsets to span %d bytes, got %d", len(dictionary), n)
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		id   int
+		word string
+		want string
+	}{
+		{0, "time", "time"},
+		{3, "time", "ime"},
+		{9, "time", "Time"},
+		{15, "time", " Time "},
+		{44, "time", "TIME"},
+		{49, "time", "timing "},
+		{54, "time", ""},
+		{73, "time", " the time of the "},
+		{9, "élan", "Élan"},
+		{44, "élan", "ÉLAN"},
+	} {
+		if got := string(transforms[tc.id].apply(nil, []byte(tc.word))); got != tc.want {
+			t.Errorf("transform %d of %q: expected %q, got %q", tc.id, tc.word, tc.want, got)
+		}
+	}
+}
+
+// The streams were produced by the reference implementation, with the
+// quality and window size given.
+func TestReaderGolden(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name   string
+		input  []byte
+		stream string
+	}{
+		{
+			"empty, -q 11",
+			nil,
+			"3b",
+		},
+		{
+			"dictionary words, -q 11",
+			prose(300),
+			"1b2b01009c0776ac0fbcd906c663124ce43ca1e6ed4acf30aab72a422a333728b781212553fe1b13362c66b3a558d4a66ef3e9e8b16351bad5254274a2e9be42c2fdc78c4f4983b540caedb5e5acf491224319931b96c6fdf20686754bac6f0594db107164813d885e44fa7902b66f69b224018c83995db0f7e55323b9359e01",
+		},
+		{
+			"context modeling, -q 11",
+			prose(1200),
+			"1baf04002c0e6c1b46f6d9ae85f1b087c144ce136afea5f47ea3a30a5b454865e6566869662d3783302fa4cfee25df1a0a341685aac9d1254e60537df682c1ab03a92b1f8504f75f16cc27571ad8af8112bdce26aeab8fb8936133676e64b1dc396f6cadbddf128bae43b0adc9a05e8e7a812d88bc2252eba9c9f6d3d56481842dcc815d2458c787ffd048908a3d1d5c0fb0857a9713a06ac256ec50ece93d62231c8628ead973cfe648c59d8719fe9005f5250958da71021ecd2dbe353c992208a44caf11907bc12ecf5c627807d3af18b1949e872d3edeb6702dd875fe71358026ad79f1b013a498628418e4033b9d53449dd40333aa2d8e8cd6a164e80d7303697b8333051a1e0f598090175055c11275a89c102e7fe2f3d5d0c11eb7318240453caef214002b3b3a59fb27b569d192d45d47452e1e6713354d812d64be748409bcbba34f9aca9e51638b1e1eae7a78a8caadd42a7e1e849ad405",
+		},
+		{
+			"uncompressed meta-block, -q 11",
+			noise(200),
+			"8b6380c67e816b4bfbe2fb54f6bddf7c1ce18701bf31de56720f4767668759aa883c59ea56137bd285a1d83c54552f37ae655bda027998cce31a768e5fd9998f1f3f36ee43784d0dfabea6dae4868edc296d4eff56e17020fb8fb1580590c509dc53cdaa3b489952d3529d069feab5c206139849b2011eac3288319c52469571368f57f6391d16fa8874f5987c175c41bb6d718e0f7059c7011b2f333d91c01da50d0dab338d7e5e8f3ee66874a63ab1c39311a864c7dbcae060e1f3bf090067a2e325a0213187d562c5a803",
+		},
+		{
+			"small window, -q 9 -w 10",
+			bases(600),
+			"a1b81200201d36764607feffbbd839d10a061880fe7b67a1f72799ac6c305d00495dc9041d03c19d725ddb24e9db7fe5dfe4e3e0e256e19f81fb9d72ff7ebe85d3dae23a62d58edaf5399745fcbfc88d1bfe1a783442a8a86319d60766604dee1e9b80432969b215801ab6f05cc89a3d220621928e02dc9b1919aff7d3459bc007c8d9999eadc4e4453af105f8976c872d752d6c5397ded53a654f010951917bf2820c5297c19c8dbf84241d24d6fa43733c504d08460d6db5be3b0ca44b6605115538b0c93849601c28707034944ee6dc7fa34e8f55317360f8e3a06b61fda8a40764fc90ca1c1c80e0521409c201",
+		},
+		{
+			"large window, -q 5 -w 24",
+			prose(200),
+			"1fc7000004ca6d7d251dfd596903e98662706a9a4150e7b61172621ce776b014b3a159d4466a426d13c1d5e5c1be9368583cd5a2523c4660af56ce23ae2469a3dcae5d54d25bf07f0a0b1e8a86b141e9ec971bf2e78e35376f440def40851fa018a951da25f39fb701",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			stream, err := hex.DecodeString(tc.stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := decompress(t, stream); !bytes.Equal(got, tc.input) {
+				t.Fatalf("expected %q, got %q", tc.input, got)
+			}
+		})
+	}
+}
+
+// TestReaderWithBrotliCLI decodes streams produced by the reference
+// implementation's command line tool at a range of qualities and window
+// sizes, when it is installed.
+func TestReaderWithBrotliCLI(t *testing.T) {
+	t.Parallel()
+	path, err := exec.LookPath("brotli")
+	if err != nil {
+		t.Skip("brotli command line tool not installed")
+	}
+
+	// Large enough for several meta-blocks, and for copies to reach beyond
+	// the smaller windows
+	input := append(prose(300000), bases(200000)...)
+	input = append(input, noise(100000)...)
+	for _, args := range [][]string{
+		{"-q", "0"},
+		{"-q", "2"},
+		{"-q", "5"},
+		{"-q", "9"},
+		{"-q", "11"},
+		{"-q", "11", "-w", "10"},
+		{"-q", "9", "-w", "24"},
+	} {
+		args := args
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			t.Parallel()
+			cmd := exec.Command(path, append(args, "-c")...)
+			cmd.Stdin = bytes.NewReader(input)
+			stream, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("brotli failed: %s", err)
+			}
+			if got := decompress(t, stream); !bytes.Equal(got, input) {
+				t.Fatalf("decoded %d bytes that do not match input", len(got))
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	t.Parallel()
+	valid, _ := hex.DecodeString("1b2b01009c0776ac0fbcd906c663124ce43ca1e6ed4acf30aab72a422a333728b781212553fe1b13362c66b3a558d4a66ef3e9e8b16351bad5254274a2e9be42c2fdc78c4f4983b540caedb5e5acf491224319931b96c6fdf20686754bac6f0594db107164813d885e44fa7902b66f69b224018c83995db0f7e55323b9359e01")
+
+	for _, tc := range []struct {
+		name    string
+		input   []byte
+		wantErr string
+	}{
+		{"empty", nil, "unexpected EOF"},
+		{"invalid window size", []byte{0x11}, "invalid window size"},
+		{"truncated", valid[:len(valid)/2], "unexpected EOF"},
+		{"trailing data", append(valid[:len(valid):len(valid)], 0), "unexpected data after end of stream"},
+		{"non-zero padding", []byte{0xbb}, "non-zero padding"},
+		{"leading zero nibble", []byte{0x04, 0x00, 0x00}, "leading zero nibble"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			r, err := NewReader(bytes.NewReader(tc.input))
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %q", tc.wantErr, err)
+			}
+		})
+	}
+
+	// Corrupt streams may decode to garbage without an error, since brotli
+	// has no checksum, but must never cause a panic
+	t.Run("corrupt streams", func(t *testing.T) {
+		t.Parallel()
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 2000; i++ {
+			corrupt := append([]byte(nil), valid...)
+			corrupt[rng.Intn(len(corrupt))] ^= byte(1 << uint(rng.Intn(8)))
+			if r, err := NewReader(bytes.NewReader(corrupt)); err == nil {
+				io.Copy(io.Discard, r)
+			}
+		}
+	})
+}
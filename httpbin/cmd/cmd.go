@@ -3,6 +3,7 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -17,6 +18,7 @@ import (
 	"time"
 
 	"github.com/mccutchen/go-httpbin/v2/httpbin"
+	"github.com/mccutchen/go-httpbin/v2/httpbin/httpbintest"
 )
 
 const (
@@ -65,28 +67,45 @@ func mainImpl(args []string, getEnv func(string) string, getHostname func() (str
 		return 1
 	}
 
-	opts := []httpbin.OptionFunc{
-		httpbin.WithMaxBodySize(cfg.MaxBodySize),
-		httpbin.WithMaxDuration(cfg.MaxDuration),
-		httpbin.WithObserver(httpbin.StdLogObserver(logger)),
+	if cfg.VerifyURL != "" {
+		return verify(cfg.VerifyURL, out)
 	}
-	if cfg.RealHostname != "" {
-		opts = append(opts, httpbin.WithHostname(cfg.RealHostname))
+
+	app, err := newApp(cfg, logger)
+	if err != nil {
+		fmt.Fprintf(out, "error: %s\n", err)
+		return 1
 	}
-	if len(cfg.AllowedRedirectDomains) > 0 {
-		opts = append(opts, httpbin.WithAllowedRedirectDomains(cfg.AllowedRedirectDomains))
+
+	if cfg.PrintConfig {
+		b, _ := json.MarshalIndent(cfg.fileConfig(), "", "  ")
+		fmt.Fprintf(out, "%s\n", b)
+		return 0
 	}
-	app := httpbin.New(opts...)
 
 	srv := &http.Server{
 		Addr:              net.JoinHostPort(cfg.ListenHost, strconv.Itoa(cfg.ListenPort)),
 		Handler:           app.Handler(),
+		ConnContext:       app.ConnContext,
 		MaxHeaderBytes:    srvMaxHeaderBytes,
 		ReadHeaderTimeout: srvReadHeaderTimeout,
 		ReadTimeout:       srvReadTimeout,
 	}
+	// The request line counts towards MaxHeaderBytes, so make room for URLs
+	// up to the configured limit, which then decides how long URLs are
+	// handled rather than the server's bare 431 response.
+	if cfg.MaxURLLength > 0 {
+		srv.MaxHeaderBytes += cfg.MaxURLLength
+	}
+	if cfg.usesClientCerts() {
+		srv.TLSConfig = app.TLSConfig()
+	}
+	disableGeneralOptionsHandler(srv)
 
-	if err := listenAndServeGracefully(srv, cfg, logger); err != nil {
+	err = listenAndServeGracefully(srv, cfg, logger)
+	// Deliver any request logs still queued by an asynchronous observer
+	app.Close()
+	if err != nil {
 		logger.Printf("error: %s", err)
 		return 1
 	}
@@ -94,6 +113,32 @@ func mainImpl(args []string, getEnv func(string) string, getHostname func() (str
 	return 0
 }
 
+// newApp creates the httpbin instance described by cfg, reporting invalid
+// options as errors rather than panicking.
+func newApp(cfg *config, logger *log.Logger) (*httpbin.HTTPBin, error) {
+	opts := []httpbin.OptionFunc{
+		httpbin.WithMaxBodySize(cfg.MaxBodySize),
+		httpbin.WithMaxDuration(cfg.MaxDuration),
+		httpbin.WithObserver(httpbin.StdLogObserver(logger)),
+	}
+	if cfg.RealHostname != "" {
+		opts = append(opts, httpbin.WithHostname(cfg.RealHostname))
+	}
+	if len(cfg.AllowedRedirectDomains) > 0 {
+		opts = append(opts, httpbin.WithAllowedRedirectDomains(cfg.AllowedRedirectDomains))
+	}
+	fileOpts, err := cfg.options()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	opts = append(opts, fileOpts...)
+	// Method policies are the only options New validates
+	if err := httpbin.Validate(opts...); err != nil {
+		return nil, fmt.Errorf("invalid configuration: method_policies: %w", err)
+	}
+	return httpbin.New(opts...), nil
+}
+
 // config holds the configuration needed to initialize and run go-httpbin as a
 // standalone server.
 type config struct {
@@ -105,9 +150,15 @@ type config struct {
 	RealHostname           string
 	TLSCertFile            string
 	TLSKeyFile             string
+	VerifyURL              string
+	PrintConfig            bool
+
+	// options that may only be given in a configuration file
+	optionsConfig
 
 	// temporary placeholders for arguments that need extra processing
 	rawAllowedRedirectDomains string
+	rawConfigFile             string
 	rawUseRealHostname        bool
 }
 
@@ -126,8 +177,10 @@ func (e ConfigError) Error() string {
 	return e.Err.Error()
 }
 
-// loadConfig parses command line arguments and env vars into a fully resolved
-// Config struct. Command line arguments take precedence over env vars.
+// loadConfig parses command line arguments, env vars, and the optional
+// configuration file into a fully resolved Config struct. Command line
+// arguments take precedence over env vars, which take precedence over the
+// configuration file.
 func loadConfig(args []string, getEnv func(string) string, getHostname func() (string, error)) (*config, error) {
 	cfg := &config{}
 
@@ -140,6 +193,9 @@ func loadConfig(args []string, getEnv func(string) string, getHostname func() (s
 	fs.StringVar(&cfg.ListenHost, "host", defaultListenHost, "Host to listen on")
 	fs.StringVar(&cfg.TLSCertFile, "https-cert-file", "", "HTTPS Server certificate file")
 	fs.StringVar(&cfg.TLSKeyFile, "https-key-file", "", "HTTPS Server private key file")
+	fs.StringVar(&cfg.VerifyURL, "verify", "", "Smoke test the go-httpbin instance at this base URL and exit, instead of starting a server")
+	fs.StringVar(&cfg.rawConfigFile, "config", "", "JSON configuration file, which may set any option (see -print-config for its format)")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "Print the effective configuration in the format of a configuration file and exit")
 
 	// in order to fully control error output whether CLI arguments or env vars
 	// are used to configure the app, we need to take control away from the
@@ -170,6 +226,45 @@ func loadConfig(args []string, getEnv func(string) string, getHostname func() (s
 
 	var err error
 
+	// Settings in the configuration file apply unless overridden by a
+	// command line flag or an environment var
+	if cfg.rawConfigFile != "" {
+		fc, err := loadConfigFile(cfg.rawConfigFile)
+		if err != nil {
+			return nil, configErr("invalid config file %s", err)
+		}
+		setFlags := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+		fromFile := func(flagName, envName string) bool {
+			return !setFlags[flagName] && getEnv(envName) == ""
+		}
+		if fc.Host != "" && fromFile("host", "HOST") {
+			cfg.ListenHost = fc.Host
+		}
+		if fc.Port != 0 && fromFile("port", "PORT") {
+			cfg.ListenPort = fc.Port
+		}
+		if fc.HTTPSCertFile != "" && fromFile("https-cert-file", "HTTPS_CERT_FILE") {
+			cfg.TLSCertFile = fc.HTTPSCertFile
+		}
+		if fc.HTTPSKeyFile != "" && fromFile("https-key-file", "HTTPS_KEY_FILE") {
+			cfg.TLSKeyFile = fc.HTTPSKeyFile
+		}
+		if fc.MaxBodySize != 0 && fromFile("max-body-size", "MAX_BODY_SIZE") {
+			cfg.MaxBodySize = fc.MaxBodySize
+		}
+		if fc.MaxDuration != 0 && fromFile("max-duration", "MAX_DURATION") {
+			cfg.MaxDuration = time.Duration(fc.MaxDuration)
+		}
+		if fc.UseRealHostname && fromFile("use-real-hostname", "USE_REAL_HOSTNAME") {
+			cfg.rawUseRealHostname = true
+		}
+		if len(fc.AllowedRedirectDomains) > 0 && fromFile("allowed-redirect-domains", "ALLOWED_REDIRECT_DOMAINS") {
+			cfg.rawAllowedRedirectDomains = strings.Join(fc.AllowedRedirectDomains, ",")
+		}
+		cfg.optionsConfig = fc.optionsConfig
+	}
+
 	// Command line flags take precedence over environment vars, so we only
 	// check for environment vars if we have default values for our command
 	// line flags.
@@ -207,6 +302,9 @@ func loadConfig(args []string, getEnv func(string) string, getHostname func() (s
 			return nil, configErr("https cert and key must both be provided")
 		}
 	}
+	if cfg.usesClientCerts() && cfg.TLSCertFile == "" {
+		return nil, configErr("client_ca_file and mtls_required require an https cert and key")
+	}
 
 	// useRealHostname will be true if either the `-use-real-hostname`
 	// arg is given on the command line or if the USE_REAL_HOSTNAME env var
@@ -226,17 +324,58 @@ func loadConfig(args []string, getEnv func(string) string, getHostname func() (s
 		cfg.rawAllowedRedirectDomains = getEnv("ALLOWED_REDIRECT_DOMAINS")
 	}
 	for _, domain := range strings.Split(cfg.rawAllowedRedirectDomains, ",") {
-		if strings.TrimSpace(domain) != "" {
-			cfg.AllowedRedirectDomains = append(cfg.AllowedRedirectDomains, strings.TrimSpace(domain))
+		if domain = strings.TrimSpace(domain); domain != "" {
+			if err := httpbin.ValidateRedirectDomain(domain); err != nil {
+				return nil, err
+			}
+			cfg.AllowedRedirectDomains = append(cfg.AllowedRedirectDomains, domain)
 		}
 	}
 
 	// reset temporary fields to their zero values
 	cfg.rawAllowedRedirectDomains = ""
+	cfg.rawConfigFile = ""
 	cfg.rawUseRealHostname = false
 	return cfg, nil
 }
 
+// verify smoke tests the remote go-httpbin instance at baseURL, printing the
+// result for each endpoint, and returns the exit code.
+func verify(baseURL string, out io.Writer) int {
+	results, err := httpbintest.VerifyAll(context.Background(), baseURL)
+	if err != nil {
+		fmt.Fprintf(out, "error: %s\n", err)
+		return 1
+	}
+
+	var passed, skipped, failed int
+	for _, result := range results {
+		outcome := "PASS"
+		switch {
+		case result.Skipped:
+			outcome = "SKIP"
+			skipped++
+		case result.Failed():
+			outcome = "FAIL"
+			failed++
+		default:
+			passed++
+		}
+		fmt.Fprintf(out, "%s %s %s", outcome, result.Method, result.URL)
+		if result.Err != nil {
+			fmt.Fprintf(out, " error: %s\n", result.Err)
+			continue
+		}
+		fmt.Fprintf(out, " status=%d expected=%d duration=%s\n", result.Status, result.ExpectedStatus, result.Duration.Round(time.Microsecond))
+	}
+	fmt.Fprintf(out, "%d passed, %d skipped, %d failed\n", passed, skipped, failed)
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
 func listenAndServeGracefully(srv *http.Server, cfg *config, logger *log.Logger) error {
 	doneCh := make(chan error, 1)
 
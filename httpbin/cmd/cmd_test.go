@@ -2,10 +2,17 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,6 +24,8 @@ import (
 const usage = `Usage of go-httpbin:
   -allowed-redirect-domains string
     	Comma-separated list of domains the /redirect-to endpoint will allow
+  -config string
+    	JSON configuration file, which may set any option (see -print-config for its format)
   -host string
     	Host to listen on (default "0.0.0.0")
   -https-cert-file string
@@ -29,8 +38,12 @@ const usage = `Usage of go-httpbin:
     	Maximum duration a response may take (default 10s)
   -port int
     	Port to listen on (default 8080)
+  -print-config
+    	Print the effective configuration in the format of a configuration file and exit
   -use-real-hostname
     	Expose value of os.Hostname() in the /hostname endpoint instead of dummy value
+  -verify string
+    	Smoke test the go-httpbin instance at this base URL and exit, instead of starting a server
 `
 
 func TestLoadConfig(t *testing.T) {
@@ -66,6 +79,18 @@ func TestLoadConfig(t *testing.T) {
 			wantErr: flag.ErrHelp,
 		},
 
+		// verify
+		"ok -verify": {
+			args: []string{"-verify", "https://httpbin.example.com/prefix"},
+			wantCfg: &config{
+				ListenHost:  "0.0.0.0",
+				ListenPort:  8080,
+				MaxBodySize: httpbin.DefaultMaxBodySize,
+				MaxDuration: httpbin.DefaultMaxDuration,
+				VerifyURL:   "https://httpbin.example.com/prefix",
+			},
+		},
+
 		// max body size
 		"invalid -max-body-size": {
 			args:    []string{"-max-body-size", "foo"},
@@ -385,6 +410,20 @@ func TestLoadConfig(t *testing.T) {
 				AllowedRedirectDomains: []string{"foo.cli", "bar.cli"},
 			},
 		},
+		"ok allowed redirect domain patterns": {
+			args: []string{"-allowed-redirect-domains", "*.example.com,.example.org,example.net:8443"},
+			wantCfg: &config{
+				ListenHost:             "0.0.0.0",
+				ListenPort:             8080,
+				MaxBodySize:            httpbin.DefaultMaxBodySize,
+				MaxDuration:            httpbin.DefaultMaxDuration,
+				AllowedRedirectDomains: []string{"*.example.com", ".example.org", "example.net:8443"},
+			},
+		},
+		"err allowed redirect domain wildcard": {
+			args:    []string{"-allowed-redirect-domains", "example.com,*"},
+			wantErr: errors.New(`invalid redirect domain "*": must name a host`),
+		},
 		"ok allowed redirect domains are normalized": {
 			args: []string{"-allowed-redirect-domains", "foo, bar  ,, baz   "},
 			wantCfg: &config{
@@ -461,6 +500,11 @@ func TestMainImpl(t *testing.T) {
 			wantCode: 1,
 			wantOut:  "go-httpbin listening on http://0.0.0.0:-256\nerror: listen tcp: address -256: invalid port\n",
 		},
+		"verify error": {
+			args:     []string{"-verify", "ftp://example.com"},
+			wantCode: 1,
+			wantOut:  "error: invalid base URL \"ftp://example.com\": must be an absolute http or https URL\n",
+		},
 		"tls cert error": {
 			args: []string{
 				"-port", "0",
@@ -496,3 +540,315 @@ func TestMainImpl(t *testing.T) {
 		})
 	}
 }
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(httpbin.New())
+	defer srv.Close()
+
+	buf := &bytes.Buffer{}
+	gotCode := mainImpl([]string{"-verify", srv.URL}, func(string) string { return "" }, os.Hostname, buf)
+	out := buf.String()
+	if gotCode != 0 {
+		t.Fatalf("expected return code 0, got %d; output:\n%s", gotCode, out)
+	}
+	for _, want := range []string{
+		"PASS GET " + srv.URL + "/get status=200 expected=200 duration=",
+		"SKIP POST " + srv.URL + "/sign?target=/get status=405 expected=200 duration=",
+		" passed, 1 skipped, 0 failed\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+// writeConfigFile writes a configuration file to a temporary directory and
+// returns its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "httpbin.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	t.Parallel()
+
+	t.Run("precedence", func(t *testing.T) {
+		t.Parallel()
+		path := writeConfigFile(t, `{"port": 9000, "host": "127.0.0.1", "max_duration": "3s", "server_timing": true}`)
+		for _, tc := range []struct {
+			name     string
+			args     []string
+			env      map[string]string
+			wantPort int
+		}{
+			{"file overrides defaults", nil, nil, 9000},
+			{"env overrides file", nil, map[string]string{"PORT": "9001"}, 9001},
+			{"flag overrides env and file", []string{"-port", "9002"}, map[string]string{"PORT": "9001"}, 9002},
+			{"flag set to default overrides file", []string{"-port", "8080"}, nil, 8080},
+		} {
+			args := append([]string{"-config", path}, tc.args...)
+			cfg, err := loadConfig(args, func(key string) string { return tc.env[key] }, os.Hostname)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", tc.name, err)
+			}
+			if cfg.ListenPort != tc.wantPort {
+				t.Errorf("%s: expected port %d, got %d", tc.name, tc.wantPort, cfg.ListenPort)
+			}
+			if cfg.ListenHost != "127.0.0.1" || cfg.MaxDuration != 3*time.Second || !cfg.ServerTiming {
+				t.Errorf("%s: expected other settings from file, got %#v", tc.name, cfg)
+			}
+		}
+	})
+
+	t.Run("errors give line numbers", func(t *testing.T) {
+		t.Parallel()
+		for _, tc := range []struct {
+			contents string
+			wantErr  string
+		}{
+			{"{\n  \"port\": 9000,\n  \"prot\": 9000\n}", `:3: unknown key "prot"`},
+			{"{\n  \"default_params\": {\n    \"drip_delay\": \"1s\",\n    \"drip_dealy\": \"1s\"\n  }\n}", `:4: unknown key "default_params.drip_dealy"`},
+			{"{\n  \"port\": \"9000\"\n}", ":2: port must be an integer"},
+			{"{\n  \"max_duration\": \"10 seconds\"\n}", `:2: max_duration: invalid duration "10 seconds"`},
+			{"{\n  \"method_policies\": {\"/get\": [\"GET\", 1]}\n}", ":2: method_policies./get[1] must be a string"},
+			{"{\n  \"server_timing\": \"yes\"\n}", ":2: server_timing must be true or false"},
+			{"{\n  \"port\": 9000,,\n}", ":2: invalid character ',' looking for beginning of value"},
+			{"[]", ":1: configuration must be an object"},
+			{"{} {}", ":1: unexpected data after the top-level object"},
+		} {
+			path := writeConfigFile(t, tc.contents)
+			_, err := loadConfig([]string{"-config", path}, func(string) string { return "" }, os.Hostname)
+			if err == nil {
+				t.Fatalf("expected error for %q", tc.contents)
+			}
+			if want := "invalid config file " + path + tc.wantErr; err.Error() != want {
+				t.Errorf("incorrect error for %q\nwant: %q\ngot:  %q", tc.contents, want, err)
+			}
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+		serverHeader, poweredBy := "nginx", ""
+		dripDuration, dripDelay, dripNumBytes := duration(time.Second), duration(0), int64(5)
+		want := &fileConfig{
+			Host:                   "127.0.0.1",
+			Port:                   9000,
+			HTTPSCertFile:          "server.crt",
+			HTTPSKeyFile:           "server.key",
+			MaxBodySize:            2048,
+			MaxDuration:            duration(3 * time.Second),
+			UseRealHostname:        true,
+			AllowedRedirectDomains: []string{"example.com", "example.org"},
+			optionsConfig: optionsConfig{
+				DefaultParams: defaultParamsConfig{
+					DripDuration: &dripDuration,
+					DripDelay:    &dripDelay,
+					DripNumBytes: &dripNumBytes,
+				},
+				MaxEgressConcurrency:    3,
+				SignedURLKey:            "signing-key",
+				SignedURLMaxSkew:        duration(time.Minute),
+				DigestNonceKey:          "nonce-key",
+				CanonicalBaseURL:        "https://httpbin.example.com/prefix",
+				SelfTestToken:           "selftest-token",
+				AdminToken:              "admin-token",
+				ServerTiming:            true,
+				LoadSignals:             true,
+				ErrorClassHeader:        true,
+				RequestTiming:           true,
+				TraceDecision:           true,
+				FeatureFlags:            map[string]bool{"server-timing": false},
+				ServerHeader:            &serverHeader,
+				PoweredByHeader:         &poweredBy,
+				MaxReflectedHeaderBytes: 512,
+				MethodPolicies:          map[string][]string{"/get": {"GET"}},
+				ClientCAFile:            "ca.pem",
+				MTLSRequired:            []string{"/admin/"},
+				OIDCIssuer:              "https://httpbin.example.com",
+				ExcludedTags:            []string{"destructive"},
+				AddressFamilyDelays:     map[string]duration{"ipv4": duration(200 * time.Millisecond)},
+				AsyncObserverBuffer:     64,
+				PrometheusMetrics:       true,
+				CanonicalJSON:           true,
+				MaxURLLength:            8192,
+				EnvPrefixes:             []string{"HTTPBIN_"},
+			},
+		}
+		assertAllFieldsSet(t, reflect.ValueOf(*want), "fileConfig")
+
+		b, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadConfig([]string{"-config", writeConfigFile(t, string(b))}, func(string) string { return "" }, func() (string, error) { return "real-hostname", nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cfg.fileConfig(); !reflect.DeepEqual(got, want) {
+			gotJSON, _ := json.Marshal(got)
+			t.Fatalf("round trip mismatch\nwant: %s\ngot:  %s", b, gotJSON)
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		t.Parallel()
+		for _, tc := range []struct {
+			contents string
+			wantErr  string
+		}{
+			{`{"canonical_base_url": "/relative"}`, `invalid configuration: canonical_base_url "/relative" must be an absolute URL`},
+			{`{"method_policies": {"/nonexistent": ["GET"]}}`, `invalid configuration: method_policies: method policy for unknown route pattern "/nonexistent"`},
+			{`{"method_policies": {"/get": []}}`, `invalid configuration: method_policies: method policy for "/get" allows no methods`},
+			{`{"excluded_tags": ["nope"]}`, `invalid configuration: excluded_tags: unknown route tag "nope"`},
+			{`{"mtls_required": ["admin"], "https_cert_file": "a", "https_key_file": "b"}`, `invalid configuration: mtls_required pattern "admin" must begin with a slash`},
+			{`{"server_header": "bad\nvalue"}`, `invalid configuration: server_header "bad\nvalue" must not contain control characters`},
+			{`{"powered_by_header": "bad\u0000"}`, `invalid configuration: powered_by_header "bad\x00" must not contain control characters`},
+			{`{"client_ca_file": "ca-does-not-exist.pem", "https_cert_file": "a", "https_key_file": "b"}`, "invalid configuration: client_ca_file: open ca-does-not-exist.pem"},
+			{`{"mtls_required": ["/admin/"]}`, "client_ca_file and mtls_required require an https cert and key"},
+			{`{"oidc_issuer": "https://issuer.example/?tenant=1"}`, `invalid configuration: oidc_issuer "https://issuer.example/?tenant=1" must be an absolute URL without a query or fragment`},
+		} {
+			buf := &bytes.Buffer{}
+			code := mainImpl([]string{"-config", writeConfigFile(t, tc.contents), "-print-config"}, func(string) string { return "" }, os.Hostname, buf)
+			if code == 0 || !strings.Contains(buf.String(), tc.wantErr) {
+				t.Errorf("%s: expected failure containing %q, got code %d and output:\n%s", tc.contents, tc.wantErr, code, buf)
+			}
+		}
+	})
+
+	t.Run("print config", func(t *testing.T) {
+		t.Parallel()
+		path := writeConfigFile(t, `{"port": 9000, "server_header": "nginx"}`)
+		buf := &bytes.Buffer{}
+		code := mainImpl([]string{"-config", path, "-print-config", "-max-body-size", "99"}, func(string) string { return "" }, os.Hostname, buf)
+		if code != 0 {
+			t.Fatalf("expected return code 0, got %d; output:\n%s", code, buf)
+		}
+		fc, err := parseConfigFile(buf.Bytes())
+		if err != nil {
+			t.Fatalf("expected printed config to be a valid config file, got %s:\n%s", err, buf)
+		}
+		if fc.Port != 9000 || fc.MaxBodySize != 99 || fc.MaxDuration != duration(httpbin.DefaultMaxDuration) || *fc.ServerHeader != "nginx" {
+			t.Fatalf("expected merged config, got:\n%s", buf)
+		}
+		if *fc.DefaultParams.DripNumBytes != httpbin.DefaultDefaultParams.DripNumBytes || fc.MaxEgressConcurrency != httpbin.DefaultMaxEgressConcurrency {
+			t.Fatalf("expected library defaults to be filled in, got:\n%s", buf)
+		}
+	})
+
+	t.Run("default params match admin settings", func(t *testing.T) {
+		t.Parallel()
+		app := httpbin.New(httpbin.WithAdminAPI("token"))
+		r := httptest.NewRequest("GET", "/admin/settings", nil)
+		r.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		var settings map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &settings); err != nil {
+			t.Fatalf("failed to decode admin settings %q: %s", w.Body, err)
+		}
+
+		dripDuration, dripDelay, dripNumBytes := duration(time.Second), duration(0), int64(5)
+		b, _ := json.Marshal(defaultParamsConfig{DripDuration: &dripDuration, DripDelay: &dripDelay, DripNumBytes: &dripNumBytes})
+		var params map[string]interface{}
+		json.Unmarshal(b, &params)
+
+		if len(params) != len(settings) {
+			t.Fatalf("expected default_params keys %v to match admin settings %v", params, settings)
+		}
+		for key := range params {
+			if _, ok := settings[key]; !ok {
+				t.Errorf("default_params key %q is not an admin setting, got %v", key, settings)
+			}
+		}
+	})
+}
+
+// assertAllFieldsSet fails if any field of v, recursively, has its zero
+// value, so that tests using v cover every setting.
+func assertAllFieldsSet(t *testing.T, v reflect.Value, path string) {
+	t.Helper()
+	if v.Kind() == reflect.Struct {
+		for i := 0; i < v.NumField(); i++ {
+			assertAllFieldsSet(t, v.Field(i), path+"."+v.Type().Field(i).Name)
+		}
+		return
+	}
+	if v.IsZero() {
+		t.Errorf("%s is not set", path)
+	}
+}
+
+// TestConfigFileCoversOptions makes sure that every option in the httpbin
+// package can be given in a configuration file, so that a new option cannot
+// be added without also adding it to the file format.
+func TestConfigFileCoversOptions(t *testing.T) {
+	t.Parallel()
+
+	// The configuration key(s) for each option, or an empty string for the
+	// options that cannot be given in a file
+	optionKeys := map[string][]string{
+		"WithAddressFamilyDelay":      {"address_family_delays"},
+		"WithAllowedRedirectDomains":  {"allowed_redirect_domains"},
+		"WithAdminAPI":                {"admin_token"},
+		"WithAsyncObserver":           {"async_observer_buffer"},
+		"WithCanonicalBaseURL":        {"canonical_base_url"},
+		"WithCanonicalJSON":           {"canonical_json"},
+		"WithClientCAs":               {"client_ca_file"},
+		"WithDefaultParams":           {"default_params"},
+		"WithDigestNonceKey":          {"digest_nonce_key"},
+		"WithEnvPrefixes":             {"env_prefixes"},
+		"WithErrorClassHeader":        {"error_class_header"},
+		"WithExcludedTags":            {"excluded_tags"},
+		"WithFeatureFlags":            {"feature_flags"},
+		"WithHostname":                {"use_real_hostname"},
+		"WithLoadSignals":             {"load_signals"},
+		"WithMaxBodySize":             {"max_body_size"},
+		"WithMaxDuration":             {"max_duration"},
+		"WithMaxEgressConcurrency":    {"max_egress_concurrency"},
+		"WithMaxReflectedHeaderBytes": {"max_reflected_header_bytes"},
+		"WithMaxURLLength":            {"max_url_length"},
+		"WithMethodPolicy":            {"method_policies"},
+		"WithMTLSRequired":            {"mtls_required"},
+		"WithOIDCSimulator":           {"oidc_issuer"},
+		"WithPoweredByHeader":         {"powered_by_header"},
+		"WithPrometheusMetrics":       {"prometheus_metrics"},
+		"WithRequestTiming":           {"request_timing"},
+		"WithSelfTestToken":           {"selftest_token"},
+		"WithServerHeader":            {"server_header"},
+		"WithServerTiming":            {"server_timing"},
+		"WithSignedURLKey":            {"signed_url_key", "signed_url_max_skew"},
+		// Only the default decision function can be expressed in a file
+		"WithTraceDecision": {"trace_decision"},
+		// The command always logs requests via httpbin.StdLogObserver
+		"WithObserver": nil,
+	}
+
+	f, err := parser.ParseFile(token.NewFileSet(), filepath.Join("..", "options.go"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := jsonFields(reflect.TypeOf(fileConfig{}))
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || !strings.HasPrefix(fn.Name.Name, "With") {
+			continue
+		}
+		keys, ok := optionKeys[fn.Name.Name]
+		if !ok {
+			t.Errorf("option %s cannot be given in a configuration file", fn.Name.Name)
+			continue
+		}
+		for _, key := range keys {
+			if _, ok := fields[key]; !ok {
+				t.Errorf("option %s maps to unknown configuration key %q", fn.Name.Name, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mccutchen/go-httpbin/v2/httpbin"
+)
+
+// fileConfig is the format of the JSON configuration file given via -config,
+// which can express every option offered by the httpbin package as well as
+// the settings also available as command line flags and environment vars.
+// Zero values leave the corresponding settings at their defaults.
+type fileConfig struct {
+	Host                   string   `json:"host"`
+	Port                   int      `json:"port"`
+	HTTPSCertFile          string   `json:"https_cert_file"`
+	HTTPSKeyFile           string   `json:"https_key_file"`
+	MaxBodySize            int64    `json:"max_body_size"`
+	MaxDuration            duration `json:"max_duration"`
+	UseRealHostname        bool     `json:"use_real_hostname"`
+	AllowedRedirectDomains []string `json:"allowed_redirect_domains"`
+
+	optionsConfig
+}
+
+// optionsConfig holds the settings that may only be given in a
+// configuration file, each of which corresponds to an httpbin.OptionFunc.
+type optionsConfig struct {
+	DefaultParams           defaultParamsConfig `json:"default_params"`
+	MaxEgressConcurrency    int                 `json:"max_egress_concurrency"`
+	SignedURLKey            string              `json:"signed_url_key"`
+	SignedURLMaxSkew        duration            `json:"signed_url_max_skew"`
+	DigestNonceKey          string              `json:"digest_nonce_key"`
+	CanonicalBaseURL        string              `json:"canonical_base_url"`
+	SelfTestToken           string              `json:"selftest_token"`
+	AdminToken              string              `json:"admin_token"`
+	ServerTiming            bool                `json:"server_timing"`
+	LoadSignals             bool                `json:"load_signals"`
+	ErrorClassHeader        bool                `json:"error_class_header"`
+	RequestTiming           bool                `json:"request_timing"`
+	TraceDecision           bool                `json:"trace_decision"`
+	FeatureFlags            map[string]bool     `json:"feature_flags"`
+	ServerHeader            *string             `json:"server_header"`
+	PoweredByHeader         *string             `json:"powered_by_header"`
+	MaxReflectedHeaderBytes int                 `json:"max_reflected_header_bytes"`
+	MethodPolicies          map[string][]string `json:"method_policies"`
+	ClientCAFile            string              `json:"client_ca_file"`
+	MTLSRequired            []string            `json:"mtls_required"`
+	OIDCIssuer              string              `json:"oidc_issuer"`
+	ExcludedTags            []string            `json:"excluded_tags"`
+	AddressFamilyDelays     map[string]duration `json:"address_family_delays"`
+	AsyncObserverBuffer     int                 `json:"async_observer_buffer"`
+	PrometheusMetrics       bool                `json:"prometheus_metrics"`
+	CanonicalJSON           bool                `json:"canonical_json"`
+	MaxURLLength            int                 `json:"max_url_length"`
+	EnvPrefixes             []string            `json:"env_prefixes"`
+}
+
+// defaultParamsConfig overrides individual fields of
+// httpbin.DefaultDefaultParams.
+type defaultParamsConfig struct {
+	DripDuration *duration `json:"drip_duration"`
+	DripDelay    *duration `json:"drip_delay"`
+	DripNumBytes *int64    `json:"drip_numbytes"`
+}
+
+// duration is a time.Duration represented in JSON as a string like "1.5s".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+var durationType = reflect.TypeOf(duration(0))
+
+// options translates the configuration into the httpbin options it
+// describes.
+func (c optionsConfig) options() ([]httpbin.OptionFunc, error) {
+	var opts []httpbin.OptionFunc
+
+	if p := c.DefaultParams; p.DripDuration != nil || p.DripDelay != nil || p.DripNumBytes != nil {
+		params := httpbin.DefaultDefaultParams
+		if p.DripDuration != nil {
+			params.DripDuration = time.Duration(*p.DripDuration)
+		}
+		if p.DripDelay != nil {
+			params.DripDelay = time.Duration(*p.DripDelay)
+		}
+		if p.DripNumBytes != nil {
+			params.DripNumBytes = *p.DripNumBytes
+		}
+		opts = append(opts, httpbin.WithDefaultParams(params))
+	}
+	if c.MaxEgressConcurrency < 0 {
+		return nil, errors.New("max_egress_concurrency must not be negative")
+	} else if c.MaxEgressConcurrency > 0 {
+		opts = append(opts, httpbin.WithMaxEgressConcurrency(c.MaxEgressConcurrency))
+	}
+	if c.SignedURLKey != "" {
+		opts = append(opts, httpbin.WithSignedURLKey(c.SignedURLKey, time.Duration(c.SignedURLMaxSkew)))
+	} else if c.SignedURLMaxSkew != 0 {
+		return nil, errors.New("signed_url_max_skew requires signed_url_key")
+	}
+	if c.DigestNonceKey != "" {
+		opts = append(opts, httpbin.WithDigestNonceKey(c.DigestNonceKey))
+	}
+	if c.CanonicalBaseURL != "" {
+		u, err := url.Parse(c.CanonicalBaseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("canonical_base_url %q must be an absolute URL", c.CanonicalBaseURL)
+		}
+		opts = append(opts, httpbin.WithCanonicalBaseURL(u))
+	}
+	if c.SelfTestToken != "" {
+		opts = append(opts, httpbin.WithSelfTestToken(c.SelfTestToken))
+	}
+	if c.AdminToken != "" {
+		opts = append(opts, httpbin.WithAdminAPI(c.AdminToken))
+	}
+	if c.ServerTiming {
+		opts = append(opts, httpbin.WithServerTiming())
+	}
+	if c.LoadSignals {
+		opts = append(opts, httpbin.WithLoadSignals())
+	}
+	if c.ErrorClassHeader {
+		opts = append(opts, httpbin.WithErrorClassHeader())
+	}
+	if c.RequestTiming {
+		opts = append(opts, httpbin.WithRequestTiming())
+	}
+	if c.TraceDecision {
+		opts = append(opts, httpbin.WithTraceDecision(nil))
+	}
+	if len(c.FeatureFlags) > 0 {
+		opts = append(opts, httpbin.WithFeatureFlags(c.FeatureFlags))
+	}
+	if c.ServerHeader != nil {
+		if !isValidHeaderValue(*c.ServerHeader) {
+			return nil, fmt.Errorf("server_header %q must not contain control characters", *c.ServerHeader)
+		}
+		opts = append(opts, httpbin.WithServerHeader(*c.ServerHeader))
+	}
+	if c.PoweredByHeader != nil {
+		if !isValidHeaderValue(*c.PoweredByHeader) {
+			return nil, fmt.Errorf("powered_by_header %q must not contain control characters", *c.PoweredByHeader)
+		}
+		opts = append(opts, httpbin.WithPoweredByHeader(*c.PoweredByHeader))
+	}
+	if c.MaxReflectedHeaderBytes < 0 {
+		return nil, errors.New("max_reflected_header_bytes must not be negative")
+	} else if c.MaxReflectedHeaderBytes > 0 {
+		opts = append(opts, httpbin.WithMaxReflectedHeaderBytes(c.MaxReflectedHeaderBytes))
+	}
+	patterns := make([]string, 0, len(c.MethodPolicies))
+	for pattern := range c.MethodPolicies {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		opts = append(opts, httpbin.WithMethodPolicy(pattern, c.MethodPolicies[pattern]...))
+	}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("client_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client_ca_file: no PEM certificates found in %s", c.ClientCAFile)
+		}
+		opts = append(opts, httpbin.WithClientCAs(pool))
+	}
+	for _, pattern := range c.MTLSRequired {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("mtls_required pattern %q must begin with a slash", pattern)
+		}
+	}
+	if len(c.MTLSRequired) > 0 {
+		opts = append(opts, httpbin.WithMTLSRequired(c.MTLSRequired...))
+	}
+	for _, tag := range c.ExcludedTags {
+		if err := httpbin.ValidateRouteTag(tag); err != nil {
+			return nil, fmt.Errorf("excluded_tags: %w", err)
+		}
+	}
+	if len(c.ExcludedTags) > 0 {
+		opts = append(opts, httpbin.WithExcludedTags(c.ExcludedTags...))
+	}
+	families := make([]string, 0, len(c.AddressFamilyDelays))
+	for family, delay := range c.AddressFamilyDelays {
+		if family != "ipv4" && family != "ipv6" {
+			return nil, fmt.Errorf("address_family_delays: unknown address family %q, must be ipv4 or ipv6", family)
+		}
+		if delay < 0 {
+			return nil, fmt.Errorf("address_family_delays: %s delay must not be negative", family)
+		}
+		families = append(families, family)
+	}
+	sort.Strings(families)
+	for _, family := range families {
+		opts = append(opts, httpbin.WithAddressFamilyDelay(family, time.Duration(c.AddressFamilyDelays[family])))
+	}
+	if c.AsyncObserverBuffer < 0 {
+		return nil, errors.New("async_observer_buffer must not be negative")
+	} else if c.AsyncObserverBuffer > 0 {
+		opts = append(opts, httpbin.WithAsyncObserver(c.AsyncObserverBuffer))
+	}
+	for _, prefix := range c.EnvPrefixes {
+		if prefix == "" {
+			return nil, errors.New("env_prefixes must not contain an empty prefix, which would expose every environment variable")
+		}
+	}
+	if len(c.EnvPrefixes) > 0 {
+		opts = append(opts, httpbin.WithEnvPrefixes(c.EnvPrefixes...))
+	}
+	if c.MaxURLLength < 0 {
+		return nil, errors.New("max_url_length must not be negative")
+	} else if c.MaxURLLength > 0 {
+		opts = append(opts, httpbin.WithMaxURLLength(c.MaxURLLength))
+	}
+	if c.CanonicalJSON {
+		opts = append(opts, httpbin.WithCanonicalJSON())
+	}
+	if c.PrometheusMetrics {
+		opts = append(opts, httpbin.WithPrometheusMetrics())
+	}
+	if c.OIDCIssuer != "" {
+		u, err := url.Parse(c.OIDCIssuer)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("oidc_issuer %q must be an absolute URL without a query or fragment", c.OIDCIssuer)
+		}
+		opts = append(opts, httpbin.WithOIDCSimulator(c.OIDCIssuer))
+	}
+	return opts, nil
+}
+
+// usesClientCerts reports whether the configuration needs the server to
+// request TLS client certificates.
+func (c optionsConfig) usesClientCerts() bool {
+	return c.ClientCAFile != "" || len(c.MTLSRequired) > 0
+}
+
+// loadConfigFile reads and validates the configuration file at path. Errors
+// give the line of the offending key or value.
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := parseConfigFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return fc, nil
+}
+
+// parseConfigFile parses a configuration file, rejecting unknown keys and
+// values of the wrong type with errors of the form "<line>: <problem>".
+func parseConfigFile(data []byte) (*fileConfig, error) {
+	v := &configValidator{data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	v.dec.UseNumber()
+	if err := v.validate(reflect.TypeOf(fileConfig{}), ""); err != nil {
+		return nil, err
+	}
+	if _, err := v.dec.Token(); err != io.EOF {
+		return nil, v.errorf("unexpected data after the top-level object")
+	}
+
+	fc := &fileConfig{}
+	if err := json.Unmarshal(data, fc); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// configValidator walks the tokens of a configuration file, checking that
+// they match the shape of the Go type they will be decoded into.
+type configValidator struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+// errorf returns an error prefixed with the line on which the most recently
+// read token ends.
+func (v *configValidator) errorf(format string, a ...interface{}) error {
+	line := 1 + bytes.Count(v.data[:v.dec.InputOffset()], []byte("\n"))
+	return fmt.Errorf("%d: %s", line, fmt.Sprintf(format, a...))
+}
+
+func (v *configValidator) token() (json.Token, error) {
+	tok, err := v.dec.Token()
+	if err == io.EOF {
+		return nil, v.errorf("unexpected end of file")
+	}
+	if err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(v.data[:syntaxErr.Offset], []byte("\n"))
+			return nil, fmt.Errorf("%d: %s", line, syntaxErr)
+		}
+		return nil, v.errorf("%s", err)
+	}
+	return tok, nil
+}
+
+// validate checks the next value against type t, where key names the value
+// in error messages.
+func (v *configValidator) validate(t reflect.Type, key string) error {
+	tok, err := v.token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		// null leaves any value unset
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	name := key
+	if name == "" {
+		name = "configuration"
+	}
+
+	if t == durationType {
+		s, ok := tok.(string)
+		if !ok {
+			return v.errorf("%s must be a duration string like \"1.5s\"", name)
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return v.errorf("%s: invalid duration %q", name, s)
+		}
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		if tok != json.Delim('{') {
+			return v.errorf("%s must be an object", name)
+		}
+		var fields map[string]reflect.Type
+		if t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		}
+		for v.dec.More() {
+			tok, err := v.token()
+			if err != nil {
+				return err
+			}
+			k := tok.(string)
+			elem, fullKey := t, k
+			if key != "" {
+				fullKey = key + "." + k
+			}
+			if fields != nil {
+				var ok bool
+				if elem, ok = fields[k]; !ok {
+					return v.errorf("unknown key %q", fullKey)
+				}
+			} else {
+				elem = t.Elem()
+			}
+			if err := v.validate(elem, fullKey); err != nil {
+				return err
+			}
+		}
+		_, err := v.token()
+		return err
+	case reflect.Slice:
+		if tok != json.Delim('[') {
+			return v.errorf("%s must be an array", name)
+		}
+		for i := 0; v.dec.More(); i++ {
+			if err := v.validate(t.Elem(), fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+		_, err := v.token()
+		return err
+	case reflect.String:
+		if _, ok := tok.(string); !ok {
+			return v.errorf("%s must be a string", name)
+		}
+	case reflect.Bool:
+		if _, ok := tok.(bool); !ok {
+			return v.errorf("%s must be true or false", name)
+		}
+	case reflect.Int, reflect.Int64:
+		n, ok := tok.(json.Number)
+		if !ok {
+			return v.errorf("%s must be an integer", name)
+		}
+		if _, err := n.Int64(); err != nil {
+			return v.errorf("%s must be an integer, got %s", name, n)
+		}
+	default:
+		panic(fmt.Sprintf("unsupported config type %s", t))
+	}
+	return nil
+}
+
+// jsonFields maps the JSON keys of a struct's fields, including those
+// promoted from embedded structs, to their types.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for k, ft := range jsonFields(f.Type) {
+				fields[k] = ft
+			}
+			continue
+		}
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			fields[name] = f.Type
+		}
+	}
+	return fields
+}
+
+// fileConfig returns the effective configuration in the format of a
+// configuration file, for -print-config.
+func (cfg *config) fileConfig() *fileConfig {
+	fc := &fileConfig{
+		Host:                   cfg.ListenHost,
+		Port:                   cfg.ListenPort,
+		HTTPSCertFile:          cfg.TLSCertFile,
+		HTTPSKeyFile:           cfg.TLSKeyFile,
+		MaxBodySize:            cfg.MaxBodySize,
+		MaxDuration:            duration(cfg.MaxDuration),
+		UseRealHostname:        cfg.RealHostname != "",
+		AllowedRedirectDomains: cfg.AllowedRedirectDomains,
+		optionsConfig:          cfg.optionsConfig,
+	}
+
+	// Fill in the library's defaults for settings left unset
+	params := &fc.DefaultParams
+	if params.DripDuration == nil {
+		d := duration(httpbin.DefaultDefaultParams.DripDuration)
+		params.DripDuration = &d
+	}
+	if params.DripDelay == nil {
+		d := duration(httpbin.DefaultDefaultParams.DripDelay)
+		params.DripDelay = &d
+	}
+	if params.DripNumBytes == nil {
+		n := httpbin.DefaultDefaultParams.DripNumBytes
+		params.DripNumBytes = &n
+	}
+	if fc.MaxEgressConcurrency == 0 {
+		fc.MaxEgressConcurrency = httpbin.DefaultMaxEgressConcurrency
+	}
+	return fc
+}
+
+// isValidHeaderValue reports whether s contains no control characters other
+// than horizontal tab, which the httpbin package requires of the values
+// given to WithServerHeader and WithPoweredByHeader.
+func isValidHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
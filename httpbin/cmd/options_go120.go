@@ -0,0 +1,12 @@
+//go:build go1.20
+// +build go1.20
+
+package cmd
+
+import "net/http"
+
+// disableGeneralOptionsHandler lets go-httpbin answer OPTIONS * requests
+// itself, instead of net/http's built-in handler.
+func disableGeneralOptionsHandler(srv *http.Server) {
+	srv.DisableGeneralOptionsHandler = true
+}
@@ -0,0 +1,10 @@
+//go:build !go1.20
+// +build !go1.20
+
+package cmd
+
+import "net/http"
+
+// disableGeneralOptionsHandler is a no-op before Go 1.20, where net/http
+// always answers OPTIONS * requests itself.
+func disableGeneralOptionsHandler(srv *http.Server) {}
@@ -1,22 +1,33 @@
 // Package digest provides a limited implementation of HTTP Digest
-// Authentication, as defined in RFC 2617.
+// Authentication, as defined in RFC 2617 and RFC 7616.
 //
-// Only the "auth" QOP directive is handled at this time, and while support for
-// the SHA-256 algorithm is implemented here it does not actually work in
+// The "auth" and "auth-int" QOP directives are handled, with the MD5 and
+// SHA-256 algorithms and their "-sess" variants. Note that while SHA-256 is
+// supported by curl and most client libraries, it does not actually work in
 // either Chrome or Firefox.
 //
+// The package level Challenge and Check functions issue random nonces and
+// accept any nonce. An Authenticator issues signed nonces, rejects forged
+// ones, and detects stale ones.
+//
 // For more info, see:
 // https://tools.ietf.org/html/rfc2617
+// https://tools.ietf.org/html/rfc7616
 // https://en.wikipedia.org/wiki/Digest_access_authentication
 package digest
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
 	crypto_rand "crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,6 +39,8 @@ type digestAlgorithm int
 const (
 	MD5 digestAlgorithm = iota
 	SHA256
+	MD5Sess
+	SHA256Sess
 )
 
 func (a digestAlgorithm) String() string {
@@ -36,24 +49,81 @@ func (a digestAlgorithm) String() string {
 		return "MD5"
 	case SHA256:
 		return "SHA-256"
+	case MD5Sess:
+		return "MD5-sess"
+	case SHA256Sess:
+		return "SHA-256-sess"
 	}
 	return "UNKNOWN"
 }
 
+// sess reports whether a is one of the "-sess" variants, whose HA1 hash
+// also covers the server and client nonces.
+func (a digestAlgorithm) sess() bool {
+	return a == MD5Sess || a == SHA256Sess
+}
+
+// ParseAlgorithm returns the algorithm with the given name, e.g. SHA-256 or
+// MD5-sess, ignoring case, and whether it is supported.
+func ParseAlgorithm(name string) (digestAlgorithm, bool) {
+	for _, a := range []digestAlgorithm{MD5, SHA256, MD5Sess, SHA256Sess} {
+		if strings.EqualFold(name, a.String()) {
+			return a, true
+		}
+	}
+	return MD5, false
+}
+
+// QOP directives supported by this package
+const (
+	QOPAuth    = "auth"
+	QOPAuthInt = "auth-int"
+)
+
 // Check returns a bool indicating whether the request is correctly
-// authenticated for the given username and password.
+// authenticated for the given username and password, with whatever
+// algorithm and QOP directive the client chose. For the "auth-int" QOP
+// directive, the request body is read in full.
 func Check(req *http.Request, username, password string) bool {
 	auth := parseAuthorizationHeader(req.Header.Get("Authorization"))
+	return check(req, auth, username, password)
+}
+
+// CheckQOP is like Check, but also requires that the client used the given
+// QOP directive and algorithm, as offered by ChallengeQOP.
+func CheckQOP(req *http.Request, username, password, qop string, algorithm digestAlgorithm) bool {
+	auth := parseAuthorizationHeader(req.Header.Get("Authorization"))
+	if auth == nil || auth.qop != qop || auth.algorithm != algorithm {
+		return false
+	}
+	return check(req, auth, username, password)
+}
+
+func check(req *http.Request, auth *authorization, username, password string) bool {
 	if auth == nil || auth.username != username {
 		return false
 	}
-	expectedResponse := response(auth, password, req.Method, req.RequestURI)
+	var body []byte
+	if auth.qop == QOPAuthInt && req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return false
+		}
+	}
+	expectedResponse := response(auth, password, req.Method, req.RequestURI, body)
 	return compare(auth.response, expectedResponse)
 }
 
 // Challenge returns a WWW-Authenticate header value for the given realm and
-// algorithm. If an invalid realm or an unsupported algorithm is given
+// algorithm, offering the "auth" QOP directive.
 func Challenge(realm string, algorithm digestAlgorithm) string {
+	return ChallengeQOP(realm, QOPAuth, algorithm)
+}
+
+// ChallengeQOP returns a WWW-Authenticate header value for the given realm,
+// QOP directive and algorithm.
+func ChallengeQOP(realm, qop string, algorithm digestAlgorithm) string {
 	entropy := make([]byte, 32)
 	crypto_rand.Read(entropy)
 
@@ -64,7 +134,123 @@ func Challenge(realm string, algorithm digestAlgorithm) string {
 	opaque := hash(opaqueVal, MD5)
 	nonce := hash([]byte(nonceVal), MD5)
 
-	return fmt.Sprintf("Digest qop=auth, realm=%#v, algorithm=%s, nonce=%s, opaque=%s", sanitizeRealm(realm), algorithm, nonce, opaque)
+	return fmt.Sprintf("Digest qop=%s, realm=%#v, algorithm=%s, nonce=%s, opaque=%s", qop, sanitizeRealm(realm), algorithm, nonce, opaque)
+}
+
+// Authenticator issues and verifies stateless nonces. Each nonce carries the
+// time it was issued and an HMAC under the authenticator's key, and each
+// opaque value is an HMAC of its nonce, so forged values are detected and
+// expired nonces can be reported as stale without keeping any state on the
+// server.
+type Authenticator struct {
+	key []byte
+	now func() time.Time
+}
+
+// NewAuthenticator returns an Authenticator signing nonces with the given
+// key and dating them with the given clock.
+func NewAuthenticator(key []byte, now func() time.Time) *Authenticator {
+	return &Authenticator{key: key, now: now}
+}
+
+// Staleness limits how long a nonce is fresh: for MaxAge after it was
+// issued, and for MaxUses requests, as counted by the client's nonce count.
+// Zero values impose no limit.
+type Staleness struct {
+	MaxAge  time.Duration
+	MaxUses uint64
+}
+
+// Result is the outcome of an Authenticator's Check.
+type Result int
+
+// Results of an Authenticator's Check
+const (
+	// Unauthorized requests have missing, malformed, forged or incorrect
+	// credentials.
+	Unauthorized Result = iota
+	// Authorized requests have correct credentials and a fresh nonce.
+	Authorized
+	// Stale requests have correct credentials, but a nonce that is no
+	// longer fresh, so the client should retry with a new one without
+	// prompting the user again.
+	Stale
+)
+
+// nonce sizes, in bytes
+const (
+	nonceTimeSize   = 8
+	nonceRandomSize = 8
+	nonceMACSize    = 16
+)
+
+// Challenge returns a WWW-Authenticate header value for the given realm,
+// QOP directive and algorithm, with a fresh nonce. If stale is true, the
+// challenge tells the client that its previous nonce was stale.
+func (a *Authenticator) Challenge(realm, qop string, algorithm digestAlgorithm, stale bool) string {
+	payload := make([]byte, nonceTimeSize+nonceRandomSize)
+	binary.BigEndian.PutUint64(payload, uint64(a.now().UnixNano()))
+	crypto_rand.Read(payload[nonceTimeSize:])
+	nonce := base64.RawURLEncoding.EncodeToString(append(payload, a.mac(payload)[:nonceMACSize]...))
+
+	challenge := fmt.Sprintf("Digest qop=%s, realm=%#v, algorithm=%s, nonce=%s, opaque=%s", qop, sanitizeRealm(realm), algorithm, nonce, a.opaque(nonce))
+	if stale {
+		challenge += ", stale=true"
+	}
+	return challenge
+}
+
+// Check reports whether the request is correctly authenticated for the given
+// username and password, using the given QOP directive and algorithm and a
+// nonce and opaque value issued by this authenticator. A request that
+// would be authorized but for its nonce no longer being fresh is Stale.
+func (a *Authenticator) Check(req *http.Request, username, password, qop string, algorithm digestAlgorithm, staleness Staleness) Result {
+	auth := parseAuthorizationHeader(req.Header.Get("Authorization"))
+	if auth == nil || auth.qop != qop || auth.algorithm != algorithm {
+		return Unauthorized
+	}
+	issued, ok := a.verifyNonce(auth.nonce)
+	if !ok || !compare(auth.opaque, a.opaque(auth.nonce)) {
+		return Unauthorized
+	}
+	if !check(req, auth, username, password) {
+		return Unauthorized
+	}
+	if staleness.MaxAge > 0 && a.now().Sub(issued) > staleness.MaxAge {
+		return Stale
+	}
+	if staleness.MaxUses > 0 {
+		nc, err := strconv.ParseUint(auth.nc, 16, 64)
+		if err != nil || nc > staleness.MaxUses {
+			return Stale
+		}
+	}
+	return Authorized
+}
+
+// verifyNonce checks that nonce was issued by this authenticator, returning
+// the time it was issued.
+func (a *Authenticator) verifyNonce(nonce string) (time.Time, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != nonceTimeSize+nonceRandomSize+nonceMACSize {
+		return time.Time{}, false
+	}
+	payload, mac := raw[:nonceTimeSize+nonceRandomSize], raw[nonceTimeSize+nonceRandomSize:]
+	if !hmac.Equal(mac, a.mac(payload)[:nonceMACSize]) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(payload))), true
+}
+
+// opaque returns the opaque value issued along with nonce.
+func (a *Authenticator) opaque(nonce string) string {
+	return fmt.Sprintf("%x", a.mac([]byte("opaque:" + nonce))[:16])
+}
+
+func (a *Authenticator) mac(data []byte) []byte {
+	m := hmac.New(sha256.New, a.key)
+	m.Write(data)
+	return m.Sum(nil)
 }
 
 // sanitizeRealm tries to ensure that a given realm does not include any
@@ -119,10 +305,8 @@ func parseAuthorizationHeader(value string) *authorization {
 	authInfo := parts[1]
 	auth := parseDictHeader(authInfo)
 
-	algo := MD5
-	if strings.ToLower(auth["algorithm"]) == "sha-256" {
-		algo = SHA256
-	}
+	// unsupported algorithms fall back to MD5
+	algo, _ := ParseAlgorithm(auth["algorithm"])
 
 	return &authorization{
 		algorithm: algo,
@@ -130,7 +314,7 @@ func parseAuthorizationHeader(value string) *authorization {
 		nc:        auth["nc"],
 		nonce:     auth["nonce"],
 		opaque:    auth["opaque"],
-		qop:       auth["qop"],
+		qop:       strings.ToLower(auth["qop"]),
 		realm:     auth["realm"],
 		response:  auth["response"],
 		uri:       auth["uri"],
@@ -162,10 +346,10 @@ func parseDictHeader(value string) map[string]string {
 }
 
 // hash generates the hex digest of the given data using the given hashing
-// algorithm, which must be one of MD5 or SHA256.
+// algorithm, where the "-sess" variants hash like their base algorithms.
 func hash(data []byte, algorithm digestAlgorithm) string {
 	switch algorithm {
-	case SHA256:
+	case SHA256, SHA256Sess:
 		return fmt.Sprintf("%x", sha256.Sum256(data))
 	default:
 		return fmt.Sprintf("%x", md5.Sum(data))
@@ -176,19 +360,34 @@ func hash(data []byte, algorithm digestAlgorithm) string {
 //
 //	HA1 = H(A1) = H(username:realm:password)
 //
+// or, for the "-sess" algorithms,
+//
+//	HA1 = H(H(username:realm:password):nonce:clientNonce)
+//
 // and H is one of MD5 or SHA256.
-func makeHA1(realm, username, password string, algorithm digestAlgorithm) string {
-	A1 := fmt.Sprintf("%s:%s:%s", username, realm, password)
-	return hash([]byte(A1), algorithm)
+func makeHA1(auth *authorization, password string) string {
+	A1 := fmt.Sprintf("%s:%s:%s", auth.username, auth.realm, password)
+	ha1 := hash([]byte(A1), auth.algorithm)
+	if auth.algorithm.sess() {
+		ha1 = hash([]byte(fmt.Sprintf("%s:%s:%s", ha1, auth.nonce, auth.cnonce)), auth.algorithm)
+	}
+	return ha1
 }
 
 // makeHA2 returns the HA2 hash, where
 //
 //	HA2 = H(A2) = H(method:digestURI)
 //
+// or, for the "auth-int" QOP directive,
+//
+//	HA2 = H(A2) = H(method:digestURI:H(entityBody))
+//
 // and H is one of MD5 or SHA256.
-func makeHA2(auth *authorization, method, uri string) string {
+func makeHA2(auth *authorization, method, uri string, body []byte) string {
 	A2 := fmt.Sprintf("%s:%s", method, uri)
+	if auth.qop == QOPAuthInt {
+		A2 = fmt.Sprintf("%s:%s", A2, hash(body, auth.algorithm))
+	}
 	return hash([]byte(A2), auth.algorithm)
 }
 
@@ -202,12 +401,12 @@ func makeHA2(auth *authorization, method, uri string) string {
 //	RESPONSE = H(HA1:nonce:HA2)
 //
 // where H is one of MD5 or SHA256.
-func response(auth *authorization, password, method, uri string) string {
-	ha1 := makeHA1(auth.realm, auth.username, password, auth.algorithm)
-	ha2 := makeHA2(auth, method, uri)
+func response(auth *authorization, password, method, uri string, body []byte) string {
+	ha1 := makeHA1(auth, password)
+	ha2 := makeHA2(auth, method, uri, body)
 
 	var r string
-	if auth.qop == "auth" || auth.qop == "auth-int" {
+	if auth.qop == QOPAuth || auth.qop == QOPAuthInt {
 		r = fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, auth.nonce, auth.nc, auth.cnonce, auth.qop, ha2)
 	} else {
 		r = fmt.Sprintf("%s:%s:%s", ha1, auth.nonce, ha2)
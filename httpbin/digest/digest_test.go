@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Well-formed examples from Wikipedia:
@@ -84,6 +86,8 @@ func TestChallenge(t *testing.T) {
 	}{
 		{"realm", "realm", MD5, "MD5"},
 		{"realm", "realm", SHA256, "SHA-256"},
+		{"realm", "realm", MD5Sess, "MD5-sess"},
+		{"realm", "realm", SHA256Sess, "SHA-256-sess"},
 		{"realm with spaces", "realm with spaces", SHA256, "SHA-256"},
 		{`realm "with" "quotes"`, "realm with quotes", MD5, "MD5"},
 		{`spaces, "quotes," and commas`, "spaces quotes and commas", MD5, "MD5"},
@@ -93,17 +97,273 @@ func TestChallenge(t *testing.T) {
 		result := parseDictHeader(challenge)
 		assertStringEquals(t, test.expectedRealm, result["realm"])
 		assertStringEquals(t, test.expectedAlgorithm, result["algorithm"])
+		assertStringEquals(t, "auth", result["Digest qop"])
 	}
+
+	result := parseDictHeader(ChallengeQOP("realm", QOPAuthInt, SHA256Sess))
+	assertStringEquals(t, "auth-int", result["Digest qop"])
+	assertStringEquals(t, "SHA-256-sess", result["algorithm"])
 }
 
 func TestResponse(t *testing.T) {
 	t.Parallel()
 	auth := parseAuthorizationHeader(exampleAuthorization)
 	expected := auth.response
-	got := response(auth, examplePassword, "GET", "/dir/index.html")
+	got := response(auth, examplePassword, "GET", "/dir/index.html", nil)
 	assertStringEquals(t, expected, got)
 }
 
+// TestRFC7616Responses checks the examples from RFC 7616 section 3.9.1
+func TestRFC7616Responses(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		algorithm digestAlgorithm
+		expected  string
+	}{
+		{MD5, "8ca523f5e9506fed4657c9700eebdbec"},
+		{SHA256, "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.algorithm.String(), func(t *testing.T) {
+			t.Parallel()
+			auth := &authorization{
+				algorithm: test.algorithm,
+				cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+				nc:        "00000001",
+				nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+				qop:       QOPAuth,
+				realm:     "http-auth@example.org",
+				uri:       "/dir/index.html",
+				username:  "Mufasa",
+			}
+			got := response(auth, "Circle of Life", "GET", "/dir/index.html", nil)
+			assertStringEquals(t, test.expected, got)
+		})
+	}
+}
+
+func TestSessAndAuthIntResponses(t *testing.T) {
+	t.Parallel()
+	base := authorization{
+		cnonce:   "0a4f113b",
+		nc:       "00000001",
+		nonce:    "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		realm:    "testrealm@host.com",
+		username: exampleUsername,
+	}
+	body := []byte("hello, world!\n")
+
+	tests := []struct {
+		name      string
+		algorithm digestAlgorithm
+		qop       string
+		ha1       string
+		ha2       string
+	}{
+		{
+			name:      "MD5-sess",
+			algorithm: MD5Sess,
+			qop:       QOPAuth,
+			ha1:       hash([]byte(hash([]byte("Mufasa:testrealm@host.com:Circle Of Life"), MD5)+":dcd98b7102dd2f0e8b11d0f600bfb0c093:0a4f113b"), MD5),
+			ha2:       hash([]byte("POST:/dir/index.html"), MD5),
+		},
+		{
+			name:      "SHA-256-sess",
+			algorithm: SHA256Sess,
+			qop:       QOPAuth,
+			ha1:       hash([]byte(hash([]byte("Mufasa:testrealm@host.com:Circle Of Life"), SHA256)+":dcd98b7102dd2f0e8b11d0f600bfb0c093:0a4f113b"), SHA256),
+			ha2:       hash([]byte("POST:/dir/index.html"), SHA256),
+		},
+		{
+			name:      "MD5 auth-int",
+			algorithm: MD5,
+			qop:       QOPAuthInt,
+			ha1:       hash([]byte("Mufasa:testrealm@host.com:Circle Of Life"), MD5),
+			ha2:       hash([]byte("POST:/dir/index.html:910c8bc73110b0cd1bc5d2bcae782511"), MD5),
+		},
+		{
+			name:      "SHA-256-sess auth-int",
+			algorithm: SHA256Sess,
+			qop:       QOPAuthInt,
+			ha1:       hash([]byte(hash([]byte("Mufasa:testrealm@host.com:Circle Of Life"), SHA256)+":dcd98b7102dd2f0e8b11d0f600bfb0c093:0a4f113b"), SHA256),
+			ha2:       hash([]byte("POST:/dir/index.html:4dca0fd5f424a31b03ab807cbae77eb32bf2d089eed1cee154b3afed458de0dc"), SHA256),
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			auth := base
+			auth.algorithm = test.algorithm
+			auth.qop = test.qop
+			expected := hash([]byte(fmt.Sprintf("%s:%s:%s:%s:%s:%s", test.ha1, auth.nonce, auth.nc, auth.cnonce, auth.qop, test.ha2)), test.algorithm)
+			got := response(&auth, examplePassword, "POST", "/dir/index.html", body)
+			assertStringEquals(t, expected, got)
+		})
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		expected digestAlgorithm
+		ok       bool
+	}{
+		{"MD5", MD5, true},
+		{"md5", MD5, true},
+		{"SHA-256", SHA256, true},
+		{"sha-256", SHA256, true},
+		{"MD5-sess", MD5Sess, true},
+		{"MD5-SESS", MD5Sess, true},
+		{"SHA-256-sess", SHA256Sess, true},
+		{"sha-256-SESS", SHA256Sess, true},
+
+		{"", MD5, false},
+		{"SHA256", MD5, false},
+		{"SHA-512", MD5, false},
+		{"SHA-512-256", MD5, false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := ParseAlgorithm(test.name)
+			if got != test.expected || ok != test.ok {
+				t.Errorf("expected (%v, %v), got (%v, %v)", test.expected, test.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestCheckQOP(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		qop       string
+		algorithm digestAlgorithm
+		expected  bool
+	}{
+		{"matching", QOPAuth, MD5, true},
+		{"wrong qop", QOPAuthInt, MD5, false},
+		{"wrong algorithm", QOPAuth, SHA256, false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			req := buildRequest("GET", "/dir/index.html", exampleAuthorization)
+			if got := CheckQOP(req, exampleUsername, examplePassword, test.qop, test.algorithm); got != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+// answerChallenge builds an Authorization header answering the given
+// Authenticator challenge as the nc'th use of its nonce.
+func answerChallenge(challenge, uri, password string, nc int) string {
+	params := parseDictHeader(strings.TrimPrefix(challenge, "Digest "))
+	auth := &authorization{
+		algorithm: MD5,
+		cnonce:    "0a4f113b",
+		nc:        fmt.Sprintf("%08x", nc),
+		nonce:     params["nonce"],
+		qop:       params["qop"],
+		realm:     params["realm"],
+		username:  exampleUsername,
+	}
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5, qop=%s, nc=%s, cnonce="%s", response="%s", opaque="%s"`,
+		auth.username, auth.realm, auth.nonce, uri, auth.qop, auth.nc, auth.cnonce, response(auth, password, "GET", uri, nil), params["opaque"])
+}
+
+func TestAuthenticator(t *testing.T) {
+	t.Parallel()
+	const uri = "/dir/index.html"
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		password  string
+		nc        int
+		elapsed   time.Duration
+		staleness Staleness
+		tamper    func(challenge string) string
+		expected  Result
+	}{
+		{name: "fresh", password: examplePassword, nc: 1, expected: Authorized},
+		{name: "wrong password", password: "wrong", nc: 1, expected: Unauthorized},
+		{name: "no limit", password: examplePassword, nc: 1000, elapsed: time.Hour, expected: Authorized},
+		{name: "within max age", password: examplePassword, nc: 1, elapsed: 10 * time.Second, staleness: Staleness{MaxAge: 10 * time.Second}, expected: Authorized},
+		{name: "past max age", password: examplePassword, nc: 1, elapsed: 11 * time.Second, staleness: Staleness{MaxAge: 10 * time.Second}, expected: Stale},
+		{name: "past max age wrong password", password: "wrong", nc: 1, elapsed: 11 * time.Second, staleness: Staleness{MaxAge: 10 * time.Second}, expected: Unauthorized},
+		{name: "within max uses", password: examplePassword, nc: 3, staleness: Staleness{MaxUses: 3}, expected: Authorized},
+		{name: "past max uses", password: examplePassword, nc: 4, staleness: Staleness{MaxUses: 3}, expected: Stale},
+		{
+			name:     "forged nonce",
+			password: examplePassword,
+			nc:       1,
+			tamper: func(challenge string) string {
+				return strings.Replace(challenge, "nonce=", "nonce=AAAA", 1)
+			},
+			expected: Unauthorized,
+		},
+		{
+			name:     "forged opaque",
+			password: examplePassword,
+			nc:       1,
+			tamper: func(challenge string) string {
+				return strings.Replace(challenge, "opaque=", "opaque=00", 1)
+			},
+			expected: Unauthorized,
+		},
+		{
+			name:     "foreign nonce",
+			password: examplePassword,
+			nc:       1,
+			tamper: func(challenge string) string {
+				return NewAuthenticator([]byte("other key"), func() time.Time { return epoch }).Challenge("testrealm@host.com", QOPAuth, MD5, false)
+			},
+			expected: Unauthorized,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			now := epoch
+			a := NewAuthenticator([]byte("key"), func() time.Time { return now })
+			challenge := a.Challenge("testrealm@host.com", QOPAuth, MD5, false)
+			if test.tamper != nil {
+				challenge = test.tamper(challenge)
+			}
+			now = now.Add(test.elapsed)
+
+			req := buildRequest("GET", uri, answerChallenge(challenge, uri, test.password, test.nc))
+			if got := a.Check(req, exampleUsername, examplePassword, QOPAuth, MD5, test.staleness); got != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+
+	t.Run("challenge", func(t *testing.T) {
+		t.Parallel()
+		a := NewAuthenticator([]byte("key"), time.Now)
+		first := a.Challenge("testrealm@host.com", QOPAuth, MD5, false)
+		if strings.Contains(first, "stale") {
+			t.Errorf("expected challenge without stale, got %q", first)
+		}
+		stale := a.Challenge("testrealm@host.com", QOPAuth, MD5, true)
+		if !strings.HasSuffix(stale, ", stale=true") {
+			t.Errorf("expected challenge with stale=true, got %q", stale)
+		}
+		if parseDictHeader(first)["nonce"] == parseDictHeader(stale)["nonce"] {
+			t.Errorf("expected each challenge to have a fresh nonce")
+		}
+	})
+}
+
 func TestHash(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -247,13 +507,17 @@ func TestParseAuthorizationHeader(t *testing.T) {
 			algorithm: MD5,
 			username:  "u",
 		}},
-		// session variants not recognized
+		// session variants are recognized, in any case
 		{"Digest algorithm=SHA-256-sess, username=u", &authorization{
-			algorithm: MD5,
+			algorithm: SHA256Sess,
 			username:  "u",
 		}},
 		{"Digest algorithm=MD5-sess, username=u", &authorization{
-			algorithm: MD5,
+			algorithm: MD5Sess,
+			username:  "u",
+		}},
+		{"Digest algorithm=md5-SESS, username=u", &authorization{
+			algorithm: MD5Sess,
 			username:  "u",
 		}},
 
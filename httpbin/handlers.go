@@ -4,17 +4,33 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mccutchen/go-httpbin/v2/httpbin/digest"
+	"github.com/mccutchen/go-httpbin/v2/httpbin/websocket"
+	"github.com/mccutchen/go-httpbin/v2/httpbin/zstd"
 )
 
 func notImplementedHandler(w http.ResponseWriter, r *http.Request) {
@@ -28,8 +44,104 @@ func (h *HTTPBin) Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, msg, http.StatusNotFound)
 		return
 	}
+	tags, err := parseTagFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	page := mustStaticAsset("index.html")
+	if len(tags) > 0 || len(h.excludedTags) > 0 {
+		page = filterIndexPage(page, h.routes(), tags)
+	}
 	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' camo.githubusercontent.com")
-	writeHTML(w, mustStaticAsset("index.html"), http.StatusOK)
+	writeHTML(w, page, http.StatusOK)
+}
+
+// IndexJSON describes the enabled endpoints, optionally limited to those
+// with every tag given in the tag query parameter
+func (h *HTTPBin) IndexJSON(w http.ResponseWriter, r *http.Request) {
+	tags, err := parseTagFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	resp := &indexResponse{
+		Endpoints: []indexEndpoint{},
+		Tags:      routeTags,
+	}
+	for _, rt := range h.routes() {
+		if !rt.hasTags(tags) {
+			continue
+		}
+		usage := rt.usage
+		if usage == "" {
+			usage = rt.pattern
+		}
+		resp.Endpoints = append(resp.Endpoints, indexEndpoint{
+			Pattern: rt.pattern,
+			Usage:   usage,
+			Methods: rt.methods,
+			Tags:    rt.tags,
+			Example: rt.example,
+			Params:  h.routeParams(rt.pattern),
+		})
+	}
+	sort.Slice(resp.Endpoints, func(i, j int) bool {
+		return resp.Endpoints[i].Pattern < resp.Endpoints[j].Pattern
+	})
+	writeJSON(http.StatusOK, w, resp)
+}
+
+// Help describes the endpoint serving the path following /help (e.g.
+// /help/drip), including its parameters with the defaults and limits in
+// effect on this instance and example requests against its base URL, as HTML
+// if the client accepts it and JSON otherwise.
+func (h *HTTPBin) Help(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/help")
+	if path == "/" {
+		writeError(w, http.StatusNotFound, errors.New("use /help/{endpoint}, e.g. /help/drip, or see /index.json for every endpoint"))
+		return
+	}
+	routes := h.routes()
+	rt, ok := routeForPath(routes, path)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no endpoint serves %s", path))
+		return
+	}
+
+	usage := rt.usage
+	if usage == "" {
+		usage = rt.pattern
+	}
+	resp := helpResponse{
+		Pattern:     rt.pattern,
+		Usage:       usage,
+		Description: indexDescription(mustStaticAsset("index.html"), routes, rt.pattern),
+		Methods:     rt.methods,
+		Tags:        rt.tags,
+		Params:      h.routeParams(rt.pattern),
+		Examples:    []string{},
+		Limits: helpLimits{
+			MaxBodySize: h.MaxBodySize,
+			MaxDuration: h.MaxDuration.String(),
+		},
+	}
+	if resp.Params == nil {
+		resp.Params = []routeParam{}
+	}
+	if rt.example != "" {
+		method := "GET"
+		if len(rt.methods) > 0 {
+			method = rt.methods[0]
+		}
+		resp.Examples = append(resp.Examples, helpCurlCommand(method, h.helpBaseURL(r)+rt.example))
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		writeHTML(w, renderHelp(resp), http.StatusOK)
+		return
+	}
+	writeJSON(http.StatusOK, w, resp)
 }
 
 // FormsPost renders an HTML form that submits a request to the /post endpoint
@@ -39,21 +151,27 @@ func (h *HTTPBin) FormsPost(w http.ResponseWriter, r *http.Request) {
 
 // UTF8 renders an HTML encoding stress test
 func (h *HTTPBin) UTF8(w http.ResponseWriter, r *http.Request) {
-	writeHTML(w, mustStaticAsset("utf8.html"), http.StatusOK)
+	writeText(w, r, http.StatusOK, htmlContentType, mustStaticAsset("utf8.html"))
 }
 
 // Get handles HTTP GET requests
 func (h *HTTPBin) Get(w http.ResponseWriter, r *http.Request) {
+	h.setCanonicalHeaders(w, r)
 	writeJSON(http.StatusOK, w, &noBodyResponse{
-		Args:    r.URL.Query(),
-		Headers: getRequestHeaders(r),
-		Origin:  getClientIP(r),
-		URL:     getURL(r).String(),
+		Args:      r.URL.Query(),
+		Headers:   getRequestHeaders(r),
+		Origin:    getClientIP(r),
+		URL:       getURL(r).String(),
+		Proto:     r.Proto,
+		Route:     RoutePattern(r),
+		TLS:       getTLSInfo(r),
+		URLLength: h.echoedURLLength(r),
 	})
 }
 
 // Anything returns anything that is passed to request.
 func (h *HTTPBin) Anything(w http.ResponseWriter, r *http.Request) {
+	h.setCanonicalHeaders(w, r)
 	// Short-circuit for HEAD requests, which should be handled like regular
 	// GET requests (where the autohead middleware will take care of discarding
 	// the body)
@@ -68,11 +186,26 @@ func (h *HTTPBin) Anything(w http.ResponseWriter, r *http.Request) {
 
 // RequestWithBody handles POST, PUT, and PATCH requests
 func (h *HTTPBin) RequestWithBody(w http.ResponseWriter, r *http.Request) {
+	h.requestWithBody(w, r, nil, nil)
+}
+
+func (h *HTTPBin) requestWithBody(w http.ResponseWriter, r *http.Request, sample *delaySample, applied *appliedDelay) {
 	resp := &bodyResponse{
-		Args:    r.URL.Query(),
-		Headers: getRequestHeaders(r),
-		Origin:  getClientIP(r),
-		URL:     getURL(r).String(),
+		Args:         r.URL.Query(),
+		Headers:      getRequestHeaders(r),
+		Origin:       getClientIP(r),
+		URL:          getURL(r).String(),
+		Proto:        r.Proto,
+		Route:        RoutePattern(r),
+		TLS:          getTLSInfo(r),
+		URLLength:    h.echoedURLLength(r),
+		Delay:        sample,
+		AppliedDelay: applied,
+	}
+
+	if err := decodeRequestBody(w, r, h.MaxBodySize, resp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	err := parseBody(w, r, resp)
@@ -128,6 +261,43 @@ func (h *HTTPBin) Deflate(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
+// Zstd returns a zstd-encoded response
+func (h *HTTPBin) Zstd(w http.ResponseWriter, r *http.Request) {
+	var body bytes.Buffer
+	mustMarshalJSON(&body, &noBodyResponse{
+		Args:    r.URL.Query(),
+		Headers: getRequestHeaders(r),
+		Origin:  getClientIP(r),
+		Zstd:    true,
+	})
+
+	w.Header().Set("Content-Encoding", "zstd")
+	w.Header().Set("Content-Type", jsonContentType)
+
+	// Small payloads are compressed up front so that Content-Length can be
+	// set, while large ones are streamed to the client block by block.
+	if body.Len() <= maxBufferedZstdPayload {
+		var buf bytes.Buffer
+		zw := zstd.NewWriter(&buf)
+		zw.Write(body.Bytes())
+		zw.Close()
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.WriteHeader(http.StatusOK)
+		w.Write(buf.Bytes())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	zw := zstd.NewWriter(w)
+	if _, err := zw.Write(body.Bytes()); err != nil {
+		annotateWriteError(r, err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		annotateWriteError(r, err)
+	}
+}
+
 // IP echoes the IP address of the incoming request
 func (h *HTTPBin) IP(w http.ResponseWriter, r *http.Request) {
 	writeJSON(http.StatusOK, w, &ipResponse{
@@ -240,36 +410,131 @@ var (
 	}
 )
 
-// Status responds with the specified status code. TODO: support random choice
-// from multiple, optionally weighted status codes.
+// Status responds with the specified status code, or with one chosen at
+// random from a comma-separated list of codes each optionally weighted by a
+// ":weight" suffix, e.g. /status/200:0.7,500:0.2,429:0.1. Codes without a
+// weight have a weight of 1.
+//
+// The response may be customized with ?body=, ?content-type= and repeated
+// ?header=Name:Value parameters, though the headers of special cases like the
+// Location of a redirect still win over user-supplied ones.
 func (h *HTTPBin) Status(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) != 3 {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
-	code, err := strconv.Atoi(parts[2])
+	var code int
+	if strings.ContainsAny(parts[2], ",:") {
+		choices, err := parseWeightedStatuses(parts[2])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		code = pickWeightedStatus(choices, h.randFloat())
+	} else {
+		var err error
+		code, err = strconv.Atoi(parts[2])
+		if err != nil || !isAcceptedStatus(code) {
+			http.Error(w, "Invalid status", http.StatusBadRequest)
+			return
+		}
+	}
+	custom, err := parseStatusCustomization(r.URL.Query(), h.MaxBodySize)
 	if err != nil {
-		http.Error(w, "Invalid status", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	Annotate(r.Context(), "status_code", strconv.Itoa(code))
+	if code >= 500 {
+		classifyError(r, ErrorClassRequested)
+	}
 
+	if !h.reflectHeaders(w, custom.headers) {
+		return
+	}
+	body := custom.body
 	if specialCase, ok := statusSpecialCases[code]; ok {
 		for key, val := range specialCase.headers {
+			// A custom body brings its own content type
+			if body != nil && key == "Content-Type" {
+				continue
+			}
 			w.Header().Set(key, val)
 		}
-		w.WriteHeader(code)
-		if specialCase.body != nil {
-			w.Write(specialCase.body)
+		if body == nil {
+			body = specialCase.body
 		}
-		return
 	}
-
+	if custom.body != nil && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
 	w.WriteHeader(code)
+	// Informational, 204 and 304 responses cannot have a body
+	if body != nil && code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified {
+		w.Write(body)
+	}
+}
+
+// statusCustomization holds the response headers and body requested via
+// /status query parameters.
+type statusCustomization struct {
+	headers http.Header
+	body    []byte
+}
+
+// parseStatusCustomization parses the ?body=, ?content-type= and repeated
+// ?header=Name:Value parameters accepted by /status, rejecting bodies larger
+// than maxBodySize and headers that would allow header injection. The body
+// is nil if none was given.
+func parseStatusCustomization(q url.Values, maxBodySize int64) (statusCustomization, error) {
+	custom := statusCustomization{headers: make(http.Header)}
+	for _, raw := range q["header"] {
+		i := strings.IndexByte(raw, ':')
+		if i < 0 {
+			return custom, fmt.Errorf("invalid header %q: must be of the form Name:Value", raw)
+		}
+		name, value := raw[:i], strings.TrimLeft(raw[i+1:], " \t")
+		if !isHTTPToken(name) {
+			return custom, fmt.Errorf("invalid header name %q", name)
+		}
+		if !isValidHeaderValue(value) {
+			return custom, fmt.Errorf("invalid value for header %s: must not contain control characters", name)
+		}
+		custom.headers.Add(name, value)
+	}
+	if vs, ok := q["content-type"]; ok {
+		if !isValidHeaderValue(vs[0]) {
+			return custom, errors.New("invalid content-type: must not contain control characters")
+		}
+		custom.headers.Set("Content-Type", vs[0])
+	}
+	if vs, ok := q["body"]; ok {
+		if int64(len(vs[0])) > maxBodySize {
+			return custom, fmt.Errorf("body of %d bytes exceeds the limit of %d bytes", len(vs[0]), maxBodySize)
+		}
+		custom.body = []byte(vs[0])
+	}
+	return custom, nil
+}
+
+// Statuses lists every status code accepted by /status, along with how it
+// is handled.
+func (h *HTTPBin) Statuses(w http.ResponseWriter, r *http.Request) {
+	writeJSON(http.StatusOK, w, statusesResponse{Statuses: statusCatalog()})
 }
 
 // Unstable - returns 500, sometimes
+//
+// Given a ?pattern= of F (fail) and S (succeed), e.g. FFS, the outcome is
+// instead deterministic: successive requests for a ?key= follow the pattern,
+// holding on its last state or, with ?repeat=true, cycling through it.
 func (h *HTTPBin) Unstable(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("pattern") != "" {
+		h.doUnstablePattern(w, r)
+		return
+	}
+
 	var err error
 
 	// rng/seed
@@ -295,19 +560,226 @@ func (h *HTTPBin) Unstable(w http.ResponseWriter, r *http.Request) {
 	var status int
 	if rng.Float64() < failureRate {
 		status = http.StatusInternalServerError
+		classifyError(r, ErrorClassInjected)
 	} else {
 		status = http.StatusOK
 	}
 	w.WriteHeader(status)
 }
 
+// doUnstablePattern serves /unstable?pattern=, failing or succeeding as the
+// next position in the pattern for the request's key dictates.
+func (h *HTTPBin) doUnstablePattern(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	pattern := strings.ToUpper(q.Get("pattern"))
+	if len(pattern) > maxUnstablePatternLength || strings.Trim(pattern, "FS") != "" {
+		writeParamError(w, "pattern", fmt.Errorf("must be 1-%d of the letters F and S", maxUnstablePatternLength))
+		return
+	}
+	key := q.Get("key")
+	if key == "" {
+		key = "default"
+	}
+	if !isSlug(key) {
+		writeParamError(w, "key", errors.New("must be 1-32 letters, digits, dashes, or underscores"))
+		return
+	}
+	repeat := false
+	if raw := q.Get("repeat"); raw != "" {
+		var err error
+		repeat, err = strconv.ParseBool(raw)
+		if err != nil {
+			writeParamError(w, "repeat", errors.New("must be a boolean"))
+			return
+		}
+	}
+
+	requests, err := h.unstableCounters.next(key)
+	if err != nil {
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	var i int
+	if repeat {
+		i = int((requests - 1) % int64(len(pattern)))
+	} else if requests < int64(len(pattern)) {
+		i = int(requests - 1)
+	} else {
+		i = len(pattern) - 1
+	}
+
+	outcome, status := "succeed", http.StatusOK
+	if pattern[i] == 'F' {
+		outcome, status = "fail", http.StatusInternalServerError
+		classifyError(r, ErrorClassInjected)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(status, w, unstablePatternResponse{
+		Key:      key,
+		Pattern:  pattern,
+		Repeat:   repeat,
+		Requests: requests,
+		Position: i + 1,
+		Outcome:  outcome,
+		Status:   status,
+	})
+}
+
+// Retry fails the first n requests for a key, with a 503 or the given
+// ?status_code=, and succeeds afterwards, so that clients' retry logic can be
+// exercised. Keys are forgotten once they have not been requested for ten
+// minutes, and a DELETE request resets a key's count.
+//
+// /retry/<key>/<n>
+func (h *HTTPBin) Retry(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("go-httpbin does not handle the path %s, use /retry/{key}/{n}", r.URL.Path))
+		return
+	}
+	key := parts[2]
+	if !isSlug(key) {
+		writeParamError(w, "key", errors.New("must be 1-32 letters, digits, dashes, or underscores"))
+		return
+	}
+	failures, err := strconv.Atoi(parts[3])
+	if err != nil || failures < 0 || failures > maxRetryFailures {
+		writeParamError(w, "n", fmt.Errorf("must be an integer in [0, %d]", maxRetryFailures))
+		return
+	}
+
+	if r.Method == "DELETE" {
+		h.retryCounters.delete(key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	failureStatus, err := parseBoundedInt(r.URL.Query().Get("status_code"), http.StatusServiceUnavailable, 400, 599)
+	if err != nil {
+		writeParamError(w, "status_code", err)
+		return
+	}
+
+	attempt, err := h.retryCounters.next(key)
+	if err != nil {
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	resp := retryResponse{
+		Key:       key,
+		Attempt:   attempt,
+		Failures:  failures,
+		Succeeded: attempt > int64(failures),
+		Status:    http.StatusOK,
+	}
+	if !resp.Succeeded {
+		resp.RemainingFailures = int64(failures) - attempt
+		resp.Status = failureStatus
+		if failureStatus >= 500 {
+			classifyError(r, ErrorClassInjected)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(resp.Status, w, resp)
+}
+
+// UnstableSchedule fails on a fixed schedule rather than at random, being
+// "down" for the first down_for of every period (defaulting to 30s of every
+// 5m) as measured from the Unix epoch. Because the phase is derived purely
+// from the current time, every replica agrees on it without coordination.
+func (h *HTTPBin) UnstableSchedule(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var (
+		period       = 5 * time.Minute
+		downFor      = 30 * time.Second
+		downStatus   = http.StatusServiceUnavailable
+		statusWhenUp = http.StatusOK
+
+		err error
+	)
+
+	if rawPeriod := q.Get("period"); rawPeriod != "" {
+		period, err = parseDuration(rawPeriod)
+		if err != nil || period <= 0 {
+			http.Error(w, "Invalid period", http.StatusBadRequest)
+			return
+		}
+	}
+	if rawDownFor := q.Get("down_for"); rawDownFor != "" {
+		downFor, err = parseDuration(rawDownFor)
+		if err != nil || downFor < 0 {
+			http.Error(w, "Invalid down_for", http.StatusBadRequest)
+			return
+		}
+	}
+	if downFor > period {
+		http.Error(w, "down_for must not exceed period", http.StatusBadRequest)
+		return
+	}
+	if rawStatus := q.Get("down_status"); rawStatus != "" {
+		downStatus, err = strconv.Atoi(rawStatus)
+		if err != nil || downStatus < 200 || downStatus > 599 {
+			http.Error(w, "Invalid down_status", http.StatusBadRequest)
+			return
+		}
+	}
+	if rawStatus := q.Get("status_when_up"); rawStatus != "" {
+		statusWhenUp, err = strconv.Atoi(rawStatus)
+		if err != nil || statusWhenUp < 200 || statusWhenUp > 599 {
+			http.Error(w, "Invalid status_when_up", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := h.now()
+	elapsed := time.Duration(now.UnixNano() % int64(period))
+
+	phase, status, untilNext := "up", statusWhenUp, period-elapsed
+	if elapsed < downFor {
+		phase, status, untilNext = "down", downStatus, downFor-elapsed
+		if status >= 500 {
+			classifyError(r, ErrorClassInjected)
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(untilNext.Seconds())), 10))
+	}
+
+	// Some statuses forbid a response body
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(status, w, unstableScheduleResponse{
+		Phase:            phase,
+		Status:           status,
+		Period:           period.String(),
+		DownFor:          downFor.String(),
+		NextTransitionIn: untilNext.String(),
+		NextTransitionAt: now.Add(untilNext).UTC().Format(time.RFC3339Nano),
+	})
+}
+
 // ResponseHeaders responds with a map of header values
 func (h *HTTPBin) ResponseHeaders(w http.ResponseWriter, r *http.Request) {
 	args := r.URL.Query()
-	for k, vs := range args {
-		for _, v := range vs {
-			w.Header().Add(k, v)
+	// ?server_header= overrides any configured Server header, suppressing it
+	// if empty
+	if vs, ok := args["server_header"]; ok {
+		value := vs[0]
+		if !isValidHeaderValue(value) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid server_header %q", value))
+			return
 		}
+		delete(args, "server_header")
+		delete(args, "Server")
+		w.Header()["Server"] = nil
+		if value != "" {
+			args["Server"] = []string{value}
+		}
+	}
+	if !h.reflectHeaders(w, http.Header(args)) {
+		return
 	}
 	if contentType := w.Header().Get("Content-Type"); contentType == "" {
 		w.Header().Set("Content-Type", jsonContentType)
@@ -339,7 +811,7 @@ func redirectLocation(r *http.Request, relative bool, n int) string {
 	return location
 }
 
-func doRedirect(w http.ResponseWriter, r *http.Request, relative bool) {
+func (h *HTTPBin) doRedirect(w http.ResponseWriter, r *http.Request, relative bool) {
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) != 3 {
 		http.Error(w, "Not found", http.StatusNotFound)
@@ -350,6 +822,8 @@ func doRedirect(w http.ResponseWriter, r *http.Request, relative bool) {
 		http.Error(w, "Invalid redirect", http.StatusBadRequest)
 		return
 	}
+	Annotate(r.Context(), "redirects_remaining", strconv.Itoa(n-1))
+	h.setCanonicalHeaders(w, r)
 
 	w.Header().Set("Location", redirectLocation(r, relative, n-1))
 	w.WriteHeader(http.StatusFound)
@@ -361,17 +835,90 @@ func doRedirect(w http.ResponseWriter, r *http.Request, relative bool) {
 func (h *HTTPBin) Redirect(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
 	relative := strings.ToLower(params.Get("absolute")) != "true"
-	doRedirect(w, r, relative)
+	h.doRedirect(w, r, relative)
 }
 
 // RelativeRedirect responds with an HTTP 302 redirect a given number of times
 func (h *HTTPBin) RelativeRedirect(w http.ResponseWriter, r *http.Request) {
-	doRedirect(w, r, true)
+	h.doRedirect(w, r, true)
 }
 
 // AbsoluteRedirect responds with an HTTP 302 redirect a given number of times
 func (h *HTTPBin) AbsoluteRedirect(w http.ResponseWriter, r *http.Request) {
-	doRedirect(w, r, false)
+	h.doRedirect(w, r, false)
+}
+
+// RedirectLoop responds with a redirect that cycles forever through the
+// hops given in the ?via query param (defaulting to a,b,c), so that clients'
+// redirect limits can be tested against a genuine loop. Each hop is served by
+// /redirect-loop/{hop} and reports how many hops have been followed so far
+// in the X-Redirect-Hop header.
+func (h *HTTPBin) RedirectLoop(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	via := []string{"a", "b", "c"}
+	if rawVia := q.Get("via"); rawVia != "" {
+		via = strings.Split(rawVia, ",")
+	}
+	if len(via) > maxRedirectLoopHops {
+		http.Error(w, fmt.Sprintf("Invalid via: at most %d hops allowed", maxRedirectLoopHops), http.StatusBadRequest)
+		return
+	}
+	for _, hop := range via {
+		if !isSlug(hop) {
+			http.Error(w, fmt.Sprintf("Invalid via: hop %q must be 1-32 alphanumeric, dash, or underscore characters", hop), http.StatusBadRequest)
+			return
+		}
+	}
+
+	statusCode := http.StatusFound
+	if rawStatus := q.Get("status"); rawStatus != "" {
+		var err error
+		statusCode, err = strconv.Atoi(rawStatus)
+		if err != nil || !isRedirectStatus(statusCode) {
+			http.Error(w, "Invalid status, must be one of 301, 302, 303, 307, or 308", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The entry point is hop 0, and each hop redirects to the hop after its
+	// own position in via, wrapping around at the end.
+	hopCount := 0
+	next := 0
+	if current := strings.TrimPrefix(r.URL.Path, "/redirect-loop"); current != "" {
+		current = strings.TrimPrefix(current, "/")
+		pos := -1
+		for i, hop := range via {
+			if hop == current {
+				pos = i
+				break
+			}
+		}
+		if pos == -1 {
+			http.Error(w, fmt.Sprintf("Not found: hop %q is not in via", current), http.StatusNotFound)
+			return
+		}
+		next = (pos + 1) % len(via)
+
+		var err error
+		hopCount, err = strconv.Atoi(q.Get("hop"))
+		if err != nil || hopCount < 1 {
+			http.Error(w, "Invalid hop, must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	Annotate(r.Context(), "redirect_hop", strconv.Itoa(hopCount))
+
+	nextQuery := url.Values{}
+	nextQuery.Set("via", strings.Join(via, ","))
+	nextQuery.Set("status", strconv.Itoa(statusCode))
+	nextQuery.Set("hop", strconv.Itoa(hopCount+1))
+
+	if !h.reflectHeaders(w, http.Header{"Location": {"/redirect-loop/" + via[next] + "?" + nextQuery.Encode()}}) {
+		return
+	}
+	w.Header().Set("X-Redirect-Hop", strconv.Itoa(hopCount))
+	w.WriteHeader(statusCode)
 }
 
 // RedirectTo responds with a redirect to a specific URL with an optional
@@ -392,7 +939,7 @@ func (h *HTTPBin) RedirectTo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if u.IsAbs() && len(h.AllowedRedirectDomains) > 0 {
-		if _, ok := h.AllowedRedirectDomains[u.Hostname()]; !ok {
+		if !h.redirectDomainAllowed(u.Host) {
 			domainListItems := make([]string, 0, len(h.AllowedRedirectDomains))
 			for domain := range h.AllowedRedirectDomains {
 				domainListItems = append(domainListItems, fmt.Sprintf("- %s", domain))
@@ -412,13 +959,22 @@ Allowed redirect destinations:
 	rawStatusCode := q.Get("status_code")
 	if rawStatusCode != "" {
 		statusCode, err = strconv.Atoi(q.Get("status_code"))
-		if err != nil || statusCode < 300 || statusCode > 399 {
-			http.Error(w, "Invalid status code", http.StatusBadRequest)
+		switch {
+		case err != nil || statusCode < 300 || statusCode > 399:
+			writeParamError(w, "status_code", errors.New("must be a redirect status code between 300 and 399"))
+			return
+		case statusCode == http.StatusNotModified:
+			writeParamError(w, "status_code", errors.New("304 Not Modified answers a conditional request and is not followed as a redirect"))
+			return
+		case statusCode == 306:
+			writeParamError(w, "status_code", errors.New("306 is reserved and no longer used"))
 			return
 		}
 	}
 
-	w.Header().Set("Location", u.String())
+	if !h.reflectHeaders(w, http.Header{"Location": {u.String()}}) {
+		return
+	}
 	w.WriteHeader(statusCode)
 }
 
@@ -433,14 +989,42 @@ func (h *HTTPBin) Cookies(w http.ResponseWriter, r *http.Request) {
 
 // SetCookies sets cookies as specified in query params and redirects to
 // Cookies endpoint
+//
+// The __path, __domain, __max_age, __secure, __httponly and __samesite
+// params set those attributes on every cookie. Alternatively, a POST with a
+// JSON body may list cookies, each with its own attributes, e.g.
+//
+//	[{"name": "k", "value": "v", "path": "/", "secure": true, "samesite": "strict"}]
 func (h *HTTPBin) SetCookies(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
-	for k := range params {
-		http.SetCookie(w, &http.Cookie{
-			Name:     k,
-			Value:    params.Get(k),
-			HttpOnly: true,
-		})
+	var specs []cookieSpec
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Method == "POST" && mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&specs); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid cookies: %w", err))
+			return
+		}
+	} else {
+		var (
+			param string
+			err   error
+		)
+		specs, param, err = parseCookieQuery(r.URL.Query())
+		if err != nil {
+			writeParamError(w, param, err)
+			return
+		}
+	}
+
+	cookies := make([]*http.Cookie, 0, len(specs))
+	for _, spec := range specs {
+		c, err := spec.cookie()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid cookie %q: %w", spec.Name, err))
+			return
+		}
+		cookies = append(cookies, c)
+	}
+	if !h.reflectCookies(w, cookies) {
+		return
 	}
 	w.Header().Set("Location", "/cookies")
 	w.WriteHeader(http.StatusFound)
@@ -448,16 +1032,44 @@ func (h *HTTPBin) SetCookies(w http.ResponseWriter, r *http.Request) {
 
 // DeleteCookies deletes cookies specified in query params and redirects to
 // Cookies endpoint
+//
+// The __path and __domain params scope the expirations to match cookies set
+// with those attributes, and all=true deletes every cookie in the request.
+// Alternatively, a POST with a JSON body may list cookies, each with its own
+// scope, e.g.
+//
+//	[{"name": "k", "path": "/foo", "domain": "example.com"}]
 func (h *HTTPBin) DeleteCookies(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
-	for k := range params {
-		http.SetCookie(w, &http.Cookie{
-			Name:     k,
-			Value:    params.Get(k),
-			HttpOnly: true,
-			MaxAge:   -1,
-			Expires:  time.Now().Add(-1 * 24 * 365 * time.Hour),
-		})
+	var specs []cookieSpec
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Method == "POST" && mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&specs); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid cookies: %w", err))
+			return
+		}
+	} else {
+		var (
+			param string
+			err   error
+		)
+		specs, param, err = parseDeleteCookiesQuery(r.URL.Query(), r.Cookies())
+		if err != nil {
+			writeParamError(w, param, err)
+			return
+		}
+	}
+
+	now := h.now()
+	cookies := make([]*http.Cookie, 0, len(specs))
+	for _, spec := range specs {
+		c, err := spec.expiredCookie(now)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid cookie %q: %w", spec.Name, err))
+			return
+		}
+		cookies = append(cookies, c)
+	}
+	if !h.reflectCookies(w, cookies) {
+		return
 	}
 	w.Header().Set("Location", "/cookies")
 	w.WriteHeader(http.StatusFound)
@@ -477,6 +1089,7 @@ func (h *HTTPBin) BasicAuth(w http.ResponseWriter, r *http.Request) {
 
 	status := http.StatusOK
 	authorized := givenUser == expectedUser && givenPass == expectedPass
+	annotateAuth(r, givenUser, authorized)
 	if !authorized {
 		status = http.StatusUnauthorized
 		w.Header().Set("WWW-Authenticate", `Basic realm="Fake Realm"`)
@@ -502,6 +1115,7 @@ func (h *HTTPBin) HiddenBasicAuth(w http.ResponseWriter, r *http.Request) {
 	givenUser, givenPass, _ := r.BasicAuth()
 
 	authorized := givenUser == expectedUser && givenPass == expectedPass
+	annotateAuth(r, givenUser, authorized)
 	if !authorized {
 		http.Error(w, "Not Found", http.StatusNotFound)
 		return
@@ -513,14 +1127,118 @@ func (h *HTTPBin) HiddenBasicAuth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Stream responds with max(n, 100) lines of JSON-encoded request data.
-func (h *HTTPBin) Stream(w http.ResponseWriter, r *http.Request) {
+// ExpectContinueAuth requires HTTP Basic authentication for uploads, so that
+// clients can be tested against an auth challenge to an Expect: 100-continue
+// request. Authorized requests are sent 100 Continue as their body is read.
+// Unauthorized ones are sent the 401 challenge without 100 Continue, after
+// which the server keeps reading for ?wait= (250ms by default) to count any
+// body bytes the client sends regardless, which a compliant client will not.
+// Both report how many body bytes arrived.
+//
+// Counting the bytes sent after a challenge requires hijacking the
+// connection, so over HTTP/2 the 401 reports none.
+func (h *HTTPBin) ExpectContinueAuth(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) != 3 {
-		http.Error(w, "Not found", http.StatusNotFound)
+	if len(parts) != 4 {
+		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
-	n, err := strconv.Atoi(parts[2])
+	wait := defaultExpectContinueWait
+	if raw := r.URL.Query().Get("wait"); raw != "" {
+		var err error
+		wait, err = parseBoundedDuration(raw, 0, h.MaxDuration)
+		if err != nil {
+			writeParamError(w, "wait", err)
+			return
+		}
+	}
+
+	givenUser, givenPass, _ := r.BasicAuth()
+	authorized := givenUser == parts[2] && givenPass == parts[3]
+	annotateAuth(r, givenUser, authorized)
+
+	resp := expectContinueAuthResponse{
+		Authorized:     authorized,
+		User:           givenUser,
+		ExpectContinue: strings.EqualFold(r.Header.Get("Expect"), "100-continue"),
+	}
+	if r.ContentLength >= 0 {
+		resp.DeclaredLength = &r.ContentLength
+	}
+
+	if authorized {
+		// The server sends 100 Continue on the first read of the body
+		resp.ContinueSent = resp.ExpectContinue && r.ContentLength != 0
+		n, err := io.Copy(io.Discard, io.LimitReader(r.Body, h.MaxBodySize+1))
+		resp.BodyBytesReceived = n
+		Annotate(r.Context(), "expect_continue_body_bytes", strconv.FormatInt(n, 10))
+		switch {
+		case n > h.MaxBodySize:
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds the limit of %d bytes", h.MaxBodySize))
+		case err != nil:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("error reading request body: %w", err))
+		default:
+			writeJSON(http.StatusOK, w, resp)
+		}
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="Fake Realm"`)
+	if r.ProtoMajor != 1 {
+		writeJSON(http.StatusUnauthorized, w, resp)
+		return
+	}
+	conn, buf, err := hijack(w)
+	if err != nil {
+		http.Error(w, "Not implemented: connection cannot be hijacked", http.StatusNotImplemented)
+		return
+	}
+	defer conn.Close()
+
+	// Send the challenge immediately, holding back the response body until
+	// the wait is over so that it can report what arrived in the meantime
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("Connection", "close")
+	buf.WriteString("HTTP/1.1 401 Unauthorized\r\n")
+	if err = w.Header().Write(buf); err == nil {
+		buf.WriteString("\r\n")
+		err = buf.Flush()
+	}
+	if err != nil {
+		annotateWriteError(r, err)
+		return
+	}
+
+	var body io.Reader = buf.Reader
+	switch {
+	case r.ContentLength >= 0:
+		body = io.LimitReader(body, r.ContentLength)
+	case len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked":
+		body = httputil.NewChunkedReader(body)
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	resp.BodyBytesReceived, _ = io.Copy(io.Discard, io.LimitReader(body, h.MaxBodySize))
+	Annotate(r.Context(), "expect_continue_body_bytes", strconv.FormatInt(resp.BodyBytesReceived, 10))
+
+	buf.Write(mustMarshalCompactJSON(resp))
+	if err := buf.Flush(); err != nil {
+		annotateWriteError(r, err)
+	}
+}
+
+// Stream responds with max(n, 100) lines of JSON-encoded request data.
+//
+// With ?shape=burst, lines are instead delivered in bursts of burst_size
+// lines (defaulting to 10) separated by idle periods of burst_interval
+// (defaulting to 1s), optionally limited to count bursts. During idle
+// periods, an empty keepalive line may be sent every keepalive interval.
+func (h *HTTPBin) Stream(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	n, err := strconv.Atoi(parts[2])
 	if err != nil {
 		http.Error(w, "Invalid integer", http.StatusBadRequest)
 		return
@@ -532,25 +1250,92 @@ func (h *HTTPBin) Stream(w http.ResponseWriter, r *http.Request) {
 		n = 1
 	}
 
+	q := r.URL.Query()
+	var (
+		burstSize     = n
+		burstInterval = time.Second
+		keepalive     time.Duration
+	)
+	switch q.Get("shape") {
+	case "", "smooth":
+	case "burst":
+		burstSize = 10
+		if userBurstSize := q.Get("burst_size"); userBurstSize != "" {
+			burstSize, err = strconv.Atoi(userBurstSize)
+			if err != nil || burstSize < 1 {
+				http.Error(w, "Invalid burst_size", http.StatusBadRequest)
+				return
+			}
+		}
+		if userInterval := q.Get("burst_interval"); userInterval != "" {
+			burstInterval, err = parseBoundedDuration(userInterval, 0, h.MaxDuration)
+			if err != nil {
+				http.Error(w, "Invalid burst_interval", http.StatusBadRequest)
+				return
+			}
+		}
+		if userCount := q.Get("count"); userCount != "" {
+			count, err := strconv.Atoi(userCount)
+			if err != nil || count < 1 {
+				http.Error(w, "Invalid count", http.StatusBadRequest)
+				return
+			}
+			if count*burstSize < n {
+				n = count * burstSize
+			}
+		}
+		if userKeepalive := q.Get("keepalive"); userKeepalive != "" {
+			keepalive, err = parseBoundedDuration(userKeepalive, time.Millisecond, h.MaxDuration)
+			if err != nil {
+				http.Error(w, "Invalid keepalive", http.StatusBadRequest)
+				return
+			}
+		}
+		bursts := (n + burstSize - 1) / burstSize
+		if time.Duration(bursts-1)*burstInterval > h.MaxDuration {
+			http.Error(w, "Too much time", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Invalid shape, must be smooth or burst", http.StatusBadRequest)
+		return
+	}
+
 	resp := &streamResponse{
-		Args:    r.URL.Query(),
+		Args:    q,
 		Headers: getRequestHeaders(r),
 		Origin:  getClientIP(r),
 		URL:     getURL(r).String(),
 	}
 
-	f := w.(http.Flusher)
-	for i := 0; i < n; i++ {
+	lines := make([][]byte, n)
+	var intended int64
+	for i := range lines {
 		resp.ID = i
 		// Call json.Marshal directly to avoid pretty printing
 		line, _ := json.Marshal(resp)
-		w.Write(append(line, '\n'))
-		f.Flush()
+		lines[i] = append(line, '\n')
+		intended += int64(len(lines[i]))
+	}
+	annotateIntendedBytes(r, intended)
+
+	for i, line := range lines {
+		if i > 0 && i%burstSize == 0 && !idle(w, r, burstInterval, keepalive) {
+			return
+		}
+		if err := writeAndFlush(w, line); err != nil {
+			annotateWriteError(r, err)
+			return
+		}
 	}
 }
 
 // Delay waits for a given amount of time before responding, where the time may
-// be specified as a golang-style duration or seconds in floating point.
+// be specified as a golang-style duration or seconds in floating point, or as
+// a range like /delay/100ms-2s from which a delay is chosen uniformly at
+// random, reproducibly given a ?seed=. Delays longer than MaxDuration are
+// clamped to it, as is the upper end of a range, and the delay actually
+// applied is reported in the response.
 func (h *HTTPBin) Delay(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) != 3 {
@@ -558,39 +1343,323 @@ func (h *HTTPBin) Delay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	delay, err := parseBoundedDuration(parts[2], 0, h.MaxDuration)
+	low, high, isRange, err := parseDelayRange(parts[2])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if low < 0 || high < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid delay %q: must not be negative", parts[2]))
+		return
+	}
+	if low > high {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid delay range %q: min must not exceed max", parts[2]))
+		return
+	}
+	q := r.URL.Query()
+	clamped := high > h.MaxDuration
+
+	requested := low
+	var requestedRange *delayRange
+	if isRange {
+		if q.Get("jitter") != "" || q.Get("distribution") != "" {
+			writeError(w, http.StatusBadRequest, errors.New("a delay range cannot be combined with jitter"))
+			return
+		}
+		rng, err := parseSeed(q.Get("seed"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid seed: %w", err))
+			return
+		}
+		requestedRange = &delayRange{MinMS: low.Seconds() * 1e3, MaxMS: high.Seconds() * 1e3}
+		// Sample from the range with its upper end clamped to MaxDuration
+		if clamped {
+			high = h.MaxDuration
+			if low > high {
+				low = high
+			}
+		}
+		requested = low + time.Duration(rng.Int63n(int64(high-low)+1))
+	}
+	delay := requested
+	if delay > h.MaxDuration {
+		delay = h.MaxDuration
+	}
+
+	sample, err := h.parseDelaySample(q, delay)
 	if err != nil {
-		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	if sample != nil {
+		Annotate(r.Context(), "delay_base", delay.String())
+		delay = sample.sampled
+	}
+	applied := &appliedDelay{
+		Range:       requestedRange,
+		RequestedMS: requested.Seconds() * 1e3,
+		AppliedMS:   delay.Seconds() * 1e3,
+		Clamped:     clamped || (sample != nil && sample.Clamped),
+	}
 
+	Annotate(r.Context(), "delay_requested", requested.String())
+	stopSleep := getTimingRecorder(r).phase("sleep")
+	start := time.Now()
 	select {
 	case <-r.Context().Done():
+		Annotate(r.Context(), "delay_actual", time.Since(start).String())
 		w.WriteHeader(499) // "Client Closed Request" https://httpstatuses.com/499
 		return
 	case <-time.After(delay):
 	}
-	h.RequestWithBody(w, r)
+	Annotate(r.Context(), "delay_actual", time.Since(start).String())
+	stopSleep()
+	h.requestWithBody(w, r, sample, applied)
+}
+
+// parseDelaySample samples a jittered delay around the base delay according
+// to the ?jitter=, ?distribution=, ?seed=, and ?clamp= query params, or returns
+// nil if neither jitter nor a distribution was requested.
+//
+// Unless clamping is requested, it is an error for the largest delay the
+// distribution may produce to exceed MaxDuration.
+func (h *HTTPBin) parseDelaySample(q url.Values, base time.Duration) (*delaySample, error) {
+	rawJitter, distribution := q.Get("jitter"), q.Get("distribution")
+	if rawJitter == "" && distribution == "" {
+		return nil, nil
+	}
+
+	var jitter time.Duration
+	if rawJitter != "" {
+		var err error
+		jitter, err = parseBoundedDuration(rawJitter, 0, h.MaxDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jitter: %w", err)
+		}
+	}
+	if distribution == "" {
+		distribution = delayDistributionUniform
+	}
+	if _, ok := delayJitterSpread[distribution]; !ok {
+		return nil, fmt.Errorf("invalid distribution %q: must be one of uniform, normal, or exponential", distribution)
+	}
+	var clamp bool
+	if rawClamp := q.Get("clamp"); rawClamp != "" {
+		var err error
+		clamp, err = strconv.ParseBool(rawClamp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clamp: %w", err)
+		}
+	}
+	rng, err := parseSeed(q.Get("seed"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed: %w", err)
+	}
+
+	max := maxJitteredDelay(distribution, base, jitter)
+	if max > h.MaxDuration && !clamp {
+		return nil, fmt.Errorf("delay %s with %s jitter of %s may reach %s, longer than %s; use clamp=true to cap it", base, distribution, jitter, max, h.MaxDuration)
+	}
+
+	sampled := sampleDelay(rng, distribution, base, jitter)
+	clamped := sampled > h.MaxDuration
+	if clamped {
+		sampled = h.MaxDuration
+	}
+	return &delaySample{
+		Distribution: distribution,
+		BaseMS:       base.Seconds() * 1e3,
+		JitterMS:     jitter.Seconds() * 1e3,
+		MaxMS:        max.Seconds() * 1e3,
+		SampledMS:    sampled.Seconds() * 1e3,
+		Clamped:      clamped,
+		sampled:      sampled,
+	}, nil
+}
+
+// Degraded reports the synthetic health of the components given by
+// ?components=name:state,... (where state is up, slow, or down) and sets an
+// X-Degraded header saying whether any component is unhealthy, so clients
+// that react to degradation signals rather than status codes have a
+// deterministic target. The response is a 200 unless a ?status_when=
+// rule such as db:down=503 maps a component's state to another status, and
+// ?slow_latency= adds the given delay for each slow component.
+func (h *HTTPBin) Degraded(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	components, err := parseDegradedComponents(q.Get("components"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid components: %w", err))
+		return
+	}
+	rules, err := parseDegradedStatusRules(q.Get("status_when"), components)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid status_when: %w", err))
+		return
+	}
+
+	var degraded bool
+	var slow int64
+	for _, c := range components {
+		degraded = degraded || c.Status != degradedUp
+		if c.Status == degradedSlow {
+			slow++
+		}
+	}
+
+	var latency time.Duration
+	if raw := q.Get("slow_latency"); raw != "" {
+		perComponent, err := parseBoundedDuration(raw, 0, h.MaxDuration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid slow_latency: %w", err))
+			return
+		}
+		latency = perComponent * time.Duration(slow)
+		if latency > h.MaxDuration {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("total latency %s for %d slow components longer than %s", latency, slow, h.MaxDuration))
+			return
+		}
+	}
+
+	status := http.StatusOK
+	for _, rule := range rules {
+		if components[rule.component].Status == rule.state {
+			status = rule.status
+			break
+		}
+	}
+
+	if latency > 0 {
+		stopSleep := getTimingRecorder(r).phase("sleep")
+		select {
+		case <-r.Context().Done():
+			w.WriteHeader(499) // "Client Closed Request" https://httpstatuses.com/499
+			return
+		case <-time.After(latency):
+		}
+		stopSleep()
+	}
+
+	list := make([]degradedComponent, 0, len(components))
+	for _, c := range components {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].index < list[j].index })
+
+	if status >= 500 {
+		classifyError(r, ErrorClassRequested)
+	}
+	w.Header().Set("X-Degraded", strconv.FormatBool(degraded))
+	writeJSON(status, w, degradedResponse{
+		Degraded:   degraded,
+		Components: list,
+		LatencyMS:  latency.Milliseconds(),
+	})
+}
+
+// SlowReader reads the request body at no more than ?rate= bytes per second
+// (default 1024), in small chunks separated by sleeps, so that clients with
+// upload timeouts can be tested against a slow-consuming server. It reports
+// the bytes received and the time taken, which the Observer also records via
+// Result.RequestSize if the client gives up first.
+//
+// Reading stops after MaxDuration, in which case the response has the status
+// given by ?timeout_status= (default 408) and the connection is closed. The
+// deadline is checked between reads, so a single read from a client that has
+// stalled entirely is bounded only by the server's own read timeout.
+func (h *HTTPBin) SlowReader(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	// Any faster than reading the largest allowed body in one second isn't
+	// usefully slow
+	rate, err := parseBoundedInt(q.Get("rate"), defaultSlowReaderRate, 1, int(h.MaxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid rate: %w", err))
+		return
+	}
+	timeoutStatus, err := parseBoundedInt(q.Get("timeout_status"), http.StatusRequestTimeout, 400, 599)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout_status: %w", err))
+		return
+	}
+
+	body := r.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	chunk := make([]byte, slowReaderChunkSize(rate))
+	deadline := time.NewTimer(h.MaxDuration)
+	defer deadline.Stop()
+	start := time.Now()
+	resp := slowReaderResponse{Rate: rate}
+	outcome := ""
+	for outcome == "" {
+		n, err := body.Read(chunk)
+		resp.BytesReceived += int64(n)
+		switch {
+		case err == io.EOF:
+			outcome = "completed"
+			continue
+		case err != nil && resp.BytesReceived >= h.MaxBodySize:
+			outcome = "too_large"
+			continue
+		case err != nil:
+			outcome = "client_gone"
+			continue
+		}
+
+		// Sleep until the bytes received so far are due at the given rate
+		due := time.Duration(float64(resp.BytesReceived) / float64(rate) * float64(time.Second))
+		select {
+		case <-time.After(due - time.Since(start)):
+		case <-deadline.C:
+			outcome = "timeout"
+		case <-r.Context().Done():
+			outcome = "client_gone"
+		}
+	}
+	resp.ElapsedMS = time.Since(start).Seconds() * 1e3
+	Annotate(r.Context(), "slow_reader_bytes", strconv.FormatInt(resp.BytesReceived, 10))
+	Annotate(r.Context(), "slow_reader_outcome", outcome)
+
+	switch outcome {
+	case "timeout":
+		resp.TimedOut = true
+		w.Header().Set("Connection", "close")
+		writeJSON(timeoutStatus, w, resp)
+	case "too_large":
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds the limit of %d bytes", h.MaxBodySize))
+	case "client_gone":
+		w.WriteHeader(499) // "Client Closed Request" https://httpstatuses.com/499
+	default:
+		writeJSON(http.StatusOK, w, resp)
+	}
 }
 
 // Drip returns data over a duration after an optional initial delay, then
 // (optionally) returns with the given status code.
+//
+// By default the status and headers are sent before the initial delay; with
+// delay_before_headers=true they are held back until it has elapsed, to
+// simulate a server that is slow to respond at all.
 func (h *HTTPBin) Drip(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 
 	var (
-		duration = h.DefaultParams.DripDuration
-		delay    = h.DefaultParams.DripDelay
-		numBytes = h.DefaultParams.DripNumBytes
+		defaults = h.currentSettings().DefaultParams
+		duration = defaults.DripDuration
+		delay    = defaults.DripDelay
+		numBytes = defaults.DripNumBytes
 		code     = http.StatusOK
 
+		delayBeforeHeaders bool
+
 		err error
 	)
 
 	if userDuration := q.Get("duration"); userDuration != "" {
 		duration, err = parseBoundedDuration(userDuration, 0, h.MaxDuration)
 		if err != nil {
-			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			writeParamError(w, "duration", err)
 			return
 		}
 	}
@@ -598,15 +1667,19 @@ func (h *HTTPBin) Drip(w http.ResponseWriter, r *http.Request) {
 	if userDelay := q.Get("delay"); userDelay != "" {
 		delay, err = parseBoundedDuration(userDelay, 0, h.MaxDuration)
 		if err != nil {
-			http.Error(w, "Invalid delay", http.StatusBadRequest)
+			writeParamError(w, "delay", err)
 			return
 		}
 	}
 
 	if userNumBytes := q.Get("numbytes"); userNumBytes != "" {
 		numBytes, err = strconv.ParseInt(userNumBytes, 10, 64)
-		if err != nil || numBytes <= 0 || numBytes > h.MaxBodySize {
-			http.Error(w, "Invalid numbytes", http.StatusBadRequest)
+		if err != nil {
+			writeParamError(w, "numbytes", errors.New("must be an integer"))
+			return
+		}
+		if numBytes < 0 || numBytes > h.MaxBodySize {
+			writeParamError(w, "numbytes", fmt.Errorf("must be between 0 and %d", h.MaxBodySize))
 			return
 		}
 	}
@@ -614,34 +1687,65 @@ func (h *HTTPBin) Drip(w http.ResponseWriter, r *http.Request) {
 	if userCode := q.Get("code"); userCode != "" {
 		code, err = strconv.Atoi(userCode)
 		if err != nil || code < 100 || code >= 600 {
-			http.Error(w, "Invalid code", http.StatusBadRequest)
+			writeParamError(w, "code", errors.New("must be an HTTP status code between 100 and 599"))
+			return
+		}
+	}
+
+	if userDelayBeforeHeaders := q.Get("delay_before_headers"); userDelayBeforeHeaders != "" {
+		delayBeforeHeaders, err = strconv.ParseBool(userDelayBeforeHeaders)
+		if err != nil {
+			writeParamError(w, "delay_before_headers", errors.New("must be a boolean"))
 			return
 		}
 	}
 
+	// With no bytes to drip there is nothing to spread over the duration
+	if numBytes == 0 && duration > 0 {
+		writeParamError(w, "numbytes", fmt.Errorf("must be positive to drip over a duration of %s", duration))
+		return
+	}
+
 	if duration+delay > h.MaxDuration {
-		http.Error(w, "Too much time", http.StatusBadRequest)
+		writeParamError(w, "duration", fmt.Errorf("duration %s plus delay %s exceeds the maximum of %s", duration, delay, h.MaxDuration))
 		return
 	}
 
-	pause := duration / time.Duration(numBytes)
+	if delayBeforeHeaders {
+		select {
+		case <-r.Context().Done():
+			w.WriteHeader(499) // "Client Closed Request" https://httpstatuses.com/499
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	var pause time.Duration
+	if numBytes > 0 {
+		pause = duration / time.Duration(numBytes)
+	}
 	flusher := w.(http.Flusher)
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", numBytes))
+	annotateIntendedBytes(r, numBytes)
 	w.WriteHeader(code)
 	flusher.Flush()
 
-	select {
-	case <-r.Context().Done():
-		return
-	case <-time.After(delay):
+	if !delayBeforeHeaders {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
 	}
 
 	b := []byte{'*'}
 	for i := int64(0); i < numBytes; i++ {
-		w.Write(b)
-		flusher.Flush()
+		if err := writeAndFlush(w, b); err != nil {
+			annotateWriteError(r, err)
+			return
+		}
 
 		select {
 		case <-r.Context().Done():
@@ -651,59 +1755,568 @@ func (h *HTTPBin) Drip(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Range returns up to N bytes, with support for HTTP Range requests.
+// SSE streams ?count= server-sent events with sequential ids starting at 0,
+// one every ?delay=, or spread evenly over ?duration=. With ?retry=, the
+// stream starts with a retry field telling clients how many milliseconds to
+// wait before reconnecting. Each event's data gives its id and the time it
+// was sent, and the stream ends with a done event once every event has been
+// sent.
 //
-// This departs from httpbin by not supporting the chunk_size or duration
-// parameters.
-func (h *HTTPBin) Range(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) != 3 {
-		http.Error(w, "Not found", http.StatusNotFound)
+// Apart from their timestamps, events are derived from their ids and the
+// query params alone, so a client reconnecting with a Last-Event-ID header
+// resumes the same stream from the following event without any state being
+// kept on the server. Once every event has been delivered, reconnecting
+// clients get 204 No Content, which tells EventSource clients to stop
+// reconnecting.
+func (h *HTTPBin) SSE(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	count, err := parseBoundedInt(q.Get("count"), defaultSSECount, 1, maxSSECount)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid count: %w", err))
 		return
 	}
-
-	numBytes, err := strconv.ParseInt(parts[2], 10, 64)
+	delay := defaultSSEDelay
+	if raw := q.Get("delay"); raw != "" {
+		delay, err = parseBoundedDuration(raw, 0, h.MaxDuration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid delay: %w", err))
+			return
+		}
+	}
+	if raw := q.Get("duration"); raw != "" {
+		if q.Get("delay") != "" {
+			writeError(w, http.StatusBadRequest, errors.New("delay and duration may not both be given, since each determines the other"))
+			return
+		}
+		duration, err := parseBoundedDuration(raw, 0, h.MaxDuration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration: %w", err))
+			return
+		}
+		delay = 0
+		if count > 1 {
+			delay = duration / time.Duration(count-1)
+		}
+	}
+	if total := time.Duration(count-1) * delay; total > h.MaxDuration {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%d events with a delay of %s take %s, longer than %s", count, delay, total, h.MaxDuration))
+		return
+	}
+	retry, err := parseBoundedInt(q.Get("retry"), -1, 0, maxSSERetryMS)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid retry: %w", err))
 		return
 	}
 
-	w.Header().Add("ETag", fmt.Sprintf("range%d", numBytes))
-	w.Header().Add("Accept-Ranges", "bytes")
-
-	if numBytes <= 0 || numBytes > h.MaxBodySize {
-		http.Error(w, "Invalid number of bytes", http.StatusBadRequest)
+	next := 0
+	if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+		lastEventID, err := strconv.Atoi(raw)
+		if err != nil || lastEventID < 0 || lastEventID >= count {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid Last-Event-ID %q: must be an event id from 0 to %d", raw, count-1))
+			return
+		}
+		next = lastEventID + 1
+	}
+	Annotate(r.Context(), "sse_resume_from", strconv.Itoa(next))
+	if next == count {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	content := newSyntheticByteStream(numBytes, func(offset int64) byte {
-		return byte(97 + (offset % 26))
-	})
-	var modtime time.Time
-	http.ServeContent(w, r, "", modtime, content)
-}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
 
-// HTML renders a basic HTML page
-func (h *HTTPBin) HTML(w http.ResponseWriter, r *http.Request) {
-	writeHTML(w, mustStaticAsset("moby.html"), http.StatusOK)
+	if retry >= 0 {
+		if err := writeAndFlush(w, []byte(fmt.Sprintf("retry: %d\n\n", retry))); err != nil {
+			annotateWriteError(r, err)
+			return
+		}
+	}
+	for id := next; id < count; id++ {
+		if id > next {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+		data, _ := json.Marshal(sseEventData{
+			ID:        id,
+			Count:     count,
+			Timestamp: h.now().UTC().Format(time.RFC3339Nano),
+		})
+		if err := writeAndFlush(w, formatSSEEvent(int64(id), data)); err != nil {
+			annotateWriteError(r, err)
+			return
+		}
+	}
+	data, _ := json.Marshal(sseDoneData{Count: count})
+	if err := writeAndFlush(w, []byte(fmt.Sprintf("event: done\ndata: %s\n\n", data))); err != nil {
+		annotateWriteError(r, err)
+	}
 }
 
-// Robots renders a basic robots.txt file
-func (h *HTTPBin) Robots(w http.ResponseWriter, r *http.Request) {
-	robotsTxt := []byte(`User-agent: *
-Disallow: /deny
-`)
-	writeResponse(w, http.StatusOK, "text/plain", robotsTxt)
-}
+// HeaderTiming controls when the response headers are sent relative to the
+// body, so that clients measuring time-to-first-byte separately from
+// header-complete time can be validated against both shapes:
+//
+//   - mode=early (the default) sends the headers immediately and then drips
+//     the body out over the given duration
+//   - mode=late withholds the status line and headers until the duration has
+//     elapsed, sending them just before the body. This requires hijacking an
+//     HTTP/1.x connection, and will return 501 otherwise.
+func (h *HTTPBin) HeaderTiming(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var (
+		defaults = h.currentSettings().DefaultParams
+		duration = defaults.DripDuration
+		numBytes = defaults.DripNumBytes
+
+		err error
+	)
+
+	if userDuration := q.Get("duration"); userDuration != "" {
+		duration, err = parseBoundedDuration(userDuration, 0, h.MaxDuration)
+		if err != nil {
+			writeParamError(w, "duration", err)
+			return
+		}
+	}
+
+	if userNumBytes := q.Get("numbytes"); userNumBytes != "" {
+		numBytes, err = strconv.ParseInt(userNumBytes, 10, 64)
+		if err != nil {
+			writeParamError(w, "numbytes", errors.New("must be an integer"))
+			return
+		}
+		if numBytes <= 0 || numBytes > h.MaxBodySize {
+			writeParamError(w, "numbytes", fmt.Errorf("must be between 1 and %d", h.MaxBodySize))
+			return
+		}
+	}
+
+	mode := q.Get("mode")
+	if mode != "" && mode != "early" && mode != "late" {
+		writeParamError(w, "mode", errors.New("must be early or late"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", numBytes))
+
+	switch mode {
+	case "", "early":
+		// The default number of bytes may have been configured as zero
+		var pause time.Duration
+		if numBytes > 0 {
+			pause = duration / time.Duration(numBytes)
+		}
+		flusher := w.(http.Flusher)
+		annotateIntendedBytes(r, numBytes)
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		b := []byte{'*'}
+		for i := int64(0); i < numBytes; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(pause):
+			}
+			if err := writeAndFlush(w, b); err != nil {
+				annotateWriteError(r, err)
+				return
+			}
+		}
+	case "late":
+		if r.ProtoMajor != 1 {
+			http.Error(w, "Not implemented: mode=late requires HTTP/1.x", http.StatusNotImplemented)
+			return
+		}
+		conn, buf, err := hijack(w)
+		if err != nil {
+			http.Error(w, "Not implemented: connection cannot be hijacked", http.StatusNotImplemented)
+			return
+		}
+		defer conn.Close()
+
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+		}
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        w.Header(),
+			ContentLength: numBytes,
+			Body:          io.NopCloser(bytes.NewReader(bytes.Repeat([]byte{'*'}, int(numBytes)))),
+			Close:         true,
+		}
+		resp.Write(buf)
+		buf.Flush()
+	}
+}
+
+// HeaderCase writes a response over a hijacked HTTP/1.x connection with
+// header names in exactly the requested casing (lower, upper, or mixed) and
+// with the custom header given by ?name= placed first or last, so that
+// clients' header normalization can be tested. With ?format=json, the
+// response instead describes exactly what would have been sent.
+func (h *HTTPBin) HeaderCase(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	name := q.Get("name")
+	if name == "" {
+		name = "X-Custom-Header"
+	}
+	value := q.Get("value")
+	if value == "" {
+		value = "go-httpbin"
+	}
+	if !isHeaderToken(name) || strings.ContainsAny(value, "\r\n") {
+		http.Error(w, "Invalid header name or value", http.StatusBadRequest)
+		return
+	}
+
+	casing := q.Get("casing")
+	if casing == "" {
+		casing = "lower"
+	}
+	applyCase, ok := headerCasings[casing]
+	if !ok {
+		http.Error(w, "Invalid casing, must be lower, upper, or mixed", http.StatusBadRequest)
+		return
+	}
+
+	body := "ok\n"
+	headers := []headerLine{
+		{Name: "Content-Type", Value: "text/plain; charset=utf-8"},
+		{Name: "Content-Length", Value: strconv.Itoa(len(body))},
+		{Name: "Connection", Value: "close"},
+	}
+	custom := headerLine{Name: name, Value: value}
+	switch q.Get("order") {
+	case "", "first":
+		headers = append([]headerLine{custom}, headers...)
+	case "last":
+		headers = append(headers, custom)
+	default:
+		http.Error(w, "Invalid order, must be first or last", http.StatusBadRequest)
+		return
+	}
+
+	var raw strings.Builder
+	raw.WriteString("HTTP/1.1 200 OK\r\n")
+	for i := range headers {
+		headers[i].Name = applyCase(headers[i].Name)
+		fmt.Fprintf(&raw, "%s: %s\r\n", headers[i].Name, headers[i].Value)
+	}
+	raw.WriteString("\r\n")
+	raw.WriteString(body)
+
+	if q.Get("format") == "json" {
+		writeJSON(http.StatusOK, w, headerCaseResponse{
+			Headers: headers,
+			Raw:     raw.String(),
+		})
+		return
+	}
+
+	if r.ProtoMajor != 1 {
+		http.Error(w, "Not implemented: header casing requires HTTP/1.x", http.StatusNotImplemented)
+		return
+	}
+	conn, buf, err := hijack(w)
+	if err != nil {
+		http.Error(w, "Not implemented: connection cannot be hijacked", http.StatusNotImplemented)
+		return
+	}
+	defer conn.Close()
+	buf.WriteString(raw.String())
+	buf.Flush()
+}
+
+// Framing serves the same deterministic body using the framing given by
+// ?mode=: an explicit Content-Length, chunked transfer encoding, or a body
+// delimited only by the server closing the connection (eof), so that each of
+// a client's body termination paths can be tested against identical content.
+func (h *HTTPBin) Framing(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "content-length"
+	}
+	content := newSyntheticByteStream(framingBodySize, func(offset int64) byte {
+		return byte(97 + (offset % 26))
+	})
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	annotateIntendedBytes(r, framingBodySize)
+	switch mode {
+	case "content-length":
+		w.Header().Set("Content-Length", strconv.Itoa(framingBodySize))
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, content); err != nil {
+			annotateWriteError(r, err)
+		}
+	case "chunked":
+		if !r.ProtoAtLeast(1, 1) || r.ProtoMajor != 1 {
+			http.Error(w, "Not implemented: mode=chunked requires HTTP/1.1", http.StatusNotImplemented)
+			return
+		}
+		// Without a Content-Length, net/http chunks the response as soon as
+		// it is flushed
+		w.WriteHeader(http.StatusOK)
+		chunk := make([]byte, framingChunkSize)
+		for {
+			n, _ := content.Read(chunk)
+			if n == 0 {
+				return
+			}
+			if err := writeAndFlush(w, chunk[:n]); err != nil {
+				annotateWriteError(r, err)
+				return
+			}
+		}
+	case "eof":
+		if r.ProtoMajor != 1 {
+			http.Error(w, "Not implemented: mode=eof requires HTTP/1.x", http.StatusNotImplemented)
+			return
+		}
+		conn, buf, err := hijack(w)
+		if err != nil {
+			http.Error(w, "Not implemented: connection cannot be hijacked", http.StatusNotImplemented)
+			return
+		}
+		defer conn.Close()
+
+		w.Header().Set("Connection", "close")
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        w.Header(),
+			ContentLength: -1,
+			Body:          io.NopCloser(content),
+			Close:         true,
+		}
+		if err := resp.Write(buf); err == nil {
+			err = buf.Flush()
+		}
+		if err != nil {
+			annotateWriteError(r, err)
+		}
+	default:
+		http.Error(w, "Invalid mode, must be content-length, chunked, or eof", http.StatusBadRequest)
+	}
+}
+
+// Probe responds with the headers a download of ?content_length= bytes would
+// have (Content-Length, ETag, and Accept-Ranges) and then closes the
+// connection without sending any of the body, even for GET requests, to
+// simulate origins that cut transfers short immediately after the headers.
+// This requires hijacking an HTTP/1.x connection, and will return 501
+// otherwise.
+func (h *HTTPBin) Probe(w http.ResponseWriter, r *http.Request) {
+	contentLength := int64(defaultProbeContentLength)
+	if raw := r.URL.Query().Get("content_length"); raw != "" {
+		var err error
+		contentLength, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || contentLength < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid content_length %q: must be a non-negative integer", raw))
+			return
+		}
+	}
+
+	if r.ProtoMajor != 1 {
+		http.Error(w, "Not implemented: probe requires HTTP/1.x", http.StatusNotImplemented)
+		return
+	}
+	conn, buf, err := hijack(w)
+	if err != nil {
+		http.Error(w, "Not implemented: connection cannot be hijacked", http.StatusNotImplemented)
+		return
+	}
+	defer conn.Close()
+
+	annotateIntendedBytes(r, 0)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	w.Header().Set("ETag", fmt.Sprintf(`"probe-%d"`, contentLength))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Connection", "close")
+	buf.WriteString("HTTP/1.1 200 OK\r\n")
+	if err := w.Header().Write(buf); err == nil {
+		buf.WriteString("\r\n")
+		err = buf.Flush()
+	}
+	if err != nil {
+		annotateWriteError(r, err)
+	}
+}
+
+// Truncate declares a ?declare= byte body in its Content-Length but cuts
+// the response off after exactly ?send= bytes of it, so that clients can
+// check which bytes of a truncated download arrived. The body and ETag are
+// those of /range/{declare}, so a Range request there can resume and
+// complete the download. By default, 10240 bytes (or MaxBodySize, if
+// smaller) are declared and half of them sent.
+//
+// Over HTTP/1.x, the connection is hijacked and closed after the last byte is
+// sent. Over HTTP/2, the handler aborts with http.ErrAbortHandler after
+// flushing, which makes the server reset the stream.
+func (h *HTTPBin) Truncate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	defaultDeclare := defaultTruncateDeclare
+	if int64(defaultDeclare) > h.MaxBodySize {
+		defaultDeclare = int(h.MaxBodySize)
+	}
+	declare, err := parseBoundedInt(q.Get("declare"), defaultDeclare, 1, int(h.MaxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid declare: %w", err))
+		return
+	}
+	send, err := parseBoundedInt(q.Get("send"), declare/2, 0, declare-1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid send: %w", err))
+		return
+	}
+
+	annotateIntendedBytes(r, int64(send))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(declare))
+	w.Header().Set("ETag", fmt.Sprintf("range%d", declare))
+	w.Header().Set("Accept-Ranges", "bytes")
+	content := newSyntheticByteStream(int64(send), rangeByte)
+
+	if r.ProtoMajor != 1 {
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, content); err != nil {
+			annotateWriteError(r, err)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	conn, buf, err := hijack(w)
+	if err != nil {
+		http.Error(w, "Not implemented: connection cannot be hijacked", http.StatusNotImplemented)
+		return
+	}
+	defer conn.Close()
+
+	w.Header().Set("Connection", "close")
+	buf.WriteString("HTTP/1.1 200 OK\r\n")
+	if err = w.Header().Write(buf); err == nil {
+		buf.WriteString("\r\n")
+		if _, err = io.Copy(buf, content); err == nil {
+			err = buf.Flush()
+		}
+	}
+	if err != nil {
+		annotateWriteError(r, err)
+	}
+}
+
+// Range returns up to N bytes, with support for HTTP Range requests.
+//
+// This departs from httpbin by not supporting the chunk_size or duration
+// parameters.
+func (h *HTTPBin) Range(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	numBytes, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		writeParamError(w, "n", errors.New("must be an integer"))
+		return
+	}
+
+	w.Header().Add("ETag", fmt.Sprintf("range%d", numBytes))
+	w.Header().Add("Accept-Ranges", "bytes")
+
+	if numBytes <= 0 || numBytes > h.MaxBodySize {
+		writeParamError(w, "n", fmt.Errorf("must be between 1 and %d", h.MaxBodySize))
+		return
+	}
+
+	// ServeContent answers single range, unsatisfiable and conditional
+	// requests, but serves the whole body when multiple ranges add up to
+	// more than it, so we build multipart/byteranges responses ourselves
+	if ranges, err := parseByteRanges(r.Header.Get("Range"), numBytes); err == nil && len(ranges) > 1 && !isConditionalRequest(r) {
+		if len(ranges) <= maxByteRanges && sumByteRanges(ranges) <= h.MaxBodySize {
+			body, contentType := multipartByteRanges(ranges, numBytes, rangeContentType, rangeByte)
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			annotateIntendedBytes(r, int64(len(body)))
+			w.WriteHeader(http.StatusPartialContent)
+			if _, err := w.Write(body); err != nil {
+				annotateWriteError(r, err)
+			}
+			return
+		}
+		// Servers may ignore a Range header asking for too much
+		r.Header.Del("Range")
+	}
+
+	content := newSyntheticByteStream(numBytes, rangeByte)
+	var modtime time.Time
+	http.ServeContent(w, r, "", modtime, content)
+
+	// ServeContent stops at the first write error, so we only need to
+	// report how much it meant to send
+	if cl, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+		annotateIntendedBytes(r, cl)
+	}
+}
+
+// HTML renders a basic HTML page
+func (h *HTTPBin) HTML(w http.ResponseWriter, r *http.Request) {
+	writeText(w, r, http.StatusOK, htmlContentType, mustStaticAsset("moby.html"))
+}
+
+// Robots renders a basic robots.txt file
+func (h *HTTPBin) Robots(w http.ResponseWriter, r *http.Request) {
+	robotsTxt := []byte(`User-agent: *
+Disallow: /deny
+`)
+	writeText(w, r, http.StatusOK, "text/plain", robotsTxt)
+}
 
 // Deny renders a basic page that robots should never access
 func (h *HTTPBin) Deny(w http.ResponseWriter, r *http.Request) {
-	writeResponse(w, http.StatusOK, "text/plain", []byte(`YOU SHOULDN'T BE HERE`))
+	writeText(w, r, http.StatusOK, "text/plain", []byte(`YOU SHOULDN'T BE HERE`))
 }
 
 // Cache returns a 304 if an If-Modified-Since or an If-None-Match header is
 // present, otherwise returns the same response as Get.
+//
+// Given a last_modified param, it instead evaluates those headers against
+// that Last-Modified time, and the ETag derived from it, per RFC 7232.
 func (h *HTTPBin) Cache(w http.ResponseWriter, r *http.Request) {
+	if raw := r.URL.Query().Get("last_modified"); raw != "" {
+		lastModified, err := parseLastModified(raw)
+		if err != nil {
+			writeParamError(w, "last_modified", err)
+			return
+		}
+		h.doCacheLastModified(w, r, lastModified)
+		return
+	}
+
 	if r.Header.Get("If-Modified-Since") != "" || r.Header.Get("If-None-Match") != "" {
 		w.WriteHeader(http.StatusNotModified)
 		return
@@ -715,6 +2328,31 @@ func (h *HTTPBin) Cache(w http.ResponseWriter, r *http.Request) {
 	h.Get(w, r)
 }
 
+// doCacheLastModified responds with a 304 if the request's preconditions
+// show that the client's copy, last modified at lastModified, is current,
+// otherwise with the same response as Get. If-None-Match takes precedence
+// over If-Modified-Since, and malformed If-Modified-Since dates are ignored.
+func (h *HTTPBin) doCacheLastModified(w http.ResponseWriter, r *http.Request, lastModified time.Time) {
+	formatted := lastModified.UTC().Format(http.TimeFormat)
+	etag := fmt.Sprintf(`"%s"`, sha1hash(formatted))
+	w.Header().Set("Last-Modified", formatted)
+	w.Header().Set("ETag", etag)
+
+	notModified := false
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		notModified = etagListMatches(ifNoneMatch, etag, true)
+	} else if r.Method == "GET" || r.Method == "HEAD" {
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+			notModified = !lastModified.After(since)
+		}
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Get(w, r)
+}
+
 // CacheControl sets a Cache-Control header for N seconds for /cache/N requests
 func (h *HTTPBin) CacheControl(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
@@ -733,331 +2371,2314 @@ func (h *HTTPBin) CacheControl(w http.ResponseWriter, r *http.Request) {
 	h.Get(w, r)
 }
 
-// ETag assumes the resource has the given etag and responds to If-None-Match
-// and If-Match headers appropriately.
-func (h *HTTPBin) ETag(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) != 3 {
-		http.Error(w, "Not found", http.StatusNotFound)
+// CacheSequence serves a resource whose ETag changes after every
+// changes_every requests (3 by default) for a given ?key= namespace, so that
+// a client polling with If-None-Match sees a predictable sequence of 200 and
+// 304 responses. A DELETE request resets the key's sequence.
+func (h *HTTPBin) CacheSequence(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	key := q.Get("key")
+	if key == "" {
+		key = "default"
+	}
+	if !isSlug(key) {
+		writeError(w, http.StatusBadRequest, errors.New("invalid key, must be 1-32 letters, digits, dashes, or underscores"))
 		return
 	}
 
-	etag := parts[2]
-	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, etag))
+	if r.Method == "DELETE" {
+		h.cacheSequences.delete(key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
-	var buf bytes.Buffer
-	mustMarshalJSON(&buf, noBodyResponse{
-		Args:    r.URL.Query(),
-		Headers: getRequestHeaders(r),
-		Origin:  getClientIP(r),
-		URL:     getURL(r).String(),
-	})
+	changesEvery, err := parseBoundedInt(q.Get("changes_every"), 3, 1, math.MaxInt32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid changes_every: %w", err))
+		return
+	}
 
-	// Let http.ServeContent deal with If-None-Match and If-Match headers:
-	// https://golang.org/pkg/net/http/#ServeContent
-	http.ServeContent(w, r, "response.json", time.Now(), bytes.NewReader(buf.Bytes()))
-}
+	requests, err := h.cacheSequences.next(key)
+	if err != nil {
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	generation := (requests-1)/int64(changesEvery) + 1
+	etag := fmt.Sprintf(`"%s-%d"`, key, generation)
 
-// Bytes returns N random bytes generated with an optional seed
-func (h *HTTPBin) Bytes(w http.ResponseWriter, r *http.Request) {
-	handleBytes(w, r, false)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Cache-Generation", strconv.FormatInt(generation, 10))
+	if etagListMatches(r.Header.Get("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(http.StatusOK, w, cacheSequenceResponse{
+		Key:          key,
+		Generation:   generation,
+		Requests:     requests,
+		ChangesEvery: changesEvery,
+		ETag:         etag,
+	})
 }
 
-// StreamBytes streams N random bytes generated with an optional seed in chunks
-// of a given size.
-func (h *HTTPBin) StreamBytes(w http.ResponseWriter, r *http.Request) {
-	handleBytes(w, r, true)
-}
+// CDNSim emulates a shared cache in front of a slow origin. The first
+// request for a ?key= within ?ttl= seconds (60 by default) is a miss, which
+// waits ?origin_delay= before responding with Age: 0, and subsequent requests
+// are hits, which respond immediately with an Age reflecting how long ago
+// the entry was stored. A request with Cache-Control: no-cache forces a miss.
+func (h *HTTPBin) CDNSim(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
 
-// handleBytes consolidates the logic for validating input params of the Bytes
-// and StreamBytes endpoints and knows how to write the response in chunks if
-// streaming is true.
-func handleBytes(w http.ResponseWriter, r *http.Request, streaming bool) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) != 3 {
-		http.Error(w, "Not found", http.StatusNotFound)
+	key := q.Get("key")
+	if key == "" {
+		key = "default"
+	}
+	if !isSlug(key) {
+		writeError(w, http.StatusBadRequest, errors.New("invalid key, must be 1-32 letters, digits, dashes, or underscores"))
+		return
+	}
+	ttlSeconds, err := parseBoundedInt(q.Get("ttl"), int(defaultCDNSimTTL/time.Second), 1, int(maxCDNSimTTL/time.Second))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl: %w", err))
 		return
 	}
+	var originDelay time.Duration
+	if raw := q.Get("origin_delay"); raw != "" {
+		originDelay, err = parseBoundedDuration(raw, 0, h.MaxDuration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid origin_delay: %w", err))
+			return
+		}
+	}
+
+	bypass := hasCacheDirective(r.Header.Get("Cache-Control"), "no-cache")
+	entry, age, hit, err := h.cdnSim.get(key, time.Duration(ttlSeconds)*time.Second, bypass)
+	if err != nil {
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+
+	status := "MISS"
+	if hit {
+		status = "HIT"
+	} else if originDelay > 0 {
+		select {
+		case <-r.Context().Done():
+			w.WriteHeader(499) // "Client Closed Request" https://httpstatuses.com/499
+			return
+		case <-time.After(originDelay):
+		}
+	}
+
+	ageSeconds := int64(age / time.Second)
+	ttl := int64(entry.ttl / time.Second)
+	w.Header().Set("X-Cache", status)
+	w.Header().Set("Age", strconv.FormatInt(ageSeconds, 10))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", ttl))
+	writeJSON(http.StatusOK, w, cdnSimResponse{
+		Key:      key,
+		Cache:    status,
+		Age:      ageSeconds,
+		TTL:      ttl,
+		StoredAt: entry.storedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// DateSkew echoes the request like /get, but with a Date response header
+// skewed from the server's clock by the given offset, so clients can be
+// tested against a server whose time disagrees with their own. Optional
+// expires and last_modified durations set Expires and Last-Modified relative
+// to the skewed time rather than the true one.
+func (h *HTTPBin) DateSkew(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var offset, expires, lastModified time.Duration
+	var err error
+	if raw := q.Get("offset"); raw != "" {
+		if offset, err = parseBoundedDuration(raw, -maxDateSkew, maxDateSkew); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset: %w", err))
+			return
+		}
+	}
+	if raw := q.Get("expires"); raw != "" {
+		if expires, err = parseBoundedDuration(raw, 0, maxDateSkew); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid expires: %w", err))
+			return
+		}
+	}
+	if raw := q.Get("last_modified"); raw != "" {
+		if lastModified, err = parseBoundedDuration(raw, 0, maxDateSkew); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid last_modified: %w", err))
+			return
+		}
+	}
+
+	now := h.now().UTC()
+	skewed := now.Add(offset)
+
+	// net/http only adds its own Date header when the handler hasn't set one
+	w.Header().Set("Date", skewed.Format(http.TimeFormat))
+	if q.Get("expires") != "" {
+		w.Header().Set("Expires", skewed.Add(expires).Format(http.TimeFormat))
+	}
+	if q.Get("last_modified") != "" {
+		w.Header().Set("Last-Modified", skewed.Add(-lastModified).Format(http.TimeFormat))
+	}
+
+	writeJSON(http.StatusOK, w, dateSkewResponse{
+		Args:          q,
+		Headers:       getRequestHeaders(r),
+		Origin:        getClientIP(r),
+		URL:           getURL(r).String(),
+		ServerDate:    now.Format(http.TimeFormat),
+		SkewedDate:    skewed.Format(http.TimeFormat),
+		OffsetSeconds: int64(offset / time.Second),
+	})
+}
+
+// ETag assumes the resource has the given etag, or the weak etag W/"etag"
+// given ?weak=true, and responds to If-None-Match and If-Match headers
+// appropriately.
+func (h *HTTPBin) ETag(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	weak := false
+	if raw := r.URL.Query().Get("weak"); raw != "" {
+		var err error
+		weak, err = strconv.ParseBool(raw)
+		if err != nil {
+			writeParamError(w, "weak", errors.New("must be a boolean"))
+			return
+		}
+	}
+
+	etag := fmt.Sprintf(`"%s"`, parts[2])
+	if weak {
+		etag = "W/" + etag
+	}
+	if !h.reflectHeaders(w, http.Header{"ETag": {etag}}) {
+		return
+	}
+
+	var buf bytes.Buffer
+	mustMarshalJSON(&buf, noBodyResponse{
+		Args:    r.URL.Query(),
+		Headers: getRequestHeaders(r),
+		Origin:  getClientIP(r),
+		URL:     getURL(r).String(),
+	})
+
+	// Evaluate If-Match and If-None-Match in the order given by RFC 7232
+	// section 6, then drop them and the date preconditions they override
+	// before letting http.ServeContent deal with the rest
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, false) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		r.Header.Del("If-Match")
+		r.Header.Del("If-Unmodified-Since")
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, true) {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				w.WriteHeader(http.StatusNotModified)
+			} else {
+				w.WriteHeader(http.StatusPreconditionFailed)
+			}
+			return
+		}
+		r.Header.Del("If-None-Match")
+		r.Header.Del("If-Modified-Since")
+	}
+
+	http.ServeContent(w, r, "response.json", time.Now(), bytes.NewReader(buf.Bytes()))
+}
+
+// Archive streams a generated zip or tar.gz archive of deterministic files,
+// whose names and contents are derived from an optional seed, for testing
+// client-side extraction code. With ?hostile=true the archive also contains
+// an entry with a deeply nested path and one with a "../" name.
+func (h *HTTPBin) Archive(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var (
+		format   = "zip"
+		numFiles = 10
+		fileSize = 1024
+
+		err error
+	)
+
+	if userFormat := q.Get("format"); userFormat != "" {
+		format = userFormat
+	}
+	if format != "zip" && format != "tar.gz" {
+		writeParamError(w, "format", errors.New("must be zip or tar.gz"))
+		return
+	}
+	if userFiles := q.Get("files"); userFiles != "" {
+		numFiles, err = strconv.Atoi(userFiles)
+		if err != nil {
+			writeParamError(w, "files", errors.New("must be an integer"))
+			return
+		}
+		if numFiles < 1 || numFiles > maxArchiveFiles {
+			writeParamError(w, "files", fmt.Errorf("must be between 1 and %d", maxArchiveFiles))
+			return
+		}
+	}
+	if userFileSize := q.Get("file_size"); userFileSize != "" {
+		fileSize, err = strconv.Atoi(userFileSize)
+		if err != nil {
+			writeParamError(w, "file_size", errors.New("must be an integer"))
+			return
+		}
+		if fileSize < 0 || int64(fileSize) > h.MaxBodySize {
+			writeParamError(w, "file_size", fmt.Errorf("must be between 0 and %d", h.MaxBodySize))
+			return
+		}
+	}
+	hostile := q.Get("hostile") == "true"
+	if archiveSize(format, numFiles, fileSize, hostile) > h.MaxBodySize {
+		writeParamError(w, "file_size", fmt.Errorf("an archive of %d files of %d bytes exceeds the maximum size of %d bytes", numFiles, fileSize, h.MaxBodySize))
+		return
+	}
+
+	rng, err := parseSeed(q.Get("seed"))
+	if err != nil {
+		writeParamError(w, "seed", errors.New("must be an integer"))
+		return
+	}
+	entries := generateArchiveEntries(rng, numFiles, fileSize, hostile)
+
+	write := writeZip
+	contentType := "application/zip"
+	if format == "tar.gz" {
+		write = writeTarGz
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="archive.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+	if err := write(w, entries); err != nil {
+		annotateWriteError(r, err)
+	}
+}
+
+// Sizes returns a random payload whose size is picked from a list of size
+// buckets, optionally weighted, so that a single URL can produce a
+// realistic distribution of response sizes. The chosen size is capped at
+// MaxBodySize and reported in the X-Chosen-Size header.
+func (h *HTTPBin) Sizes(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	rawBuckets := q.Get("buckets")
+	if rawBuckets == "" {
+		writeParamError(w, "buckets", errors.New("required"))
+		return
+	}
+	buckets, err := parseSizeBuckets(rawBuckets)
+	if err != nil {
+		writeParamError(w, "buckets", err)
+		return
+	}
+	if pick := q.Get("pick"); pick != "" && pick != "random" {
+		writeParamError(w, "pick", errors.New("must be random"))
+		return
+	}
+	rng, err := parseSeed(q.Get("seed"))
+	if err != nil {
+		writeParamError(w, "seed", errors.New("must be an integer"))
+		return
+	}
+
+	size := pickSizeBucket(rng, buckets)
+	if size > h.MaxBodySize {
+		size = h.MaxBodySize
+	}
+	annotateIntendedBytes(r, size)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Chosen-Size", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	if err := writeRandomBytes(w, rng, size); err != nil {
+		annotateWriteError(r, err)
+	}
+}
+
+// Page renders an HTML page referencing ?assets= generated stylesheets,
+// scripts, and images served by PageAsset, whose sizes and latencies are
+// drawn from the ?sizes= and ?latency= ranges, so that a single URL produces
+// a realistic page-load waterfall. The assets are deterministic under
+// ?seed=, and ?cacheable= makes all, half, or none of them cacheable.
+func (h *HTTPBin) Page(w http.ResponseWriter, r *http.Request) {
+	p, err := parsePageParams(r.URL.Query(), h.MaxBodySize, h.MaxDuration)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	assets := make([]pageAsset, p.assets)
+	for i := range assets {
+		assets[i] = p.asset(i)
+	}
+	writeHTML(w, renderPage(assets), http.StatusOK)
+}
+
+// PageManifest describes the assets of the page /page renders for the same
+// query params.
+func (h *HTTPBin) PageManifest(w http.ResponseWriter, r *http.Request) {
+	p, err := parsePageParams(r.URL.Query(), h.MaxBodySize, h.MaxDuration)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	resp := pageManifestResponse{
+		Seed:    p.seed,
+		PageURL: "/page?" + p.query().Encode(),
+		Assets:  make([]pageAsset, p.assets),
+	}
+	for i := range resp.Assets {
+		resp.Assets[i] = p.asset(i)
+	}
+	writeJSON(http.StatusOK, w, resp)
+}
+
+// PageAsset serves one of the assets of a /page, after its latency. Cacheable
+// assets get an ETag and a max-age and answer a matching If-None-Match with
+// 304 Not Modified, while the rest are marked no-store.
+func (h *HTTPBin) PageAsset(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	p, err := parsePageParams(r.URL.Query(), h.MaxBodySize, h.MaxDuration)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := strconv.Atoi(parts[3])
+	if err != nil || id < 0 || id >= p.assets {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no asset %q on a page of %d assets", parts[3], p.assets))
+		return
+	}
+	asset := p.asset(id)
+
+	select {
+	case <-r.Context().Done():
+		w.WriteHeader(499) // "Client Closed Request" https://httpstatuses.com/499
+		return
+	case <-time.After(time.Duration(asset.LatencyMS * float64(time.Millisecond))):
+	}
+
+	if asset.Cacheable {
+		etag := fmt.Sprintf(`"page-%d-%d"`, p.seed, id)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	annotateIntendedBytes(r, asset.Size)
+	w.Header().Set("Content-Length", strconv.FormatInt(asset.Size, 10))
+	writeResponse(w, http.StatusOK, asset.ContentType, pageAssetBody(asset))
+}
+
+// Paginate serves a deterministic list of synthetic items one page at a
+// time, in the page-number (?page=), offset/limit (?offset=&limit=), or
+// opaque cursor (?cursor=) style selected by ?style=.
+func (h *HTTPBin) Paginate(w http.ResponseWriter, r *http.Request) {
+	total, err := parseBoundedInt(r.URL.Query().Get("total"), defaultPaginateTotal, 0, maxPaginateTotal)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid total: %w", err))
+		return
+	}
+	meta, offset, limit, ok := h.paginate(w, r, total)
+	if !ok {
+		return
+	}
+	writeJSON(http.StatusOK, w, paginateResponse{
+		paginationMeta: meta,
+		Items:          paginateItems(offset, limit, total),
+	})
+}
+
+// paginate selects the window of a list of the given total length requested
+// by the ?style=, ?page_size=, and style-specific query params shared by the
+// paginated endpoints, setting the Link header for page-number style
+// requests. If the params are invalid, it writes a 400 Bad Request and
+// returns ok=false.
+func (h *HTTPBin) paginate(w http.ResponseWriter, r *http.Request, total int) (meta paginationMeta, offset, limit int, ok bool) {
+	q := r.URL.Query()
+
+	pageSize, err := parseBoundedInt(q.Get("page_size"), defaultPaginatePageSize, 1, maxPaginatePageSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid page_size: %w", err))
+		return meta, 0, 0, false
+	}
+
+	meta.Style = q.Get("style")
+	if meta.Style == "" {
+		meta.Style = "page"
+	}
+
+	switch meta.Style {
+	case "page":
+		totalPages := (total + pageSize - 1) / pageSize
+		lastPage := totalPages
+		if lastPage < 1 {
+			lastPage = 1
+		}
+		page, err := parseBoundedInt(q.Get("page"), 1, 1, lastPage)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid page: %w", err))
+			return meta, 0, 0, false
+		}
+		offset, limit = (page-1)*pageSize, pageSize
+		meta.Page = page
+		meta.PageSize = pageSize
+		meta.Total = &total
+		meta.TotalPages = &totalPages
+		w.Header().Set("Link", paginateLinks(r, page, lastPage))
+
+	case "offset":
+		offset, err = parseBoundedInt(q.Get("offset"), 0, 0, total)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset: %w", err))
+			return meta, 0, 0, false
+		}
+		limit, err = parseBoundedInt(q.Get("limit"), pageSize, 1, maxPaginatePageSize)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %w", err))
+			return meta, 0, 0, false
+		}
+		meta.Offset = &offset
+		meta.Limit = limit
+		meta.Total = &total
+
+	case "cursor":
+		if cursor := q.Get("cursor"); cursor != "" {
+			offset, err = h.parsePaginateCursor(cursor, total, pageSize)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid cursor: %w", err))
+				return meta, 0, 0, false
+			}
+		}
+		limit = pageSize
+		meta.PageSize = pageSize
+		if next := offset + pageSize; next < total {
+			meta.NextCursor = h.paginateCursor(next, total, pageSize)
+		}
+
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid style, must be page, offset, or cursor"))
+		return meta, 0, 0, false
+	}
+
+	if offset+limit > total {
+		limit = total - offset
+	}
+	return meta, offset, limit, true
+}
+
+// Users serves a deterministic dataset of synthetic user records generated
+// from ?seed=, as a paginated list at /users (supporting the same pagination
+// styles as /paginate) or one record at a time at /users/{id}. A ?fields=
+// param selects a sparse fieldset, including nested fields like
+// address.city, and a ?sort= param orders the list by one or more
+// comma-separated fields, each prefixed with - for descending order.
+func (h *HTTPBin) Users(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var seed int64
+	if rawSeed := q.Get("seed"); rawSeed != "" {
+		var err error
+		seed, err = strconv.ParseInt(rawSeed, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid seed: %q is not an integer", rawSeed))
+			return
+		}
+	}
+	total, err := parseBoundedInt(q.Get("total"), defaultUsersTotal, 0, maxUsersTotal)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid total: %w", err))
+		return
+	}
+	fields, err := parseUserFields(q.Get("fields"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid fields: %w", err))
+		return
+	}
+
+	if rawID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/users"), "/"); rawID != "" {
+		id, err := strconv.Atoi(rawID)
+		if err != nil || id < 1 || id > total {
+			writeError(w, http.StatusNotFound, fmt.Errorf("user %q not found", rawID))
+			return
+		}
+		writeJSON(http.StatusOK, w, selectUserFields(generateUser(seed, id), fields))
+		return
+	}
+
+	sortKeys, err := parseUserSort(q.Get("sort"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid sort: %w", err))
+		return
+	}
+	meta, offset, limit, ok := h.paginate(w, r, total)
+	if !ok {
+		return
+	}
+
+	var users []userRecord
+	if len(sortKeys) > 0 {
+		// Sorting requires the whole dataset, which is cheap enough to
+		// generate given the upper bound on ?total=.
+		users = generateUsers(seed, 0, total)
+		sortUsers(users, sortKeys)
+		users = users[offset : offset+limit]
+	} else {
+		users = generateUsers(seed, offset, limit)
+	}
+
+	resp := usersResponse{
+		paginationMeta: meta,
+		Seed:           seed,
+		Items:          make([]interface{}, 0, len(users)),
+	}
+	for _, u := range users {
+		resp.Items = append(resp.Items, selectUserFields(u, fields))
+	}
+	writeJSON(http.StatusOK, w, resp)
+}
+
+// Naughty serves a versioned corpus of strings known to break naive clients,
+// selected by ?category= (all categories by default) and limited to the
+// first ?count= strings, as a JSON array or, with ?as=lines, one string per
+// line. The response is truncated to fit within MaxBodySize, which is
+// reported via the X-Naughty-Truncated header.
+func (h *HTTPBin) Naughty(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	version, err := parseBoundedInt(q.Get("version"), latestNaughtyVersion, 1, latestNaughtyVersion)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid version: %w", err))
+		return
+	}
+
+	categories := naughtyCategories
+	if category := q.Get("category"); category != "" {
+		categories = nil
+		for _, c := range naughtyCategories {
+			if c == category {
+				categories = []string{c}
+			}
+		}
+		if categories == nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid category, must be one of %s", strings.Join(naughtyCategories, ", ")))
+			return
+		}
+	}
+
+	as := q.Get("as")
+	if as != "" && as != "json" && as != "lines" {
+		writeError(w, http.StatusBadRequest, errors.New("invalid as, must be json or lines"))
+		return
+	}
+
+	var corpus []string
+	for _, category := range categories {
+		strs, err := naughtyStrings(version, category)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("error loading %s corpus: %w", category, err))
+			return
+		}
+		corpus = append(corpus, strs...)
+	}
+
+	count, err := parseBoundedInt(q.Get("count"), len(corpus), 1, len(corpus))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid count: %w", err))
+		return
+	}
+
+	contentType := jsonContentType
+	if as == "lines" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	body, written, omitted, truncated := encodeNaughtyStrings(corpus[:count], as == "lines", h.MaxBodySize)
+	w.Header().Set("X-Naughty-Version", strconv.Itoa(version))
+	w.Header().Set("X-Naughty-Count", strconv.Itoa(written))
+	if omitted > 0 {
+		w.Header().Set("X-Naughty-Omitted", strconv.Itoa(omitted))
+	}
+	if truncated {
+		w.Header().Set("X-Naughty-Truncated", "true")
+	}
+	writeResponse(w, http.StatusOK, contentType, body)
+}
+
+// Diff compares the two parts, named a and b, of a multipart request body
+// byte by byte and reports whether they are identical, where they first
+// differ, and their lengths and hashes. A ?context=n query param adds hex
+// dumps of up to n bytes on either side of the first difference.
+func (h *HTTPBin) Diff(w http.ResponseWriter, r *http.Request) {
+	contextSize, err := parseBoundedInt(r.URL.Query().Get("context"), 0, 0, maxDiffContext)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid context: %w", err))
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid multipart body: %w", err))
+		return
+	}
+	parts := make(map[string][]byte, 2)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid multipart body: %w", err))
+			return
+		}
+		name := part.FormName()
+		if name != "a" && name != "b" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unexpected part %q, body must contain exactly two parts named a and b", name))
+			return
+		}
+		if _, ok := parts[name]; ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("duplicate part %q, body must contain exactly two parts named a and b", name))
+			return
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("error reading part %q: %w", name, err))
+			return
+		}
+		parts[name] = data
+	}
+	a, okA := parts["a"]
+	b, okB := parts["b"]
+	if !okA || !okB {
+		writeError(w, http.StatusBadRequest, errors.New("body must contain exactly two parts named a and b"))
+		return
+	}
+
+	sumA, sumB := sha256.Sum256(a), sha256.Sum256(b)
+	resp := diffResponse{
+		Identical: bytes.Equal(a, b),
+		LengthA:   int64(len(a)),
+		LengthB:   int64(len(b)),
+		SHA256A:   hex.EncodeToString(sumA[:]),
+		SHA256B:   hex.EncodeToString(sumB[:]),
+	}
+	if !resp.Identical {
+		offset := firstDifference(a, b)
+		resp.FirstDifferentOffset = &offset
+		if contextSize > 0 {
+			start := offset - int64(contextSize)
+			if start < 0 {
+				start = 0
+			}
+			end := offset + int64(contextSize)
+			resp.Context = &diffContext{
+				Offset: start,
+				A:      hex.Dump(byteWindow(a, start, end)),
+				B:      hex.Dump(byteWindow(b, start, end)),
+			}
+		}
+	}
+	writeJSON(http.StatusOK, w, resp)
+}
+
+// Coalesce performs simulated work taking ?work= (default 500ms, at most
+// MaxDuration) at most once at a time per ?key=, so that clients implementing
+// request coalescing can observe whether duplicate requests were suppressed.
+// Concurrent requests for the same key wait for the in-flight computation and
+// all receive the same body, giving its computation ID and the number of
+// requests it served. The X-Coalesced header says whether a request joined a
+// computation started by another.
+//
+// The work continues even if the request that started it is canceled, so
+// that the requests waiting on it are still served.
+func (h *HTTPBin) Coalesce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key := q.Get("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing key"))
+		return
+	}
+	work := defaultCoalesceWork
+	if work > h.MaxDuration {
+		work = h.MaxDuration
+	}
+	if rawWork := q.Get("work"); rawWork != "" {
+		var err error
+		work, err = parseBoundedDuration(rawWork, 0, h.MaxDuration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid work: %w", err))
+			return
+		}
+	}
+
+	call, leader := h.coalescer.join(key)
+	if leader {
+		started := h.now()
+		time.Sleep(work)
+		h.coalescer.finish(key, call, coalesceResponse{
+			Key:           key,
+			ComputationID: uuidv4(),
+			WorkMS:        work.Seconds() * 1e3,
+			Started:       started.UTC(),
+			Completed:     h.now().UTC(),
+		})
+	} else {
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			if h.coalescer.leave(call) {
+				w.WriteHeader(499) // "Client Closed Request" https://httpstatuses.com/499
+				return
+			}
+		}
+	}
+
+	Annotate(r.Context(), "coalesce_id", call.result.ComputationID)
+	w.Header().Set("X-Coalesced", strconv.FormatBool(!leader))
+	writeJSON(http.StatusOK, w, call.result)
+}
+
+// Fanout implements a minimal pub/sub service for testing streaming
+// clients: a POST to /fanout/{channel} publishes its body to every current
+// subscriber of the channel, connected via server-sent events at
+// /fanout/{channel}/sse or via WebSocket at /fanout/{channel}/ws. Messages
+// sent by WebSocket subscribers are published to the channel too.
+//
+// Each subscriber has a small bounded queue, and messages published while it
+// is full are dropped for that subscriber and reported to it before its next
+// message. Subscriptions last at most MaxDuration.
+func (h *HTTPBin) Fanout(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 3 || len(parts) > 4 || !isSlug(parts[2]) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("go-httpbin does not handle the path %s, use /fanout/{channel}[/sse|/ws]", r.URL.Path))
+		return
+	}
+	channel := parts[2]
+
+	var handler func(http.ResponseWriter, *http.Request, string)
+	method := "GET"
+	switch {
+	case len(parts) == 3:
+		handler, method = h.fanoutPublish, "POST"
+	case parts[3] == "sse":
+		handler = h.fanoutSSE
+	case parts[3] == "ws":
+		handler = h.fanoutWebSocket
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("go-httpbin does not handle the path %s, use /fanout/{channel}[/sse|/ws]", r.URL.Path))
+		return
+	}
+	methods(func(w http.ResponseWriter, r *http.Request) { handler(w, r, channel) }, method)(w, r)
+}
+
+func (h *HTTPBin) fanoutPublish(w http.ResponseWriter, r *http.Request, channel string) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxFanoutMessageSize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error reading request body: %w", err))
+		return
+	}
+	if len(data) > maxFanoutMessageSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("message too large, at most %d bytes allowed", maxFanoutMessageSize))
+		return
+	}
+
+	id, subscribers, dropped, err := h.fanout.publish(channel, data)
+	if err != nil {
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	writeJSON(http.StatusOK, w, fanoutPublishResponse{
+		Channel:     channel,
+		ID:          id,
+		Subscribers: subscribers,
+		Dropped:     dropped,
+	})
+}
+
+// fanoutSSE delivers a channel's messages as server-sent events, first
+// replaying any buffered messages published after the Last-Event-ID given by
+// a reconnecting client.
+func (h *HTTPBin) fanoutSSE(w http.ResponseWriter, r *http.Request, channel string) {
+	var lastEventID int64
+	if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+		var err error
+		lastEventID, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || lastEventID < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid Last-Event-ID"))
+			return
+		}
+	}
+
+	sub, replay, err := h.fanout.subscribe(channel, lastEventID)
+	if err != nil {
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	defer h.fanout.unsubscribe(channel, sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	send := func(msg fanoutMessage) error {
+		if dropped := sub.takeDropped(); dropped > 0 {
+			if err := writeAndFlush(w, []byte(fmt.Sprintf("event: dropped\ndata: %d\n\n", dropped))); err != nil {
+				return err
+			}
+		}
+		return writeAndFlush(w, formatSSEEvent(msg.id, msg.data))
+	}
+	for _, msg := range replay {
+		if err := send(msg); err != nil {
+			annotateWriteError(r, err)
+			return
+		}
+	}
+
+	timer := time.NewTimer(h.MaxDuration)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-sub.queue:
+			if err := send(msg); err != nil {
+				annotateWriteError(r, err)
+				return
+			}
+		case <-sub.closed:
+			return
+		case <-timer.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// fanoutWebSocket delivers a channel's messages to a WebSocket client as
+// JSON objects, and publishes any messages the client sends.
+func (h *HTTPBin) fanoutWebSocket(w http.ResponseWriter, r *http.Request, channel string) {
+	sub, _, err := h.fanout.subscribe(channel, 0)
+	if err != nil {
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	defer h.fanout.unsubscribe(channel, sub)
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	conn.MaxMessageSize = maxFanoutMessageSize
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			h.fanout.publish(channel, msg)
+		}
+	}()
+
+	send := func(msg fanoutMessage) error {
+		if dropped := sub.takeDropped(); dropped > 0 {
+			if err := conn.WriteMessage(websocket.OpText, mustMarshalCompactJSON(fanoutWebSocketMessage{Dropped: dropped})); err != nil {
+				return err
+			}
+		}
+		return conn.WriteMessage(websocket.OpText, mustMarshalCompactJSON(fanoutWebSocketMessage{ID: msg.id, Data: string(msg.data)}))
+	}
+
+	timer := time.NewTimer(h.MaxDuration)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-sub.queue:
+			if err := send(msg); err != nil {
+				annotateWriteError(r, err)
+				conn.Close(websocket.CloseGoingAway, "write failed")
+				return
+			}
+		case <-sub.closed:
+			conn.Close(websocket.CloseGoingAway, "channel reset")
+			return
+		case <-timer.C:
+			conn.Close(websocket.CloseNormalClosure, "subscription expired")
+			return
+		case <-readErr:
+			conn.Close(websocket.CloseGoingAway, "read failed")
+			return
+		}
+	}
+}
+
+// WebSocketEcho upgrades the connection to a WebSocket and echoes back every
+// text and binary message it receives, answering pings with pongs, so that
+// WebSocket-aware proxies and load balancers can be exercised. Messages
+// larger than ?max_message_size= bytes (MaxBodySize by default), or sent in
+// frames larger than ?max_fragment_size= bytes, close the connection with
+// status 1009 (message too big). Connections are closed after MaxDuration,
+// and the messages and bytes received and echoed are reported to the
+// Observer via annotations.
+//
+// Requests that are not WebSocket handshakes get 426 Upgrade Required.
+func (h *HTTPBin) WebSocketEcho(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsHandshake(r) {
+		w.Header().Set("Upgrade", "websocket")
+		writeError(w, http.StatusUpgradeRequired, errors.New("this endpoint requires a WebSocket handshake, with Connection: Upgrade and Upgrade: websocket headers"))
+		return
+	}
+	q := r.URL.Query()
+	maxMessageSize, err := parseBoundedInt(q.Get("max_message_size"), int(h.MaxBodySize), 1, int(h.MaxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid max_message_size: %w", err))
+		return
+	}
+	maxFragmentSize, err := parseBoundedInt(q.Get("max_fragment_size"), 0, 1, maxMessageSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid max_fragment_size: %w", err))
+		return
+	}
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	conn.MaxMessageSize = int64(maxMessageSize)
+	conn.MaxFrameSize = int64(maxFragmentSize)
+
+	var (
+		messages       int
+		received, sent int64
+		closeCode      int
+	)
+	defer func() {
+		ctx := r.Context()
+		Annotate(ctx, "websocket_messages", strconv.Itoa(messages))
+		Annotate(ctx, "websocket_bytes_received", strconv.FormatInt(received, 10))
+		Annotate(ctx, "websocket_bytes_sent", strconv.FormatInt(sent, 10))
+		if closeCode != 0 {
+			Annotate(ctx, "websocket_close_code", strconv.Itoa(closeCode))
+		}
+	}()
+
+	deadline := time.Now().Add(h.MaxDuration)
+	conn.SetReadDeadline(deadline)
+	conn.SetWriteDeadline(deadline)
+	for {
+		op, msg, err := conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			var netErr net.Error
+			switch {
+			case errors.As(err, &closeErr):
+				closeCode = closeErr.Code
+			case errors.As(err, &netErr) && netErr.Timeout():
+				closeCode = websocket.CloseNormalClosure
+				conn.Close(closeCode, "maximum connection lifetime reached")
+			default:
+				conn.Close(websocket.CloseGoingAway, "read failed")
+			}
+			return
+		}
+		messages++
+		received += int64(len(msg))
+		if err := conn.WriteMessage(op, msg); err != nil {
+			annotateWriteError(r, err)
+			conn.Close(websocket.CloseGoingAway, "write failed")
+			return
+		}
+		sent += int64(len(msg))
+	}
+}
+
+// PatchTarget exposes a small per-key JSON document that PATCH requests
+// modify using either an RFC 6902 JSON Patch or an RFC 7386 JSON Merge Patch,
+// so clients can check their handling of failed test operations (409) and
+// unsupported patch formats (415). GET returns the document and DELETE
+// resets it.
+func (h *HTTPBin) PatchTarget(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		key = "default"
+	}
+	if !isSlug(key) {
+		writeError(w, http.StatusBadRequest, errors.New("invalid key, must be 1-32 letters, digits, dashes, or underscores"))
+		return
+	}
+
+	w.Header().Set("Accept-Patch", acceptPatch)
+	switch r.Method {
+	case "DELETE":
+		h.patchTargets.delete(key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "GET", "HEAD":
+		doc, err := h.patchTargets.get(key)
+		if err != nil {
+			writeError(w, http.StatusTooManyRequests, err)
+			return
+		}
+		writeJSON(http.StatusOK, w, doc)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != jsonPatchContentType && mediaType != mergePatchContentType {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported patch media type %q, must be one of %s", mediaType, acceptPatch))
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error reading request body: %w", err))
+		return
+	}
+
+	var patch func(doc interface{}) (interface{}, error)
+	if mediaType == jsonPatchContentType {
+		ops, err := parseJSONPatch(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		patch = func(doc interface{}) (interface{}, error) { return applyJSONPatch(doc, ops) }
+	} else {
+		var mergePatch interface{}
+		if err := json.Unmarshal(body, &mergePatch); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid merge-patch document: %w", err))
+			return
+		}
+		patch = func(doc interface{}) (interface{}, error) { return applyMergePatch(doc, mergePatch), nil }
+	}
+
+	doc, err := h.patchTargets.update(key, func(doc interface{}) (interface{}, error) {
+		doc, err := patch(doc)
+		if err != nil {
+			return nil, err
+		}
+		return doc, checkPatchedSize(doc)
+	})
+	switch {
+	case errors.Is(err, errPatchConflict):
+		writeError(w, http.StatusConflict, err)
+		return
+	case errors.Is(err, errPatchTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusTooManyRequests, err)
+		return
+	}
+	writeJSON(http.StatusOK, w, doc)
+}
+
+// Verify streams the request body through the hash named by a sha256, md5,
+// or crc32c query param (or given as a standard Content-MD5 header) and
+// reports whether the computed digest matches the supplied one.
+func (h *HTTPBin) Verify(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var algorithm, expected string
+	for _, name := range []string{"sha256", "md5", "crc32c"} {
+		if v := q.Get(name); v != "" {
+			if algorithm != "" {
+				writeError(w, http.StatusBadRequest, errors.New("only one of sha256, md5, crc32c, or Content-MD5 may be given"))
+				return
+			}
+			algorithm, expected = name, strings.ToLower(v)
+		}
+	}
+	if contentMD5 := r.Header.Get("Content-MD5"); contentMD5 != "" {
+		if algorithm != "" {
+			writeError(w, http.StatusBadRequest, errors.New("only one of sha256, md5, crc32c, or Content-MD5 may be given"))
+			return
+		}
+		decoded, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(decoded) != md5.Size {
+			writeError(w, http.StatusBadRequest, errors.New("invalid Content-MD5 header, must be a base64-encoded MD5 digest"))
+			return
+		}
+		algorithm, expected = "md5", hex.EncodeToString(decoded)
+	}
+	if algorithm == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing digest, one of sha256, md5, crc32c, or Content-MD5 is required"))
+		return
+	}
+
+	hasher := verifyHashes[algorithm]()
+	if decoded, err := hex.DecodeString(expected); err != nil || len(decoded) != hasher.Size() {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s digest, must be %d hex characters", algorithm, hasher.Size()*2))
+		return
+	}
+
+	if _, err := io.Copy(hasher, r.Body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error reading request body: %w", err))
+		return
+	}
+	actual := hex.EncodeToString(hasher.Sum(nil))
+
+	resp := verifyResponse{
+		Match:     actual == expected,
+		Algorithm: algorithm,
+		Expected:  expected,
+		Actual:    actual,
+	}
+	status := http.StatusOK
+	if !resp.Match {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(status, w, resp)
+}
+
+// Stats reports the number of requests, request body bytes read, and
+// response body bytes written for each route that has handled a request
+// since the instance started (or was last reset via /admin/reset), along
+// with the state of the queue used by WithAsyncObserver, if any.
+func (h *HTTPBin) Stats(w http.ResponseWriter, r *http.Request) {
+	resp := statsResponse{
+		Total:  h.traffic.total.snapshot(),
+		Routes: make(map[string]trafficStats),
+	}
+	for pattern, c := range h.traffic.routes {
+		if stats := c.snapshot(); stats.Requests > 0 {
+			resp.Routes[pattern] = stats
+		}
+	}
+	if h.asyncObserver != nil {
+		resp.Observer = h.asyncObserver.stats()
+	}
+	writeJSON(http.StatusOK, w, resp)
+}
+
+// Metrics exposes the request counts and latency histograms collected since
+// the instance started (or was last reset via /admin/reset) in the
+// Prometheus text exposition format, for scraping.
+func (h *HTTPBin) Metrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	h.metrics.writeTo(&buf)
+	writeResponse(w, http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
+
+// Bytes returns N bytes of the content given by the pattern param: random
+// bytes generated with an optional seed by default, or zeros, repeating
+// text, or a repeating cycle of every byte value.
+func (h *HTTPBin) Bytes(w http.ResponseWriter, r *http.Request) {
+	h.handleBytes(w, r, false)
+}
+
+// StreamBytes streams N bytes of the content given by the pattern param, as
+// for Bytes, in chunks of a given size, optionally pausing for a given delay
+// between chunks.
+func (h *HTTPBin) StreamBytes(w http.ResponseWriter, r *http.Request) {
+	h.handleBytes(w, r, true)
+}
+
+// handleBytes consolidates the logic for validating input params of the Bytes
+// and StreamBytes endpoints and knows how to write the response in chunks if
+// streaming is true.
+func (h *HTTPBin) handleBytes(w http.ResponseWriter, r *http.Request, streaming bool) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	numBytes, err := strconv.Atoi(parts[2])
+	if err != nil {
+		writeParamError(w, "n", errors.New("must be an integer"))
+		return
+	}
+
+	if numBytes < 0 {
+		writeParamError(w, "n", errors.New("must not be negative"))
+		return
+	}
+
+	// Special case 0 bytes and exit early, since streaming & chunk size do not
+	// matter here.
+	if numBytes == 0 {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if numBytes > 100*1024 {
+		numBytes = 100 * 1024
+	}
+
+	var (
+		chunkSize     int
+		write         func([]byte) error
+		timing        = getTimingRecorder(r)
+		generateStart time.Time
+	)
+
+	if streaming {
+		if r.URL.Query().Get("chunk_size") != "" {
+			chunkSize, err = strconv.Atoi(r.URL.Query().Get("chunk_size"))
+			if err != nil {
+				writeParamError(w, "chunk_size", errors.New("must be an integer"))
+				return
+			}
+		} else {
+			chunkSize = 10 * 1024
+		}
+
+		var delay time.Duration
+		if raw := r.URL.Query().Get("delay"); raw != "" {
+			delay, err = parseBoundedDuration(raw, 0, h.MaxDuration)
+			if err != nil {
+				writeParamError(w, "delay", err)
+				return
+			}
+		}
+		// Clamp the delay so that the pauses between chunks add up to no
+		// more than MaxDuration
+		numChunks := 1
+		if chunkSize > 0 {
+			numChunks = (numBytes + chunkSize - 1) / chunkSize
+		}
+		if numChunks > 1 && time.Duration(numChunks-1)*delay > h.MaxDuration {
+			delay = h.MaxDuration / time.Duration(numChunks-1)
+			w.Header().Set("X-Httpbin-Delay-Clamped", "true")
+		}
+		if delay > 0 {
+			w.Header().Set("X-Httpbin-Chunk-Delay", delay.String())
+		}
+
+		write = func() func(chunk []byte) error {
+			f := w.(http.Flusher)
+			written := 0
+			return func(chunk []byte) error {
+				if written > 0 && delay > 0 {
+					select {
+					case <-r.Context().Done():
+						return r.Context().Err()
+					case <-time.After(delay):
+					}
+				}
+				written++
+				_, err := w.Write(chunk)
+				f.Flush()
+				return err
+			}
+		}()
+	} else {
+		chunkSize = numBytes
+		write = func(chunk []byte) error {
+			timing.add("generate", time.Since(generateStart))
+			defer timing.phase("write")()
+			w.Header().Set("Content-Length", strconv.Itoa(len(chunk)))
+			w.WriteHeader(http.StatusOK)
+			_, err := w.Write(chunk)
+			return err
+		}
+	}
+
+	// rng/seed
+	seed, err := parseSeedValue(r.URL.Query().Get("seed"))
+	if err != nil {
+		writeParamError(w, "seed", err)
+		return
+	}
+
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		pattern = bytesPatternRandom
+	}
+	next, err := bytesPatternGenerator(pattern, seed)
+	if err != nil {
+		writeParamError(w, "pattern", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Httpbin-Pattern", pattern)
+	if pattern == bytesPatternRandom {
+		w.Header().Set("X-Httpbin-Seed", strconv.FormatInt(seed, 10))
+	}
+	annotateIntendedBytes(r, int64(numBytes))
+	if streaming {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	var chunk []byte
+	generateStart = time.Now()
+	for i := 0; i < numBytes; i++ {
+		chunk = append(chunk, next(i))
+		if len(chunk) == chunkSize {
+			if err := write(chunk); err != nil {
+				annotateWriteError(r, err)
+				return
+			}
+			chunk = nil
+		}
+	}
+	if len(chunk) > 0 {
+		if err := write(chunk); err != nil {
+			annotateWriteError(r, err)
+		}
+	}
+}
+
+// Links redirects to the first page in a series of N links
+func (h *HTTPBin) Links(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 && len(parts) != 4 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	n, err := strconv.Atoi(parts[2])
+	if err != nil || n < 0 || n > 256 {
+		http.Error(w, "Invalid link count", http.StatusBadRequest)
+		return
+	}
+
+	// Are we handling /links/<n>/<offset>? If so, render an HTML page
+	if len(parts) == 4 {
+		offset, err := strconv.Atoi(parts[3])
+		if err != nil {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+		}
+		doLinksPage(w, r, n, offset)
+		return
+	}
+
+	// Otherwise, redirect from /links/<n> to /links/<n>/0
+	r.URL.Path = r.URL.Path + "/0"
+	w.Header().Set("Location", r.URL.String())
+	w.WriteHeader(http.StatusFound)
+}
+
+// doLinksPage renders a page with a series of N links
+func doLinksPage(w http.ResponseWriter, r *http.Request, n int, offset int) {
+	w.Header().Add("Content-Type", htmlContentType)
+	w.WriteHeader(http.StatusOK)
+
+	w.Write([]byte("<html><head><title>Links</title></head><body>"))
+	for i := 0; i < n; i++ {
+		if i == offset {
+			fmt.Fprintf(w, "%d ", i)
+		} else {
+			fmt.Fprintf(w, `<a href="/links/%d/%d">%d</a> `, n, i, i)
+		}
+	}
+	w.Write([]byte("</body></html>"))
+}
+
+// ImageAccept responds with the image format most acceptable to the client,
+// according to the q-values in its Accept header
+func (h *HTTPBin) ImageAccept(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Accept")
+	contentType := negotiateContentType(r.Header.Get("Accept"), imageContentTypes)
+	if contentType == "" {
+		http.Error(w, "Unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+	doImage(w, imageKind(contentType))
+}
+
+// Image responds with an image of a specific kind, from /image/<kind>
+func (h *HTTPBin) Image(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("width") != "" || q.Get("height") != "" {
+		h.doGeneratedImage(w, q, parts[2])
+		return
+	}
+	doImage(w, parts[2])
+}
+
+// doGeneratedImage responds with a test pattern image of the dimensions
+// given by the width and height query params, encoded on the fly. The pixel
+// count is bounded by MaxBodySize, which the patterns compress far below.
+func (h *HTTPBin) doGeneratedImage(w http.ResponseWriter, q url.Values, kind string) {
+	encode, ok := imageEncoders[kind]
+	if !ok {
+		writeParamError(w, "format", errors.New("sized images can only be generated as png or jpeg"))
+		return
+	}
+	width, err := parseBoundedInt(q.Get("width"), defaultImageDimension, 1, maxImageDimension)
+	if err != nil {
+		writeParamError(w, "width", err)
+		return
+	}
+	height, err := parseBoundedInt(q.Get("height"), defaultImageDimension, 1, maxImageDimension)
+	if err != nil {
+		writeParamError(w, "height", err)
+		return
+	}
+	if int64(width)*int64(height) > h.MaxBodySize {
+		writeParamError(w, "height", fmt.Errorf("%dx%d image exceeds the limit of %d pixels", width, height, h.MaxBodySize))
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, generateImage(width, height)); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if int64(buf.Len()) > h.MaxBodySize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("encoded image of %d bytes exceeds the limit of %d bytes", buf.Len(), h.MaxBodySize))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	writeResponse(w, http.StatusOK, "image/"+kind, buf.Bytes())
+}
+
+// doImage responds with a specific kind of image, if there is an image asset
+// of the given kind.
+func doImage(w http.ResponseWriter, kind string) {
+	img, err := staticAsset("image." + kind)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	contentType := "image/" + kind
+	if kind == "svg" {
+		contentType = "image/svg+xml"
+	}
+	writeResponse(w, http.StatusOK, contentType, img)
+}
+
+// XML responds with an XML document
+func (h *HTTPBin) XML(w http.ResponseWriter, r *http.Request) {
+	writeText(w, r, http.StatusOK, "application/xml", mustStaticAsset("sample.xml"))
+}
+
+// SOAP echoes a SOAP 1.1 (text/xml) or SOAP 1.2 (application/soap+xml)
+// request inside a SOAP envelope of the same version, or responds with a SOAP
+// Fault if the request is not a well-formed envelope. A ?fault=client or
+// ?fault=server query param forces the corresponding fault.
+func (h *HTTPBin) SOAP(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	version, ok := soapVersions[mediaType]
+	if !ok {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported media type %q, must be text/xml or application/soap+xml", mediaType))
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("error reading request body: %w", err))
+		return
+	}
+
+	switch r.URL.Query().Get("fault") {
+	case "":
+	case "client":
+		writeSOAPFault(w, version, true, "Client fault requested via ?fault=client")
+		return
+	case "server":
+		writeSOAPFault(w, version, false, "Server fault requested via ?fault=server")
+		return
+	default:
+		writeParamError(w, "fault", errors.New("must be client or server"))
+		return
+	}
+
+	if err := parseSOAPEnvelope(body, version); err != nil {
+		writeSOAPFault(w, version, true, err.Error())
+		return
+	}
+
+	// SOAP 1.1 carries the action in its own header, while SOAP 1.2 carries
+	// it as a media type parameter
+	action := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	if version == soap12 {
+		action = params["action"]
+	}
+	digest := sha256.Sum256(body)
+	writeSOAPEcho(w, version, getRequestHeaders(r), action, hex.EncodeToString(digest[:]))
+}
+
+// DigestAuth handles a simple implementation of HTTP Digest Authentication,
+// which supports the "auth" and "auth-int" QOPs and the MD5 and SHA-256
+// crypto algorithms and their "-sess" variants. The client must use the QOP
+// and algorithm given in the path, which defaults to MD5.
+//
+// Nonces are signed, so forged ones are rejected. Given ?stale_after=, a
+// nonce goes stale after that many seconds or, as e.g. 3uses, that many
+// uses, and a request with otherwise valid credentials is challenged again
+// with stale=true and a fresh nonce. Nonces are only accepted by instances
+// sharing the key that signed them, which is random per instance unless set
+// via WithDigestNonceKey.
+//
+// /digest-auth/<qop>/<user>/<passwd>
+// /digest-auth/<qop>/<user>/<passwd>/<algorithm>
+func (h *HTTPBin) DigestAuth(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	count := len(parts)
+
+	if count != 5 && count != 6 {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	qop := strings.ToLower(parts[2])
+	user := parts[3]
+	password := parts[4]
+
+	algoName := "MD5"
+	if count == 6 {
+		algoName = parts[5]
+	}
+
+	if qop != digest.QOPAuth && qop != digest.QOPAuthInt {
+		http.Error(w, "Invalid QOP directive", http.StatusBadRequest)
+		return
+	}
+	algorithm, ok := digest.ParseAlgorithm(algoName)
+	if !ok {
+		http.Error(w, "Invalid algorithm", http.StatusBadRequest)
+		return
+	}
+
+	staleness, err := parseDigestStaleAfter(r.URL.Query().Get("stale_after"))
+	if err != nil {
+		writeParamError(w, "stale_after", err)
+		return
+	}
+
+	// auth-int hashes the request body into the response
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxBodySize)
+	}
+	result := h.digestAuth.Check(r, user, password, qop, algorithm, staleness)
+	annotateAuth(r, user, result == digest.Authorized)
+	if result != digest.Authorized {
+		w.Header().Set("WWW-Authenticate", h.digestAuth.Challenge("go-httpbin", qop, algorithm, result == digest.Stale))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(http.StatusOK, w, authResponse{
+		Authorized: true,
+		User:       user,
+	})
+}
+
+// maxUUIDCount is the largest number of UUIDs /uuid will generate at once.
+const maxUUIDCount = 1000
+
+// UUID - responds with a generated UUID, or a batch of them given ?count=, of
+// the version given by ?version= (1, 4, or 7, defaulting to 4)
+func (h *HTTPBin) UUID(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	now := h.now()
+	generate := func(int) string { return uuidv4() }
+	switch q.Get("version") {
+	case "", "4":
+	case "1":
+		// Successive timestamps keep each UUID in a batch distinct
+		generate = func(i int) string { return uuidv1(now.Add(time.Duration(i) * 100 * time.Nanosecond)) }
+	case "7":
+		generate = func(int) string { return uuidv7(now) }
+	default:
+		writeParamError(w, "version", errors.New("must be 1, 4, or 7"))
+		return
+	}
+
+	if _, ok := q["count"]; !ok {
+		writeJSON(http.StatusOK, w, uuidResponse{
+			UUID: generate(0),
+		})
+		return
+	}
+	count, err := strconv.Atoi(q.Get("count"))
+	if err != nil || count < 1 || count > maxUUIDCount {
+		writeParamError(w, "count", fmt.Errorf("must be an integer between 1 and %d", maxUUIDCount))
+		return
+	}
+	resp := uuidsResponse{UUIDs: make([]string, count)}
+	for i := range resp.UUIDs {
+		resp.UUIDs[i] = generate(i)
+	}
+	if q.Get("version") == "7" {
+		// Version 7 UUIDs sharing a timestamp are ordered by their random
+		// bits, so sorting them keeps the batch in the order they sort
+		sort.Strings(resp.UUIDs)
+	}
+	writeJSON(http.StatusOK, w, resp)
+}
+
+// Base64 - encodes/decodes input data
+func (h *HTTPBin) Base64(w http.ResponseWriter, r *http.Request) {
+	b, err := newBase64Helper(r.URL.Path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		return
+	}
+
+	var result []byte
+	var base64Error error
+
+	if b.operation == "decode" {
+		result, base64Error = b.Decode()
+	} else {
+		result, base64Error = b.Encode()
+	}
+
+	if base64Error != nil {
+		http.Error(w, fmt.Sprintf("%s failed: %s", b.operation, base64Error), http.StatusBadRequest)
+		return
+	}
+	if int64(len(result)) > h.MaxBodySize {
+		http.Error(w, fmt.Sprintf("%s failed: output of %d bytes exceeds the limit of %d", b.operation, len(result), h.MaxBodySize), http.StatusBadRequest)
+		return
+	}
+	writeResponse(w, http.StatusOK, "text/plain", result)
+}
+
+// DumpRequest - returns the given request in its HTTP/1.x wire representation.
+// The returned representation is an approximation only;
+// some details of the initial request are lost while parsing it into
+// an http.Request. In particular, the order and case of header field
+// names are lost.
+func (h *HTTPBin) DumpRequest(w http.ResponseWriter, r *http.Request) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "text":
+	case "json":
+		h.dumpRequestJSON(w, r)
+		return
+	default:
+		writeParamError(w, "format", fmt.Errorf("must be one of text, json, got %q", format))
+		return
+	}
+
+	dump, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(dump)
+}
+
+// dumpRequestJSON renders the request as a dumpRequestResponse, with a body
+// of up to MaxBodySize bytes.
+func (h *HTTPBin) dumpRequestJSON(w http.ResponseWriter, r *http.Request) {
+	resp := dumpRequestResponse{
+		Method:        r.Method,
+		URL:           r.URL.RequestURI(),
+		Proto:         r.Proto,
+		Headers:       dumpHeaders(getRequestHeaders(r), "Host"),
+		ContentLength: r.ContentLength,
+	}
+
+	if r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, h.MaxBodySize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("error reading request body: %w", err))
+			return
+		}
+		if int64(len(body)) == h.MaxBodySize {
+			// Anything but a clean EOF, including the error from the
+			// MaxBytesReader installed by limitRequestSize, means there was
+			// more to read
+			var probe [1]byte
+			_, err := io.ReadFull(r.Body, probe[:])
+			resp.Truncated = err != io.EOF
+		}
+		if utf8.Valid(body) {
+			resp.Body = string(body)
+			resp.BodyEncoding = "utf-8"
+		} else {
+			resp.Body = base64.StdEncoding.EncodeToString(body)
+			resp.BodyEncoding = "base64"
+		}
+	}
+
+	// Trailers are only populated once the body has been read in full
+	if !resp.Truncated {
+		resp.Trailers = dumpHeaders(r.Trailer, "")
+	}
+
+	writeJSON(http.StatusOK, w, resp)
+}
+
+// Egress makes an outbound GET request to the given target URL, which must be
+// on a host in the AllowedRedirectDomains allowlist, and reports the source
+// address the server used along with the target's response status and the
+// request latency.
+func (h *HTTPBin) Egress(w http.ResponseWriter, r *http.Request) {
+	rawTarget := r.URL.Query().Get("target")
+	if rawTarget == "" {
+		http.Error(w, "Missing target", http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(rawTarget)
+	if err != nil || !target.IsAbs() || (target.Scheme != "http" && target.Scheme != "https") {
+		http.Error(w, "Invalid target", http.StatusBadRequest)
+		return
+	}
+	if !h.redirectDomainAllowed(target.Host) {
+		http.Error(w, "Forbidden egress target", http.StatusForbidden)
+		return
+	}
+
+	select {
+	case h.egressSem <- struct{}{}:
+		defer func() { <-h.egressSem }()
+	default:
+		http.Error(w, "Too many concurrent egress requests", http.StatusServiceUnavailable)
+		return
+	}
+
+	var localAddr, remoteAddr net.Addr
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localAddr = info.Conn.LocalAddr()
+			remoteAddr = info.Conn.RemoteAddr()
+		},
+	}
+	ctx := httptrace.WithClientTrace(r.Context(), trace)
+	req, _ := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+
+	start := time.Now()
+	resp, err := newEgressClient(h.MaxDuration, h.egressAllowIP).Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		if errors.Is(err, errPrivateAddress) {
+			http.Error(w, "Forbidden egress target: private address", http.StatusForbidden)
+			return
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			classifyError(r, ErrorClassTimeout)
+		}
+		http.Error(w, fmt.Sprintf("Egress request failed: %s", err), http.StatusBadGateway)
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, h.MaxBodySize))
+	resp.Body.Close()
+
+	result := egressResponse{
+		Target:    target.String(),
+		Status:    resp.StatusCode,
+		LatencyMS: latency.Seconds() * 1e3,
+	}
+	if addr, ok := localAddr.(*net.TCPAddr); ok {
+		result.SourceIP = addr.IP.String()
+		result.SourcePort = addr.Port
+	}
+	if remoteAddr != nil {
+		result.RemoteAddr = remoteAddr.String()
+	}
+	writeJSON(http.StatusOK, w, result)
+}
+
+// AdminSettings returns the instance's runtime settings on GET, and applies
+// a partial update given as a JSON body on PUT.
+func (h *HTTPBin) AdminSettings(w http.ResponseWriter, r *http.Request) {
+	if !checkBearerToken(w, r, h.adminToken) {
+		Annotate(r.Context(), "admin_auth", "rejected")
+		return
+	}
+
+	if r.Method == "PUT" {
+		var update adminSettingsUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid settings: %w", err))
+			return
+		}
+
+		h.settingsMu.Lock()
+		settings, err := update.apply(*h.currentSettings(), h.MaxDuration, h.MaxBodySize)
+		if err == nil {
+			h.settings.Store(&settings)
+		}
+		h.settingsMu.Unlock()
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		Annotate(r.Context(), "admin_action", "update_settings")
+		Annotate(r.Context(), "admin_settings", string(mustMarshalCompactJSON(newAdminSettingsResponse(&settings))))
+	}
+
+	writeJSON(http.StatusOK, w, newAdminSettingsResponse(h.currentSettings()))
+}
+
+// AdminReset clears all of the instance's stateful stores.
+func (h *HTTPBin) AdminReset(w http.ResponseWriter, r *http.Request) {
+	if !checkBearerToken(w, r, h.adminToken) {
+		Annotate(r.Context(), "admin_auth", "rejected")
+		return
+	}
+	for _, reset := range h.resetters {
+		reset()
+	}
+	Annotate(r.Context(), "admin_action", "reset")
+	writeJSON(http.StatusOK, w, adminResetResponse{Reset: len(h.resetters)})
+}
+
+// SelfTest exercises every endpoint that has an example request in the route
+// table by invoking the instance's own handler directly, reporting whether
+// each responded with its expected status. The whole run is bounded by
+// MaxDuration, after which any remaining endpoints are reported as failed.
+func (h *HTTPBin) SelfTest(w http.ResponseWriter, r *http.Request) {
+	if !checkBearerToken(w, r, h.selfTestToken) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.MaxDuration)
+	defer cancel()
+
+	resp := selfTestResponse{Passed: true}
+	start := time.Now()
+	for _, ex := range h.exampleRequests() {
+		// Never recurse into /selftest itself
+		if ex.Route == r.URL.Path {
+			continue
+		}
+
+		result := selfTestResult{
+			Route:          ex.Route,
+			Method:         ex.Method,
+			URL:            ex.Path,
+			ExpectedStatus: ex.ExpectedStatus,
+		}
+
+		if ctx.Err() != nil {
+			result.Error = "self test time budget exhausted"
+		} else {
+			req, _ := http.NewRequestWithContext(ctx, ex.Method, ex.Path, http.NoBody)
+			req.Host = r.Host
+			req.RemoteAddr = r.RemoteAddr
+			req.RequestURI = ex.Path
+			req.Header.Set("User-Agent", "go-httpbin-selftest")
+			sw := &selfTestResponseWriter{header: make(http.Header)}
+
+			reqStart := time.Now()
+			h.handler.ServeHTTP(sw, req)
+			result.DurationMS = time.Since(reqStart).Seconds() * 1e3
+
+			result.Status = sw.status
+			if result.Status == 0 {
+				result.Status = http.StatusOK
+			}
+			result.Passed = result.Status == ex.ExpectedStatus
+		}
+
+		if !result.Passed {
+			resp.Passed = false
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	resp.DurationMS = time.Since(start).Seconds() * 1e3
 
-	numBytes, err := strconv.Atoi(parts[2])
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	status := http.StatusOK
+	if !resp.Passed {
+		status = http.StatusInternalServerError
 	}
+	writeJSON(status, w, resp)
+}
 
-	if numBytes < 0 {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+// Resolve reports what the server resolves the given host to, so that
+// resolutions from the client's and server's environments can be compared
+// when debugging split-horizon DNS. Only hosts in AllowedRedirectDomains may
+// be resolved.
+//
+// Failed lookups are reported via the error field rather than an error
+// status. Note that the stdlib resolver only exposes the final canonical name
+// of a CNAME chain, not its intermediate hops.
+func (h *HTTPBin) Resolve(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		http.Error(w, "Missing host", http.StatusBadRequest)
 		return
 	}
-
-	// Special case 0 bytes and exit early, since streaming & chunk size do not
-	// matter here.
-	if numBytes == 0 {
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusOK)
+	if !h.redirectDomainAllowed(host) {
+		http.Error(w, "Forbidden host", http.StatusForbidden)
 		return
 	}
 
-	if numBytes > 100*1024 {
-		numBytes = 100 * 1024
+	ctx, cancel := context.WithTimeout(r.Context(), resolveTimeout)
+	defer cancel()
+
+	resp := resolveResponse{
+		Host: host,
+		A:    []string{},
+		AAAA: []string{},
 	}
 
-	var chunkSize int
-	var write func([]byte)
+	start := time.Now()
+	addrs, err := h.resolver.LookupIPAddr(ctx, host)
+	if err == nil {
+		var cname string
+		cname, err = h.resolver.LookupCNAME(ctx, host)
+		resp.CanonicalName = cname
+	}
+	resp.LatencyMS = time.Since(start).Seconds() * 1e3
 
-	if streaming {
-		if r.URL.Query().Get("chunk_size") != "" {
-			chunkSize, err = strconv.Atoi(r.URL.Query().Get("chunk_size"))
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+	if err != nil {
+		resp.Error = classifyLookupError(err)
+		resp.ErrorDetail = err.Error()
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			resp.A = append(resp.A, addr.IP.String())
 		} else {
-			chunkSize = 10 * 1024
-		}
-
-		write = func() func(chunk []byte) {
-			f := w.(http.Flusher)
-			return func(chunk []byte) {
-				w.Write(chunk)
-				f.Flush()
-			}
-		}()
-	} else {
-		chunkSize = numBytes
-		write = func(chunk []byte) {
-			w.Header().Set("Content-Length", strconv.Itoa(len(chunk)))
-			w.Write(chunk)
+			resp.AAAA = append(resp.AAAA, addr.IP.String())
 		}
 	}
+	writeJSON(http.StatusOK, w, resp)
+}
 
-	// rng/seed
-	rng, err := parseSeed(r.URL.Query().Get("seed"))
-	if err != nil {
-		http.Error(w, "invalid seed", http.StatusBadRequest)
+// Churn reports the sequence number of the connection a request arrived on
+// and the number of requests handled on that connection, closing the
+// connection after every Nth request (given by the close_every query param,
+// defaulting to 10) so that clients can exercise their connection pools
+// against a server that periodically recycles keep-alive connections.
+//
+// Each request is handled on its own, so there is no notion of a run of
+// requests: clients decide how many requests to make and count the
+// connections they observe.
+//
+// Requires the server to use HTTPBin.ConnContext.
+func (h *HTTPBin) Churn(w http.ResponseWriter, r *http.Request) {
+	conn := getConnInfo(r)
+	if conn == nil {
+		http.Error(w, "Not implemented: server must be configured with HTTPBin.ConnContext", http.StatusNotImplemented)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusOK)
-
-	var chunk []byte
-	for i := 0; i < numBytes; i++ {
-		chunk = append(chunk, byte(rng.Intn(256)))
-		if len(chunk) == chunkSize {
-			write(chunk)
-			chunk = nil
+	closeEvery := int64(10)
+	if rawCloseEvery := r.URL.Query().Get("close_every"); rawCloseEvery != "" {
+		var err error
+		closeEvery, err = strconv.ParseInt(rawCloseEvery, 10, 64)
+		if err != nil || closeEvery < 1 {
+			http.Error(w, "Invalid close_every", http.StatusBadRequest)
+			return
 		}
 	}
-	if len(chunk) > 0 {
-		write(chunk)
+
+	n := conn.nextRequest()
+	closing := n%closeEvery == 0
+	if closing {
+		w.Header().Set("Connection", "close")
 	}
+	writeJSON(http.StatusOK, w, churnResponse{
+		Connection: conn.id,
+		Request:    n,
+		CloseEvery: closeEvery,
+		Closing:    closing,
+	})
 }
 
-// Links redirects to the first page in a series of N links
-func (h *HTTPBin) Links(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) != 3 && len(parts) != 4 {
-		http.Error(w, "Not found", http.StatusNotFound)
-		return
+// DualStack reports the address family a request's connection arrived over,
+// the literal local and remote addresses of the connection, and the name of
+// the listener that accepted it if the server names its listeners with
+// HTTPBin.ListenerContext. Responses over a family given to
+// WithAddressFamilyDelay are delayed accordingly, up to MaxDuration.
+func (h *HTTPBin) DualStack(w http.ResponseWriter, r *http.Request) {
+	family, mapped := addressFamily(r.RemoteAddr)
+	resp := dualStackResponse{
+		Family:     family,
+		IPv4Mapped: mapped,
+		RemoteAddr: r.RemoteAddr,
 	}
-
-	n, err := strconv.Atoi(parts[2])
-	if err != nil || n < 0 || n > 256 {
-		http.Error(w, "Invalid link count", http.StatusBadRequest)
-		return
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		resp.LocalAddr = local.String()
+	}
+	if name, ok := r.Context().Value(listenerNameKey{}).(string); ok {
+		resp.Listener = name
 	}
 
-	// Are we handling /links/<n>/<offset>? If so, render an HTML page
-	if len(parts) == 4 {
-		offset, err := strconv.Atoi(parts[3])
-		if err != nil {
-			http.Error(w, "Invalid offset", http.StatusBadRequest)
+	if delay := h.familyDelays[family]; delay > 0 {
+		if delay > h.MaxDuration {
+			delay = h.MaxDuration
 		}
-		doLinksPage(w, r, n, offset)
-		return
+		select {
+		case <-r.Context().Done():
+			w.WriteHeader(499) // "Client Closed Request" https://httpstatuses.com/499
+			return
+		case <-time.After(delay):
+		}
+		resp.DelayMS = float64(delay) / float64(time.Millisecond)
 	}
+	writeJSON(http.StatusOK, w, resp)
+}
 
-	// Otherwise, redirect from /links/<n> to /links/<n>/0
-	r.URL.Path = r.URL.Path + "/0"
-	w.Header().Set("Location", r.URL.String())
-	w.WriteHeader(http.StatusFound)
+// Memento is an RFC 7089 resource that negotiates among a synthetic set of
+// past versions of itself based on the Accept-Datetime request header,
+// returning the version that was current at the requested time. A missing or
+// malformed Accept-Datetime selects the newest version.
+func (h *HTTPBin) Memento(w http.ResponseWriter, r *http.Request) {
+	versions := mementoVersions(h.now())
+	acceptDatetime := r.Header.Get("Accept-Datetime")
+	v := negotiateMemento(versions, acceptDatetime)
+
+	w.Header().Set("Vary", "Accept-Datetime")
+	w.Header().Set("Content-Location", fmt.Sprintf("/memento/%d", v))
+	writeMemento(w, versions, v, acceptDatetime, `</memento>; rel="original timegate"`)
 }
 
-// doLinksPage renders a page with a series of N links
-func doLinksPage(w http.ResponseWriter, r *http.Request, n int, offset int) {
-	w.Header().Add("Content-Type", htmlContentType)
-	w.WriteHeader(http.StatusOK)
+// MementoTimeGate redirects to the version of the Memento resource that was
+// current at the time given by the Accept-Datetime request header.
+func (h *HTTPBin) MementoTimeGate(w http.ResponseWriter, r *http.Request) {
+	versions := mementoVersions(h.now())
+	v := negotiateMemento(versions, r.Header.Get("Accept-Datetime"))
 
-	w.Write([]byte("<html><head><title>Links</title></head><body>"))
-	for i := 0; i < n; i++ {
-		if i == offset {
-			fmt.Fprintf(w, "%d ", i)
-		} else {
-			fmt.Fprintf(w, `<a href="/links/%d/%d">%d</a> `, n, i, i)
-		}
-	}
-	w.Write([]byte("</body></html>"))
+	w.Header().Set("Vary", "Accept-Datetime")
+	w.Header().Set("Link", `</memento>; rel="original", </memento/timemap>; rel="timemap"; type="application/link-format"`)
+	w.Header().Set("Location", fmt.Sprintf("/memento/%d", v))
+	w.WriteHeader(http.StatusFound)
 }
 
-// ImageAccept responds with an appropriate image based on the Accept header
-func (h *HTTPBin) ImageAccept(w http.ResponseWriter, r *http.Request) {
-	accept := r.Header.Get("Accept")
-	if accept == "" || strings.Contains(accept, "image/png") || strings.Contains(accept, "image/*") {
-		doImage(w, "png")
-	} else if strings.Contains(accept, "image/webp") {
-		doImage(w, "webp")
-	} else if strings.Contains(accept, "image/svg+xml") {
-		doImage(w, "svg")
-	} else if strings.Contains(accept, "image/jpeg") {
-		doImage(w, "jpeg")
-	} else {
-		http.Error(w, "Unsupported media type", http.StatusUnsupportedMediaType)
+// MementoTimeMap lists every available version of the Memento resource in
+// application/link-format.
+func (h *HTTPBin) MementoTimeMap(w http.ResponseWriter, r *http.Request) {
+	versions := mementoVersions(h.now())
+
+	links := []string{
+		`</memento>; rel="original"`,
+		`</memento/timegate>; rel="timegate"`,
+		fmt.Sprintf(`</memento/timemap>; rel="self"; type="application/link-format"; from="%s"; until="%s"`,
+			versions[0].Format(http.TimeFormat), versions[len(versions)-1].Format(http.TimeFormat)),
+	}
+	for i, t := range versions {
+		links = append(links, fmt.Sprintf(`</memento/%d>; rel="%s"; datetime="%s"`, i+1, mementoRel(versions, i+1), t.Format(http.TimeFormat)))
 	}
+	writeResponse(w, http.StatusOK, "application/link-format", []byte(strings.Join(links, ",\n")+"\n"))
 }
 
-// Image responds with an image of a specific kind, from /image/<kind>
-func (h *HTTPBin) Image(w http.ResponseWriter, r *http.Request) {
+// MementoVersion returns a specific version of the Memento resource, as
+// linked to by the timegate and timemap.
+func (h *HTTPBin) MementoVersion(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) != 3 {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
-	doImage(w, parts[2])
-}
-
-// doImage responds with a specific kind of image, if there is an image asset
-// of the given kind.
-func doImage(w http.ResponseWriter, kind string) {
-	img, err := staticAsset("image." + kind)
-	if err != nil {
-		http.Error(w, "Not Found", http.StatusNotFound)
-	}
-	contentType := "image/" + kind
-	if kind == "svg" {
-		contentType = "image/svg+xml"
+	versions := mementoVersions(h.now())
+	v, err := strconv.Atoi(parts[2])
+	if err != nil || v < 1 || v > len(versions) {
+		http.Error(w, "Invalid version", http.StatusNotFound)
+		return
 	}
-	writeResponse(w, http.StatusOK, contentType, img)
-}
-
-// XML responds with an XML document
-func (h *HTTPBin) XML(w http.ResponseWriter, r *http.Request) {
-	writeResponse(w, http.StatusOK, "application/xml", mustStaticAsset("sample.xml"))
+	writeMemento(w, versions, v, "", `</memento>; rel="original"`, `</memento/timegate>; rel="timegate"`)
 }
 
-// DigestAuth handles a simple implementation of HTTP Digest Authentication,
-// which supports the "auth" QOP and the MD5 and SHA-256 crypto algorithms.
-//
-// /digest-auth/<qop>/<user>/<passwd>
-// /digest-auth/<qop>/<user>/<passwd>/<algorithm>
-func (h *HTTPBin) DigestAuth(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	count := len(parts)
+// Challenge responds with a 401 offering one or more WWW-Authenticate
+// challenges, given by the comma-separated schemes query param (defaulting to
+// Basic,Bearer,Digest), so that clients choosing among multiple offered
+// schemes can be tested. Each challenge is sent in its own header unless
+// ?combined=true, in which case they are joined into a single header.
+func (h *HTTPBin) Challenge(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
 
-	if count != 5 && count != 6 {
-		http.Error(w, "Not Found", http.StatusNotFound)
-		return
+	realm := q.Get("realm")
+	if realm == "" {
+		realm = "go-httpbin"
 	}
 
-	qop := strings.ToLower(parts[2])
-	user := parts[3]
-	password := parts[4]
+	rawSchemes := q.Get("schemes")
+	if rawSchemes == "" {
+		rawSchemes = "Basic,Bearer,Digest"
+	}
 
-	algoName := "MD5"
-	if count == 6 {
-		algoName = strings.ToUpper(parts[5])
+	var challenges []string
+	for _, scheme := range strings.Split(rawSchemes, ",") {
+		challenge, ok := authChallenge(strings.TrimSpace(scheme), realm)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unsupported scheme %q, must be one of Basic, Bearer, Digest", scheme), http.StatusBadRequest)
+			return
+		}
+		challenges = append(challenges, challenge)
 	}
 
-	if qop != "auth" {
-		http.Error(w, "Invalid QOP directive", http.StatusBadRequest)
-		return
+	if q.Get("combined") == "true" {
+		w.Header().Set("WWW-Authenticate", strings.Join(challenges, ", "))
+	} else {
+		for _, challenge := range challenges {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
 	}
-	if algoName != "MD5" && algoName != "SHA-256" {
-		http.Error(w, "Invalid algorithm", http.StatusBadRequest)
+	writeJSON(http.StatusUnauthorized, w, challengeResponse{
+		Challenges: challenges,
+	})
+}
+
+// Sign generates a signed path that will be accepted by the Signed endpoint,
+// given a target path and an optional TTL (defaulting to 60 seconds).
+func (h *HTTPBin) Sign(w http.ResponseWriter, r *http.Request) {
+	target := r.FormValue("target")
+	if target == "" {
+		http.Error(w, "Missing target", http.StatusBadRequest)
 		return
 	}
-
-	algorithm := digest.MD5
-	if algoName == "SHA-256" {
-		algorithm = digest.SHA256
+	if !strings.HasPrefix(target, "/") {
+		target = "/" + target
 	}
 
-	if !digest.Check(r, user, password) {
-		w.Header().Set("WWW-Authenticate", digest.Challenge("go-httpbin", algorithm))
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	ttl := 60 * time.Second
+	if rawTTL := r.FormValue("ttl"); rawTTL != "" {
+		var err error
+		ttl, err = parseDuration(rawTTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
 	}
 
-	writeJSON(http.StatusOK, w, authResponse{
-		Authorized: true,
-		User:       user,
+	expiry := h.now().Add(ttl).Unix()
+	path := fmt.Sprintf("/signed/%d/%s%s", expiry, signURLPath(h.signedURLKey, expiry, target), target)
+
+	u := getURL(r)
+	u.Path = path
+	u.RawPath = ""
+	u.RawQuery = ""
+	writeJSON(http.StatusOK, w, signResponse{
+		Path:    path,
+		URL:     u.String(),
+		Expires: expiry,
 	})
 }
 
-// UUID - responds with a generated UUID
-func (h *HTTPBin) UUID(w http.ResponseWriter, r *http.Request) {
-	writeJSON(http.StatusOK, w, uuidResponse{
-		UUID: uuidv4(),
-	})
-}
+// Signed verifies a URL generated by the Sign endpoint, responding like
+// Anything if the signature is valid and unexpired, with a 403 if the
+// signature is invalid, or with a 410 if it has expired.
+//
+// /signed/<expiry>/<signature>/<target...>
+//
+// An optional ?skew= query param allows expired URLs to be accepted within
+// the configured clock skew tolerance.
+func (h *HTTPBin) Signed(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(r.URL.Path, "/", 5)
+	if len(parts) < 4 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
 
-// Base64 - encodes/decodes input data
-func (h *HTTPBin) Base64(w http.ResponseWriter, r *http.Request) {
-	b, err := newBase64Helper(r.URL.Path)
+	expiry, err := strconv.ParseInt(parts[2], 10, 64)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
 		return
 	}
 
-	var result []byte
-	var base64Error error
+	var skew time.Duration
+	if rawSkew := r.URL.Query().Get("skew"); rawSkew != "" {
+		skew, err = parseBoundedDuration(rawSkew, 0, h.signedURLMaxSkew)
+		if err != nil {
+			http.Error(w, "Invalid skew", http.StatusBadRequest)
+			return
+		}
+	}
 
-	if b.operation == "decode" {
-		result, base64Error = b.Decode()
-	} else {
-		result, base64Error = b.Encode()
+	target := "/"
+	if len(parts) == 5 {
+		target += parts[4]
 	}
 
-	if base64Error != nil {
-		http.Error(w, fmt.Sprintf("%s failed: %s", b.operation, base64Error), http.StatusBadRequest)
+	wantSig := signURLPath(h.signedURLKey, expiry, target)
+	if !hmac.Equal([]byte(parts[3]), []byte(wantSig)) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
 		return
 	}
-	writeResponse(w, http.StatusOK, "text/plain", result)
-}
 
-// DumpRequest - returns the given request in its HTTP/1.x wire representation.
-// The returned representation is an approximation only;
-// some details of the initial request are lost while parsing it into
-// an http.Request. In particular, the order and case of header field
-// names are lost.
-func (h *HTTPBin) DumpRequest(w http.ResponseWriter, r *http.Request) {
-	dump, err := httputil.DumpRequest(r, true)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if h.now().After(time.Unix(expiry, 0).Add(skew)) {
+		http.Error(w, "Signed URL expired", http.StatusGone)
 		return
 	}
-	w.Write(dump)
+
+	h.Anything(w, r)
 }
 
 // JSON - returns a sample json
 func (h *HTTPBin) JSON(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", jsonContentType)
-	w.WriteHeader(http.StatusOK)
-	w.Write(mustStaticAsset("sample.json"))
+	writeText(w, r, http.StatusOK, jsonContentType, mustStaticAsset("sample.json"))
 }
 
 // Bearer - Prompts the user for authorization using bearer authentication.
+//
+// Given ?jwt=true&secret=..., the token must be a JWT signed with HMAC-SHA256
+// under the secret whose exp and nbf claims, if any, admit the current time,
+// and its claims are returned. Invalid tokens are rejected with a JSON body
+// naming the reason.
 func (h *HTTPBin) Bearer(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	validateJWT := false
+	if raw := q.Get("jwt"); raw != "" {
+		var err error
+		validateJWT, err = strconv.ParseBool(raw)
+		if err != nil {
+			writeParamError(w, "jwt", errors.New("must be a boolean"))
+			return
+		}
+	}
+	secret := q.Get("secret")
+	if validateJWT && secret == "" {
+		writeParamError(w, "secret", errors.New("required to validate a JWT"))
+		return
+	}
+
 	reqToken := r.Header.Get("Authorization")
 	tokenFields := strings.Fields(reqToken)
 	if len(tokenFields) != 2 || tokenFields[0] != "Bearer" {
+		annotateAuth(r, "", false)
 		w.Header().Set("WWW-Authenticate", "Bearer")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+
+	var claims map[string]interface{}
+	if validateJWT {
+		var err error
+		claims, err = verifyHS256JWT(tokenFields[1], []byte(secret), h.now())
+		if err != nil {
+			jwtErr := asJWTError(err)
+			annotateAuth(r, "", false)
+			Annotate(r.Context(), "jwt_error", jwtErr.reason)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%s`, quoteString(jwtErr.description)))
+			writeJSON(http.StatusUnauthorized, w, bearerErrorResponse{
+				Error:            "invalid_token",
+				Reason:           jwtErr.reason,
+				ErrorDescription: jwtErr.description,
+			})
+			return
+		}
+	}
+
+	annotateAuth(r, "", true)
 	writeJSON(http.StatusOK, w, bearerResponse{
 		Authenticated: true,
 		Token:         tokenFields[1],
+		Claims:        claims,
 	})
 }
 
@@ -1067,3 +4688,135 @@ func (h *HTTPBin) Hostname(w http.ResponseWriter, r *http.Request) {
 		Hostname: h.hostname,
 	})
 }
+
+// Env returns the server's environment variables whose names begin with one
+// of the prefixes configured via WithEnvPrefixes, or none at all if no
+// prefixes are configured.
+func (h *HTTPBin) Env(w http.ResponseWriter, r *http.Request) {
+	resp := envResponse{}
+	if len(h.envPrefixes) > 0 {
+		for _, kv := range os.Environ() {
+			i := strings.IndexByte(kv, '=')
+			if i < 0 {
+				continue
+			}
+			name := kv[:i]
+			for _, prefix := range h.envPrefixes {
+				if strings.HasPrefix(name, prefix) {
+					resp[name] = kv[i+1:]
+					break
+				}
+			}
+		}
+	}
+	writeJSON(http.StatusOK, w, resp)
+}
+
+// OIDCDiscovery serves the OpenID Provider metadata of the OIDC simulator,
+// pointing clients at its JWKS and token endpoints.
+func (h *HTTPBin) OIDCDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(http.StatusOK, w, oidcDiscoveryResponse{
+		Issuer:                            h.oidcIssuer,
+		JWKSURI:                           h.oidcIssuer + "/jwks.json",
+		TokenEndpoint:                     h.oidcIssuer + "/oauth/token",
+		GrantTypesSupported:               []string{"client_credentials"},
+		ResponseTypesSupported:            []string{"token"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{oidcSigningAlg},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+// JWKS publishes the public keys with which the OIDC simulator signs tokens,
+// including any recently rotated-out keys that are still in their grace
+// period.
+func (h *HTTPBin) JWKS(w http.ResponseWriter, r *http.Request) {
+	keys := h.oidcKeys.published(h.now())
+	resp := jwksResponse{Keys: make([]jsonWebKey, 0, len(keys))}
+	for _, key := range keys {
+		resp.Keys = append(resp.Keys, key.jwk())
+	}
+	writeJSON(http.StatusOK, w, resp)
+}
+
+// OAuthToken issues signed JWT access tokens via the client credentials
+// grant. Any client_id, given as a form value or via basic auth, is accepted
+// along with any secret; the optional audience and scope form values are
+// reflected into the token's claims.
+func (h *HTTPBin) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(http.StatusBadRequest, w, oauthErrorResponse{Error: "invalid_request", ErrorDescription: err.Error()})
+		return
+	}
+	if grantType := r.PostForm.Get("grant_type"); grantType != "client_credentials" {
+		writeJSON(http.StatusBadRequest, w, oauthErrorResponse{
+			Error:            "unsupported_grant_type",
+			ErrorDescription: fmt.Sprintf("grant_type %q is not supported, only client_credentials", grantType),
+		})
+		return
+	}
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+	if clientID == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeJSON(http.StatusUnauthorized, w, oauthErrorResponse{Error: "invalid_client", ErrorDescription: "missing client_id"})
+		return
+	}
+	audience := r.PostForm.Get("audience")
+	if audience == "" {
+		audience = clientID
+	}
+
+	now := h.now()
+	key := h.oidcKeys.signingKey()
+	token := key.sign(oauthTokenClaims{
+		Issuer:    h.oidcIssuer,
+		Subject:   clientID,
+		Audience:  audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expires:   now.Add(oidcTokenLifetime).Unix(),
+		ID:        uuidv4(),
+		ClientID:  clientID,
+		Scope:     r.PostForm.Get("scope"),
+	})
+	Annotate(r.Context(), "oidc_kid", key.id)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(http.StatusOK, w, oauthTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(oidcTokenLifetime / time.Second),
+		Scope:       r.PostForm.Get("scope"),
+	})
+}
+
+// AdminOIDCRotateKeys replaces the OIDC simulator's signing key, keeping the
+// old key published for the grace period given by the optional ?grace=
+// duration, which defaults to the lifetime of the tokens it signed.
+func (h *HTTPBin) AdminOIDCRotateKeys(w http.ResponseWriter, r *http.Request) {
+	if !checkBearerToken(w, r, h.adminToken) {
+		Annotate(r.Context(), "admin_auth", "rejected")
+		return
+	}
+	grace := oidcKeyGracePeriod
+	if rawGrace := r.URL.Query().Get("grace"); rawGrace != "" {
+		var err error
+		grace, err = parseDuration(rawGrace)
+		if err != nil || grace < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid grace %q: must be a non-negative duration", rawGrace))
+			return
+		}
+	}
+
+	now := h.now()
+	key := h.oidcKeys.rotate(now, grace)
+	resp := adminOIDCRotateResponse{Kid: key.id, Retired: []oidcRetiredKey{}}
+	for _, retired := range h.oidcKeys.published(now)[1:] {
+		resp.Retired = append(resp.Retired, oidcRetiredKey{Kid: retired.id, Expires: retired.expires.UTC()})
+	}
+	Annotate(r.Context(), "admin_action", "rotate_oidc_keys")
+	Annotate(r.Context(), "oidc_kid", key.id)
+	writeJSON(http.StatusOK, w, resp)
+}
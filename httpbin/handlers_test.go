@@ -1,29 +1,57 @@
 package httpbin
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"log"
+	"math"
+	"math/big"
 	"math/rand"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
 	"net/url"
+	"os"
+	"os/exec"
 	"reflect"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/mccutchen/go-httpbin/v2/httpbin/websocket"
+	"github.com/mccutchen/go-httpbin/v2/httpbin/zstd"
 )
 
 const (
@@ -91,6 +119,24 @@ func assertBodyEquals(t *testing.T, w *httptest.ResponseRecorder, want string) {
 	}
 }
 
+// assertParamError asserts that the response is a 400 Bad Request JSON error
+// naming the given request parameter.
+func assertParamError(t *testing.T, w *httptest.ResponseRecorder, param string) {
+	t.Helper()
+	assertStatusCode(t, w, http.StatusBadRequest)
+	assertContentType(t, w, jsonContentType)
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode error response %q: %s", w.Body.String(), err)
+	}
+	if resp.Param != param {
+		t.Fatalf("expected error for param %q, got %+v", param, resp)
+	}
+	if !strings.HasPrefix(resp.Detail, "invalid "+param+": ") {
+		t.Fatalf("expected detail describing invalid %s, got %q", param, resp.Detail)
+	}
+}
+
 func randStringBytes(n int) string {
 	rand.New(rand.NewSource(time.Now().UnixNano()))
 	b := make([]byte, n)
@@ -120,6 +166,210 @@ func TestIndex__NotFound(t *testing.T) {
 	assertBodyContains(t, w, "/foo")
 }
 
+func TestIndex__TagFilter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("filters entries", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/?tag=redirects", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertBodyContains(t, w, "<code>/redirect-to?url=foo</code>")
+		assertBodyContains(t, w, "<code>/absolute-redirect/:n</code>")
+		for _, absent := range []string{"<code>/get</code>", "<code>/status/:code</code>"} {
+			if strings.Contains(w.Body.String(), absent) {
+				t.Errorf("expected filtered index to omit %s", absent)
+			}
+		}
+	})
+
+	t.Run("unknown tag", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/?tag=nope", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+	})
+}
+
+func TestIndexJSON(t *testing.T) {
+	t.Parallel()
+
+	get := func(t *testing.T, path string) indexResponse {
+		t.Helper()
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		var resp indexResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	t.Run("all endpoints", func(t *testing.T) {
+		t.Parallel()
+		resp := get(t, "/index.json")
+		if len(resp.Endpoints) != len(app.routes()) {
+			t.Fatalf("expected %d endpoints, got %d", len(app.routes()), len(resp.Endpoints))
+		}
+		if len(resp.Tags) != len(routeTags) {
+			t.Fatalf("expected %d tags, got %d", len(routeTags), len(resp.Tags))
+		}
+		for _, ep := range resp.Endpoints {
+			if ep.Pattern == "/delay/" {
+				if ep.Usage != "/delay/{duration}" {
+					t.Errorf("unexpected /delay/ usage %q", ep.Usage)
+				}
+				return
+			}
+		}
+		t.Fatalf("expected /delay/ in %v", resp.Endpoints)
+	})
+
+	t.Run("every tag must match", func(t *testing.T) {
+		t.Parallel()
+		resp := get(t, "/index.json?tag=streaming&tag=hijacks-connection")
+		if len(resp.Endpoints) == 0 {
+			t.Fatalf("expected some endpoints")
+		}
+		for _, ep := range resp.Endpoints {
+			rt := route{tags: ep.Tags}
+			if !rt.hasTags([]string{"streaming", "hijacks-connection"}) {
+				t.Errorf("endpoint %s has tags %v", ep.Pattern, ep.Tags)
+			}
+		}
+	})
+
+	t.Run("unknown tag", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/index.json?tag=nope", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+		assertBodyContains(t, w, "unknown tag")
+	})
+}
+
+func TestHelp(t *testing.T) {
+	t.Parallel()
+
+	getHelp := func(t *testing.T, app *HTTPBin, path string) helpResponse {
+		t.Helper()
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		var resp helpResponse
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	paramsByName := func(params []routeParam) map[string]routeParam {
+		m := make(map[string]routeParam, len(params))
+		for _, p := range params {
+			m[p.Name] = p
+		}
+		return m
+	}
+
+	t.Run("reflects instance limits", func(t *testing.T) {
+		t.Parallel()
+		app := New(
+			WithMaxBodySize(4096),
+			WithMaxDuration(7*time.Second),
+			WithDefaultParams(DefaultParams{DripDuration: time.Second, DripDelay: 0, DripNumBytes: 3}),
+		)
+		resp := getHelp(t, app, "/help/drip")
+		if resp.Pattern != "/drip" || resp.Usage != "/drip" {
+			t.Fatalf("unexpected route %q (%q)", resp.Pattern, resp.Usage)
+		}
+		if want := "Drips data over a duration after an optional initial delay"; !strings.HasPrefix(resp.Description, want) {
+			t.Fatalf("expected description starting %q, got %q", want, resp.Description)
+		}
+		if resp.Limits != (helpLimits{MaxBodySize: 4096, MaxDuration: "7s"}) {
+			t.Fatalf("unexpected limits %+v", resp.Limits)
+		}
+		params := paramsByName(resp.Params)
+		if p := params["duration"]; p.Default != "1s" || p.Max != "7s" {
+			t.Fatalf("unexpected duration param %+v", p)
+		}
+		if p := params["numbytes"]; p.Default != "3" || p.Max != "4096" {
+			t.Fatalf("unexpected numbytes param %+v", p)
+		}
+		if !reflect.DeepEqual(resp.Examples, []string{"curl -i 'http://example.com/drip?duration=0&delay=0&numbytes=1'"}) {
+			t.Fatalf("unexpected examples %v", resp.Examples)
+		}
+	})
+
+	t.Run("agrees with index.json", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxBodySize(2048))
+		r, _ := http.NewRequest("GET", "/index.json", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		var index indexResponse
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &index))
+		for _, ep := range index.Endpoints {
+			if ep.Pattern != "/range/" {
+				continue
+			}
+			resp := getHelp(t, app, "/help/range/10")
+			if !reflect.DeepEqual(resp.Params, ep.Params) {
+				t.Fatalf("help params %+v disagree with index params %+v", resp.Params, ep.Params)
+			}
+			if resp.Params[0].Max != "2048" {
+				t.Fatalf("expected max of 2048, got %+v", resp.Params[0])
+			}
+			return
+		}
+		t.Fatalf("/range/ missing from index")
+	})
+
+	t.Run("canonical base url", func(t *testing.T) {
+		t.Parallel()
+		base, _ := url.Parse("https://httpbin.example.com/prefix")
+		app := New(WithCanonicalBaseURL(base))
+		resp := getHelp(t, app, "/help/post")
+		if !reflect.DeepEqual(resp.Examples, []string{"curl -i -X POST 'https://httpbin.example.com/prefix/post'"}) {
+			t.Fatalf("unexpected examples %v", resp.Examples)
+		}
+		if len(resp.Params) != 0 || resp.Params == nil {
+			t.Fatalf("expected empty params, got %#v", resp.Params)
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxDuration(3 * time.Second))
+		r := httptest.NewRequest("GET", "/help/delay/1s", nil)
+		r.Header.Set("Accept", "text/html,application/xhtml+xml")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, htmlContentType)
+		assertBodyContains(t, w, "<h1><code>/delay/{duration}</code></h1>")
+		assertBodyContains(t, w, "<td>duration</td><td>path</td><td>duration</td><td></td><td>0s</td><td>3s</td>")
+		assertBodyContains(t, w, "<li>Max duration: 3s</li>")
+		assertBodyContains(t, w, html.EscapeString("curl -i 'http://example.com/delay/0'"))
+	})
+
+	t.Run("unknown endpoint", func(t *testing.T) {
+		t.Parallel()
+		for _, path := range []string{"/help/", "/help/no-such-endpoint"} {
+			r, _ := http.NewRequest("GET", path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotFound)
+			assertContentType(t, w, jsonContentType)
+		}
+	})
+}
+
 func TestFormsPost(t *testing.T) {
 	t.Parallel()
 	r, _ := http.NewRequest("GET", "/forms/post", nil)
@@ -188,7 +438,8 @@ func TestGet(t *testing.T) {
 		app.ServeHTTP(w, r)
 
 		assertStatusCode(t, w, http.StatusMethodNotAllowed)
-		assertContentType(t, w, "text/plain; charset=utf-8")
+		assertContentType(t, w, jsonContentType)
+		assertHeader(t, w, "Allow", "GET, HEAD, OPTIONS")
 	})
 
 	protoTests := []struct {
@@ -514,6 +765,229 @@ func TestAnything(t *testing.T) {
 	})
 }
 
+func TestConnectionDetails(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewUnstartedServer(app)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	// The test certificate is valid for example.com, which lets the client
+	// send it as the SNI server name
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.ServerName = "example.com"
+	client := &http.Client{Transport: transport}
+
+	for _, tc := range []struct {
+		method    string
+		path      string
+		wantRoute string
+	}{
+		{"GET", "/get", "/get"},
+		{"POST", "/post", "/post"},
+		{"PUT", "/anything/else", "/anything/"},
+	} {
+		req, _ := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+		resp, err := client.Do(req)
+		assertNil(t, err)
+		defer resp.Body.Close()
+
+		var result bodyResponse
+		assertNil(t, json.NewDecoder(resp.Body).Decode(&result))
+		if result.Proto != "HTTP/2.0" || result.Route != tc.wantRoute {
+			t.Fatalf("%s %s: expected proto HTTP/2.0 and route %s, got %s and %s", tc.method, tc.path, tc.wantRoute, result.Proto, result.Route)
+		}
+		if result.TLS == nil {
+			t.Fatalf("%s %s: expected tls details", tc.method, tc.path)
+		}
+		got := *result.TLS
+		if got.Version != "TLS 1.3" || got.ALPN != "h2" || got.ServerName != "example.com" || got.CipherSuite == "" {
+			t.Fatalf("%s %s: unexpected tls details %+v", tc.method, tc.path, got)
+		}
+	}
+
+	t.Run("plain http", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/anything/else", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertBodyContains(t, w, `"tls": null`)
+
+		var result bodyResponse
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &result))
+		if result.Proto != "HTTP/1.1" || result.Route != "/anything/" {
+			t.Fatalf("expected proto HTTP/1.1 and route /anything/, got %s and %s", result.Proto, result.Route)
+		}
+	})
+}
+
+func TestRequestBodyFraming(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	// send writes a raw request with the given framing headers and body, so
+	// that each framing arrives exactly as written
+	send := func(t *testing.T, method, path, headers, body string) *http.Response {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assertNil(t, err)
+		t.Cleanup(func() { conn.Close() })
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n%s\r\n%s", method, path, srv.Listener.Addr(), headers, body)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+		assertNil(t, err)
+		return resp
+	}
+
+	int64Ptr := func(n int64) *int64 { return &n }
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		headers string
+		body    string
+
+		wantData   string
+		wantJSON   interface{}
+		wantForm   bool
+		wantBody   bodyDescriptor
+		wantStatus int
+	}{
+		{
+			name:     "no content-length",
+			method:   "POST",
+			wantBody: bodyDescriptor{},
+		},
+		{
+			name:     "content-length 0",
+			method:   "POST",
+			headers:  "Content-Length: 0\r\n",
+			wantBody: bodyDescriptor{DeclaredLength: int64Ptr(0)},
+		},
+		{
+			name:     "empty chunked",
+			method:   "POST",
+			headers:  "Transfer-Encoding: chunked\r\n",
+			body:     "0\r\n\r\n",
+			wantBody: bodyDescriptor{Chunked: true},
+		},
+		{
+			name:     "empty json",
+			method:   "POST",
+			headers:  "Content-Type: application/json\r\nContent-Length: 0\r\n",
+			wantBody: bodyDescriptor{DeclaredLength: int64Ptr(0)},
+		},
+		{
+			name:     "empty form",
+			method:   "POST",
+			headers:  "Content-Type: application/x-www-form-urlencoded\r\nContent-Length: 0\r\n",
+			wantBody: bodyDescriptor{DeclaredLength: int64Ptr(0)},
+		},
+		{
+			name:     "empty multipart",
+			method:   "POST",
+			headers:  "Content-Type: multipart/form-data; boundary=x\r\nTransfer-Encoding: chunked\r\n",
+			body:     "0\r\n\r\n",
+			wantBody: bodyDescriptor{Chunked: true},
+		},
+		{
+			name:     "empty binary",
+			method:   "POST",
+			headers:  "Content-Type: application/octet-stream\r\nContent-Length: 0\r\n",
+			wantBody: bodyDescriptor{DeclaredLength: int64Ptr(0)},
+		},
+		{
+			name:     "content-length body",
+			method:   "POST",
+			headers:  "Content-Type: text/plain\r\nContent-Length: 5\r\n",
+			body:     "hello",
+			wantData: "hello",
+			wantBody: bodyDescriptor{Present: true, DeclaredLength: int64Ptr(5)},
+		},
+		{
+			name:     "chunked body",
+			method:   "POST",
+			headers:  "Content-Type: application/json\r\nTransfer-Encoding: chunked\r\n",
+			body:     "2\r\n{}\r\n0\r\n\r\n",
+			wantData: "{}",
+			wantJSON: map[string]interface{}{},
+			wantBody: bodyDescriptor{Present: true, Chunked: true},
+		},
+		{
+			name:     "chunked form",
+			method:   "PUT",
+			headers:  "Content-Type: application/x-www-form-urlencoded\r\nTransfer-Encoding: chunked\r\n",
+			body:     "3\r\na=b\r\n0\r\n\r\n",
+			wantData: "a=b",
+			wantForm: true,
+			wantBody: bodyDescriptor{Present: true, Chunked: true},
+		},
+		{
+			name:     "get with body",
+			method:   "GET",
+			headers:  "Content-Type: text/plain\r\nContent-Length: 5\r\n",
+			body:     "hello",
+			wantData: "hello",
+			wantBody: bodyDescriptor{Present: true, DeclaredLength: int64Ptr(5)},
+		},
+		{
+			name:     "get without body",
+			method:   "GET",
+			wantBody: bodyDescriptor{},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			resp := send(t, tc.method, "/anything", tc.headers, tc.body)
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.StatusCode)
+			}
+
+			var result bodyResponse
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Data != tc.wantData {
+				t.Errorf("expected data %q, got %q", tc.wantData, result.Data)
+			}
+			if !reflect.DeepEqual(result.JSON, tc.wantJSON) {
+				t.Errorf("expected json %#v, got %#v", tc.wantJSON, result.JSON)
+			}
+			if gotForm := result.Form != nil; gotForm != tc.wantForm {
+				t.Errorf("expected form present = %v, got %#v", tc.wantForm, result.Form)
+			}
+			if result.Files != nil {
+				t.Errorf("expected null files, got %#v", result.Files)
+			}
+			if result.Body == nil {
+				t.Fatalf("expected body descriptor")
+			}
+			if !reflect.DeepEqual(*result.Body, tc.wantBody) {
+				t.Errorf("expected body %s, got %s", mustMarshalCompactJSON(tc.wantBody), mustMarshalCompactJSON(*result.Body))
+			}
+		})
+	}
+
+	t.Run("head with body", func(t *testing.T) {
+		t.Parallel()
+		resp := send(t, "HEAD", "/anything", "Content-Type: text/plain\r\nContent-Length: 5\r\n", "hello")
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		body, err := io.ReadAll(resp.Body)
+		assertNil(t, err)
+		if len(body) != 0 {
+			t.Fatalf("expected no response body for HEAD, got %q", body)
+		}
+	})
+}
+
 // getFuncName uses runtime type reflection to get the name of the given
 // function.
 //
@@ -1028,6 +1502,10 @@ func TestStatus(t *testing.T) {
 		{"/status/200/foo", http.StatusNotFound},
 		{"/status/3.14", http.StatusBadRequest},
 		{"/status/foo", http.StatusBadRequest},
+		{"/status/99", http.StatusBadRequest},
+		{"/status/600", http.StatusBadRequest},
+		{"/status/1000", http.StatusBadRequest},
+		{"/status/-200", http.StatusBadRequest},
 	}
 
 	for _, test := range errorTests {
@@ -1042,2035 +1520,11342 @@ func TestStatus(t *testing.T) {
 	}
 }
 
-func TestUnstable(t *testing.T) {
+func TestWeightedStatus(t *testing.T) {
 	t.Parallel()
-	t.Run("ok_no_seed", func(t *testing.T) {
+
+	t.Run("distribution", func(t *testing.T) {
 		t.Parallel()
-		r, _ := http.NewRequest("GET", "/unstable", nil)
+		app := New()
+		app.randFloat = rand.New(rand.NewSource(1)).Float64
+
+		const n = 5000
+		counts := make(map[int]int)
+		for i := 0; i < n; i++ {
+			r, _ := http.NewRequest("GET", "/status/200:0.7,500:0.2,429:0.1", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			counts[w.Code]++
+		}
+		for code, want := range map[int]float64{200: 0.7, 500: 0.2, 429: 0.1} {
+			if got := float64(counts[code]) / n; math.Abs(got-want) > 0.02 {
+				t.Errorf("expected status %d for about %.0f%% of requests, got %.1f%%", code, want*100, got*100)
+			}
+		}
+		if len(counts) != 3 {
+			t.Errorf("expected only the given statuses, got %v", counts)
+		}
+	})
+
+	t.Run("unweighted codes share equally", func(t *testing.T) {
+		t.Parallel()
+		choices, err := parseWeightedStatuses("200,201,202:2")
+		assertNil(t, err)
+		want := []weightedStatus{{200, 0.25}, {201, 0.25}, {202, 0.5}}
+		if !reflect.DeepEqual(choices, want) {
+			t.Fatalf("expected %v, got %v", want, choices)
+		}
+	})
+
+	t.Run("picks", func(t *testing.T) {
+		t.Parallel()
+		choices := []weightedStatus{{200, 0.5}, {404, 0}, {500, 0.5}}
+		for _, tc := range []struct {
+			f    float64
+			want int
+		}{
+			{0, 200},
+			{0.4999, 200},
+			{0.5, 500},
+			{0.9999, 500},
+			// values past the rounded total go to the last weighted code
+			{1, 500},
+		} {
+			if got := pickWeightedStatus(choices, tc.f); got != tc.want {
+				t.Errorf("pick(%v): expected %d, got %d", tc.f, tc.want, got)
+			}
+		}
+		if got := pickWeightedStatus([]weightedStatus{{201, 1}, {404, 0}}, 1); got != 201 {
+			t.Errorf("expected zero-weight code never to be picked, got %d", got)
+		}
+	})
+
+	t.Run("special cases apply", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/status/418:1,200:0", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
-		if w.Code != 200 && w.Code != 500 {
-			t.Fatalf("expected status code 200 or 500, got %d", w.Code)
-		}
+		assertStatusCode(t, w, http.StatusTeapot)
+		assertBodyEquals(t, w, "I'm a teapot!")
 	})
 
-	// rand.NewSource(1234567890).Float64() => 0.08
-	tests := []struct {
-		url    string
-		status int
+	for _, tc := range []struct {
+		path    string
+		wantErr string
 	}{
-		{"/unstable?seed=1234567890", 500},
-		{"/unstable?seed=1234567890&failure_rate=0.07", 200},
-	}
-	for _, test := range tests {
-		test := test
-		t.Run("ok_"+test.url, func(t *testing.T) {
+		{"/status/200,foo", `invalid status code in segment \"foo\"`},
+		{"/status/200,600:1", `invalid status code in segment \"600:1\"`},
+		{"/status/200:x,500", `invalid weight in segment \"200:x\"`},
+		{"/status/200:-1,500", `invalid weight in segment \"200:-1\"`},
+		{"/status/200:,500", `invalid weight in segment \"200:\"`},
+		{"/status/200:Inf", `invalid weight in segment \"200:Inf\"`},
+		{"/status/200,", `invalid status code in segment \"\"`},
+		{"/status/200:0,500:0", "at least one must be positive"},
+	} {
+		tc := tc
+		t.Run("bad"+tc.path, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
+			r, _ := http.NewRequest("GET", tc.path, nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.status)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+			assertBodyContains(t, w, tc.wantErr)
 		})
 	}
+}
 
-	edgeCaseTests := []string{
-		// strange but valid seed
-		"/unstable?seed=-12345",
-	}
-	for _, test := range edgeCaseTests {
-		test := test
-		t.Run("bad"+test, func(t *testing.T) {
-			t.Parallel()
-			r, _ := http.NewRequest("GET", test, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			if w.Code != 200 && w.Code != 500 {
-				t.Fatalf("expected status code 200 or 500, got %d", w.Code)
-			}
-		})
-	}
+func TestStatusCustomResponse(t *testing.T) {
+	t.Parallel()
 
-	badTests := []string{
-		// bad failure_rate
-		"/unstable?failure_rate=foo",
-		"/unstable?failure_rate=-1",
-		"/unstable?failure_rate=1.23",
-		// bad seed
-		"/unstable?seed=3.14",
-		"/unstable?seed=foo",
-	}
-	for _, test := range badTests {
-		test := test
-		t.Run("bad"+test, func(t *testing.T) {
+	t.Run("503 with json body and retry-after", func(t *testing.T) {
+		t.Parallel()
+		params := url.Values{
+			"body":         {`{"error": "upstream unavailable"}`},
+			"content-type": {"application/json"},
+			"header":       {"Retry-After: 120", "X-Upstream:db-1", "X-Upstream:db-2"},
+		}
+		r, _ := http.NewRequest("GET", "/status/503?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusServiceUnavailable)
+		assertContentType(t, w, "application/json")
+		assertHeader(t, w, "Retry-After", "120")
+		if got := w.Header()["X-Upstream"]; !reflect.DeepEqual(got, []string{"db-1", "db-2"}) {
+			t.Fatalf("expected repeated X-Upstream headers, got %v", got)
+		}
+		assertBodyEquals(t, w, `{"error": "upstream unavailable"}`)
+	})
+
+	t.Run("body defaults to plain text", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/status/500?body=oops", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusInternalServerError)
+		assertContentType(t, w, "text/plain; charset=utf-8")
+		assertBodyEquals(t, w, "oops")
+	})
+
+	t.Run("special case location wins", func(t *testing.T) {
+		t.Parallel()
+		params := url.Values{"header": {"Location:https://example.com/", "X-Extra:1"}, "body": {"moved"}}
+		r, _ := http.NewRequest("GET", "/status/302?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusFound)
+		assertHeader(t, w, "Location", "/redirect/1")
+		assertHeader(t, w, "X-Extra", "1")
+		assertBodyEquals(t, w, "moved")
+	})
+
+	t.Run("custom body replaces special case body", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/status/406?body=nope&content-type=text/plain", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNotAcceptable)
+		assertContentType(t, w, "text/plain")
+		assertBodyEquals(t, w, "nope")
+	})
+
+	t.Run("no body for 204", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/status/204?body=ignored", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNoContent)
+		assertBodyEquals(t, w, "")
+	})
+
+	t.Run("body size limited", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxBodySize(8))
+		r, _ := http.NewRequest("GET", "/status/500?body=123456789", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+		assertBodyContains(t, w, "body of 9 bytes exceeds the limit of 8 bytes")
+	})
+
+	for _, tc := range []struct {
+		name    string
+		params  url.Values
+		wantErr string
+	}{
+		{"header without colon", url.Values{"header": {"X-Foo"}}, "must be of the form Name:Value"},
+		{"bad header name", url.Values{"header": {"X Foo:bar"}}, `invalid header name \"X Foo\"`},
+		{"crlf in header value", url.Values{"header": {"X-Foo:bar\r\nSet-Cookie: a=b"}}, "invalid value for header X-Foo"},
+		{"newline in content type", url.Values{"content-type": {"text/plain\nX-Foo: bar"}}, "invalid content-type"},
+	} {
+		tc := tc
+		t.Run("bad/"+tc.name, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test, nil)
+			r, _ := http.NewRequest("GET", "/status/200?"+tc.params.Encode(), nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
 			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+			assertBodyContains(t, w, tc.wantErr)
+			if w.Header().Get("Set-Cookie") != "" || w.Header().Get("X-Foo") != "" {
+				t.Fatalf("expected no injected headers, got %v", w.Header())
+			}
 		})
 	}
 }
 
-func TestResponseHeaders__OK(t *testing.T) {
+func TestStatuses(t *testing.T) {
 	t.Parallel()
-	headers := map[string][]string{
-		"Foo": {"foo"},
-		"Bar": {"bar1, bar2"},
-	}
-
-	params := url.Values{}
-	for k, vs := range headers {
-		for _, v := range vs {
-			params.Add(k, v)
-		}
-	}
 
-	r, _ := http.NewRequest("GET", fmt.Sprintf("/response-headers?%s", params.Encode()), nil)
+	r, _ := http.NewRequest("GET", "/statuses", nil)
 	w := httptest.NewRecorder()
 	app.ServeHTTP(w, r)
-
 	assertStatusCode(t, w, http.StatusOK)
 	assertContentType(t, w, jsonContentType)
 
-	for k, expectedValues := range headers {
-		values, ok := w.Header()[k]
-		if !ok {
-			t.Fatalf("expected header %s in response headers", k)
-		}
-		if !reflect.DeepEqual(values, expectedValues) {
-			t.Fatalf("expected key values %#v for header %s, got %#v", expectedValues, k, values)
-		}
+	var resp statusesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
 	}
+	assertIntEqual(t, len(resp.Statuses), maxStatusCode-minStatusCode+1)
 
-	resp := &http.Header{}
-	err := json.Unmarshal(w.Body.Bytes(), resp)
-	if err != nil {
-		t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+	byCode := make(map[int]statusCatalogEntry, len(resp.Statuses))
+	for _, entry := range resp.Statuses {
+		byCode[entry.Code] = entry
+	}
+	spotChecks := []struct {
+		code        int
+		reason      string
+		bodyAllowed bool
+		special     bool
+	}{
+		{100, "Continue", false, true},
+		{101, "Switching Protocols", false, true},
+		{200, "OK", true, false},
+		{204, "No Content", false, true},
+		{302, "Found", true, true},
+		{304, "Not Modified", false, true},
+		{418, "I'm a teapot", true, true},
+		{499, "", true, false},
+		{503, "Service Unavailable", true, false},
+	}
+	for _, check := range spotChecks {
+		entry := byCode[check.code]
+		if entry.Reason != check.reason || entry.BodyAllowed != check.bodyAllowed || entry.SpecialHandling != check.special {
+			t.Errorf("unexpected catalog entry for %d: %+v", check.code, entry)
+		}
+	}
+	if got := byCode[302].Headers["Location"]; got != "/redirect/1" {
+		t.Errorf("expected 302 entry to list its Location header, got %q", got)
 	}
 
-	for k, expectedValues := range headers {
-		values, ok := (*resp)[k]
-		if !ok {
-			t.Fatalf("expected header %s in response body", k)
+	// Every listed code must be accepted by /status, responding as
+	// described
+	for _, entry := range resp.Statuses {
+		r, _ := http.NewRequest("GET", entry.URL, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if w.Code != entry.Code {
+			t.Errorf("expected %s to respond with %d, got %d", entry.URL, entry.Code, w.Code)
 		}
-		if !reflect.DeepEqual(values, expectedValues) {
-			t.Fatalf("expected key values %#v for header %s, got %#v", expectedValues, k, values)
+		if !entry.BodyAllowed && w.Body.Len() > 0 {
+			t.Errorf("expected %s to respond without a body, got %q", entry.URL, w.Body)
+		}
+		for key, val := range entry.Headers {
+			if got := w.Header().Get(key); got != val {
+				t.Errorf("expected %s to set %s=%q, got %q", entry.URL, key, val, got)
+			}
 		}
 	}
 }
 
-func TestResponseHeaders__OverrideContentType(t *testing.T) {
+func TestUnstable(t *testing.T) {
 	t.Parallel()
-	contentType := "text/test"
-
-	params := url.Values{}
-	params.Set("Content-Type", contentType)
-
-	r, _ := http.NewRequest("GET", fmt.Sprintf("/response-headers?%s", params.Encode()), nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
-
-	assertStatusCode(t, w, http.StatusOK)
-	assertContentType(t, w, contentType)
-}
+	t.Run("ok_no_seed", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/unstable", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if w.Code != 200 && w.Code != 500 {
+			t.Fatalf("expected status code 200 or 500, got %d", w.Code)
+		}
+	})
 
-func TestRedirects(t *testing.T) {
-	t.Parallel()
+	// rand.NewSource(1234567890).Float64() => 0.08
 	tests := []struct {
-		requestURL       string
-		expectedLocation string
+		url    string
+		status int
 	}{
-		{"/redirect/1", "/get"},
-		{"/redirect/2", "/relative-redirect/1"},
-		{"/redirect/100", "/relative-redirect/99"},
-
-		{"/redirect/1?absolute=true", "http://host/get"},
-		{"/redirect/2?absolute=TRUE", "http://host/absolute-redirect/1"},
-		{"/redirect/100?absolute=True", "http://host/absolute-redirect/99"},
-
-		{"/redirect/100?absolute=t", "/relative-redirect/99"},
-		{"/redirect/100?absolute=1", "/relative-redirect/99"},
-		{"/redirect/100?absolute=yes", "/relative-redirect/99"},
-
-		{"/relative-redirect/1", "/get"},
-		{"/relative-redirect/2", "/relative-redirect/1"},
-		{"/relative-redirect/100", "/relative-redirect/99"},
-
-		{"/absolute-redirect/1", "http://host/get"},
-		{"/absolute-redirect/2", "http://host/absolute-redirect/1"},
-		{"/absolute-redirect/100", "http://host/absolute-redirect/99"},
+		{"/unstable?seed=1234567890", 500},
+		{"/unstable?seed=1234567890&failure_rate=0.07", 200},
 	}
-
 	for _, test := range tests {
 		test := test
-		t.Run("ok"+test.requestURL, func(t *testing.T) {
+		t.Run("ok_"+test.url, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.requestURL, nil)
-			r.Host = "host"
+			r, _ := http.NewRequest("GET", test.url, nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-
-			assertStatusCode(t, w, http.StatusFound)
-			assertHeader(t, w, "Location", test.expectedLocation)
+			assertStatusCode(t, w, test.status)
 		})
 	}
 
-	errorTests := []struct {
-		requestURL     string
-		expectedStatus int
-	}{
-		{"/redirect", http.StatusNotFound},
-		{"/redirect/", http.StatusBadRequest},
-		{"/redirect/3.14", http.StatusBadRequest},
-		{"/redirect/foo", http.StatusBadRequest},
-		{"/redirect/10/foo", http.StatusNotFound},
-
-		{"/relative-redirect", http.StatusNotFound},
-		{"/relative-redirect/", http.StatusBadRequest},
-		{"/relative-redirect/3.14", http.StatusBadRequest},
-		{"/relative-redirect/foo", http.StatusBadRequest},
-		{"/relative-redirect/10/foo", http.StatusNotFound},
-
-		{"/absolute-redirect", http.StatusNotFound},
-		{"/absolute-redirect/", http.StatusBadRequest},
-		{"/absolute-redirect/3.14", http.StatusBadRequest},
-		{"/absolute-redirect/foo", http.StatusBadRequest},
-		{"/absolute-redirect/10/foo", http.StatusNotFound},
+	edgeCaseTests := []string{
+		// strange but valid seed
+		"/unstable?seed=-12345",
 	}
-
-	for _, test := range errorTests {
+	for _, test := range edgeCaseTests {
 		test := test
-		t.Run("error"+test.requestURL, func(t *testing.T) {
+		t.Run("bad"+test, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.requestURL, nil)
+			r, _ := http.NewRequest("GET", test, nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-
-			assertStatusCode(t, w, test.expectedStatus)
+			if w.Code != 200 && w.Code != 500 {
+				t.Fatalf("expected status code 200 or 500, got %d", w.Code)
+			}
 		})
 	}
-}
-
-func TestRedirectTo(t *testing.T) {
-	t.Parallel()
-	okTests := []struct {
-		url              string
-		expectedLocation string
-		expectedStatus   int
-	}{
-		{"/redirect-to?url=http://www.example.com/", "http://www.example.com/", http.StatusFound},
-		{"/redirect-to?url=http://www.example.com/&status_code=307", "http://www.example.com/", http.StatusTemporaryRedirect},
-
-		{"/redirect-to?url=/get", "/get", http.StatusFound},
-		{"/redirect-to?url=/get&status_code=307", "/get", http.StatusTemporaryRedirect},
 
-		{"/redirect-to?url=foo", "foo", http.StatusFound},
+	badTests := []string{
+		// bad failure_rate
+		"/unstable?failure_rate=foo",
+		"/unstable?failure_rate=-1",
+		"/unstable?failure_rate=1.23",
+		// bad seed
+		"/unstable?seed=3.14",
+		"/unstable?seed=foo",
 	}
-
-	for _, test := range okTests {
+	for _, test := range badTests {
 		test := test
-		t.Run("ok"+test.url, func(t *testing.T) {
+		t.Run("bad"+test, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
+			r, _ := http.NewRequest("GET", test, nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-
-			assertStatusCode(t, w, test.expectedStatus)
-			assertHeader(t, w, "Location", test.expectedLocation)
+			assertStatusCode(t, w, http.StatusBadRequest)
 		})
 	}
+}
 
-	badTests := []struct {
-		url            string
-		expectedStatus int
+func TestUnstablePattern(t *testing.T) {
+	t.Parallel()
+
+	// unstable makes a request to /unstable and decodes its response
+	unstable := func(t *testing.T, app *HTTPBin, url string) unstablePatternResponse {
+		t.Helper()
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertContentType(t, w, jsonContentType)
+		var resp unstablePatternResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+		}
+		if resp.Status != w.Code {
+			t.Fatalf("expected status %d in body to match response status %d", resp.Status, w.Code)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name      string
+		url       string
+		statuses  []int
+		positions []int
 	}{
-		{"/redirect-to", http.StatusBadRequest},                                               // missing url
-		{"/redirect-to?status_code=302", http.StatusBadRequest},                               // missing url
-		{"/redirect-to?url=foo&status_code=201", http.StatusBadRequest},                       // invalid status code
-		{"/redirect-to?url=foo&status_code=418", http.StatusBadRequest},                       // invalid status code
-		{"/redirect-to?url=http%3A%2F%2Ffoo%25%25bar&status_code=418", http.StatusBadRequest}, // invalid URL
+		{
+			name:      "hold_on_last_state",
+			url:       "/unstable?key=hold&pattern=FFS",
+			statuses:  []int{500, 500, 200, 200, 200},
+			positions: []int{1, 2, 3, 3, 3},
+		},
+		{
+			name:      "hold_on_last_failure",
+			url:       "/unstable?key=hold-fail&pattern=sf&repeat=false",
+			statuses:  []int{200, 500, 500},
+			positions: []int{1, 2, 2},
+		},
+		{
+			name:      "repeat",
+			url:       "/unstable?key=repeat&pattern=FFS&repeat=true",
+			statuses:  []int{500, 500, 200, 500, 500, 200, 500},
+			positions: []int{1, 2, 3, 1, 2, 3, 1},
+		},
 	}
-	for _, test := range badTests {
+	for _, test := range tests {
 		test := test
-		t.Run("bad"+test.url, func(t *testing.T) {
+		t.Run(test.name, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-
-			assertStatusCode(t, w, test.expectedStatus)
+			for i, status := range test.statuses {
+				resp := unstable(t, app, test.url)
+				if resp.Status != status || resp.Position != test.positions[i] || resp.Requests != int64(i+1) {
+					t.Fatalf("request %d: expected status %d at position %d, got %+v", i+1, status, test.positions[i], resp)
+				}
+			}
 		})
 	}
 
-	allowListHandler := New(
-		WithAllowedRedirectDomains([]string{"httpbingo.org", "example.org"}),
-		WithObserver(StdLogObserver(log.New(io.Discard, "", 0))),
-	).Handler()
-
-	allowedDomainsError := `Forbidden redirect URL. Please be careful with this link.
+	t.Run("keys_are_independent", func(t *testing.T) {
+		t.Parallel()
+		for _, key := range []string{"independent-a", "independent-b"} {
+			resp := unstable(t, app, "/unstable?pattern=FS&key="+key)
+			if resp.Key != key || resp.Outcome != "fail" || resp.Position != 1 {
+				t.Fatalf("expected first request for key %q to fail, got %+v", key, resp)
+			}
+		}
+	})
 
-Allowed redirect destinations:
-- example.org
-- httpbingo.org
-`
+	t.Run("concurrent_requests", func(t *testing.T) {
+		t.Parallel()
+		const n = 50
+		url := "/unstable?key=concurrent&pattern=FFFFS&repeat=true"
+		var wg sync.WaitGroup
+		results := make([]unstablePatternResponse, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r, _ := http.NewRequest("GET", url, nil)
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+				if err := json.Unmarshal(w.Body.Bytes(), &results[i]); err != nil {
+					t.Errorf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
 
-	allowListTests := []struct {
-		url            string
-		expectedStatus int
+		seen := make(map[int64]bool)
+		failures := 0
+		for _, resp := range results {
+			if seen[resp.Requests] {
+				t.Fatalf("request count %d seen twice", resp.Requests)
+			}
+			seen[resp.Requests] = true
+			if resp.Outcome == "fail" {
+				failures++
+			}
+		}
+		if failures != n*4/5 {
+			t.Fatalf("expected %d failures, got %d", n*4/5, failures)
+		}
+	})
+
+	t.Run("keys_expire", func(t *testing.T) {
+		t.Parallel()
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		app := New()
+		app.now = func() time.Time { return now }
+
+		url := "/unstable?key=expiring&pattern=FS"
+		unstable(t, app, url)
+		if resp := unstable(t, app, url); resp.Outcome != "succeed" {
+			t.Fatalf("expected second request to succeed, got %+v", resp)
+		}
+		now = now.Add(keyCounterTTL + time.Second)
+		if resp := unstable(t, app, url); resp.Outcome != "fail" || resp.Requests != 1 {
+			t.Fatalf("expected expired key to start the pattern over, got %+v", resp)
+		}
+	})
+
+	paramTests := []struct {
+		url   string
+		param string
 	}{
-		{"/redirect-to?url=http://httpbingo.org", http.StatusFound},                // allowlist ok
-		{"/redirect-to?url=https://httpbingo.org", http.StatusFound},               // scheme doesn't matter
-		{"/redirect-to?url=https://example.org/foo/bar", http.StatusFound},         // paths don't matter
-		{"/redirect-to?url=https://foo.example.org/foo/bar", http.StatusForbidden}, // subdomains of allowed domains do not match
-		{"/redirect-to?url=https://evil.com", http.StatusForbidden},                // not in allowlist
+		{"/unstable?pattern=FXS", "pattern"},
+		{"/unstable?pattern=" + strings.Repeat("F", maxUnstablePatternLength+1), "pattern"},
+		{"/unstable?pattern=FS&key=bad.key", "key"},
+		{"/unstable?pattern=FS&repeat=sometimes", "repeat"},
 	}
-	for _, test := range allowListTests {
+	for _, test := range paramTests {
 		test := test
-		t.Run("allowlist"+test.url, func(t *testing.T) {
+		t.Run("bad"+test.url, func(t *testing.T) {
 			t.Parallel()
 			r, _ := http.NewRequest("GET", test.url, nil)
 			w := httptest.NewRecorder()
-			allowListHandler.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.expectedStatus)
-			if test.expectedStatus >= 400 {
-				assertBodyEquals(t, w, allowedDomainsError)
-			}
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, test.param)
 		})
 	}
 }
 
-func TestCookies(t *testing.T) {
+func TestRetry(t *testing.T) {
 	t.Parallel()
-	testCookies := func(t *testing.T, cookies cookiesResponse) {
-		r, _ := http.NewRequest("GET", "/cookies", nil)
-		for k, v := range cookies {
-			r.AddCookie(&http.Cookie{
-				Name:  k,
-				Value: v,
-			})
-		}
+
+	// retry makes a request to /retry and decodes its response
+	retry := func(t *testing.T, app *HTTPBin, url string) retryResponse {
+		t.Helper()
+		r, _ := http.NewRequest("GET", url, nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
-
-		assertStatusCode(t, w, http.StatusOK)
 		assertContentType(t, w, jsonContentType)
-
-		resp := cookiesResponse{}
-		err := json.Unmarshal(w.Body.Bytes(), &resp)
-		if err != nil {
+		assertHeader(t, w, "Cache-Control", "no-store")
+		var resp retryResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
 			t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
 		}
-
-		if !reflect.DeepEqual(cookies, resp) {
-			t.Fatalf("expected cookies %#v, got %#v", cookies, resp)
+		if resp.Status != w.Code {
+			t.Fatalf("expected status %d in body to match response status %d", resp.Status, w.Code)
 		}
+		return resp
 	}
 
-	t.Run("ok/no cookies", func(t *testing.T) {
+	t.Run("fails_n_times_then_succeeds", func(t *testing.T) {
 		t.Parallel()
-		testCookies(t, cookiesResponse{})
+		want := []retryResponse{
+			{Key: "three", Attempt: 1, Failures: 3, RemainingFailures: 2, Status: 503},
+			{Key: "three", Attempt: 2, Failures: 3, RemainingFailures: 1, Status: 503},
+			{Key: "three", Attempt: 3, Failures: 3, RemainingFailures: 0, Status: 503},
+			{Key: "three", Attempt: 4, Failures: 3, RemainingFailures: 0, Succeeded: true, Status: 200},
+			{Key: "three", Attempt: 5, Failures: 3, RemainingFailures: 0, Succeeded: true, Status: 200},
+		}
+		for _, w := range want {
+			if got := retry(t, app, "/retry/three/3"); got != w {
+				t.Fatalf("expected %+v, got %+v", w, got)
+			}
+		}
 	})
 
-	t.Run("ok/cookies", func(t *testing.T) {
+	t.Run("zero_failures", func(t *testing.T) {
 		t.Parallel()
-		testCookies(t, cookiesResponse{
-			"k1": "v1",
-			"k2": "v2",
-		})
+		if got := retry(t, app, "/retry/zero/0"); !got.Succeeded || got.Attempt != 1 {
+			t.Fatalf("expected first attempt to succeed, got %+v", got)
+		}
 	})
-}
-
-func TestSetCookies(t *testing.T) {
-	t.Parallel()
-	cookies := cookiesResponse{
-		"k1": "v1",
-		"k2": "v2",
-	}
-
-	params := &url.Values{}
-	for k, v := range cookies {
-		params.Set(k, v)
-	}
-
-	r, _ := http.NewRequest("GET", fmt.Sprintf("/cookies/set?%s", params.Encode()), nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
-
-	assertStatusCode(t, w, http.StatusFound)
-	assertHeader(t, w, "Location", "/cookies")
 
-	for _, c := range w.Result().Cookies() {
-		v, ok := cookies[c.Name]
-		if !ok {
-			t.Fatalf("got unexpected cookie %s=%s", c.Name, c.Value)
+	t.Run("status_code", func(t *testing.T) {
+		t.Parallel()
+		if got := retry(t, app, "/retry/status/1?status_code=429"); got.Status != 429 {
+			t.Fatalf("expected failure with status 429, got %+v", got)
 		}
-		if v != c.Value {
-			t.Fatalf("got cookie %s=%s, expected value in %#v", c.Name, c.Value, v)
+		if got := retry(t, app, "/retry/status/1?status_code=429"); got.Status != 200 {
+			t.Fatalf("expected success, got %+v", got)
 		}
-	}
-}
-
-func TestDeleteCookies(t *testing.T) {
-	t.Parallel()
-	cookies := cookiesResponse{
-		"k1": "v1",
-		"k2": "v2",
-	}
-
-	toDelete := "k2"
-	params := &url.Values{}
-	params.Set(toDelete, "")
-
-	r, _ := http.NewRequest("GET", fmt.Sprintf("/cookies/delete?%s", params.Encode()), nil)
-	for k, v := range cookies {
-		r.AddCookie(&http.Cookie{
-			Name:  k,
-			Value: v,
-		})
-	}
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
-
-	assertStatusCode(t, w, http.StatusFound)
-	assertHeader(t, w, "Location", "/cookies")
+	})
 
-	for _, c := range w.Result().Cookies() {
-		if c.Name == toDelete {
-			if time.Since(c.Expires) < (24*365-1)*time.Hour {
-				t.Fatalf("expected cookie %s to be deleted; got %#v", toDelete, c)
-			}
+	t.Run("delete_resets", func(t *testing.T) {
+		t.Parallel()
+		retry(t, app, "/retry/reset/1")
+		if got := retry(t, app, "/retry/reset/1"); !got.Succeeded {
+			t.Fatalf("expected second attempt to succeed, got %+v", got)
 		}
-	}
-}
 
-func TestBasicAuth(t *testing.T) {
-	t.Parallel()
-	t.Run("ok", func(t *testing.T) {
-		t.Parallel()
-		r, _ := http.NewRequest("GET", "/basic-auth/user/pass", nil)
-		r.SetBasicAuth("user", "pass")
+		r, _ := http.NewRequest("DELETE", "/retry/reset/1", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNoContent)
 
-		assertStatusCode(t, w, http.StatusOK)
-		assertContentType(t, w, jsonContentType)
-
-		resp := &authResponse{}
-		json.Unmarshal(w.Body.Bytes(), resp)
-
-		expectedResp := &authResponse{
-			Authorized: true,
-			User:       "user",
-		}
-		if !reflect.DeepEqual(resp, expectedResp) {
-			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
+		if got := retry(t, app, "/retry/reset/1"); got.Succeeded || got.Attempt != 1 {
+			t.Fatalf("expected reset key to fail its first attempt again, got %+v", got)
 		}
 	})
 
-	t.Run("error/no auth", func(t *testing.T) {
+	t.Run("keys_expire", func(t *testing.T) {
 		t.Parallel()
-		r, _ := http.NewRequest("GET", "/basic-auth/user/pass", nil)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-
-		assertStatusCode(t, w, http.StatusUnauthorized)
-		assertContentType(t, w, jsonContentType)
-		assertHeader(t, w, "WWW-Authenticate", `Basic realm="Fake Realm"`)
-
-		resp := &authResponse{}
-		json.Unmarshal(w.Body.Bytes(), resp)
-
-		expectedResp := &authResponse{
-			Authorized: false,
-			User:       "",
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		app := New()
+		app.now = func() time.Time { return now }
+
+		retry(t, app, "/retry/expiring/1")
+		now = now.Add(keyCounterTTL - time.Second)
+		if got := retry(t, app, "/retry/expiring/1"); !got.Succeeded {
+			t.Fatalf("expected key to be remembered, got %+v", got)
 		}
-		if !reflect.DeepEqual(resp, expectedResp) {
-			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
+		now = now.Add(keyCounterTTL + time.Second)
+		if got := retry(t, app, "/retry/expiring/1"); got.Succeeded || got.Attempt != 1 {
+			t.Fatalf("expected expired key to start over, got %+v", got)
 		}
 	})
 
-	t.Run("error/bad auth", func(t *testing.T) {
+	t.Run("concurrent_requests", func(t *testing.T) {
 		t.Parallel()
-		r, _ := http.NewRequest("GET", "/basic-auth/user/pass", nil)
-		r.SetBasicAuth("bad", "auth")
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-
-		assertStatusCode(t, w, http.StatusUnauthorized)
-		assertContentType(t, w, jsonContentType)
-		assertHeader(t, w, "WWW-Authenticate", `Basic realm="Fake Realm"`)
-
-		resp := &authResponse{}
-		json.Unmarshal(w.Body.Bytes(), resp)
+		const n, failures = 50, 20
+		var wg sync.WaitGroup
+		results := make([]retryResponse, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r, _ := http.NewRequest("GET", fmt.Sprintf("/retry/concurrent/%d", failures), nil)
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+				if err := json.Unmarshal(w.Body.Bytes(), &results[i]); err != nil {
+					t.Errorf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
 
-		expectedResp := &authResponse{
-			Authorized: false,
-			User:       "bad",
+		seen := make(map[int64]bool)
+		failed := 0
+		for _, resp := range results {
+			if seen[resp.Attempt] {
+				t.Fatalf("attempt %d seen twice", resp.Attempt)
+			}
+			seen[resp.Attempt] = true
+			if !resp.Succeeded {
+				failed++
+			}
 		}
-		if !reflect.DeepEqual(resp, expectedResp) {
-			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
+		if failed != failures {
+			t.Fatalf("expected %d failed attempts, got %d", failures, failed)
 		}
 	})
 
-	errorTests := []struct {
-		url    string
-		status int
+	paramTests := []struct {
+		url   string
+		param string
 	}{
-		{"/basic-auth", http.StatusNotFound},
-		{"/basic-auth/user", http.StatusNotFound},
-		{"/basic-auth/user/pass/extra", http.StatusNotFound},
-	}
-	for _, test := range errorTests {
+		{"/retry/bad.key/1", "key"},
+		{"/retry/k/", "n"},
+		{"/retry/k/-1", "n"},
+		{"/retry/k/foo", "n"},
+		{fmt.Sprintf("/retry/k/%d", maxRetryFailures+1), "n"},
+		{"/retry/k/1?status_code=200", "status_code"},
+		{"/retry/k/1?status_code=600", "status_code"},
+		{"/retry/k/1?status_code=foo", "status_code"},
+	}
+	for _, test := range paramTests {
 		test := test
-		t.Run("error"+test.url, func(t *testing.T) {
+		t.Run("bad"+test.url, func(t *testing.T) {
 			t.Parallel()
 			r, _ := http.NewRequest("GET", test.url, nil)
-			r.SetBasicAuth("foo", "bar")
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.status)
+			assertParamError(t, w, test.param)
+		})
+	}
+
+	for _, url := range []string{"/retry/", "/retry/k", "/retry/k/1/extra"} {
+		url := url
+		t.Run("not_found"+url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotFound)
 		})
 	}
 }
 
-func TestHiddenBasicAuth(t *testing.T) {
+func TestResponseHeaders__OK(t *testing.T) {
 	t.Parallel()
-	t.Run("ok", func(t *testing.T) {
-		t.Parallel()
-		r, _ := http.NewRequest("GET", "/hidden-basic-auth/user/pass", nil)
-		r.SetBasicAuth("user", "pass")
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
+	headers := map[string][]string{
+		"Foo": {"foo"},
+		"Bar": {"bar1, bar2"},
+	}
 
-		assertStatusCode(t, w, http.StatusOK)
-		assertContentType(t, w, jsonContentType)
+	params := url.Values{}
+	for k, vs := range headers {
+		for _, v := range vs {
+			params.Add(k, v)
+		}
+	}
 
-		resp := &authResponse{}
-		json.Unmarshal(w.Body.Bytes(), resp)
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/response-headers?%s", params.Encode()), nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
 
-		expectedResp := &authResponse{
-			Authorized: true,
-			User:       "user",
+	assertStatusCode(t, w, http.StatusOK)
+	assertContentType(t, w, jsonContentType)
+
+	for k, expectedValues := range headers {
+		values, ok := w.Header()[k]
+		if !ok {
+			t.Fatalf("expected header %s in response headers", k)
 		}
-		if !reflect.DeepEqual(resp, expectedResp) {
-			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
+		if !reflect.DeepEqual(values, expectedValues) {
+			t.Fatalf("expected key values %#v for header %s, got %#v", expectedValues, k, values)
 		}
-	})
-
-	t.Run("error/no auth", func(t *testing.T) {
-		t.Parallel()
-		r, _ := http.NewRequest("GET", "/hidden-basic-auth/user/pass", nil)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
+	}
 
-		assertStatusCode(t, w, http.StatusNotFound)
-		if w.Header().Get("WWW-Authenticate") != "" {
-			t.Fatal("did not expect WWW-Authenticate header")
+	resp := &http.Header{}
+	err := json.Unmarshal(w.Body.Bytes(), resp)
+	if err != nil {
+		t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+	}
+
+	for k, expectedValues := range headers {
+		values, ok := (*resp)[k]
+		if !ok {
+			t.Fatalf("expected header %s in response body", k)
 		}
-	})
+		if !reflect.DeepEqual(values, expectedValues) {
+			t.Fatalf("expected key values %#v for header %s, got %#v", expectedValues, k, values)
+		}
+	}
+}
 
-	t.Run("error/bad auth", func(t *testing.T) {
-		t.Parallel()
-		r, _ := http.NewRequest("GET", "/hidden-basic-auth/user/pass", nil)
-		r.SetBasicAuth("bad", "auth")
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
+func TestResponseHeaders__OverrideContentType(t *testing.T) {
+	t.Parallel()
+	contentType := "text/test"
 
-		assertStatusCode(t, w, http.StatusNotFound)
-		if w.Header().Get("WWW-Authenticate") != "" {
-			t.Fatal("did not expect WWW-Authenticate header")
-		}
-	})
+	params := url.Values{}
+	params.Set("Content-Type", contentType)
 
-	errorTests := []struct {
-		url    string
-		status int
-	}{
-		{"/hidden-basic-auth", http.StatusNotFound},
-		{"/hidden-basic-auth/user", http.StatusNotFound},
-		{"/hidden-basic-auth/user/pass/extra", http.StatusNotFound},
-	}
-	for _, test := range errorTests {
-		test := test
-		t.Run("error"+test.url, func(t *testing.T) {
-			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			r.SetBasicAuth("foo", "bar")
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.status)
-		})
-	}
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/response-headers?%s", params.Encode()), nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertStatusCode(t, w, http.StatusOK)
+	assertContentType(t, w, contentType)
 }
 
-func TestDigestAuth(t *testing.T) {
+func TestRedirects(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
-		url    string
-		status int
+		requestURL       string
+		expectedLocation string
 	}{
-		{"/digest-auth", http.StatusNotFound},
-		{"/digest-auth/user", http.StatusNotFound},
-		{"/digest-auth/user/pass", http.StatusNotFound},
-		{"/digest-auth/auth/user/pass/MD5/foo", http.StatusNotFound},
+		{"/redirect/1", "/get"},
+		{"/redirect/2", "/relative-redirect/1"},
+		{"/redirect/100", "/relative-redirect/99"},
 
-		// valid but unauthenticated requests
-		{"/digest-auth/auth/user/pass", http.StatusUnauthorized},
-		{"/digest-auth/auth/user/pass/MD5", http.StatusUnauthorized},
-		{"/digest-auth/auth/user/pass/SHA-256", http.StatusUnauthorized},
+		{"/redirect/1?absolute=true", "http://host/get"},
+		{"/redirect/2?absolute=TRUE", "http://host/absolute-redirect/1"},
+		{"/redirect/100?absolute=True", "http://host/absolute-redirect/99"},
 
-		// invalid requests
-		{"/digest-auth/bad-qop/user/pass/MD5", http.StatusBadRequest},
-		{"/digest-auth/auth/user/pass/SHA-512", http.StatusBadRequest},
+		{"/redirect/100?absolute=t", "/relative-redirect/99"},
+		{"/redirect/100?absolute=1", "/relative-redirect/99"},
+		{"/redirect/100?absolute=yes", "/relative-redirect/99"},
+
+		{"/relative-redirect/1", "/get"},
+		{"/relative-redirect/2", "/relative-redirect/1"},
+		{"/relative-redirect/100", "/relative-redirect/99"},
+
+		{"/absolute-redirect/1", "http://host/get"},
+		{"/absolute-redirect/2", "http://host/absolute-redirect/1"},
+		{"/absolute-redirect/100", "http://host/absolute-redirect/99"},
 	}
+
 	for _, test := range tests {
 		test := test
-		t.Run("ok"+test.url, func(t *testing.T) {
+		t.Run("ok"+test.requestURL, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
+			r, _ := http.NewRequest("GET", test.requestURL, nil)
+			r.Host = "host"
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.status)
+
+			assertStatusCode(t, w, http.StatusFound)
+			assertHeader(t, w, "Location", test.expectedLocation)
 		})
 	}
 
-	t.Run("ok", func(t *testing.T) {
-		t.Parallel()
-		// Example captured from a successful login in a browser
-		authorization := `Digest username="user",
-			realm="go-httpbin",
-			nonce="6fb213c6593975c877bb1247370527ad",
-			uri="/digest-auth/auth/user/pass/MD5",
-			algorithm=MD5,
-			response="9b7a05d78051b4f668356eedf32f55d6",
-			opaque="fd1c386a015a2bb7c41585f54329ce91",
-			qop=auth,
-			nc=00000001,
-			cnonce="aaab705226af5bd4"`
+	errorTests := []struct {
+		requestURL     string
+		expectedStatus int
+	}{
+		{"/redirect", http.StatusNotFound},
+		{"/redirect/", http.StatusBadRequest},
+		{"/redirect/3.14", http.StatusBadRequest},
+		{"/redirect/foo", http.StatusBadRequest},
+		{"/redirect/10/foo", http.StatusNotFound},
 
-		url := "/digest-auth/auth/user/pass/MD5"
-		r, _ := http.NewRequest("GET", url, nil)
-		r.RequestURI = url
-		r.Header.Set("Authorization", authorization)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
+		{"/relative-redirect", http.StatusNotFound},
+		{"/relative-redirect/", http.StatusBadRequest},
+		{"/relative-redirect/3.14", http.StatusBadRequest},
+		{"/relative-redirect/foo", http.StatusBadRequest},
+		{"/relative-redirect/10/foo", http.StatusNotFound},
 
-		assertStatusCode(t, w, http.StatusOK)
+		{"/absolute-redirect", http.StatusNotFound},
+		{"/absolute-redirect/", http.StatusBadRequest},
+		{"/absolute-redirect/3.14", http.StatusBadRequest},
+		{"/absolute-redirect/foo", http.StatusBadRequest},
+		{"/absolute-redirect/10/foo", http.StatusNotFound},
+	}
 
-		resp := &authResponse{}
-		json.Unmarshal(w.Body.Bytes(), resp)
+	for _, test := range errorTests {
+		test := test
+		t.Run("error"+test.requestURL, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.requestURL, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
 
-		expectedResp := &authResponse{
-			Authorized: true,
-			User:       "user",
-		}
-		if !reflect.DeepEqual(resp, expectedResp) {
-			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
-		}
-	})
+			assertStatusCode(t, w, test.expectedStatus)
+		})
+	}
 }
 
-func TestGzip(t *testing.T) {
+func TestRedirectTo(t *testing.T) {
 	t.Parallel()
-	r, _ := http.NewRequest("GET", "/gzip", nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
+	okTests := []struct {
+		url              string
+		expectedLocation string
+		expectedStatus   int
+	}{
+		{"/redirect-to?url=http://www.example.com/", "http://www.example.com/", http.StatusFound},
+		{"/redirect-to?url=http://www.example.com/&status_code=307", "http://www.example.com/", http.StatusTemporaryRedirect},
+		{"/redirect-to?url=http://www.example.com/&status_code=301", "http://www.example.com/", http.StatusMovedPermanently},
+		{"/redirect-to?url=http://www.example.com/&status_code=308", "http://www.example.com/", http.StatusPermanentRedirect},
 
-	assertContentType(t, w, "application/json; encoding=utf-8")
-	assertHeader(t, w, "Content-Encoding", "gzip")
-	assertStatusCode(t, w, http.StatusOK)
+		{"/redirect-to?url=/get", "/get", http.StatusFound},
+		{"/redirect-to?url=/get&status_code=307", "/get", http.StatusTemporaryRedirect},
+		{"/redirect-to?url=/get&status_code=308", "/get", http.StatusPermanentRedirect},
 
-	zippedContentLengthStr := w.Header().Get("Content-Length")
-	if zippedContentLengthStr == "" {
-		t.Fatalf("missing Content-Length header in response")
+		{"/redirect-to?url=foo", "foo", http.StatusFound},
 	}
 
-	zippedContentLength, err := strconv.Atoi(zippedContentLengthStr)
-	if err != nil {
-		t.Fatalf("error converting Content-Lengh %v to integer: %s", zippedContentLengthStr, err)
-	}
+	for _, test := range okTests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
 
-	gzipReader, err := gzip.NewReader(w.Body)
-	if err != nil {
-		t.Fatalf("error creating gzip reader: %s", err)
+			assertStatusCode(t, w, test.expectedStatus)
+			assertHeader(t, w, "Location", test.expectedLocation)
+		})
 	}
 
-	unzippedBody, err := io.ReadAll(gzipReader)
-	if err != nil {
-		t.Fatalf("error reading gzipped body: %s", err)
-	}
-	var resp *noBodyResponse
-	if err := json.Unmarshal(unzippedBody, &resp); err != nil {
-		t.Fatalf("error unmarshalling response: %s", err)
+	badTests := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{"/redirect-to", http.StatusBadRequest},                                               // missing url
+		{"/redirect-to?status_code=302", http.StatusBadRequest},                               // missing url
+		{"/redirect-to?url=foo&status_code=201", http.StatusBadRequest},                       // invalid status code
+		{"/redirect-to?url=foo&status_code=418", http.StatusBadRequest},                       // invalid status code
+		{"/redirect-to?url=http%3A%2F%2Ffoo%25%25bar&status_code=418", http.StatusBadRequest}, // invalid URL
 	}
+	for _, test := range badTests {
+		test := test
+		t.Run("bad"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
 
-	if resp.Gzipped != true {
-		t.Fatalf("expected resp.Gzipped == true")
+			assertStatusCode(t, w, test.expectedStatus)
+		})
 	}
 
-	if len(unzippedBody) <= zippedContentLength {
-		t.Fatalf("expected compressed body")
+	for _, code := range []string{"200", "304", "306", "400", "foo"} {
+		code := code
+		t.Run("bad status code "+code, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/redirect-to?url=/get&status_code="+code, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, "status_code")
+			if loc := w.Header().Get("Location"); loc != "" {
+				t.Fatalf("expected no Location header, got %q", loc)
+			}
+		})
 	}
-}
 
-func TestDeflate(t *testing.T) {
-	t.Parallel()
-	r, _ := http.NewRequest("GET", "/deflate", nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
+	allowListHandler := New(
+		WithAllowedRedirectDomains([]string{"httpbingo.org", "example.org", "*.example.net"}),
+		WithObserver(StdLogObserver(log.New(io.Discard, "", 0))),
+	).Handler()
 
-	assertContentType(t, w, "application/json; encoding=utf-8")
-	assertHeader(t, w, "Content-Encoding", "deflate")
-	assertStatusCode(t, w, http.StatusOK)
+	allowedDomainsError := `Forbidden redirect URL. Please be careful with this link.
 
-	contentLengthHeader := w.Header().Get("Content-Length")
-	if contentLengthHeader == "" {
-		t.Fatalf("missing Content-Length header in response")
-	}
+Allowed redirect destinations:
+- *.example.net
+- example.org
+- httpbingo.org
+`
 
-	compressedContentLength, err := strconv.Atoi(contentLengthHeader)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	reader, err := zlib.NewReader(w.Body)
-	if err != nil {
-		t.Fatal(err)
-	}
-	body, err := io.ReadAll(reader)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	var resp *noBodyResponse
-	err = json.Unmarshal(body, &resp)
-	if err != nil {
-		t.Fatalf("error unmarshalling response: %s", err)
+	allowListTests := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{"/redirect-to?url=http://httpbingo.org", http.StatusFound},                 // allowlist ok
+		{"/redirect-to?url=https://httpbingo.org", http.StatusFound},                // scheme doesn't matter
+		{"/redirect-to?url=https://example.org/foo/bar", http.StatusFound},          // paths don't matter
+		{"/redirect-to?url=https://foo.example.org/foo/bar", http.StatusForbidden},  // subdomains of allowed domains do not match
+		{"/redirect-to?url=https://evil.com", http.StatusForbidden},                 // not in allowlist
+		{"/redirect-to?url=https://evil.com&status_code=308", http.StatusForbidden}, // allowlist applies to every status code
+		{"/redirect-to?url=https://example.org&status_code=308", http.StatusPermanentRedirect},
+		{"/redirect-to?url=https://example.org:8443/foo", http.StatusFound}, // ports don't matter
+		{"/redirect-to?url=https://www.example.net/", http.StatusFound},     // wildcard subdomain
+		{"/redirect-to?url=https://a.b.example.net/", http.StatusFound},     // nested wildcard subdomain
+		{"/redirect-to?url=https://example.net/", http.StatusForbidden},     // wildcard does not match apex
+		{"/redirect-to?url=https://evilexample.net/", http.StatusForbidden}, // wildcard requires a dot
 	}
-
-	if resp.Deflated != true {
-		t.Fatalf("expected resp.Deflated == true")
+	for _, test := range allowListTests {
+		test := test
+		t.Run("allowlist"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			allowListHandler.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.expectedStatus)
+			if test.expectedStatus >= 400 {
+				assertBodyEquals(t, w, allowedDomainsError)
+			}
+		})
 	}
+}
 
-	if len(body) <= compressedContentLength {
-		t.Fatalf("expected compressed body")
-	}
+func TestAllowedRedirectDomainsValidation(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expected panic for bare wildcard")
+		}
+	}()
+	WithAllowedRedirectDomains([]string{"example.com", "*"})
 }
 
-func TestStream(t *testing.T) {
+func TestCookies(t *testing.T) {
 	t.Parallel()
-	okTests := []struct {
-		url           string
-		expectedLines int
-	}{
-		{"/stream/20", 20},
-		{"/stream/100", 100},
-		{"/stream/1000", 100},
-		{"/stream/0", 1},
-		{"/stream/-100", 1},
-	}
-	for _, test := range okTests {
-		test := test
-		t.Run("ok"+test.url, func(t *testing.T) {
-			t.Parallel()
-			srv := httptest.NewServer(app)
-			defer srv.Close()
+	testCookies := func(t *testing.T, cookies cookiesResponse) {
+		r, _ := http.NewRequest("GET", "/cookies", nil)
+		for k, v := range cookies {
+			r.AddCookie(&http.Cookie{
+				Name:  k,
+				Value: v,
+			})
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
 
-			resp, err := http.Get(srv.URL + test.url)
-			assertNil(t, err)
-			defer resp.Body.Close()
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
 
-			// Expect empty content-length due to streaming response
-			assertHeader(t, resp, "Content-Length", "")
+		resp := cookiesResponse{}
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+		}
 
-			if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
-				t.Fatalf("expected Transfer-Encoding: chunked, got %#v", resp.TransferEncoding)
-			}
+		if !reflect.DeepEqual(cookies, resp) {
+			t.Fatalf("expected cookies %#v, got %#v", cookies, resp)
+		}
+	}
 
-			var sr *streamResponse
+	t.Run("ok/no cookies", func(t *testing.T) {
+		t.Parallel()
+		testCookies(t, cookiesResponse{})
+	})
 
-			i := 0
-			scanner := bufio.NewScanner(resp.Body)
-			for scanner.Scan() {
-				if err := json.Unmarshal(scanner.Bytes(), &sr); err != nil {
-					t.Fatalf("error unmarshalling response: %s", err)
-				}
-				if sr.ID != i {
-					t.Fatalf("bad id: %v != %v", sr.ID, i)
-				}
-				i++
-			}
-			if err := scanner.Err(); err != nil {
-				t.Fatalf("error scanning streaming response: %s", err)
-			}
+	t.Run("ok/cookies", func(t *testing.T) {
+		t.Parallel()
+		testCookies(t, cookiesResponse{
+			"k1": "v1",
+			"k2": "v2",
 		})
-	}
+	})
+}
 
-	badTests := []struct {
-		url  string
-		code int
-	}{
-		{"/stream", http.StatusNotFound},
-		{"/stream/foo", http.StatusBadRequest},
-		{"/stream/3.1415", http.StatusBadRequest},
-		{"/stream/10/foo", http.StatusNotFound},
-	}
+func TestMaxReflectedHeaderBytes(t *testing.T) {
+	t.Parallel()
 
-	for _, test := range badTests {
-		test := test
-		t.Run("bad"+test.url, func(t *testing.T) {
+	const limit = 256
+	app := New(WithMaxReflectedHeaderBytes(limit))
+	big := strings.Repeat("x", limit)
+
+	tests := []struct {
+		name       string
+		smallPath  string
+		smallCode  int
+		bigPath    string
+		wantHeader string
+	}{
+		{"response-headers", "/response-headers?X-Foo=bar", http.StatusOK, "/response-headers?X-Foo=" + big, "X-Foo"},
+		{"response-headers many", "/response-headers?a=1&b=2", http.StatusOK, "/response-headers?" + strings.Repeat("X-Foo=bar&", 32), "X-Foo"},
+		{"cookies/set", "/cookies/set?k=v", http.StatusFound, "/cookies/set?k=" + big, "Set-Cookie"},
+		{"cookies/delete", "/cookies/delete?k", http.StatusFound, "/cookies/delete?" + big, "Set-Cookie"},
+		{"redirect-to", "/redirect-to?url=/get", http.StatusFound, "/redirect-to?url=/" + big, "Location"},
+		{"redirect-loop", "/redirect-loop?via=a,b", http.StatusFound, "/redirect-loop?via=" + strings.TrimSuffix(strings.Repeat(strings.Repeat("x", 32)+",", 8), ","), "Location"},
+		{"etag", "/etag/abc", http.StatusOK, "/etag/" + big, "ETag"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
+
+			r, _ := http.NewRequest("GET", tc.smallPath, nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.code)
+			assertStatusCode(t, w, tc.smallCode)
+
+			r, _ = http.NewRequest("GET", tc.bigPath, nil)
+			w = httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+			assertBodyContains(t, w, fmt.Sprintf("exceeding the limit of %d bytes", limit))
+			assertHeader(t, w, tc.wantHeader, "")
+			assertHeader(t, w, "Location", "")
 		})
 	}
+
+	t.Run("no limit by default", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/response-headers?X-Foo="+big, nil)
+		w := httptest.NewRecorder()
+		New().ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "X-Foo", big)
+	})
 }
 
-func TestDelay(t *testing.T) {
+func TestMaxURLLength(t *testing.T) {
 	t.Parallel()
-	okTests := []struct {
-		url           string
-		expectedDelay time.Duration
-	}{
-		// go-style durations are supported
-		{"/delay/0ms", 0},
-		{"/delay/500ms", 500 * time.Millisecond},
 
-		// as are floating point seconds
-		{"/delay/0", 0},
-		{"/delay/0.5", 500 * time.Millisecond},
-		{"/delay/1", maxDuration},
+	const limit = 128
+	app := New(WithMaxURLLength(limit))
+
+	// pathOfLength returns a path to the given endpoint exactly n bytes long
+	pathOfLength := func(endpoint string, n int) string {
+		prefix := endpoint + "?q="
+		return prefix + strings.Repeat("x", n-len(prefix))
 	}
-	for _, test := range okTests {
-		test := test
-		t.Run("ok"+test.url, func(t *testing.T) {
-			t.Parallel()
-			start := time.Now()
 
-			r, _ := http.NewRequest("GET", test.url, nil)
+	t.Run("at the limit", func(t *testing.T) {
+		t.Parallel()
+		for _, tc := range []struct {
+			method   string
+			endpoint string
+		}{
+			{"GET", "/get"},
+			{"POST", "/anything"},
+		} {
+			r := httptest.NewRequest(tc.method, pathOfLength(tc.endpoint, limit), nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-
-			elapsed := time.Since(start)
-
 			assertStatusCode(t, w, http.StatusOK)
-			assertHeader(t, w, "Content-Type", jsonContentType)
 
-			var resp *bodyResponse
-			err := json.Unmarshal(w.Body.Bytes(), &resp)
-			if err != nil {
-				t.Fatalf("error unmarshalling response: %s", err)
+			var resp struct {
+				URLLength int `json:"url_length"`
 			}
+			assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assertIntEqual(t, resp.URLLength, limit)
+		}
+	})
 
-			if elapsed < test.expectedDelay {
-				t.Fatalf("expected delay of %s, got %s", test.expectedDelay, elapsed)
-			}
-		})
-	}
+	t.Run("over the limit", func(t *testing.T) {
+		t.Parallel()
+		body := &failingReader{t: t}
+		r := httptest.NewRequest("POST", pathOfLength("/anything", limit+1), body)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusRequestURITooLong)
+		assertContentType(t, w, jsonContentType)
 
-	t.Run("handle cancelation", func(t *testing.T) {
+		var resp errorResponse
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assertIntEqual(t, resp.StatusCode, http.StatusRequestURITooLong)
+		assertIntEqual(t, resp.URLLength, limit+1)
+		assertIntEqual(t, resp.MaxURLLength, limit)
+		if want := fmt.Sprintf("URL length of %d exceeds the limit of %d", limit+1, limit); resp.Detail != want {
+			t.Fatalf("expected detail %q, got %q", want, resp.Detail)
+		}
+	})
+
+	t.Run("over real connection", func(t *testing.T) {
 		t.Parallel()
 		srv := httptest.NewServer(app)
 		defer srv.Close()
-
-		client := http.Client{
-			Timeout: time.Duration(10 * time.Millisecond),
-		}
-		_, err := client.Get(srv.URL + "/delay/1")
-		if err == nil {
-			t.Fatal("expected timeout error")
+		for _, tc := range []struct {
+			n    int
+			want int
+		}{
+			{limit, http.StatusOK},
+			{limit + 1, http.StatusRequestURITooLong},
+		} {
+			resp, err := http.Get(srv.URL + pathOfLength("/get", tc.n))
+			assertNil(t, err)
+			resp.Body.Close()
+			assertIntEqual(t, resp.StatusCode, tc.want)
 		}
 	})
 
-	t.Run("cancelation causes 499", func(t *testing.T) {
+	t.Run("no limit by default", func(t *testing.T) {
 		t.Parallel()
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
-		defer cancel()
-
-		r, _ := http.NewRequestWithContext(ctx, "GET", "/delay/1s", nil)
+		r := httptest.NewRequest("GET", pathOfLength("/get", 4*limit), nil)
 		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-
-		if w.Code != 499 {
-			t.Errorf("expected 499 response, got %d", w.Code)
+		New().ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		if strings.Contains(w.Body.String(), "url_length") {
+			t.Fatalf("expected no url_length without a limit, got %s", w.Body)
 		}
 	})
 
-	badTests := []struct {
-		url  string
-		code int
-	}{
-		{"/delay", http.StatusNotFound},
-		{"/delay/foo", http.StatusBadRequest},
-		{"/delay/1/foo", http.StatusNotFound},
+	t.Run("invalid limit", func(t *testing.T) {
+		t.Parallel()
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("expected panic for non-positive limit")
+			}
+		}()
+		WithMaxURLLength(0)
+	})
+}
 
-		{"/delay/1.5s", http.StatusBadRequest},
-		{"/delay/-1ms", http.StatusBadRequest},
-		{"/delay/1.5", http.StatusBadRequest},
-		{"/delay/-1", http.StatusBadRequest},
-		{"/delay/-3.14", http.StatusBadRequest},
-	}
+// failingReader fails the test if it is ever read.
+type failingReader struct {
+	t *testing.T
+}
 
-	for _, test := range badTests {
-		test := test
-		t.Run("bad"+test.url, func(t *testing.T) {
-			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.code)
-		})
-	}
+func (r *failingReader) Read([]byte) (int, error) {
+	r.t.Errorf("unexpected read of request body")
+	return 0, io.EOF
 }
 
-func TestDrip(t *testing.T) {
+func TestSetCookies(t *testing.T) {
 	t.Parallel()
-	okTests := []struct {
-		params   *url.Values
-		duration time.Duration
-		numbytes int
-		code     int
-	}{
-		// there are useful defaults for all values
-		{&url.Values{}, 0, 10, http.StatusOK},
+	cookies := cookiesResponse{
+		"k1": "v1",
+		"k2": "v2",
+	}
 
-		// go-style durations are accepted
-		{&url.Values{"duration": {"5ms"}}, 5 * time.Millisecond, 10, http.StatusOK},
-		{&url.Values{"duration": {"0h"}}, 0, 10, http.StatusOK},
-		{&url.Values{"delay": {"5ms"}}, 5 * time.Millisecond, 10, http.StatusOK},
-		{&url.Values{"delay": {"0h"}}, 0, 10, http.StatusOK},
+	params := &url.Values{}
+	for k, v := range cookies {
+		params.Set(k, v)
+	}
 
-		// or floating point seconds
-		{&url.Values{"duration": {"0.25"}}, 250 * time.Millisecond, 10, http.StatusOK},
-		{&url.Values{"duration": {"0"}}, 0, 10, http.StatusOK},
-		{&url.Values{"duration": {"1"}}, 1 * time.Second, 10, http.StatusOK},
-		{&url.Values{"delay": {"0.25"}}, 250 * time.Millisecond, 10, http.StatusOK},
-		{&url.Values{"delay": {"0"}}, 0, 10, http.StatusOK},
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/cookies/set?%s", params.Encode()), nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
 
-		{&url.Values{"numbytes": {"1"}}, 0, 1, http.StatusOK},
-		{&url.Values{"numbytes": {"101"}}, 0, 101, http.StatusOK},
-		{&url.Values{"numbytes": {fmt.Sprintf("%d", maxBodySize)}}, 0, int(maxBodySize), http.StatusOK},
+	assertStatusCode(t, w, http.StatusFound)
+	assertHeader(t, w, "Location", "/cookies")
 
-		{&url.Values{"code": {"100"}}, 0, 10, 100},
-		{&url.Values{"code": {"404"}}, 0, 10, 404},
-		{&url.Values{"code": {"599"}}, 0, 10, 599},
-		{&url.Values{"code": {"567"}}, 0, 10, 567},
+	for _, c := range w.Result().Cookies() {
+		v, ok := cookies[c.Name]
+		if !ok {
+			t.Fatalf("got unexpected cookie %s=%s", c.Name, c.Value)
+		}
+		if v != c.Value {
+			t.Fatalf("got cookie %s=%s, expected value in %#v", c.Name, c.Value, v)
+		}
+	}
+}
 
-		{&url.Values{"duration": {"250ms"}, "delay": {"250ms"}}, 500 * time.Millisecond, 10, http.StatusOK},
-		{&url.Values{"duration": {"250ms"}, "delay": {"0.25s"}}, 500 * time.Millisecond, 10, http.StatusOK},
+func TestSetCookiesAttributes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		url      string
+		body     string
+		expected []string
+	}{
+		{
+			name:     "defaults",
+			url:      "/cookies/set?k2=v2&k1=v1",
+			expected: []string{"k1=v1; HttpOnly", "k2=v2; HttpOnly"},
+		},
+		{
+			name:     "query_attributes",
+			url:      "/cookies/set?k=v&__secure=true&__samesite=strict&__max_age=3600&__path=/foo&__domain=example.com",
+			expected: []string{"k=v; Path=/foo; Domain=example.com; Max-Age=3600; HttpOnly; Secure; SameSite=Strict"},
+		},
+		{
+			name:     "query_attributes_apply_to_all_cookies",
+			url:      "/cookies/set?a=1&b=2&__samesite=Lax&__httponly=false",
+			expected: []string{"a=1; SameSite=Lax", "b=2; SameSite=Lax"},
+		},
+		{
+			name:     "zero_max_age",
+			url:      "/cookies/set?k=v&__max_age=0",
+			expected: []string{"k=v; Max-Age=0; HttpOnly"},
+		},
+		{
+			name:     "samesite_none",
+			url:      "/cookies/set?k=v&__samesite=none&__secure=true",
+			expected: []string{"k=v; HttpOnly; Secure; SameSite=None"},
+		},
+		{
+			name:     "host_prefix",
+			url:      "/cookies/set?__Host-id=1&__secure=true&__path=/",
+			expected: []string{"__Host-id=1; Path=/; HttpOnly; Secure"},
+		},
+		{
+			name:     "secure_prefix",
+			url:      "/cookies/set?__Secure-id=1&__secure=1",
+			expected: []string{"__Secure-id=1; HttpOnly; Secure"},
+		},
+		{
+			name: "json_body",
+			url:  "/cookies/set",
+			body: `[
+				{"name": "session", "value": "abc", "path": "/", "secure": true, "samesite": "strict", "max_age": 60},
+				{"name": "pref", "value": "dark", "domain": "example.com", "httponly": false},
+				{"name": "__Host-id", "value": "1", "path": "/", "secure": true}
+			]`,
+			expected: []string{
+				"session=abc; Path=/; Max-Age=60; HttpOnly; Secure; SameSite=Strict",
+				"pref=dark; Domain=example.com",
+				"__Host-id=1; Path=/; HttpOnly; Secure",
+			},
+		},
 	}
-	for _, test := range okTests {
+	for _, test := range tests {
 		test := test
-		t.Run(fmt.Sprintf("ok/%s", test.params.Encode()), func(t *testing.T) {
+		t.Run(test.name, func(t *testing.T) {
 			t.Parallel()
-			url := "/drip?" + test.params.Encode()
-			start := time.Now()
-
-			r, _ := http.NewRequest("GET", url, nil)
+			method, body := "GET", io.Reader(nil)
+			if test.body != "" {
+				method, body = "POST", strings.NewReader(test.body)
+			}
+			r, _ := http.NewRequest(method, test.url, body)
+			if test.body != "" {
+				r.Header.Set("Content-Type", "application/json")
+			}
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
 
-			elapsed := time.Since(start)
+			assertStatusCode(t, w, http.StatusFound)
+			assertHeader(t, w, "Location", "/cookies")
+			if got := w.Header()["Set-Cookie"]; !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("expected Set-Cookie headers %#v, got %#v", test.expected, got)
+			}
+		})
+	}
 
-			assertStatusCode(t, w, test.code)
-			assertHeader(t, w, "Content-Type", "application/octet-stream")
-			assertHeader(t, w, "Content-Length", strconv.Itoa(test.numbytes))
-			if len(w.Body.Bytes()) != test.numbytes {
-				t.Fatalf("expected %d bytes, got %d", test.numbytes, len(w.Body.Bytes()))
+	paramTests := []struct {
+		url   string
+		param string
+	}{
+		{"/cookies/set?k=v&__samesite=sometimes", "__samesite"},
+		{"/cookies/set?k=v&__secure=maybe", "__secure"},
+		{"/cookies/set?k=v&__httponly=maybe", "__httponly"},
+		{"/cookies/set?k=v&__max_age=-1", "__max_age"},
+		{"/cookies/set?k=v&__max_age=soon", "__max_age"},
+	}
+	for _, test := range paramTests {
+		test := test
+		t.Run("invalid_params"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, test.param)
+			if _, ok := w.Header()["Set-Cookie"]; ok {
+				t.Fatalf("expected no cookies to be set, got %#v", w.Header()["Set-Cookie"])
 			}
+		})
+	}
 
-			if elapsed < test.duration {
-				t.Fatalf("expected minimum duration of %s, request took %s", test.duration, elapsed)
+	badRequestTests := []struct {
+		name string
+		url  string
+		body string
+	}{
+		{"host_prefix_without_secure", "/cookies/set?__Host-id=1&__path=/", ""},
+		{"host_prefix_without_root_path", "/cookies/set?__Host-id=1&__secure=true", ""},
+		{"host_prefix_with_domain", "/cookies/set?__host-id=1&__secure=true&__path=/&__domain=example.com", ""},
+		{"secure_prefix_without_secure", "/cookies/set?__Secure-id=1", ""},
+		{"json_invalid_samesite", "/cookies/set", `[{"name": "k", "value": "v", "samesite": "sometimes"}]`},
+		{"json_negative_max_age", "/cookies/set", `[{"name": "k", "value": "v", "max_age": -1}]`},
+		{"json_malformed", "/cookies/set", `{"name": "k"}`},
+	}
+	for _, test := range badRequestTests {
+		test := test
+		t.Run("bad_request/"+test.name, func(t *testing.T) {
+			t.Parallel()
+			method, body := "GET", io.Reader(nil)
+			if test.body != "" {
+				method, body = "POST", strings.NewReader(test.body)
+			}
+			r, _ := http.NewRequest(method, test.url, body)
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+			if _, ok := w.Header()["Set-Cookie"]; ok {
+				t.Fatalf("expected no cookies to be set, got %#v", w.Header()["Set-Cookie"])
 			}
 		})
 	}
+}
 
-	t.Run("writes are actually incremmental", func(t *testing.T) {
-		t.Parallel()
+func TestDeleteCookies(t *testing.T) {
+	t.Parallel()
+	cookies := cookiesResponse{
+		"k1": "v1",
+		"k2": "v2",
+	}
 
-		srv := httptest.NewServer(app)
-		defer srv.Close()
+	toDelete := "k2"
+	params := &url.Values{}
+	params.Set(toDelete, "")
 
-		var (
-			duration  = 100 * time.Millisecond
-			numBytes  = 3
-			wantDelay = duration / time.Duration(numBytes)
-			wantBytes = []byte{'*'}
-		)
-		resp, err := http.Get(srv.URL + fmt.Sprintf("/drip?duration=%s&delay=%s&numbytes=%d", duration, wantDelay, numBytes))
-		if err != nil {
-			t.Fatalf("unexpected error: %s", err)
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/cookies/delete?%s", params.Encode()), nil)
+	for k, v := range cookies {
+		r.AddCookie(&http.Cookie{
+			Name:  k,
+			Value: v,
+		})
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertStatusCode(t, w, http.StatusFound)
+	assertHeader(t, w, "Location", "/cookies")
+
+	for _, c := range w.Result().Cookies() {
+		if c.Name == toDelete {
+			if time.Since(c.Expires) < (24*365-1)*time.Hour {
+				t.Fatalf("expected cookie %s to be deleted; got %#v", toDelete, c)
+			}
 		}
-		defer resp.Body.Close()
+	}
+}
 
-		// Here we read from the response one byte at a time, and ensure that
-		// at least the expected delay occurs for each read.
-		//
-		// The request above includes an initial delay equal to the expected
-		// wait between writes so that even the first iteration of this loop
-		// expects to wait the same amount of time for a read.
-		buf := make([]byte, 1)
-		for {
-			start := time.Now()
-			n, err := resp.Body.Read(buf)
-			gotDelay := time.Since(start)
+func TestDeleteCookiesScoped(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	app := New()
+	app.now = func() time.Time { return now }
+	const expired = "Expires=Tue, 01 Jan 2019 00:00:00 GMT; Max-Age=0"
 
-			if err == io.EOF {
-				break
+	tests := []struct {
+		name     string
+		url      string
+		body     string
+		cookies  []string
+		expected []string
+	}{
+		{
+			name:     "query",
+			url:      "/cookies/delete?k2=&k1=",
+			expected: []string{"k1=; " + expired + "; HttpOnly", "k2=; " + expired + "; HttpOnly"},
+		},
+		{
+			name:     "query_scoped",
+			url:      "/cookies/delete?k=&__path=/foo&__domain=example.com",
+			expected: []string{"k=; Path=/foo; Domain=example.com; " + expired + "; HttpOnly"},
+		},
+		{
+			name:     "all",
+			url:      "/cookies/delete?all=true",
+			cookies:  []string{"b", "a", "b"},
+			expected: []string{"a=; " + expired + "; HttpOnly", "b=; " + expired + "; HttpOnly"},
+		},
+		{
+			name:     "all_scoped_and_named",
+			url:      "/cookies/delete?all=1&c=&__path=/",
+			cookies:  []string{"a"},
+			expected: []string{"a=; Path=/; " + expired + "; HttpOnly", "c=; Path=/; " + expired + "; HttpOnly"},
+		},
+		{
+			name:     "all_false",
+			url:      "/cookies/delete?all=false",
+			cookies:  []string{"a"},
+			expected: nil,
+		},
+		{
+			name:    "prefixed",
+			url:     "/cookies/delete?all=true",
+			cookies: []string{"__Host-id", "__Secure-id"},
+			expected: []string{
+				"__Host-id=; Path=/; " + expired + "; HttpOnly; Secure",
+				"__Secure-id=; " + expired + "; HttpOnly; Secure",
+			},
+		},
+		{
+			name: "json_body",
+			url:  "/cookies/delete",
+			body: `[
+				{"name": "session", "path": "/app", "domain": "example.com"},
+				{"name": "pref", "domain": "example.com"},
+				{"name": "plain"}
+			]`,
+			expected: []string{
+				"session=; Path=/app; Domain=example.com; " + expired + "; HttpOnly",
+				"pref=; Domain=example.com; " + expired + "; HttpOnly",
+				"plain=; " + expired + "; HttpOnly",
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			method, body := "GET", io.Reader(nil)
+			if test.body != "" {
+				method, body = "POST", strings.NewReader(test.body)
 			}
-			assertNil(t, err)
-			assertIntEqual(t, n, 1)
-			if !reflect.DeepEqual(buf, wantBytes) {
-				t.Fatalf("unexpected bytes read: got %v, want %v", buf, wantBytes)
+			r, _ := http.NewRequest(method, test.url, body)
+			if test.body != "" {
+				r.Header.Set("Content-Type", "application/json")
 			}
+			for _, name := range test.cookies {
+				r.AddCookie(&http.Cookie{Name: name, Value: "v"})
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
 
-			if gotDelay < wantDelay {
-				t.Fatalf("to wait at least %s between reads, waited %s", wantDelay, gotDelay)
+			assertStatusCode(t, w, http.StatusFound)
+			assertHeader(t, w, "Location", "/cookies")
+			if got := w.Header()["Set-Cookie"]; !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("expected Set-Cookie headers %#v, got %#v", test.expected, got)
+			}
+		})
+	}
+
+	t.Run("invalid_all", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/cookies/delete?all=everything", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertParamError(t, w, "all")
+	})
+
+	badRequestTests := []struct {
+		name string
+		url  string
+		body string
+	}{
+		{"host_prefix_with_path", "/cookies/delete?__Host-id=&__path=/foo", ""},
+		{"host_prefix_with_domain", "/cookies/delete?__Host-id=&__domain=example.com", ""},
+		{"json_malformed", "/cookies/delete", `{"name": "k"}`},
+	}
+	for _, test := range badRequestTests {
+		test := test
+		t.Run("bad_request/"+test.name, func(t *testing.T) {
+			t.Parallel()
+			method, body := "GET", io.Reader(nil)
+			if test.body != "" {
+				method, body = "POST", strings.NewReader(test.body)
+			}
+			r, _ := http.NewRequest(method, test.url, body)
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			if _, ok := w.Header()["Set-Cookie"]; ok {
+				t.Fatalf("expected no cookies to be deleted, got %#v", w.Header()["Set-Cookie"])
 			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	t.Parallel()
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/basic-auth/user/pass", nil)
+		r.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+
+		resp := &authResponse{}
+		json.Unmarshal(w.Body.Bytes(), resp)
+
+		expectedResp := &authResponse{
+			Authorized: true,
+			User:       "user",
+		}
+		if !reflect.DeepEqual(resp, expectedResp) {
+			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
+		}
+	})
+
+	t.Run("error/no auth", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/basic-auth/user/pass", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		assertContentType(t, w, jsonContentType)
+		assertHeader(t, w, "WWW-Authenticate", `Basic realm="Fake Realm"`)
+
+		resp := &authResponse{}
+		json.Unmarshal(w.Body.Bytes(), resp)
+
+		expectedResp := &authResponse{
+			Authorized: false,
+			User:       "",
+		}
+		if !reflect.DeepEqual(resp, expectedResp) {
+			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
+		}
+	})
+
+	t.Run("error/bad auth", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/basic-auth/user/pass", nil)
+		r.SetBasicAuth("bad", "auth")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		assertContentType(t, w, jsonContentType)
+		assertHeader(t, w, "WWW-Authenticate", `Basic realm="Fake Realm"`)
+
+		resp := &authResponse{}
+		json.Unmarshal(w.Body.Bytes(), resp)
+
+		expectedResp := &authResponse{
+			Authorized: false,
+			User:       "bad",
+		}
+		if !reflect.DeepEqual(resp, expectedResp) {
+			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
+		}
+	})
+
+	errorTests := []struct {
+		url    string
+		status int
+	}{
+		{"/basic-auth", http.StatusNotFound},
+		{"/basic-auth/user", http.StatusNotFound},
+		{"/basic-auth/user/pass/extra", http.StatusNotFound},
+	}
+	for _, test := range errorTests {
+		test := test
+		t.Run("error"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			r.SetBasicAuth("foo", "bar")
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.status)
+		})
+	}
+}
+
+func TestHiddenBasicAuth(t *testing.T) {
+	t.Parallel()
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/hidden-basic-auth/user/pass", nil)
+		r.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+
+		resp := &authResponse{}
+		json.Unmarshal(w.Body.Bytes(), resp)
+
+		expectedResp := &authResponse{
+			Authorized: true,
+			User:       "user",
+		}
+		if !reflect.DeepEqual(resp, expectedResp) {
+			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
+		}
+	})
+
+	t.Run("error/no auth", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/hidden-basic-auth/user/pass", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusNotFound)
+		if w.Header().Get("WWW-Authenticate") != "" {
+			t.Fatal("did not expect WWW-Authenticate header")
+		}
+	})
+
+	t.Run("error/bad auth", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/hidden-basic-auth/user/pass", nil)
+		r.SetBasicAuth("bad", "auth")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusNotFound)
+		if w.Header().Get("WWW-Authenticate") != "" {
+			t.Fatal("did not expect WWW-Authenticate header")
+		}
+	})
+
+	errorTests := []struct {
+		url    string
+		status int
+	}{
+		{"/hidden-basic-auth", http.StatusNotFound},
+		{"/hidden-basic-auth/user", http.StatusNotFound},
+		{"/hidden-basic-auth/user/pass/extra", http.StatusNotFound},
+	}
+	for _, test := range errorTests {
+		test := test
+		t.Run("error"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			r.SetBasicAuth("foo", "bar")
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.status)
+		})
+	}
+}
+
+func TestExpectContinueAuth(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	const (
+		path = "/expect-continue-auth/user/pass?wait=100ms"
+		body = "0123456789"
+	)
+
+	decode := func(t *testing.T, r io.Reader) expectContinueAuthResponse {
+		t.Helper()
+		var resp expectContinueAuthResponse
+		if err := json.NewDecoder(r).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// compliant sends the request with a client that waits for 100
+	// Continue before sending the body
+	compliant := func(t *testing.T, withAuth bool) (*http.Response, expectContinueAuthResponse) {
+		t.Helper()
+		client := &http.Client{
+			Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second},
+		}
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Expect", "100-continue")
+		if withAuth {
+			req.SetBasicAuth("user", "pass")
+		}
+		resp, err := client.Do(req)
+		assertNil(t, err)
+		defer resp.Body.Close()
+		return resp, decode(t, resp.Body)
+	}
+
+	// naive writes the body immediately after the request headers, without
+	// waiting for 100 Continue
+	naive := func(t *testing.T, auth string) (*http.Response, expectContinueAuthResponse) {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assertNil(t, err)
+		t.Cleanup(func() { conn.Close() })
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: %d\r\n%s\r\n%s", path, srv.Listener.Addr(), len(body), auth, body)
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: "POST"})
+		assertNil(t, err)
+		if resp.StatusCode == http.StatusContinue {
+			resp, err = http.ReadResponse(br, &http.Request{Method: "POST"})
+			assertNil(t, err)
+		}
+		defer resp.Body.Close()
+		return resp, decode(t, resp.Body)
+	}
+
+	t.Run("compliant client withholds body from challenge", func(t *testing.T) {
+		t.Parallel()
+		resp, result := compliant(t, false)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("WWW-Authenticate"); got != `Basic realm="Fake Realm"` {
+			t.Fatalf("unexpected WWW-Authenticate %q", got)
+		}
+		if result.Authorized || !result.ExpectContinue || result.ContinueSent {
+			t.Fatalf("unexpected result %+v", result)
+		}
+		if result.BodyBytesReceived != 0 {
+			t.Fatalf("expected no body bytes, got %d", result.BodyBytesReceived)
+		}
+		if result.DeclaredLength == nil || *result.DeclaredLength != int64(len(body)) {
+			t.Fatalf("expected declared length %d, got %v", len(body), result.DeclaredLength)
+		}
+	})
+
+	t.Run("compliant client sends body once authorized", func(t *testing.T) {
+		t.Parallel()
+		resp, result := compliant(t, true)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		if !result.Authorized || result.User != "user" || !result.ExpectContinue || !result.ContinueSent {
+			t.Fatalf("unexpected result %+v", result)
+		}
+		if result.BodyBytesReceived != int64(len(body)) {
+			t.Fatalf("expected %d body bytes, got %d", len(body), result.BodyBytesReceived)
+		}
+	})
+
+	t.Run("naive client sends body to challenge", func(t *testing.T) {
+		t.Parallel()
+		resp, result := naive(t, "")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", resp.StatusCode)
+		}
+		if result.Authorized || result.ContinueSent {
+			t.Fatalf("unexpected result %+v", result)
+		}
+		if result.BodyBytesReceived != int64(len(body)) {
+			t.Fatalf("expected %d body bytes sent despite the challenge, got %d", len(body), result.BodyBytesReceived)
+		}
+	})
+
+	t.Run("naive client authorized", func(t *testing.T) {
+		t.Parallel()
+		resp, result := naive(t, "Authorization: Basic dXNlcjpwYXNz\r\n")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		if !result.Authorized || result.BodyBytesReceived != int64(len(body)) {
+			t.Fatalf("unexpected result %+v", result)
+		}
+	})
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		t.Parallel()
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		req.SetBasicAuth("user", "wrong")
+		resp, err := http.DefaultClient.Do(req)
+		assertNil(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", resp.StatusCode)
+		}
+		if result := decode(t, resp.Body); result.ExpectContinue || result.User != "user" {
+			t.Fatalf("unexpected result %+v", result)
+		}
+	})
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/expect-continue-auth/user", http.StatusNotFound},
+		{"/expect-continue-auth/user/pass/extra", http.StatusNotFound},
+		{"/expect-continue-auth/user/pass?wait=foo", http.StatusBadRequest},
+		{"/expect-continue-auth/user/pass?wait=1m", http.StatusBadRequest},
+	} {
+		tc := tc
+		t.Run("bad"+tc.path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("POST", tc.path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, tc.code)
+		})
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/digest-auth", http.StatusNotFound},
+		{"/digest-auth/user", http.StatusNotFound},
+		{"/digest-auth/user/pass", http.StatusNotFound},
+		{"/digest-auth/auth/user/pass/MD5/foo", http.StatusNotFound},
+
+		// valid but unauthenticated requests
+		{"/digest-auth/auth/user/pass", http.StatusUnauthorized},
+		{"/digest-auth/auth/user/pass/MD5", http.StatusUnauthorized},
+		{"/digest-auth/auth/user/pass/SHA-256", http.StatusUnauthorized},
+
+		{"/digest-auth/auth-int/user/pass", http.StatusUnauthorized},
+		{"/digest-auth/auth/user/pass/MD5-sess", http.StatusUnauthorized},
+		{"/digest-auth/auth-int/user/pass/SHA-256-sess", http.StatusUnauthorized},
+
+		// invalid requests
+		{"/digest-auth/bad-qop/user/pass/MD5", http.StatusBadRequest},
+		{"/digest-auth/auth/user/pass/SHA-512", http.StatusBadRequest},
+		{"/digest-auth/auth/user/pass/SHA256", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.status)
+		})
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+		url := "/digest-auth/auth/user/pass/MD5"
+		r, _ := http.NewRequest("GET", url, nil)
+		r.RequestURI = url
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		challenge := parseDigestChallenge(t, w.Header().Get("WWW-Authenticate"))
+
+		r, _ = http.NewRequest("GET", url, nil)
+		r.RequestURI = url
+		r.Header.Set("Authorization", digestAuthorization(challenge, "MD5", "GET", url, "user", "pass", ""))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+
+		resp := &authResponse{}
+		json.Unmarshal(w.Body.Bytes(), resp)
+
+		expectedResp := &authResponse{
+			Authorized: true,
+			User:       "user",
+		}
+		if !reflect.DeepEqual(resp, expectedResp) {
+			t.Fatalf("expected response %#v, got %#v", expectedResp, resp)
+		}
+	})
+
+	t.Run("captured_nonce_rejected", func(t *testing.T) {
+		t.Parallel()
+		// Example captured from a successful login in a browser, whose
+		// nonce was not issued by this server
+		authorization := `Digest username="user",
+			realm="go-httpbin",
+			nonce="6fb213c6593975c877bb1247370527ad",
+			uri="/digest-auth/auth/user/pass/MD5",
+			algorithm=MD5,
+			response="9b7a05d78051b4f668356eedf32f55d6",
+			opaque="fd1c386a015a2bb7c41585f54329ce91",
+			qop=auth,
+			nc=00000001,
+			cnonce="aaab705226af5bd4"`
+
+		url := "/digest-auth/auth/user/pass/MD5"
+		r, _ := http.NewRequest("GET", url, nil)
+		r.RequestURI = url
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		if strings.Contains(w.Header().Get("WWW-Authenticate"), "stale=true") {
+			t.Fatalf("expected forged nonce not to be reported stale")
+		}
+	})
+}
+
+func TestDigestAuthStaleness(t *testing.T) {
+	t.Parallel()
+
+	// challenge fetches a fresh challenge from app for uri
+	challenge := func(t *testing.T, app *HTTPBin, uri string) map[string]string {
+		t.Helper()
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.RequestURI = uri
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		return parseDigestChallenge(t, w.Header().Get("WWW-Authenticate"))
+	}
+	// authenticate answers challenge using nonce count nc
+	authenticate := func(app *HTTPBin, uri string, challenge map[string]string, nc int) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.RequestURI = uri
+		r.Header.Set("Authorization", digestAuthorizationNC(challenge, nc, "MD5", "GET", uri, "user", "pass", ""))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("shared_nonce_key", func(t *testing.T) {
+		t.Parallel()
+		uri := "/digest-auth/auth/user/pass/MD5"
+
+		// replicas sharing a key accept each other's nonces
+		issuer := New(WithDigestNonceKey("shared"))
+		c := challenge(t, issuer, uri)
+		assertStatusCode(t, authenticate(New(WithDigestNonceKey("shared")), uri, c, 1), http.StatusOK)
+
+		// while replicas with their own random keys reject them
+		c = challenge(t, New(), uri)
+		assertStatusCode(t, authenticate(New(), uri, c, 1), http.StatusUnauthorized)
+	})
+
+	t.Run("stale_after_seconds", func(t *testing.T) {
+		t.Parallel()
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		app := New()
+		app.now = func() time.Time { return now }
+
+		uri := "/digest-auth/auth/user/pass/MD5?stale_after=10"
+		c := challenge(t, app, uri)
+		if _, ok := c["stale"]; ok {
+			t.Fatalf("expected initial challenge not to be stale")
+		}
+		assertStatusCode(t, authenticate(app, uri, c, 1), http.StatusOK)
+
+		now = now.Add(10 * time.Second)
+		assertStatusCode(t, authenticate(app, uri, c, 2), http.StatusOK)
+
+		now = now.Add(time.Second)
+		w := authenticate(app, uri, c, 3)
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		fresh := parseDigestChallenge(t, w.Header().Get("WWW-Authenticate"))
+		if fresh["stale"] != "true" {
+			t.Fatalf("expected stale=true in challenge, got %q", w.Header().Get("WWW-Authenticate"))
+		}
+		if fresh["nonce"] == c["nonce"] {
+			t.Fatalf("expected a fresh nonce in stale challenge")
+		}
+		assertStatusCode(t, authenticate(app, uri, fresh, 1), http.StatusOK)
+
+		// a stale nonce with the wrong password is just unauthorized
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.RequestURI = uri
+		r.Header.Set("Authorization", digestAuthorization(c, "MD5", "GET", uri, "user", "wrong", ""))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		if _, ok := parseDigestChallenge(t, w.Header().Get("WWW-Authenticate"))["stale"]; ok {
+			t.Fatalf("expected wrong credentials not to be reported stale")
+		}
+	})
+
+	t.Run("stale_after_uses", func(t *testing.T) {
+		t.Parallel()
+		uri := "/digest-auth/auth/user/pass/MD5?stale_after=2uses"
+		c := challenge(t, app, uri)
+		assertStatusCode(t, authenticate(app, uri, c, 1), http.StatusOK)
+		assertStatusCode(t, authenticate(app, uri, c, 2), http.StatusOK)
+
+		w := authenticate(app, uri, c, 3)
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		if parseDigestChallenge(t, w.Header().Get("WWW-Authenticate"))["stale"] != "true" {
+			t.Fatalf("expected stale=true in challenge, got %q", w.Header().Get("WWW-Authenticate"))
+		}
+	})
+
+	t.Run("no_stale_after", func(t *testing.T) {
+		t.Parallel()
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		app := New()
+		app.now = func() time.Time { return now }
+
+		uri := "/digest-auth/auth/user/pass/MD5"
+		c := challenge(t, app, uri)
+		now = now.Add(24 * time.Hour)
+		assertStatusCode(t, authenticate(app, uri, c, 1000), http.StatusOK)
+	})
+
+	t.Run("tampered_nonce", func(t *testing.T) {
+		t.Parallel()
+		uri := "/digest-auth/auth/user/pass/MD5?stale_after=10"
+		c := challenge(t, app, uri)
+		nonce := []byte(c["nonce"])
+		if nonce[0] == 'A' {
+			nonce[0] = 'B'
+		} else {
+			nonce[0] = 'A'
+		}
+		c["nonce"] = string(nonce)
+
+		w := authenticate(app, uri, c, 1)
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		if _, ok := parseDigestChallenge(t, w.Header().Get("WWW-Authenticate"))["stale"]; ok {
+			t.Fatalf("expected tampered nonce not to be reported stale")
+		}
+	})
+
+	t.Run("nonce_from_another_server", func(t *testing.T) {
+		t.Parallel()
+		uri := "/digest-auth/auth/user/pass/MD5"
+		c := challenge(t, New(), uri)
+		assertStatusCode(t, authenticate(app, uri, c, 1), http.StatusUnauthorized)
+	})
+
+	t.Run("tampered_opaque", func(t *testing.T) {
+		t.Parallel()
+		uri := "/digest-auth/auth/user/pass/MD5"
+		c := challenge(t, app, uri)
+		c["opaque"] = challenge(t, app, uri)["opaque"]
+		assertStatusCode(t, authenticate(app, uri, c, 1), http.StatusUnauthorized)
+	})
+
+	for _, param := range []string{"0", "-1", "foo", "0uses", "-1uses", "fuses", "1.5uses"} {
+		param := param
+		t.Run("invalid_stale_after/"+param, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/digest-auth/auth/user/pass/MD5?stale_after="+url.QueryEscape(param), nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, "stale_after")
+		})
+	}
+}
+
+func TestDigestAuthHandshake(t *testing.T) {
+	t.Parallel()
+
+	type handshake struct {
+		qop       string
+		algorithm string
+		// echo is the algorithm as the client echoes it back
+		echo string
+	}
+	var tests []handshake
+	for _, qop := range []string{"auth", "auth-int"} {
+		for _, algorithm := range []string{"MD5", "SHA-256", "MD5-sess", "SHA-256-sess"} {
+			tests = append(tests,
+				handshake{qop, algorithm, algorithm},
+				handshake{qop, algorithm, strings.ToLower(algorithm)},
+			)
+		}
+	}
+	// the algorithm in the path is not case sensitive either
+	tests = append(tests, handshake{"auth", "sha-256-SESS", "SHA-256-sess"})
+
+	for _, test := range tests {
+		test := test
+		t.Run(fmt.Sprintf("%s/%s/echo=%s", test.qop, test.algorithm, test.echo), func(t *testing.T) {
+			t.Parallel()
+			uri := fmt.Sprintf("/digest-auth/%s/user/pass/%s", test.qop, test.algorithm)
+			body := "some request body"
+
+			r, _ := http.NewRequest("POST", uri, strings.NewReader(body))
+			r.RequestURI = uri
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusUnauthorized)
+
+			challenge := parseDigestChallenge(t, w.Header().Get("WWW-Authenticate"))
+			if challenge["qop"] != test.qop {
+				t.Fatalf("expected challenge to offer qop %q, got %q", test.qop, challenge["qop"])
+			}
+			if !strings.EqualFold(challenge["algorithm"], test.algorithm) {
+				t.Fatalf("expected challenge to offer algorithm %q, got %q", test.algorithm, challenge["algorithm"])
+			}
+
+			authorization := digestAuthorization(challenge, test.echo, "POST", uri, "user", "pass", body)
+			r, _ = http.NewRequest("POST", uri, strings.NewReader(body))
+			r.RequestURI = uri
+			r.Header.Set("Authorization", authorization)
+			w = httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+
+			// the response does not verify if any input to it changes
+			if test.qop == "auth-int" {
+				r, _ = http.NewRequest("POST", uri, strings.NewReader(body+" tampered"))
+				r.RequestURI = uri
+				r.Header.Set("Authorization", authorization)
+				w = httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+				assertStatusCode(t, w, http.StatusUnauthorized)
+			}
+			r, _ = http.NewRequest("POST", uri, strings.NewReader(body))
+			r.RequestURI = uri
+			r.Header.Set("Authorization", digestAuthorization(challenge, test.echo, "POST", uri, "user", "wrong", body))
+			w = httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusUnauthorized)
+		})
+	}
+
+	t.Run("algorithm_must_match_challenge", func(t *testing.T) {
+		t.Parallel()
+		uri := "/digest-auth/auth/user/pass/SHA-256"
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.RequestURI = uri
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		challenge := parseDigestChallenge(t, w.Header().Get("WWW-Authenticate"))
+
+		r, _ = http.NewRequest("GET", uri, nil)
+		r.RequestURI = uri
+		r.Header.Set("Authorization", digestAuthorization(challenge, "MD5", "GET", uri, "user", "pass", ""))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusUnauthorized)
+	})
+
+	t.Run("qop_must_match_challenge", func(t *testing.T) {
+		t.Parallel()
+		uri := "/digest-auth/auth-int/user/pass/MD5"
+		r, _ := http.NewRequest("GET", uri, nil)
+		r.RequestURI = uri
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		challenge := parseDigestChallenge(t, w.Header().Get("WWW-Authenticate"))
+		challenge["qop"] = "auth"
+
+		r, _ = http.NewRequest("GET", uri, nil)
+		r.RequestURI = uri
+		r.Header.Set("Authorization", digestAuthorization(challenge, "MD5", "GET", uri, "user", "pass", ""))
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusUnauthorized)
+	})
+}
+
+// parseDigestChallenge parses the parameters of a Digest WWW-Authenticate
+// challenge, none of whose values may contain commas.
+func parseDigestChallenge(t *testing.T, header string) map[string]string {
+	t.Helper()
+	if !strings.HasPrefix(header, "Digest ") {
+		t.Fatalf("expected Digest challenge, got %q", header)
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(strings.TrimPrefix(header, "Digest "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			t.Fatalf("malformed challenge param %q in %q", param, header)
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+// digestAuthorization answers a Digest challenge as a client would, per RFC
+// 7616, echoing the algorithm as given.
+func digestAuthorization(challenge map[string]string, algorithm, method, uri, user, password, body string) string {
+	return digestAuthorizationNC(challenge, 1, algorithm, method, uri, user, password, body)
+}
+
+// digestAuthorizationNC is digestAuthorization for the nc'th use of the
+// challenge's nonce.
+func digestAuthorizationNC(challenge map[string]string, nonceCount int, algorithm, method, uri, user, password, body string) string {
+	h := func(s string) string {
+		if strings.HasPrefix(strings.ToUpper(algorithm), "SHA-256") {
+			return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+		}
+		return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	}
+	const cnonce = "0a4f113b"
+	nc := fmt.Sprintf("%08x", nonceCount)
+	qop, nonce := challenge["qop"], challenge["nonce"]
+
+	ha1 := h(user + ":" + challenge["realm"] + ":" + password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	if qop == "auth-int" {
+		ha2 = h(method + ":" + uri + ":" + h(body))
+	}
+	response := h(strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=%s, nc=%s, cnonce="%s", response="%s", opaque="%s"`,
+		user, challenge["realm"], nonce, uri, algorithm, qop, nc, cnonce, response, challenge["opaque"])
+}
+
+func TestGzip(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest("GET", "/gzip", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertContentType(t, w, "application/json; encoding=utf-8")
+	assertHeader(t, w, "Content-Encoding", "gzip")
+	assertStatusCode(t, w, http.StatusOK)
+
+	zippedContentLengthStr := w.Header().Get("Content-Length")
+	if zippedContentLengthStr == "" {
+		t.Fatalf("missing Content-Length header in response")
+	}
+
+	zippedContentLength, err := strconv.Atoi(zippedContentLengthStr)
+	if err != nil {
+		t.Fatalf("error converting Content-Lengh %v to integer: %s", zippedContentLengthStr, err)
+	}
+
+	gzipReader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("error creating gzip reader: %s", err)
+	}
+
+	unzippedBody, err := io.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatalf("error reading gzipped body: %s", err)
+	}
+	var resp *noBodyResponse
+	if err := json.Unmarshal(unzippedBody, &resp); err != nil {
+		t.Fatalf("error unmarshalling response: %s", err)
+	}
+
+	if resp.Gzipped != true {
+		t.Fatalf("expected resp.Gzipped == true")
+	}
+
+	if len(unzippedBody) <= zippedContentLength {
+		t.Fatalf("expected compressed body")
+	}
+}
+
+func TestDeflate(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest("GET", "/deflate", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertContentType(t, w, "application/json; encoding=utf-8")
+	assertHeader(t, w, "Content-Encoding", "deflate")
+	assertStatusCode(t, w, http.StatusOK)
+
+	contentLengthHeader := w.Header().Get("Content-Length")
+	if contentLengthHeader == "" {
+		t.Fatalf("missing Content-Length header in response")
+	}
+
+	compressedContentLength, err := strconv.Atoi(contentLengthHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := zlib.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp *noBodyResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatalf("error unmarshalling response: %s", err)
+	}
+
+	if resp.Deflated != true {
+		t.Fatalf("expected resp.Deflated == true")
+	}
+
+	if len(body) <= compressedContentLength {
+		t.Fatalf("expected compressed body")
+	}
+}
+
+func TestZstd(t *testing.T) {
+	t.Parallel()
+
+	// decodeZstd decodes body using the reference implementation's command
+	// line tool, skipping the test if it is not installed.
+	decodeZstd := func(t *testing.T, body []byte) []byte {
+		t.Helper()
+		path, err := exec.LookPath("zstd")
+		if err != nil {
+			t.Skip("zstd command not found")
+		}
+		cmd := exec.Command(path, "-d", "-c")
+		cmd.Stdin = bytes.NewReader(body)
+		decoded, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("zstd -d failed: %s", err)
+		}
+		return decoded
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/zstd?foo=bar", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		assertHeader(t, w, "Content-Encoding", "zstd")
+		assertHeader(t, w, "Content-Length", strconv.Itoa(w.Body.Len()))
+		if !bytes.HasPrefix(w.Body.Bytes(), []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+			t.Fatalf("expected zstd magic number, got body %x", w.Body.Bytes())
+		}
+
+		var resp noBodyResponse
+		if err := json.Unmarshal(decodeZstd(t, w.Body.Bytes()), &resp); err != nil {
+			t.Fatalf("error unmarshalling response: %s", err)
+		}
+		if !resp.Zstd || resp.Args.Get("foo") != "bar" {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+	})
+
+	t.Run("large payloads are streamed", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/zstd", nil)
+		for i := 0; i < 200; i++ {
+			r.Header.Add(fmt.Sprintf("X-Padding-%d", i), strings.Repeat("x", 1000))
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "Content-Encoding", "zstd")
+		assertHeader(t, w, "Content-Length", "")
+		if w.Body.Len() > maxBufferedZstdPayload {
+			t.Fatalf("expected repetitive payload to compress, got %d bytes", w.Body.Len())
+		}
+
+		var resp noBodyResponse
+		if err := json.Unmarshal(decodeZstd(t, w.Body.Bytes()), &resp); err != nil {
+			t.Fatalf("error unmarshalling response: %s", err)
+		}
+		if !resp.Zstd || len(resp.Headers) < 200 {
+			t.Fatalf("expected every header in decoded response, got %d", len(resp.Headers))
+		}
+	})
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+	okTests := []struct {
+		url           string
+		expectedLines int
+	}{
+		{"/stream/20", 20},
+		{"/stream/100", 100},
+		{"/stream/1000", 100},
+		{"/stream/0", 1},
+		{"/stream/-100", 1},
+	}
+	for _, test := range okTests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(app)
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + test.url)
+			assertNil(t, err)
+			defer resp.Body.Close()
+
+			// Expect empty content-length due to streaming response
+			assertHeader(t, resp, "Content-Length", "")
+
+			if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+				t.Fatalf("expected Transfer-Encoding: chunked, got %#v", resp.TransferEncoding)
+			}
+
+			var sr *streamResponse
+
+			i := 0
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if err := json.Unmarshal(scanner.Bytes(), &sr); err != nil {
+					t.Fatalf("error unmarshalling response: %s", err)
+				}
+				if sr.ID != i {
+					t.Fatalf("bad id: %v != %v", sr.ID, i)
+				}
+				i++
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatalf("error scanning streaming response: %s", err)
+			}
+		})
+	}
+
+	badTests := []struct {
+		url  string
+		code int
+	}{
+		{"/stream", http.StatusNotFound},
+		{"/stream/foo", http.StatusBadRequest},
+		{"/stream/3.1415", http.StatusBadRequest},
+		{"/stream/10/foo", http.StatusNotFound},
+	}
+
+	for _, test := range badTests {
+		test := test
+		t.Run("bad"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.code)
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	t.Parallel()
+	okTests := []struct {
+		url           string
+		expectedDelay time.Duration
+		clamped       bool
+	}{
+		// go-style durations are supported
+		{"/delay/0ms", 0, false},
+		{"/delay/500ms", 500 * time.Millisecond, false},
+		{"/delay/750ms", 750 * time.Millisecond, false},
+
+		// as are floating point seconds
+		{"/delay/0", 0, false},
+		{"/delay/0.5", 500 * time.Millisecond, false},
+		{"/delay/1", maxDuration, false},
+
+		// and longer delays are clamped to the max duration
+		{"/delay/1.5s", maxDuration, true},
+		{"/delay/1.5", maxDuration, true},
+	}
+	for _, test := range okTests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+			start := time.Now()
+
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			elapsed := time.Since(start)
+
+			assertStatusCode(t, w, http.StatusOK)
+			assertHeader(t, w, "Content-Type", jsonContentType)
+
+			var resp *bodyResponse
+			err := json.Unmarshal(w.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatalf("error unmarshalling response: %s", err)
+			}
+
+			if elapsed < test.expectedDelay {
+				t.Fatalf("expected delay of %s, got %s", test.expectedDelay, elapsed)
+			}
+			wantMS := test.expectedDelay.Seconds() * 1e3
+			if resp.AppliedDelay == nil || resp.AppliedDelay.AppliedMS != wantMS || resp.AppliedDelay.Clamped != test.clamped {
+				t.Fatalf("expected applied delay of %vms with clamped=%v, got %+v", wantMS, test.clamped, resp.AppliedDelay)
+			}
+			if !test.clamped && resp.AppliedDelay.RequestedMS != wantMS {
+				t.Fatalf("expected requested delay of %vms, got %vms", wantMS, resp.AppliedDelay.RequestedMS)
+			}
+		})
+	}
+
+	t.Run("clamped delay reports requested value", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxDuration(10 * time.Millisecond))
+		r, _ := http.NewRequest("GET", "/delay/2s", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		var resp bodyResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if want := (appliedDelay{RequestedMS: 2000, AppliedMS: 10, Clamped: true}); resp.AppliedDelay == nil || *resp.AppliedDelay != want {
+			t.Fatalf("expected applied delay %+v, got %+v", want, resp.AppliedDelay)
+		}
+	})
+
+	t.Run("handle cancelation", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		client := http.Client{
+			Timeout: time.Duration(10 * time.Millisecond),
+		}
+		_, err := client.Get(srv.URL + "/delay/1")
+		if err == nil {
+			t.Fatal("expected timeout error")
+		}
+	})
+
+	t.Run("cancelation causes 499", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		r, _ := http.NewRequestWithContext(ctx, "GET", "/delay/1s", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		if w.Code != 499 {
+			t.Errorf("expected 499 response, got %d", w.Code)
+		}
+	})
+
+	badTests := []struct {
+		url  string
+		code int
+	}{
+		{"/delay", http.StatusNotFound},
+		{"/delay/foo", http.StatusBadRequest},
+		{"/delay/1/foo", http.StatusNotFound},
+
+		{"/delay/-1ms", http.StatusBadRequest},
+		{"/delay/-1", http.StatusBadRequest},
+		{"/delay/-3.14", http.StatusBadRequest},
+		{"/delay/NaN", http.StatusBadRequest},
+		{"/delay/1e300", http.StatusBadRequest},
+	}
+
+	for _, test := range badTests {
+		test := test
+		t.Run("bad"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.code)
+			if test.code == http.StatusBadRequest {
+				assertContentType(t, w, jsonContentType)
+			}
+		})
+	}
+}
+
+func TestDelayRange(t *testing.T) {
+	t.Parallel()
+
+	get := func(t *testing.T, app *HTTPBin, path string) (*httptest.ResponseRecorder, appliedDelay) {
+		t.Helper()
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		var resp bodyResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.AppliedDelay == nil {
+				t.Fatalf("expected applied_delay in response %s", w.Body)
+			}
+			return w, *resp.AppliedDelay
+		}
+		return w, appliedDelay{}
+	}
+
+	for _, tc := range []struct {
+		path     string
+		min, max float64
+	}{
+		{"/delay/100ms-200ms", 100, 200},
+		{"/delay/0.05-0.1", 50, 100},
+		{"/delay/0-0ms", 0, 0},
+		{"/delay/20ms-20ms", 20, 20},
+	} {
+		tc := tc
+		t.Run("ok"+tc.path, func(t *testing.T) {
+			t.Parallel()
+			start := time.Now()
+			w, applied := get(t, app, tc.path)
+			elapsed := time.Since(start)
+			assertStatusCode(t, w, http.StatusOK)
+			if applied.Range == nil || *applied.Range != (delayRange{MinMS: tc.min, MaxMS: tc.max}) {
+				t.Fatalf("expected range %v-%v, got %+v", tc.min, tc.max, applied.Range)
+			}
+			if applied.AppliedMS < tc.min || applied.AppliedMS > tc.max || applied.AppliedMS != applied.RequestedMS || applied.Clamped {
+				t.Fatalf("expected unclamped delay within range, got %+v", applied)
+			}
+			if elapsed < time.Duration(applied.AppliedMS*float64(time.Millisecond)) {
+				t.Fatalf("expected to wait %vms, waited %s", applied.AppliedMS, elapsed)
+			}
+		})
+	}
+
+	t.Run("seed is reproducible", func(t *testing.T) {
+		t.Parallel()
+		_, first := get(t, app, "/delay/0-50ms?seed=42")
+		_, second := get(t, app, "/delay/0-50ms?seed=42")
+		if first.AppliedMS != second.AppliedMS {
+			t.Fatalf("expected the same delay for the same seed, got %v and %v", first.AppliedMS, second.AppliedMS)
+		}
+	})
+
+	t.Run("covers the whole range", func(t *testing.T) {
+		t.Parallel()
+		seen := make(map[float64]bool)
+		for seed := 0; seed < 100; seed++ {
+			_, applied := get(t, app, fmt.Sprintf("/delay/0-2ns?seed=%d", seed))
+			seen[math.Round(applied.AppliedMS*1e6)] = true
+		}
+		if len(seen) != 3 || !seen[0] || !seen[1] || !seen[2] {
+			t.Fatalf("expected delays of 0, 1, and 2ns, got %v", seen)
+		}
+	})
+
+	t.Run("max is clamped", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxDuration(50 * time.Millisecond))
+		w, applied := get(t, app, "/delay/10ms-5s")
+		assertStatusCode(t, w, http.StatusOK)
+		if *applied.Range != (delayRange{MinMS: 10, MaxMS: 5000}) || !applied.Clamped || applied.AppliedMS < 10 || applied.AppliedMS > 50 {
+			t.Fatalf("expected delay within 10-50ms reported as clamped, got %+v", applied)
+		}
+		_, applied = get(t, app, "/delay/1s-5s")
+		if applied.AppliedMS != 50 || !applied.Clamped {
+			t.Fatalf("expected range beyond max duration to be clamped to it, got %+v", applied)
+		}
+	})
+
+	t.Run("exponents are not ranges", func(t *testing.T) {
+		t.Parallel()
+		_, applied := get(t, app, "/delay/1e-2")
+		if applied.Range != nil || applied.AppliedMS != 10 {
+			t.Fatalf("expected a single 10ms delay, got %+v", applied)
+		}
+	})
+
+	for _, tc := range []struct {
+		path    string
+		wantErr string
+	}{
+		{"/delay/2s-1s", "min must not exceed max"},
+		{"/delay/-1-2", "must not be negative"},
+		{"/delay/1--2", "must not be negative"},
+		{"/delay/1-", "must be a duration like 750ms"},
+		{"/delay/a-b", "must be a duration like 750ms"},
+		{"/delay/0-1ms?jitter=1ms", "cannot be combined with jitter"},
+		{"/delay/0-1ms?seed=foo", "invalid seed"},
+	} {
+		tc := tc
+		t.Run("bad"+tc.path, func(t *testing.T) {
+			t.Parallel()
+			w, _ := get(t, app, tc.path)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+			assertBodyContains(t, w, tc.wantErr)
+		})
+	}
+}
+
+func TestDelayJitter(t *testing.T) {
+	t.Parallel()
+
+	doRequest := func(t *testing.T, path string) *bodyResponse {
+		t.Helper()
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		app.ServeHTTP(w, r)
+		elapsed := time.Since(start)
+		assertStatusCode(t, w, http.StatusOK)
+
+		var resp *bodyResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("error unmarshalling response: %s", err)
+		}
+		if resp.Delay == nil {
+			t.Fatalf("expected delay in response, got %s", w.Body.String())
+		}
+		if sampled := time.Duration(resp.Delay.SampledMS * float64(time.Millisecond)); elapsed < sampled {
+			t.Fatalf("expected delay of at least %s, got %s", sampled, elapsed)
+		}
+		return resp
+	}
+
+	t.Run("no jitter requested", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/delay/0?seed=1", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		if strings.Contains(w.Body.String(), `"delay"`) {
+			t.Fatalf("expected no delay in response, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("reports distribution and sample", func(t *testing.T) {
+		t.Parallel()
+		for _, tc := range []struct {
+			path         string
+			distribution string
+			maxMS        float64
+		}{
+			{"/delay/20ms?jitter=10ms", "uniform", 30},
+			{"/delay/20ms?jitter=5ms&distribution=normal", "normal", 35},
+			{"/delay/20ms?jitter=5ms&distribution=exponential", "exponential", 45},
+			{"/delay/20ms?distribution=normal", "normal", 20},
+		} {
+			resp := doRequest(t, tc.path+"&seed=1234")
+			got := resp.Delay
+			if got.Distribution != tc.distribution || got.BaseMS != 20 || got.MaxMS != tc.maxMS || got.Clamped {
+				t.Errorf("%s: unexpected delay %+v", tc.path, got)
+			}
+			if got.SampledMS < 0 || got.SampledMS > got.MaxMS {
+				t.Errorf("%s: sampled delay %vms outside [0, %v]", tc.path, got.SampledMS, got.MaxMS)
+			}
+			if tc.distribution == "exponential" && got.SampledMS < got.BaseMS {
+				t.Errorf("%s: exponential sample %vms below base", tc.path, got.SampledMS)
+			}
+		}
+	})
+
+	t.Run("seed makes sampling reproducible", func(t *testing.T) {
+		t.Parallel()
+		a := doRequest(t, "/delay/0?jitter=50ms&distribution=normal&seed=42").Delay
+		b := doRequest(t, "/delay/0?jitter=50ms&distribution=normal&seed=42").Delay
+		if a.SampledMS != b.SampledMS {
+			t.Fatalf("expected identical samples with same seed, got %v and %v", a.SampledMS, b.SampledMS)
+		}
+	})
+
+	t.Run("clamped to max duration", func(t *testing.T) {
+		t.Parallel()
+		// with a base of the full max duration (1s), every sample in the upper
+		// half of the jitter range is clamped
+		var sawClamped bool
+		for seed := 0; seed < 20 && !sawClamped; seed++ {
+			resp := doRequest(t, fmt.Sprintf("/delay/990ms?jitter=20ms&clamp=true&seed=%d", seed))
+			if resp.Delay.SampledMS > 1000 {
+				t.Fatalf("expected sample clamped to 1000ms, got %v", resp.Delay.SampledMS)
+			}
+			sawClamped = resp.Delay.Clamped
+			if sawClamped && resp.Delay.SampledMS != 1000 {
+				t.Fatalf("expected clamped sample of 1000ms, got %v", resp.Delay.SampledMS)
+			}
+		}
+		if !sawClamped {
+			t.Fatal("expected at least one clamped sample")
+		}
+	})
+
+	for _, tc := range []struct {
+		path    string
+		wantErr string
+	}{
+		{"/delay/900ms?jitter=200ms", "delay 900ms with uniform jitter of 200ms may reach 1.1s, longer than 1s; use clamp=true to cap it"},
+		{"/delay/100ms?jitter=400ms&distribution=normal", "delay 100ms with normal jitter of 400ms may reach 1.3s, longer than 1s; use clamp=true to cap it"},
+		{"/delay/0?jitter=2s&clamp=true", "invalid jitter: duration 2s longer than 1s"},
+		{"/delay/0?jitter=-1ms", "invalid jitter: duration -1ms shorter than 0s"},
+		{"/delay/0?jitter=foo", "invalid jitter: "},
+		{"/delay/0?distribution=pareto", "must be one of uniform, normal, or exponential"},
+		{"/delay/0?jitter=1ms&clamp=maybe", "invalid clamp: "},
+		{"/delay/0?jitter=1ms&seed=abc", "invalid seed: "},
+	} {
+		tc := tc
+		t.Run("bad"+tc.path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", tc.path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+			assertBodyContains(t, w, tc.wantErr)
+		})
+	}
+}
+
+func TestDrip(t *testing.T) {
+	t.Parallel()
+	okTests := []struct {
+		params   *url.Values
+		duration time.Duration
+		numbytes int
+		code     int
+	}{
+		// there are useful defaults for all values
+		{&url.Values{}, 0, 10, http.StatusOK},
+
+		// go-style durations are accepted
+		{&url.Values{"duration": {"5ms"}}, 5 * time.Millisecond, 10, http.StatusOK},
+		{&url.Values{"duration": {"0h"}}, 0, 10, http.StatusOK},
+		{&url.Values{"delay": {"5ms"}}, 5 * time.Millisecond, 10, http.StatusOK},
+		{&url.Values{"delay": {"0h"}}, 0, 10, http.StatusOK},
+
+		// or floating point seconds
+		{&url.Values{"duration": {"0.25"}}, 250 * time.Millisecond, 10, http.StatusOK},
+		{&url.Values{"duration": {"0"}}, 0, 10, http.StatusOK},
+		{&url.Values{"duration": {"1"}}, 1 * time.Second, 10, http.StatusOK},
+		{&url.Values{"delay": {"0.25"}}, 250 * time.Millisecond, 10, http.StatusOK},
+		{&url.Values{"delay": {"0"}}, 0, 10, http.StatusOK},
+
+		{&url.Values{"numbytes": {"1"}}, 0, 1, http.StatusOK},
+		{&url.Values{"numbytes": {"101"}}, 0, 101, http.StatusOK},
+		{&url.Values{"numbytes": {fmt.Sprintf("%d", maxBodySize)}}, 0, int(maxBodySize), http.StatusOK},
+
+		{&url.Values{"code": {"100"}}, 0, 10, 100},
+		{&url.Values{"code": {"404"}}, 0, 10, 404},
+		{&url.Values{"code": {"599"}}, 0, 10, 599},
+		{&url.Values{"code": {"567"}}, 0, 10, 567},
+
+		{&url.Values{"duration": {"250ms"}, "delay": {"250ms"}}, 500 * time.Millisecond, 10, http.StatusOK},
+		{&url.Values{"duration": {"250ms"}, "delay": {"0.25s"}}, 500 * time.Millisecond, 10, http.StatusOK},
+	}
+	for _, test := range okTests {
+		test := test
+		t.Run(fmt.Sprintf("ok/%s", test.params.Encode()), func(t *testing.T) {
+			t.Parallel()
+			url := "/drip?" + test.params.Encode()
+			start := time.Now()
+
+			r, _ := http.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			elapsed := time.Since(start)
+
+			assertStatusCode(t, w, test.code)
+			assertHeader(t, w, "Content-Type", "application/octet-stream")
+			assertHeader(t, w, "Content-Length", strconv.Itoa(test.numbytes))
+			if len(w.Body.Bytes()) != test.numbytes {
+				t.Fatalf("expected %d bytes, got %d", test.numbytes, len(w.Body.Bytes()))
+			}
+
+			if elapsed < test.duration {
+				t.Fatalf("expected minimum duration of %s, request took %s", test.duration, elapsed)
+			}
+		})
+	}
+
+	t.Run("writes are actually incremmental", func(t *testing.T) {
+		t.Parallel()
+
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		var (
+			duration  = 100 * time.Millisecond
+			numBytes  = 3
+			wantDelay = duration / time.Duration(numBytes)
+			wantBytes = []byte{'*'}
+		)
+		resp, err := http.Get(srv.URL + fmt.Sprintf("/drip?duration=%s&delay=%s&numbytes=%d", duration, wantDelay, numBytes))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+
+		// Here we read from the response one byte at a time, and ensure that
+		// at least the expected delay occurs for each read.
+		//
+		// The request above includes an initial delay equal to the expected
+		// wait between writes so that even the first iteration of this loop
+		// expects to wait the same amount of time for a read.
+		buf := make([]byte, 1)
+		for {
+			start := time.Now()
+			n, err := resp.Body.Read(buf)
+			gotDelay := time.Since(start)
+
+			if err == io.EOF {
+				break
+			}
+			assertNil(t, err)
+			assertIntEqual(t, n, 1)
+			if !reflect.DeepEqual(buf, wantBytes) {
+				t.Fatalf("unexpected bytes read: got %v, want %v", buf, wantBytes)
+			}
+
+			if gotDelay < wantDelay {
+				t.Fatalf("to wait at least %s between reads, waited %s", wantDelay, gotDelay)
+			}
+		}
+	})
+
+	t.Run("handle cancelation during initial delay", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		// For this test, we expect the client to time out and cancel the
+		// request after 10ms.  The handler should immediately write a 200 OK
+		// status before the client timeout, preventing a client error, but it
+		// will wait 500ms to write anything to the response body.
+		//
+		// So, we're testing that a) the client got an immediate 200 OK but
+		// that b) the response body was empty.
+		client := http.Client{
+			Timeout: time.Duration(10 * time.Millisecond),
+		}
+		resp, err := client.Get(srv.URL + "/drip?duration=500ms&delay=500ms")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("error reading response body: %s", err)
+		}
+
+		if len(body) != 0 {
+			t.Fatalf("expected client timeout before body was written, got body %q", string(body))
+		}
+	})
+
+	t.Run("delay before headers", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		// With a response header timeout shorter than the delay, the
+		// default behavior gets headers in time but delaying them makes
+		// the client give up.
+		client := http.Client{
+			Transport: &http.Transport{ResponseHeaderTimeout: 100 * time.Millisecond},
+		}
+
+		resp, err := client.Get(srv.URL + "/drip?duration=0&delay=300ms&numbytes=1")
+		if err != nil {
+			t.Fatalf("unexpected error with headers sent before delay: %s", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assertBytesEqual(t, body, []byte("*"))
+
+		resp, err = client.Get(srv.URL + "/drip?duration=0&delay=300ms&numbytes=1&delay_before_headers=true")
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("expected response header timeout, got %d response", resp.StatusCode)
+		}
+		if !strings.Contains(err.Error(), "timeout awaiting response headers") {
+			t.Fatalf("expected response header timeout, got %s", err)
+		}
+	})
+
+	t.Run("delay before headers is bounded by max duration", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/drip?duration=750ms&delay=500ms&delay_before_headers=true", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+	})
+
+	t.Run("handle cancelation before headers", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		r, _ := http.NewRequestWithContext(ctx, "GET", "/drip?duration=0&delay=500ms&delay_before_headers=true", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, 499)
+		assertBodyEquals(t, w, "")
+	})
+
+	t.Run("handle cancelation during drip", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		client := http.Client{
+			Timeout: time.Duration(250 * time.Millisecond),
+		}
+		resp, err := client.Get(srv.URL + "/drip?duration=900ms&delay=100ms")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// in this case, the timeout happens while trying to read the body
+		body, err := io.ReadAll(resp.Body)
+		if err == nil {
+			t.Fatal("expected timeout reading body")
+		}
+
+		// but we should have received a partial response
+		assertBytesEqual(t, body, []byte("**"))
+	})
+
+	badTests := []struct {
+		params *url.Values
+		param  string
+	}{
+		{&url.Values{"duration": {"1m"}}, "duration"},
+		{&url.Values{"duration": {"-1ms"}}, "duration"},
+		{&url.Values{"duration": {"1001"}}, "duration"},
+		{&url.Values{"duration": {"-1"}}, "duration"},
+		{&url.Values{"duration": {"foo"}}, "duration"},
+
+		{&url.Values{"delay": {"1m"}}, "delay"},
+		{&url.Values{"delay": {"-1ms"}}, "delay"},
+		{&url.Values{"delay": {"1001"}}, "delay"},
+		{&url.Values{"delay": {"-1"}}, "delay"},
+		{&url.Values{"delay": {"foo"}}, "delay"},
+
+		{&url.Values{"numbytes": {"foo"}}, "numbytes"},
+		{&url.Values{"numbytes": {"-1"}}, "numbytes"},
+		{&url.Values{"numbytes": {"0xff"}}, "numbytes"},
+		{&url.Values{"numbytes": {fmt.Sprintf("%d", maxBodySize+1)}}, "numbytes"},
+
+		// no bytes to drip over a duration
+		{&url.Values{"numbytes": {"0"}}, "numbytes"},
+		{&url.Values{"numbytes": {"0"}, "duration": {"500ms"}}, "numbytes"},
+
+		{&url.Values{"code": {"foo"}}, "code"},
+		{&url.Values{"code": {"-1"}}, "code"},
+		{&url.Values{"code": {"25"}}, "code"},
+		{&url.Values{"code": {"600"}}, "code"},
+
+		{&url.Values{"delay_before_headers": {"maybe"}}, "delay_before_headers"},
+
+		// request would take too long
+		{&url.Values{"duration": {"750ms"}, "delay": {"500ms"}}, "duration"},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run(fmt.Sprintf("bad/%s", test.params.Encode()), func(t *testing.T) {
+			t.Parallel()
+			url := "/drip?" + test.params.Encode()
+
+			r, _ := http.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, test.param)
+		})
+	}
+
+	t.Run("no bytes and no duration", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/drip?numbytes=0&duration=0&delay=0", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "Content-Length", "0")
+		assertBodyEquals(t, w, "")
+	})
+
+	t.Run("ensure HEAD request works with streaming responses", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		resp, err := http.Head(srv.URL + "/drip?duration=900ms&delay=100ms")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("error reading response body: %s", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected HTTP 200 OK rsponse, got %d", resp.StatusCode)
+		}
+		if bodySize := len(body); bodySize > 0 {
+			t.Fatalf("expected empty body from HEAD request, bot: %s", string(body))
+		}
+	})
+}
+
+func TestRange(t *testing.T) {
+	t.Parallel()
+	t.Run("ok_no_range", func(t *testing.T) {
+		t.Parallel()
+		wantBytes := maxBodySize - 1
+		url := fmt.Sprintf("/range/%d", wantBytes)
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "ETag", fmt.Sprintf("range%d", wantBytes))
+		assertHeader(t, w, "Accept-Ranges", "bytes")
+		assertHeader(t, w, "Content-Length", strconv.Itoa(int(wantBytes)))
+		assertContentType(t, w, "text/plain; charset=utf-8")
+
+		if len(w.Body.String()) != int(wantBytes) {
+			t.Errorf("expected content length %d, got %d", wantBytes, len(w.Body.String()))
+		}
+	})
+
+	t.Run("ok_range", func(t *testing.T) {
+		t.Parallel()
+		url := "/range/100"
+		r, _ := http.NewRequest("GET", url, nil)
+		r.Header.Add("Range", "bytes=10-24")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusPartialContent)
+		assertHeader(t, w, "ETag", "range100")
+		assertHeader(t, w, "Accept-Ranges", "bytes")
+		assertHeader(t, w, "Content-Length", "15")
+		assertHeader(t, w, "Content-Range", "bytes 10-24/100")
+		assertBodyEquals(t, w, "klmnopqrstuvwxy")
+	})
+
+	t.Run("ok_range_first_16_bytes", func(t *testing.T) {
+		t.Parallel()
+		url := "/range/1000"
+		r, _ := http.NewRequest("GET", url, nil)
+		r.Header.Add("Range", "bytes=0-15")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusPartialContent)
+		assertHeader(t, w, "ETag", "range1000")
+		assertHeader(t, w, "Accept-Ranges", "bytes")
+		assertHeader(t, w, "Content-Length", "16")
+		assertHeader(t, w, "Content-Range", "bytes 0-15/1000")
+		assertBodyEquals(t, w, "abcdefghijklmnop")
+	})
+
+	t.Run("ok_range_open_ended_last_6_bytes", func(t *testing.T) {
+		t.Parallel()
+		url := "/range/26"
+		r, _ := http.NewRequest("GET", url, nil)
+		r.Header.Add("Range", "bytes=20-")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusPartialContent)
+		assertHeader(t, w, "ETag", "range26")
+		assertHeader(t, w, "Content-Length", "6")
+		assertHeader(t, w, "Content-Range", "bytes 20-25/26")
+		assertBodyEquals(t, w, "uvwxyz")
+	})
+
+	t.Run("ok_range_suffix", func(t *testing.T) {
+		t.Parallel()
+		url := "/range/26"
+		r, _ := http.NewRequest("GET", url, nil)
+		r.Header.Add("Range", "bytes=-5")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		t.Logf("headers = %v", w.Header())
+		assertStatusCode(t, w, http.StatusPartialContent)
+		assertHeader(t, w, "ETag", "range26")
+		assertHeader(t, w, "Content-Length", "5")
+		assertHeader(t, w, "Content-Range", "bytes 21-25/26")
+		assertBodyEquals(t, w, "vwxyz")
+	})
+
+	t.Run("err_range_out_of_bounds", func(t *testing.T) {
+		t.Parallel()
+		url := "/range/26"
+		r, _ := http.NewRequest("GET", url, nil)
+		r.Header.Add("Range", "bytes=-5")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusPartialContent)
+		assertHeader(t, w, "ETag", "range26")
+		assertHeader(t, w, "Content-Length", "5")
+		assertHeader(t, w, "Content-Range", "bytes 21-25/26")
+		assertBodyEquals(t, w, "vwxyz")
+	})
+
+	multiRangeTests := []struct {
+		url         string
+		rangeHeader string
+		wantParts   []string
+		wantRanges  []string
+	}{
+		{"/range/100", "bytes=0-9,20-29", []string{"abcdefghij", "uvwxyzabcd"}, []string{"bytes 0-9/100", "bytes 20-29/100"}},
+		// descending and overlapping ranges are served as requested
+		{"/range/100", "bytes=20-29, 0-9, 5-14", []string{"uvwxyzabcd", "abcdefghij", "fghijklmno"}, []string{"bytes 20-29/100", "bytes 0-9/100", "bytes 5-14/100"}},
+		// ranges adding up to more than the resource are not merged
+		{"/range/26", "bytes=0-,0-", []string{"abcdefghijklmnopqrstuvwxyz", "abcdefghijklmnopqrstuvwxyz"}, []string{"bytes 0-25/26", "bytes 0-25/26"}},
+		// suffix, open ended and truncated ranges
+		{"/range/26", "bytes=-3,24-,10-99", []string{"xyz", "yz", "klmnopqrstuvwxyz"}, []string{"bytes 23-25/26", "bytes 24-25/26", "bytes 10-25/26"}},
+		// unsatisfiable ranges are dropped
+		{"/range/26", "bytes=0-1,50-60,2-3", []string{"ab", "cd"}, []string{"bytes 0-1/26", "bytes 2-3/26"}},
+	}
+	for _, test := range multiRangeTests {
+		test := test
+		t.Run("ok_multi_range/"+test.rangeHeader, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			r.Header.Add("Range", test.rangeHeader)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, http.StatusPartialContent)
+			assertHeader(t, w, "Accept-Ranges", "bytes")
+			assertHeader(t, w, "Content-Length", strconv.Itoa(w.Body.Len()))
+			if got := w.Header().Get("Content-Range"); got != "" {
+				t.Fatalf("expected no top level Content-Range, got %q", got)
+			}
+
+			mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+			assertNil(t, err)
+			if mediaType != "multipart/byteranges" || params["boundary"] == "" {
+				t.Fatalf("expected multipart/byteranges with a boundary, got %q", w.Header().Get("Content-Type"))
+			}
+			mr := multipart.NewReader(w.Body, params["boundary"])
+			for i := range test.wantParts {
+				part, err := mr.NextPart()
+				assertNil(t, err)
+				if got := part.Header.Get("Content-Range"); got != test.wantRanges[i] {
+					t.Fatalf("part %d: expected Content-Range %q, got %q", i, test.wantRanges[i], got)
+				}
+				if got := part.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+					t.Fatalf("part %d: expected Content-Type text/plain; charset=utf-8, got %q", i, got)
+				}
+				body, err := io.ReadAll(part)
+				assertNil(t, err)
+				if string(body) != test.wantParts[i] {
+					t.Fatalf("part %d: expected body %q, got %q", i, test.wantParts[i], body)
+				}
+			}
+			if _, err := mr.NextPart(); err != io.EOF {
+				t.Fatalf("expected %d parts, got more (err %v)", len(test.wantParts), err)
+			}
+		})
+	}
+
+	t.Run("ok_multi_range_one_satisfiable", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/range/26", nil)
+		r.Header.Add("Range", "bytes=0-4,50-60")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusPartialContent)
+		assertHeader(t, w, "Content-Range", "bytes 0-4/26")
+		assertBodyEquals(t, w, "abcde")
+	})
+
+	unsatisfiableTests := []string{
+		"bytes=26-30",
+		"bytes=30-40,50-60",
+	}
+	for _, rangeHeader := range unsatisfiableTests {
+		rangeHeader := rangeHeader
+		t.Run("err_unsatisfiable/"+rangeHeader, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/range/26", nil)
+			r.Header.Add("Range", rangeHeader)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, http.StatusRequestedRangeNotSatisfiable)
+			assertHeader(t, w, "Content-Range", "bytes */26")
+		})
+	}
+
+	t.Run("ok_multi_range_too_large", func(t *testing.T) {
+		t.Parallel()
+		// the ranges add up to more than maxBodySize, so the Range header
+		// is ignored
+		r, _ := http.NewRequest("GET", "/range/1000", nil)
+		r.Header.Add("Range", "bytes=0-599,0-599")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "Content-Length", "1000")
+	})
+
+	t.Run("ok_multi_range_too_many", func(t *testing.T) {
+		t.Parallel()
+		specs := make([]string, maxByteRanges+1)
+		for i := range specs {
+			specs[i] = "0-0"
+		}
+		r, _ := http.NewRequest("GET", "/range/26", nil)
+		r.Header.Add("Range", "bytes="+strings.Join(specs, ","))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertBodyEquals(t, w, "abcdefghijklmnopqrstuvwxyz")
+	})
+
+	// Note: httpbin rejects these requests with invalid range headers, but the
+	// go stdlib just ignores them.
+	badRangeTests := []struct {
+		url         string
+		rangeHeader string
+	}{
+		{"/range/26", "bytes=10-5"},
+		{"/range/26", "bytes=32-40"},
+		{"/range/26", "bytes=0-40"},
+	}
+	for _, test := range badRangeTests {
+		test := test
+		t.Run(fmt.Sprintf("ok_bad_range_header/%s", test.rangeHeader), func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+			assertBodyEquals(t, w, "abcdefghijklmnopqrstuvwxyz")
+		})
+	}
+
+	badTests := []struct {
+		url   string
+		code  int
+		param string
+	}{
+		{"/range/1/foo", http.StatusNotFound, ""},
+
+		{"/range/", http.StatusBadRequest, "n"},
+		{"/range/foo", http.StatusBadRequest, "n"},
+		{"/range/1.5", http.StatusBadRequest, "n"},
+		{"/range/-1", http.StatusBadRequest, "n"},
+		{"/range/0", http.StatusBadRequest, "n"},
+		{fmt.Sprintf("/range/%d", maxBodySize+1), http.StatusBadRequest, "n"},
+	}
+
+	for _, test := range badTests {
+		test := test
+		t.Run("bad"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.code)
+			if test.param != "" {
+				assertParamError(t, w, test.param)
+			}
+		})
+	}
+}
+
+func TestHTML(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest("GET", "/html", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertContentType(t, w, htmlContentType)
+	assertBodyContains(t, w, `<h1>Herman Melville - Moby-Dick</h1>`)
+}
+
+func TestRobots(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest("GET", "/robots.txt", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertContentType(t, w, "text/plain")
+	assertBodyContains(t, w, `Disallow: /deny`)
+}
+
+func TestDeny(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest("GET", "/deny", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertContentType(t, w, "text/plain")
+	assertBodyContains(t, w, `YOU SHOULDN'T BE HERE`)
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+	t.Run("ok_no_cache", func(t *testing.T) {
+		t.Parallel()
+		url := "/cache"
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+
+		lastModified := w.Header().Get("Last-Modified")
+		if lastModified == "" {
+			t.Fatalf("did get Last-Modified header")
+		}
+
+		etag := w.Header().Get("ETag")
+		if etag != sha1hash(lastModified) {
+			t.Fatalf("expected ETag header %v, got %v", sha1hash(lastModified), etag)
+		}
+
+		var resp *noBodyResponse
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+		}
+	})
+
+	tests := []struct {
+		headerKey string
+		headerVal string
+	}{
+		{"If-None-Match", "my-custom-etag"},
+		{"If-Modified-Since", "my-custom-date"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(fmt.Sprintf("ok_cache/%s", test.headerKey), func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/cache", nil)
+			r.Header.Add(test.headerKey, test.headerVal)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotModified)
+		})
+	}
+}
+
+func TestCacheLastModified(t *testing.T) {
+	t.Parallel()
+
+	const lastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
+	lastModifiedUnix := strconv.FormatInt(time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC).Unix(), 10)
+	etag := `"` + sha1hash(lastModified) + `"`
+
+	tests := []struct {
+		name       string
+		param      string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"no_conditions", lastModified, nil, http.StatusOK},
+		{"no_conditions_unix", lastModifiedUnix, nil, http.StatusOK},
+
+		{"ims_equal", lastModified, map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"ims_equal_unix", lastModifiedUnix, map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"ims_newer", lastModified, map[string]string{"If-Modified-Since": "Wed, 21 Oct 2015 07:28:01 GMT"}, http.StatusNotModified},
+		{"ims_older", lastModified, map[string]string{"If-Modified-Since": "Wed, 21 Oct 2015 07:27:59 GMT"}, http.StatusOK},
+		{"ims_rfc850", lastModified, map[string]string{"If-Modified-Since": "Wednesday, 21-Oct-15 07:28:00 GMT"}, http.StatusNotModified},
+		{"ims_asctime", lastModified, map[string]string{"If-Modified-Since": "Wed Oct 21 07:28:00 2015"}, http.StatusNotModified},
+
+		// malformed dates are ignored
+		{"ims_malformed", lastModified, map[string]string{"If-Modified-Since": "my-custom-date"}, http.StatusOK},
+		{"ims_empty", lastModified, map[string]string{"If-Modified-Since": ""}, http.StatusOK},
+		{"ims_unix", lastModified, map[string]string{"If-Modified-Since": lastModifiedUnix}, http.StatusOK},
+
+		// If-None-Match takes precedence over If-Modified-Since
+		{"inm_match", lastModified, map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"inm_match_weak", lastModified, map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified},
+		{"inm_match_list", lastModified, map[string]string{"If-None-Match": `"other", ` + etag}, http.StatusNotModified},
+		{"inm_star", lastModified, map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"inm_no_match", lastModified, map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"inm_unquoted", lastModified, map[string]string{"If-None-Match": sha1hash(lastModified)}, http.StatusOK},
+		{"inm_no_match_ims_newer", lastModified, map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Thu, 22 Oct 2015 00:00:00 GMT"}, http.StatusOK},
+		{"inm_match_ims_older", lastModified, map[string]string{"If-None-Match": etag, "If-Modified-Since": "Tue, 20 Oct 2015 00:00:00 GMT"}, http.StatusNotModified},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/cache?last_modified="+url.QueryEscape(test.param), nil)
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, test.wantStatus)
+			assertHeader(t, w, "Last-Modified", lastModified)
+			assertHeader(t, w, "ETag", etag)
+			if test.wantStatus == http.StatusNotModified {
+				assertBodyEquals(t, w, "")
+			} else {
+				assertContentType(t, w, jsonContentType)
+			}
+		})
+	}
+
+	t.Run("ims_ignored_for_post", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("POST", "/cache?last_modified="+lastModifiedUnix, nil)
+		r.Header.Set("If-Modified-Since", lastModified)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+	})
+
+	for _, param := range []string{"yesterday", "2015-10-21", "1.5"} {
+		param := param
+		t.Run("bad_last_modified/"+param, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/cache?last_modified="+url.QueryEscape(param), nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, "last_modified")
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	t.Parallel()
+	t.Run("ok_cache_control", func(t *testing.T) {
+		t.Parallel()
+		url := "/cache/60"
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		assertHeader(t, w, "Cache-Control", "public, max-age=60")
+	})
+
+	badTests := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{"/cache/60/foo", http.StatusNotFound},
+		{"/cache/foo", http.StatusBadRequest},
+		{"/cache/3.14", http.StatusBadRequest},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run("bad"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.expectedStatus)
+		})
+	}
+}
+
+func TestETag(t *testing.T) {
+	t.Parallel()
+	t.Run("ok_no_headers", func(t *testing.T) {
+		t.Parallel()
+		url := "/etag/abc"
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "ETag", `"abc"`)
+	})
+
+	tests := []struct {
+		name           string
+		etag           string
+		headerKey      string
+		headerVal      string
+		expectedStatus int
+	}{
+		{"if_none_match_matches", "abc", "If-None-Match", `"abc"`, http.StatusNotModified},
+		{"if_none_match_matches_list", "abc", "If-None-Match", `"123", "abc"`, http.StatusNotModified},
+		{"if_none_match_matches_star", "abc", "If-None-Match", "*", http.StatusNotModified},
+		{"if_none_match_matches_w_prefix", "c3piozzzz", "If-None-Match", `W/"xyzzy", W/"r2d2xxxx", W/"c3piozzzz"`, http.StatusNotModified},
+		{"if_none_match_has_no_match", "abc", "If-None-Match", `"123"`, http.StatusOK},
+
+		{"if_match_matches", "abc", "If-Match", `"abc"`, http.StatusOK},
+		{"if_match_matches_list", "abc", "If-Match", `"123", "abc"`, http.StatusOK},
+		{"if_match_matches_star", "abc", "If-Match", "*", http.StatusOK},
+		{"if_match_has_no_match", "abc", "If-Match", `"xxxxxx"`, http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run("ok_"+test.name, func(t *testing.T) {
+			t.Parallel()
+			url := "/etag/" + test.etag
+			r, _ := http.NewRequest("GET", url, nil)
+			r.Header.Add(test.headerKey, test.headerVal)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.expectedStatus)
+		})
+	}
+
+	t.Run("ok_weak", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/etag/abc?weak=true", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "ETag", `W/"abc"`)
+	})
+
+	// The examples of RFC 7232 section 2.3.2, plus lists, wildcards and
+	// quoted tags containing commas
+	preconditionTests := []struct {
+		name        string
+		url         string
+		method      string
+		ifMatch     string
+		ifNoneMatch string
+		want        int
+	}{
+		// W/"1" vs W/"1": no strong match, weak match
+		{"rfc_weak_weak/if_match", "/etag/1?weak=true", "GET", `W/"1"`, "", http.StatusPreconditionFailed},
+		{"rfc_weak_weak/if_none_match", "/etag/1?weak=true", "GET", "", `W/"1"`, http.StatusNotModified},
+		// W/"1" vs W/"2": no strong match, no weak match
+		{"rfc_weak_weak_differ/if_match", "/etag/2?weak=true", "GET", `W/"1"`, "", http.StatusPreconditionFailed},
+		{"rfc_weak_weak_differ/if_none_match", "/etag/2?weak=true", "GET", "", `W/"1"`, http.StatusOK},
+		// W/"1" vs "1": no strong match, weak match
+		{"rfc_weak_strong/if_match", "/etag/1", "GET", `W/"1"`, "", http.StatusPreconditionFailed},
+		{"rfc_weak_strong/if_none_match", "/etag/1", "GET", "", `W/"1"`, http.StatusNotModified},
+		{"rfc_strong_weak/if_match", "/etag/1?weak=true", "GET", `"1"`, "", http.StatusPreconditionFailed},
+		{"rfc_strong_weak/if_none_match", "/etag/1?weak=true", "GET", "", `"1"`, http.StatusNotModified},
+		// "1" vs "1": strong match, weak match
+		{"rfc_strong_strong/if_match", "/etag/1", "GET", `"1"`, "", http.StatusOK},
+		{"rfc_strong_strong/if_none_match", "/etag/1", "GET", "", `"1"`, http.StatusNotModified},
+
+		{"list/if_match", "/etag/c3pio", "GET", `"xyzzy", "r2d2xxxx", "c3pio"`, "", http.StatusOK},
+		{"list_no_space/if_match", "/etag/c3pio", "GET", `"xyzzy","c3pio"`, "", http.StatusOK},
+		{"list_no_match/if_match", "/etag/c3pio", "GET", `"xyzzy", "r2d2xxxx"`, "", http.StatusPreconditionFailed},
+		{"list_weak/if_none_match", "/etag/c3pio", "GET", "", `W/"xyzzy", W/"c3pio"`, http.StatusNotModified},
+		{"star/if_match_weak", "/etag/abc?weak=true", "GET", "*", "", http.StatusOK},
+		{"star/if_none_match_weak", "/etag/abc?weak=true", "GET", "", "*", http.StatusNotModified},
+
+		// commas inside quotes are part of the tag, not separators
+		{"comma/if_match", "/etag/a,b", "GET", `"a,b"`, "", http.StatusOK},
+		{"comma_other/if_match", "/etag/a", "GET", `"a,b"`, "", http.StatusPreconditionFailed},
+		{"comma_list/if_none_match", "/etag/b", "GET", "", `"a,b", "c"`, http.StatusOK},
+		{"comma_list_match/if_none_match", "/etag/c", "GET", "", `"a,b", "c"`, http.StatusNotModified},
+		{"comma_weak/if_none_match", "/etag/x,y", "GET", "", `W/"x,y"`, http.StatusNotModified},
+
+		// malformed elements end the list
+		{"malformed/if_none_match", "/etag/abc", "GET", "", `abc`, http.StatusOK},
+		{"malformed_then_match/if_none_match", "/etag/abc", "GET", "", `"x", bogus, "abc"`, http.StatusOK},
+
+		// If-None-Match fails with 412 for methods other than GET and HEAD
+		{"if_none_match_head", "/etag/abc", "HEAD", "", `"abc"`, http.StatusNotModified},
+		{"if_none_match_post", "/etag/abc", "POST", "", `"abc"`, http.StatusPreconditionFailed},
+
+		// If-Match is evaluated first
+		{"both/if_match_fails", "/etag/abc", "GET", `"xyz"`, `"abc"`, http.StatusPreconditionFailed},
+		{"both/if_match_passes_not_modified", "/etag/abc", "GET", `"abc"`, `"abc"`, http.StatusNotModified},
+		{"both/pass", "/etag/abc", "GET", `"abc"`, `"xyz"`, http.StatusOK},
+		{"both/weak_if_match_fails", "/etag/abc?weak=true", "GET", `W/"abc"`, `"xyz"`, http.StatusPreconditionFailed},
+	}
+	for _, test := range preconditionTests {
+		test := test
+		t.Run("preconditions/"+test.name, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest(test.method, test.url, nil)
+			if test.ifMatch != "" {
+				r.Header.Set("If-Match", test.ifMatch)
+			}
+			if test.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", test.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.want)
+			if w.Header().Get("ETag") == "" {
+				t.Fatalf("expected ETag header in %d response", w.Code)
+			}
+		})
+	}
+
+	t.Run("if_none_match_overrides_if_modified_since", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/etag/abc", nil)
+		r.Header.Set("If-None-Match", `"xyz"`)
+		r.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+	})
+
+	badTests := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{"/etag/foo/bar", http.StatusNotFound},
+		{"/etag/foo?weak=maybe", http.StatusBadRequest},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run(fmt.Sprintf("bad/%s", test.url), func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.expectedStatus)
+		})
+	}
+}
+
+func TestBytes(t *testing.T) {
+	t.Parallel()
+	t.Run("ok_no_seed", func(t *testing.T) {
+		t.Parallel()
+		url := "/bytes/1024"
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, "application/octet-stream")
+		if len(w.Body.String()) != 1024 {
+			t.Errorf("expected content length 1024, got %d", len(w.Body.String()))
+		}
+	})
+
+	t.Run("ok_seed", func(t *testing.T) {
+		t.Parallel()
+		url := "/bytes/16?seed=1234567890"
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, "application/octet-stream")
+
+		bodyHex := fmt.Sprintf("%x", w.Body.Bytes())
+		wantHex := "bfcd2afa15a2b372c707985a22024a8e"
+		if bodyHex != wantHex {
+			t.Errorf("expected body in hexadecimal = %v, got %v", wantHex, bodyHex)
+		}
+	})
+
+	t.Run("ok_seed_header", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/bytes/16", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "X-Httpbin-Pattern", "random")
+		seed := w.Header().Get("X-Httpbin-Seed")
+		if seed == "" {
+			t.Fatalf("expected X-Httpbin-Seed header")
+		}
+
+		// the reported seed reproduces the same bytes
+		r, _ = http.NewRequest("GET", "/bytes/16?seed="+seed, nil)
+		w2 := httptest.NewRecorder()
+		app.ServeHTTP(w2, r)
+		assertHeader(t, w2, "X-Httpbin-Seed", seed)
+		assertBytesEqual(t, w2.Body.Bytes(), w.Body.Bytes())
+	})
+
+	patternTests := []struct {
+		url  string
+		want []byte
+	}{
+		{"/bytes/16?pattern=random&seed=1234567890", []byte("\xbf\xcd\x2a\xfa\x15\xa2\xb3\x72\xc7\x07\x98\x5a\x22\x02\x4a\x8e")},
+		{"/bytes/8?pattern=zero", make([]byte, 8)},
+		{"/bytes/30?pattern=text", []byte("Lorem ipsum dolor sit amet, co")},
+		{"/bytes/129?pattern=text", []byte(bytesPatternLorem + "Lorem")},
+		{"/bytes/4?pattern=cycle", []byte{0, 1, 2, 3}},
+	}
+	for _, test := range patternTests {
+		test := test
+		t.Run("ok_pattern"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, "application/octet-stream")
+			assertHeader(t, w, "X-Httpbin-Pattern", r.URL.Query().Get("pattern"))
+			assertHeader(t, w, "Content-Length", strconv.Itoa(len(test.want)))
+			assertBytesEqual(t, w.Body.Bytes(), test.want)
+		})
+	}
+
+	t.Run("ok_pattern_cycle_wraps", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/bytes/600?pattern=cycle", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "X-Httpbin-Seed", "")
+		body := w.Body.Bytes()
+		if len(body) != 600 {
+			t.Fatalf("expected 600 bytes, got %d", len(body))
+		}
+		for i, b := range body {
+			if b != byte(i%256) {
+				t.Fatalf("expected byte %d to be %#x, got %#x", i, i%256, b)
+			}
+		}
+	})
+
+	edgeCaseTests := []struct {
+		url                   string
+		expectedContentLength int
+	}{
+		{"/bytes/0", 0},
+		{"/bytes/1", 1},
+		{"/bytes/99999999", 100 * 1024},
+
+		// negative seed allowed
+		{"/bytes/16?seed=-12345", 16},
+
+		{"/bytes/99999999?pattern=zero", 100 * 1024},
+		{"/bytes/1000?pattern=text", 1000},
+		{"/bytes/1000?pattern=cycle&seed=1", 1000},
+	}
+	for _, test := range edgeCaseTests {
+		test := test
+		t.Run("edge"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+			assertHeader(t, w, "Content-Length", fmt.Sprintf("%d", test.expectedContentLength))
+			if len(w.Body.Bytes()) != test.expectedContentLength {
+				t.Errorf("expected body of length %d, got %d", test.expectedContentLength, len(w.Body.Bytes()))
+			}
+		})
+	}
+
+	badTests := []struct {
+		url            string
+		expectedStatus int
+		param          string
+	}{
+		{"/bytes/-1", http.StatusBadRequest, "n"},
+
+		{"/bytes", http.StatusNotFound, ""},
+		{"/bytes/16/foo", http.StatusNotFound, ""},
+
+		{"/bytes/foo", http.StatusBadRequest, "n"},
+		{"/bytes/3.14", http.StatusBadRequest, "n"},
+
+		{"/bytes/16?seed=12345678901234567890", http.StatusBadRequest, "seed"}, // seed too big
+		{"/bytes/16?seed=foo", http.StatusBadRequest, "seed"},
+		{"/bytes/16?seed=3.14", http.StatusBadRequest, "seed"},
+
+		{"/bytes/16?pattern=ones", http.StatusBadRequest, "pattern"},
+		{"/bytes/16?pattern=ZERO", http.StatusBadRequest, "pattern"},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run("bad"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.expectedStatus)
+			if test.param != "" {
+				assertParamError(t, w, test.param)
+			}
+		})
+	}
+}
+
+func TestStreamBytes(t *testing.T) {
+	t.Parallel()
+	okTests := []struct {
+		url                   string
+		expectedContentLength int
+	}{
+		{"/stream-bytes/256", 256},
+		{"/stream-bytes/256?chunk_size=1", 256},
+		{"/stream-bytes/256?chunk_size=256", 256},
+		{"/stream-bytes/256?chunk_size=7", 256},
+
+		// too-large chunk size is okay
+		{"/stream-bytes/256?chunk_size=512", 256},
+
+		// as is negative chunk size
+		{"/stream-bytes/256?chunk_size=-10", 256},
+	}
+	for _, test := range okTests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(app)
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + test.url)
+			assertNil(t, err)
+			defer resp.Body.Close()
+
+			if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+				t.Fatalf("expected Transfer-Encoding: chunked, got %#v", resp.TransferEncoding)
+			}
+
+			// Expect empty content-length due to streaming response
+			assertHeader(t, resp, "Content-Length", "")
+
+			body, err := io.ReadAll(resp.Body)
+			assertNil(t, err)
+			if len(body) != test.expectedContentLength {
+				t.Fatalf("expected body of length %d, got %d", test.expectedContentLength, len(body))
+			}
+		})
+	}
+
+	patternTests := []struct {
+		url  string
+		want []byte
+	}{
+		{"/stream-bytes/8?pattern=zero&chunk_size=3", make([]byte, 8)},
+		{"/stream-bytes/11?pattern=text&chunk_size=4", []byte("Lorem ipsum")},
+		{"/stream-bytes/300?pattern=cycle&chunk_size=100", append(bytesCycle(256), bytesCycle(44)...)},
+	}
+	for _, test := range patternTests {
+		test := test
+		t.Run("ok_pattern"+test.url, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(app)
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL + test.url)
+			assertNil(t, err)
+			defer resp.Body.Close()
+
+			assertHeader(t, resp, "X-Httpbin-Pattern", resp.Request.URL.Query().Get("pattern"))
+			body, err := io.ReadAll(resp.Body)
+			assertNil(t, err)
+			assertBytesEqual(t, body, test.want)
+		})
+	}
+
+	badTests := []struct {
+		url   string
+		code  int
+		param string
+	}{
+		{"/stream-bytes", http.StatusNotFound, ""},
+		{"/stream-bytes/10/foo", http.StatusNotFound, ""},
+
+		{"/stream-bytes/foo", http.StatusBadRequest, "n"},
+		{"/stream-bytes/3.1415", http.StatusBadRequest, "n"},
+		{"/stream-bytes/-1", http.StatusBadRequest, "n"},
+
+		{"/stream-bytes/16?chunk_size=foo", http.StatusBadRequest, "chunk_size"},
+		{"/stream-bytes/16?chunk_size=3.14", http.StatusBadRequest, "chunk_size"},
+
+		{"/stream-bytes/16?seed=foo", http.StatusBadRequest, "seed"},
+		{"/stream-bytes/16?pattern=foo", http.StatusBadRequest, "pattern"},
+
+		{"/stream-bytes/16?delay=foo", http.StatusBadRequest, "delay"},
+		{"/stream-bytes/16?delay=-1s", http.StatusBadRequest, "delay"},
+		{"/stream-bytes/16?delay=2s", http.StatusBadRequest, "delay"},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run("bad"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.code)
+			if test.param != "" {
+				assertParamError(t, w, test.param)
+			}
+		})
+	}
+}
+
+func TestStreamBytesDelay(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ok_delay_between_chunks", func(t *testing.T) {
+		t.Parallel()
+
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		start := time.Now()
+		resp, err := http.Get(srv.URL + "/stream-bytes/50?chunk_size=10&delay=100ms")
+		assertNil(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assertNil(t, err)
+		elapsed := time.Since(start)
+
+		if len(body) != 50 {
+			t.Fatalf("expected body of length 50, got %d", len(body))
+		}
+		// 5 chunks means 4 delays
+		if elapsed < 400*time.Millisecond {
+			t.Fatalf("expected response to take at least 400ms, took %s", elapsed)
+		}
+		assertHeader(t, resp, "X-Httpbin-Chunk-Delay", "100ms")
+		assertHeader(t, resp, "X-Httpbin-Delay-Clamped", "")
+	})
+
+	t.Run("ok_float_seconds", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/stream-bytes/2?chunk_size=1&delay=0.05", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "X-Httpbin-Chunk-Delay", "50ms")
+	})
+
+	t.Run("ok_delay_clamped", func(t *testing.T) {
+		t.Parallel()
+		// 9 delays of 500ms would exceed maxDuration
+		start := time.Now()
+		r, _ := http.NewRequest("GET", "/stream-bytes/10?chunk_size=1&delay=500ms", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		elapsed := time.Since(start)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "X-Httpbin-Delay-Clamped", "true")
+		assertHeader(t, w, "X-Httpbin-Chunk-Delay", (maxDuration / 9).String())
+		if elapsed > maxDuration+500*time.Millisecond {
+			t.Fatalf("expected clamped response to take about %s, took %s", maxDuration, elapsed)
+		}
+		if w.Body.Len() != 10 {
+			t.Fatalf("expected body of length 10, got %d", w.Body.Len())
+		}
+	})
+
+	t.Run("ok_single_chunk_not_clamped", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/stream-bytes/10?chunk_size=-1&delay=1s", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "X-Httpbin-Delay-Clamped", "")
+	})
+
+	t.Run("cancel_stops_writes", func(t *testing.T) {
+		t.Parallel()
+
+		var handled time.Time
+		done := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			app.ServeHTTP(w, r)
+			handled = time.Now()
+			close(done)
+		}))
+		defer srv.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/stream-bytes/3?chunk_size=1&delay=500ms", nil)
+		resp, err := http.DefaultClient.Do(req)
+		assertNil(t, err)
+		defer resp.Body.Close()
+
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(resp.Body, buf)
+		assertNil(t, err)
+		canceled := time.Now()
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(maxDuration):
+			t.Fatalf("handler still writing %s after client canceled", maxDuration)
+		}
+		if elapsed := handled.Sub(canceled); elapsed > 250*time.Millisecond {
+			t.Fatalf("expected handler to stop promptly after cancellation, took %s", elapsed)
+		}
+	})
+}
+
+// bytesCycle returns the first n bytes of the cycle pattern of /bytes.
+func bytesCycle(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestLinks(t *testing.T) {
+	t.Parallel()
+	redirectTests := []struct {
+		url              string
+		expectedLocation string
+	}{
+		{"/links/1", "/links/1/0"},
+		{"/links/100", "/links/100/0"},
+	}
+
+	for _, test := range redirectTests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, http.StatusFound)
+			assertHeader(t, w, "Location", test.expectedLocation)
+		})
+	}
+
+	errorTests := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{"/links/10/1/foo", http.StatusNotFound},
+
+		// invalid N
+		{"/links/3.14", http.StatusBadRequest},
+		{"/links/-1", http.StatusBadRequest},
+		{"/links/257", http.StatusBadRequest},
+
+		// invalid offset
+		{"/links/1/3.14", http.StatusBadRequest},
+		{"/links/1/foo", http.StatusBadRequest},
+	}
+
+	for _, test := range errorTests {
+		test := test
+		t.Run("error"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, test.expectedStatus)
+		})
+	}
+
+	linksPageTests := []struct {
+		url             string
+		expectedContent string
+	}{
+		{"/links/2/0", `<html><head><title>Links</title></head><body>0 <a href="/links/2/1">1</a> </body></html>`},
+		{"/links/2/1", `<html><head><title>Links</title></head><body><a href="/links/2/0">0</a> 1 </body></html>`},
+
+		// offsets too large and too small are ignored
+		{"/links/2/2", `<html><head><title>Links</title></head><body><a href="/links/2/0">0</a> <a href="/links/2/1">1</a> </body></html>`},
+		{"/links/2/10", `<html><head><title>Links</title></head><body><a href="/links/2/0">0</a> <a href="/links/2/1">1</a> </body></html>`},
+		{"/links/2/-1", `<html><head><title>Links</title></head><body><a href="/links/2/0">0</a> <a href="/links/2/1">1</a> </body></html>`},
+	}
+	for _, test := range linksPageTests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, htmlContentType)
+			assertBodyEquals(t, w, test.expectedContent)
+		})
+	}
+}
+
+func TestImage(t *testing.T) {
+	t.Parallel()
+	acceptTests := []struct {
+		acceptHeader        string
+		expectedContentType string
+		expectedStatus      int
+	}{
+		{"", "image/png", http.StatusOK},
+		{"image/*", "image/png", http.StatusOK},
+		{"image/png", "image/png", http.StatusOK},
+		{"image/jpeg", "image/jpeg", http.StatusOK},
+		{"image/webp", "image/webp", http.StatusOK},
+		{"image/svg+xml", "image/svg+xml", http.StatusOK},
+		{"image/avif", "image/avif", http.StatusOK},
+		{"*/*", "image/png", http.StatusOK},
+		{"IMAGE/WEBP", "image/webp", http.StatusOK},
+
+		// q-values decide between acceptable types
+		{"image/png;q=0.5, image/webp", "image/webp", http.StatusOK},
+		{"image/jpeg;q=0.9, image/avif;q=0.8", "image/jpeg", http.StatusOK},
+		{"image/webp;q=0.4, image/avif;q=0.7, image/png;q=0.1", "image/avif", http.StatusOK},
+		{"image/*;q=0.5, image/jpeg", "image/jpeg", http.StatusOK},
+		{"image/*, image/png;q=0", "image/avif", http.StatusOK},
+		{"*/*;q=0.1, image/svg+xml;q=0.2", "image/svg+xml", http.StatusOK},
+		{"text/html, image/webp;q=0.3", "image/webp", http.StatusOK},
+
+		// specific ranges beat wildcards of equal quality, then server
+		// preference breaks ties
+		{"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "image/avif", http.StatusOK},
+		{"image/webp, image/avif", "image/avif", http.StatusOK},
+		{"image/jpeg, image/*", "image/jpeg", http.StatusOK},
+
+		// malformed q-values are ignored
+		{"image/webp;q=2, image/jpeg", "image/jpeg", http.StatusOK},
+		{"image/webp;q=abc", "", http.StatusUnsupportedMediaType},
+
+		{"image/raw", "", http.StatusUnsupportedMediaType},
+		{"image/jpg", "", http.StatusUnsupportedMediaType},
+		{"image/svg", "", http.StatusUnsupportedMediaType},
+		{"text/html", "", http.StatusUnsupportedMediaType},
+		{"image/*;q=0", "", http.StatusUnsupportedMediaType},
+		{"*/*;q=0", "", http.StatusUnsupportedMediaType},
+	}
+
+	for _, test := range acceptTests {
+		test := test
+		t.Run("ok/accept="+test.acceptHeader, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/image", nil)
+			r.Header.Set("Accept", test.acceptHeader)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, test.expectedStatus)
+			assertHeader(t, w, "Vary", "Accept")
+			if test.expectedContentType != "" {
+				assertContentType(t, w, test.expectedContentType)
+			}
+		})
+	}
+
+	t.Run("ok/avif", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/image/avif", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, "image/avif")
+		if body := w.Body.Bytes(); len(body) < 12 || string(body[4:12]) != "ftypavif" {
+			t.Fatalf("expected AVIF file type box, got %q", body)
+		}
+	})
+
+	imageTests := []struct {
+		url            string
+		expectedStatus int
+	}{
+		{"/image/png", http.StatusOK},
+		{"/image/jpeg", http.StatusOK},
+		{"/image/webp", http.StatusOK},
+		{"/image/svg", http.StatusOK},
+		{"/image/avif", http.StatusOK},
+
+		{"/image/raw", http.StatusNotFound},
+		{"/image/jpg", http.StatusNotFound},
+		{"/image/png/foo", http.StatusNotFound},
+	}
+
+	for _, test := range imageTests {
+		test := test
+		t.Run("error"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.expectedStatus)
+		})
+	}
+}
+
+func TestGeneratedImage(t *testing.T) {
+	t.Parallel()
+
+	app := New(WithMaxBodySize(1024 * 1024))
+
+	okTests := []struct {
+		url           string
+		contentType   string
+		decode        func(io.Reader) (image.Image, error)
+		width, height int
+	}{
+		{"/image/png?width=800&height=600", "image/png", png.Decode, 800, 600},
+		{"/image/jpeg?width=800&height=600", "image/jpeg", jpeg.Decode, 800, 600},
+		{"/image/png?width=4096&height=1", "image/png", png.Decode, 4096, 1},
+		{"/image/png?width=10", "image/png", png.Decode, 10, 256},
+		{"/image/jpeg?height=10", "image/jpeg", jpeg.Decode, 256, 10},
+	}
+	for _, test := range okTests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, test.contentType)
+			assertHeader(t, w, "Content-Length", strconv.Itoa(w.Body.Len()))
+			img, err := test.decode(w.Body)
+			assertNil(t, err)
+			if got, want := img.Bounds(), image.Rect(0, 0, test.width, test.height); got != want {
+				t.Fatalf("expected image bounds %v, got %v", want, got)
+			}
+		})
+	}
+
+	t.Run("ok/deterministic", func(t *testing.T) {
+		t.Parallel()
+		var bodies [][]byte
+		for i := 0; i < 2; i++ {
+			r, _ := http.NewRequest("GET", "/image/png?width=64&height=48", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+			bodies = append(bodies, w.Body.Bytes())
+		}
+		assertBytesEqual(t, bodies[0], bodies[1])
+	})
+
+	errorTests := []struct {
+		url   string
+		param string
+	}{
+		{"/image/png?width=0&height=10", "width"},
+		{"/image/png?width=4097&height=10", "width"},
+		{"/image/png?width=abc", "width"},
+		{"/image/jpeg?width=10&height=-1", "height"},
+		{"/image/jpeg?width=10&height=5000", "height"},
+		{"/image/png?width=2048&height=1024", "height"},
+		{"/image/svg?width=10&height=10", "format"},
+		{"/image/webp?width=10&height=10", "format"},
+	}
+	for _, test := range errorTests {
+		test := test
+		t.Run("error"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, test.param)
+		})
+	}
+}
+
+func TestXML(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest("GET", "/xml", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertContentType(t, w, "application/xml")
+	assertBodyContains(t, w, `<?xml version='1.0' encoding='us-ascii'?>`)
+}
+
+func isValidUUIDv4(uuid string) error {
+	if len(uuid) != 36 {
+		return fmt.Errorf("uuid length: %d != 36", len(uuid))
+	}
+	r := regexp.MustCompile("^[a-f0-9]{8}-[a-f0-9]{4}-4[a-f0-9]{3}-[8|9|a|b][a-f0-9]{3}-[a-f0-9]{12}$")
+	if !r.MatchString(uuid) {
+		return errors.New("Failed to match against uuidv4 regex")
+	}
+	return nil
+}
+
+func TestUUID(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest("GET", "/uuid", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertStatusCode(t, w, http.StatusOK)
+
+	// Test response unmarshalling
+	var resp *uuidResponse
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+	}
+
+	// Test if the value is an actual UUID
+	if err := isValidUUIDv4(resp.UUID); err != nil {
+		t.Fatalf("Invalid uuid %s: %s", resp.UUID, err)
+	}
+}
+
+func TestUUIDVersionsAndCount(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, time.March, 1, 12, 30, 45, 123456700, time.UTC)
+	app := New()
+	app.now = func() time.Time { return now }
+
+	uuidPattern := regexp.MustCompile("^[a-f0-9]{8}-[a-f0-9]{4}-([a-f0-9])[a-f0-9]{3}-[89ab][a-f0-9]{3}-[a-f0-9]{12}$")
+	parseUUID := func(t *testing.T, s string, version string) []byte {
+		t.Helper()
+		m := uuidPattern.FindStringSubmatch(s)
+		if m == nil || m[1] != version {
+			t.Fatalf("expected a version %s UUID, got %q", version, s)
+		}
+		b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+		assertNil(t, err)
+		return b
+	}
+
+	get := func(t *testing.T, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("single", func(t *testing.T) {
+		t.Parallel()
+		for _, version := range []string{"1", "4", "7"} {
+			w := get(t, "/uuid?version="+version)
+			assertStatusCode(t, w, http.StatusOK)
+			var resp uuidResponse
+			assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			b := parseUUID(t, resp.UUID, version)
+
+			switch version {
+			case "1":
+				ts := uint64(binary.BigEndian.Uint32(b[0:4])) |
+					uint64(binary.BigEndian.Uint16(b[4:6]))<<32 |
+					uint64(binary.BigEndian.Uint16(b[6:8])&0x0fff)<<48
+				if got := time.Unix(0, int64(ts-uuidEpochOffset)*100); !got.Equal(now) {
+					t.Fatalf("expected v1 timestamp %s, got %s", now, got)
+				}
+			case "7":
+				ms := uint64(binary.BigEndian.Uint16(b[0:2]))<<32 | uint64(binary.BigEndian.Uint32(b[2:6]))
+				if want := uint64(now.UnixNano() / int64(time.Millisecond)); ms != want {
+					t.Fatalf("expected v7 timestamp %d, got %d", want, ms)
+				}
+			}
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		t.Parallel()
+		for _, version := range []string{"1", "4", "7"} {
+			w := get(t, "/uuid?count=50&version="+version)
+			assertStatusCode(t, w, http.StatusOK)
+			var resp uuidsResponse
+			assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assertIntEqual(t, len(resp.UUIDs), 50)
+			seen := make(map[string]bool, len(resp.UUIDs))
+			for _, u := range resp.UUIDs {
+				parseUUID(t, u, version)
+				if seen[u] {
+					t.Fatalf("duplicate UUID %s", u)
+				}
+				seen[u] = true
+			}
+			if version == "7" && !sort.StringsAreSorted(resp.UUIDs) {
+				t.Fatalf("expected v7 UUIDs in sort order, got %v", resp.UUIDs)
+			}
+		}
+
+		w := get(t, fmt.Sprintf("/uuid?count=%d", maxUUIDCount))
+		assertStatusCode(t, w, http.StatusOK)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		for path, param := range map[string]string{
+			"/uuid?version=3":    "version",
+			"/uuid?version=v4":   "version",
+			"/uuid?count=0":      "count",
+			"/uuid?count=1001":   "count",
+			"/uuid?count=":       "count",
+			"/uuid?count=banana": "count",
+		} {
+			w := get(t, path)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertParamError(t, w, param)
+		}
+	})
+}
+
+func TestBase64(t *testing.T) {
+	t.Parallel()
+	okTests := []struct {
+		requestURL string
+		want       string
+	}{
+		{
+			"/base64/dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n",
+			"valid_base64_encoded_string",
+		},
+		{
+			"/base64/decode/dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n",
+			"valid_base64_encoded_string",
+		},
+		{
+			"/base64/encode/valid_base64_encoded_string",
+			"dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n",
+		},
+		{
+			// make sure we correctly handle padding
+			// https://github.com/mccutchen/go-httpbin/issues/118
+			"/base64/dGVzdC1pbWFnZQ==",
+			"test-image",
+		},
+		{
+			// URL-safe base64 is used for decoding (note the - instead of + in
+			// encoded input string)
+			"/base64/decode/YWJjMTIzIT8kKiYoKSctPUB-",
+			"abc123!?$*&()'-=@~",
+		},
+		{
+			// URL-safe base64 is used for encoding (note the - instead of + in
+			// encoded output string)
+			"/base64/encode/abc123%21%3F%24%2A%26%28%29%27-%3D%40~",
+			"YWJjMTIzIT8kKiYoKSctPUB-",
+		},
+		{
+			// standard base64 is accepted too (note the + instead of - in
+			// encoded input string)
+			"/base64/decode/YWJjMTIzIT8kKiYoKSctPUB+",
+			"abc123!?$*&()'-=@~",
+		},
+		{
+			// standard base64 may contain slashes, which requires the
+			// explicit decode subpath
+			"/base64/decode/Pz8/Pj4+",
+			"???>>>",
+		},
+		{
+			"/base64/Pz8_Pj4-",
+			"???>>>",
+		},
+		{
+			// padding may be omitted
+			"/base64/dGVzdC1pbWFnZQ",
+			"test-image",
+		},
+		{
+			"/base64/decode/dGVzdC1pbWFnZQ",
+			"test-image",
+		},
+		{
+			"/base64/aMOpbGxvLCB3w7ZybGQg4pyT",
+			"héllo, wörld ✓",
+		},
+		{
+			"/base64/encode/h%C3%A9llo%2C%20w%C3%B6rld%20%E2%9C%93",
+			"aMOpbGxvLCB3w7ZybGQg4pyT",
+		},
+		{
+			// the raw remainder of the path is encoded, slashes and all
+			"/base64/encode/a/b",
+			"YS9i",
+		},
+	}
+
+	for _, test := range okTests {
+		test := test
+		t.Run("ok"+test.requestURL, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.requestURL, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, "text/plain")
+			assertBodyEquals(t, w, test.want)
+		})
+	}
+
+	errorTests := []struct {
+		requestURL           string
+		expectedBodyContains string
+	}{
+		{
+			"/base64/invalid_base64_encoded_string",
+			"decode failed",
+		},
+		{
+			"/base64/decode/invalid_base64_encoded_string",
+			"decode failed",
+		},
+		{
+			"/base64/decode/invalid_base64_encoded_string",
+			"decode failed",
+		},
+		{
+			"/base64/decode/" + randStringBytes(Base64MaxLen+1),
+			"Cannot handle input",
+		},
+		{
+			"/base64/decode/" + randStringBytes(Base64MaxLen+1),
+			"Cannot handle input",
+		},
+		{
+			"/base64/",
+			"no input data",
+		},
+		{
+			"/base64/decode/",
+			"no input data",
+		},
+		{
+			"/base64/unknown/dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n",
+			"invalid operation: unknown",
+		},
+		{
+			"/base64/decode/a",
+			"not valid in any of the URL-safe, standard, unpadded URL-safe, unpadded standard alphabets",
+		},
+		{
+			// mixing the two alphabets is not allowed
+			"/base64/decode/Pz8_Pj4+",
+			"illegal base64 data",
+		},
+	}
+
+	for _, test := range errorTests {
+		test := test
+		t.Run("error"+test.requestURL, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.requestURL, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertBodyContains(t, w, test.expectedBodyContains)
+		})
+	}
+
+	t.Run("output exceeds max body size", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxBodySize(8))
+		r, _ := http.NewRequest("GET", "/base64/encode/valid_base64_encoded_string", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+		assertBodyContains(t, w, "encode failed: output of 36 bytes exceeds the limit of 8")
+
+		r, _ = http.NewRequest("GET", "/base64/dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+		assertBodyContains(t, w, "decode failed: output of 27 bytes exceeds the limit of 8")
+	})
+}
+
+func TestDumpRequest(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest("GET", "/dump/request?foo=bar", nil)
+	r.Host = "test-host"
+	r.Header.Set("x-test-header2", "Test-Value2")
+	r.Header.Set("x-test-header1", "Test-Value1")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertContentType(t, w, "text/plain; charset=utf-8")
+	assertBodyEquals(t, w, "GET /dump/request?foo=bar HTTP/1.1\r\nHost: test-host\r\nX-Test-Header1: Test-Value1\r\nX-Test-Header2: Test-Value2\r\n\r\n")
+}
+
+func TestDumpRequestJSON(t *testing.T) {
+	t.Parallel()
+
+	dump := func(t *testing.T, app *HTTPBin, r *http.Request) dumpRequestResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		var resp dumpRequestResponse
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	t.Run("multipart post", func(t *testing.T) {
+		t.Parallel()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		assertNil(t, mw.WriteField("foo", "bar"))
+		mw.Close()
+
+		r, _ := http.NewRequest("POST", "/dump/request?format=json&x=1", bytes.NewReader(body.Bytes()))
+		r.Host = "test-host"
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Add("X-Repeated", "second")
+		r.Header.Add("X-Repeated", "first")
+		resp := dump(t, app, r)
+
+		if resp.Method != "POST" || resp.URL != "/dump/request?format=json&x=1" || resp.Proto != "HTTP/1.1" {
+			t.Fatalf("unexpected request line %s %s %s", resp.Method, resp.URL, resp.Proto)
+		}
+		wantHeaders := []dumpHeader{
+			{"Host", "test-host"},
+			{"Content-Type", mw.FormDataContentType()},
+			{"X-Repeated", "second"},
+			{"X-Repeated", "first"},
+		}
+		if !reflect.DeepEqual(resp.Headers, wantHeaders) {
+			t.Fatalf("expected headers %v, got %v", wantHeaders, resp.Headers)
+		}
+		assertIntEqual(t, int(resp.ContentLength), body.Len())
+		if resp.Body != body.String() || resp.BodyEncoding != "utf-8" || resp.Truncated {
+			t.Fatalf("unexpected body %q (%s, truncated=%v)", resp.Body, resp.BodyEncoding, resp.Truncated)
+		}
+		if len(resp.Trailers) != 0 {
+			t.Fatalf("expected no trailers, got %v", resp.Trailers)
+		}
+	})
+
+	t.Run("binary body", func(t *testing.T) {
+		t.Parallel()
+		body := []byte{0x00, 0xff, 0xfe, 'a'}
+		r, _ := http.NewRequest("PUT", "/dump/request?format=json", bytes.NewReader(body))
+		resp := dump(t, app, r)
+		if resp.BodyEncoding != "base64" || resp.Body != base64.StdEncoding.EncodeToString(body) {
+			t.Fatalf("expected base64 body, got %q (%s)", resp.Body, resp.BodyEncoding)
+		}
+	})
+
+	t.Run("body is truncated at max body size", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxBodySize(4))
+		r, _ := http.NewRequest("POST", "/dump/request?format=json", strings.NewReader("0123456789"))
+		resp := dump(t, app, r)
+		if resp.Body != "0123" || !resp.Truncated {
+			t.Fatalf("expected truncated body, got %q (truncated=%v)", resp.Body, resp.Truncated)
+		}
+		assertIntEqual(t, int(resp.ContentLength), 10)
+	})
+
+	t.Run("trailers", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("POST", "/dump/request?format=json", strings.NewReader("data"))
+		r.Trailer = http.Header{"X-Checksum": {"abc"}}
+		resp := dump(t, app, r)
+		wantTrailers := []dumpHeader{{"X-Checksum", "abc"}}
+		if !reflect.DeepEqual(resp.Trailers, wantTrailers) {
+			t.Fatalf("expected trailers %v, got %v", wantTrailers, resp.Trailers)
+		}
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/dump/request?format=xml", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+		assertParamError(t, w, "format")
+	})
+}
+
+func TestJSON(t *testing.T) {
+	t.Parallel()
+	r, _ := http.NewRequest("GET", "/json", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+
+	assertContentType(t, w, jsonContentType)
+	assertBodyContains(t, w, `Wake up to WonderWidgets!`)
+}
+
+func TestBearer(t *testing.T) {
+	t.Parallel()
+	requestURL := "/bearer"
+
+	t.Run("valid_token", func(t *testing.T) {
+		t.Parallel()
+		token := "valid_token"
+		r, _ := http.NewRequest("GET", requestURL, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+
+		var resp *bearerResponse
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+		}
+
+		if resp.Authenticated != true {
+			t.Fatalf("expected response key %s=%#v, got %#v",
+				"Authenticated", true, resp.Authenticated)
+		}
+		if resp.Token != token {
+			t.Fatalf("expected response key %s=%#v, got %#v",
+				"token", token, resp.Authenticated)
+		}
+	})
+
+	errorTests := []struct {
+		authorizationHeader string
+	}{
+		{
+			"",
+		},
+		{
+			"Bearer",
+		},
+		{
+			"Bearer x y",
+		},
+		{
+			"bearer x",
+		},
+		{
+			"Bearer1 x",
+		},
+		{
+			"xBearer x",
+		},
+	}
+	for _, test := range errorTests {
+		test := test
+		t.Run("error"+test.authorizationHeader, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", requestURL, nil)
+			if test.authorizationHeader != "" {
+				r.Header.Set("Authorization", test.authorizationHeader)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertHeader(t, w, "WWW-Authenticate", "Bearer")
+			assertStatusCode(t, w, http.StatusUnauthorized)
+		})
+	}
+}
+
+func TestBearerJWT(t *testing.T) {
+	t.Parallel()
+	const secret = "s3cr3t"
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	app := New()
+	app.now = func() time.Time { return now }
+
+	requestURL := "/bearer?jwt=true&secret=" + secret
+	bearer := func(token string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", requestURL, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		token := mintHS256JWT(secret, `{"alg":"HS256","typ":"JWT"}`, fmt.Sprintf(`{"sub":"user","exp":%d,"nbf":%d,"n":12345678901234567}`, now.Add(time.Minute).Unix(), now.Add(-time.Minute).Unix()))
+		w := bearer(token)
+		assertStatusCode(t, w, http.StatusOK)
+
+		var resp bearerResponse
+		dec := json.NewDecoder(w.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+		}
+		if !resp.Authenticated || resp.Token != token {
+			t.Fatalf("expected authenticated response for token, got %+v", resp)
+		}
+		if resp.Claims["sub"] != "user" {
+			t.Fatalf("expected sub claim %q, got %#v", "user", resp.Claims["sub"])
+		}
+		if resp.Claims["n"] != json.Number("12345678901234567") {
+			t.Fatalf("expected large numeric claim to round trip exactly, got %#v", resp.Claims["n"])
+		}
+	})
+
+	t.Run("no_time_claims", func(t *testing.T) {
+		t.Parallel()
+		assertStatusCode(t, bearer(mintHS256JWT(secret, `{"alg":"HS256"}`, `{"sub":"user"}`)), http.StatusOK)
+	})
+
+	t.Run("validation_is_opt_in", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/bearer?secret="+secret, nil)
+		r.Header.Set("Authorization", "Bearer not-a-jwt")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		if strings.Contains(w.Body.String(), "claims") {
+			t.Fatalf("expected no claims without jwt=true, got %s", w.Body)
+		}
+	})
+
+	errorTests := []struct {
+		name   string
+		token  string
+		reason string
+	}{
+		{"not_a_jwt", "foo", "malformed"},
+		{"bad_base64", "a.b!.c", "malformed"},
+		{"payload_not_object", mintHS256JWT(secret, `{"alg":"HS256"}`, `[1]`), "malformed"},
+		{"exp_not_number", mintHS256JWT(secret, `{"alg":"HS256"}`, `{"exp":"tomorrow"}`), "malformed"},
+		{"wrong_secret", mintHS256JWT("other", `{"alg":"HS256"}`, `{"sub":"user"}`), "bad_signature"},
+		{"alg_none", mintHS256JWT(secret, `{"alg":"none"}`, `{"sub":"user"}`), "bad_signature"},
+		{"tampered_payload", func() string {
+			parts := strings.Split(mintHS256JWT(secret, `{"alg":"HS256"}`, `{"sub":"user"}`), ".")
+			parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`))
+			return strings.Join(parts, ".")
+		}(), "bad_signature"},
+		{"expired", mintHS256JWT(secret, `{"alg":"HS256"}`, fmt.Sprintf(`{"exp":%d}`, now.Add(-time.Second).Unix())), "expired"},
+		{"expires_now", mintHS256JWT(secret, `{"alg":"HS256"}`, fmt.Sprintf(`{"exp":%d}`, now.Unix())), "expired"},
+		{"not_yet_valid", mintHS256JWT(secret, `{"alg":"HS256"}`, fmt.Sprintf(`{"nbf":%d}`, now.Add(time.Second).Unix())), "not_yet_valid"},
+	}
+	for _, test := range errorTests {
+		test := test
+		t.Run("error/"+test.name, func(t *testing.T) {
+			t.Parallel()
+			w := bearer(test.token)
+			assertStatusCode(t, w, http.StatusUnauthorized)
+			assertContentType(t, w, jsonContentType)
+			if got := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(got, `Bearer error="invalid_token", error_description="`) {
+				t.Fatalf("expected invalid_token challenge, got %q", got)
+			}
+			var resp bearerErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+			}
+			if resp.Authenticated || resp.Error != "invalid_token" || resp.Reason != test.reason || resp.ErrorDescription == "" {
+				t.Fatalf("expected invalid_token error with reason %q, got %+v", test.reason, resp)
+			}
+		})
+	}
+
+	t.Run("missing_token", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", requestURL, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		assertHeader(t, w, "WWW-Authenticate", "Bearer")
+	})
+
+	paramTests := []struct {
+		url   string
+		param string
+	}{
+		{"/bearer?jwt=yes&secret=" + secret, "jwt"},
+		{"/bearer?jwt=true", "secret"},
+	}
+	for _, test := range paramTests {
+		test := test
+		t.Run("invalid_params"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			r.Header.Set("Authorization", "Bearer "+mintHS256JWT(secret, `{"alg":"HS256"}`, `{}`))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, test.param)
+		})
+	}
+}
+
+// mintHS256JWT returns a compact JWS with the given JSON header and payload,
+// signed with HMAC-SHA256 under secret whatever alg the header names.
+func mintHS256JWT(secret, header, payload string) string {
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestNotImplemented(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		url string
+	}{
+		{"/brotli"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotImplemented)
+		})
+	}
+}
+
+func TestHostname(t *testing.T) {
+	t.Parallel()
+	loadResponse := func(t *testing.T, bodyBytes []byte) hostnameResponse {
+		var resp hostnameResponse
+		err := json.Unmarshal(bodyBytes, &resp)
+		if err != nil {
+			t.Fatalf("failed to unmarshal body %q from JSON: %s", string(bodyBytes), err)
+		}
+		return resp
+	}
+
+	t.Run("default hostname", func(t *testing.T) {
+		t.Parallel()
+		var (
+			app  = New()
+			r, _ = http.NewRequest("GET", "/hostname", nil)
+			w    = httptest.NewRecorder()
+		)
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		resp := loadResponse(t, w.Body.Bytes())
+		if resp.Hostname != DefaultHostname {
+			t.Errorf("expected hostname %q, got %q", DefaultHostname, resp.Hostname)
+		}
+	})
+
+	t.Run("real hostname", func(t *testing.T) {
+		t.Parallel()
+		var (
+			realHostname = "real-hostname"
+			app          = New(WithHostname(realHostname))
+			r, _         = http.NewRequest("GET", "/hostname", nil)
+			w            = httptest.NewRecorder()
+		)
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		resp := loadResponse(t, w.Body.Bytes())
+		if resp.Hostname != realHostname {
+			t.Errorf("expected hostname %q, got %q", realHostname, resp.Hostname)
+		}
+	})
+}
+
+func TestEnv(t *testing.T) {
+	t.Parallel()
+
+	// The names are unique to this test, so that it may run in parallel
+	// with others despite the environment being shared by the process
+	vars := map[string]string{
+		"HTTPBIN_TEST_ENV_PLAIN":  "value",
+		"HTTPBIN_TEST_ENV_EQUALS": "a=b==c=",
+		"HTTPBIN_TEST_ENV_EMPTY":  "",
+		"DDTEST_ENV_OTHER":        "other",
+		"httpbin_test_env_lower":  "lower",
+		"SECRET_TEST_ENV_TOKEN":   "hunter2",
+	}
+	for k, v := range vars {
+		assertNil(t, os.Setenv(k, v))
+	}
+	t.Cleanup(func() {
+		for k := range vars {
+			os.Unsetenv(k)
+		}
+	})
+
+	getEnv := func(t *testing.T, app *HTTPBin) envResponse {
+		t.Helper()
+		r, _ := http.NewRequest("GET", "/env", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		var resp envResponse
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	t.Run("filtered by prefix", func(t *testing.T) {
+		t.Parallel()
+		resp := getEnv(t, New(WithEnvPrefixes("HTTPBIN_TEST_ENV_", "DDTEST_")))
+		want := envResponse{
+			"HTTPBIN_TEST_ENV_PLAIN":  "value",
+			"HTTPBIN_TEST_ENV_EQUALS": "a=b==c=",
+			"HTTPBIN_TEST_ENV_EMPTY":  "",
+			"DDTEST_ENV_OTHER":        "other",
+		}
+		if !reflect.DeepEqual(resp, want) {
+			t.Fatalf("expected %v, got %v", want, resp)
+		}
+	})
+
+	t.Run("nothing without prefixes", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/env", nil)
+		w := httptest.NewRecorder()
+		New().ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertBodyEquals(t, w, "{}\n")
+	})
+}
+
+func TestSignedURLs(t *testing.T) {
+	t.Parallel()
+
+	var (
+		key     = "test-signing-key"
+		maxSkew = 5 * time.Second
+		now     = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+	app := New(WithSignedURLKey(key, maxSkew))
+	app.now = func() time.Time { return now }
+
+	signedPath := func(expiry time.Time, target string) string {
+		return fmt.Sprintf("/signed/%d/%s%s", expiry.Unix(), signURLPath([]byte(key), expiry.Unix(), target), target)
+	}
+
+	t.Run("sign", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("POST", "/sign?target=/foo/bar&ttl=30s", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+
+		var resp signResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal body %q from JSON: %s", w.Body.String(), err)
+		}
+		wantExpiry := now.Add(30 * time.Second)
+		if resp.Expires != wantExpiry.Unix() {
+			t.Fatalf("expected expires %d, got %d", wantExpiry.Unix(), resp.Expires)
+		}
+		if want := signedPath(wantExpiry, "/foo/bar"); resp.Path != want {
+			t.Fatalf("expected path %q, got %q", want, resp.Path)
+		}
+		if !strings.HasSuffix(resp.URL, resp.Path) {
+			t.Fatalf("expected url %q to end with path %q", resp.URL, resp.Path)
+		}
+
+		// the generated path must be accepted by the verifier
+		r, _ = http.NewRequest("GET", resp.Path, nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+	})
+
+	t.Run("sign requires POST", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/sign?target=/foo", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusMethodNotAllowed)
+	})
+
+	badSignTests := []string{
+		"/sign",
+		"/sign?target=/foo&ttl=foo",
+		"/sign?target=/foo&ttl=0",
+		"/sign?target=/foo&ttl=-1s",
+	}
+	for _, url := range badSignTests {
+		url := url
+		t.Run("bad"+url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("POST", url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+		})
+	}
+
+	validPath := signedPath(now.Add(time.Minute), "/foo/bar")
+
+	tests := []struct {
+		name string
+		url  string
+		code int
+	}{
+		{"valid", validPath, http.StatusOK},
+		{"valid with query params", validPath + "?a=b", http.StatusOK},
+		{"valid root target", signedPath(now.Add(time.Minute), "/"), http.StatusOK},
+		{"expires exactly now", signedPath(now, "/foo"), http.StatusOK},
+		{"expired one second ago", signedPath(now.Add(-time.Second), "/foo"), http.StatusGone},
+		{"expired within skew", signedPath(now.Add(-time.Second), "/foo") + "?skew=1s", http.StatusOK},
+		{"expired beyond skew", signedPath(now.Add(-2*time.Second), "/foo") + "?skew=1s", http.StatusGone},
+		{"skew too large", signedPath(now, "/foo") + "?skew=1m", http.StatusBadRequest},
+		{"invalid skew", signedPath(now, "/foo") + "?skew=foo", http.StatusBadRequest},
+		{"tampered path", strings.Replace(validPath, "/foo/bar", "/foo/baz", 1), http.StatusForbidden},
+		{"tampered expiry", fmt.Sprintf("/signed/%d/%s", now.Add(time.Hour).Unix(), strings.SplitN(validPath, "/", 4)[3]), http.StatusForbidden},
+		{"tampered signature", fmt.Sprintf("/signed/%d/bad-signature/foo/bar", now.Add(time.Minute).Unix()), http.StatusForbidden},
+		{"invalid expiry", "/signed/foo/bar/baz", http.StatusBadRequest},
+		{"missing signature", "/signed/123", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.code)
+		})
+	}
+
+	t.Run("expired url with bad signature is forbidden", func(t *testing.T) {
+		t.Parallel()
+		url := fmt.Sprintf("/signed/%d/bad-signature/foo", now.Add(-time.Hour).Unix())
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusForbidden)
+	})
+
+	t.Run("disabled without key", func(t *testing.T) {
+		t.Parallel()
+		for _, url := range []string{"/sign", validPath} {
+			r, _ := http.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+			New().ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotFound)
+		}
+	})
+
+	t.Run("disabled with empty key", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithSignedURLKey("", maxSkew))
+		for _, url := range []string{"/sign", validPath} {
+			r, _ := http.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotFound)
+		}
+	})
+}
+
+func TestEgress(t *testing.T) {
+	t.Parallel()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	t.Cleanup(target.Close)
+
+	targetURL, _ := url.Parse(target.URL)
+	newApp := func(opts ...OptionFunc) *HTTPBin {
+		opts = append([]OptionFunc{
+			WithAllowedRedirectDomains([]string{targetURL.Hostname()}),
+			WithMaxDuration(100 * time.Millisecond),
+		}, opts...)
+		app := New(opts...)
+		// our test target listens on loopback, which is normally refused
+		app.egressAllowIP = func(net.IP) bool { return true }
+		return app
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/egress?target="+url.QueryEscape(target.URL+"/foo"), nil)
+		w := httptest.NewRecorder()
+		newApp().ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+
+		var resp egressResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal body %q from JSON: %s", w.Body.String(), err)
+		}
+		if resp.Status != http.StatusTeapot {
+			t.Errorf("expected target status %d, got %d", http.StatusTeapot, resp.Status)
+		}
+		if resp.SourceIP != "127.0.0.1" || resp.SourcePort == 0 {
+			t.Errorf("unexpected source address %s:%d", resp.SourceIP, resp.SourcePort)
+		}
+		if resp.RemoteAddr != targetURL.Host {
+			t.Errorf("expected remote addr %q, got %q", targetURL.Host, resp.RemoteAddr)
+		}
+		if resp.LatencyMS <= 0 {
+			t.Errorf("expected positive latency, got %v", resp.LatencyMS)
+		}
+	})
+
+	t.Run("private addresses are refused", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithAllowedRedirectDomains([]string{targetURL.Hostname()}))
+		r, _ := http.NewRequest("GET", "/egress?target="+url.QueryEscape(target.URL), nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusForbidden)
+		assertBodyContains(t, w, "private address")
+	})
+
+	t.Run("timeout is bounded by max duration", func(t *testing.T) {
+		t.Parallel()
+		start := time.Now()
+		r, _ := http.NewRequest("GET", "/egress?target="+url.QueryEscape(target.URL+"/slow"), nil)
+		w := httptest.NewRecorder()
+		newApp().ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadGateway)
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("expected egress request to time out quickly, took %s", elapsed)
+		}
+	})
+
+	t.Run("concurrency is capped", func(t *testing.T) {
+		t.Parallel()
+		app := newApp(WithMaxEgressConcurrency(1))
+		app.egressSem <- struct{}{}
+		defer func() { <-app.egressSem }()
+
+		r, _ := http.NewRequest("GET", "/egress?target="+url.QueryEscape(target.URL), nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusServiceUnavailable)
+	})
+
+	t.Run("non-positive concurrency uses the default", func(t *testing.T) {
+		t.Parallel()
+		for _, n := range []int{0, -1} {
+			app := newApp(WithMaxEgressConcurrency(n))
+			if got := cap(app.egressSem); got != DefaultMaxEgressConcurrency {
+				t.Errorf("WithMaxEgressConcurrency(%d): expected capacity %d, got %d", n, DefaultMaxEgressConcurrency, got)
+			}
+
+			r, _ := http.NewRequest("GET", "/egress?target="+url.QueryEscape(target.URL), nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+		}
+	})
+
+	badTests := []struct {
+		target string
+		code   int
+	}{
+		{"", http.StatusBadRequest},
+		{"/relative", http.StatusBadRequest},
+		{"ftp://" + targetURL.Host, http.StatusBadRequest},
+		{"http://evil.com/", http.StatusForbidden},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run("bad/"+test.target, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/egress?target="+url.QueryEscape(test.target), nil)
+			w := httptest.NewRecorder()
+			newApp().ServeHTTP(w, r)
+			assertStatusCode(t, w, test.code)
+		})
+	}
+}
+
+// parseServerTiming parses a Server-Timing header value into a map of metric
+// names to durations in milliseconds, failing the test if the value does not
+// match the header's grammar.
+func parseServerTiming(t *testing.T, value string) map[string]float64 {
+	t.Helper()
+	metricRe := regexp.MustCompile(`^([!#$%&'*+\-.^_` + "`" + `|~0-9A-Za-z]+);dur=([0-9]+(?:\.[0-9]+)?)$`)
+	metrics := make(map[string]float64)
+	for _, entry := range strings.Split(value, ",") {
+		match := metricRe.FindStringSubmatch(strings.TrimSpace(entry))
+		if match == nil {
+			t.Fatalf("invalid Server-Timing entry %q in %q", entry, value)
+		}
+		dur, _ := strconv.ParseFloat(match[2], 64)
+		metrics[match[1]] = dur
+	}
+	return metrics
+}
+
+func TestServerTiming(t *testing.T) {
+	t.Parallel()
+	app := New(WithServerTiming(), WithMaxBodySize(maxBodySize), WithMaxDuration(maxDuration))
+
+	tests := []struct {
+		method      string
+		url         string
+		body        string
+		wantMetrics []string
+		minDuration map[string]float64
+	}{
+		{"GET", "/delay/50ms", "", []string{"sleep", "read", "parse"}, map[string]float64{"sleep": 50}},
+		{"GET", "/bytes/512", "", []string{"generate"}, nil},
+		{"POST", "/post", `{"foo": "bar"}`, []string{"read", "parse"}, nil},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+
+			metrics := parseServerTiming(t, w.Header().Get("Server-Timing"))
+			if len(metrics) != len(test.wantMetrics) {
+				t.Fatalf("expected metrics %v, got %v", test.wantMetrics, metrics)
+			}
+			for _, name := range test.wantMetrics {
+				if _, ok := metrics[name]; !ok {
+					t.Fatalf("expected metric %q in %v", name, metrics)
+				}
+			}
+			for name, min := range test.minDuration {
+				if metrics[name] < min {
+					t.Fatalf("expected %s duration >= %vms, got %vms", name, min, metrics[name])
+				}
+			}
+		})
+	}
+
+	t.Run("phases after headers are sent as trailers", func(t *testing.T) {
+		t.Parallel()
+		handler := serverTiming(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timing := getTimingRecorder(r)
+			timing.add("before", time.Millisecond)
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			timing.add("after", 2*time.Millisecond)
+		}))
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		assertNil(t, err)
+		defer resp.Body.Close()
+		io.ReadAll(resp.Body)
+
+		headerMetrics := parseServerTiming(t, resp.Header.Get("Server-Timing"))
+		if !reflect.DeepEqual(headerMetrics, map[string]float64{"before": 1}) {
+			t.Fatalf("unexpected header metrics %v", headerMetrics)
+		}
+		trailerMetrics := parseServerTiming(t, resp.Trailer.Get("Server-Timing"))
+		if !reflect.DeepEqual(trailerMetrics, map[string]float64{"after": 2}) {
+			t.Fatalf("unexpected trailer metrics %v", trailerMetrics)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/delay/0", nil)
+		w := httptest.NewRecorder()
+		New().ServeHTTP(w, r)
+		assertHeader(t, w, "Server-Timing", "")
+	})
+}
+
+func TestRequestBodyDecoding(t *testing.T) {
+	t.Parallel()
+
+	// There is no brotli encoder to hand, so the bodies used below were
+	// compressed with the reference implementation
+	brotliStreams := map[string]string{
+		`{"foo": "bar"}`:                   "8b06807b22666f6f223a2022626172227d03",
+		`foo=bar&baz=quux`:                 "8b0780666f6f3d6261722662617a3d7175757803",
+		strings.Repeat("a", 1025):          "1b0004f825c2a2b1404037",
+		strings.Repeat("hello world ", 10): "1b7700f88d946ede44558696206c6f354b62b5400654db00",
+	}
+
+	compress := func(encoding string, body []byte) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case "br":
+			stream, ok := brotliStreams[string(body)]
+			if !ok {
+				panic(fmt.Sprintf("no brotli stream for body %q", body))
+			}
+			b, _ := hex.DecodeString(stream)
+			return b
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		case "zstd":
+			w = zstd.NewWriter(&buf)
+		}
+		w.Write(body)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	for _, encoding := range []string{"gzip", "deflate", "zstd", "br"} {
+		encoding := encoding
+
+		t.Run(encoding+"/json", func(t *testing.T) {
+			t.Parallel()
+			body := compress(encoding, []byte(`{"foo": "bar"}`))
+			r, _ := http.NewRequest("POST", "/post", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Content-Encoding", encoding)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+
+			var resp *bodyResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q from JSON: %s", w.Body.String(), err)
+			}
+			if resp.Encoding != encoding {
+				t.Errorf("expected encoding %q, got %q", encoding, resp.Encoding)
+			}
+			if resp.Data != `{"foo": "bar"}` {
+				t.Errorf("expected decoded data, got %q", resp.Data)
+			}
+			if !reflect.DeepEqual(resp.JSON, map[string]interface{}{"foo": "bar"}) {
+				t.Errorf("expected decoded json, got %#v", resp.JSON)
+			}
+		})
+
+		t.Run(encoding+"/form", func(t *testing.T) {
+			t.Parallel()
+			body := compress(encoding, []byte(`foo=bar&baz=quux`))
+			r, _ := http.NewRequest("PUT", "/anything", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Content-Encoding", encoding)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+
+			var resp *bodyResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q from JSON: %s", w.Body.String(), err)
+			}
+			if resp.Form["foo"][0] != "bar" || resp.Form["baz"][0] != "quux" {
+				t.Errorf("unexpected form %#v", resp.Form)
+			}
+		})
+
+		t.Run(encoding+"/decoded body too large", func(t *testing.T) {
+			t.Parallel()
+			// highly compressible, so the encoded body is under the limit
+			body := compress(encoding, bytes.Repeat([]byte("a"), int(maxBodySize)+1))
+			if int64(len(body)) >= maxBodySize {
+				t.Fatalf("expected encoded body to be smaller than %d bytes", maxBodySize)
+			}
+			r, _ := http.NewRequest("POST", "/post", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "text/plain")
+			r.Header.Set("Content-Encoding", encoding)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertBodyContains(t, w, "too large")
+		})
+
+		t.Run(encoding+"/truncated body", func(t *testing.T) {
+			t.Parallel()
+			body := compress(encoding, []byte(strings.Repeat("hello world ", 10)))
+			r, _ := http.NewRequest("POST", "/post", bytes.NewReader(body[:len(body)/2]))
+			r.Header.Set("Content-Type", "text/plain")
+			r.Header.Set("Content-Encoding", encoding)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertBodyContains(t, w, "error decoding "+encoding+" request body")
+		})
+
+		t.Run(encoding+"/corrupt body", func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("POST", "/post", strings.NewReader("definitely not compressed"))
+			r.Header.Set("Content-Type", "text/plain")
+			r.Header.Set("Content-Encoding", encoding)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertBodyContains(t, w, "error decoding "+encoding+" request body")
+		})
+	}
+
+	t.Run("unknown encodings are echoed as-is", func(t *testing.T) {
+		t.Parallel()
+		body := []byte{0x1f, 0x9d, 0x90, 0x00}
+		r, _ := http.NewRequest("POST", "/post", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Content-Encoding", "compress")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+
+		var resp *bodyResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal body %q from JSON: %s", w.Body.String(), err)
+		}
+		if resp.Encoding != "" {
+			t.Errorf("expected empty encoding, got %q", resp.Encoding)
+		}
+		if want := encodeData(body, "application/json"); resp.Data != want {
+			t.Errorf("expected data %q, got %q", want, resp.Data)
+		}
+		if resp.JSON != nil {
+			t.Errorf("expected nil json, got %#v", resp.JSON)
+		}
+	})
+}
+
+func TestChurn(t *testing.T) {
+	t.Parallel()
+
+	app := New()
+	srv := httptest.NewUnstartedServer(app)
+	srv.Config.ConnContext = app.ConnContext
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	t.Run("connections are recycled", func(t *testing.T) {
+		t.Parallel()
+		client := &http.Client{Transport: &http.Transport{}}
+
+		var (
+			closeEvery   = 4
+			numRequests  = 10
+			connections  []int64
+			requestSeqs  []int64
+			wantRequests = []int64{1, 2, 3, 4, 1, 2, 3, 4, 1, 2}
+		)
+		for i := 0; i < numRequests; i++ {
+			resp, err := client.Get(fmt.Sprintf("%s/churn?close_every=%d", srv.URL, closeEvery))
+			assertNil(t, err)
+			var result churnResponse
+			assertNil(t, json.NewDecoder(resp.Body).Decode(&result))
+			resp.Body.Close()
+
+			if wantClosing := (i+1)%closeEvery == 0; result.Closing != wantClosing {
+				t.Fatalf("request %d: expected closing=%v, got %v", i, wantClosing, result.Closing)
+			}
+			connections = append(connections, result.Connection)
+			requestSeqs = append(requestSeqs, result.Request)
+		}
+
+		if !reflect.DeepEqual(requestSeqs, wantRequests) {
+			t.Fatalf("expected per-connection request numbers %v, got %v", wantRequests, requestSeqs)
+		}
+		for i := 1; i < numRequests; i++ {
+			newConn := connections[i] != connections[i-1]
+			if wantNewConn := i%closeEvery == 0; newConn != wantNewConn {
+				t.Fatalf("request %d: expected new connection=%v, got connections %v", i, wantNewConn, connections)
+			}
+		}
+	})
+
+	t.Run("invalid close_every", func(t *testing.T) {
+		t.Parallel()
+		for _, value := range []string{"0", "-1", "foo"} {
+			resp, err := http.Get(srv.URL + "/churn?close_every=" + value)
+			assertNil(t, err)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("close_every=%s: expected status 400, got %d", value, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("documents the params it reads", func(t *testing.T) {
+		t.Parallel()
+		params := app.routeParams("/churn")
+		if len(params) != 1 || params[0].Name != "close_every" || params[0].Default != "10" {
+			t.Fatalf("expected only close_every to be documented, got %+v", params)
+		}
+	})
+
+	t.Run("requires ConnContext", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/churn", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNotImplemented)
+	})
+}
+
+func TestCharset(t *testing.T) {
+	t.Parallel()
+
+	// "ßéö" appears in the /encoding/utf8 page
+	goldenTests := []struct {
+		query           string
+		wantContentType string
+		wantBytes       []byte
+	}{
+		{"charset=utf-8", "text/html; charset=utf-8", []byte{0xc3, 0x9f, 0xc3, 0xa9, 0xc3, 0xb6}},
+		{"charset=iso-8859-1", "text/html; charset=iso-8859-1", []byte{0xdf, 0xe9, 0xf6}},
+		{"charset=ISO-8859-1", "text/html; charset=iso-8859-1", []byte{0xdf, 0xe9, 0xf6}},
+		{"charset=utf-16le", "text/html; charset=utf-16le", []byte{0xdf, 0x00, 0xe9, 0x00, 0xf6, 0x00}},
+		{"charset=utf-16be", "text/html; charset=utf-16be", []byte{0x00, 0xdf, 0x00, 0xe9, 0x00, 0xf6}},
+
+		// mismatches declare the requested charset but encode another
+		{"charset=iso-8859-1&charset_mismatch=true", "text/html; charset=iso-8859-1", []byte{0xc3, 0x9f, 0xc3, 0xa9, 0xc3, 0xb6}},
+		{"charset=utf-16le&charset_mismatch=true", "text/html; charset=utf-16le", []byte{0xc3, 0x9f, 0xc3, 0xa9, 0xc3, 0xb6}},
+		{"charset_mismatch=true", "text/html; charset=utf-8", []byte{0xdf, 0xe9, 0xf6}},
+	}
+	for _, test := range goldenTests {
+		test := test
+		t.Run(test.query, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/encoding/utf8?"+test.query, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, test.wantContentType)
+			if !bytes.Contains(w.Body.Bytes(), test.wantBytes) {
+				t.Fatalf("expected body to contain bytes % x", test.wantBytes)
+			}
+		})
+	}
+
+	t.Run("unrepresentable characters are replaced", func(t *testing.T) {
+		t.Parallel()
+		assertBytesEqual(t, encodeLatin1([]byte("aé€")), []byte{'a', 0xe9, '?'})
+		assertBytesEqual(t, encodeUTF16([]byte("a😀"), true), []byte{0x00, 'a', 0xd8, 0x3d, 0xde, 0x00})
+	})
+
+	endpointTests := []struct {
+		url             string
+		wantContentType string
+		wantUTF8Body    func(original []byte) []byte
+	}{
+		{"/html", "text/html; charset=utf-16be", nil},
+		{"/robots.txt", "text/plain; charset=utf-16be", nil},
+		{"/deny", "text/plain; charset=utf-16be", nil},
+		{"/xml", "application/xml; charset=utf-16be", func(original []byte) []byte {
+			return bytes.Replace(original, []byte("encoding='us-ascii'"), []byte("encoding='utf-16be'"), 1)
+		}},
+	}
+	for _, test := range endpointTests {
+		test := test
+		t.Run(test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			utf8Body := w.Body.Bytes()
+			if test.wantUTF8Body != nil {
+				utf8Body = test.wantUTF8Body(utf8Body)
+			}
+
+			r, _ = http.NewRequest("GET", test.url+"?charset=utf-16be", nil)
+			w = httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, test.wantContentType)
+			assertBytesEqual(t, w.Body.Bytes(), encodeUTF16(utf8Body, true))
+		})
+	}
+
+	t.Run("in-document declarations are rewritten", func(t *testing.T) {
+		t.Parallel()
+		tests := []struct {
+			mediaType string
+			body      string
+			want      string
+		}{
+			{"text/html", `<meta charset="utf-8">`, `<meta charset="iso-8859-1">`},
+			{"text/html", `<META CHARSET=UTF-8>`, `<META CHARSET=iso-8859-1>`},
+			{"text/html", `<meta http-equiv="Content-Type" content="text/html; charset=utf-8">`, `<meta http-equiv="Content-Type" content="text/html; charset=iso-8859-1">`},
+			{"text/html", `<p>charset=utf-8</p>`, `<p>charset=utf-8</p>`},
+			{"application/xml", `<?xml version="1.0" encoding="UTF-8"?><a encoding="x"/>`, `<?xml version="1.0" encoding="iso-8859-1"?><a encoding="x"/>`},
+			{"application/soap+xml", `<?xml version='1.0' encoding='utf-8'?>`, `<?xml version='1.0' encoding='iso-8859-1'?>`},
+			{"application/xml", `<a><?xml encoding="utf-8"?></a>`, `<a><?xml encoding="utf-8"?></a>`},
+			{"text/plain", `<meta charset="utf-8">`, `<meta charset="utf-8">`},
+		}
+		for _, test := range tests {
+			got := string(rewriteCharsetDeclarations(test.mediaType, []byte(test.body), "iso-8859-1"))
+			if got != test.want {
+				t.Errorf("%s %s: expected %s, got %s", test.mediaType, test.body, test.want, got)
+			}
+		}
+	})
+
+	t.Run("json is always utf-8", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/json?charset=utf-8", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, "application/json; charset=utf-8")
+
+		for _, query := range []string{"charset=utf-16le", "charset=iso-8859-1", "charset_mismatch=true"} {
+			r, _ := http.NewRequest("GET", "/json?"+query, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertBodyContains(t, w, "always utf-8")
+		}
+	})
+
+	t.Run("unsupported charset", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/html?charset=ebcdic", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+		assertBodyContains(t, w, "iso-8859-1, utf-16be, utf-16le, utf-8")
+	})
+}
+
+func TestLoadSignals(t *testing.T) {
+	t.Parallel()
+
+	app := New(WithLoadSignals(), WithMaxDuration(maxDuration))
+	srv := httptest.NewUnstartedServer(app)
+	srv.Config.ConnContext = app.ConnContext
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	t.Run("parallel load", func(t *testing.T) {
+		t.Parallel()
+
+		const numRequests = 10
+		type result struct {
+			inflight  int
+			queueWait float64
+			err       error
+		}
+		results := make(chan result, numRequests)
+		for i := 0; i < numRequests; i++ {
+			go func() {
+				resp, err := http.Get(srv.URL + "/delay/100ms")
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				io.ReadAll(resp.Body)
+
+				inflight, err := strconv.Atoi(resp.Header.Get("X-Inflight-Requests"))
+				if err != nil {
+					results <- result{err: fmt.Errorf("invalid X-Inflight-Requests: %w", err)}
+					return
+				}
+				queueWait, err := strconv.ParseFloat(resp.Header.Get("X-Queue-Wait-Ms"), 64)
+				if err != nil {
+					results <- result{err: fmt.Errorf("invalid X-Queue-Wait-Ms: %w", err)}
+					return
+				}
+				results <- result{inflight: inflight, queueWait: queueWait}
+			}()
+		}
+
+		maxInflight := 0
+		for i := 0; i < numRequests; i++ {
+			result := <-results
+			assertNil(t, result.err)
+			if result.inflight < 1 || result.inflight > numRequests {
+				t.Fatalf("implausible inflight count %d", result.inflight)
+			}
+			if result.queueWait < 0 {
+				t.Fatalf("implausible queue wait %v", result.queueWait)
+			}
+			if result.inflight > maxInflight {
+				maxInflight = result.inflight
+			}
+		}
+		if maxInflight < 2 {
+			t.Fatalf("expected concurrent requests to observe each other, max inflight %d", maxInflight)
+		}
+		if n := atomic.LoadInt64(&app.inflight); n != 0 {
+			t.Fatalf("expected no requests in flight after load, got %d", n)
+		}
+	})
+
+	t.Run("queue wait only reported for first request on a connection", func(t *testing.T) {
+		t.Parallel()
+		conn := &connInfo{accepted: time.Now().Add(-time.Second)}
+		start := time.Now()
+		if wait := conn.queueWait(start); wait < time.Second {
+			t.Fatalf("expected queue wait of at least 1s, got %s", wait)
+		}
+		if wait := conn.queueWait(start); wait != 0 {
+			t.Fatalf("expected zero queue wait on reused connection, got %s", wait)
+		}
+	})
+
+	t.Run("queue wait omitted without ConnContext", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/get", nil)
+		w := httptest.NewRecorder()
+		New(WithLoadSignals()).ServeHTTP(w, r)
+		assertHeader(t, w, "X-Inflight-Requests", "1")
+		assertHeader(t, w, "X-Queue-Wait-Ms", "")
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/get", nil)
+		w := httptest.NewRecorder()
+		New().ServeHTTP(w, r)
+		assertHeader(t, w, "X-Inflight-Requests", "")
+	})
+}
+
+func TestUsageNotFound(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		path    string
+		pattern string
+	}{
+		{"/absolute-redirect", "/absolute-redirect/{n}"},
+		{"/base64", "/base64/{value}"},
+		{"/basic-auth", "/basic-auth/{user}/{password}"},
+		{"/bytes", "/bytes/{n}"},
+		{"/delay", "/delay/{duration}"},
+		{"/digest-auth", "/digest-auth/{qop}/{user}/{password}/{algorithm}"},
+		{"/etag", "/etag/{etag}"},
+		{"/hidden-basic-auth", "/hidden-basic-auth/{user}/{password}"},
+		{"/links", "/links/{n}/{offset}"},
+		{"/range", "/range/{n}"},
+		{"/redirect", "/redirect/{n}"},
+		{"/relative-redirect", "/relative-redirect/{n}"},
+		{"/status", "/status/{code}"},
+		{"/stream", "/stream/{n}"},
+		{"/stream-bytes", "/stream-bytes/{n}"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, http.StatusNotFound)
+			assertContentType(t, w, jsonContentType)
+
+			var resp errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body.String(), err)
+			}
+			assertIntEqual(t, resp.StatusCode, http.StatusNotFound)
+			if !strings.Contains(resp.Detail, "use "+test.pattern) {
+				t.Fatalf("expected hint to mention %q, got %q", test.pattern, resp.Detail)
+			}
+		})
+	}
+
+	t.Run("signed_requires_key", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithSignedURLKey("secret", 0))
+		r, _ := http.NewRequest("GET", "/signed", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusNotFound)
+		assertBodyContains(t, w, "/signed/{expiry}/{signature}/{target}")
+	})
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		method  string
+		path    string
+		allowed []string
+	}{
+		{"POST", "/get", []string{"GET", "HEAD", "OPTIONS"}},
+		{"GET", "/post", []string{"POST", "OPTIONS"}},
+		{"PUT", "/delete", []string{"DELETE", "OPTIONS"}},
+		{"GET", "/head", []string{"HEAD", "OPTIONS"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.method+test.path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest(test.method, test.path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, http.StatusMethodNotAllowed)
+			assertContentType(t, w, jsonContentType)
+			assertHeader(t, w, "Allow", strings.Join(test.allowed, ", "))
+
+			var resp errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body.String(), err)
+			}
+			assertIntEqual(t, resp.StatusCode, http.StatusMethodNotAllowed)
+			if strings.Join(resp.AllowedMethods, ", ") != strings.Join(test.allowed, ", ") {
+				t.Fatalf("expected allowed_methods %v, got %v", test.allowed, resp.AllowedMethods)
+			}
+		})
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	t.Parallel()
+
+	decode := func(t *testing.T, body io.Reader) dualStackResponse {
+		t.Helper()
+		var resp dualStackResponse
+		if err := json.NewDecoder(body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, tc := range []struct {
+		network, addr string
+		family        string
+	}{
+		{"tcp4", "127.0.0.1:0", "ipv4"},
+		{"tcp6", "[::1]:0", "ipv6"},
+	} {
+		tc := tc
+		t.Run(tc.family+" listener", func(t *testing.T) {
+			t.Parallel()
+			ln, err := net.Listen(tc.network, tc.addr)
+			if err != nil {
+				t.Skipf("cannot listen on %s: %s", tc.addr, err)
+			}
+			srv := httptest.NewUnstartedServer(app)
+			srv.Listener.Close()
+			srv.Listener = ln
+			srv.Config.BaseContext = app.ListenerContext(tc.family + "-only")
+			srv.Start()
+			defer srv.Close()
+
+			resp, err := srv.Client().Get(srv.URL + "/dualstack")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			got := decode(t, resp.Body)
+			if got.Family != tc.family || got.IPv4Mapped {
+				t.Fatalf("expected unmapped %s, got %+v", tc.family, got)
+			}
+			if got.Listener != tc.family+"-only" {
+				t.Fatalf("expected listener %q, got %q", tc.family+"-only", got.Listener)
+			}
+			if got.LocalAddr != ln.Addr().String() {
+				t.Fatalf("expected local addr %s, got %s", ln.Addr(), got.LocalAddr)
+			}
+			if got.RemoteAddr == "" {
+				t.Fatalf("expected remote addr")
+			}
+		})
+	}
+
+	t.Run("ipv4-mapped remote address", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/dualstack", nil)
+		r.RemoteAddr = "[::ffff:192.0.2.1]:1234"
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		got := decode(t, w.Body)
+		if got.Family != "ipv4" || !got.IPv4Mapped {
+			t.Fatalf("expected mapped ipv4, got %+v", got)
+		}
+	})
+
+	t.Run("family delay", func(t *testing.T) {
+		t.Parallel()
+		delay := 100 * time.Millisecond
+		app := New(WithAddressFamilyDelay("ipv4", delay))
+		for _, tc := range []struct {
+			remoteAddr string
+			delayed    bool
+		}{
+			{"192.0.2.1:1234", true},
+			{"[2001:db8::1]:1234", false},
+		} {
+			r, _ := http.NewRequest("GET", "/dualstack", nil)
+			r.RemoteAddr = tc.remoteAddr
+			w := httptest.NewRecorder()
+			start := time.Now()
+			app.ServeHTTP(w, r)
+			elapsed := time.Since(start)
+			assertStatusCode(t, w, http.StatusOK)
+			got := decode(t, w.Body)
+			if tc.delayed {
+				if elapsed < delay || got.DelayMS != 100 {
+					t.Errorf("expected %s response to be delayed by %s, took %s (%+v)", tc.remoteAddr, delay, elapsed, got)
+				}
+			} else if elapsed >= delay || got.DelayMS != 0 {
+				t.Errorf("expected %s response not to be delayed, took %s (%+v)", tc.remoteAddr, elapsed, got)
+			}
+		}
+	})
+
+	t.Run("family delay bounded by max duration", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithAddressFamilyDelay("ipv6", time.Minute), WithMaxDuration(50*time.Millisecond))
+		r, _ := http.NewRequest("GET", "/dualstack", nil)
+		r.RemoteAddr = "[2001:db8::1]:1234"
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		if got := decode(t, w.Body); got.DelayMS != 50 {
+			t.Fatalf("expected delay to be clamped to 50ms, got %v", got.DelayMS)
+		}
+	})
+
+	t.Run("client gone during delay", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithAddressFamilyDelay("ipv4", time.Second))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		r, _ := http.NewRequestWithContext(ctx, "GET", "/dualstack", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, 499)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		t.Parallel()
+		for _, fn := range []func(){
+			func() { WithAddressFamilyDelay("ipx", time.Second) },
+			func() { WithAddressFamilyDelay("ipv4", -time.Second) },
+		} {
+			func() {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("expected panic")
+					}
+				}()
+				fn()
+			}()
+		}
+	})
+}
+
+func TestMemento(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2023, 6, 15, 12, 30, 0, 0, time.UTC)
+	app := New()
+	app.now = func() time.Time { return now }
+	versions := mementoVersions(now)
+
+	if len(versions) != mementoVersionCount {
+		t.Fatalf("expected %d versions, got %d", mementoVersionCount, len(versions))
+	}
+	if !versions[len(versions)-1].Equal(time.Date(2023, 6, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected newest version at start of day, got %s", versions[len(versions)-1])
+	}
+	if !versions[0].Equal(time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected oldest version one year ago, got %s", versions[0])
+	}
+
+	negotiationTests := []struct {
+		name           string
+		acceptDatetime string
+		version        int
+	}{
+		{"missing", "", mementoVersionCount},
+		{"malformed", "yesterday-ish", mementoVersionCount},
+		{"future", "Mon, 01 Jan 2024 00:00:00 GMT", mementoVersionCount},
+		{"before_oldest", "Sat, 01 Jan 2000 00:00:00 GMT", 1},
+		{"exact", versions[4].Format(http.TimeFormat), 5},
+		{"between", versions[4].Add(time.Hour).Format(http.TimeFormat), 5},
+		{"just_before", versions[4].Add(-time.Second).Format(http.TimeFormat), 4},
+	}
+	for _, test := range negotiationTests {
+		test := test
+		t.Run("negotiate/"+test.name, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", "/memento", nil)
+			if test.acceptDatetime != "" {
+				r.Header.Set("Accept-Datetime", test.acceptDatetime)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			datetime := versions[test.version-1].Format(http.TimeFormat)
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, jsonContentType)
+			assertHeader(t, w, "Memento-Datetime", datetime)
+			assertHeader(t, w, "Vary", "Accept-Datetime")
+			assertHeader(t, w, "Content-Location", fmt.Sprintf("/memento/%d", test.version))
+
+			link := w.Header().Get("Link")
+			for _, want := range []string{
+				`</memento>; rel="original timegate"`,
+				`</memento/timemap>; rel="timemap"; type="application/link-format"`,
+			} {
+				if !strings.Contains(link, want) {
+					t.Fatalf("expected Link header to contain %q, got %q", want, link)
+				}
+			}
+
+			var resp mementoResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body.String(), err)
+			}
+			assertIntEqual(t, resp.Version, test.version)
+			if resp.MementoDatetime != datetime {
+				t.Fatalf("expected memento_datetime %q, got %q", datetime, resp.MementoDatetime)
+			}
+		})
+	}
+
+	t.Run("timegate", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/memento/timegate", nil)
+		r.Header.Set("Accept-Datetime", versions[2].Add(time.Minute).Format(http.TimeFormat))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusFound)
+		assertHeader(t, w, "Location", "/memento/3")
+		assertHeader(t, w, "Vary", "Accept-Datetime")
+	})
+
+	t.Run("timemap", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/memento/timemap", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, "application/link-format")
+		assertBodyContains(t, w, `</memento/timegate>; rel="timegate"`)
+		assertBodyContains(t, w, fmt.Sprintf(`</memento/1>; rel="first memento"; datetime="%s"`, versions[0].Format(http.TimeFormat)))
+		assertBodyContains(t, w, fmt.Sprintf(`</memento/%d>; rel="last memento"; datetime="%s"`, mementoVersionCount, versions[mementoVersionCount-1].Format(http.TimeFormat)))
+		if n := strings.Count(w.Body.String(), `memento"; datetime=`); n != mementoVersionCount {
+			t.Fatalf("expected %d mementos in timemap, got %d", mementoVersionCount, n)
+		}
+	})
+
+	t.Run("version", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/memento/7", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "Memento-Datetime", versions[6].Format(http.TimeFormat))
+	})
+
+	for _, path := range []string{"/memento/0", "/memento/13", "/memento/foo", "/memento/1/2"} {
+		path := path
+		t.Run("invalid_version"+path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotFound)
+		})
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	// rawChallenges issues a request over a raw connection and returns the
+	// WWW-Authenticate header lines exactly as they appeared on the wire.
+	rawChallenges := func(t *testing.T, path string) (string, []string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assertNil(t, err)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", path, srv.Listener.Addr())
+		raw, err := io.ReadAll(conn)
+		assertNil(t, err)
+
+		head := strings.SplitN(string(raw), "\r\n\r\n", 2)[0]
+		lines := strings.Split(head, "\r\n")
+		var challenges []string
+		for _, line := range lines[1:] {
+			if strings.HasPrefix(line, "Www-Authenticate: ") {
+				challenges = append(challenges, strings.TrimPrefix(line, "Www-Authenticate: "))
+			}
+		}
+		return lines[0], challenges
+	}
+
+	const (
+		basic  = `Basic realm="go-httpbin", charset="UTF-8"`
+		bearer = `Bearer realm="go-httpbin", error="invalid_token", error_description="The access token expired"`
+		digest = `Digest realm="go-httpbin", qop="auth", algorithm=MD5, nonce="d9b2f053dbff7af634108fcd9f3c638d", opaque="63c5ca3853fd266f01d0fce182d036b6"`
+	)
+
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"/challenge", []string{basic, bearer, digest}},
+		{"/challenge?schemes=Digest,basic", []string{digest, basic}},
+		{"/challenge?schemes=Bearer", []string{bearer}},
+		{"/challenge?combined=true", []string{basic + ", " + bearer + ", " + digest}},
+		{"/challenge?schemes=Basic,Bearer&combined=true", []string{basic + ", " + bearer}},
+		{
+			"/challenge?schemes=Basic,Digest&combined=true&realm=" + url.QueryEscape(`a, "quoted" \ realm`),
+			[]string{
+				`Basic realm="a, \"quoted\" \\ realm", charset="UTF-8", ` +
+					`Digest realm="a, \"quoted\" \\ realm", qop="auth", algorithm=MD5, nonce="6b0be97aacb97db539db176cbd8d3d4d", opaque="85db7f003b72b4b7676eafce0717ce48"`,
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.path, func(t *testing.T) {
+			t.Parallel()
+			status, challenges := rawChallenges(t, test.path)
+			if status != "HTTP/1.1 401 Unauthorized" {
+				t.Fatalf("expected 401 status line, got %q", status)
+			}
+			if !reflect.DeepEqual(challenges, test.expected) {
+				t.Fatalf("expected challenges\n%q\ngot\n%q", test.expected, challenges)
+			}
+		})
+	}
+
+	t.Run("body", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/challenge?schemes=Basic", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusUnauthorized)
+		assertContentType(t, w, jsonContentType)
+		assertBodyContains(t, w, `"challenges"`)
+	})
+
+	t.Run("unsupported_scheme", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/challenge?schemes=Basic,Negotiate", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusBadRequest)
+		assertBodyContains(t, w, "Negotiate")
+	})
+}
+
+func TestUnstableSchedule(t *testing.T) {
+	t.Parallel()
+
+	// Start at a period boundary: 2023-01-01T00:00:00Z is a multiple of 5m
+	// since the Unix epoch.
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		offset     time.Duration
+		path       string
+		phase      string
+		status     int
+		untilNext  string
+		retryAfter string
+	}{
+		{0, "/unstable/schedule", "down", http.StatusServiceUnavailable, "30s", "30"},
+		{29*time.Second + 500*time.Millisecond, "/unstable/schedule", "down", http.StatusServiceUnavailable, "500ms", "1"},
+		{30 * time.Second, "/unstable/schedule", "up", http.StatusOK, "4m30s", ""},
+		{4*time.Minute + 59*time.Second, "/unstable/schedule", "up", http.StatusOK, "1s", ""},
+		{5 * time.Minute, "/unstable/schedule", "down", http.StatusServiceUnavailable, "30s", "30"},
+		{10 * time.Second, "/unstable/schedule?period=1m&down_for=20s&down_status=502", "down", http.StatusBadGateway, "10s", "10"},
+		{20 * time.Second, "/unstable/schedule?period=1m&down_for=20s&status_when_up=201", "up", http.StatusCreated, "40s", ""},
+		{20 * time.Second, "/unstable/schedule?period=1m&down_for=20s&status_when_up=204", "up", http.StatusNoContent, "", ""},
+		{0, "/unstable/schedule?down_for=0", "up", http.StatusOK, "5m0s", ""},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(fmt.Sprintf("%s@%s", test.path, test.offset), func(t *testing.T) {
+			t.Parallel()
+			now := start.Add(test.offset)
+			app := New()
+			app.now = func() time.Time { return now }
+
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+
+			assertStatusCode(t, w, test.status)
+			assertHeader(t, w, "Retry-After", test.retryAfter)
+			if test.status == http.StatusNoContent {
+				return
+			}
+
+			var resp unstableScheduleResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body.String(), err)
+			}
+			if resp.Phase != test.phase {
+				t.Fatalf("expected phase %q, got %q", test.phase, resp.Phase)
+			}
+			if resp.NextTransitionIn != test.untilNext {
+				t.Fatalf("expected next_transition_in %q, got %q", test.untilNext, resp.NextTransitionIn)
+			}
+		})
+	}
+
+	badRequestTests := []string{
+		"/unstable/schedule?period=0",
+		"/unstable/schedule?period=foo",
+		"/unstable/schedule?down_for=-1s",
+		"/unstable/schedule?period=10s&down_for=20s",
+		"/unstable/schedule?down_status=99",
+		"/unstable/schedule?status_when_up=600",
+	}
+	for _, path := range badRequestTests {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestCanonicalHeaders(t *testing.T) {
+	t.Parallel()
+
+	baseURL, _ := url.Parse("https://example.com/mount/")
+	app := New(WithCanonicalBaseURL(baseURL))
+	mux := http.NewServeMux()
+	mux.Handle("/mount/", http.StripPrefix("/mount", app))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	tests := []struct {
+		path      string
+		location  string
+		canonical string
+	}{
+		{
+			"/mount/get?b=2&a=1",
+			"https://example.com/mount/get?b=2&a=1",
+			"https://example.com/mount/get?b=2&a=1",
+		},
+		{
+			"/mount/anything/with%20space/%C3%A9?q=%3Cx%3E",
+			"https://example.com/mount/anything/with%20space/%C3%A9?q=%3Cx%3E",
+			"https://example.com/mount/anything/with%20space/%C3%A9?q=%3Cx%3E",
+		},
+		{
+			"/mount/redirect/2",
+			"https://example.com/mount/redirect/2",
+			"https://example.com/mount/redirect/2",
+		},
+		{
+			"/mount/get?canonical_mismatch=true",
+			"https://example.com/mount/get?canonical_mismatch=true",
+			"https://example.com/mount/canonical-mismatch/get?canonical_mismatch=true",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.path, func(t *testing.T) {
+			t.Parallel()
+			resp, err := client.Get(srv.URL + test.path)
+			assertNil(t, err)
+			defer resp.Body.Close()
+
+			if got := resp.Header.Get("Content-Location"); got != test.location {
+				t.Fatalf("expected Content-Location %q, got %q", test.location, got)
+			}
+			if _, err := url.ParseRequestURI(resp.Header.Get("Content-Location")); err != nil {
+				t.Fatalf("expected absolute Content-Location: %s", err)
+			}
+			expectedLink := fmt.Sprintf(`<%s>; rel="canonical"`, test.canonical)
+			if got := resp.Header.Get("Link"); got != expectedLink {
+				t.Fatalf("expected Link %q, got %q", expectedLink, got)
+			}
+		})
+	}
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/get", nil)
+		w := httptest.NewRecorder()
+		app := New()
+		app.ServeHTTP(w, r)
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "Content-Location", "")
+		assertHeader(t, w, "Link", "")
+	})
+}
+
+type fakeResolver struct {
+	addrs map[string][]net.IPAddr
+	cname map[string]string
+	err   error
+	delay time.Duration
+}
+
+func (f *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if f.delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(f.delay):
+		}
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.addrs[host], nil
+}
+
+func (f *fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	return f.cname[host], nil
+}
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+
+	newApp := func(resolver hostResolver) *HTTPBin {
+		app := New(WithAllowedRedirectDomains([]string{"example.com", "missing.example.com"}))
+		app.resolver = resolver
+		return app
+	}
+
+	doResolve := func(t *testing.T, app *HTTPBin, path string) (*httptest.ResponseRecorder, resolveResponse) {
+		t.Helper()
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		var resp resolveResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body.String(), err)
+			}
+		}
+		return w, resp
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+		app := newApp(&fakeResolver{
+			addrs: map[string][]net.IPAddr{
+				"example.com": {
+					{IP: net.ParseIP("93.184.216.34")},
+					{IP: net.ParseIP("2606:2800:220:1:248:1893:25c8:1946")},
+				},
+			},
+			cname: map[string]string{"example.com": "edge.example.net."},
+		})
+		w, resp := doResolve(t, app, "/resolve?host=example.com")
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		if !reflect.DeepEqual(resp.A, []string{"93.184.216.34"}) {
+			t.Fatalf("unexpected A records: %v", resp.A)
+		}
+		if !reflect.DeepEqual(resp.AAAA, []string{"2606:2800:220:1:248:1893:25c8:1946"}) {
+			t.Fatalf("unexpected AAAA records: %v", resp.AAAA)
+		}
+		if resp.CanonicalName != "edge.example.net." {
+			t.Fatalf("unexpected canonical name: %q", resp.CanonicalName)
+		}
+		if resp.Error != "" {
+			t.Fatalf("unexpected error: %q", resp.Error)
+		}
+	})
+
+	t.Run("nxdomain", func(t *testing.T) {
+		t.Parallel()
+		app := newApp(&fakeResolver{
+			err: &net.DNSError{Err: "no such host", Name: "missing.example.com", IsNotFound: true},
+		})
+		w, resp := doResolve(t, app, "/resolve?host=missing.example.com")
+
+		assertStatusCode(t, w, http.StatusOK)
+		if resp.Error != "nxdomain" {
+			t.Fatalf("expected nxdomain error, got %q", resp.Error)
+		}
+		if len(resp.A) != 0 || len(resp.AAAA) != 0 {
+			t.Fatalf("expected no records, got %v %v", resp.A, resp.AAAA)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		app := newApp(&fakeResolver{delay: time.Minute})
+		w, resp := doResolve(t, app, "/resolve?host=example.com")
+
+		assertStatusCode(t, w, http.StatusOK)
+		if resp.Error != "timeout" {
+			t.Fatalf("expected timeout error, got %q", resp.Error)
+		}
+		if resp.LatencyMS < float64(resolveTimeout/time.Millisecond) {
+			t.Fatalf("expected latency of at least %s, got %fms", resolveTimeout, resp.LatencyMS)
+		}
+	})
+
+	t.Run("forbidden_host", func(t *testing.T) {
+		t.Parallel()
+		app := newApp(&fakeResolver{})
+		w, _ := doResolve(t, app, "/resolve?host=internal.corp")
+		assertStatusCode(t, w, http.StatusForbidden)
+	})
+
+	t.Run("missing_host", func(t *testing.T) {
+		t.Parallel()
+		app := newApp(&fakeResolver{})
+		w, _ := doResolve(t, app, "/resolve")
+		assertStatusCode(t, w, http.StatusBadRequest)
+	})
+}
+
+func TestHeaderTiming(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	// firstByte issues a request over a raw connection, returning the time
+	// until the first byte of the response arrived and the full response.
+	firstByte := func(t *testing.T, path string) (time.Duration, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assertNil(t, err)
+		defer conn.Close()
+
+		start := time.Now()
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", path, srv.Listener.Addr())
+
+		b := make([]byte, 1)
+		_, err = conn.Read(b)
+		assertNil(t, err)
+		elapsed := time.Since(start)
+
+		rest, err := io.ReadAll(conn)
+		assertNil(t, err)
+		return elapsed, string(b) + string(rest)
+	}
+
+	const duration = 500 * time.Millisecond
+
+	t.Run("early", func(t *testing.T) {
+		t.Parallel()
+		elapsed, resp := firstByte(t, fmt.Sprintf("/header-timing?mode=early&duration=%s&numbytes=5", duration))
+		if elapsed >= duration/2 {
+			t.Fatalf("expected headers well before %s, got first byte after %s", duration, elapsed)
+		}
+		if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(resp, "\r\n\r\n*****") {
+			t.Fatalf("unexpected response %q", resp)
+		}
+	})
+
+	t.Run("late", func(t *testing.T) {
+		t.Parallel()
+		elapsed, resp := firstByte(t, fmt.Sprintf("/header-timing?mode=late&duration=%s&numbytes=5", duration))
+		if elapsed < duration {
+			t.Fatalf("expected headers after at least %s, got first byte after %s", duration, elapsed)
+		}
+		if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(resp, "\r\n\r\n*****") {
+			t.Fatalf("unexpected response %q", resp)
+		}
+		if !strings.Contains(resp, "Content-Length: 5\r\n") {
+			t.Fatalf("expected Content-Length header in %q", resp)
+		}
+	})
+
+	t.Run("late_honors_request_context", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), 50*time.Millisecond)
+			defer cancel()
+			app.ServeHTTP(w, r.WithContext(ctx))
+		}))
+		t.Cleanup(srv.Close)
+
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assertNil(t, err)
+		defer conn.Close()
+
+		start := time.Now()
+		fmt.Fprintf(conn, "GET /header-timing?mode=late&duration=1s HTTP/1.1\r\nHost: %s\r\n\r\n", srv.Listener.Addr())
+		resp, err := io.ReadAll(conn)
+		assertNil(t, err)
+		if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+			t.Fatalf("expected connection to close soon after the context was canceled, took %s", elapsed)
+		}
+		if len(resp) != 0 {
+			t.Fatalf("expected no response, got %q", resp)
+		}
+	})
+
+	t.Run("late_requires_http1", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/header-timing?mode=late&duration=0", nil)
+		r.ProtoMajor, r.ProtoMinor = 2, 0
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNotImplemented)
+	})
+
+	t.Run("zero_default_numbytes", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithDefaultParams(DefaultParams{DripDuration: time.Second}))
+		r, _ := http.NewRequest("GET", "/header-timing?duration=10ms", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertBodyEquals(t, w, "")
+	})
+
+	badRequestTests := []struct {
+		path  string
+		param string
+	}{
+		{"/header-timing?mode=sideways", "mode"},
+		{"/header-timing?duration=1h", "duration"},
+		{"/header-timing?duration=foo", "duration"},
+		{"/header-timing?numbytes=0", "numbytes"},
+		{"/header-timing?numbytes=foo", "numbytes"},
+	}
+	for _, test := range badRequestTests {
+		test := test
+		t.Run(test.path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, test.param)
+		})
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	t.Parallel()
+
+	const token = "selftest-token"
+
+	doSelfTest := func(t *testing.T, app *HTTPBin, token string) (*httptest.ResponseRecorder, selfTestResponse) {
+		t.Helper()
+		r, _ := http.NewRequest("POST", "/selftest", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		var resp selfTestResponse
+		if w.Code == http.StatusOK || w.Code == http.StatusInternalServerError {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body.String(), err)
+			}
+		}
+		return w, resp
+	}
+
+	t.Run("all_pass", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithSelfTestToken(token), WithSignedURLKey("key", 0))
+		w, resp := doSelfTest(t, app, token)
+
+		assertStatusCode(t, w, http.StatusOK)
+		if !resp.Passed {
+			for _, result := range resp.Results {
+				if !result.Passed {
+					t.Errorf("route %s failed: %+v", result.Route, result)
+				}
+			}
+			t.FailNow()
+		}
+
+		tested := make(map[string]bool, len(resp.Results))
+		for _, result := range resp.Results {
+			tested[result.Route] = true
+		}
+		if tested["/selftest"] {
+			t.Fatalf("selftest must not recurse into itself")
+		}
+		for _, rt := range app.routes() {
+			if rt.example != "" && !tested[rt.pattern] {
+				t.Errorf("route %s has an example but was not tested", rt.pattern)
+			}
+		}
+		if !tested["/sign"] {
+			t.Fatalf("expected optional /sign route to be exercised")
+		}
+	})
+
+	t.Run("reports_failures", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithSelfTestToken(token))
+		// Make the instance reject the example for /range
+		app.MaxBodySize = 5
+		w, resp := doSelfTest(t, app, token)
+
+		assertStatusCode(t, w, http.StatusInternalServerError)
+		if resp.Passed {
+			t.Fatalf("expected self test to fail")
+		}
+		for _, result := range resp.Results {
+			if result.Route == "/range/" {
+				if result.Passed || result.Status != http.StatusBadRequest {
+					t.Fatalf("expected /range/ to fail with 400, got %+v", result)
+				}
+				return
+			}
+		}
+		t.Fatalf("expected /range/ result in %+v", resp.Results)
+	})
+
+	t.Run("time_budget", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithSelfTestToken(token), WithMaxDuration(0))
+		w, resp := doSelfTest(t, app, token)
+
+		assertStatusCode(t, w, http.StatusInternalServerError)
+		for _, result := range resp.Results {
+			if result.Error != "self test time budget exhausted" {
+				t.Fatalf("expected every route to exhaust the time budget, got %+v", result)
+			}
+		}
+	})
+
+	t.Run("requires_token", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithSelfTestToken(token))
+		for _, given := range []string{"", "wrong"} {
+			w, _ := doSelfTest(t, app, given)
+			assertStatusCode(t, w, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		t.Parallel()
+		w, _ := doSelfTest(t, app, token)
+		assertStatusCode(t, w, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestArchive(t *testing.T) {
+	t.Parallel()
+
+	// archives count their headers and names against the body size limit,
+	// so the shared app's limit is too small for them
+	const archiveMaxBodySize = 64 * 1024
+	app := New(WithMaxBodySize(archiveMaxBodySize))
+
+	getArchive := func(t *testing.T, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	readZip := func(t *testing.T, body []byte) map[string][]byte {
+		t.Helper()
+		// Newer versions of Go may report hostile entry names as an error
+		// alongside a usable reader, depending on GODEBUG settings
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if zr == nil {
+			t.Fatalf("invalid zip archive: %s", err)
+		}
+		files := make(map[string][]byte)
+		for _, f := range zr.File {
+			if !f.Modified.Equal(archiveModTime) {
+				t.Fatalf("expected fixed mod time for %s, got %s", f.Name, f.Modified)
+			}
+			rc, err := f.Open()
+			assertNil(t, err)
+			data, err := io.ReadAll(rc)
+			assertNil(t, err)
+			rc.Close()
+			files[f.Name] = data
+		}
+		return files
+	}
+
+	readTarGz := func(t *testing.T, body []byte) map[string][]byte {
+		t.Helper()
+		gzr, err := gzip.NewReader(bytes.NewReader(body))
+		assertNil(t, err)
+		tr := tar.NewReader(gzr)
+		files := make(map[string][]byte)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if hdr == nil {
+				t.Fatalf("invalid tar archive: %s", err)
+			}
+			if !hdr.ModTime.Equal(archiveModTime) {
+				t.Fatalf("expected fixed mod time for %s, got %s", hdr.Name, hdr.ModTime)
+			}
+			data, err := io.ReadAll(tr)
+			assertNil(t, err)
+			files[hdr.Name] = data
+		}
+		return files
+	}
+
+	formats := []struct {
+		format      string
+		contentType string
+		read        func(*testing.T, []byte) map[string][]byte
+	}{
+		{"zip", "application/zip", readZip},
+		{"tar.gz", "application/gzip", readTarGz},
+	}
+	for _, f := range formats {
+		f := f
+		t.Run(f.format, func(t *testing.T) {
+			t.Parallel()
+			path := fmt.Sprintf("/archive?format=%s&files=5&file_size=100&seed=3", f.format)
+			w := getArchive(t, path)
+
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, f.contentType)
+			assertHeader(t, w, "Content-Disposition", fmt.Sprintf(`attachment; filename="archive.%s"`, f.format))
+
+			files := f.read(t, w.Body.Bytes())
+			if len(files) != 5 {
+				t.Fatalf("expected 5 files, got %d", len(files))
+			}
+			for name, data := range files {
+				if !strings.HasPrefix(name, "files/") || len(data) != 100 {
+					t.Fatalf("unexpected entry %q with %d bytes", name, len(data))
+				}
+			}
+
+			// archives are byte-for-byte reproducible given a seed
+			again := getArchive(t, path)
+			assertBytesEqual(t, again.Body.Bytes(), w.Body.Bytes())
+
+			other := getArchive(t, fmt.Sprintf("/archive?format=%s&files=5&file_size=100&seed=4", f.format))
+			if bytes.Equal(other.Body.Bytes(), w.Body.Bytes()) {
+				t.Fatalf("expected different seeds to produce different archives")
+			}
+		})
+
+		t.Run(f.format+"/hostile", func(t *testing.T) {
+			t.Parallel()
+			w := getArchive(t, fmt.Sprintf("/archive?format=%s&files=1&file_size=10&seed=3&hostile=true", f.format))
+			assertStatusCode(t, w, http.StatusOK)
+
+			files := f.read(t, w.Body.Bytes())
+			if len(files) != 3 {
+				t.Fatalf("expected 3 files, got %d", len(files))
+			}
+			if _, ok := files["../escaped.txt"]; !ok {
+				t.Fatalf("expected dot-dot entry in %v", files)
+			}
+			if _, ok := files[strings.Repeat("nested/", 64)+"deep.txt"]; !ok {
+				t.Fatalf("expected deeply nested entry in %v", files)
+			}
+		})
+	}
+
+	t.Run("size_bound", func(t *testing.T) {
+		t.Parallel()
+		for _, format := range []string{"zip", "tar.gz"} {
+			for _, hostile := range []bool{false, true} {
+				for _, p := range []struct{ files, fileSize int }{{1, 0}, {1, 1}, {3, 511}, {10, 512}, {100, 0}, {150, 1000}, {1000, 7}} {
+					var buf bytes.Buffer
+					write := writeZip
+					if format == "tar.gz" {
+						write = writeTarGz
+					}
+					entries := generateArchiveEntries(rand.New(rand.NewSource(1)), p.files, p.fileSize, hostile)
+					assertNil(t, write(&buf, entries))
+					if bound := archiveSize(format, p.files, p.fileSize, hostile); int64(buf.Len()) > bound {
+						t.Fatalf("%s archive of %d files of %d bytes (hostile=%v) is %d bytes, exceeding its bound of %d", format, p.files, p.fileSize, hostile, buf.Len(), bound)
+					}
+				}
+			}
+		}
+	})
+
+	badRequestTests := []struct {
+		path  string
+		param string
+	}{
+		{"/archive?format=rar", "format"},
+		{"/archive?files=0", "files"},
+		{"/archive?files=foo", "files"},
+		{"/archive?file_size=-1", "file_size"},
+		{"/archive?file_size=foo", "file_size"},
+		{"/archive?seed=foo", "seed"},
+		{fmt.Sprintf("/archive?files=2&file_size=%d", archiveMaxBodySize), "file_size"},
+		{fmt.Sprintf("/archive?files=1&file_size=%d", archiveMaxBodySize+1), "file_size"},
+		{fmt.Sprintf("/archive?files=%d&file_size=0", maxArchiveFiles+1), "files"},
+		{"/archive?files=2000000&file_size=0", "files"},
+		// headers and names alone exceed the limit
+		{"/archive?files=1000&file_size=0", "file_size"},
+		{"/archive?format=tar.gz&files=200&file_size=0", "file_size"},
+		// the data fits, but not with the headers and names
+		{fmt.Sprintf("/archive?files=1&file_size=%d", archiveMaxBodySize-50), "file_size"},
+	}
+	for _, test := range badRequestTests {
+		test := test
+		t.Run(test.path, func(t *testing.T) {
+			t.Parallel()
+			w := getArchive(t, test.path)
+			assertParamError(t, w, test.param)
+		})
+	}
+}
+
+func TestHeaderCase(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	rawResponse := func(t *testing.T, path string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assertNil(t, err)
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, srv.Listener.Addr())
+		raw, err := io.ReadAll(conn)
+		assertNil(t, err)
+		return string(raw)
+	}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{
+			"",
+			"HTTP/1.1 200 OK\r\nx-custom-header: go-httpbin\r\ncontent-type: text/plain; charset=utf-8\r\ncontent-length: 3\r\nconnection: close\r\n\r\nok\n",
+		},
+		{
+			"?name=X-Foo-Bar&casing=upper&value=baz",
+			"HTTP/1.1 200 OK\r\nX-FOO-BAR: baz\r\nCONTENT-TYPE: text/plain; charset=utf-8\r\nCONTENT-LENGTH: 3\r\nCONNECTION: close\r\n\r\nok\n",
+		},
+		{
+			"?casing=mixed&order=last",
+			"HTTP/1.1 200 OK\r\ncOnTeNt-TyPe: text/plain; charset=utf-8\r\ncOnTeNt-LeNgTh: 3\r\ncOnNeCtIoN: close\r\nx-CuStOm-HeAdEr: go-httpbin\r\n\r\nok\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run("wire"+test.query, func(t *testing.T) {
+			t.Parallel()
+			got := rawResponse(t, "/header-case"+test.query)
+			if got != test.expected {
+				t.Fatalf("expected raw response\n%q\ngot\n%q", test.expected, got)
+			}
+
+			// the JSON format documents exactly what is sent on the wire
+			sep := "?"
+			if test.query != "" {
+				sep = "&"
+			}
+			r, _ := http.NewRequest("GET", "/header-case"+test.query+sep+"format=json", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+
+			var resp headerCaseResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body.String(), err)
+			}
+			if resp.Raw != test.expected {
+				t.Fatalf("expected raw field\n%q\ngot\n%q", test.expected, resp.Raw)
+			}
+			assertIntEqual(t, len(resp.Headers), 4)
+		})
+	}
+
+	t.Run("requires_http1", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/header-case", nil)
+		r.ProtoMajor, r.ProtoMinor = 2, 0
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNotImplemented)
+	})
+
+	badRequestTests := []string{
+		"/header-case?casing=title",
+		"/header-case?order=middle",
+		"/header-case?name=bad%20name",
+		"/header-case?value=a%0d%0aInjected:%20true",
+	}
+	for _, path := range badRequestTests {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestStreamBursts(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	type timedLine struct {
+		at   time.Duration
+		line string
+	}
+
+	// readTimedLines reads every line of the response to the given path,
+	// timestamping each relative to the start of the request.
+	readTimedLines := func(t *testing.T, path string) []timedLine {
+		t.Helper()
+		start := time.Now()
+		resp, err := http.Get(srv.URL + path)
+		assertNil(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+
+		var lines []timedLine
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines = append(lines, timedLine{time.Since(start), scanner.Text()})
+		}
+		assertNil(t, scanner.Err())
+		return lines
+	}
+
+	const interval = 200 * time.Millisecond
+
+	t.Run("clustering", func(t *testing.T) {
+		t.Parallel()
+		lines := readTimedLines(t, fmt.Sprintf("/stream/9?shape=burst&burst_size=3&burst_interval=%s", interval))
+		assertIntEqual(t, len(lines), 9)
+
+		for i := 1; i < len(lines); i++ {
+			gap := lines[i].at - lines[i-1].at
+			if i%3 == 0 {
+				if gap < interval*3/4 {
+					t.Fatalf("expected idle gap of ~%s before line %d, got %s", interval, i, gap)
+				}
+			} else if gap > interval/4 {
+				t.Fatalf("expected line %d to arrive in the same burst, got gap of %s", i, gap)
+			}
+		}
+	})
+
+	t.Run("count_limits_bursts", func(t *testing.T) {
+		t.Parallel()
+		lines := readTimedLines(t, "/stream/50?shape=burst&burst_size=4&burst_interval=10ms&count=2")
+		assertIntEqual(t, len(lines), 8)
+	})
+
+	t.Run("keepalives", func(t *testing.T) {
+		t.Parallel()
+		lines := readTimedLines(t, fmt.Sprintf("/stream/4?shape=burst&burst_size=2&burst_interval=%s&keepalive=50ms", interval))
+
+		var messages, keepalives int
+		for _, l := range lines {
+			if l.line == "" {
+				keepalives++
+			} else {
+				messages++
+			}
+		}
+		assertIntEqual(t, messages, 4)
+		if keepalives < 2 {
+			t.Fatalf("expected keepalives during idle period, got %d", keepalives)
+		}
+	})
+
+	badRequestTests := []string{
+		"/stream/10?shape=wobbly",
+		"/stream/10?shape=burst&burst_size=0",
+		"/stream/10?shape=burst&burst_interval=foo",
+		"/stream/10?shape=burst&count=0",
+		"/stream/10?shape=burst&keepalive=0",
+		"/stream/10?shape=burst&burst_interval=1h",
+		// 10 bursts of 1 line with 9 idle periods of 500ms exceeds MaxDuration
+		"/stream/10?shape=burst&burst_size=1&burst_interval=500ms",
+	}
+	for _, path := range badRequestTests {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestStreamingClientDisconnect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		path     string
+		intended int64
+	}{
+		{"/drip?duration=5s&numbytes=50", 50},
+		{"/header-timing?duration=5s&numbytes=50", 50},
+		{"/stream/20?shape=burst&burst_size=1&burst_interval=500ms&keepalive=10ms", -1},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.path, func(t *testing.T) {
+			t.Parallel()
+
+			results := make(chan Result, 1)
+			app := New(
+				WithMaxDuration(10*time.Second),
+				WithObserver(func(r Result) { results <- r }),
+			)
+			srv := httptest.NewServer(app)
+			t.Cleanup(srv.Close)
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			assertNil(t, err)
+			fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", test.path, srv.Listener.Addr())
+
+			// read the headers and the first part of the body, then hang up
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			assertNil(t, err)
+			_, err = resp.Body.Read(make([]byte, 1))
+			assertNil(t, err)
+			conn.Close()
+
+			select {
+			case result := <-results:
+				intended, err := strconv.ParseInt(result.Annotations["bytes_intended"], 10, 64)
+				assertNil(t, err)
+				if test.intended >= 0 && intended != test.intended {
+					t.Fatalf("expected bytes_intended=%d, got %d", test.intended, intended)
+				}
+				if result.Size < 1 || result.Size >= intended {
+					t.Fatalf("expected partial delivery of %d intended bytes, got %d", intended, result.Size)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("handler did not exit promptly after client disconnect")
+			}
+		})
+	}
+
+	t.Run("write_error", func(t *testing.T) {
+		t.Parallel()
+
+		// Simulate a connection that fails after the first write, without
+		// the request context being cancelled
+		var result Result
+		app := New(WithObserver(func(r Result) { result = r }))
+		r, _ := http.NewRequest("GET", "/stream-bytes/100?chunk_size=10", nil)
+		w := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder(), failAfter: 1}
+
+		done := make(chan struct{})
+		go func() {
+			app.ServeHTTP(w, r)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("handler did not exit promptly after write error")
+		}
+
+		if result.Size != 10 {
+			t.Fatalf("expected 10 bytes delivered, got %d", result.Size)
+		}
+		if result.Annotations["bytes_intended"] != "100" {
+			t.Fatalf("expected bytes_intended=100, got %v", result.Annotations)
+		}
+		if result.Annotations["write_error"] == "" {
+			t.Fatalf("expected write_error annotation, got %v", result.Annotations)
+		}
+	})
+}
+
+// failingResponseWriter is a ResponseRecorder whose writes start failing
+// after a given number of successful writes.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	failAfter int
+	writes    int
+}
+
+func (w *failingResponseWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if w.writes > w.failAfter {
+		return 0, errors.New("connection reset by peer")
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestAdminAPI(t *testing.T) {
+	t.Parallel()
+
+	const token = "admin-token"
+
+	doAdmin := func(t *testing.T, app *HTTPBin, method, path, token, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("get_settings", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithAdminAPI(token), WithDefaultParams(testDefaultParams))
+		w := doAdmin(t, app, "GET", "/admin/settings", token, "")
+
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		var resp adminSettingsResponse
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		if resp != newAdminSettingsResponse(&runtimeSettings{DefaultParams: testDefaultParams}) {
+			t.Fatalf("unexpected settings %+v", resp)
+		}
+	})
+
+	t.Run("exported defaults apply until overridden", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithAdminAPI(token))
+		app.DefaultParams = testDefaultParams
+
+		w := doAdmin(t, app, "GET", "/admin/settings", token, "")
+		assertStatusCode(t, w, http.StatusOK)
+		var resp adminSettingsResponse
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		if resp != newAdminSettingsResponse(&runtimeSettings{DefaultParams: testDefaultParams}) {
+			t.Fatalf("expected settings to reflect DefaultParams set after New, got %+v", resp)
+		}
+
+		w = doAdmin(t, app, "PUT", "/admin/settings", token, `{"drip_numbytes": 7}`)
+		assertStatusCode(t, w, http.StatusOK)
+		app.DefaultParams = DefaultDefaultParams
+		want := testDefaultParams
+		want.DripNumBytes = 7
+		if got := app.currentSettings().DefaultParams; got != want {
+			t.Fatalf("expected admin override %+v to take precedence, got %+v", want, got)
+		}
+	})
+
+	t.Run("put_settings", func(t *testing.T) {
+		t.Parallel()
+		var results []Result
+		app := New(
+			WithAdminAPI(token),
+			WithMaxDuration(time.Minute),
+			WithObserver(func(r Result) { results = append(results, r) }),
+		)
+
+		w := doAdmin(t, app, "PUT", "/admin/settings", token, `{"drip_duration": "100ms", "drip_delay": "0s"}`)
+		assertStatusCode(t, w, http.StatusOK)
+		assertBodyContains(t, w, `"drip_duration": "100ms"`)
+
+		// untouched settings are preserved
+		assertIntEqual(t, int(app.currentSettings().DefaultParams.DripNumBytes), int(DefaultDefaultParams.DripNumBytes))
+
+		// the new defaults take effect immediately
+		r, _ := http.NewRequest("GET", "/drip", nil)
+		w = httptest.NewRecorder()
+		start := time.Now()
+		app.ServeHTTP(w, r)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("expected new drip defaults to apply, request took %s", elapsed)
+		}
+
+		if results[0].Annotations["admin_action"] != "update_settings" {
+			t.Fatalf("expected audit annotation, got %v", results[0].Annotations)
+		}
+		if !strings.Contains(results[0].Annotations["admin_settings"], `"drip_duration":"100ms"`) {
+			t.Fatalf("expected new settings in audit annotation, got %v", results[0].Annotations)
+		}
+	})
+
+	t.Run("put_invalid_settings", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithAdminAPI(token))
+		for _, body := range []string{
+			`not json`,
+			`{"drip_duration": "forever"}`,
+			`{"drip_delay": "1h"}`,
+			`{"drip_numbytes": 0}`,
+		} {
+			w := doAdmin(t, app, "PUT", "/admin/settings", token, body)
+			assertStatusCode(t, w, http.StatusBadRequest)
+		}
+		if *app.currentSettings() != (runtimeSettings{DefaultParams: DefaultDefaultParams}) {
+			t.Fatalf("expected invalid updates to leave settings unchanged, got %+v", app.currentSettings())
+		}
+	})
+
+	t.Run("concurrent_updates", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithAdminAPI(token))
+
+		var wg sync.WaitGroup
+		for i := 1; i <= 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				doAdmin(t, app, "PUT", "/admin/settings", token, fmt.Sprintf(`{"drip_numbytes": %d}`, i))
+				doAdmin(t, app, "GET", "/drip?duration=0&delay=0", "", "")
+			}(i)
+		}
+		wg.Wait()
+
+		if n := app.currentSettings().DefaultParams.DripNumBytes; n < 1 || n > 20 {
+			t.Fatalf("unexpected drip_numbytes after concurrent updates: %d", n)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithAdminAPI(token))
+		var resets int
+		app.resetters = append(app.resetters, func() { resets++ }, func() { resets++ })
+
+		w := doAdmin(t, app, "POST", "/admin/reset", token, "")
+		assertStatusCode(t, w, http.StatusOK)
+		assertBodyEquals(t, w, fmt.Sprintf("{\n  \"reset\": %d\n}\n", len(app.resetters)))
+		assertIntEqual(t, resets, 2)
+	})
+
+	t.Run("bad_token", func(t *testing.T) {
+		t.Parallel()
+		var results []Result
+		app := New(WithAdminAPI(token), WithObserver(func(r Result) { results = append(results, r) }))
+
+		for _, given := range []string{"", "wrong", token + "x"} {
+			for _, req := range []struct{ method, path string }{
+				{"GET", "/admin/settings"},
+				{"PUT", "/admin/settings"},
+				{"POST", "/admin/reset"},
+			} {
+				w := doAdmin(t, app, req.method, req.path, given, `{"drip_numbytes": 1}`)
+				assertStatusCode(t, w, http.StatusUnauthorized)
+				assertHeader(t, w, "WWW-Authenticate", "Bearer")
+			}
+		}
+		if results[0].Annotations["admin_auth"] != "rejected" {
+			t.Fatalf("expected rejected auth to be annotated, got %v", results[0].Annotations)
+		}
+		if app.currentSettings().DefaultParams.DripNumBytes != DefaultDefaultParams.DripNumBytes {
+			t.Fatalf("expected unauthorized update to be rejected")
+		}
+	})
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		t.Parallel()
+		w := doAdmin(t, app, "GET", "/admin/settings", token, "")
+		assertStatusCode(t, w, http.StatusNotFound)
+	})
+}
+
+func TestSOAP(t *testing.T) {
+	t.Parallel()
+
+	const (
+		ns11 = "http://schemas.xmlsoap.org/soap/envelope/"
+		ns12 = "http://www.w3.org/2003/05/soap-envelope"
+	)
+	envelope := func(ns string) string {
+		return `<?xml version="1.0"?><soap:Envelope xmlns:soap="` + ns + `"><soap:Body><Ping/></soap:Body></soap:Envelope>`
+	}
+
+	doSOAP := func(t *testing.T, path, contentType, body string, headers map[string]string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("soap11_echo", func(t *testing.T) {
+		t.Parallel()
+		body := envelope(ns11)
+		w := doSOAP(t, "/soap", "text/xml; charset=utf-8", body, map[string]string{
+			"SOAPAction": `"urn:ping"`,
+			"X-Test":     "a<b",
+		})
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, "text/xml; charset=utf-8")
+		digest := sha256.Sum256([]byte(body))
+		assertBodyContains(t, w, `<soap:Envelope xmlns:soap="`+ns11+`">`)
+		assertBodyContains(t, w, `<SOAPAction>urn:ping</SOAPAction>`)
+		assertBodyContains(t, w, `<BodySHA256>`+hex.EncodeToString(digest[:])+`</BodySHA256>`)
+		assertBodyContains(t, w, `<Header name="X-Test">a&lt;b</Header>`)
+		if err := parseSOAPEnvelope(w.Body.Bytes(), soap11); err != nil {
+			t.Fatalf("response is not a valid SOAP envelope: %s", err)
+		}
+	})
+
+	t.Run("soap12_echo", func(t *testing.T) {
+		t.Parallel()
+		w := doSOAP(t, "/soap", `application/soap+xml; charset=utf-8; action="urn:ping12"`, envelope(ns12), nil)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, "application/soap+xml; charset=utf-8")
+		assertBodyContains(t, w, `<soap:Envelope xmlns:soap="`+ns12+`">`)
+		assertBodyContains(t, w, `<SOAPAction>urn:ping12</SOAPAction>`)
+	})
+
+	faultTests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantFault   string
+	}{
+		{"soap11_malformed", "/soap", "text/xml", "<soap:Envelope", http.StatusInternalServerError, "<faultcode>soap:Client</faultcode>"},
+		{"soap11_missing_body", "/soap", "text/xml", `<soap:Envelope xmlns:soap="` + ns11 + `"/>`, http.StatusInternalServerError, "<faultcode>soap:Client</faultcode>"},
+		{"soap11_wrong_namespace", "/soap", "text/xml", envelope(ns12), http.StatusInternalServerError, "<faultcode>soap:Client</faultcode>"},
+		{"soap11_forced_client", "/soap?fault=client", "text/xml", envelope(ns11), http.StatusInternalServerError, "<faultcode>soap:Client</faultcode>"},
+		{"soap11_forced_server", "/soap?fault=server", "text/xml", envelope(ns11), http.StatusInternalServerError, "<faultcode>soap:Server</faultcode>"},
+		{"soap12_malformed", "/soap", "application/soap+xml", "<a><b></a>", http.StatusBadRequest, "<soap:Value>soap:Sender</soap:Value>"},
+		{"soap12_forced_client", "/soap?fault=client", "application/soap+xml", envelope(ns12), http.StatusBadRequest, "<soap:Value>soap:Sender</soap:Value>"},
+		{"soap12_forced_server", "/soap?fault=server", "application/soap+xml", envelope(ns12), http.StatusInternalServerError, "<soap:Value>soap:Receiver</soap:Value>"},
+	}
+	for _, test := range faultTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			w := doSOAP(t, test.path, test.contentType, test.body, nil)
+			assertStatusCode(t, w, test.wantStatus)
+			if strings.HasPrefix(test.contentType, "text/xml") {
+				assertContentType(t, w, "text/xml; charset=utf-8")
+				assertBodyContains(t, w, "<faultstring>")
+			} else {
+				assertContentType(t, w, "application/soap+xml; charset=utf-8")
+				assertBodyContains(t, w, "<soap:Reason>")
+			}
+			assertBodyContains(t, w, test.wantFault)
+		})
+	}
+
+	t.Run("unsupported_media_type", func(t *testing.T) {
+		t.Parallel()
+		w := doSOAP(t, "/soap", "application/json", "{}", nil)
+		assertStatusCode(t, w, http.StatusUnsupportedMediaType)
+		assertContentType(t, w, jsonContentType)
+		assertBodyContains(t, w, "must be text/xml or application/soap+xml")
+	})
+
+	t.Run("invalid_fault", func(t *testing.T) {
+		t.Parallel()
+		w := doSOAP(t, "/soap?fault=bogus", "text/xml", envelope(ns11), nil)
+		assertParamError(t, w, "fault")
+	})
+
+	t.Run("method_not_allowed", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/soap", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestRedirectLoop(t *testing.T) {
+	t.Parallel()
+
+	t.Run("follows_loop", func(t *testing.T) {
+		t.Parallel()
+
+		srv := httptest.NewServer(app)
+		t.Cleanup(srv.Close)
+
+		var hops []string
+		client := &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				hops = append(hops, req.URL.Path)
+				if len(via) >= 7 {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+		}
+		resp, err := client.Get(srv.URL + "/redirect-loop?via=x,y")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("expected client to stop on a redirect, got %d", resp.StatusCode)
+		}
+		assertHeader(t, resp, "X-Redirect-Hop", "6")
+		want := []string{
+			"/redirect-loop/x", "/redirect-loop/y", "/redirect-loop/x", "/redirect-loop/y",
+			"/redirect-loop/x", "/redirect-loop/y", "/redirect-loop/x",
+		}
+		if !reflect.DeepEqual(hops, want) {
+			t.Fatalf("expected hops %v, got %v", want, hops)
+		}
+	})
+
+	okTests := []struct {
+		url          string
+		wantStatus   int
+		wantHop      string
+		wantLocation string
+	}{
+		{"/redirect-loop", http.StatusFound, "0", "/redirect-loop/a?hop=1&status=302&via=a%2Cb%2Cc"},
+		{"/redirect-loop?status=301", http.StatusMovedPermanently, "0", "/redirect-loop/a?hop=1&status=301&via=a%2Cb%2Cc"},
+		{"/redirect-loop/b?hop=5&status=308", http.StatusPermanentRedirect, "5", "/redirect-loop/c?hop=6&status=308&via=a%2Cb%2Cc"},
+		{"/redirect-loop/c?hop=6", http.StatusFound, "6", "/redirect-loop/a?hop=7&status=302&via=a%2Cb%2Cc"},
+		{"/redirect-loop/only?via=only&hop=1", http.StatusFound, "1", "/redirect-loop/only?hop=2&status=302&via=only"},
+	}
+	for _, test := range okTests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.wantStatus)
+			assertHeader(t, w, "X-Redirect-Hop", test.wantHop)
+			assertHeader(t, w, "Location", test.wantLocation)
+		})
+	}
+
+	badTests := []struct {
+		url        string
+		wantStatus int
+	}{
+		{"/redirect-loop?status=200", http.StatusBadRequest},
+		{"/redirect-loop?status=304", http.StatusBadRequest},
+		{"/redirect-loop?status=foo", http.StatusBadRequest},
+		{"/redirect-loop?via=a,,b", http.StatusBadRequest},
+		{"/redirect-loop?via=a/b", http.StatusBadRequest},
+		{"/redirect-loop?via=" + strings.Repeat("a,", maxRedirectLoopHops) + "a", http.StatusBadRequest},
+		{"/redirect-loop/a", http.StatusBadRequest},
+		{"/redirect-loop/a?hop=0", http.StatusBadRequest},
+		{"/redirect-loop/z?hop=1", http.StatusNotFound},
+		{"/redirect-loop/a/b?hop=1", http.StatusNotFound},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run("bad"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.wantStatus)
+		})
+	}
+}
+
+func TestSizes(t *testing.T) {
+	t.Parallel()
+
+	okTests := []struct {
+		url      string
+		wantSize int
+	}{
+		{"/sizes?buckets=10", 10},
+		{"/sizes?buckets=0", 0},
+		{"/sizes?buckets=1k", 1024},
+		{"/sizes?buckets=100:0,200:1", 200},
+		{"/sizes?buckets=100:1,200:0&pick=random", 100},
+		// capped at MaxBodySize
+		{"/sizes?buckets=1m", 1024},
+	}
+	for _, test := range okTests {
+		test := test
+		t.Run("ok"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, "application/octet-stream")
+			assertHeader(t, w, "X-Chosen-Size", strconv.Itoa(test.wantSize))
+			assertHeader(t, w, "Content-Length", strconv.Itoa(test.wantSize))
+			if w.Body.Len() != test.wantSize {
+				t.Fatalf("expected %d bytes, got %d", test.wantSize, w.Body.Len())
+			}
+		})
+	}
+
+	t.Run("deterministic_with_seed", func(t *testing.T) {
+		t.Parallel()
+		get := func() *httptest.ResponseRecorder {
+			r, _ := http.NewRequest("GET", "/sizes?buckets=1,10,100,1000&seed=1234", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+			return w
+		}
+		w1, w2 := get(), get()
+		assertHeader(t, w2, "X-Chosen-Size", w1.Header().Get("X-Chosen-Size"))
+		if !bytes.Equal(w1.Body.Bytes(), w2.Body.Bytes()) {
+			t.Fatalf("expected identical bodies for the same seed")
+		}
+	})
+
+	t.Run("weighted_distribution", func(t *testing.T) {
+		t.Parallel()
+		buckets, err := parseSizeBuckets("1:0.25,2:0.75")
+		assertNil(t, err)
+		rng := rand.New(rand.NewSource(1))
+		counts := map[int64]int{}
+		for i := 0; i < 10000; i++ {
+			counts[pickSizeBucket(rng, buckets)]++
+		}
+		if counts[1] < 2200 || counts[1] > 2800 {
+			t.Fatalf("expected ~25%% of picks to be size 1, got %v", counts)
+		}
+	})
+
+	t.Run("large_sizes_are_chunked", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxBodySize(1024 * 1024))
+		r, _ := http.NewRequest("GET", "/sizes?buckets=1m&seed=1", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "X-Chosen-Size", "1048576")
+		if w.Body.Len() != 1024*1024 {
+			t.Fatalf("expected 1MiB body, got %d bytes", w.Body.Len())
+		}
+	})
+
+	badTests := []struct {
+		url   string
+		param string
+	}{
+		{"/sizes", "buckets"},
+		{"/sizes?buckets=", "buckets"},
+		{"/sizes?buckets=foo", "buckets"},
+		{"/sizes?buckets=-1", "buckets"},
+		{"/sizes?buckets=1x", "buckets"},
+		{"/sizes?buckets=1k:foo", "buckets"},
+		{"/sizes?buckets=1k:-1", "buckets"},
+		{"/sizes?buckets=1k:0,2k:0", "buckets"},
+		{"/sizes?buckets=1k,,2k", "buckets"},
+		{"/sizes?buckets=99999999999999999g", "buckets"},
+		{"/sizes?buckets=1k&pick=cycle", "pick"},
+		{"/sizes?buckets=1k&seed=foo", "seed"},
+		{"/sizes?buckets=" + strings.Repeat("1,", maxSizeBuckets) + "1", "buckets"},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run("bad"+test.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", test.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertParamError(t, w, test.param)
+		})
+	}
+}
+
+func TestPage(t *testing.T) {
+	t.Parallel()
+
+	const params = "assets=6&sizes=16-256&latency=0-20ms&seed=42"
+
+	getManifest := func(t *testing.T, query string) pageManifestResponse {
+		t.Helper()
+		r, _ := http.NewRequest("GET", "/page/manifest?"+query, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		var resp pageManifestResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	t.Run("page references manifest assets", func(t *testing.T) {
+		t.Parallel()
+		manifest := getManifest(t, params)
+		if len(manifest.Assets) != 6 {
+			t.Fatalf("expected 6 assets, got %d", len(manifest.Assets))
+		}
+
+		r, _ := http.NewRequest("GET", "/page?"+params, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, htmlContentType)
+		for _, a := range manifest.Assets {
+			assertBodyContains(t, w, html.EscapeString(a.URL))
+			if a.Size < 16 || a.Size > 256 {
+				t.Errorf("asset %d size %d outside of range", a.ID, a.Size)
+			}
+			if a.LatencyMS < 0 || a.LatencyMS > 20 {
+				t.Errorf("asset %d latency %vms outside of range", a.ID, a.LatencyMS)
+			}
+			if !a.Cacheable {
+				t.Errorf("expected asset %d to be cacheable by default", a.ID)
+			}
+		}
+		assertBodyContains(t, w, "<link rel=\"stylesheet\"")
+		assertBodyContains(t, w, "<script src=")
+		assertBodyContains(t, w, "<img src=")
+	})
+
+	t.Run("deterministic under seed", func(t *testing.T) {
+		t.Parallel()
+		a, b := getManifest(t, params), getManifest(t, params)
+		if !reflect.DeepEqual(a, b) {
+			t.Fatalf("expected identical manifests, got %#v and %#v", a, b)
+		}
+		c := getManifest(t, "assets=6&sizes=16-256&latency=0-20ms&seed=43")
+		if reflect.DeepEqual(a.Assets, c.Assets) {
+			t.Fatalf("expected different seeds to give different assets")
+		}
+	})
+
+	t.Run("unseeded page passes its seed to assets", func(t *testing.T) {
+		t.Parallel()
+		manifest := getManifest(t, "assets=2")
+		r, _ := http.NewRequest("GET", manifest.PageURL, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertBodyContains(t, w, fmt.Sprintf("seed=%d", manifest.Seed))
+	})
+
+	t.Run("assets match manifest", func(t *testing.T) {
+		t.Parallel()
+		for _, a := range getManifest(t, params).Assets {
+			r, _ := http.NewRequest("GET", a.URL, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, a.ContentType)
+			assertHeader(t, w, "Content-Length", strconv.FormatInt(a.Size, 10))
+			if int64(w.Body.Len()) != a.Size {
+				t.Errorf("asset %d: expected %d bytes, got %d", a.ID, a.Size, w.Body.Len())
+			}
+		}
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		t.Parallel()
+		start := time.Now()
+		r, _ := http.NewRequest("GET", "/page/asset/0?assets=1&sizes=16&latency=50ms&seed=1", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Fatalf("expected asset to take at least 50ms, took %s", elapsed)
+		}
+	})
+
+	t.Run("half cacheable", func(t *testing.T) {
+		t.Parallel()
+		query := "assets=4&sizes=16-64&latency=0&cacheable=half&seed=1"
+		for _, a := range getManifest(t, query).Assets {
+			r, _ := http.NewRequest("GET", a.URL, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusOK)
+
+			if a.Cacheable != (a.ID%2 == 0) {
+				t.Fatalf("expected only even assets to be cacheable, got %+v", a)
+			}
+			if !a.Cacheable {
+				assertHeader(t, w, "Cache-Control", "no-store")
+				assertHeader(t, w, "ETag", "")
+				continue
+			}
+			assertHeader(t, w, "Cache-Control", "public, max-age=3600")
+			etag := w.Header().Get("ETag")
+			if etag == "" {
+				t.Fatalf("expected ETag on cacheable asset %d", a.ID)
+			}
+
+			r, _ = http.NewRequest("GET", a.URL, nil)
+			r.Header.Set("If-None-Match", etag)
+			w = httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotModified)
+			assertBodyEquals(t, w, "")
+		}
+	})
+
+	t.Run("defaults fit instance limits", func(t *testing.T) {
+		t.Parallel()
+		for _, a := range getManifest(t, "seed=1").Assets {
+			if a.Size > maxBodySize {
+				t.Errorf("asset %d size %d exceeds max body size", a.ID, a.Size)
+			}
+		}
+	})
+
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{"/page?assets=0", http.StatusBadRequest},
+		{"/page?assets=101", http.StatusBadRequest},
+		{"/page?sizes=foo", http.StatusBadRequest},
+		{"/page?sizes=200-100", http.StatusBadRequest},
+		{fmt.Sprintf("/page?sizes=1-%d", maxBodySize+1), http.StatusBadRequest},
+		{"/page?sizes=16&latency=2s", http.StatusBadRequest},
+		{"/page?sizes=16&latency=80-10ms", http.StatusBadRequest},
+		{"/page?sizes=16&latency=foo", http.StatusBadRequest},
+		{"/page?sizes=16&cacheable=some", http.StatusBadRequest},
+		{"/page?sizes=16&seed=foo", http.StatusBadRequest},
+		{"/page/manifest?assets=foo", http.StatusBadRequest},
+		{"/page/asset/2?assets=2&sizes=16", http.StatusNotFound},
+		{"/page/asset/-1?sizes=16", http.StatusNotFound},
+		{"/page/asset/foo?sizes=16", http.StatusNotFound},
+		{"/page/asset/0/extra?sizes=16", http.StatusNotFound},
+		{"/page/asset/0?latency=5s", http.StatusBadRequest},
+	} {
+		tc := tc
+		t.Run("bad"+tc.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", tc.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, tc.code)
+		})
+	}
+}
+
+func TestSplitUnitRange(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		raw, lo, hi string
+	}{
+		{"5k-200k", "5k", "200k"},
+		{"10-80ms", "10ms", "80ms"},
+		{"0.5-2s", "0.5s", "2s"},
+		{"10ms-1s", "10ms", "1s"},
+		{"1k", "1k", "1k"},
+		{"-5ms", "-5ms", "-5ms"},
+	} {
+		lo, hi := splitUnitRange(tc.raw)
+		if lo != tc.lo || hi != tc.hi {
+			t.Errorf("splitUnitRange(%q) = %q, %q, want %q, %q", tc.raw, lo, hi, tc.lo, tc.hi)
+		}
+	}
+}
+
+func TestAsteriskOptions(t *testing.T) {
+	t.Parallel()
+
+	t.Run("handler", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithSelfTestToken("secret"), WithServerTiming())
+		r, _ := http.NewRequest("OPTIONS", "*", nil)
+		r.RequestURI = "*"
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNoContent)
+		assertHeader(t, w, "Allow", "GET, POST, HEAD, PUT, DELETE, PATCH, OPTIONS")
+		assertHeader(t, w, "X-Server-Capabilities", "selftest, server-timing")
+		assertBodyEquals(t, w, "")
+	})
+
+	t.Run("no_capabilities", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("OPTIONS", "*", nil)
+		r.RequestURI = "*"
+		w := httptest.NewRecorder()
+		New().ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNoContent)
+		if _, ok := w.Header()["X-Server-Capabilities"]; ok {
+			t.Fatalf("expected no X-Server-Capabilities header, got %q", w.Header().Get("X-Server-Capabilities"))
+		}
+	})
+
+	t.Run("path_options_unaffected", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("OPTIONS", "/get", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "Access-Control-Allow-Methods", "GET, POST, HEAD, PUT, DELETE, PATCH, OPTIONS")
+	})
+
+	t.Run("raw_request", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewUnstartedServer(New(WithAdminAPI("secret")))
+		if !canServeAsteriskOptions(srv.Config) {
+			t.Skip("net/http answers OPTIONS * itself before Go 1.20")
+		}
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+		}
+		assertHeader(t, resp, "Allow", "GET, POST, HEAD, PUT, DELETE, PATCH, OPTIONS")
+		assertHeader(t, resp, "X-Server-Capabilities", "admin-api")
+	})
+}
+
+func TestPaginate(t *testing.T) {
+	t.Parallel()
+
+	doPaginate := func(t *testing.T, url string) (*httptest.ResponseRecorder, paginateResponse) {
+		t.Helper()
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		var resp paginateResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
+			}
+		}
+		return w, resp
+	}
+	ids := func(items []paginateItem) []int {
+		out := make([]int, 0, len(items))
+		for _, item := range items {
+			out = append(out, item.ID)
+		}
+		return out
+	}
+
+	t.Run("page", func(t *testing.T) {
+		t.Parallel()
+		w, resp := doPaginate(t, "/paginate?total=250&page_size=25&page=3")
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		if resp.Style != "page" || resp.Page != 3 || resp.PageSize != 25 || *resp.Total != 250 || *resp.TotalPages != 10 {
+			t.Fatalf("unexpected response metadata: %+v", resp)
+		}
+		if len(resp.Items) != 25 || resp.Items[0] != (paginateItem{ID: 51, Name: "item-51"}) {
+			t.Fatalf("unexpected items: %+v", resp.Items)
+		}
+		assertHeader(t, w, "Link", strings.Join([]string{
+			`</paginate?page=1&page_size=25&total=250>; rel="first"`,
+			`</paginate?page=2&page_size=25&total=250>; rel="prev"`,
+			`</paginate?page=4&page_size=25&total=250>; rel="next"`,
+			`</paginate?page=10&page_size=25&total=250>; rel="last"`,
+		}, ", "))
+	})
+
+	t.Run("page_last_partial", func(t *testing.T) {
+		t.Parallel()
+		w, resp := doPaginate(t, "/paginate?total=23&page_size=10&page=3")
+		assertStatusCode(t, w, http.StatusOK)
+		if !reflect.DeepEqual(ids(resp.Items), []int{21, 22, 23}) {
+			t.Fatalf("unexpected items: %v", ids(resp.Items))
+		}
+		assertHeader(t, w, "Link", `</paginate?page=1&page_size=10&total=23>; rel="first", </paginate?page=2&page_size=10&total=23>; rel="prev", </paginate?page=3&page_size=10&total=23>; rel="last"`)
+	})
+
+	t.Run("page_empty", func(t *testing.T) {
+		t.Parallel()
+		w, resp := doPaginate(t, "/paginate?total=0")
+		assertStatusCode(t, w, http.StatusOK)
+		if len(resp.Items) != 0 || *resp.Total != 0 || *resp.TotalPages != 0 {
+			t.Fatalf("unexpected response: %+v", resp)
+		}
+		assertBodyContains(t, w, `"items": []`)
+	})
+
+	t.Run("offset", func(t *testing.T) {
+		t.Parallel()
+		w, resp := doPaginate(t, "/paginate?style=offset&total=250&offset=245&limit=10")
+		assertStatusCode(t, w, http.StatusOK)
+		if resp.Style != "offset" || *resp.Offset != 245 || resp.Limit != 10 || *resp.Total != 250 {
+			t.Fatalf("unexpected response metadata: %+v", resp)
+		}
+		if !reflect.DeepEqual(ids(resp.Items), []int{246, 247, 248, 249, 250}) {
+			t.Fatalf("unexpected items: %v", ids(resp.Items))
+		}
+	})
+
+	t.Run("cursor_walk", func(t *testing.T) {
+		t.Parallel()
+		var (
+			seen   []int
+			cursor string
+			pages  int
+		)
+		for {
+			url := "/paginate?style=cursor&total=25&page_size=10"
+			if cursor != "" {
+				url += "&cursor=" + cursor
+			}
+			w, resp := doPaginate(t, url)
+			assertStatusCode(t, w, http.StatusOK)
+			if resp.Total != nil {
+				t.Fatalf("expected cursor style to omit total, got %d", *resp.Total)
+			}
+			seen = append(seen, ids(resp.Items)...)
+			pages++
+			if resp.NextCursor == "" {
+				break
+			}
+			cursor = resp.NextCursor
+		}
+		if pages != 3 || len(seen) != 25 || seen[0] != 1 || seen[24] != 25 {
+			t.Fatalf("expected to walk 25 items over 3 pages, got %d pages: %v", pages, seen)
+		}
+	})
+
+	t.Run("cursor_tampered", func(t *testing.T) {
+		t.Parallel()
+		_, resp := doPaginate(t, "/paginate?style=cursor&total=100")
+		decoded, _ := base64.RawURLEncoding.DecodeString(resp.NextCursor)
+		tampered := base64.RawURLEncoding.EncodeToString(bytes.Replace(decoded, []byte("10:"), []byte("90:"), 1))
+
+		for _, cursor := range []string{tampered, "not-base64!", base64.RawURLEncoding.EncodeToString([]byte("10:100:10"))} {
+			w, _ := doPaginate(t, "/paginate?style=cursor&total=100&cursor="+cursor)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+		}
+	})
+
+	t.Run("cursor_from_other_instance", func(t *testing.T) {
+		t.Parallel()
+		_, resp := doPaginate(t, "/paginate?style=cursor&total=100")
+		r, _ := http.NewRequest("GET", "/paginate?style=cursor&total=100&cursor="+resp.NextCursor, nil)
+		w := httptest.NewRecorder()
+		New().ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+	})
+
+	t.Run("cursor_params_changed", func(t *testing.T) {
+		t.Parallel()
+		_, resp := doPaginate(t, "/paginate?style=cursor&total=100")
+		w, _ := doPaginate(t, "/paginate?style=cursor&total=100&page_size=20&cursor="+resp.NextCursor)
+		assertStatusCode(t, w, http.StatusBadRequest)
+	})
+
+	for _, url := range []string{
+		"/paginate?style=foo",
+		"/paginate?total=-1",
+		"/paginate?total=foo",
+		"/paginate?page_size=0",
+		"/paginate?total=20&page_size=10&page=0",
+		"/paginate?total=20&page_size=10&page=3",
+		"/paginate?total=0&page=2",
+		"/paginate?style=offset&total=20&offset=21",
+		"/paginate?style=offset&offset=-1",
+		"/paginate?style=offset&limit=0",
+	} {
+		url := url
+		t.Run("bad"+url, func(t *testing.T) {
+			t.Parallel()
+			w, _ := doPaginate(t, url)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+		})
+	}
+}
+
+func TestUsers(t *testing.T) {
+	t.Parallel()
+
+	doUsers := func(t *testing.T, url string) (*httptest.ResponseRecorder, usersResponse) {
+		t.Helper()
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		var resp usersResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
+		}
+		return w, resp
+	}
+
+	decodeUsers := func(t *testing.T, resp usersResponse) []userRecord {
+		t.Helper()
+		raw, _ := json.Marshal(resp.Items)
+		var users []userRecord
+		if err := json.Unmarshal(raw, &users); err != nil {
+			t.Fatalf("failed to unmarshal items %s: %s", raw, err)
+		}
+		return users
+	}
+
+	t.Run("deterministic", func(t *testing.T) {
+		t.Parallel()
+		_, a := doUsers(t, "/users?seed=42&page_size=20")
+		_, b := doUsers(t, "/users?seed=42&page_size=20")
+		_, c := doUsers(t, "/users?seed=43&page_size=20")
+		usersA, usersB, usersC := decodeUsers(t, a), decodeUsers(t, b), decodeUsers(t, c)
+		if !reflect.DeepEqual(usersA, usersB) {
+			t.Fatalf("expected identical records for the same seed")
+		}
+		if reflect.DeepEqual(usersA, usersC) {
+			t.Fatalf("expected different records for different seeds")
+		}
+		if a.Seed != 42 || len(usersA) != 20 {
+			t.Fatalf("expected 20 records for seed 42, got %d for seed %d", len(usersA), a.Seed)
+		}
+		for i, u := range usersA {
+			if u.ID != i+1 || u.Email == "" || u.Address.City == "" {
+				t.Fatalf("unexpected record %+v", u)
+			}
+			if _, err := time.Parse(time.RFC3339, u.CreatedAt); err != nil {
+				t.Fatalf("expected RFC3339 created_at, got %q", u.CreatedAt)
+			}
+		}
+	})
+
+	t.Run("stable across releases", func(t *testing.T) {
+		t.Parallel()
+		// Recorded fixtures depend on the dataset never changing for a
+		// given seed.
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/users/1?seed=1", nil)
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		var got map[string]interface{}
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &got))
+		want := map[string]interface{}{
+			"id":         1.0,
+			"username":   "katherine.mccarthy1",
+			"first_name": "Katherine",
+			"last_name":  "McCarthy",
+			"email":      "katherine.mccarthy.1@example.com",
+			"phone":      "+1-555-9190",
+			"active":     true,
+			"address": map[string]interface{}{
+				"street":      "5246 Main St",
+				"unit":        nil,
+				"city":        "Berlin",
+				"postal_code": "28819",
+				"country":     "DE",
+			},
+			"created_at":    "2020-09-11T17:04:13Z",
+			"last_login_at": "2020-09-15T23:06:24Z",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected record\n%v\ngot\n%v", want, got)
+		}
+	})
+
+	t.Run("nullable fields are present", func(t *testing.T) {
+		t.Parallel()
+		_, resp := doUsers(t, "/users?page_size=100")
+		var sawNull bool
+		for _, item := range resp.Items {
+			u := item.(map[string]interface{})
+			for _, key := range []string{"phone", "last_login_at"} {
+				v, ok := u[key]
+				if !ok {
+					t.Fatalf("expected %s in every record, got %v", key, u)
+				}
+				sawNull = sawNull || v == nil
+			}
+		}
+		if !sawNull {
+			t.Fatalf("expected at least one null field in 100 records")
+		}
+	})
+
+	t.Run("single record matches list", func(t *testing.T) {
+		t.Parallel()
+		_, list := doUsers(t, "/users?seed=7&style=offset&offset=4&limit=1")
+		w, _ := doUsers(t, "/users/5?seed=7")
+		var single userRecord
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &single))
+		if got := decodeUsers(t, list); len(got) != 1 || !reflect.DeepEqual(got[0], single) {
+			t.Fatalf("expected /users/5 to match list item, got %+v and %+v", single, got)
+		}
+	})
+
+	t.Run("sparse fieldsets", func(t *testing.T) {
+		t.Parallel()
+		_, resp := doUsers(t, "/users?page_size=3&fields=id,address.city,address.country")
+		for _, item := range resp.Items {
+			u := item.(map[string]interface{})
+			address, _ := u["address"].(map[string]interface{})
+			if len(u) != 2 || len(address) != 2 || address["city"] == nil || address["country"] == nil {
+				t.Fatalf("unexpected sparse record %v", u)
+			}
+		}
+
+		// Selecting a whole object includes all of its fields.
+		_, resp = doUsers(t, "/users?page_size=1&fields=address.city,address")
+		address := resp.Items[0].(map[string]interface{})["address"].(map[string]interface{})
+		if _, ok := address["street"]; !ok {
+			t.Fatalf("expected whole address, got %v", address)
+		}
+	})
+
+	t.Run("sort", func(t *testing.T) {
+		t.Parallel()
+		_, resp := doUsers(t, "/users?page_size=100&sort=last_name,-created_at")
+		users := decodeUsers(t, resp)
+		for i := 1; i < len(users); i++ {
+			a, b := users[i-1], users[i]
+			if a.LastName > b.LastName || (a.LastName == b.LastName && a.CreatedAt < b.CreatedAt) {
+				t.Fatalf("records out of order: %+v before %+v", a, b)
+			}
+		}
+
+		_, resp = doUsers(t, "/users?page_size=100&sort=-last_login_at")
+		users = decodeUsers(t, resp)
+		if users[0].LastLoginAt == nil || users[len(users)-1].LastLoginAt != nil {
+			t.Fatalf("expected nulls to sort last")
+		}
+	})
+
+	t.Run("sorted pages are consistent", func(t *testing.T) {
+		t.Parallel()
+		_, all := doUsers(t, "/users?total=30&page_size=30&sort=address.city")
+		_, page := doUsers(t, "/users?total=30&page_size=10&page=2&sort=address.city")
+		if !reflect.DeepEqual(decodeUsers(t, all)[10:20], decodeUsers(t, page)) {
+			t.Fatalf("expected page 2 to match the sorted list")
+		}
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		t.Parallel()
+		w, resp := doUsers(t, "/users?total=25&page_size=10&page=3")
+		if len(resp.Items) != 5 || *resp.Total != 25 || *resp.TotalPages != 3 {
+			t.Fatalf("unexpected page %+v", resp.paginationMeta)
+		}
+		assertHeader(t, w, "Link", `</users?page=1&page_size=10&total=25>; rel="first", </users?page=2&page_size=10&total=25>; rel="prev", </users?page=3&page_size=10&total=25>; rel="last"`)
+
+		_, resp = doUsers(t, "/users?total=25&style=cursor&page_size=20")
+		if resp.NextCursor == "" {
+			t.Fatalf("expected next cursor")
+		}
+		_, resp = doUsers(t, "/users?total=25&style=cursor&page_size=20&cursor="+resp.NextCursor)
+		if users := decodeUsers(t, resp); len(users) != 5 || users[0].ID != 21 || resp.NextCursor != "" {
+			t.Fatalf("unexpected last cursor page %+v", resp.paginationMeta)
+		}
+	})
+
+	for _, tc := range []struct {
+		url    string
+		status int
+	}{
+		{"/users/0", http.StatusNotFound},
+		{"/users/101", http.StatusNotFound},
+		{"/users/11?total=10", http.StatusNotFound},
+		{"/users/foo", http.StatusNotFound},
+		{"/users/1/address", http.StatusNotFound},
+		{"/users?seed=foo", http.StatusBadRequest},
+		{"/users?total=10001", http.StatusBadRequest},
+		{"/users?fields=id,password", http.StatusBadRequest},
+		{"/users?fields=address.planet", http.StatusBadRequest},
+		{"/users?sort=address", http.StatusBadRequest},
+		{"/users?sort=-nope", http.StatusBadRequest},
+		{"/users?style=nope", http.StatusBadRequest},
+	} {
+		tc := tc
+		t.Run("error "+tc.url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", tc.url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, tc.status)
+			assertContentType(t, w, jsonContentType)
+			assertBodyContains(t, w, `"error"`)
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	type part struct{ name, data string }
+	doDiff := func(t *testing.T, url string, parts ...part) (*httptest.ResponseRecorder, diffResponse) {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, p := range parts {
+			fw, err := mw.CreateFormFile(p.name, p.name+".bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte(p.data))
+		}
+		mw.Close()
+
+		r, _ := http.NewRequest("POST", url, &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		var resp diffResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
+			}
+		}
+		return w, resp
+	}
+	sha := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	t.Run("identical", func(t *testing.T) {
+		t.Parallel()
+		w, resp := doDiff(t, "/diff", part{"a", "hello"}, part{"b", "hello"})
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		want := diffResponse{Identical: true, LengthA: 5, LengthB: 5, SHA256A: sha("hello"), SHA256B: sha("hello")}
+		if !reflect.DeepEqual(resp, want) {
+			t.Fatalf("expected %+v, got %+v", want, resp)
+		}
+	})
+
+	t.Run("different", func(t *testing.T) {
+		t.Parallel()
+		w, resp := doDiff(t, "/diff", part{"b", "hello world"}, part{"a", "hello there"})
+		assertStatusCode(t, w, http.StatusOK)
+		if resp.Identical || resp.FirstDifferentOffset == nil || *resp.FirstDifferentOffset != 6 {
+			t.Fatalf("expected first difference at offset 6, got %+v", resp)
+		}
+		if resp.SHA256A != sha("hello there") || resp.SHA256B != sha("hello world") {
+			t.Fatalf("unexpected hashes: %+v", resp)
+		}
+		if resp.Context != nil {
+			t.Fatalf("expected no context by default, got %+v", resp.Context)
+		}
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		t.Parallel()
+		_, resp := doDiff(t, "/diff", part{"a", "abc"}, part{"b", "abcdef"})
+		if resp.Identical || *resp.FirstDifferentOffset != 3 || resp.LengthA != 3 || resp.LengthB != 6 {
+			t.Fatalf("unexpected response: %+v", resp)
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		t.Parallel()
+		_, resp := doDiff(t, "/diff?context=2", part{"a", "0123456789"}, part{"b", "01234X6789"})
+		want := &diffContext{
+			Offset: 3,
+			A:      hex.Dump([]byte("3456")),
+			B:      hex.Dump([]byte("34X6")),
+		}
+		if !reflect.DeepEqual(resp.Context, want) {
+			t.Fatalf("expected context %+v, got %+v", want, resp.Context)
+		}
+	})
+
+	t.Run("too_large", func(t *testing.T) {
+		t.Parallel()
+		w, _ := doDiff(t, "/diff", part{"a", strings.Repeat("a", 1024)}, part{"b", "b"})
+		assertStatusCode(t, w, http.StatusBadRequest)
+	})
+
+	badTests := []struct {
+		name  string
+		url   string
+		parts []part
+	}{
+		{"one_part", "/diff", []part{{"a", "x"}}},
+		{"three_parts", "/diff", []part{{"a", "x"}, {"b", "x"}, {"c", "x"}}},
+		{"duplicate_part", "/diff", []part{{"a", "x"}, {"a", "x"}}},
+		{"wrong_names", "/diff", []part{{"x", "x"}, {"y", "x"}}},
+		{"bad_context", "/diff?context=-1", []part{{"a", "x"}, {"b", "y"}}},
+		{"huge_context", "/diff?context=100000", []part{{"a", "x"}, {"b", "y"}}},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run("bad/"+test.name, func(t *testing.T) {
+			t.Parallel()
+			w, _ := doDiff(t, test.url, test.parts...)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+		})
+	}
+
+	t.Run("not_multipart", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("POST", "/diff", strings.NewReader("a=1&b=2"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+	})
+}
+
+// dialWebSocket opens a WebSocket connection to the given path on srv,
+// returning the raw connection and a reader for the frames sent by the
+// server.
+func dialWebSocket(t *testing.T, srv *httptest.Server, path string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", path)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101, got %d", resp.StatusCode)
+	}
+	return conn, br
+}
+
+// writeWebSocketFrame writes a single masked client frame.
+func writeWebSocketFrame(t *testing.T, conn net.Conn, op websocket.Opcode, payload []byte) {
+	t.Helper()
+	writeWebSocketFragment(t, conn, true, op, payload)
+}
+
+// writeWebSocketFragment writes a single masked client frame, which is the
+// last frame of its message if fin is true.
+func writeWebSocketFragment(t *testing.T, conn net.Conn, fin bool, op websocket.Opcode, payload []byte) {
+	t.Helper()
+	if len(payload) > 125 {
+		t.Fatalf("test helper only supports short payloads")
+	}
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	mask := []byte{0xA, 0xB, 0xC, 0xD}
+	frame := append([]byte{b0, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readWebSocketFrame reads a single unfragmented server frame.
+func readWebSocketFrame(t *testing.T, br *bufio.Reader) (websocket.Opcode, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		t.Fatalf("error reading frame: %s", err)
+	}
+	length := int(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(br, ext[:])
+		length = int(ext[0])<<8 | int(ext[1])
+	case 127:
+		t.Fatalf("test helper does not support 64-bit frame lengths")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatalf("error reading payload: %s", err)
+	}
+	return websocket.Opcode(header[0] & 0x0F), payload
+}
+
+// readSSEEvent reads the lines of the next server-sent event, up to the blank
+// line that ends it.
+func readSSEEvent(t *testing.T, br *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading event: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// errReader fails every read with err.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestSlowReader(t *testing.T) {
+	t.Parallel()
+
+	decode := func(t *testing.T, w *httptest.ResponseRecorder) slowReaderResponse {
+		t.Helper()
+		var resp slowReaderResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
+		}
+		return resp
+	}
+
+	t.Run("reads at the given rate", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("POST", "/upload/slow-reader?rate=1000", bytes.NewReader(make([]byte, 300)))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		resp := decode(t, w)
+		if resp.BytesReceived != 300 || resp.Rate != 1000 || resp.TimedOut {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+		// 100 byte chunks, the last of which is due after 300ms
+		if resp.ElapsedMS < 290 {
+			t.Fatalf("expected reading 300 bytes at 1000 bytes/sec to take at least 300ms, took %vms", resp.ElapsedMS)
+		}
+	})
+
+	t.Run("empty body", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("POST", "/upload/slow-reader", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		if resp := decode(t, w); resp.BytesReceived != 0 || resp.Rate != 1024 {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+	})
+
+	for _, tc := range []struct {
+		query      string
+		wantStatus int
+	}{
+		{"rate=100", http.StatusRequestTimeout},
+		{"rate=100&timeout_status=503", http.StatusServiceUnavailable},
+	} {
+		tc := tc
+		t.Run("max duration/"+tc.query, func(t *testing.T) {
+			t.Parallel()
+			app := New(WithMaxDuration(150 * time.Millisecond))
+			r, _ := http.NewRequest("PUT", "/upload/slow-reader?"+tc.query, bytes.NewReader(make([]byte, 1000)))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, tc.wantStatus)
+			assertHeader(t, w, "Connection", "close")
+			resp := decode(t, w)
+			if !resp.TimedOut || resp.BytesReceived == 0 || resp.BytesReceived >= 1000 {
+				t.Fatalf("expected a partial read that timed out, got %+v", resp)
+			}
+		})
+	}
+
+	t.Run("body too large", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxBodySize(50))
+		r, _ := http.NewRequest("POST", "/upload/slow-reader?rate=50", bytes.NewReader(make([]byte, 60)))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusRequestEntityTooLarge)
+		assertContentType(t, w, jsonContentType)
+	})
+
+	t.Run("client abort is observed", func(t *testing.T) {
+		t.Parallel()
+		results := make(chan Result, 1)
+		app := New(WithObserver(func(result Result) { results <- result }))
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		body := io.MultiReader(bytes.NewReader(make([]byte, 200)), errReader{errors.New("upload aborted")})
+		resp, err := srv.Client().Post(srv.URL+"/upload/slow-reader?rate=1000", "application/octet-stream", body)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("expected client error, got status %d", resp.StatusCode)
+		}
+
+		select {
+		case result := <-results:
+			if result.Status != 499 || result.RequestSize != 200 {
+				t.Fatalf("expected 499 after reading 200 bytes, got status %d after %d bytes", result.Status, result.RequestSize)
+			}
+			if got := result.Annotations["slow_reader_outcome"]; got != "client_gone" {
+				t.Fatalf("expected client_gone outcome, got %q", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for observer")
+		}
+	})
+
+	for _, path := range []string{
+		"/upload/slow-reader?rate=0",
+		"/upload/slow-reader?rate=foo",
+		"/upload/slow-reader?rate=2048",
+		"/upload/slow-reader?timeout_status=200",
+	} {
+		path := path
+		t.Run("bad"+path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("POST", path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	t.Parallel()
+
+	t.Run("concurrent callers share one computation", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithMaxDuration(5 * time.Second))
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		const n = 50
+		var (
+			wg        sync.WaitGroup
+			start     = make(chan struct{})
+			responses = make([]coalesceResponse, n)
+			coalesced = make([]string, n)
+			errs      = make(chan error, n)
+		)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				resp, err := srv.Client().Get(srv.URL + "/coalesce?key=abc&work=1s")
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer resp.Body.Close()
+				coalesced[i] = resp.Header.Get("X-Coalesced")
+				errs <- json.NewDecoder(resp.Body).Decode(&responses[i])
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ids := make(map[string]bool)
+		leaders := 0
+		for i, resp := range responses {
+			ids[resp.ComputationID] = true
+			if coalesced[i] == "false" {
+				leaders++
+			}
+			if resp != responses[0] {
+				t.Fatalf("expected identical responses, got %+v and %+v", responses[0], resp)
+			}
+		}
+		if len(ids) != 1 || leaders != 1 {
+			t.Fatalf("expected exactly one computation and leader, got %d ids and %d leaders", len(ids), leaders)
+		}
+		if got := responses[0]; got.Waiters != n || got.Key != "abc" || got.WorkMS != 1000 {
+			t.Fatalf("expected %d waiters for key abc with 1000ms of work, got %+v", n, got)
+		}
+		if got := app.coalescer.inflight(); got != 0 {
+			t.Fatalf("expected completed computation to be forgotten, %d still in flight", got)
+		}
+
+		// Later requests start a new computation
+		r, _ := http.NewRequest("GET", "/coalesce?key=abc&work=0", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "X-Coalesced", "false")
+		var resp coalesceResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if ids[resp.ComputationID] || resp.Waiters != 1 {
+			t.Fatalf("expected a new computation serving one waiter, got %+v", resp)
+		}
+	})
+
+	t.Run("keys are independent", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+		var wg sync.WaitGroup
+		ids := make([]string, 2)
+		for i, key := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(i int, key string) {
+				defer wg.Done()
+				r, _ := http.NewRequest("GET", "/coalesce?key="+key+"&work=50ms", nil)
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+				var resp coalesceResponse
+				json.Unmarshal(w.Body.Bytes(), &resp)
+				ids[i] = resp.ComputationID
+			}(i, key)
+		}
+		wg.Wait()
+		if ids[0] == "" || ids[0] == ids[1] {
+			t.Fatalf("expected distinct computations per key, got %v", ids)
+		}
+	})
+
+	t.Run("canceled waiter is not counted", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+		leaderDone := make(chan coalesceResponse)
+		go func() {
+			r, _ := http.NewRequest("GET", "/coalesce?key=k&work=300ms", nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			var resp coalesceResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			leaderDone <- resp
+		}()
+		for app.coalescer.inflight() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		r, _ := http.NewRequestWithContext(ctx, "GET", "/coalesce?key=k", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if w.Code != 499 {
+			t.Fatalf("expected 499 for canceled waiter, got %d", w.Code)
+		}
+		if resp := <-leaderDone; resp.Waiters != 1 {
+			t.Fatalf("expected 1 waiter, got %d", resp.Waiters)
+		}
+	})
+
+	for _, tc := range []struct {
+		path    string
+		wantErr string
+	}{
+		{"/coalesce", "missing key"},
+		{"/coalesce?key=a&work=2s", "invalid work"},
+		{"/coalesce?key=a&work=-1s", "invalid work"},
+		{"/coalesce?key=a&work=foo", "invalid work"},
+	} {
+		tc := tc
+		t.Run("bad"+tc.path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", tc.path, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertBodyContains(t, w, tc.wantErr)
+		})
+	}
+}
+
+func TestFanout(t *testing.T) {
+	t.Parallel()
+
+	newFanoutServer := func(t *testing.T, opts ...OptionFunc) (*HTTPBin, *httptest.Server) {
+		app := New(append([]OptionFunc{WithMaxDuration(5 * time.Second)}, opts...)...)
+		srv := httptest.NewServer(app)
+		t.Cleanup(srv.Close)
+		return app, srv
+	}
+	publish := func(t *testing.T, srv *httptest.Server, channel, body string) fanoutPublishResponse {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/fanout/"+channel, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected publish to succeed, got %d", resp.StatusCode)
+		}
+		var result fanoutPublishResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	subscribeSSE := func(t *testing.T, srv *httptest.Server, channel, lastEventID string) *bufio.Reader {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/fanout/"+channel+"/sse", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected subscribe to succeed, got %d", resp.StatusCode)
+		}
+		assertHeader(t, resp, "Content-Type", "text/event-stream")
+		return bufio.NewReader(resp.Body)
+	}
+	t.Run("sse", func(t *testing.T) {
+		t.Parallel()
+		_, srv := newFanoutServer(t)
+
+		events1 := subscribeSSE(t, srv, "news", "")
+		events2 := subscribeSSE(t, srv, "news", "")
+		result := publish(t, srv, "news", "hello\nworld")
+		if result.ID != 1 || result.Subscribers != 2 || result.Dropped != 0 {
+			t.Fatalf("unexpected publish result: %+v", result)
+		}
+
+		want := []string{"id: 1", "data: hello", "data: world"}
+		for _, events := range []*bufio.Reader{events1, events2} {
+			if got := readSSEEvent(t, events); !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected event %q, got %q", want, got)
+			}
+		}
+	})
+
+	t.Run("last_event_id_replay", func(t *testing.T) {
+		t.Parallel()
+		_, srv := newFanoutServer(t)
+
+		for _, msg := range []string{"one", "two", "three"} {
+			publish(t, srv, "replay", msg)
+		}
+		events := subscribeSSE(t, srv, "replay", "1")
+		publish(t, srv, "replay", "four")
+
+		for _, want := range [][]string{
+			{"id: 2", "data: two"},
+			{"id: 3", "data: three"},
+			{"id: 4", "data: four"},
+		} {
+			if got := readSSEEvent(t, events); !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected event %q, got %q", want, got)
+			}
+		}
+	})
+
+	t.Run("dropped_messages_reported", func(t *testing.T) {
+		t.Parallel()
+		app, srv := newFanoutServer(t)
+
+		events := subscribeSSE(t, srv, "slow", "")
+		app.fanout.mu.Lock()
+		for sub := range app.fanout.channels["slow"].subs {
+			atomic.AddInt64(&sub.dropped, 2)
+		}
+		app.fanout.mu.Unlock()
+		publish(t, srv, "slow", "after drops")
+
+		if got := readSSEEvent(t, events); !reflect.DeepEqual(got, []string{"event: dropped", "data: 2"}) {
+			t.Fatalf("expected dropped event, got %q", got)
+		}
+		if got := readSSEEvent(t, events); !reflect.DeepEqual(got, []string{"id: 1", "data: after drops"}) {
+			t.Fatalf("expected message after dropped event, got %q", got)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		t.Parallel()
+		_, srv := newFanoutServer(t)
+
+		conn, br := dialWebSocket(t, srv, "/fanout/chat/ws")
+		events := subscribeSSE(t, srv, "chat", "")
+
+		publish(t, srv, "chat", "from http")
+		op, payload := readWebSocketFrame(t, br)
+		if op != websocket.OpText || string(payload) != `{"id":1,"data":"from http"}` {
+			t.Fatalf("unexpected websocket message: opcode %d payload %s", op, payload)
+		}
+
+		// Messages sent by WebSocket subscribers are bridged to everyone
+		writeWebSocketFrame(t, conn, websocket.OpText, []byte("from ws"))
+		if op, payload := readWebSocketFrame(t, br); string(payload) != `{"id":2,"data":"from ws"}` {
+			t.Fatalf("unexpected websocket message: opcode %d payload %s", op, payload)
+		}
+		readSSEEvent(t, events)
+		if got := readSSEEvent(t, events); !reflect.DeepEqual(got, []string{"id: 2", "data: from ws"}) {
+			t.Fatalf("expected bridged event, got %q", got)
+		}
+
+		writeWebSocketFrame(t, conn, websocket.OpClose, []byte{0x03, 0xE8})
+		if op, _ := readWebSocketFrame(t, br); op != websocket.OpClose {
+			t.Fatalf("expected close frame, got opcode %d", op)
+		}
+	})
+
+	t.Run("websocket_closed_after_abrupt_disconnect", func(t *testing.T) {
+		t.Parallel()
+		_, srv := newFanoutServer(t)
+
+		conn, br := dialWebSocket(t, srv, "/fanout/chat/ws")
+		// Drop the connection without a close frame, which the server sees
+		// as a raw EOF, and make sure it closes its side well before the
+		// subscription would expire.
+		if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if op, _ := readWebSocketFrame(t, br); op != websocket.OpClose {
+			t.Fatalf("expected close frame, got opcode %d", op)
+		}
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Fatalf("expected server to close the connection, got %v", err)
+		}
+	})
+
+	t.Run("bounded_queues", func(t *testing.T) {
+		t.Parallel()
+		b := newFanoutBroker(time.Now)
+		sub, _, err := b.subscribe("c", 0)
+		assertNil(t, err)
+
+		var dropped int
+		for i := 0; i < fanoutQueueSize+3; i++ {
+			_, _, d, err := b.publish("c", []byte("x"))
+			assertNil(t, err)
+			dropped += d
+		}
+		assertIntEqual(t, dropped, 3)
+		assertIntEqual(t, int(sub.takeDropped()), 3)
+		assertIntEqual(t, int(sub.takeDropped()), 0)
+		assertIntEqual(t, len(sub.queue), fanoutQueueSize)
+	})
+
+	t.Run("replay_buffer_bounded", func(t *testing.T) {
+		t.Parallel()
+		b := newFanoutBroker(time.Now)
+		for i := 0; i < fanoutBufferSize+10; i++ {
+			b.publish("c", []byte("x"))
+		}
+		_, replay, err := b.subscribe("c", 1)
+		assertNil(t, err)
+		assertIntEqual(t, len(replay), fanoutBufferSize)
+		assertIntEqual(t, int(replay[0].id), 11)
+	})
+
+	t.Run("channel_limit_and_expiry", func(t *testing.T) {
+		t.Parallel()
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		b := newFanoutBroker(func() time.Time { return now })
+
+		sub, _, err := b.subscribe("active", 0)
+		assertNil(t, err)
+		for i := 1; i < maxFanoutChannels; i++ {
+			_, _, _, err := b.publish(fmt.Sprintf("c%d", i), nil)
+			assertNil(t, err)
+		}
+		if _, _, _, err := b.publish("one-too-many", nil); err != errTooManyFanoutChannels {
+			t.Fatalf("expected errTooManyFanoutChannels, got %v", err)
+		}
+
+		// Idle channels expire, but not those with subscribers
+		now = now.Add(fanoutIdleTTL + time.Second)
+		_, _, _, err = b.publish("fresh", nil)
+		assertNil(t, err)
+		assertIntEqual(t, len(b.channels), 2)
+		if _, ok := b.channels["active"]; !ok {
+			t.Fatalf("expected channel with a subscriber to survive expiry")
+		}
+		b.unsubscribe("active", sub)
+	})
+
+	t.Run("reset_disconnects_subscribers", func(t *testing.T) {
+		t.Parallel()
+		_, srv := newFanoutServer(t, WithAdminAPI("secret"))
+
+		events := subscribeSSE(t, srv, "reset", "")
+		req, _ := http.NewRequest("POST", srv.URL+"/admin/reset", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if _, err := events.ReadString('\n'); err != io.EOF {
+			t.Fatalf("expected subscription to end after reset, got %v", err)
+		}
+	})
+
+	t.Run("subscription_expires", func(t *testing.T) {
+		t.Parallel()
+		_, srv := newFanoutServer(t, WithMaxDuration(50*time.Millisecond))
+		events := subscribeSSE(t, srv, "short", "")
+		if _, err := events.ReadString('\n'); err != io.EOF {
+			t.Fatalf("expected subscription to end after MaxDuration, got %v", err)
+		}
+	})
+
+	t.Run("message_too_large", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("POST", "/fanout/big", strings.NewReader(strings.Repeat("x", maxFanoutMessageSize+1)))
+		w := httptest.NewRecorder()
+		New(WithMaxBodySize(1024*1024)).ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusRequestEntityTooLarge)
+	})
+
+	badTests := []struct {
+		method     string
+		path       string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"POST", "/fanout/", nil, http.StatusNotFound},
+		{"POST", "/fanout/bad.name", nil, http.StatusNotFound},
+		{"GET", "/fanout/c/nope", nil, http.StatusNotFound},
+		{"GET", "/fanout/c/sse/extra", nil, http.StatusNotFound},
+		{"GET", "/fanout/c", nil, http.StatusMethodNotAllowed},
+		{"POST", "/fanout/c/sse", nil, http.StatusMethodNotAllowed},
+		{"POST", "/fanout/c/ws", nil, http.StatusMethodNotAllowed},
+		{"GET", "/fanout/c/sse", map[string]string{"Last-Event-ID": "nope"}, http.StatusBadRequest},
+		{"GET", "/fanout/c/ws", nil, http.StatusBadRequest},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run("bad/"+test.method+test.path, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest(test.method, test.path, nil)
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, test.wantStatus)
+		})
+	}
+}
+
+func TestCacheSequence(t *testing.T) {
+	t.Parallel()
+
+	// poll polls the given URL with If-None-Match set to the last ETag seen
+	poll := func(t *testing.T, app *HTTPBin, url string, n int) []int {
+		t.Helper()
+		var (
+			statuses []int
+			etag     string
+		)
+		for i := 0; i < n; i++ {
+			r, _ := http.NewRequest("GET", url, nil)
+			if etag != "" {
+				r.Header.Set("If-None-Match", etag)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			statuses = append(statuses, w.Code)
+			etag = w.Header().Get("ETag")
+		}
+		return statuses
+	}
+
+	t.Run("sequence", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+		got := poll(t, app, "/cache/sequence?changes_every=3&key=a", 7)
+		want := []int{200, 304, 304, 200, 304, 304, 200}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected statuses %v, got %v", want, got)
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+		poll(t, app, "/cache/sequence?changes_every=2&key=b", 2)
+
+		r, _ := http.NewRequest("GET", "/cache/sequence?changes_every=2&key=b", nil)
+		r.Header.Set("If-None-Match", `"b-1"`)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "ETag", `"b-2"`)
+		assertHeader(t, w, "X-Cache-Generation", "2")
+		assertHeader(t, w, "Cache-Control", "no-cache")
+
+		var resp cacheSequenceResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		want := cacheSequenceResponse{Key: "b", Generation: 2, Requests: 3, ChangesEvery: 2, ETag: `"b-2"`}
+		if resp != want {
+			t.Fatalf("expected %+v, got %+v", want, resp)
+		}
+	})
+
+	t.Run("weak_and_wildcard_etags", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+		for _, ifNoneMatch := range []string{`W/"c-1"`, `"other", "c-1"`, `*`} {
+			r, _ := http.NewRequest("GET", "/cache/sequence?key=c&changes_every=100", nil)
+			r.Header.Set("If-None-Match", ifNoneMatch)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotModified)
+		}
+	})
+
+	t.Run("keys_are_independent", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+		poll(t, app, "/cache/sequence?changes_every=1&key=x", 5)
+		r, _ := http.NewRequest("GET", "/cache/sequence?changes_every=1&key=y", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertHeader(t, w, "X-Cache-Generation", "1")
+	})
+
+	t.Run("delete_resets", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+		poll(t, app, "/cache/sequence?changes_every=1&key=d", 5)
+
+		r, _ := http.NewRequest("DELETE", "/cache/sequence?key=d", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNoContent)
+
+		r, _ = http.NewRequest("GET", "/cache/sequence?changes_every=1&key=d", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertHeader(t, w, "X-Cache-Generation", "1")
+	})
+
+	t.Run("ttl_and_key_limit", func(t *testing.T) {
+		t.Parallel()
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := newKeyCounters(func() time.Time { return now })
+		for i := 0; i < maxCounterKeys; i++ {
+			_, err := c.next(fmt.Sprintf("k%d", i))
+			assertNil(t, err)
+		}
+		if n, _ := c.next("k0"); n != 2 {
+			t.Fatalf("expected existing key to keep counting, got %d", n)
+		}
+		if _, err := c.next("one-too-many"); err != errTooManyCounterKeys {
+			t.Fatalf("expected errTooManyCounterKeys, got %v", err)
+		}
+
+		now = now.Add(keyCounterTTL + time.Second)
+		if n, err := c.next("k0"); err != nil || n != 1 {
+			t.Fatalf("expected expired key to restart, got %d, %v", n, err)
+		}
+		if _, err := c.next("one-too-many"); err != nil {
+			t.Fatalf("expected expired keys to be evicted, got %v", err)
+		}
+	})
+
+	for _, url := range []string{
+		"/cache/sequence?changes_every=0",
+		"/cache/sequence?changes_every=foo",
+		"/cache/sequence?key=bad.key",
+	} {
+		url := url
+		t.Run("bad"+url, func(t *testing.T) {
+			t.Parallel()
+			r, _ := http.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestCDNSim(t *testing.T) {
+	t.Parallel()
+
+	// newTestApp returns an app whose clock only advances when told to
+	newTestApp := func() (*HTTPBin, func(time.Duration)) {
+		app := New(WithMaxDuration(time.Second))
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		var mu sync.Mutex
+		app.now = func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		}
+		return app, func(d time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			now = now.Add(d)
+		}
+	}
+
+	get := func(t *testing.T, app *HTTPBin, url string, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, _ := http.NewRequest("GET", url, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("miss then hits until expiry", func(t *testing.T) {
+		t.Parallel()
+		app, advance := newTestApp()
+
+		w := get(t, app, "/cdn-sim?key=a&ttl=60")
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "X-Cache", "MISS")
+		assertHeader(t, w, "Age", "0")
+		assertHeader(t, w, "Cache-Control", "public, max-age=60")
+
+		advance(15500 * time.Millisecond)
+		w = get(t, app, "/cdn-sim?key=a&ttl=60")
+		assertHeader(t, w, "X-Cache", "HIT")
+		assertHeader(t, w, "Age", "15")
+		var resp cdnSimResponse
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		want := cdnSimResponse{Key: "a", Cache: "HIT", Age: 15, TTL: 60, StoredAt: "2024-01-01T00:00:00Z"}
+		if resp != want {
+			t.Fatalf("expected %+v, got %+v", want, resp)
 		}
+
+		advance(44 * time.Second)
+		assertHeader(t, get(t, app, "/cdn-sim?key=a&ttl=60"), "Age", "59")
+
+		advance(time.Second)
+		w = get(t, app, "/cdn-sim?key=a&ttl=60")
+		assertHeader(t, w, "X-Cache", "MISS")
+		assertHeader(t, w, "Age", "0")
 	})
 
-	t.Run("handle cancelation during initial delay", func(t *testing.T) {
+	t.Run("keys are independent", func(t *testing.T) {
 		t.Parallel()
-		srv := httptest.NewServer(app)
-		defer srv.Close()
+		app, _ := newTestApp()
+		get(t, app, "/cdn-sim?key=x")
+		assertHeader(t, get(t, app, "/cdn-sim?key=x"), "X-Cache", "HIT")
+		assertHeader(t, get(t, app, "/cdn-sim?key=y"), "X-Cache", "MISS")
+	})
 
-		// For this test, we expect the client to time out and cancel the
-		// request after 10ms.  The handler should immediately write a 200 OK
-		// status before the client timeout, preventing a client error, but it
-		// will wait 500ms to write anything to the response body.
-		//
-		// So, we're testing that a) the client got an immediate 200 OK but
-		// that b) the response body was empty.
-		client := http.Client{
-			Timeout: time.Duration(10 * time.Millisecond),
-		}
-		resp, err := client.Get(srv.URL + "/drip?duration=500ms&delay=500ms")
-		if err != nil {
-			t.Fatalf("unexpected error: %s", err)
-		}
-		defer resp.Body.Close()
+	t.Run("entry keeps its original ttl", func(t *testing.T) {
+		t.Parallel()
+		app, advance := newTestApp()
+		get(t, app, "/cdn-sim?key=t&ttl=10")
+		advance(20 * time.Second)
+		w := get(t, app, "/cdn-sim?key=t&ttl=10")
+		assertHeader(t, w, "X-Cache", "MISS")
+		w = get(t, app, "/cdn-sim?key=t&ttl=3600")
+		assertHeader(t, w, "X-Cache", "HIT")
+		assertHeader(t, w, "Cache-Control", "public, max-age=10")
+	})
 
-		body, _ := io.ReadAll(resp.Body)
-		if err != nil {
-			t.Fatalf("error reading response body: %s", err)
-		}
+	t.Run("no-cache forces a miss", func(t *testing.T) {
+		t.Parallel()
+		app, advance := newTestApp()
+		get(t, app, "/cdn-sim?key=n")
+		advance(5 * time.Second)
+		assertHeader(t, get(t, app, "/cdn-sim?key=n", "Cache-Control", "max-age=0, No-Cache"), "X-Cache", "MISS")
+		advance(time.Second)
+		assertHeader(t, get(t, app, "/cdn-sim?key=n"), "Age", "1")
+	})
 
-		if len(body) != 0 {
-			t.Fatalf("expected client timeout before body was written, got body %q", string(body))
+	t.Run("origin delay applies to misses only", func(t *testing.T) {
+		t.Parallel()
+		app, _ := newTestApp()
+		start := time.Now()
+		assertHeader(t, get(t, app, "/cdn-sim?key=d&origin_delay=100ms"), "X-Cache", "MISS")
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("expected miss to take at least 100ms, took %s", elapsed)
+		}
+		start = time.Now()
+		assertHeader(t, get(t, app, "/cdn-sim?key=d&origin_delay=500ms"), "X-Cache", "HIT")
+		if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+			t.Fatalf("expected hit to be immediate, took %s", elapsed)
 		}
 	})
 
-	t.Run("handle cancelation during drip", func(t *testing.T) {
+	t.Run("reset", func(t *testing.T) {
 		t.Parallel()
-		srv := httptest.NewServer(app)
-		defer srv.Close()
+		app, _ := newTestApp()
+		get(t, app, "/cdn-sim?key=r")
+		app.cdnSim.reset()
+		assertHeader(t, get(t, app, "/cdn-sim?key=r"), "X-Cache", "MISS")
+	})
 
-		client := http.Client{
-			Timeout: time.Duration(250 * time.Millisecond),
+	t.Run("key limit", func(t *testing.T) {
+		t.Parallel()
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := newCDNSimCache(func() time.Time { return now })
+		for i := 0; i < maxCDNSimKeys; i++ {
+			_, _, _, err := c.get(fmt.Sprintf("k%d", i), time.Minute, false)
+			assertNil(t, err)
 		}
-		resp, err := client.Get(srv.URL + "/drip?duration=900ms&delay=100ms")
-		if err != nil {
-			t.Fatalf("unexpected error: %s", err)
+		if _, _, hit, err := c.get("k0", time.Minute, true); err != nil || hit {
+			t.Fatalf("expected existing key to be refreshed, got hit=%v, %v", hit, err)
 		}
+		if _, _, _, err := c.get("one-too-many", time.Minute, false); err != errTooManyCDNSimKeys {
+			t.Fatalf("expected errTooManyCDNSimKeys, got %v", err)
+		}
+		now = now.Add(time.Minute)
+		if _, _, _, err := c.get("one-too-many", time.Minute, false); err != nil {
+			t.Fatalf("expected expired keys to be evicted, got %v", err)
+		}
+	})
 
-		// in this case, the timeout happens while trying to read the body
-		body, err := io.ReadAll(resp.Body)
-		if err == nil {
-			t.Fatal("expected timeout reading body")
+	for _, url := range []string{
+		"/cdn-sim?key=not%20a%20slug",
+		"/cdn-sim?ttl=0",
+		"/cdn-sim?ttl=86401",
+		"/cdn-sim?ttl=foo",
+		"/cdn-sim?origin_delay=2s",
+		"/cdn-sim?origin_delay=foo",
+	} {
+		url := url
+		t.Run("error "+url, func(t *testing.T) {
+			t.Parallel()
+			w := get(t, app, url)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	const body = "The quick brown fox jumps over the lazy dog"
+	var (
+		sha256Digest = "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"
+		md5Digest    = "9e107d9d372bb6826bd81d3542a419d6"
+		crc32cDigest = "22620404"
+	)
+
+	doVerify := func(t *testing.T, url, body string, headers map[string]string) (*httptest.ResponseRecorder, verifyResponse) {
+		t.Helper()
+		r, _ := http.NewRequest("POST", url, strings.NewReader(body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		var resp verifyResponse
+		if w.Code == http.StatusOK || w.Code == http.StatusUnprocessableEntity {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
+			}
 		}
+		return w, resp
+	}
 
-		// but we should have received a partial response
-		assertBytesEqual(t, body, []byte("**"))
-	})
+	matchTests := []struct {
+		algorithm string
+		url       string
+		headers   map[string]string
+		digest    string
+	}{
+		{"sha256", "/verify?sha256=" + sha256Digest, nil, sha256Digest},
+		{"sha256", "/verify?sha256=" + strings.ToUpper(sha256Digest), nil, sha256Digest},
+		{"md5", "/verify?md5=" + md5Digest, nil, md5Digest},
+		{"crc32c", "/verify?crc32c=" + crc32cDigest, nil, crc32cDigest},
+		{"md5", "/verify", map[string]string{"Content-MD5": "nhB9nTcrtoJr2B01QqQZ1g=="}, md5Digest},
+	}
+	for _, test := range matchTests {
+		test := test
+		t.Run("match"+test.url, func(t *testing.T) {
+			t.Parallel()
+			w, resp := doVerify(t, test.url, body, test.headers)
+			assertStatusCode(t, w, http.StatusOK)
+			assertContentType(t, w, jsonContentType)
+			want := verifyResponse{Match: true, Algorithm: test.algorithm, Expected: test.digest, Actual: test.digest}
+			if resp != want {
+				t.Fatalf("expected %+v, got %+v", want, resp)
+			}
+
+			// Flipping a single character of the body must be detected
+			corrupted := strings.Replace(body, "fox", "fax", 1)
+			w, resp = doVerify(t, test.url, corrupted, test.headers)
+			assertStatusCode(t, w, http.StatusUnprocessableEntity)
+			if resp.Match || resp.Expected != test.digest || resp.Actual == test.digest || resp.Actual == "" {
+				t.Fatalf("expected mismatch with both digests, got %+v", resp)
+			}
+		})
+	}
 
 	badTests := []struct {
-		params *url.Values
-		code   int
+		url     string
+		headers map[string]string
 	}{
-		{&url.Values{"duration": {"1m"}}, http.StatusBadRequest},
-		{&url.Values{"duration": {"-1ms"}}, http.StatusBadRequest},
-		{&url.Values{"duration": {"1001"}}, http.StatusBadRequest},
-		{&url.Values{"duration": {"-1"}}, http.StatusBadRequest},
-		{&url.Values{"duration": {"foo"}}, http.StatusBadRequest},
-
-		{&url.Values{"delay": {"1m"}}, http.StatusBadRequest},
-		{&url.Values{"delay": {"-1ms"}}, http.StatusBadRequest},
-		{&url.Values{"delay": {"1001"}}, http.StatusBadRequest},
-		{&url.Values{"delay": {"-1"}}, http.StatusBadRequest},
-		{&url.Values{"delay": {"foo"}}, http.StatusBadRequest},
-
-		{&url.Values{"numbytes": {"foo"}}, http.StatusBadRequest},
-		{&url.Values{"numbytes": {"0"}}, http.StatusBadRequest},
-		{&url.Values{"numbytes": {"-1"}}, http.StatusBadRequest},
-		{&url.Values{"numbytes": {"0xff"}}, http.StatusBadRequest},
-		{&url.Values{"numbytes": {fmt.Sprintf("%d", maxBodySize+1)}}, http.StatusBadRequest},
-
-		{&url.Values{"code": {"foo"}}, http.StatusBadRequest},
-		{&url.Values{"code": {"-1"}}, http.StatusBadRequest},
-		{&url.Values{"code": {"25"}}, http.StatusBadRequest},
-		{&url.Values{"code": {"600"}}, http.StatusBadRequest},
-
-		// request would take too long
-		{&url.Values{"duration": {"750ms"}, "delay": {"500ms"}}, http.StatusBadRequest},
+		{"/verify", nil},
+		{"/verify?sha256=abc", nil},
+		{"/verify?sha256=" + strings.Repeat("z", 64), nil},
+		{"/verify?md5=" + sha256Digest, nil},
+		{"/verify?crc32c=123", nil},
+		{"/verify?sha256=" + sha256Digest + "&md5=" + md5Digest, nil},
+		{"/verify?md5=" + md5Digest, map[string]string{"Content-MD5": "nhB9nTcrtoJr2B01QqQZ1g=="}},
+		{"/verify", map[string]string{"Content-MD5": "not base64"}},
+		{"/verify", map[string]string{"Content-MD5": "YWJj"}},
 	}
 	for _, test := range badTests {
 		test := test
-		t.Run(fmt.Sprintf("bad/%s", test.params.Encode()), func(t *testing.T) {
+		t.Run("bad"+test.url, func(t *testing.T) {
 			t.Parallel()
-			url := "/drip?" + test.params.Encode()
-
-			r, _ := http.NewRequest("GET", url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.code)
+			w, _ := doVerify(t, test.url, body, test.headers)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
 		})
 	}
 
-	t.Run("ensure HEAD request works with streaming responses", func(t *testing.T) {
+	t.Run("body_too_large", func(t *testing.T) {
 		t.Parallel()
-		srv := httptest.NewServer(app)
-		defer srv.Close()
+		w, _ := doVerify(t, "/verify?md5="+md5Digest, strings.Repeat("x", 2048), nil)
+		assertStatusCode(t, w, http.StatusBadRequest)
+	})
+}
 
-		resp, err := http.Head(srv.URL + "/drip?duration=900ms&delay=100ms")
-		if err != nil {
-			t.Fatalf("unexpected error: %s", err)
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	getStats := func(t *testing.T, app *HTTPBin) statsResponse {
+		t.Helper()
+		r, _ := http.NewRequest("GET", "/stats", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		var resp statsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
 		}
-		defer resp.Body.Close()
+		return resp
+	}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			t.Fatalf("error reading response body: %s", err)
+	t.Run("counts bytes per route", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+
+		r, _ := http.NewRequest("POST", "/verify?md5=9e107d9d372bb6826bd81d3542a419d6", strings.NewReader("The quick brown fox jumps over the lazy dog"))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		verifyBytes := uint64(w.Body.Len())
+
+		r, _ = http.NewRequest("GET", "/bytes/100", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+
+		r, _ = http.NewRequest("GET", "/no/such/route", nil)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNotFound)
+		notFoundBytes := uint64(w.Body.Len())
+
+		resp := getStats(t, app)
+		want := map[string]trafficStats{
+			"/verify":      {Requests: 1, RequestBytes: 43, ResponseBytes: verifyBytes},
+			"/bytes/":      {Requests: 1, ResponseBytes: 100},
+			unmatchedRoute: {Requests: 1, ResponseBytes: notFoundBytes},
+		}
+		if !reflect.DeepEqual(resp.Routes, want) {
+			t.Fatalf("expected routes %+v, got %+v", want, resp.Routes)
+		}
+		wantTotal := trafficStats{Requests: 3, RequestBytes: 43, ResponseBytes: verifyBytes + 100 + notFoundBytes}
+		if resp.Total != wantTotal {
+			t.Fatalf("expected total %+v, got %+v", wantTotal, resp.Total)
 		}
+	})
 
-		if resp.StatusCode != http.StatusOK {
-			t.Fatalf("expected HTTP 200 OK rsponse, got %d", resp.StatusCode)
+	t.Run("accumulates under parallel load", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+
+		const workers, requestsPerWorker = 8, 25
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < requestsPerWorker; j++ {
+					r, _ := http.NewRequest("POST", "/drip?duration=0&numbytes=10", strings.NewReader("hello"))
+					w := httptest.NewRecorder()
+					app.ServeHTTP(w, r)
+				}
+			}()
 		}
-		if bodySize := len(body); bodySize > 0 {
-			t.Fatalf("expected empty body from HEAD request, bot: %s", string(body))
+		wg.Wait()
+
+		resp := getStats(t, app)
+		want := trafficStats{Requests: workers * requestsPerWorker, ResponseBytes: workers * requestsPerWorker * 10}
+		if got := resp.Routes["/drip"]; got != want {
+			t.Fatalf("expected /drip stats %+v, got %+v", want, got)
 		}
 	})
-}
 
-func TestRange(t *testing.T) {
-	t.Parallel()
-	t.Run("ok_no_range", func(t *testing.T) {
+	t.Run("reset", func(t *testing.T) {
 		t.Parallel()
-		wantBytes := maxBodySize - 1
-		url := fmt.Sprintf("/range/%d", wantBytes)
-		r, _ := http.NewRequest("GET", url, nil)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
+		app := New()
 
-		assertStatusCode(t, w, http.StatusOK)
-		assertHeader(t, w, "ETag", fmt.Sprintf("range%d", wantBytes))
-		assertHeader(t, w, "Accept-Ranges", "bytes")
-		assertHeader(t, w, "Content-Length", strconv.Itoa(int(wantBytes)))
-		assertContentType(t, w, "text/plain; charset=utf-8")
+		r, _ := http.NewRequest("GET", "/bytes/10", nil)
+		app.ServeHTTP(httptest.NewRecorder(), r)
+		app.traffic.reset()
 
-		if len(w.Body.String()) != int(wantBytes) {
-			t.Errorf("expected content length %d, got %d", wantBytes, len(w.Body.String()))
+		resp := getStats(t, app)
+		if len(resp.Routes) != 0 || resp.Total != (trafficStats{}) {
+			t.Fatalf("expected empty stats after reset, got %+v", resp)
 		}
 	})
 
-	t.Run("ok_range", func(t *testing.T) {
+	t.Run("observer sees request size", func(t *testing.T) {
 		t.Parallel()
-		url := "/range/100"
-		r, _ := http.NewRequest("GET", url, nil)
-		r.Header.Add("Range", "bytes=10-24")
+		var result Result
+		app := New(WithObserver(func(r Result) { result = r }))
+
+		r, _ := http.NewRequest("POST", "/anything", strings.NewReader("hello world"))
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
-
-		assertStatusCode(t, w, http.StatusPartialContent)
-		assertHeader(t, w, "ETag", "range100")
-		assertHeader(t, w, "Accept-Ranges", "bytes")
-		assertHeader(t, w, "Content-Length", "15")
-		assertHeader(t, w, "Content-Range", "bytes 10-24/100")
-		assertBodyEquals(t, w, "klmnopqrstuvwxy")
+		assertStatusCode(t, w, http.StatusOK)
+		assertIntEqual(t, int(result.RequestSize), 11)
+		assertIntEqual(t, int(result.Size), w.Body.Len())
 	})
+}
 
-	t.Run("ok_range_first_16_bytes", func(t *testing.T) {
-		t.Parallel()
-		url := "/range/1000"
-		r, _ := http.NewRequest("GET", url, nil)
-		r.Header.Add("Range", "bytes=0-15")
+func TestCanonicalJSON(t *testing.T) {
+	t.Parallel()
+
+	get := func(t *testing.T, app *HTTPBin, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, _ := http.NewRequest("GET", path, nil)
+		r.Header.Set("X-Zebra", "1")
+		r.Header.Set("X-Aardvark", "2")
+		r.AddCookie(&http.Cookie{Name: "zz", Value: "1"})
+		r.AddCookie(&http.Cookie{Name: "aa", Value: "2"})
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
+		return w
+	}
+
+	// assertSortedKeys walks the JSON document in body, checking that the
+	// keys of every object appear in lexicographic order.
+	assertSortedKeys := func(t *testing.T, body []byte) {
+		t.Helper()
+		dec := json.NewDecoder(bytes.NewReader(body))
+		type frame struct {
+			object  bool
+			wantKey bool
+			lastKey string
+		}
+		var stack []frame
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				return
+			}
+			assertNil(t, err)
+			var top *frame
+			if len(stack) > 0 {
+				top = &stack[len(stack)-1]
+			}
+			if top != nil && top.object && top.wantKey {
+				if key, ok := tok.(string); ok {
+					if key < top.lastKey {
+						t.Fatalf("key %q follows %q in %s", key, top.lastKey, body)
+					}
+					top.lastKey, top.wantKey = key, false
+					continue
+				}
+			}
+			if top != nil && top.object {
+				top.wantKey = true
+			}
+			switch tok {
+			case json.Delim('{'):
+				stack = append(stack, frame{object: true, wantKey: true})
+			case json.Delim('['):
+				stack = append(stack, frame{})
+			case json.Delim('}'), json.Delim(']'):
+				stack = stack[:len(stack)-1]
+				if len(stack) > 0 && stack[len(stack)-1].object {
+					stack[len(stack)-1].wantKey = true
+				}
+			}
+		}
+	}
 
-		assertStatusCode(t, w, http.StatusPartialContent)
-		assertHeader(t, w, "ETag", "range1000")
-		assertHeader(t, w, "Accept-Ranges", "bytes")
-		assertHeader(t, w, "Content-Length", "16")
-		assertHeader(t, w, "Content-Range", "bytes 0-15/1000")
-		assertBodyEquals(t, w, "abcdefghijklmnop")
+	t.Run("opt in per request", func(t *testing.T) {
+		t.Parallel()
+		for _, path := range []string{
+			// struct-backed, with nested maps
+			"/get?canonical=true&b=2&a=1",
+			// map-backed
+			"/cookies?canonical=true",
+			"/json?canonical=true",
+		} {
+			path := path
+			t.Run(path, func(t *testing.T) {
+				t.Parallel()
+				first := get(t, app, path)
+				assertContentType(t, first, jsonContentType)
+				assertSortedKeys(t, first.Body.Bytes())
+				for i := 0; i < 5; i++ {
+					again := get(t, app, path)
+					assertBytesEqual(t, again.Body.Bytes(), first.Body.Bytes())
+				}
+			})
+		}
 	})
 
-	t.Run("ok_range_open_ended_last_6_bytes", func(t *testing.T) {
+	t.Run("byte identical across instances", func(t *testing.T) {
 		t.Parallel()
-		url := "/range/26"
-		r, _ := http.NewRequest("GET", url, nil)
-		r.Header.Add("Range", "bytes=20-")
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
+		path := "/anything/golden?y=2.50&x=1"
+		a := get(t, New(), path+"&canonical=true")
+		b := get(t, New(WithCanonicalJSON()), path+"&canonical=true")
+		assertStatusCode(t, a, http.StatusOK)
+		assertSortedKeys(t, a.Body.Bytes())
+		assertBytesEqual(t, a.Body.Bytes(), b.Body.Bytes())
+	})
 
-		assertStatusCode(t, w, http.StatusPartialContent)
-		assertHeader(t, w, "ETag", "range26")
-		assertHeader(t, w, "Content-Length", "6")
-		assertHeader(t, w, "Content-Range", "bytes 20-25/26")
-		assertBodyEquals(t, w, "uvwxyz")
+	// /stats is struct-backed, with fields not declared in sorted order
+	t.Run("instance default", func(t *testing.T) {
+		t.Parallel()
+		app := New(WithCanonicalJSON())
+		w := get(t, app, "/stats")
+		assertSortedKeys(t, w.Body.Bytes())
+		if !strings.HasPrefix(w.Body.String(), "{\n  \"routes\":") {
+			t.Fatalf("expected canonical body, got %s", w.Body)
+		}
+
+		w = get(t, app, "/stats?canonical=false")
+		if !strings.HasPrefix(w.Body.String(), "{\n  \"total\":") {
+			t.Fatalf("expected default body, got %s", w.Body)
+		}
 	})
 
-	t.Run("ok_range_suffix", func(t *testing.T) {
+	t.Run("numbers are preserved", func(t *testing.T) {
 		t.Parallel()
-		url := "/range/26"
-		r, _ := http.NewRequest("GET", url, nil)
-		r.Header.Add("Range", "bytes=-5")
+		w := httptest.NewRecorder()
+		writeJSON(http.StatusOK, &canonicalJSONResponseWriter{w: w}, map[string]interface{}{
+			"b": 1.5,
+			"a": []interface{}{int64(1) << 60, 0.1, 1e21},
+		})
+		assertBodyEquals(t, w, "{\n  \"a\": [\n    1152921504606846976,\n    0.1,\n    1e+21\n  ],\n  \"b\": 1.5\n}\n")
+	})
+
+	t.Run("invalid param", func(t *testing.T) {
+		t.Parallel()
+		w := get(t, app, "/get?canonical=maybe")
+		assertStatusCode(t, w, http.StatusBadRequest)
+		assertParamError(t, w, "canonical")
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	scrape := func(t *testing.T, app *HTTPBin) string {
+		t.Helper()
+		r, _ := http.NewRequest("GET", "/metrics", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, "text/plain; version=0.0.4; charset=utf-8")
+		return w.Body.String()
+	}
 
-		t.Logf("headers = %v", w.Header())
-		assertStatusCode(t, w, http.StatusPartialContent)
-		assertHeader(t, w, "ETag", "range26")
-		assertHeader(t, w, "Content-Length", "5")
-		assertHeader(t, w, "Content-Range", "bytes 21-25/26")
-		assertBodyEquals(t, w, "vwxyz")
+	t.Run("counts and histograms", func(t *testing.T) {
+		t.Parallel()
+
+		var observed int
+		app := New(WithPrometheusMetrics(), WithObserver(func(Result) { observed++ }))
+		responseBytes := make(map[string]int)
+		for _, req := range []struct {
+			method string
+			path   string
+			body   string
+		}{
+			{"GET", "/get", ""},
+			{"GET", "/get", ""},
+			{"GET", "/status/418", ""},
+			{"BREW", "/anything", ""},
+			{"GET", "/no/such/route", ""},
+			{"POST", "/post", "hello"},
+			{"POST", "/post", "world!"},
+		} {
+			r, _ := http.NewRequest(req.method, req.path, strings.NewReader(req.body))
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			responseBytes[req.path] += w.Body.Len()
+		}
+		if observed != 7 {
+			t.Fatalf("expected observer to see 7 requests, got %d", observed)
+		}
+
+		body := scrape(t, app)
+		for _, want := range []string{
+			"# TYPE httpbin_requests_total counter\n",
+			`httpbin_requests_total{route="/get",method="GET",code="200"} 2` + "\n",
+			`httpbin_requests_total{route="/status/",method="GET",code="418"} 1` + "\n",
+			`httpbin_requests_total{route="/anything",method="OTHER",code="200"} 1` + "\n",
+			`httpbin_requests_total{route="unmatched",method="GET",code="404"} 1` + "\n",
+			"# TYPE httpbin_request_duration_seconds histogram\n",
+			`httpbin_request_duration_seconds_bucket{route="/get",method="GET",code="200",le="0.005"} 2` + "\n",
+			`httpbin_request_duration_seconds_bucket{route="/get",method="GET",code="200",le="10"} 2` + "\n",
+			`httpbin_request_duration_seconds_bucket{route="/get",method="GET",code="200",le="+Inf"} 2` + "\n",
+			`httpbin_request_duration_seconds_count{route="/get",method="GET",code="200"} 2` + "\n",
+			`httpbin_request_duration_seconds_sum{route="/get",method="GET",code="200"} `,
+			"# TYPE httpbin_request_bytes_total counter\n",
+			`httpbin_request_bytes_total{route="/get"} 0` + "\n",
+			`httpbin_request_bytes_total{route="/post"} 11` + "\n",
+			"# TYPE httpbin_response_bytes_total counter\n",
+			fmt.Sprintf(`httpbin_response_bytes_total{route="/get"} %d`+"\n", responseBytes["/get"]),
+			fmt.Sprintf(`httpbin_response_bytes_total{route="/post"} %d`+"\n", responseBytes["/post"]),
+			fmt.Sprintf(`httpbin_response_bytes_total{route="unmatched"} %d`+"\n", responseBytes["/no/such/route"]),
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("expected metrics to contain %q, got:\n%s", want, body)
+			}
+		}
+
+		// The scrape itself is counted by the next one
+		body = scrape(t, app)
+		want := `httpbin_requests_total{route="/metrics",method="GET",code="200"} 1`
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected metrics to contain %q, got:\n%s", want, body)
+		}
+	})
+
+	t.Run("bucket boundaries", func(t *testing.T) {
+		t.Parallel()
+
+		m := newRequestMetrics()
+		for _, d := range []time.Duration{50 * time.Millisecond, 75 * time.Millisecond, time.Minute} {
+			m.record(Result{Route: "/delay/", Method: "GET", Status: 200, Duration: d})
+		}
+		var buf bytes.Buffer
+		m.writeTo(&buf)
+		for _, want := range []string{
+			`httpbin_request_duration_seconds_bucket{route="/delay/",method="GET",code="200",le="0.025"} 0`,
+			`httpbin_request_duration_seconds_bucket{route="/delay/",method="GET",code="200",le="0.05"} 1`,
+			`httpbin_request_duration_seconds_bucket{route="/delay/",method="GET",code="200",le="0.1"} 2`,
+			`httpbin_request_duration_seconds_bucket{route="/delay/",method="GET",code="200",le="10"} 2`,
+			`httpbin_request_duration_seconds_bucket{route="/delay/",method="GET",code="200",le="+Inf"} 3`,
+			`httpbin_request_duration_seconds_sum{route="/delay/",method="GET",code="200"} 60.125`,
+		} {
+			if !strings.Contains(buf.String(), want+"\n") {
+				t.Errorf("expected metrics to contain %q, got:\n%s", want, buf.String())
+			}
+		}
 	})
 
-	t.Run("err_range_out_of_bounds", func(t *testing.T) {
+	t.Run("disabled by default", func(t *testing.T) {
 		t.Parallel()
-		url := "/range/26"
-		r, _ := http.NewRequest("GET", url, nil)
-		r.Header.Add("Range", "bytes=-5")
+		r, _ := http.NewRequest("GET", "/metrics", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
-
-		assertStatusCode(t, w, http.StatusPartialContent)
-		assertHeader(t, w, "ETag", "range26")
-		assertHeader(t, w, "Content-Length", "5")
-		assertHeader(t, w, "Content-Range", "bytes 21-25/26")
-		assertBodyEquals(t, w, "vwxyz")
+		assertStatusCode(t, w, http.StatusNotFound)
 	})
+}
 
-	// Note: httpbin rejects these requests with invalid range headers, but the
-	// go stdlib just ignores them.
-	badRangeTests := []struct {
-		url         string
-		rangeHeader string
+func TestByteCounterSaturates(t *testing.T) {
+	t.Parallel()
+
+	c := &byteCounter{n: math.MaxUint64 - 10}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.add(math.MaxInt64)
+		}()
+	}
+	wg.Wait()
+	if got := c.load(); got != math.MaxUint64 {
+		t.Fatalf("expected counter to saturate at %d, got %d", uint64(math.MaxUint64), got)
+	}
+}
+
+func TestDateSkew(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	app := New()
+	app.now = func() time.Time { return now }
+
+	tests := []struct {
+		url              string
+		wantDate         time.Time
+		wantExpires      string
+		wantLastModified string
+		wantOffset       int64
 	}{
-		{"/range/26", "bytes=10-5"},
-		{"/range/26", "bytes=32-40"},
-		{"/range/26", "bytes=0-40"},
+		{"/date-skew", now, "", "", 0},
+		{"/date-skew?offset=-300s", now.Add(-5 * time.Minute), "", "", -300},
+		{"/date-skew?offset=90", now.Add(90 * time.Second), "", "", 90},
+		{"/date-skew?offset=24h", now.Add(24 * time.Hour), "", "", 86400},
+		{
+			"/date-skew?offset=-1h&expires=10m&last_modified=1h",
+			now.Add(-time.Hour),
+			now.Add(-50 * time.Minute).Format(http.TimeFormat),
+			now.Add(-2 * time.Hour).Format(http.TimeFormat),
+			-3600,
+		},
 	}
-	for _, test := range badRangeTests {
+	for _, test := range tests {
 		test := test
-		t.Run(fmt.Sprintf("ok_bad_range_header/%s", test.rangeHeader), func(t *testing.T) {
+		t.Run(test.url, func(t *testing.T) {
 			t.Parallel()
 			r, _ := http.NewRequest("GET", test.url, nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
 			assertStatusCode(t, w, http.StatusOK)
-			assertBodyEquals(t, w, "abcdefghijklmnopqrstuvwxyz")
+			assertContentType(t, w, jsonContentType)
+			assertHeader(t, w, "Date", test.wantDate.Format(http.TimeFormat))
+			assertHeader(t, w, "Expires", test.wantExpires)
+			assertHeader(t, w, "Last-Modified", test.wantLastModified)
+
+			var resp dateSkewResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
+			}
+			if resp.ServerDate != now.Format(http.TimeFormat) {
+				t.Fatalf("expected server_date %q, got %q", now.Format(http.TimeFormat), resp.ServerDate)
+			}
+			if resp.SkewedDate != test.wantDate.Format(http.TimeFormat) {
+				t.Fatalf("expected skewed_date %q, got %q", test.wantDate.Format(http.TimeFormat), resp.SkewedDate)
+			}
+			if resp.OffsetSeconds != test.wantOffset {
+				t.Fatalf("expected offset_seconds %d, got %d", test.wantOffset, resp.OffsetSeconds)
+			}
 		})
 	}
 
-	badTests := []struct {
-		url  string
-		code int
-	}{
-		{"/range/1/foo", http.StatusNotFound},
+	t.Run("overrides server date", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(app)
+		defer srv.Close()
 
-		{"/range/", http.StatusBadRequest},
-		{"/range/foo", http.StatusBadRequest},
-		{"/range/1.5", http.StatusBadRequest},
-		{"/range/-1", http.StatusBadRequest},
-	}
+		resp, err := http.Get(srv.URL + "/date-skew?offset=-1h")
+		assertNil(t, err)
+		defer resp.Body.Close()
+		assertHeader(t, resp, "Date", now.Add(-time.Hour).Format(http.TimeFormat))
+		if n := len(resp.Header.Values("Date")); n != 1 {
+			t.Fatalf("expected exactly one Date header, got %d", n)
+		}
+	})
 
-	for _, test := range badTests {
-		test := test
-		t.Run("bad"+test.url, func(t *testing.T) {
+	badTests := []string{
+		"/date-skew?offset=foo",
+		"/date-skew?offset=25h",
+		"/date-skew?offset=-25h",
+		"/date-skew?expires=-1s",
+		"/date-skew?last_modified=48h",
+	}
+	for _, url := range badTests {
+		url := url
+		t.Run("bad/"+url, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
+			r, _ := http.NewRequest("GET", url, nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.code)
+			assertStatusCode(t, w, http.StatusBadRequest)
 		})
 	}
 }
 
-func TestHTML(t *testing.T) {
+func TestPatchTarget(t *testing.T) {
 	t.Parallel()
-	r, _ := http.NewRequest("GET", "/html", nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
 
-	assertContentType(t, w, htmlContentType)
-	assertBodyContains(t, w, `<h1>Herman Melville - Moby-Dick</h1>`)
-}
+	doRequest := func(t *testing.T, app *HTTPBin, method, url, contentType, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
 
-func TestRobots(t *testing.T) {
-	t.Parallel()
-	r, _ := http.NewRequest("GET", "/robots.txt", nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
+	assertJSONDocument := func(t *testing.T, w *httptest.ResponseRecorder, want string) {
+		t.Helper()
+		var got, wantDoc interface{}
+		assertNil(t, json.Unmarshal(w.Body.Bytes(), &got))
+		assertNil(t, json.Unmarshal([]byte(want), &wantDoc))
+		if !reflect.DeepEqual(got, wantDoc) {
+			t.Fatalf("expected document %s, got %s", want, w.Body)
+		}
+	}
 
-	assertContentType(t, w, "text/plain")
-	assertBodyContains(t, w, `Disallow: /deny`)
-}
+	t.Run("get returns initial document", func(t *testing.T) {
+		t.Parallel()
+		w := doRequest(t, app, "GET", "/patch-target?key=initial", "", "")
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		assertHeader(t, w, "Accept-Patch", "application/json-patch+json, application/merge-patch+json")
+		assertJSONDocument(t, w, initialPatchDocument)
+	})
 
-func TestDeny(t *testing.T) {
-	t.Parallel()
-	r, _ := http.NewRequest("GET", "/deny", nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
+	t.Run("options advertises accepted patch types", func(t *testing.T) {
+		t.Parallel()
+		w := doRequest(t, app, "OPTIONS", "/patch-target", "", "")
+		assertStatusCode(t, w, http.StatusOK)
+		assertHeader(t, w, "Accept-Patch", "application/json-patch+json, application/merge-patch+json")
 
-	assertContentType(t, w, "text/plain")
-	assertBodyContains(t, w, `YOU SHOULDN'T BE HERE`)
-}
+		w = doRequest(t, app, "OPTIONS", "/get", "", "")
+		assertHeader(t, w, "Accept-Patch", "")
+	})
 
-func TestCache(t *testing.T) {
-	t.Parallel()
-	t.Run("ok_no_cache", func(t *testing.T) {
+	t.Run("json-patch", func(t *testing.T) {
 		t.Parallel()
-		url := "/cache"
-		r, _ := http.NewRequest("GET", url, nil)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-
+		w := doRequest(t, app, "PATCH", "/patch-target?key=json-patch", "application/json-patch+json",
+			`[{"op":"test","path":"/version","value":1},{"op":"replace","path":"/version","value":2},{"op":"add","path":"/tags/-","value":"patch"}]`)
 		assertStatusCode(t, w, http.StatusOK)
-		assertContentType(t, w, jsonContentType)
+		assertJSONDocument(t, w, `{"name":"httpbin","tags":["http","testing","patch"],"version":2}`)
 
-		lastModified := w.Header().Get("Last-Modified")
-		if lastModified == "" {
-			t.Fatalf("did get Last-Modified header")
-		}
+		w = doRequest(t, app, "GET", "/patch-target?key=json-patch", "", "")
+		assertJSONDocument(t, w, `{"name":"httpbin","tags":["http","testing","patch"],"version":2}`)
+	})
 
-		etag := w.Header().Get("ETag")
-		if etag != sha1hash(lastModified) {
-			t.Fatalf("expected ETag header %v, got %v", sha1hash(lastModified), etag)
-		}
+	t.Run("failed test op conflicts and leaves document unchanged", func(t *testing.T) {
+		t.Parallel()
+		w := doRequest(t, app, "PATCH", "/patch-target?key=failed-test", "application/json-patch+json",
+			`[{"op":"remove","path":"/tags"},{"op":"test","path":"/version","value":99}]`)
+		assertStatusCode(t, w, http.StatusConflict)
+		assertContentType(t, w, jsonContentType)
 
-		var resp *noBodyResponse
-		err := json.Unmarshal(w.Body.Bytes(), &resp)
-		if err != nil {
-			t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
-		}
+		w = doRequest(t, app, "GET", "/patch-target?key=failed-test", "", "")
+		assertJSONDocument(t, w, initialPatchDocument)
 	})
 
-	tests := []struct {
-		headerKey string
-		headerVal string
-	}{
-		{"If-None-Match", "my-custom-etag"},
-		{"If-Modified-Since", "my-custom-date"},
-	}
-	for _, test := range tests {
-		test := test
-		t.Run(fmt.Sprintf("ok_cache/%s", test.headerKey), func(t *testing.T) {
-			t.Parallel()
-			r, _ := http.NewRequest("GET", "/cache", nil)
-			r.Header.Add(test.headerKey, test.headerVal)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, http.StatusNotModified)
-		})
-	}
-}
+	t.Run("merge-patch", func(t *testing.T) {
+		t.Parallel()
+		w := doRequest(t, app, "PATCH", "/patch-target?key=merge-patch", "application/merge-patch+json; charset=utf-8",
+			`{"name":null,"tags":["merged"],"extra":{"a":1}}`)
+		assertStatusCode(t, w, http.StatusOK)
+		assertJSONDocument(t, w, `{"extra":{"a":1},"tags":["merged"],"version":1}`)
+	})
 
-func TestCacheControl(t *testing.T) {
-	t.Parallel()
-	t.Run("ok_cache_control", func(t *testing.T) {
+	t.Run("delete resets document", func(t *testing.T) {
 		t.Parallel()
-		url := "/cache/60"
-		r, _ := http.NewRequest("GET", url, nil)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
+		w := doRequest(t, app, "PATCH", "/patch-target?key=delete", "application/merge-patch+json", `{"version":5}`)
+		assertStatusCode(t, w, http.StatusOK)
+
+		w = doRequest(t, app, "DELETE", "/patch-target?key=delete", "", "")
+		assertStatusCode(t, w, http.StatusNoContent)
+
+		w = doRequest(t, app, "GET", "/patch-target?key=delete", "", "")
+		assertJSONDocument(t, w, initialPatchDocument)
+	})
+
+	t.Run("documents expire", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		app := New()
+		app.now = func() time.Time { return now }
 
+		w := doRequest(t, app, "PATCH", "/patch-target", "application/merge-patch+json", `{"version":5}`)
 		assertStatusCode(t, w, http.StatusOK)
-		assertContentType(t, w, jsonContentType)
-		assertHeader(t, w, "Cache-Control", "public, max-age=60")
+
+		now = now.Add(patchTargetTTL + time.Second)
+		w = doRequest(t, app, "GET", "/patch-target", "", "")
+		assertJSONDocument(t, w, initialPatchDocument)
 	})
 
-	badTests := []struct {
-		url            string
-		expectedStatus int
+	t.Run("document size is bounded", func(t *testing.T) {
+		t.Parallel()
+		app := New()
+		w := doRequest(t, app, "PATCH", "/patch-target", "application/merge-patch+json", `{"blob":"`+strings.Repeat("x", 512)+`"}`)
+		assertStatusCode(t, w, http.StatusOK)
+
+		// Each copy doubles the document, quickly exceeding the limit
+		var ops []string
+		for i := 0; i < 8; i++ {
+			ops = append(ops, fmt.Sprintf(`{"op":"copy","from":"","path":"/c%d"}`, i))
+		}
+		w = doRequest(t, app, "PATCH", "/patch-target", "application/json-patch+json", "["+strings.Join(ops, ",")+"]")
+		assertStatusCode(t, w, http.StatusRequestEntityTooLarge)
+	})
+
+	errorTests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        string
+		wantStatus  int
 	}{
-		{"/cache/60/foo", http.StatusNotFound},
-		{"/cache/foo", http.StatusBadRequest},
-		{"/cache/3.14", http.StatusBadRequest},
+		{"unsupported media type", "PATCH", "/patch-target", "application/json", `{"a":1}`, http.StatusUnsupportedMediaType},
+		{"missing media type", "PATCH", "/patch-target", "", `{"a":1}`, http.StatusUnsupportedMediaType},
+		{"malformed json-patch", "PATCH", "/patch-target", "application/json-patch+json", `{"op":"add"}`, http.StatusBadRequest},
+		{"unknown op", "PATCH", "/patch-target", "application/json-patch+json", `[{"op":"nope","path":"/a"}]`, http.StatusBadRequest},
+		{"malformed merge-patch", "PATCH", "/patch-target", "application/merge-patch+json", `{`, http.StatusBadRequest},
+		{"missing path", "PATCH", "/patch-target", "application/json-patch+json", `[{"op":"remove","path":"/missing"}]`, http.StatusConflict},
+		{"invalid key", "GET", "/patch-target?key=no%20spaces", "", "", http.StatusBadRequest},
+		{"method not allowed", "POST", "/patch-target", "", "", http.StatusMethodNotAllowed},
 	}
-	for _, test := range badTests {
+	for _, test := range errorTests {
 		test := test
-		t.Run("bad"+test.url, func(t *testing.T) {
+		t.Run(test.name, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.expectedStatus)
+			w := doRequest(t, app, test.method, test.url, test.contentType, test.body)
+			assertStatusCode(t, w, test.wantStatus)
+			if test.wantStatus == http.StatusUnsupportedMediaType {
+				assertHeader(t, w, "Accept-Patch", "application/json-patch+json, application/merge-patch+json")
+			}
 		})
 	}
 }
 
-func TestETag(t *testing.T) {
+func TestFraming(t *testing.T) {
 	t.Parallel()
-	t.Run("ok_no_headers", func(t *testing.T) {
-		t.Parallel()
-		url := "/etag/abc"
-		r, _ := http.NewRequest("GET", url, nil)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-		assertStatusCode(t, w, http.StatusOK)
-		assertHeader(t, w, "ETag", `"abc"`)
-	})
 
-	tests := []struct {
-		name           string
-		etag           string
-		headerKey      string
-		headerVal      string
-		expectedStatus int
-	}{
-		{"if_none_match_matches", "abc", "If-None-Match", `"abc"`, http.StatusNotModified},
-		{"if_none_match_matches_list", "abc", "If-None-Match", `"123", "abc"`, http.StatusNotModified},
-		{"if_none_match_matches_star", "abc", "If-None-Match", "*", http.StatusNotModified},
-		{"if_none_match_matches_w_prefix", "c3piozzzz", "If-None-Match", `W/"xyzzy", W/"r2d2xxxx", W/"c3piozzzz"`, http.StatusNotModified},
-		{"if_none_match_has_no_match", "abc", "If-None-Match", `"123"`, http.StatusOK},
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
 
-		{"if_match_matches", "abc", "If-Match", `"abc"`, http.StatusOK},
-		{"if_match_matches_list", "abc", "If-Match", `"123", "abc"`, http.StatusOK},
-		{"if_match_matches_star", "abc", "If-Match", "*", http.StatusOK},
-		{"if_match_has_no_match", "abc", "If-Match", `"xxxxxx"`, http.StatusPreconditionFailed},
-	}
-	for _, test := range tests {
-		test := test
-		t.Run("ok_"+test.name, func(t *testing.T) {
-			t.Parallel()
-			url := "/etag/" + test.etag
-			r, _ := http.NewRequest("GET", url, nil)
-			r.Header.Add(test.headerKey, test.headerVal)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.expectedStatus)
-		})
+	wantBody := make([]byte, framingBodySize)
+	for i := range wantBody {
+		wantBody[i] = byte(97 + (i % 26))
 	}
 
-	badTests := []struct {
-		url            string
-		expectedStatus int
-	}{
-		{"/etag/foo/bar", http.StatusNotFound},
-	}
-	for _, test := range badTests {
-		test := test
-		t.Run(fmt.Sprintf("bad/%s", test.url), func(t *testing.T) {
-			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.expectedStatus)
-		})
+	// readRaw sends a request for the given mode over a fresh connection and
+	// returns the unparsed response, which the server must terminate by
+	// closing the connection.
+	readRaw := func(t *testing.T, mode string) (*http.Response, []byte) {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assertNil(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		fmt.Fprintf(conn, "GET /framing?mode=%s HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", mode)
+		raw, err := io.ReadAll(conn)
+		assertNil(t, err)
+
+		end := bytes.Index(raw, []byte("\r\n\r\n"))
+		if end < 0 {
+			t.Fatalf("no end of headers in response %q", raw)
+		}
+		tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw[:end+4])))
+		statusLine, err := tp.ReadLine()
+		assertNil(t, err)
+		if statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line %q", statusLine)
+		}
+		header, err := tp.ReadMIMEHeader()
+		assertNil(t, err)
+		return &http.Response{Header: http.Header(header)}, raw[end+4:]
 	}
-}
 
-func TestBytes(t *testing.T) {
-	t.Parallel()
-	t.Run("ok_no_seed", func(t *testing.T) {
+	t.Run("content-length", func(t *testing.T) {
+		t.Parallel()
+		resp, body := readRaw(t, "content-length")
+		assertHeader(t, resp, "Content-Length", strconv.Itoa(framingBodySize))
+		assertHeader(t, resp, "Transfer-Encoding", "")
+		assertBytesEqual(t, body, wantBody)
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		t.Parallel()
+		resp, body := readRaw(t, "chunked")
+		assertHeader(t, resp, "Content-Length", "")
+		assertHeader(t, resp, "Transfer-Encoding", "chunked")
+		decoded, err := io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		assertNil(t, err)
+		assertBytesEqual(t, decoded, wantBody)
+	})
+
+	t.Run("eof", func(t *testing.T) {
+		t.Parallel()
+		resp, body := readRaw(t, "eof")
+		assertHeader(t, resp, "Content-Length", "")
+		assertHeader(t, resp, "Transfer-Encoding", "")
+		assertHeader(t, resp, "Connection", "close")
+		assertBytesEqual(t, body, wantBody)
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
 		t.Parallel()
-		url := "/bytes/1024"
-		r, _ := http.NewRequest("GET", url, nil)
+		r, _ := http.NewRequest("GET", "/framing?mode=bogus", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+	})
+}
 
-		assertStatusCode(t, w, http.StatusOK)
-		assertContentType(t, w, "application/octet-stream")
-		if len(w.Body.String()) != 1024 {
-			t.Errorf("expected content length 1024, got %d", len(w.Body.String()))
+func TestRequestTiming(t *testing.T) {
+	t.Parallel()
+
+	results := make(chan Result, 10)
+	app := New(WithRequestTiming(), WithObserver(func(r Result) { results <- r }))
+	srv := httptest.NewUnstartedServer(app)
+	srv.Config.ConnContext = app.ConnContext
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	// These tests share a single observer channel, so they must run
+	// serially
+
+	assertApprox := func(t *testing.T, name string, got, want, tolerance time.Duration) {
+		t.Helper()
+		if got < want-tolerance || got > want+tolerance {
+			t.Fatalf("expected %s of %s ± %s, got %s", name, want, tolerance, got)
+		}
+	}
+
+	t.Run("phases sum to total", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/delay/50ms")
+		assertNil(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		result := <-results
+		if result.Timing == nil {
+			t.Fatal("expected timing in observer result")
+		}
+		timing := *result.Timing
+		if timing.Handler < 50*time.Millisecond {
+			t.Fatalf("expected handler phase to include the delay, got %s", timing.Handler)
+		}
+		// The observer starts measuring after the request has arrived, so
+		// the phases can only exceed its duration
+		total := timing.Queue + timing.Handler + timing.Write
+		if total < result.Duration {
+			t.Fatalf("expected phases %+v to sum to at least %s", timing, result.Duration)
+		}
+		assertApprox(t, "sum of phases", total, result.Duration, 25*time.Millisecond)
+
+		headerTiming := parseServerTiming(t, resp.Header.Get("X-Timing"))
+		if _, ok := headerTiming["queue"]; !ok {
+			t.Fatalf("expected queue in X-Timing header %q", resp.Header.Get("X-Timing"))
+		}
+		if headerTiming["handler"] < 50 {
+			t.Fatalf("expected handler >= 50ms in X-Timing header %q", resp.Header.Get("X-Timing"))
 		}
 	})
 
-	t.Run("ok_seed", func(t *testing.T) {
-		t.Parallel()
-		url := "/bytes/16?seed=1234567890"
-		r, _ := http.NewRequest("GET", url, nil)
+	t.Run("write phase", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/drip?duration=100ms&numbytes=5&delay=0")
+		assertNil(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		timing := (<-results).Timing
+		if timing.Write < 80*time.Millisecond {
+			t.Fatalf("expected write phase to include drip duration, got %+v", timing)
+		}
+		if timing.Handler > 50*time.Millisecond {
+			t.Fatalf("expected short handler phase before drip headers, got %+v", timing)
+		}
+
+	})
+
+	t.Run("complete timing in trailer", func(t *testing.T) {
+		// The complete timing is only known after the body is written, so
+		// it is sent as a trailer for chunked responses
+		resp, err := http.Get(srv.URL + "/stream/2")
+		assertNil(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		<-results
+
+		trailerTiming := parseServerTiming(t, resp.Trailer.Get("X-Timing"))
+		for _, phase := range []string{"queue", "handler", "write"} {
+			if _, ok := trailerTiming[phase]; !ok {
+				t.Fatalf("expected %s in X-Timing trailer %q", phase, resp.Trailer.Get("X-Timing"))
+			}
+		}
+	})
+
+	t.Run("first request on connection queues from accept", func(t *testing.T) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assertNil(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+
+		doRequest := func() {
+			fmt.Fprint(conn, "GET /get HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			resp, err := http.ReadResponse(br, nil)
+			assertNil(t, err)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		doRequest()
+		if timing := (<-results).Timing; timing.Queue < 50*time.Millisecond {
+			t.Fatalf("expected first request to queue from accept, got %+v", timing)
+		}
+
+		doRequest()
+		if timing := (<-results).Timing; timing.Queue > 25*time.Millisecond {
+			t.Fatalf("expected reused connection to have short queue, got %+v", timing)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		var result Result
+		app := New(WithObserver(func(r Result) { result = r }))
+		r, _ := http.NewRequest("GET", "/get", nil)
 		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
+		assertHeader(t, w, "X-Timing", "")
+		if result.Timing != nil {
+			t.Fatalf("expected no timing, got %+v", result.Timing)
+		}
+	})
+}
 
-		assertStatusCode(t, w, http.StatusOK)
-		assertContentType(t, w, "application/octet-stream")
+func TestDegraded(t *testing.T) {
+	t.Parallel()
 
-		bodyHex := fmt.Sprintf("%x", w.Body.Bytes())
-		wantHex := "bfcd2afa15a2b372c707985a22024a8e"
-		if bodyHex != wantHex {
-			t.Errorf("expected body in hexadecimal = %v, got %v", wantHex, bodyHex)
+	doDegraded := func(t *testing.T, url string) (*httptest.ResponseRecorder, degradedResponse) {
+		t.Helper()
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		var resp degradedResponse
+		if w.Code != http.StatusBadRequest {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
+			}
 		}
-	})
+		return w, resp
+	}
 
-	edgeCaseTests := []struct {
-		url                   string
-		expectedContentLength int
+	tests := []struct {
+		url            string
+		wantStatus     int
+		wantDegraded   string
+		wantComponents []degradedComponent
 	}{
-		{"/bytes/0", 0},
-		{"/bytes/1", 1},
-		{"/bytes/99999999", 100 * 1024},
-
-		// negative seed allowed
-		{"/bytes/16?seed=-12345", 16},
+		{"/degraded", 200, "false", []degradedComponent{}},
+		{"/degraded?components=db:up,cache:up", 200, "false", []degradedComponent{{Name: "db", Status: "up"}, {Name: "cache", Status: "up"}}},
+		{"/degraded?components=db:down,cache:slow", 200, "true", []degradedComponent{{Name: "db", Status: "down"}, {Name: "cache", Status: "slow"}}},
+		{"/degraded?components=db:down,cache:slow&status_when=db:down=503", 503, "true", []degradedComponent{{Name: "db", Status: "down"}, {Name: "cache", Status: "slow"}}},
+		{"/degraded?components=db:up,cache:slow&status_when=db:down=503,cache:slow=429", 429, "true", []degradedComponent{{Name: "db", Status: "up"}, {Name: "cache", Status: "slow"}}},
+		{"/degraded?components=db:down,cache:slow&status_when=cache:slow=207,db:down=503", 207, "true", []degradedComponent{{Name: "db", Status: "down"}, {Name: "cache", Status: "slow"}}},
 	}
-	for _, test := range edgeCaseTests {
+	for _, test := range tests {
 		test := test
-		t.Run("edge"+test.url, func(t *testing.T) {
+		t.Run(test.url, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, http.StatusOK)
-			assertHeader(t, w, "Content-Length", fmt.Sprintf("%d", test.expectedContentLength))
-			if len(w.Body.Bytes()) != test.expectedContentLength {
-				t.Errorf("expected body of length %d, got %d", test.expectedContentLength, len(w.Body.Bytes()))
+			w, resp := doDegraded(t, test.url)
+			assertStatusCode(t, w, test.wantStatus)
+			assertContentType(t, w, jsonContentType)
+			assertHeader(t, w, "X-Degraded", test.wantDegraded)
+			if !reflect.DeepEqual(resp.Components, test.wantComponents) {
+				t.Fatalf("expected components %+v, got %+v", test.wantComponents, resp.Components)
+			}
+			if strconv.FormatBool(resp.Degraded) != test.wantDegraded {
+				t.Fatalf("expected degraded=%s, got %v", test.wantDegraded, resp.Degraded)
 			}
 		})
 	}
 
-	badTests := []struct {
-		url            string
-		expectedStatus int
-	}{
-		{"/bytes/-1", http.StatusBadRequest},
-
-		{"/bytes", http.StatusNotFound},
-		{"/bytes/16/foo", http.StatusNotFound},
-
-		{"/bytes/foo", http.StatusBadRequest},
-		{"/bytes/3.14", http.StatusBadRequest},
+	t.Run("latency per slow component", func(t *testing.T) {
+		t.Parallel()
+		start := time.Now()
+		w, resp := doDegraded(t, "/degraded?components=a:slow,b:slow,c:down&slow_latency=50ms")
+		assertStatusCode(t, w, http.StatusOK)
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("expected at least 100ms of latency, got %s", elapsed)
+		}
+		assertIntEqual(t, int(resp.LatencyMS), 100)
+	})
 
-		{"/bytes/16?seed=12345678901234567890", http.StatusBadRequest}, // seed too big
-		{"/bytes/16?seed=foo", http.StatusBadRequest},
-		{"/bytes/16?seed=3.14", http.StatusBadRequest},
-	}
-	for _, test := range badTests {
-		test := test
-		t.Run("bad"+test.url, func(t *testing.T) {
+	badTests := []string{
+		"/degraded?components=db",
+		"/degraded?components=db:sideways",
+		"/degraded?components=db:up,db:down",
+		"/degraded?components=no%20spaces:up",
+		"/degraded?components=db:down&status_when=db:down",
+		"/degraded?components=db:down&status_when=db=503",
+		"/degraded?components=db:down&status_when=db:broken=503",
+		"/degraded?components=db:down&status_when=cache:down=503",
+		"/degraded?components=db:down&status_when=db:down=999",
+		"/degraded?components=db:slow&slow_latency=foo",
+		"/degraded?components=a:slow,b:slow&slow_latency=600ms",
+	}
+	for _, url := range badTests {
+		url := url
+		t.Run("bad/"+url, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.expectedStatus)
+			w, _ := doDegraded(t, url)
+			assertStatusCode(t, w, http.StatusBadRequest)
 		})
 	}
 }
 
-func TestStreamBytes(t *testing.T) {
-	t.Parallel()
-	okTests := []struct {
-		url                   string
-		expectedContentLength int
-	}{
-		{"/stream-bytes/256", 256},
-		{"/stream-bytes/256?chunk_size=1", 256},
-		{"/stream-bytes/256?chunk_size=256", 256},
-		{"/stream-bytes/256?chunk_size=7", 256},
+// discardResponseWriter is a minimal http.ResponseWriter for benchmarks,
+// which avoids attributing httptest.ResponseRecorder's own allocations to the
+// handler being measured.
+type discardResponseWriter struct {
+	header http.Header
+}
 
-		// too-large chunk size is okay
-		{"/stream-bytes/256?chunk_size=512", 256},
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
 
-		// as is negative chunk size
-		{"/stream-bytes/256?chunk_size=-10", 256},
+func (w *discardResponseWriter) reset() {
+	for k := range w.header {
+		delete(w.header, k)
 	}
-	for _, test := range okTests {
-		test := test
-		t.Run("ok"+test.url, func(t *testing.T) {
-			t.Parallel()
-
-			srv := httptest.NewServer(app)
-			defer srv.Close()
+}
 
-			resp, err := http.Get(srv.URL + test.url)
-			assertNil(t, err)
-			defer resp.Body.Close()
+func benchmarkEndpoint(b *testing.B, path string, opts ...OptionFunc) {
+	app := New(opts...)
+	r, _ := http.NewRequest("GET", path, nil)
+	r.Header.Set("User-Agent", "go-httpbin-benchmark/1.0")
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := &discardResponseWriter{header: make(http.Header)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.reset()
+		app.ServeHTTP(w, r)
+	}
+}
 
-			if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
-				t.Fatalf("expected Transfer-Encoding: chunked, got %#v", resp.TransferEncoding)
-			}
+func BenchmarkGet(b *testing.B) {
+	benchmarkEndpoint(b, "/get?foo=bar&baz=quux")
+}
 
-			// Expect empty content-length due to streaming response
-			assertHeader(t, resp, "Content-Length", "")
+func BenchmarkHeaders(b *testing.B) {
+	benchmarkEndpoint(b, "/headers")
+}
 
-			body, err := io.ReadAll(resp.Body)
-			assertNil(t, err)
-			if len(body) != test.expectedContentLength {
-				t.Fatalf("expected body of length %d, got %d", test.expectedContentLength, len(body))
-			}
-		})
-	}
+// BenchmarkGetInstrumented measures the per-request cost of the optional
+// instrumentation, relative to BenchmarkGet.
+func BenchmarkGetInstrumented(b *testing.B) {
+	benchmarkEndpoint(b, "/get?foo=bar&baz=quux", WithObserver(func(Result) {}), WithPrometheusMetrics(), WithTraceDecision(nil))
+}
 
-	badTests := []struct {
-		url  string
-		code int
-	}{
-		{"/stream-bytes", http.StatusNotFound},
-		{"/stream-bytes/10/foo", http.StatusNotFound},
+func TestFastPathOutputUnchanged(t *testing.T) {
+	t.Parallel()
 
-		{"/stream-bytes/foo", http.StatusBadRequest},
-		{"/stream-bytes/3.1415", http.StatusBadRequest},
+	// Method-less copies of the response types, to get the default encoding
+	type plainNoBodyResponse noBodyResponse
+	type plainHeadersResponse headersResponse
 
-		{"/stream-bytes/16?chunk_size=foo", http.StatusBadRequest},
-		{"/stream-bytes/16?chunk_size=3.14", http.StatusBadRequest},
-	}
-	for _, test := range badTests {
-		test := test
-		t.Run("bad"+test.url, func(t *testing.T) {
+	for _, tc := range []struct {
+		path  string
+		plain func(body []byte) interface{}
+	}{
+		{"/get?foo=bar&baz=quux&html=<b>&x=%C3%A9", func(body []byte) interface{} {
+			var resp plainNoBodyResponse
+			_ = json.Unmarshal(body, &resp)
+			return resp
+		}},
+		{"/headers", func(body []byte) interface{} {
+			var resp plainHeadersResponse
+			_ = json.Unmarshal(body, &resp)
+			return resp
+		}},
+	} {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
+			r, _ := http.NewRequest("GET", tc.path, nil)
+			r.Header.Set("User-Agent", "go-httpbin-test")
+			r.Header.Add("X-Multi", "a")
+			r.Header.Add("X-Multi", "b \"quoted\"")
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.code)
+			assertStatusCode(t, w, http.StatusOK)
+
+			want := httptest.NewRecorder()
+			writeJSON(http.StatusOK, want, tc.plain(w.Body.Bytes()))
+			assertBodyEquals(t, w, want.Body.String())
 		})
 	}
 }
 
-func TestLinks(t *testing.T) {
+func TestSSE(t *testing.T) {
 	t.Parallel()
-	redirectTests := []struct {
-		url              string
-		expectedLocation string
-	}{
-		{"/links/1", "/links/1/0"},
-		{"/links/100", "/links/100/0"},
+
+	// A fixed clock makes every event's timestamp predictable
+	now := time.Date(2023, 4, 5, 6, 7, 8, 9, time.UTC)
+	sseApp := New(WithMaxDuration(time.Second))
+	sseApp.now = func() time.Time { return now }
+	srv := httptest.NewServer(sseApp)
+	t.Cleanup(srv.Close)
+
+	connect := func(t *testing.T, path, lastEventID string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	wantEvent := func(id, count int) []string {
+		return []string{fmt.Sprintf("id: %d", id), fmt.Sprintf(`data: {"id":%d,"count":%d,"timestamp":"2023-04-05T06:07:08.000000009Z"}`, id, count)}
+	}
+	wantDone := func(count int) []string {
+		return []string{"event: done", fmt.Sprintf(`data: {"count":%d}`, count)}
 	}
 
-	for _, test := range redirectTests {
-		test := test
-		t.Run("ok"+test.url, func(t *testing.T) {
-			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
+	t.Run("streams events with retry", func(t *testing.T) {
+		t.Parallel()
+		resp := connect(t, "/sse?count=3&delay=10ms&retry=2500", "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		assertHeader(t, resp, "Content-Type", "text/event-stream")
+		assertHeader(t, resp, "Cache-Control", "no-cache")
 
-			assertStatusCode(t, w, http.StatusFound)
-			assertHeader(t, w, "Location", test.expectedLocation)
-		})
-	}
+		br := bufio.NewReader(resp.Body)
+		if got := readSSEEvent(t, br); !reflect.DeepEqual(got, []string{"retry: 2500"}) {
+			t.Fatalf("expected retry field, got %q", got)
+		}
+		for id := 0; id < 3; id++ {
+			if got := readSSEEvent(t, br); !reflect.DeepEqual(got, wantEvent(id, 3)) {
+				t.Fatalf("expected event %q, got %q", wantEvent(id, 3), got)
+			}
+		}
+		if got := readSSEEvent(t, br); !reflect.DeepEqual(got, wantDone(3)) {
+			t.Fatalf("expected done event %q, got %q", wantDone(3), got)
+		}
+		if rest, _ := io.ReadAll(br); len(rest) != 0 {
+			t.Fatalf("expected end of stream, got %q", rest)
+		}
+	})
 
-	errorTests := []struct {
-		url            string
-		expectedStatus int
-	}{
-		{"/links/10/1/foo", http.StatusNotFound},
+	t.Run("resumes after dropped connection without gaps or duplicates", func(t *testing.T) {
+		t.Parallel()
+		const count = 10
+		path := fmt.Sprintf("/sse?count=%d&delay=5ms&retry=0", count)
+
+		var received []int
+		lastEventID := ""
+		for reconnects := 0; len(received) < count; reconnects++ {
+			if reconnects > count {
+				t.Fatalf("too many reconnects, received %v", received)
+			}
+			resp := connect(t, path, lastEventID)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", resp.StatusCode)
+			}
+			br := bufio.NewReader(resp.Body)
+			readSSEEvent(t, br) // retry field
+
+			// read up to 3 events, then drop the connection mid-stream
+			for i := 0; i < 3 && len(received) < count; i++ {
+				lines := readSSEEvent(t, br)
+				var id int
+				if _, err := fmt.Sscanf(lines[0], "id: %d", &id); err != nil {
+					t.Fatalf("unexpected event %q", lines)
+				}
+				if !reflect.DeepEqual(lines, wantEvent(id, count)) {
+					t.Fatalf("expected event %q, got %q", wantEvent(id, count), lines)
+				}
+				received = append(received, id)
+				lastEventID = strconv.Itoa(id)
+			}
+			resp.Body.Close()
+		}
 
-		// invalid N
-		{"/links/3.14", http.StatusBadRequest},
-		{"/links/-1", http.StatusBadRequest},
-		{"/links/257", http.StatusBadRequest},
+		for i, id := range received {
+			if id != i {
+				t.Fatalf("expected ids 0-%d in order exactly once, got %v", count-1, received)
+			}
+		}
 
-		// invalid offset
-		{"/links/1/3.14", http.StatusBadRequest},
-		{"/links/1/foo", http.StatusBadRequest},
-	}
+		// reconnecting after the final event tells the client to stop
+		resp := connect(t, path, strconv.Itoa(count-1))
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected 204 after final event, got %d", resp.StatusCode)
+		}
+	})
 
-	for _, test := range errorTests {
-		test := test
-		t.Run("error"+test.url, func(t *testing.T) {
-			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
+	t.Run("resumed stream is identical to the original", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/sse?count=5&delay=0", nil)
+		w := httptest.NewRecorder()
+		sseApp.ServeHTTP(w, r)
+		full := w.Body.String()
 
-			assertStatusCode(t, w, test.expectedStatus)
-		})
-	}
+		r, _ = http.NewRequest("GET", "/sse?count=5&delay=0", nil)
+		r.Header.Set("Last-Event-ID", "1")
+		w = httptest.NewRecorder()
+		sseApp.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		resumed := w.Body.String()
 
-	linksPageTests := []struct {
-		url             string
-		expectedContent string
-	}{
-		{"/links/2/0", `<html><head><title>Links</title></head><body>0 <a href="/links/2/1">1</a> </body></html>`},
-		{"/links/2/1", `<html><head><title>Links</title></head><body><a href="/links/2/0">0</a> 1 </body></html>`},
+		if !strings.HasPrefix(resumed, "id: 2\n") || !strings.HasSuffix(full, resumed) {
+			t.Fatalf("expected resumed stream to be a suffix of the full stream starting at id 2\nfull:\n%s\nresumed:\n%s", full, resumed)
+		}
+	})
 
-		// offsets too large and too small are ignored
-		{"/links/2/2", `<html><head><title>Links</title></head><body><a href="/links/2/0">0</a> <a href="/links/2/1">1</a> </body></html>`},
-		{"/links/2/10", `<html><head><title>Links</title></head><body><a href="/links/2/0">0</a> <a href="/links/2/1">1</a> </body></html>`},
-		{"/links/2/-1", `<html><head><title>Links</title></head><body><a href="/links/2/0">0</a> <a href="/links/2/1">1</a> </body></html>`},
-	}
-	for _, test := range linksPageTests {
-		test := test
-		t.Run("ok"+test.url, func(t *testing.T) {
+	t.Run("duration spreads events evenly", func(t *testing.T) {
+		t.Parallel()
+		for _, tc := range []struct {
+			path    string
+			count   int
+			minTime time.Duration
+		}{
+			{"/sse?count=3&duration=100ms", 3, 100 * time.Millisecond},
+			{"/sse?duration=90ms", 10, 90 * time.Millisecond},
+			{"/sse?count=1&duration=1s", 1, 0},
+		} {
+			start := time.Now()
+			resp := connect(t, tc.path, "")
+			br := bufio.NewReader(resp.Body)
+			for id := 0; id < tc.count; id++ {
+				if got := readSSEEvent(t, br); !reflect.DeepEqual(got, wantEvent(id, tc.count)) {
+					t.Fatalf("%s: expected event %q, got %q", tc.path, wantEvent(id, tc.count), got)
+				}
+			}
+			if got := readSSEEvent(t, br); !reflect.DeepEqual(got, wantDone(tc.count)) {
+				t.Fatalf("%s: expected done event %q, got %q", tc.path, wantDone(tc.count), got)
+			}
+			elapsed := time.Since(start)
+			if elapsed < tc.minTime || elapsed > tc.minTime+500*time.Millisecond {
+				t.Fatalf("%s: expected stream to take about %s, took %s", tc.path, tc.minTime, elapsed)
+			}
+		}
+	})
+
+	for _, tc := range []struct {
+		path        string
+		lastEventID string
+		wantErr     string
+	}{
+		{"/sse?count=0", "", "invalid count"},
+		{"/sse?count=1001", "", "invalid count"},
+		{"/sse?count=x", "", "invalid count"},
+		{"/sse?delay=x", "", "invalid delay"},
+		{"/sse?delay=2s", "", "invalid delay"},
+		{"/sse?count=3&delay=600ms", "", "3 events with a delay of 600ms take 1.2s, longer than 1s"},
+		{"/sse?duration=x", "", "invalid duration"},
+		{"/sse?duration=2s", "", "invalid duration"},
+		{"/sse?delay=10ms&duration=100ms", "", "delay and duration may not both be given"},
+		{"/sse?delay=0&retry=-1", "", "invalid retry"},
+		{"/sse?count=3&delay=0", "3", "must be an event id from 0 to 2"},
+		{"/sse?count=3&delay=0", "-1", "must be an event id from 0 to 2"},
+		{"/sse?count=3&delay=0", "abc", "must be an event id from 0 to 2"},
+	} {
+		tc := tc
+		t.Run("bad"+tc.path+"#"+tc.lastEventID, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
+			r, _ := http.NewRequest("GET", tc.path, nil)
+			if tc.lastEventID != "" {
+				r.Header.Set("Last-Event-ID", tc.lastEventID)
+			}
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-
-			assertStatusCode(t, w, http.StatusOK)
-			assertContentType(t, w, htmlContentType)
-			assertBodyEquals(t, w, test.expectedContent)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertBodyContains(t, w, tc.wantErr)
 		})
 	}
 }
 
-func TestImage(t *testing.T) {
+func TestProbe(t *testing.T) {
 	t.Parallel()
-	acceptTests := []struct {
-		acceptHeader        string
-		expectedContentType string
-		expectedStatus      int
-	}{
-		{"", "image/png", http.StatusOK},
-		{"image/*", "image/png", http.StatusOK},
-		{"image/png", "image/png", http.StatusOK},
-		{"image/jpeg", "image/jpeg", http.StatusOK},
-		{"image/webp", "image/webp", http.StatusOK},
-		{"image/svg+xml", "image/svg+xml", http.StatusOK},
 
-		{"image/raw", "", http.StatusUnsupportedMediaType},
-		{"image/jpg", "", http.StatusUnsupportedMediaType},
-		{"image/svg", "", http.StatusUnsupportedMediaType},
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	// readRaw sends a request over a fresh connection, deliberately without
+	// asking the server to close it, and returns the header block and
+	// whatever follows it before the server closes the connection.
+	readRaw := func(t *testing.T, method, path string) (*http.Response, []byte) {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		assertNil(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: example.com\r\n\r\n", method, path)
+		raw, err := io.ReadAll(conn)
+		assertNil(t, err)
+
+		end := bytes.Index(raw, []byte("\r\n\r\n"))
+		if end < 0 {
+			t.Fatalf("no end of headers in response %q", raw)
+		}
+		tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw[:end+4])))
+		statusLine, err := tp.ReadLine()
+		assertNil(t, err)
+		if statusLine != "HTTP/1.1 200 OK" {
+			t.Fatalf("unexpected status line %q", statusLine)
+		}
+		header, err := tp.ReadMIMEHeader()
+		assertNil(t, err)
+		return &http.Response{Header: http.Header(header)}, raw[end+4:]
 	}
 
-	for _, test := range acceptTests {
-		test := test
-		t.Run("ok/accept="+test.acceptHeader, func(t *testing.T) {
+	for _, tc := range []struct {
+		method        string
+		path          string
+		contentLength string
+	}{
+		{"GET", "/probe", "1024"},
+		{"GET", "/probe?content_length=0", "0"},
+		{"GET", "/probe?content_length=10737418240", "10737418240"},
+		{"HEAD", "/probe?content_length=5", "5"},
+	} {
+		tc := tc
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", "/image", nil)
-			r.Header.Set("Accept", test.acceptHeader)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-
-			assertStatusCode(t, w, test.expectedStatus)
-			if test.expectedContentType != "" {
-				assertContentType(t, w, test.expectedContentType)
+			resp, body := readRaw(t, tc.method, tc.path)
+			assertHeader(t, resp, "Content-Length", tc.contentLength)
+			assertHeader(t, resp, "ETag", `"probe-`+tc.contentLength+`"`)
+			assertHeader(t, resp, "Accept-Ranges", "bytes")
+			assertHeader(t, resp, "Connection", "close")
+			assertHeader(t, resp, "Transfer-Encoding", "")
+			if len(body) != 0 {
+				t.Fatalf("expected no body bytes after headers, got %q", body)
 			}
 		})
 	}
 
-	imageTests := []struct {
-		url            string
-		expectedStatus int
-	}{
-		{"/image/png", http.StatusOK},
-		{"/image/jpeg", http.StatusOK},
-		{"/image/webp", http.StatusOK},
-		{"/image/svg", http.StatusOK},
+	t.Run("client sees truncated body", func(t *testing.T) {
+		t.Parallel()
+		resp, err := srv.Client().Get(srv.URL + "/probe?content_length=100")
+		assertNil(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.ContentLength != 100 {
+			t.Fatalf("expected 200 advertising 100 bytes, got %d advertising %d", resp.StatusCode, resp.ContentLength)
+		}
+		if _, err := io.ReadAll(resp.Body); err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected io.ErrUnexpectedEOF reading body, got %v", err)
+		}
+	})
 
-		{"/image/raw", http.StatusNotFound},
-		{"/image/jpg", http.StatusNotFound},
-		{"/image/png/foo", http.StatusNotFound},
-	}
+	t.Run("not hijackable", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/probe", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNotImplemented)
+	})
 
-	for _, test := range imageTests {
-		test := test
-		t.Run("error"+test.url, func(t *testing.T) {
+	t.Run("http/2", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/probe", nil)
+		r.ProtoMajor, r.ProtoMinor = 2, 0
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNotImplemented)
+		assertBodyContains(t, w, "requires HTTP/1.x")
+	})
+
+	for _, raw := range []string{"-1", "foo", "1.5", "99999999999999999999"} {
+		raw := raw
+		t.Run("bad content_length "+raw, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
+			r, _ := http.NewRequest("GET", "/probe?content_length="+raw, nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, test.expectedStatus)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
 		})
 	}
-}
 
-func TestXML(t *testing.T) {
-	t.Parallel()
-	r, _ := http.NewRequest("GET", "/xml", nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
-
-	assertContentType(t, w, "application/xml")
-	assertBodyContains(t, w, `<?xml version='1.0' encoding='us-ascii'?>`)
-}
-
-func isValidUUIDv4(uuid string) error {
-	if len(uuid) != 36 {
-		return fmt.Errorf("uuid length: %d != 36", len(uuid))
-	}
-	r := regexp.MustCompile("^[a-f0-9]{8}-[a-f0-9]{4}-4[a-f0-9]{3}-[8|9|a|b][a-f0-9]{3}-[a-f0-9]{12}$")
-	if !r.MatchString(uuid) {
-		return errors.New("Failed to match against uuidv4 regex")
-	}
-	return nil
+	t.Run("method not allowed", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("POST", "/probe", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusMethodNotAllowed)
+	})
 }
 
-func TestUUID(t *testing.T) {
+func TestNaughty(t *testing.T) {
 	t.Parallel()
-	r, _ := http.NewRequest("GET", "/uuid", nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
 
-	assertStatusCode(t, w, http.StatusOK)
-
-	// Test response unmarshalling
-	var resp *uuidResponse
-	err := json.Unmarshal(w.Body.Bytes(), &resp)
-	if err != nil {
-		t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+	bigApp := New()
+	get := func(t *testing.T, app *HTTPBin, url string) *httptest.ResponseRecorder {
+		t.Helper()
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
 	}
-
-	// Test if the value is an actual UUID
-	if err := isValidUUIDv4(resp.UUID); err != nil {
-		t.Fatalf("Invalid uuid %s: %s", resp.UUID, err)
+	decode := func(t *testing.T, w *httptest.ResponseRecorder) []string {
+		t.Helper()
+		if !utf8.Valid(w.Body.Bytes()) {
+			t.Fatalf("response body is not valid UTF-8")
+		}
+		var got []string
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("failed to unmarshal body %q: %s", w.Body, err)
+		}
+		return got
 	}
-}
 
-func TestBase64(t *testing.T) {
-	t.Parallel()
-	okTests := []struct {
-		requestURL string
-		want       string
-	}{
-		{
-			"/base64/dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n",
-			"valid_base64_encoded_string",
-		},
-		{
-			"/base64/decode/dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n",
-			"valid_base64_encoded_string",
-		},
-		{
-			"/base64/encode/valid_base64_encoded_string",
-			"dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n",
+	t.Run("golden bytes", func(t *testing.T) {
+		t.Parallel()
+		w := get(t, bigApp, "/naughty?category=unicode&count=3")
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, jsonContentType)
+		assertHeader(t, w, "X-Naughty-Version", "1")
+		assertHeader(t, w, "X-Naughty-Count", "3")
+		assertBodyEquals(t, w, "[\n  \"\u200b\",\n  \"\u200d\",\n  \"a\u200bb\"\n]\n")
+	})
+
+	// A few of the strings in each category, written as Go string literals
+	// so that the JSON transport is checked against bytes that do not pass
+	// through encoding/json.
+	golden := map[string][]string{
+		"unicode": {
+			"\U0001F468\u200d\U0001F469\u200d\U0001F467\u200d\U0001F466",
+			"\u202egnp.exe",
+			"\ufeff",
+			"\ud7ff", "\ue000", "\U00010000", "\U0010FFFF",
+			"e\u0301",
+			"\u2028",
+			"a\x00b",
+			"\a\b\x1b[31mred\x1b[0m",
+			strings.Repeat("A", 4096),
 		},
-		{
-			// make sure we correctly handle padding
-			// https://github.com/mccutchen/go-httpbin/issues/118
-			"/base64/dGVzdC1pbWFnZQ==",
-			"test-image",
+		"injection": {
+			"null", "undefined", "__proto__",
+			"' OR '1'='1",
+			"<script>alert(1)</script>",
+			"foo\r\nSet-Cookie: injected=1",
+			`", "admin": true, "x": "`,
+			`\u0000`,
+			"file.txt\x00.jpg",
 		},
-		{
-			// URL-safe base64 is used for decoding (note the - instead of + in
-			// encoded input string)
-			"/base64/decode/YWJjMTIzIT8kKiYoKSctPUB-",
-			"abc123!?$*&()'-=@~",
+		"numbers": {
+			"-0", "007", "1e309", "NaN", "9007199254740993", "18446744073709551616",
+			"\u0663", "1" + strings.Repeat("0", 400),
 		},
-		{
-			// URL-safe base64 is used for encoding (note the - instead of + in
-			// encoded output string)
-			"/base64/encode/abc123%21%3F%24%2A%26%28%29%27-%3D%40~",
-			"YWJjMTIzIT8kKiYoKSctPUB-",
+		"paths": {
+			"../../etc/passwd", `..\..\windows\win.ini`, "%2e%2e%2f%2e%2e%2fetc%2fpasswd",
+			"CON", "foo\x00bar", "cafe\u0301", strings.Repeat("a", 256),
 		},
 	}
 
-	for _, test := range okTests {
-		test := test
-		t.Run("ok"+test.requestURL, func(t *testing.T) {
+	var all []string
+	for _, category := range naughtyCategories {
+		category := category
+		corpus, err := naughtyStrings(latestNaughtyVersion, category)
+		assertNil(t, err)
+		all = append(all, corpus...)
+
+		t.Run("json "+category, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.requestURL, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
+			w := get(t, bigApp, "/naughty?category="+category)
 			assertStatusCode(t, w, http.StatusOK)
-			assertContentType(t, w, "text/plain")
-			assertBodyEquals(t, w, test.want)
+			got := decode(t, w)
+			if !reflect.DeepEqual(got, corpus) {
+				t.Fatalf("expected embedded %s corpus, got %q", category, got)
+			}
+			assertHeader(t, w, "X-Naughty-Count", strconv.Itoa(len(corpus)))
+			for _, want := range golden[category] {
+				if !containsString(got, want) {
+					t.Errorf("expected %s corpus to contain %q", category, want)
+				}
+			}
 		})
 	}
 
-	errorTests := []struct {
-		requestURL           string
-		expectedBodyContains string
-	}{
-		{
-			"/base64/invalid_base64_encoded_string",
-			"decode failed",
-		},
-		{
-			"/base64/decode/invalid_base64_encoded_string",
-			"decode failed",
-		},
-		{
-			"/base64/decode/invalid_base64_encoded_string",
-			"decode failed",
-		},
-		{
-			"/base64/decode/" + randStringBytes(Base64MaxLen+1),
-			"Cannot handle input",
-		},
-		{
-			"/base64/decode/" + randStringBytes(Base64MaxLen+1),
-			"Cannot handle input",
-		},
-		{
-			"/base64/",
-			"no input data",
-		},
-		{
-			"/base64/decode/",
-			"no input data",
-		},
-		{
-			"/base64/decode/dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n/extra",
-			"invalid URL",
-		},
-		{
-			"/base64/unknown/dmFsaWRfYmFzZTY0X2VuY29kZWRfc3RyaW5n",
-			"invalid operation: unknown",
-		},
-		{
-			// we only support URL-safe base64 encoded strings (note the +
-			// instead of - in encoded input string)
-			"/base64/decode/YWJjMTIzIT8kKiYoKSctPUB+",
-			"illegal base64 data",
-		},
+	t.Run("all categories", func(t *testing.T) {
+		t.Parallel()
+		if got := decode(t, get(t, bigApp, "/naughty")); !reflect.DeepEqual(got, all) {
+			t.Fatalf("expected every category in order")
+		}
+	})
+
+	t.Run("lines", func(t *testing.T) {
+		t.Parallel()
+		w := get(t, bigApp, "/naughty?category=injection&as=lines")
+		assertStatusCode(t, w, http.StatusOK)
+		assertContentType(t, w, "text/plain; charset=utf-8")
+		assertHeader(t, w, "X-Naughty-Omitted", "3")
+
+		got := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+		assertHeader(t, w, "X-Naughty-Count", strconv.Itoa(len(got)))
+		for _, want := range golden["injection"] {
+			if strings.ContainsAny(want, "\r\n") {
+				if containsString(got, want) {
+					t.Errorf("expected %q to be omitted", want)
+				}
+			} else if !containsString(got, want) {
+				t.Errorf("expected lines to contain %q", want)
+			}
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		t.Parallel()
+		got := decode(t, get(t, bigApp, "/naughty?category=numbers&count=5"))
+		if want := []string{"0", "-0", "+0", "00", "007"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	})
+
+	t.Run("capped by max body size", func(t *testing.T) {
+		t.Parallel()
+		for _, as := range []string{"json", "lines"} {
+			w := get(t, app, "/naughty?as="+as)
+			assertStatusCode(t, w, http.StatusOK)
+			assertHeader(t, w, "X-Naughty-Truncated", "true")
+			if int64(w.Body.Len()) > app.MaxBodySize {
+				t.Fatalf("expected body of at most %d bytes, got %d", app.MaxBodySize, w.Body.Len())
+			}
+		}
+		got := decode(t, get(t, app, "/naughty"))
+		if len(got) == 0 || !reflect.DeepEqual(got, all[:len(got)]) {
+			t.Fatalf("expected a prefix of the corpus, got %q", got)
+		}
+	})
+
+	for _, url := range []string{
+		"/naughty?category=emoji",
+		"/naughty?version=0",
+		"/naughty?version=2",
+		"/naughty?as=xml",
+		"/naughty?count=0",
+		"/naughty?category=numbers&count=1000",
+	} {
+		url := url
+		t.Run("error "+url, func(t *testing.T) {
+			t.Parallel()
+			w := get(t, app, url)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertContentType(t, w, jsonContentType)
+		})
+	}
+}
+
+func containsString(strs []string, s string) bool {
+	for _, candidate := range strs {
+		if candidate == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTruncate(t *testing.T) {
+	t.Parallel()
+
+	full := make([]byte, 1000)
+	for i := range full {
+		full[i] = byte('a' + i%26)
+	}
+
+	// checkTruncated reads a truncated response, checking that exactly the
+	// first send bytes of the declared body arrived before the error.
+	checkTruncated := func(t *testing.T, resp *http.Response, send int) {
+		t.Helper()
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		if resp.ContentLength != 1000 {
+			t.Fatalf("expected declared Content-Length 1000, got %d", resp.ContentLength)
+		}
+		assertHeader(t, resp, "ETag", "range1000")
+		assertHeader(t, resp, "Accept-Ranges", "bytes")
+		body, err := io.ReadAll(resp.Body)
+		if err == nil {
+			t.Fatalf("expected error reading truncated body, got %d bytes", len(body))
+		}
+		if !bytes.Equal(body, full[:send]) {
+			t.Fatalf("expected the first %d bytes of the body, got %d bytes: %q", send, len(body), body)
+		}
 	}
 
-	for _, test := range errorTests {
-		test := test
-		t.Run("error"+test.requestURL, func(t *testing.T) {
+	t.Run("http1 resumes from range", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL + "/truncate?declare=1000&send=300")
+		assertNil(t, err)
+		checkTruncated(t, resp, 300)
+		if !resp.Close {
+			t.Fatalf("expected Connection: close")
+		}
+
+		req, _ := http.NewRequest("GET", srv.URL+"/range/1000", nil)
+		req.Header.Set("Range", "bytes=300-")
+		resp, err = http.DefaultClient.Do(req)
+		assertNil(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("expected status 206, got %d", resp.StatusCode)
+		}
+		rest, err := io.ReadAll(resp.Body)
+		assertNil(t, err)
+		if !bytes.Equal(append(full[:300:300], rest...), full) {
+			t.Fatalf("expected resumed download to complete the body")
+		}
+	})
+
+	t.Run("http2 resets stream", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewUnstartedServer(app)
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		defer srv.Close()
+
+		resp, err := srv.Client().Get(srv.URL + "/truncate?declare=1000&send=700")
+		assertNil(t, err)
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("expected HTTP/2 response, got %s", resp.Proto)
+		}
+		checkTruncated(t, resp, 700)
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL + "/truncate")
+		assertNil(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		// declare is capped at the test app's max body size of 1024 bytes
+		if resp.ContentLength != 1024 || len(body) != 512 {
+			t.Fatalf("expected 512 of 1024 bytes, got %d of %d", len(body), resp.ContentLength)
+		}
+	})
+
+	for _, tc := range []struct {
+		query   string
+		wantErr string
+	}{
+		{"declare=0", "invalid declare"},
+		{"declare=1025", "invalid declare"},
+		{"declare=x", "invalid declare"},
+		{"declare=100&send=100", "invalid send"},
+		{"declare=100&send=-1", "invalid send"},
+	} {
+		tc := tc
+		t.Run("bad "+tc.query, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", test.requestURL, nil)
+			r, _ := http.NewRequest("GET", "/truncate?"+tc.query, nil)
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
 			assertStatusCode(t, w, http.StatusBadRequest)
-			assertBodyContains(t, w, test.expectedBodyContains)
+			assertBodyContains(t, w, tc.wantErr)
 		})
 	}
 }
 
-func TestDumpRequest(t *testing.T) {
+func TestWebSocketEcho(t *testing.T) {
 	t.Parallel()
-	r, _ := http.NewRequest("GET", "/dump/request?foo=bar", nil)
-	r.Host = "test-host"
-	r.Header.Set("x-test-header2", "Test-Value2")
-	r.Header.Set("x-test-header1", "Test-Value1")
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
-
-	assertContentType(t, w, "text/plain; charset=utf-8")
-	assertBodyEquals(t, w, "GET /dump/request?foo=bar HTTP/1.1\r\nHost: test-host\r\nX-Test-Header1: Test-Value1\r\nX-Test-Header2: Test-Value2\r\n\r\n")
-}
 
-func TestJSON(t *testing.T) {
-	t.Parallel()
-	r, _ := http.NewRequest("GET", "/json", nil)
-	w := httptest.NewRecorder()
-	app.ServeHTTP(w, r)
+	// expectClose reads frames until a close frame, checking its code.
+	expectClose := func(t *testing.T, br *bufio.Reader, code int) {
+		t.Helper()
+		op, payload := readWebSocketFrame(t, br)
+		if op != websocket.OpClose || len(payload) < 2 || int(payload[0])<<8|int(payload[1]) != code {
+			t.Fatalf("expected close frame with code %d, got opcode %d payload %q", code, op, payload)
+		}
+	}
 
-	assertContentType(t, w, jsonContentType)
-	assertBodyContains(t, w, `Wake up to WonderWidgets!`)
-}
+	t.Run("echoes messages", func(t *testing.T) {
+		t.Parallel()
+		results := make(chan Result, 1)
+		app := New(WithObserver(func(r Result) { results <- r }))
+		srv := httptest.NewServer(app)
+		defer srv.Close()
 
-func TestBearer(t *testing.T) {
-	t.Parallel()
-	requestURL := "/bearer"
+		conn, br := dialWebSocket(t, srv, "/websocket/echo")
+		writeWebSocketFrame(t, conn, websocket.OpText, []byte("hello"))
+		if op, payload := readWebSocketFrame(t, br); op != websocket.OpText || string(payload) != "hello" {
+			t.Fatalf("expected text echo, got opcode %d payload %q", op, payload)
+		}
+		writeWebSocketFrame(t, conn, websocket.OpBinary, []byte{0, 1, 2})
+		if op, payload := readWebSocketFrame(t, br); op != websocket.OpBinary || !bytes.Equal(payload, []byte{0, 1, 2}) {
+			t.Fatalf("expected binary echo, got opcode %d payload %q", op, payload)
+		}
+		writeWebSocketFrame(t, conn, websocket.OpPing, []byte("ping"))
+		if op, payload := readWebSocketFrame(t, br); op != websocket.OpPong || string(payload) != "ping" {
+			t.Fatalf("expected pong, got opcode %d payload %q", op, payload)
+		}
+		writeWebSocketFrame(t, conn, websocket.OpClose, []byte{0x03, 0xE8})
+		expectClose(t, br, websocket.CloseNormalClosure)
+
+		result := <-results
+		want := map[string]string{
+			"websocket_messages":       "2",
+			"websocket_bytes_received": "8",
+			"websocket_bytes_sent":     "8",
+			"websocket_close_code":     "1000",
+		}
+		for k, v := range want {
+			if got := result.Annotations[k]; got != v {
+				t.Errorf("expected annotation %s=%q, got %q", k, v, got)
+			}
+		}
+	})
 
-	t.Run("valid_token", func(t *testing.T) {
+	t.Run("max message size", func(t *testing.T) {
 		t.Parallel()
-		token := "valid_token"
-		r, _ := http.NewRequest("GET", requestURL, nil)
-		r.Header.Set("Authorization", "Bearer "+token)
-		w := httptest.NewRecorder()
-		app.ServeHTTP(w, r)
-
-		assertStatusCode(t, w, http.StatusOK)
+		srv := httptest.NewServer(app)
+		defer srv.Close()
 
-		var resp *bearerResponse
-		err := json.Unmarshal(w.Body.Bytes(), &resp)
-		if err != nil {
-			t.Fatalf("failed to unmarshal body %s from JSON: %s", w.Body, err)
+		conn, br := dialWebSocket(t, srv, "/websocket/echo?max_message_size=8")
+		writeWebSocketFragment(t, conn, false, websocket.OpText, []byte("1234"))
+		writeWebSocketFragment(t, conn, true, websocket.OpContinuation, []byte("5678"))
+		if op, payload := readWebSocketFrame(t, br); op != websocket.OpText || string(payload) != "12345678" {
+			t.Fatalf("expected echo of message at the limit, got opcode %d payload %q", op, payload)
 		}
+		writeWebSocketFragment(t, conn, false, websocket.OpText, []byte("1234"))
+		writeWebSocketFragment(t, conn, true, websocket.OpContinuation, []byte("56789"))
+		expectClose(t, br, websocket.CloseMessageTooBig)
+	})
 
-		if resp.Authenticated != true {
-			t.Fatalf("expected response key %s=%#v, got %#v",
-				"Authenticated", true, resp.Authenticated)
+	t.Run("max fragment size", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(app)
+		defer srv.Close()
+
+		conn, br := dialWebSocket(t, srv, "/websocket/echo?max_fragment_size=4")
+		writeWebSocketFragment(t, conn, false, websocket.OpText, []byte("hell"))
+		writeWebSocketFragment(t, conn, true, websocket.OpContinuation, []byte("o"))
+		if op, payload := readWebSocketFrame(t, br); op != websocket.OpText || string(payload) != "hello" {
+			t.Fatalf("expected echo of fragmented message, got opcode %d payload %q", op, payload)
 		}
-		if resp.Token != token {
-			t.Fatalf("expected response key %s=%#v, got %#v",
-				"token", token, resp.Authenticated)
+		writeWebSocketFrame(t, conn, websocket.OpText, []byte("hello"))
+		expectClose(t, br, websocket.CloseMessageTooBig)
+	})
+
+	t.Run("max connection lifetime", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(New(WithMaxDuration(50 * time.Millisecond)))
+		defer srv.Close()
+
+		start := time.Now()
+		_, br := dialWebSocket(t, srv, "/websocket/echo")
+		expectClose(t, br, websocket.CloseNormalClosure)
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Fatalf("expected connection to last at least 50ms, closed after %s", elapsed)
 		}
 	})
 
-	errorTests := []struct {
-		authorizationHeader string
+	t.Run("requires handshake", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/websocket/echo", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusUpgradeRequired)
+		assertContentType(t, w, jsonContentType)
+		assertHeader(t, w, "Upgrade", "websocket")
+		assertBodyContains(t, w, "requires a WebSocket handshake")
+	})
+
+	for _, tc := range []struct {
+		query   string
+		wantErr string
 	}{
-		{
-			"",
-		},
-		{
-			"Bearer",
-		},
-		{
-			"Bearer x y",
-		},
-		{
-			"bearer x",
-		},
-		{
-			"Bearer1 x",
-		},
-		{
-			"xBearer x",
-		},
-	}
-	for _, test := range errorTests {
-		test := test
-		t.Run("error"+test.authorizationHeader, func(t *testing.T) {
+		{"max_message_size=0", "invalid max_message_size"},
+		{"max_message_size=1025", "invalid max_message_size"},
+		{"max_fragment_size=0", "invalid max_fragment_size"},
+		{"max_message_size=10&max_fragment_size=11", "invalid max_fragment_size"},
+	} {
+		tc := tc
+		t.Run("bad "+tc.query, func(t *testing.T) {
 			t.Parallel()
-			r, _ := http.NewRequest("GET", requestURL, nil)
-			if test.authorizationHeader != "" {
-				r.Header.Set("Authorization", test.authorizationHeader)
-			}
+			r, _ := http.NewRequest("GET", "/websocket/echo?"+tc.query, nil)
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
 			w := httptest.NewRecorder()
 			app.ServeHTTP(w, r)
-			assertHeader(t, w, "WWW-Authenticate", "Bearer")
-			assertStatusCode(t, w, http.StatusUnauthorized)
+			assertStatusCode(t, w, http.StatusBadRequest)
+			assertBodyContains(t, w, tc.wantErr)
 		})
 	}
 }
 
-func TestNotImplemented(t *testing.T) {
-	t.Parallel()
-	tests := []struct {
-		url string
-	}{
-		{"/brotli"},
+// verifyJWT checks the signature of a compact JWS against the keys of a
+// JWKS, returning its claims.
+func verifyJWT(token string, jwks jwksResponse) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("expected 3 token parts, got %d", len(parts))
 	}
-	for _, test := range tests {
-		test := test
-		t.Run(test.url, func(t *testing.T) {
-			t.Parallel()
-			r, _ := http.NewRequest("GET", test.url, nil)
-			w := httptest.NewRecorder()
-			app.ServeHTTP(w, r)
-			assertStatusCode(t, w, http.StatusNotImplemented)
-		})
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "ES256" {
+		return nil, fmt.Errorf("unexpected alg %q", header.Alg)
 	}
+	var pub *ecdsa.PublicKey
+	for _, key := range jwks.Keys {
+		if key.Kid != header.Kid {
+			continue
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(key.X)
+		y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+		if errX != nil || errY != nil || key.Kty != "EC" || key.Crv != "P-256" {
+			return nil, fmt.Errorf("invalid key %+v", key)
+		}
+		pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	if pub == nil {
+		return nil, fmt.Errorf("no published key with kid %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return nil, fmt.Errorf("invalid signature encoding")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, errors.New("invalid signature")
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	err = json.Unmarshal(rawClaims, &claims)
+	return claims, err
 }
 
-func TestHostname(t *testing.T) {
+func TestOIDCSimulator(t *testing.T) {
 	t.Parallel()
-	loadResponse := func(t *testing.T, bodyBytes []byte) hostnameResponse {
-		var resp hostnameResponse
-		err := json.Unmarshal(bodyBytes, &resp)
+
+	const adminToken = "admin-token"
+
+	t.Run("discovery to validation", func(t *testing.T) {
+		t.Parallel()
+
+		// The issuer must be known before the server starts, so listen first
+		l, err := net.Listen("tcp", "127.0.0.1:0")
 		if err != nil {
-			t.Fatalf("failed to unmarshal body %q from JSON: %s", string(bodyBytes), err)
+			t.Fatal(err)
 		}
-		return resp
-	}
+		issuer := "http://" + l.Addr().String()
+		app := New(WithOIDCSimulator(issuer+"/"), WithAdminAPI(adminToken))
+		var nowNanos int64 = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+		app.now = func() time.Time { return time.Unix(0, atomic.LoadInt64(&nowNanos)) }
+		srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: app}}
+		srv.Start()
+		defer srv.Close()
 
-	t.Run("default hostname", func(t *testing.T) {
+		getJSON := func(t *testing.T, u string, v interface{}) {
+			t.Helper()
+			resp, err := srv.Client().Get(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET %s: expected status 200, got %d", u, resp.StatusCode)
+			}
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var discovery oidcDiscoveryResponse
+		getJSON(t, issuer+"/.well-known/openid-configuration", &discovery)
+		if discovery.Issuer != issuer {
+			t.Fatalf("expected issuer %q, got %q", issuer, discovery.Issuer)
+		}
+
+		issue := func(t *testing.T) string {
+			t.Helper()
+			resp, err := srv.Client().PostForm(discovery.TokenEndpoint, url.Values{
+				"grant_type": {"client_credentials"},
+				"client_id":  {"test-client"},
+				"audience":   {"test-api"},
+				"scope":      {"read write"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var tok oauthTokenResponse
+			if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || tok.TokenType != "Bearer" || tok.ExpiresIn != 3600 {
+				t.Fatalf("unexpected token response %d %+v", resp.StatusCode, tok)
+			}
+			return tok.AccessToken
+		}
+
+		var jwks jwksResponse
+		getJSON(t, discovery.JWKSURI, &jwks)
+		if len(jwks.Keys) != 1 {
+			t.Fatalf("expected 1 published key, got %d", len(jwks.Keys))
+		}
+		oldToken := issue(t)
+		claims, err := verifyJWT(oldToken, jwks)
+		if err != nil {
+			t.Fatalf("failed to verify token: %s", err)
+		}
+		now := app.now()
+		for key, want := range map[string]interface{}{
+			"iss":       discovery.Issuer,
+			"sub":       "test-client",
+			"aud":       "test-api",
+			"client_id": "test-client",
+			"scope":     "read write",
+			"iat":       float64(now.Unix()),
+			"exp":       float64(now.Add(time.Hour).Unix()),
+		} {
+			if claims[key] != want {
+				t.Errorf("expected claim %s to be %v, got %v", key, want, claims[key])
+			}
+		}
+
+		// Rotation publishes the new key alongside the old one
+		r, _ := http.NewRequest("POST", issuer+"/admin/oidc/rotate-keys", nil)
+		r.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := srv.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rotated adminOIDCRotateResponse
+		err = json.NewDecoder(resp.Body).Decode(&rotated)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rotated.Kid == jwks.Keys[0].Kid || len(rotated.Retired) != 1 || rotated.Retired[0].Kid != jwks.Keys[0].Kid {
+			t.Fatalf("unexpected rotation response %+v", rotated)
+		}
+		if want := now.Add(time.Hour); !rotated.Retired[0].Expires.Equal(want) {
+			t.Fatalf("expected old key to expire at %s, got %s", want, rotated.Retired[0].Expires)
+		}
+
+		getJSON(t, discovery.JWKSURI, &jwks)
+		if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != rotated.Kid {
+			t.Fatalf("expected new key followed by old key, got %+v", jwks.Keys)
+		}
+		if _, err := verifyJWT(oldToken, jwks); err != nil {
+			t.Fatalf("expected old token to verify during grace period: %s", err)
+		}
+		newToken := issue(t)
+		if _, err := verifyJWT(newToken, jwks); err != nil {
+			t.Fatalf("failed to verify new token: %s", err)
+		}
+
+		// Once the grace period ends, only the new key remains
+		atomic.AddInt64(&nowNanos, int64(time.Hour))
+		getJSON(t, discovery.JWKSURI, &jwks)
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != rotated.Kid {
+			t.Fatalf("expected only the new key, got %+v", jwks.Keys)
+		}
+		if _, err := verifyJWT(oldToken, jwks); err == nil {
+			t.Fatalf("expected old token to fail verification after grace period")
+		}
+		if _, err := verifyJWT(newToken, jwks); err != nil {
+			t.Fatalf("failed to verify new token: %s", err)
+		}
+	})
+
+	t.Run("token errors", func(t *testing.T) {
 		t.Parallel()
-		var (
-			app  = New()
-			r, _ = http.NewRequest("GET", "/hostname", nil)
-			w    = httptest.NewRecorder()
-		)
-		app.ServeHTTP(w, r)
-		assertStatusCode(t, w, http.StatusOK)
-		resp := loadResponse(t, w.Body.Bytes())
-		if resp.Hostname != DefaultHostname {
-			t.Errorf("expected hostname %q, got %q", DefaultHostname, resp.Hostname)
+		app := New(WithOIDCSimulator("https://issuer.example"))
+		for _, tc := range []struct {
+			form       url.Values
+			basicAuth  bool
+			wantStatus int
+			wantError  string
+		}{
+			{url.Values{"grant_type": {"password"}, "client_id": {"c"}}, false, http.StatusBadRequest, "unsupported_grant_type"},
+			{url.Values{"client_id": {"c"}}, false, http.StatusBadRequest, "unsupported_grant_type"},
+			{url.Values{"grant_type": {"client_credentials"}}, false, http.StatusUnauthorized, "invalid_client"},
+			{url.Values{"grant_type": {"client_credentials"}}, true, http.StatusOK, ""},
+		} {
+			r, _ := http.NewRequest("POST", "/oauth/token", strings.NewReader(tc.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.basicAuth {
+				r.SetBasicAuth("basic-client", "secret")
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertStatusCode(t, w, tc.wantStatus)
+			var resp oauthErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error != tc.wantError {
+				t.Errorf("form %v: expected error %q, got %q", tc.form, tc.wantError, resp.Error)
+			}
 		}
 	})
 
-	t.Run("real hostname", func(t *testing.T) {
+	t.Run("rotation requires admin token", func(t *testing.T) {
 		t.Parallel()
-		var (
-			realHostname = "real-hostname"
-			app          = New(WithHostname(realHostname))
-			r, _         = http.NewRequest("GET", "/hostname", nil)
-			w            = httptest.NewRecorder()
-		)
+		app := New(WithOIDCSimulator("https://issuer.example"), WithAdminAPI(adminToken))
+		r, _ := http.NewRequest("POST", "/admin/oidc/rotate-keys", nil)
+		w := httptest.NewRecorder()
 		app.ServeHTTP(w, r)
-		assertStatusCode(t, w, http.StatusOK)
-		resp := loadResponse(t, w.Body.Bytes())
-		if resp.Hostname != realHostname {
-			t.Errorf("expected hostname %q, got %q", realHostname, resp.Hostname)
+		assertStatusCode(t, w, http.StatusUnauthorized)
+
+		r, _ = http.NewRequest("POST", "/admin/oidc/rotate-keys?grace=-1s", nil)
+		r.Header.Set("Authorization", "Bearer "+adminToken)
+		w = httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusBadRequest)
+		assertBodyContains(t, w, "invalid grace")
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Parallel()
+		// Unknown paths fall through to the index route, which only allows GET
+		for _, tc := range []struct {
+			app  *HTTPBin
+			path string
+		}{
+			{New(), "/.well-known/openid-configuration"},
+			{New(), "/jwks.json"},
+			{New(), "/oauth/token"},
+			{New(WithOIDCSimulator("https://issuer.example")), "/admin/oidc/rotate-keys"},
+		} {
+			r, _ := http.NewRequest("GET", tc.path, nil)
+			w := httptest.NewRecorder()
+			tc.app.ServeHTTP(w, r)
+			assertStatusCode(t, w, http.StatusNotFound)
 		}
 	})
 }
@@ -1,21 +1,56 @@
 package httpbin
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
 	crypto_rand "crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"html"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"math"
 	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf16"
+
+	"github.com/mccutchen/go-httpbin/v2/httpbin/brotli"
+	"github.com/mccutchen/go-httpbin/v2/httpbin/digest"
+	"github.com/mccutchen/go-httpbin/v2/httpbin/zstd"
 )
 
 // Base64MaxLen - Maximum input length for Base64 functions
@@ -32,12 +67,65 @@ func getRequestHeaders(r *http.Request) http.Header {
 	return h
 }
 
+// dumpHeaders flattens hdr into a list of name/value pairs, one per value, so
+// that repeated headers keep their order. Go does not record the order in
+// which distinct header names arrived, so the first name is given first and
+// the rest follow in sorted order.
+func dumpHeaders(hdr http.Header, first string) []dumpHeader {
+	names := make([]string, 0, len(hdr))
+	for name := range hdr {
+		if name != first {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := hdr[first]; ok {
+		names = append([]string{first}, names...)
+	}
+
+	result := []dumpHeader{}
+	for _, name := range names {
+		for _, value := range hdr[name] {
+			result = append(result, dumpHeader{Name: name, Value: value})
+		}
+	}
+	return result
+}
+
+// tlsVersionNames names the TLS versions a server may negotiate.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// getTLSInfo describes the TLS connection r arrived on, or returns nil if it
+// was not made over TLS.
+func getTLSInfo(r *http.Request) *tlsInfo {
+	cs := r.TLS
+	if cs == nil {
+		return nil
+	}
+	version, ok := tlsVersionNames[cs.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04X", cs.Version)
+	}
+	return &tlsInfo{
+		Version:     version,
+		CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+		ALPN:        cs.NegotiatedProtocol,
+		ServerName:  cs.ServerName,
+	}
+}
+
 // getClientIP tries to get a reasonable value for the IP address of the
 // client making the request. Note that this value will likely be trivial to
 // spoof, so do not rely on it for security purposes.
 func getClientIP(r *http.Request) string {
 	// Special case some hosting platforms that provide the value directly.
-	if clientIP := r.Header.Get("Fly-Client-IP"); clientIP != "" {
+	// (Given in canonical form, which spares Header.Get an allocation.)
+	if clientIP := r.Header.Get("Fly-Client-Ip"); clientIP != "" {
 		return clientIP
 	}
 
@@ -51,6 +139,24 @@ func getClientIP(r *http.Request) string {
 	return r.RemoteAddr
 }
 
+// requestURLLength returns the length of the request's URL as the client sent
+// it on the request line.
+func requestURLLength(r *http.Request) int {
+	if r.RequestURI != "" {
+		return len(r.RequestURI)
+	}
+	return len(r.URL.RequestURI())
+}
+
+// echoedURLLength returns the length of the request's URL for inclusion in
+// echoed responses, which is only reported when the length is limited.
+func (h *HTTPBin) echoedURLLength(r *http.Request) int {
+	if h.maxURLLength == 0 {
+		return 0
+	}
+	return requestURLLength(r)
+}
+
 func getURL(r *http.Request) *url.URL {
 	scheme := r.Header.Get("X-Forwarded-Proto")
 	if scheme == "" {
@@ -96,16 +202,622 @@ func mustMarshalJSON(w io.Writer, val interface{}) {
 	}
 }
 
+// mustMarshalCompactJSON marshals val without indentation, for embedding in
+// single-line contexts like log annotations.
+func mustMarshalCompactJSON(val interface{}) []byte {
+	b, err := json.Marshal(val)
+	if err != nil {
+		panic(err.Error())
+	}
+	return b
+}
+
+// jsonEncoder encodes JSON responses into a reusable buffer, so that they may
+// be written to the client in a single call.
+type jsonEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+// maxPooledJSONBuffer bounds the size of the buffers kept in jsonEncoders, so
+// that one unusually large response does not pin its memory indefinitely.
+const maxPooledJSONBuffer = 64 * 1024
+
+var jsonEncoderPool = sync.Pool{
+	New: func() interface{} {
+		e := &jsonEncoder{}
+		e.buf.Grow(1024)
+		e.enc = json.NewEncoder(&e.buf)
+		e.enc.SetEscapeHTML(false)
+		e.enc.SetIndent("", "  ")
+		return e
+	},
+}
+
+// jsonContentTypeHeader is shared by every JSON response to avoid allocating
+// a new header value for each one. Header.Set and Header.Add both replace
+// rather than modify it.
+var jsonContentTypeHeader = []string{jsonContentType}
+
 func writeJSON(status int, w http.ResponseWriter, val interface{}) {
-	w.Header().Set("Content-Type", jsonContentType)
+	e := jsonEncoderPool.Get().(*jsonEncoder)
+	defer func() {
+		if e.buf.Cap() <= maxPooledJSONBuffer {
+			e.buf.Reset()
+			jsonEncoderPool.Put(e)
+		}
+	}()
+	if err := e.enc.Encode(val); err != nil {
+		panic(err.Error())
+	}
+	if _, ok := w.(*canonicalJSONResponseWriter); ok {
+		canonicalizeJSON(e)
+	}
+	w.Header()["Content-Type"] = jsonContentTypeHeader
 	w.WriteHeader(status)
-	mustMarshalJSON(w, val)
+	w.Write(e.buf.Bytes())
+}
+
+// canonicalizeJSON re-encodes the document in e's buffer in canonical form:
+// every object's keys in lexicographic order, the usual two-space
+// indentation, and each number exactly as originally encoded. Struct fields
+// are otherwise encoded in declaration order, and custom marshalers may
+// order keys however they like, so this goes by way of a generic value
+// rather than relying on the Go types involved.
+func canonicalizeJSON(e *jsonEncoder) {
+	dec := json.NewDecoder(bytes.NewReader(e.buf.Bytes()))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		panic(err.Error())
+	}
+	e.buf.Reset()
+	if err := e.enc.Encode(v); err != nil {
+		panic(err.Error())
+	}
+}
+
+// reflectedHeaderSize measures the size of hdr as it would be written on the
+// wire, i.e. "Key: value\r\n" for each value.
+func reflectedHeaderSize(hdr http.Header) int {
+	var size int
+	for k, vs := range hdr {
+		for _, v := range vs {
+			size += len(k) + len(": ") + len(v) + len("\r\n")
+		}
+	}
+	return size
+}
+
+// reflectHeaders adds response headers derived from client input to the
+// response. Every endpoint that reflects client input into response headers
+// must do so via reflectHeaders, which enforces the instance's budget for
+// them (see WithMaxReflectedHeaderBytes): if hdr exceeds it, no headers are
+// added, a 400 Bad Request error is written, and false is returned.
+func (h *HTTPBin) reflectHeaders(w http.ResponseWriter, hdr http.Header) bool {
+	if h.maxReflectedHeaderBytes > 0 {
+		if size := reflectedHeaderSize(hdr); size > h.maxReflectedHeaderBytes {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("reflected response headers total %d bytes, exceeding the limit of %d bytes", size, h.maxReflectedHeaderBytes))
+			return false
+		}
+	}
+	for k, vs := range hdr {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	return true
+}
+
+// reflectCookies sets the given cookies via reflectHeaders, skipping any that
+// are invalid, as http.SetCookie does.
+func (h *HTTPBin) reflectCookies(w http.ResponseWriter, cookies []*http.Cookie) bool {
+	hdr := make(http.Header, 1)
+	for _, c := range cookies {
+		if v := c.String(); v != "" {
+			hdr.Add("Set-Cookie", v)
+		}
+	}
+	return h.reflectHeaders(w, hdr)
+}
+
+// cookieSpec describes a cookie for /cookies/set to set, either in a JSON
+// request body or via query params.
+type cookieSpec struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path"`
+	Domain   string `json:"domain"`
+	MaxAge   *int   `json:"max_age"`
+	Secure   bool   `json:"secure"`
+	HTTPOnly *bool  `json:"httponly"`
+	SameSite string `json:"samesite"`
+}
+
+// cookie returns the cookie described by spec, which is HttpOnly unless
+// stated otherwise. Cookies named with a __Secure- or __Host- prefix must
+// meet the prefix's requirements, as browsers would otherwise reject them.
+func (spec cookieSpec) cookie() (*http.Cookie, error) {
+	sameSite, err := parseSameSite(spec.SameSite)
+	if err != nil {
+		return nil, err
+	}
+	c := &http.Cookie{
+		Name:     spec.Name,
+		Value:    spec.Value,
+		Path:     spec.Path,
+		Domain:   spec.Domain,
+		Secure:   spec.Secure,
+		HttpOnly: spec.HTTPOnly == nil || *spec.HTTPOnly,
+		SameSite: sameSite,
+	}
+	if spec.MaxAge != nil {
+		switch {
+		case *spec.MaxAge < 0:
+			return nil, errors.New("max_age must be non-negative")
+		case *spec.MaxAge == 0:
+			// http.Cookie writes Max-Age=0 for a negative MaxAge
+			c.MaxAge = -1
+		default:
+			c.MaxAge = *spec.MaxAge
+		}
+	}
+	if hasCookiePrefix(c.Name, "__Secure-") && !c.Secure {
+		return nil, errors.New("cookies prefixed with __Secure- must be secure")
+	}
+	if hasCookiePrefix(c.Name, "__Host-") && (!c.Secure || c.Path != "/" || c.Domain != "") {
+		return nil, errors.New("cookies prefixed with __Host- must be secure, have path / and no domain")
+	}
+	return c, nil
+}
+
+// hasCookiePrefix reports whether name begins with prefix, matched
+// case-insensitively.
+func hasCookiePrefix(name, prefix string) bool {
+	return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+}
+
+// parseSameSite parses a SameSite cookie attribute value, matched
+// case-insensitively. An empty value leaves the attribute unset.
+func parseSameSite(raw string) (http.SameSite, error) {
+	switch strings.ToLower(raw) {
+	case "":
+		return 0, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("%q must be one of strict, lax or none", raw)
+	}
+}
+
+// parseCookieQuery parses the query params of /cookies/set into cookie
+// specs, sorted by name. Params named like cookie attributes, e.g.
+// __samesite=strict, apply to every cookie rather than naming one. A
+// non-nil error is accompanied by the name of the offending param.
+func parseCookieQuery(q url.Values) ([]cookieSpec, string, error) {
+	var attrs cookieSpec
+	if raw := q.Get("__path"); raw != "" {
+		attrs.Path = raw
+	}
+	if raw := q.Get("__domain"); raw != "" {
+		attrs.Domain = raw
+	}
+	if raw := q.Get("__max_age"); raw != "" {
+		maxAge, err := strconv.Atoi(raw)
+		if err != nil || maxAge < 0 {
+			return nil, "__max_age", errors.New("must be a non-negative integer")
+		}
+		attrs.MaxAge = &maxAge
+	}
+	for _, param := range []string{"__secure", "__httponly"} {
+		raw := q.Get(param)
+		if raw == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, param, errors.New("must be a boolean")
+		}
+		if param == "__secure" {
+			attrs.Secure = b
+		} else {
+			attrs.HTTPOnly = &b
+		}
+	}
+	if _, err := parseSameSite(q.Get("__samesite")); err != nil {
+		return nil, "__samesite", err
+	}
+	attrs.SameSite = q.Get("__samesite")
+
+	names := make([]string, 0, len(q))
+	for name := range q {
+		if !cookieAttributeParams[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	specs := make([]cookieSpec, 0, len(names))
+	for _, name := range names {
+		spec := attrs
+		spec.Name, spec.Value = name, q.Get(name)
+		specs = append(specs, spec)
+	}
+	return specs, "", nil
+}
+
+// expiredCookie returns a cookie that expires the one described by spec,
+// carrying the same path and domain so that clients match it to the cookie
+// they hold. Cookies named with a __Secure- or __Host- prefix are made to
+// meet the prefix's requirements, as clients would otherwise ignore them.
+func (spec cookieSpec) expiredCookie(now time.Time) (*http.Cookie, error) {
+	if hasCookiePrefix(spec.Name, "__Secure-") || hasCookiePrefix(spec.Name, "__Host-") {
+		spec.Secure = true
+	}
+	if hasCookiePrefix(spec.Name, "__Host-") && spec.Path == "" {
+		spec.Path = "/"
+	}
+	maxAge := 0
+	spec.Value, spec.MaxAge, spec.SameSite = "", &maxAge, ""
+	c, err := spec.cookie()
+	if err != nil {
+		return nil, err
+	}
+	c.Expires = now.Add(-1 * 24 * 365 * time.Hour)
+	return c, nil
+}
+
+// parseDeleteCookiesQuery parses the query params of /cookies/delete into
+// specs for the cookies to delete, sorted by name. The __path and __domain
+// params scope every cookie, and all=true names every cookie in the
+// request. A non-nil error is accompanied by the name of the offending
+// param.
+func parseDeleteCookiesQuery(q url.Values, requestCookies []*http.Cookie) ([]cookieSpec, string, error) {
+	all := false
+	if raw := q.Get("all"); raw != "" {
+		var err error
+		all, err = strconv.ParseBool(raw)
+		if err != nil {
+			return nil, "all", errors.New("must be a boolean")
+		}
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for name := range q {
+		if name != "all" && name != "__path" && name != "__domain" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if all {
+		for _, c := range requestCookies {
+			if !seen[c.Name] {
+				seen[c.Name] = true
+				names = append(names, c.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	specs := make([]cookieSpec, 0, len(names))
+	for _, name := range names {
+		specs = append(specs, cookieSpec{Name: name, Path: q.Get("__path"), Domain: q.Get("__domain")})
+	}
+	return specs, "", nil
+}
+
+// cookieAttributeParams are the query params of /cookies/set that set
+// cookie attributes rather than naming cookies.
+var cookieAttributeParams = map[string]bool{
+	"__path":     true,
+	"__domain":   true,
+	"__max_age":  true,
+	"__secure":   true,
+	"__httponly": true,
+	"__samesite": true,
+}
+
+// isHTTPToken reports whether s is a valid RFC 9110 token, as HTTP methods
+// must be.
+func isHTTPToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidHeaderValue reports whether s may be used as a header value without
+// risk of header injection, i.e. contains no control characters other than
+// horizontal tab.
+func isValidHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// identityHeaderValue returns the header values that set a Server or
+// X-Powered-By header to value, or nil to suppress the header if value is
+// empty. The result is shared between responses, which is safe because
+// Header.Add and Header.Set never modify an existing slice in place.
+func identityHeaderValue(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+// isPlainJSONString reports whether s encodes as itself wrapped in quotes:
+// printable ASCII that needs no escaping with HTML escaping disabled.
+func isPlainJSONString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x80 || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// appendJSONFallback appends the standard encoding of v, for the values the
+// hand-written encoders below leave to encoding/json.
+func appendJSONFallback(b []byte, v interface{}) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		panic(err.Error())
+	}
+	return append(b, bytes.TrimSuffix(buf.Bytes(), []byte("\n"))...)
+}
+
+// appendJSONString appends s as a JSON string.
+func appendJSONString(b []byte, s string) []byte {
+	if !isPlainJSONString(s) {
+		return appendJSONFallback(b, s)
+	}
+	b = append(b, '"')
+	b = append(b, s...)
+	return append(b, '"')
+}
+
+// jsonValuesSizeHint estimates the encoded size of m, so that its buffer can
+// be allocated once.
+func jsonValuesSizeHint(m map[string][]string) int {
+	n := 2
+	for k, vs := range m {
+		n += len(k) + 5
+		for _, v := range vs {
+			n += len(v) + 3
+		}
+	}
+	return n
+}
+
+// appendJSONValues appends m as a JSON object with sorted keys, matching how
+// encoding/json encodes an http.Header or url.Values. Anything needing
+// escaping is left to encoding/json, since its escaping (and its ordering of
+// non-ASCII keys) has varied between Go releases.
+func appendJSONValues(b []byte, m map[string][]string) []byte {
+	if m == nil {
+		return append(b, "null"...)
+	}
+
+	var scratch [32]string
+	keys := scratch[:0]
+	for k, vs := range m {
+		if !isPlainJSONString(k) {
+			return appendJSONFallback(b, m)
+		}
+		for _, v := range vs {
+			if !isPlainJSONString(v) {
+				return appendJSONFallback(b, m)
+			}
+		}
+		keys = append(keys, k)
+	}
+	// insertion sort, since these maps are small and sort.Strings would
+	// force keys onto the heap
+	for i := 1; i < len(keys); i++ {
+		for j := i; j > 0 && keys[j] < keys[j-1]; j-- {
+			keys[j], keys[j-1] = keys[j-1], keys[j]
+		}
+	}
+
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '"')
+		b = append(b, k...)
+		b = append(b, `":`...)
+		vs := m[k]
+		if vs == nil {
+			b = append(b, "null"...)
+			continue
+		}
+		b = append(b, '[')
+		for j, v := range vs {
+			if j > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, '"')
+			b = append(b, v...)
+			b = append(b, '"')
+		}
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// annotateAuth records the outcome of an authentication check for the
+// Observer. The user is omitted when the auth scheme has no notion of one.
+func annotateAuth(r *http.Request, user string, authorized bool) {
+	Annotate(r.Context(), "authorized", strconv.FormatBool(authorized))
+	if user != "" {
+		Annotate(r.Context(), "auth_user", user)
+	}
+}
+
+// writeError writes a JSON error response with the given status code, with
+// the given error (if any) providing further detail.
+func writeError(w http.ResponseWriter, code int, err error) {
+	resp := errorResponse{
+		StatusCode: code,
+		Error:      http.StatusText(code),
+	}
+	if err != nil {
+		resp.Detail = err.Error()
+	}
+	writeJSON(code, w, resp)
+}
+
+// writeParamError writes a 400 Bad Request JSON error naming the request
+// parameter, whether from the query string or the path, that failed
+// validation.
+func writeParamError(w http.ResponseWriter, param string, err error) {
+	writeJSON(http.StatusBadRequest, w, errorResponse{
+		StatusCode: http.StatusBadRequest,
+		Error:      http.StatusText(http.StatusBadRequest),
+		Detail:     fmt.Sprintf("invalid %s: %s", param, err),
+		Param:      param,
+	})
 }
 
 func writeHTML(w http.ResponseWriter, body []byte, status int) {
 	writeResponse(w, status, htmlContentType, body)
 }
 
+// charsetEncoders maps the charsets text responses may be transcoded into to
+// functions that transcode a UTF-8 body into that charset.
+var charsetEncoders = map[string]func([]byte) []byte{
+	"utf-8":      func(b []byte) []byte { return b },
+	"iso-8859-1": encodeLatin1,
+	"utf-16le":   func(b []byte) []byte { return encodeUTF16(b, false) },
+	"utf-16be":   func(b []byte) []byte { return encodeUTF16(b, true) },
+}
+
+// encodeLatin1 transcodes UTF-8 input into ISO-8859-1, replacing characters
+// that cannot be represented with '?'.
+func encodeLatin1(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for _, r := range string(b) {
+		if r > 0xff {
+			r = '?'
+		}
+		out = append(out, byte(r))
+	}
+	return out
+}
+
+// encodeUTF16 transcodes UTF-8 input into UTF-16 with the given byte order,
+// without a byte order mark.
+func encodeUTF16(b []byte, bigEndian bool) []byte {
+	units := utf16.Encode([]rune(string(b)))
+	out := make([]byte, 0, len(units)*2)
+	for _, u := range units {
+		if bigEndian {
+			out = append(out, byte(u>>8), byte(u))
+		} else {
+			out = append(out, byte(u), byte(u>>8))
+		}
+	}
+	return out
+}
+
+// htmlCharsetDeclaration matches the charset declared by an HTML <meta>
+// element, either as <meta charset=...> or within the content of a
+// <meta http-equiv="Content-Type"> element.
+var htmlCharsetDeclaration = regexp.MustCompile(`(?i)(<meta\b[^>]*?\bcharset\s*=\s*["']?)[a-z0-9._:-]+`)
+
+// xmlEncodingDeclaration matches the encoding declared by an XML
+// declaration.
+var xmlEncodingDeclaration = regexp.MustCompile(`^(<\?xml\b[^>]*?\bencoding\s*=\s*["'])[A-Za-z0-9._-]+`)
+
+// rewriteCharsetDeclarations replaces the charset declared within an HTML or
+// XML document with the given charset, so that it agrees with the
+// Content-Type of a transcoded response. Other media types are returned
+// unmodified.
+func rewriteCharsetDeclarations(mediaType string, body []byte, charset string) []byte {
+	var declaration *regexp.Regexp
+	switch {
+	case mediaType == "text/html":
+		declaration = htmlCharsetDeclaration
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		declaration = xmlEncodingDeclaration
+	default:
+		return body
+	}
+	return declaration.ReplaceAll(body, []byte("${1}"+charset))
+}
+
+// writeText writes a UTF-8 text response, honoring the optional charset and
+// charset_mismatch query params, which transcode the body into another
+// charset and adjust the Content-Type accordingly. When charset_mismatch is
+// true, the Content-Type declares the requested charset but the body is
+// encoded in a different one (UTF-8, or ISO-8859-1 if UTF-8 was requested).
+// Charsets declared within HTML and XML documents are rewritten to match the
+// Content-Type.
+//
+// JSON is always encoded as UTF-8, as required by RFC 8259, so JSON
+// responses only accept charset=utf-8 and reject charset_mismatch.
+func writeText(w http.ResponseWriter, r *http.Request, status int, contentType string, body []byte) {
+	q := r.URL.Query()
+	charset := strings.ToLower(q.Get("charset"))
+	mismatch := q.Get("charset_mismatch") == "true"
+	if charset == "" && !mismatch {
+		writeResponse(w, status, contentType, body)
+		return
+	}
+	if charset == "" {
+		charset = "utf-8"
+	}
+
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	if mediaType == "application/json" {
+		if charset != "utf-8" {
+			http.Error(w, fmt.Sprintf("Unsupported charset %q, JSON responses are always utf-8", charset), http.StatusBadRequest)
+			return
+		}
+		if mismatch {
+			http.Error(w, "charset_mismatch is not supported for JSON responses, which are always utf-8", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := charsetEncoders[charset]; !ok {
+		supported := make([]string, 0, len(charsetEncoders))
+		for name := range charsetEncoders {
+			supported = append(supported, name)
+		}
+		sort.Strings(supported)
+		http.Error(w, fmt.Sprintf("Unsupported charset %q, supported charsets: %s", charset, strings.Join(supported, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	encoding := charset
+	if mismatch {
+		encoding = "utf-8"
+		if charset == "utf-8" {
+			encoding = "iso-8859-1"
+		}
+	}
+
+	body = rewriteCharsetDeclarations(mediaType, body, charset)
+	writeResponse(w, status, mediaType+"; charset="+charset, charsetEncoders[encoding](body))
+}
+
 // parseBody handles parsing a request body into our standard API response,
 // taking care to only consume the request body once based on the Content-Type
 // of the request. The given bodyResponse will be modified.
@@ -113,24 +825,37 @@ func writeHTML(w http.ResponseWriter, body []byte, status int) {
 // Note: this function expects callers to limit the the maximum size of the
 // request body. See, e.g., the limitRequestSize middleware.
 func parseBody(w http.ResponseWriter, r *http.Request, resp *bodyResponse) error {
+	resp.Body = describeRequestBody(r)
 	if r.Body == nil {
 		return nil
 	}
 
+	timing := getTimingRecorder(r)
+
 	// Always set resp.Data to the incoming request body, in case we don't know
 	// how to handle the content type
+	stopRead := timing.phase("read")
 	body, err := io.ReadAll(r.Body)
+	stopRead()
 	if err != nil {
 		r.Body.Close()
 		return err
 	}
 	resp.Data = string(body)
+	defer timing.phase("parse")()
 
 	// After reading the body to populate resp.Data, we need to re-wrap it in
 	// an io.Reader for further processing below
 	r.Body.Close()
 	r.Body = io.NopCloser(bytes.NewBuffer(body))
 
+	// An empty body is echoed the same way whatever its content type, rather
+	// than as an empty form or data URL
+	resp.Body.Present = len(body) > 0
+	if !resp.Body.Present {
+		return nil
+	}
+
 	ct := r.Header.Get("Content-Type")
 
 	// Strip of charset encoding, if present
@@ -138,6 +863,13 @@ func parseBody(w http.ResponseWriter, r *http.Request, resp *bodyResponse) error
 		ct = strings.Split(ct, ";")[0]
 	}
 
+	// We can't parse bodies with a Content-Encoding we didn't decode, so we
+	// echo them back as opaque data
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && resp.Encoding == "" && !strings.EqualFold(encoding, "identity") {
+		resp.Data = encodeData(body, ct)
+		return nil
+	}
+
 	switch {
 	// cases where we don't need to parse the body
 	case strings.HasPrefix(ct, "html/"):
@@ -182,6 +914,82 @@ func parseBody(w http.ResponseWriter, r *http.Request, resp *bodyResponse) error
 	return nil
 }
 
+// describeRequestBody returns a bodyDescriptor for the request's framing. The
+// caller is responsible for setting Present once the body has been read.
+func describeRequestBody(r *http.Request) *bodyDescriptor {
+	desc := &bodyDescriptor{}
+	if raw := r.Header.Get("Content-Length"); raw != "" {
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			desc.DeclaredLength = &n
+		}
+	}
+	for _, te := range r.TransferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			desc.Chunked = true
+		}
+	}
+	return desc
+}
+
+// requestBodyDecoders maps the request Content-Encodings we know how to
+// decode to a function that returns a decoding reader.
+var requestBodyDecoders = map[string]func(io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		return zlib.NewReader(r)
+	},
+	"zstd": func(r io.Reader) (io.Reader, error) {
+		return zstd.NewReader(r)
+	},
+	"br": func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r)
+	},
+}
+
+// decodingReader wraps a decoding io.Reader to make errors encountered while
+// decoding identifiable to clients.
+type decodingReader struct {
+	r        io.Reader
+	encoding string
+}
+
+func (dr *decodingReader) Read(p []byte) (int, error) {
+	n, err := dr.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("error decoding %s request body: %w", dr.encoding, err)
+	}
+	return n, err
+}
+
+// decodeRequestBody transparently replaces the body of a request using a
+// known Content-Encoding with a reader that yields the decoded body, limited
+// to maxSize bytes after decoding. The given bodyResponse will be modified to
+// record the original encoding.
+//
+// Requests with an unknown Content-Encoding are left unmodified, so their raw
+// body is echoed.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, maxSize int64, resp *bodyResponse) error {
+	if r.Body == nil {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	newDecoder, ok := requestBodyDecoders[encoding]
+	if !ok {
+		return nil
+	}
+
+	decoder, err := newDecoder(r.Body)
+	if err != nil {
+		return fmt.Errorf("error decoding %s request body: %w", encoding, err)
+	}
+	r.Body = http.MaxBytesReader(w, io.NopCloser(&decodingReader{decoder, encoding}), maxSize)
+	r.ContentLength = -1
+	resp.Encoding = encoding
+	return nil
+}
+
 // return provided string as base64 encoded data url, with the given content type
 func encodeData(body []byte, contentType string) string {
 	data := base64.URLEncoding.EncodeToString(body)
@@ -194,6 +1002,89 @@ func encodeData(body []byte, contentType string) string {
 	return string("data:" + contentType + ";base64," + data)
 }
 
+// timingRecorder collects the durations of named phases of request handling,
+// to be reported to clients via the Server-Timing header when enabled.
+//
+// All methods are safe to call on a nil *timingRecorder, so handlers may
+// unconditionally instrument themselves.
+type timingRecorder struct {
+	mu      sync.Mutex
+	metrics []timingMetric
+}
+
+type timingMetric struct {
+	name     string
+	duration time.Duration
+}
+
+type timingRecorderKey struct{}
+
+// getTimingRecorder returns the timingRecorder attached to the request, or
+// nil if Server-Timing is not enabled.
+func getTimingRecorder(r *http.Request) *timingRecorder {
+	t, _ := r.Context().Value(timingRecorderKey{}).(*timingRecorder)
+	return t
+}
+
+// add records a phase that took the given duration.
+func (t *timingRecorder) add(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.metrics = append(t.metrics, timingMetric{name, d})
+}
+
+// phase starts timing a named phase, returning a func that must be called to
+// end the phase and record its duration.
+func (t *timingRecorder) phase(name string) func() {
+	start := time.Now()
+	return func() {
+		t.add(name, time.Since(start))
+	}
+}
+
+// serverTiming formats the metrics recorded since the given offset as a
+// Server-Timing header value, returning the value and the new offset.
+func (t *timingRecorder) serverTiming(offset int) (string, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := make([]string, 0, len(t.metrics)-offset)
+	for _, m := range t.metrics[offset:] {
+		ms := float64(m.duration.Microseconds()) / 1e3
+		entries = append(entries, m.name+";dur="+strconv.FormatFloat(ms, 'f', -1, 64))
+	}
+	return strings.Join(entries, ", "), len(t.metrics)
+}
+
+// The size of the body served by /framing, and of the chunks it is written
+// in when chunked
+const (
+	framingBodySize  = 64 * 1024
+	framingChunkSize = 4 * 1024
+)
+
+// defaultProbeContentLength is the length /probe advertises by default
+const defaultProbeContentLength = 1024
+
+// defaultTruncateDeclare is the length /truncate declares by default
+const defaultTruncateDeclare = 10240
+
+// oidcSigningAlg is the JWS algorithm with which the OIDC simulator signs
+// tokens
+const oidcSigningAlg = "ES256"
+
+// oidcTokenLifetime is how long tokens issued by /oauth/token are valid for
+const oidcTokenLifetime = time.Hour
+
+// oidcKeyGracePeriod is how long a rotated-out key remains published by
+// default, long enough for every token it signed to expire
+const oidcKeyGracePeriod = oidcTokenLifetime
+
+// maxDateSkew bounds the offsets accepted by /date-skew
+const maxDateSkew = 24 * time.Hour
+
 // parseDuration takes a user's input as a string and attempts to convert it
 // into a time.Duration. If not given as a go-style duration string, the input
 // is assumed to be seconds as a float.
@@ -204,12 +1095,38 @@ func parseDuration(input string) (time.Duration, error) {
 		if err != nil {
 			return 0, err
 		}
+		if math.IsNaN(n) || math.Abs(n) > float64(math.MaxInt64/int64(time.Second)) {
+			return 0, fmt.Errorf("duration %q out of range", input)
+		}
 		d = time.Duration(n*1000) * time.Millisecond
 	}
 	return d, nil
 }
 
-// parseBoundedDuration parses a time.Duration from user input and ensures that
+// parseDelayRange parses a /delay path segment giving either a single delay
+// or an inclusive range of delays as {min}-{max}, e.g. 100ms-2s or 0.5-3,
+// where each is parsed by parseDuration. A single delay is returned as both
+// min and max, with isRange false.
+func parseDelayRange(input string) (min, max time.Duration, isRange bool, err error) {
+	if d, err := parseDuration(input); err == nil {
+		return d, d, false, nil
+	}
+	// A leading dash is a sign rather than a separator, as may be a dash
+	// within a float exponent, so look for one that gives two valid ends
+	for i := 1; i < len(input)-1; i++ {
+		if input[i] != '-' {
+			continue
+		}
+		lo, errLo := parseDuration(input[:i])
+		hi, errHi := parseDuration(input[i+1:])
+		if errLo == nil && errHi == nil {
+			return lo, hi, true, nil
+		}
+	}
+	return 0, 0, false, fmt.Errorf("invalid delay %q: must be a duration like 750ms, a number of seconds, or a range like 100ms-2s", input)
+}
+
+// parseBoundedDuration parses a time.Duration from user input and ensures that
 // it is within a given maximum and minimum time
 func parseBoundedDuration(input string, min, max time.Duration) (time.Duration, error) {
 	d, err := parseDuration(input)
@@ -225,24 +1142,133 @@ func parseBoundedDuration(input string, min, max time.Duration) (time.Duration,
 	return d, err
 }
 
+// Distributions from which /delay may sample its jitter
+const (
+	delayDistributionUniform     = "uniform"
+	delayDistributionNormal      = "normal"
+	delayDistributionExponential = "exponential"
+)
+
+// delayJitterSpread gives the furthest a sampled delay may fall from the base
+// delay for each distribution, as a multiple of the jitter. Uniform samples
+// fall anywhere within the jitter either side of the base, normal samples use
+// the jitter as their standard deviation, and exponential samples add a tail
+// with the jitter as its mean; both of the latter are truncated to this
+// spread.
+var delayJitterSpread = map[string]float64{
+	delayDistributionUniform:     1,
+	delayDistributionNormal:      3,
+	delayDistributionExponential: 5,
+}
+
+// maxJitteredDelay returns the longest delay sampleDelay may return.
+func maxJitteredDelay(distribution string, base, jitter time.Duration) time.Duration {
+	return base + time.Duration(delayJitterSpread[distribution]*float64(jitter))
+}
+
+// sampleDelay returns the base delay plus jitter sampled from the given
+// distribution, never less than zero.
+func sampleDelay(rng *rand.Rand, distribution string, base, jitter time.Duration) time.Duration {
+	var x float64
+	switch distribution {
+	case delayDistributionUniform:
+		x = rng.Float64()*2 - 1
+	case delayDistributionNormal:
+		x = rng.NormFloat64()
+	case delayDistributionExponential:
+		x = rng.ExpFloat64()
+	}
+	spread := delayJitterSpread[distribution]
+	x = math.Max(-spread, math.Min(spread, x))
+
+	d := base + time.Duration(x*float64(jitter))
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
 // Returns a new rand.Rand from the given seed string.
-func parseSeed(rawSeed string) (*rand.Rand, error) {
-	var seed int64
-	if rawSeed != "" {
-		var err error
-		seed, err = strconv.ParseInt(rawSeed, 10, 64)
-		if err != nil {
-			return nil, err
+// weightedStatus is one of the status codes given to /status, along with
+// its share of the total weight.
+type weightedStatus struct {
+	code   int
+	weight float64
+}
+
+// parseWeightedStatuses parses a comma-separated list of status codes, each
+// optionally followed by ":weight", normalizing the weights so that they sum
+// to 1.
+func parseWeightedStatuses(raw string) ([]weightedStatus, error) {
+	segments := strings.Split(raw, ",")
+	choices := make([]weightedStatus, 0, len(segments))
+	var total float64
+	for _, segment := range segments {
+		rawCode, rawWeight := segment, ""
+		i := strings.IndexByte(segment, ':')
+		if i >= 0 {
+			rawCode, rawWeight = segment[:i], segment[i+1:]
+		}
+		code, err := strconv.Atoi(rawCode)
+		if err != nil || !isAcceptedStatus(code) {
+			return nil, fmt.Errorf("invalid status code in segment %q: must be an integer from %d to %d", segment, minStatusCode, maxStatusCode)
+		}
+		weight := 1.0
+		if i >= 0 {
+			weight, err = strconv.ParseFloat(rawWeight, 64)
+			if err != nil || weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+				return nil, fmt.Errorf("invalid weight in segment %q: must be a non-negative number", segment)
+			}
+		}
+		choices = append(choices, weightedStatus{code: code, weight: weight})
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("invalid weights in %q: at least one must be positive", raw)
+	}
+	for i := range choices {
+		choices[i].weight /= total
+	}
+	return choices, nil
+}
+
+// pickWeightedStatus chooses a status code given a random number in [0, 1).
+func pickWeightedStatus(choices []weightedStatus, f float64) int {
+	for _, choice := range choices {
+		if f < choice.weight {
+			return choice.code
+		}
+		f -= choice.weight
+	}
+	// Rounding may leave a sliver of f unaccounted for, which belongs to
+	// the last code with any weight
+	for i := len(choices) - 1; i > 0; i-- {
+		if choices[i].weight > 0 {
+			return choices[i].code
 		}
-	} else {
-		seed = time.Now().UnixNano()
 	}
+	return choices[0].code
+}
 
+func parseSeed(rawSeed string) (*rand.Rand, error) {
+	seed, err := parseSeedValue(rawSeed)
+	if err != nil {
+		return nil, err
+	}
 	src := rand.NewSource(seed)
 	rng := rand.New(src)
 	return rng, nil
 }
 
+// parseSeedValue parses a seed query param, or picks a seed from the current
+// time if it is empty.
+func parseSeedValue(rawSeed string) (int64, error) {
+	if rawSeed == "" {
+		return time.Now().UnixNano(), nil
+	}
+	return strconv.ParseInt(rawSeed, 10, 64)
+}
+
 // syntheticByteStream implements the ReadSeeker interface to allow reading
 // arbitrary subsets of bytes up to a maximum size given a function for
 // generating the byte at a given offset.
@@ -254,6 +1280,12 @@ type syntheticByteStream struct {
 	factory func(int64) byte
 }
 
+// rangeByte generates the content served by /range and /truncate, so that a
+// download cut short by /truncate can be resumed from /range.
+func rangeByte(offset int64) byte {
+	return byte(97 + (offset % 26))
+}
+
 // newSyntheticByteStream returns a new stream of bytes of a specific size,
 // given a factory function for generating the byte at a given offset.
 func newSyntheticByteStream(size int64, factory func(int64) byte) io.ReadSeeker {
@@ -313,13 +1345,180 @@ func sha1hash(input string) string {
 	return fmt.Sprintf("%x", h.Sum([]byte(input)))
 }
 
+// connInfo holds state about an individual client connection, attached to
+// the context of every request made over the connection by
+// HTTPBin.ConnContext.
+type connInfo struct {
+	id       int64
+	accepted time.Time
+	requests int64
+
+	// set once the time between accepting the connection and handling its
+	// first request has been reported
+	queueWaitReported int32
+
+	// set once the first request on the connection has been stamped with
+	// the connection's accept time as its arrival time
+	arrivalReported int32
+}
+
+type connInfoKey struct{}
+
+type listenerNameKey struct{}
+
+// addressFamily returns "ipv4" or "ipv6" for the IP in a host:port address,
+// along with whether it is an IPv4 address mapped into IPv6, as it appears
+// on a dual-stack socket, or "unknown" if the address has no IP.
+func addressFamily(addr string) (family string, mapped bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "unknown", false
+	case ip.To4() != nil:
+		return "ipv4", strings.Contains(host, ":")
+	default:
+		return "ipv6", false
+	}
+}
+
+// getConnInfo returns the connInfo for the connection a request arrived on,
+// or nil if the server is not configured to use HTTPBin.ConnContext.
+func getConnInfo(r *http.Request) *connInfo {
+	c, _ := r.Context().Value(connInfoKey{}).(*connInfo)
+	return c
+}
+
+// nextRequest increments and returns the number of requests handled on the
+// connection.
+func (c *connInfo) nextRequest() int64 {
+	return atomic.AddInt64(&c.requests, 1)
+}
+
+// queueWait returns the time between a connection being accepted and the
+// handling of its first request beginning. Only the first request on a
+// connection has a meaningful queue wait; requests on reused connections
+// report zero.
+func (c *connInfo) queueWait(start time.Time) time.Duration {
+	if !atomic.CompareAndSwapInt32(&c.queueWaitReported, 0, 1) {
+		return 0
+	}
+	return start.Sub(c.accepted)
+}
+
+// firstArrival returns the time the connection was accepted, which is the
+// earliest known arrival time of the first request on it, and whether this is
+// the first time it has been called.
+func (c *connInfo) firstArrival() (time.Time, bool) {
+	if !atomic.CompareAndSwapInt32(&c.arrivalReported, 0, 1) {
+		return time.Time{}, false
+	}
+	return c.accepted, true
+}
+
+// isPublicIP returns true if the given IP is a publicly routable unicast
+// address.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback()
+}
+
+// errPrivateAddress is returned when an outbound connection would be made to
+// a non-public IP address.
+var errPrivateAddress = errors.New("refusing to connect to a private address")
+
+// newEgressClient returns an http.Client suitable for making outbound
+// requests on behalf of a client. Connections are never reused, so that each
+// request reports its own source address, and connections may only be made
+// to IP addresses accepted by allowIP. The check happens after DNS
+// resolution, so it cannot be evaded by a hostname that resolves to a private
+// address.
+func newEgressClient(timeout time.Duration, allowIP func(net.IP) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// signURLPath computes the signature for a /signed URL, which is an HMAC of
+// the expiry timestamp and the target path.
+func signURLPath(key []byte, expiry int64, target string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d:%s", expiry, target)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 func uuidv4() string {
 	buff := make([]byte, 16)
 	_, err := crypto_rand.Read(buff[:])
 	if err != nil {
 		panic(err)
 	}
-	buff[6] = (buff[6] & 0x0f) | 0x40 // Version 4
+	return formatUUID(buff, 4)
+}
+
+// uuidEpochOffset is the number of 100ns intervals between the start of the
+// Gregorian calendar, from which version 1 UUIDs count time, and the Unix
+// epoch.
+const uuidEpochOffset = 122192928000000000
+
+// uuidv1 returns a version 1 UUID for time t, with a random clock sequence
+// and a random node ID marked as multicast, per RFC 4122 section 4.5, in
+// place of a MAC address.
+func uuidv1(t time.Time) string {
+	buff := make([]byte, 16)
+	if _, err := crypto_rand.Read(buff[8:]); err != nil {
+		panic(err)
+	}
+	ts := uint64(t.UnixNano()/100+uuidEpochOffset) & (1<<60 - 1)
+	binary.BigEndian.PutUint32(buff[0:4], uint32(ts))
+	binary.BigEndian.PutUint16(buff[4:6], uint16(ts>>32))
+	binary.BigEndian.PutUint16(buff[6:8], uint16(ts>>48))
+	buff[10] |= 0x01 // multicast bit of the node ID
+	return formatUUID(buff, 1)
+}
+
+// uuidv7 returns a version 7 UUID for time t, which begins with t's Unix
+// timestamp in milliseconds so that UUIDs sort by creation time.
+func uuidv7(t time.Time) string {
+	buff := make([]byte, 16)
+	if _, err := crypto_rand.Read(buff[6:]); err != nil {
+		panic(err)
+	}
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(buff[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(buff[2:6], uint32(ms))
+	return formatUUID(buff, 7)
+}
+
+// formatUUID sets the version and RFC 4122 variant bits of the 16 bytes in
+// buff and formats them as a UUID string.
+func formatUUID(buff []byte, version byte) string {
+	buff[6] = (buff[6] & 0x0f) | version<<4
 	buff[8] = (buff[8] & 0x3f) | 0x80 // Variant 10
 	return fmt.Sprintf("%x-%x-%x-%x-%x", buff[0:4], buff[4:6], buff[6:8], buff[8:10], buff[10:])
 }
@@ -336,7 +1535,7 @@ type base64Helper struct {
 // - /base64/encode/input_str
 // - /base64/decode/input_str
 func newBase64Helper(path string) (*base64Helper, error) {
-	parts := strings.Split(path, "/")
+	parts := strings.SplitN(path, "/", 4)
 
 	if len(parts) != 3 && len(parts) != 4 {
 		return nil, errors.New("invalid URL")
@@ -351,7 +1550,9 @@ func newBase64Helper(path string) (*base64Helper, error) {
 	} else {
 		// Validation for
 		// - /base64/encode/input_str
-		// - /base64/encode/input_str
+		// - /base64/decode/input_str
+		// where input_str may contain slashes, as used by the standard
+		// base64 alphabet
 		b.operation = parts[2]
 		if b.operation != "encode" && b.operation != "decode" {
 			return nil, fmt.Errorf("invalid operation: %s", b.operation)
@@ -375,7 +1576,3349 @@ func (b *base64Helper) Encode() ([]byte, error) {
 	return buff, nil
 }
 
-// Decode - decode data from base64
+// base64Decoders are the alphabets Decode tries, in order.
+var base64Decoders = []struct {
+	name string
+	enc  *base64.Encoding
+}{
+	{"URL-safe", base64.URLEncoding},
+	{"standard", base64.StdEncoding},
+	{"unpadded URL-safe", base64.RawURLEncoding},
+	{"unpadded standard", base64.RawStdEncoding},
+}
+
+// Decode - decode data from base64, in whichever of the URL-safe and standard
+// alphabets it uses, with or without padding
 func (b *base64Helper) Decode() ([]byte, error) {
-	return base64.URLEncoding.DecodeString(b.data)
+	var firstErr error
+	for _, d := range base64Decoders {
+		result, err := d.enc.DecodeString(b.data)
+		if err == nil {
+			return result, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	names := make([]string, len(base64Decoders))
+	for i, d := range base64Decoders {
+		names[i] = d.name
+	}
+	return nil, fmt.Errorf("not valid in any of the %s alphabets: %w", strings.Join(names, ", "), firstErr)
+}
+
+// mementoVersionCount is the number of synthetic versions of the Memento
+// resource, spaced evenly over the past year.
+const mementoVersionCount = 12
+
+// mementoVersions returns the datetimes of the synthetic versions of the
+// Memento resource, oldest first. Versions are anchored to the start of the
+// current UTC day so that they are stable across requests and replicas.
+func mementoVersions(now time.Time) []time.Time {
+	newest := now.UTC().Truncate(24 * time.Hour)
+	spacing := 365 * 24 * time.Hour / (mementoVersionCount - 1)
+	versions := make([]time.Time, mementoVersionCount)
+	for i := range versions {
+		versions[i] = newest.Add(-time.Duration(mementoVersionCount-1-i) * spacing).Truncate(time.Second)
+	}
+	return versions
+}
+
+// negotiateMemento returns the 1-based number of the version that was
+// current at the given Accept-Datetime: the newest version at or before it,
+// or the oldest version if it predates them all. Per RFC 7089 section 4.5.3,
+// a missing or malformed Accept-Datetime selects the newest version.
+func negotiateMemento(versions []time.Time, acceptDatetime string) int {
+	t, err := http.ParseTime(acceptDatetime)
+	if err != nil {
+		return len(versions)
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].After(t) {
+			return i + 1
+		}
+	}
+	return 1
+}
+
+// mementoRel returns the memento relation type for the given version number,
+// marking the first and last versions per RFC 7089 section 2.2.1.
+func mementoRel(versions []time.Time, v int) string {
+	switch {
+	case len(versions) == 1:
+		return "first last memento"
+	case v == 1:
+		return "first memento"
+	case v == len(versions):
+		return "last memento"
+	default:
+		return "memento"
+	}
+}
+
+// writeMemento writes the representation of the given version of the
+// Memento resource, along with the Memento-Datetime and Link headers that
+// identify it.
+func writeMemento(w http.ResponseWriter, versions []time.Time, v int, acceptDatetime string, links ...string) {
+	datetime := versions[v-1].Format(http.TimeFormat)
+	links = append(links,
+		`</memento/timemap>; rel="timemap"; type="application/link-format"`,
+		fmt.Sprintf(`</memento/%d>; rel="%s"; datetime="%s"`, v, mementoRel(versions, v), datetime),
+	)
+	w.Header().Set("Memento-Datetime", datetime)
+	w.Header().Set("Link", strings.Join(links, ", "))
+	writeJSON(http.StatusOK, w, mementoResponse{
+		AcceptDatetime:  acceptDatetime,
+		MementoDatetime: datetime,
+		Version:         v,
+		Versions:        len(versions),
+	})
+}
+
+// quoteString formats s as an RFC 7230 quoted-string, escaping any embedded
+// quotes and backslashes.
+func quoteString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// authChallenge returns a WWW-Authenticate challenge for the given scheme
+// (matched case-insensitively) and realm. Digest nonces are derived from the
+// realm so that challenges are deterministic.
+func authChallenge(scheme string, realm string) (string, bool) {
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return fmt.Sprintf(`Basic realm=%s, charset="UTF-8"`, quoteString(realm)), true
+	case "bearer":
+		return fmt.Sprintf(`Bearer realm=%s, error="invalid_token", error_description="The access token expired"`, quoteString(realm)), true
+	case "digest":
+		nonce := sha256.Sum256([]byte("nonce:" + realm))
+		opaque := sha256.Sum256([]byte("opaque:" + realm))
+		return fmt.Sprintf(`Digest realm=%s, qop="auth", algorithm=MD5, nonce="%x", opaque="%x"`, quoteString(realm), nonce[:16], opaque[:16]), true
+	default:
+		return "", false
+	}
+}
+
+// linkURLReplacer escapes the characters that may legally appear in a raw
+// query string but would break a URL embedded in a header like Link.
+var linkURLReplacer = strings.NewReplacer(
+	" ", "%20",
+	`"`, "%22",
+	"<", "%3C",
+	">", "%3E",
+)
+
+// canonicalURL returns the absolute URL of the given request path and raw
+// query relative to the configured base URL.
+func (h *HTTPBin) canonicalURL(path string, rawQuery string) string {
+	u := *h.canonicalBaseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	u.RawQuery = linkURLReplacer.Replace(rawQuery)
+	return u.String()
+}
+
+// setCanonicalHeaders sets Content-Location and canonical Link headers for
+// the request when a canonical base URL is configured. A
+// ?canonical_mismatch=true query param deliberately points the canonical
+// link at a different path than Content-Location.
+func (h *HTTPBin) setCanonicalHeaders(w http.ResponseWriter, r *http.Request) {
+	if h.canonicalBaseURL == nil {
+		return
+	}
+	location := h.canonicalURL(r.URL.Path, r.URL.RawQuery)
+	canonical := location
+	if r.URL.Query().Get("canonical_mismatch") == "true" {
+		canonical = h.canonicalURL("/canonical-mismatch"+r.URL.Path, r.URL.RawQuery)
+	}
+	w.Header().Set("Content-Location", location)
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="canonical"`, canonical))
+}
+
+// resolveTimeout bounds the time /resolve will wait for a DNS lookup.
+const resolveTimeout = 2 * time.Second
+
+// hostResolver is the subset of *net.Resolver used by /resolve.
+type hostResolver interface {
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// classifyLookupError describes a failed DNS lookup for a /resolve
+// response, distinguishing the common NXDOMAIN and timeout cases.
+func classifyLookupError(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return "nxdomain"
+	case errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// selfTestResponseWriter is a minimal http.ResponseWriter used by /selftest
+// to record the status of a response while discarding its body.
+type selfTestResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (sw *selfTestResponseWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *selfTestResponseWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+}
+
+func (sw *selfTestResponseWriter) Write(b []byte) (int, error) {
+	sw.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+func (sw *selfTestResponseWriter) Flush() {}
+
+// archiveModTime is the modification time given to every entry in a
+// generated archive, so that archives are byte-for-byte reproducible.
+var archiveModTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// archiveEntry is a single file in a generated archive.
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+// Limits on /archive
+const maxArchiveFiles = 10000
+
+// hostileArchiveEntries are added to hostile archives to trip up naive
+// extraction code.
+var hostileArchiveEntries = []archiveEntry{
+	{
+		name: strings.Repeat("nested/", 64) + "deep.txt",
+		data: []byte("deeply nested file\n"),
+	},
+	{
+		name: "../escaped.txt",
+		data: []byte("this file escapes the extraction directory\n"),
+	},
+}
+
+// archiveFileName returns the name of the i-th generated file in an archive,
+// given a random suffix.
+func archiveFileName(i int, suffix uint32) string {
+	return fmt.Sprintf("files/%03d-%08x.bin", i, suffix)
+}
+
+// generateArchiveEntries generates the files for an /archive response, with
+// names and contents derived from the given random source. Hostile archives
+// additionally include entries designed to trip up naive extraction code.
+func generateArchiveEntries(rng *rand.Rand, numFiles int, fileSize int, hostile bool) []archiveEntry {
+	entries := make([]archiveEntry, 0, numFiles+len(hostileArchiveEntries))
+	for i := 0; i < numFiles; i++ {
+		data := make([]byte, fileSize)
+		rng.Read(data)
+		entries = append(entries, archiveEntry{
+			name: archiveFileName(i, rng.Uint32()),
+			data: data,
+		})
+	}
+	if hostile {
+		entries = append(entries, hostileArchiveEntries...)
+	}
+	return entries
+}
+
+// Per-entry overhead of the archives written by writeZip and writeTarGz, in
+// bytes, not counting names or data
+const (
+	// local file header, data descriptor and central directory record,
+	// plus an extended timestamp field in both headers
+	zipEntryOverhead = 30 + 16 + 46 + 2*9
+	zipEndOverhead   = 22
+	tarBlockSize     = 512
+	// the longest name that fits in a ustar header without a PAX record
+	tarMaxUSTARName = 100
+)
+
+// archiveSize returns an upper bound on the size of the archive that
+// generateArchiveEntries and writeZip or writeTarGz would produce for the
+// given parameters, without generating it.
+func archiveSize(format string, numFiles int, fileSize int, hostile bool) int64 {
+	var names []int
+	for i := 0; i < numFiles; i++ {
+		names = append(names, len(archiveFileName(i, 0)))
+	}
+	var extra int64
+	if hostile {
+		for _, entry := range hostileArchiveEntries {
+			names = append(names, len(entry.name))
+			extra += int64(len(entry.data))
+		}
+	}
+
+	roundUp := func(n int64) int64 { return (n + tarBlockSize - 1) / tarBlockSize * tarBlockSize }
+	var size int64
+	if format == "zip" {
+		size = zipEndOverhead + extra + int64(numFiles)*int64(fileSize)
+		for _, n := range names {
+			size += zipEntryOverhead + 2*int64(n)
+		}
+		return size
+	}
+	size = 2*tarBlockSize + roundUp(extra) + int64(numFiles)*roundUp(int64(fileSize))
+	for _, n := range names {
+		size += tarBlockSize
+		if n > tarMaxUSTARName {
+			// a PAX header and its path record
+			size += tarBlockSize + roundUp(int64(n)+32)
+		}
+	}
+	// gzip framing, plus deflate's stored blocks for incompressible data
+	return size + 18 + 5*(size/1024+1)
+}
+
+// writeZip writes the given entries to w as an uncompressed zip archive.
+func writeZip(w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entry.name,
+			Method:   zip.Store,
+			Modified: archiveModTime,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(entry.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTarGz writes the given entries to w as a gzipped tar archive.
+func writeTarGz(w io.Writer, entries []archiveEntry) error {
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	for _, entry := range entries {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     entry.name,
+			Size:     int64(len(entry.data)),
+			Mode:     0o644,
+			ModTime:  archiveModTime,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// headerCasings maps the casings supported by /header-case to functions
+// applying them to a header name.
+var headerCasings = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"mixed": mixedCase,
+}
+
+// mixedCase alternates the case of each letter in s, starting with lower
+// case, e.g. "x-cUsToM-hEaDeR".
+func mixedCase(s string) string {
+	b := []byte(strings.ToLower(s))
+	upper := false
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' {
+			if upper {
+				b[i] = c - 'a' + 'A'
+			}
+			upper = !upper
+		}
+	}
+	return string(b)
+}
+
+// isHeaderToken reports whether s is a valid RFC 7230 header field name.
+func isHeaderToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		isAlnum := (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !isAlnum && !strings.ContainsRune("!#$%&'*+-.^_`|~", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// idle waits for the given duration between bursts of a streaming response,
+// sending an empty keepalive line every keepalive interval if it is non-zero.
+// It returns false if the request was cancelled or a keepalive could not be
+// written while waiting.
+func idle(w http.ResponseWriter, r *http.Request, d time.Duration, keepalive time.Duration) bool {
+	done := time.NewTimer(d)
+	defer done.Stop()
+
+	var tick <-chan time.Time
+	if keepalive > 0 {
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-done.C:
+			return true
+		case <-tick:
+			if err := writeAndFlush(w, []byte("\n")); err != nil {
+				annotateWriteError(r, err)
+				return false
+			}
+		}
+	}
+}
+
+// writeAndFlush writes b to w and flushes it to the client, returning any
+// error encountered. Because flushing cannot itself report an error, a failed
+// flush is only detected by the following write.
+//
+// http.ErrBodyNotAllowed is not treated as an error, since it indicates that
+// the body is being discarded by design (e.g. for a /drip?code=100 response)
+// rather than that the client has gone away.
+func writeAndFlush(w http.ResponseWriter, b []byte) error {
+	if _, err := w.Write(b); err != nil && err != http.ErrBodyNotAllowed {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// annotateIntendedBytes records how many body bytes a streaming handler
+// intends to send, which the Observer may compare to the Result's Size to
+// detect a response cut short by a client disconnect.
+func annotateIntendedBytes(r *http.Request, n int64) {
+	Annotate(r.Context(), "bytes_intended", strconv.FormatInt(n, 10))
+}
+
+// annotateWriteError records the error that caused a streaming handler to
+// stop writing its response early.
+func annotateWriteError(r *http.Request, err error) {
+	Annotate(r.Context(), "write_error", err.Error())
+}
+
+// checkBearerToken reports whether the request presents the given bearer
+// token, comparing in constant time. If it does not, a 401 response is
+// written.
+func checkBearerToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !hmac.Equal([]byte(given), []byte(token)) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, nil)
+		return false
+	}
+	return true
+}
+
+// Reasons a JWT presented to /bearer may be rejected
+const (
+	jwtMalformed    = "malformed"
+	jwtBadSignature = "bad_signature"
+	jwtExpired      = "expired"
+	jwtNotYetValid  = "not_yet_valid"
+	jwtInvalid      = "invalid"
+)
+
+// maxNumericDate bounds the JWT NumericDate claims that are accepted, in
+// seconds since the epoch, to dates that time.Time can represent.
+const maxNumericDate = 1 << 40
+
+// jwtError describes why a JWT was rejected.
+type jwtError struct {
+	reason      string
+	description string
+}
+
+func (e *jwtError) Error() string {
+	return e.description
+}
+
+// asJWTError returns the jwtError in err's chain, or a generic one if there
+// is none, so that unexpected errors are not described to clients.
+func asJWTError(err error) *jwtError {
+	var jwtErr *jwtError
+	if errors.As(err, &jwtErr) {
+		return jwtErr
+	}
+	return &jwtError{jwtInvalid, "token is invalid"}
+}
+
+// verifyHS256JWT parses a compact JWS, verifies its HMAC-SHA256 signature
+// under secret, and checks its exp and nbf claims, if present, against now,
+// returning its claims. Any error is a *jwtError.
+func verifyHS256JWT(token string, secret []byte, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, &jwtError{jwtMalformed, fmt.Sprintf("token must have 3 parts, got %d", len(parts))}
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil {
+		return nil, &jwtError{jwtMalformed, "token header is not base64url-encoded JSON"}
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, &jwtError{jwtMalformed, "token payload is not base64url-encoded"}
+	}
+	var claims map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(rawClaims))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil || claims == nil {
+		return nil, &jwtError{jwtMalformed, "token payload is not a JSON object"}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, &jwtError{jwtMalformed, "token signature is not base64url-encoded"}
+	}
+
+	if header.Alg != "HS256" {
+		return nil, &jwtError{jwtBadSignature, fmt.Sprintf("token must be signed with HS256, not %q", header.Alg)}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, &jwtError{jwtBadSignature, "token signature does not match"}
+	}
+
+	exp, ok, err := numericDateClaim(claims, "exp")
+	if err != nil {
+		return nil, err
+	}
+	if ok && !now.Before(exp) {
+		return nil, &jwtError{jwtExpired, fmt.Sprintf("token expired at %s", exp.UTC().Format(time.RFC3339))}
+	}
+	nbf, ok, err := numericDateClaim(claims, "nbf")
+	if err != nil {
+		return nil, err
+	}
+	if ok && now.Before(nbf) {
+		return nil, &jwtError{jwtNotYetValid, fmt.Sprintf("token is not valid before %s", nbf.UTC().Format(time.RFC3339))}
+	}
+	return claims, nil
+}
+
+// numericDateClaim returns the time given by the named NumericDate claim,
+// reporting whether it is present.
+func numericDateClaim(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	raw, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, isNumber := raw.(json.Number)
+	if !isNumber {
+		return time.Time{}, false, &jwtError{jwtMalformed, fmt.Sprintf("%s claim must be a number", name)}
+	}
+	secs, err := n.Float64()
+	if err != nil || math.Abs(secs) > maxNumericDate {
+		return time.Time{}, false, &jwtError{jwtMalformed, fmt.Sprintf("%s claim must be a number of seconds since the epoch", name)}
+	}
+	whole, frac := math.Modf(secs)
+	return time.Unix(int64(whole), int64(frac*float64(time.Second))), true, nil
+}
+
+// adminSettingsUpdate is a partial update to an instance's runtime settings,
+// as accepted by PUT /admin/settings. Omitted fields are left unchanged.
+type adminSettingsUpdate struct {
+	DripDuration *string `json:"drip_duration"`
+	DripDelay    *string `json:"drip_delay"`
+	DripNumBytes *int64  `json:"drip_numbytes"`
+}
+
+// apply returns a copy of the given settings with the update applied,
+// validating new values against the instance's limits.
+func (u adminSettingsUpdate) apply(s runtimeSettings, maxDuration time.Duration, maxBodySize int64) (runtimeSettings, error) {
+	var err error
+	if u.DripDuration != nil {
+		s.DefaultParams.DripDuration, err = parseBoundedDuration(*u.DripDuration, 0, maxDuration)
+		if err != nil {
+			return s, fmt.Errorf("invalid drip_duration: %w", err)
+		}
+	}
+	if u.DripDelay != nil {
+		s.DefaultParams.DripDelay, err = parseBoundedDuration(*u.DripDelay, 0, maxDuration)
+		if err != nil {
+			return s, fmt.Errorf("invalid drip_delay: %w", err)
+		}
+	}
+	if u.DripNumBytes != nil {
+		if *u.DripNumBytes <= 0 || *u.DripNumBytes > maxBodySize {
+			return s, fmt.Errorf("invalid drip_numbytes: must be between 1 and %d", maxBodySize)
+		}
+		s.DefaultParams.DripNumBytes = *u.DripNumBytes
+	}
+	return s, nil
+}
+
+// soapVersion describes the differences between SOAP 1.1 and 1.2 that
+// matter to /soap.
+type soapVersion struct {
+	namespace   string
+	contentType string
+
+	// Fault codes for faults caused by the sender and receiver
+	senderFault   string
+	receiverFault string
+
+	// Status codes for faults caused by the sender and receiver
+	senderStatus   int
+	receiverStatus int
+}
+
+var (
+	soap11 = &soapVersion{
+		namespace:      "http://schemas.xmlsoap.org/soap/envelope/",
+		contentType:    "text/xml; charset=utf-8",
+		senderFault:    "soap:Client",
+		receiverFault:  "soap:Server",
+		senderStatus:   http.StatusInternalServerError,
+		receiverStatus: http.StatusInternalServerError,
+	}
+	soap12 = &soapVersion{
+		namespace:      "http://www.w3.org/2003/05/soap-envelope",
+		contentType:    "application/soap+xml; charset=utf-8",
+		senderFault:    "soap:Sender",
+		receiverFault:  "soap:Receiver",
+		senderStatus:   http.StatusBadRequest,
+		receiverStatus: http.StatusInternalServerError,
+	}
+
+	// soapVersions maps request media types to SOAP versions
+	soapVersions = map[string]*soapVersion{
+		"text/xml":             soap11,
+		"application/soap+xml": soap12,
+	}
+)
+
+// parseSOAPEnvelope ensures that body is well-formed XML whose root element
+// is an Envelope containing a Body, in the given version's namespace.
+func parseSOAPEnvelope(body []byte, version *soapVersion) error {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	var (
+		depth   int
+		sawRoot bool
+		sawBody bool
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("malformed XML: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				if sawRoot {
+					return errors.New("malformed XML: multiple root elements")
+				}
+				if t.Name.Local != "Envelope" || t.Name.Space != version.namespace {
+					return fmt.Errorf("root element must be an Envelope in namespace %s", version.namespace)
+				}
+				sawRoot = true
+			} else if depth == 1 && t.Name.Local == "Body" && t.Name.Space == version.namespace {
+				sawBody = true
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if !sawRoot {
+		return errors.New("missing Envelope element")
+	}
+	if !sawBody {
+		return errors.New("Envelope must contain a Body element")
+	}
+	return nil
+}
+
+// xmlEscape escapes s for use as XML character data or an attribute value.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// writeSOAPEnvelope writes a SOAP envelope of the given version containing
+// the given (already escaped) body.
+func writeSOAPEnvelope(w http.ResponseWriter, version *soapVersion, status int, body string) {
+	envelope := xml.Header +
+		`<soap:Envelope xmlns:soap="` + version.namespace + `">` +
+		`<soap:Body>` + body + `</soap:Body>` +
+		`</soap:Envelope>` + "\n"
+	writeResponse(w, status, version.contentType, []byte(envelope))
+}
+
+// writeSOAPEcho writes a SOAP envelope describing the request.
+func writeSOAPEcho(w http.ResponseWriter, version *soapVersion, headers http.Header, action string, digest string) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var body strings.Builder
+	body.WriteString(`<EchoResponse xmlns="https://httpbingo.org/soap">`)
+	body.WriteString(`<Headers>`)
+	for _, k := range keys {
+		for _, v := range headers[k] {
+			fmt.Fprintf(&body, `<Header name="%s">%s</Header>`, xmlEscape(k), xmlEscape(v))
+		}
+	}
+	body.WriteString(`</Headers>`)
+	fmt.Fprintf(&body, `<SOAPAction>%s</SOAPAction>`, xmlEscape(action))
+	fmt.Fprintf(&body, `<BodySHA256>%s</BodySHA256>`, digest)
+	body.WriteString(`</EchoResponse>`)
+	writeSOAPEnvelope(w, version, http.StatusOK, body.String())
+}
+
+// writeSOAPFault writes a SOAP Fault in the format of the given version,
+// attributed to either the sender or the receiver of the request.
+func writeSOAPFault(w http.ResponseWriter, version *soapVersion, sender bool, reason string) {
+	code, status := version.receiverFault, version.receiverStatus
+	if sender {
+		code, status = version.senderFault, version.senderStatus
+	}
+
+	var fault string
+	if version == soap11 {
+		fault = `<soap:Fault>` +
+			`<faultcode>` + code + `</faultcode>` +
+			`<faultstring>` + xmlEscape(reason) + `</faultstring>` +
+			`</soap:Fault>`
+	} else {
+		fault = `<soap:Fault>` +
+			`<soap:Code><soap:Value>` + code + `</soap:Value></soap:Code>` +
+			`<soap:Reason><soap:Text xml:lang="en">` + xmlEscape(reason) + `</soap:Text></soap:Reason>` +
+			`</soap:Fault>`
+	}
+	writeSOAPEnvelope(w, version, status, fault)
+}
+
+// maxRedirectLoopHops limits the number of distinct hops in a /redirect-loop
+// cycle, so that the work done per hop stays constant.
+const maxRedirectLoopHops = 16
+
+// isSlug reports whether s is usable as a name in a URL path, e.g. a
+// /redirect-loop hop or a /fanout channel: 1-32 letters, digits, dashes, or
+// underscores.
+func isSlug(s string) bool {
+	if len(s) == 0 || len(s) > 32 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// isRedirectStatus reports whether code is a redirect status that carries a
+// Location header.
+func isRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// sizeBucket is one of the sizes /sizes may pick, with its relative weight.
+type sizeBucket struct {
+	size   int64
+	weight float64
+}
+
+// maxSizeBuckets limits the number of buckets /sizes accepts.
+const maxSizeBuckets = 64
+
+// parseSizeBuckets parses a comma-separated list of sizes, each optionally
+// followed by a :weight, e.g. "1k:0.5,1m:0.5". Sizes without an explicit
+// weight have a weight of 1.
+func parseSizeBuckets(raw string) ([]sizeBucket, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) > maxSizeBuckets {
+		return nil, fmt.Errorf("at most %d buckets allowed", maxSizeBuckets)
+	}
+	buckets := make([]sizeBucket, 0, len(parts))
+	for _, part := range parts {
+		rawSize, rawWeight := part, ""
+		if i := strings.IndexByte(part, ':'); i >= 0 {
+			rawSize, rawWeight = part[:i], part[i+1:]
+		}
+		size, err := parseByteSize(rawSize)
+		if err != nil {
+			return nil, err
+		}
+		weight := 1.0
+		if rawWeight != "" {
+			weight, err = strconv.ParseFloat(rawWeight, 64)
+			if err != nil || weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+				return nil, fmt.Errorf("invalid weight %q", rawWeight)
+			}
+		}
+		buckets = append(buckets, sizeBucket{size: size, weight: weight})
+	}
+
+	var total float64
+	for _, b := range buckets {
+		total += b.weight
+	}
+	if total == 0 {
+		return nil, errors.New("weights must not all be zero")
+	}
+	return buckets, nil
+}
+
+// parseByteSize parses a non-negative size in bytes with an optional k, m,
+// or g suffix (powers of 1024), e.g. "512", "10k", "1m".
+func parseByteSize(raw string) (int64, error) {
+	multiplier := int64(1)
+	digits := strings.ToLower(raw)
+	if n := len(digits); n > 0 {
+		switch digits[n-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			digits = digits[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+	return n * multiplier, nil
+}
+
+// pickSizeBucket picks a size from buckets at random according to their
+// weights.
+func pickSizeBucket(rng *rand.Rand, buckets []sizeBucket) int64 {
+	var total float64
+	for _, b := range buckets {
+		total += b.weight
+	}
+	target := rng.Float64() * total
+	for _, b := range buckets {
+		if target < b.weight {
+			return b.size
+		}
+		target -= b.weight
+	}
+	// Floating point rounding may leave target just past the last bucket
+	// with a non-zero weight
+	for i := len(buckets) - 1; i >= 0; i-- {
+		if buckets[i].weight > 0 {
+			return buckets[i].size
+		}
+	}
+	return buckets[len(buckets)-1].size
+}
+
+// chunkPool holds reusable buffers for writing generated response bodies in
+// fixed-size chunks, so large bodies need not be allocated in full.
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// writeRandomBytes writes n bytes generated by rng to w, one pooled chunk at
+// a time.
+func writeRandomBytes(w io.Writer, rng *rand.Rand, n int64) error {
+	bufp := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(bufp)
+	buf := *bufp
+
+	for n > 0 {
+		chunk := buf
+		if int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		rng.Read(chunk)
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+// randomKey returns a new random 32 byte key.
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := crypto_rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// parseBoundedInt parses an integer in the inclusive range [min, max],
+// returning defaultVal if raw is empty.
+func parseBoundedInt(raw string, defaultVal, min, max int) (int, error) {
+	if raw == "" {
+		return defaultVal, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an integer", raw)
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("%d is out of range [%d, %d]", n, min, max)
+	}
+	return n, nil
+}
+
+const (
+	defaultPaginateTotal    = 100
+	maxPaginateTotal        = 100000
+	defaultPaginatePageSize = 10
+	maxPaginatePageSize     = 1000
+)
+
+// paginateItems returns up to limit of the synthetic /paginate items
+// starting at the given offset.
+func paginateItems(offset, limit, total int) []paginateItem {
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	items := make([]paginateItem, 0, end-offset)
+	for i := offset; i < end; i++ {
+		items = append(items, paginateItem{ID: i + 1, Name: fmt.Sprintf("item-%d", i+1)})
+	}
+	return items
+}
+
+// paginateLinks builds the Link header for a page-number style /paginate
+// response, preserving the request's other query params.
+func paginateLinks(r *http.Request, page, lastPage int) string {
+	link := func(p int, rel string) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(p))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, q.Encode(), rel)
+	}
+	links := []string{link(1, "first")}
+	if page > 1 {
+		links = append(links, link(page-1, "prev"))
+	}
+	if page < lastPage {
+		links = append(links, link(page+1, "next"))
+	}
+	links = append(links, link(lastPage, "last"))
+	return strings.Join(links, ", ")
+}
+
+// signPaginateCursor computes the signature for a /paginate cursor payload.
+func signPaginateCursor(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// paginateCursor returns an opaque, signed cursor pointing at the given
+// offset into a list of the given total and page size.
+func (h *HTTPBin) paginateCursor(offset, total, pageSize int) string {
+	payload := fmt.Sprintf("%d:%d:%d", offset, total, pageSize)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload + ":" + signPaginateCursor(h.paginationKey, payload)))
+}
+
+// parsePaginateCursor verifies a cursor created by paginateCursor and
+// returns its offset, rejecting cursors that have been tampered with or that
+// were issued for a different total or page size.
+func (h *HTTPBin) parsePaginateCursor(cursor string, total, pageSize int) (int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("malformed cursor")
+	}
+	i := bytes.LastIndexByte(decoded, ':')
+	if i < 0 {
+		return 0, errors.New("malformed cursor")
+	}
+	payload, sig := string(decoded[:i]), decoded[i+1:]
+	if !hmac.Equal(sig, []byte(signPaginateCursor(h.paginationKey, payload))) {
+		return 0, errors.New("signature mismatch")
+	}
+
+	var offset, cursorTotal, cursorPageSize int
+	if _, err := fmt.Sscanf(payload, "%d:%d:%d", &offset, &cursorTotal, &cursorPageSize); err != nil {
+		return 0, errors.New("malformed cursor")
+	}
+	if cursorTotal != total || cursorPageSize != pageSize {
+		return 0, errors.New("cursor was issued for a different total or page_size")
+	}
+	if offset < 0 || offset >= total {
+		return 0, errors.New("offset out of range")
+	}
+	return offset, nil
+}
+
+const (
+	defaultUsersTotal = 100
+	maxUsersTotal     = 10000
+)
+
+var (
+	userFirstNames = []string{
+		"Ada", "Alan", "Barbara", "Brian", "Claude", "Dennis", "Donald", "Edsger",
+		"Frances", "Grace", "Guido", "Hedy", "Ivan", "John", "Katherine", "Ken",
+		"Linus", "Margaret", "Niklaus", "Radia", "Rob", "Sophie", "Tim", "Yukihiro",
+	}
+	userLastNames = []string{
+		"Allen", "Berners-Lee", "Dijkstra", "Goldberg", "Hamilton", "Hopper",
+		"Johnson", "Kernighan", "Knuth", "Lamarr", "Liskov", "Lovelace",
+		"Matsumoto", "McCarthy", "O'Neil", "Perlman", "Pike", "Ritchie",
+		"Shannon", "Sutherland", "Thompson", "Torvalds", "Turing", "Wirth",
+	}
+	userStreets = []string{
+		"Main St", "Oak Ave", "Maple Dr", "Cedar Ln", "Elm St", "Pine Rd",
+		"Lakeview Blvd", "Hillcrest Way", "River Rd", "Sunset Ave",
+	}
+	userCities = []struct{ city, country string }{
+		{"Austin", "US"}, {"Berlin", "DE"}, {"Boston", "US"}, {"Dublin", "IE"},
+		{"Lisbon", "PT"}, {"Montréal", "CA"}, {"Nairobi", "KE"}, {"Osaka", "JP"},
+		{"Paris", "FR"}, {"São Paulo", "BR"}, {"Seoul", "KR"}, {"Sydney", "AU"},
+	}
+	userEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// generateUser deterministically generates the /users record with the given
+// id from the given seed. Each record is generated independently, from its
+// own source, so that any one of them can be served without generating the
+// rest of the dataset.
+func generateUser(seed int64, id int) userRecord {
+	rng := rand.New(rand.NewSource(int64(uint64(seed)*0x9e3779b97f4a7c15 ^ uint64(id))))
+
+	first := userFirstNames[rng.Intn(len(userFirstNames))]
+	last := userLastNames[rng.Intn(len(userLastNames))]
+	city := userCities[rng.Intn(len(userCities))]
+	handle := strings.ToLower(strings.NewReplacer("'", "", "-", "").Replace(first + "." + last))
+
+	u := userRecord{
+		ID:        id,
+		Username:  fmt.Sprintf("%s%d", handle, id),
+		FirstName: first,
+		LastName:  last,
+		Email:     fmt.Sprintf("%s.%d@example.com", handle, id),
+		Active:    rng.Intn(5) > 0,
+		Address: userAddress{
+			Street:     fmt.Sprintf("%d %s", 1+rng.Intn(9999), userStreets[rng.Intn(len(userStreets))]),
+			City:       city.city,
+			PostalCode: fmt.Sprintf("%05d", rng.Intn(100000)),
+			Country:    city.country,
+		},
+	}
+	if rng.Intn(3) > 0 {
+		phone := fmt.Sprintf("+1-555-%04d", rng.Intn(10000))
+		u.Phone = &phone
+	}
+	if rng.Intn(4) == 0 {
+		unit := fmt.Sprintf("Apt %d", 1+rng.Intn(999))
+		u.Address.Unit = &unit
+	}
+	created := userEpoch.Add(time.Duration(rng.Int63n(4*365*24*3600)) * time.Second)
+	u.CreatedAt = created.Format(time.RFC3339)
+	if rng.Intn(4) > 0 {
+		lastLogin := created.Add(time.Duration(rng.Int63n(365*24*3600)) * time.Second).Format(time.RFC3339)
+		u.LastLoginAt = &lastLogin
+	}
+	return u
+}
+
+// generateUsers generates up to limit consecutive /users records, starting
+// at the given offset.
+func generateUsers(seed int64, offset, limit int) []userRecord {
+	users := make([]userRecord, 0, limit)
+	for i := offset; i < offset+limit; i++ {
+		users = append(users, generateUser(seed, i+1))
+	}
+	return users
+}
+
+// field returns the value of the field at the given dotted path, e.g.
+// "address.city", and whether the path names a known field.
+func (u userRecord) field(path string) (interface{}, bool) {
+	switch path {
+	case "id":
+		return u.ID, true
+	case "username":
+		return u.Username, true
+	case "first_name":
+		return u.FirstName, true
+	case "last_name":
+		return u.LastName, true
+	case "email":
+		return u.Email, true
+	case "phone":
+		return u.Phone, true
+	case "active":
+		return u.Active, true
+	case "address":
+		return u.Address, true
+	case "address.street":
+		return u.Address.Street, true
+	case "address.unit":
+		return u.Address.Unit, true
+	case "address.city":
+		return u.Address.City, true
+	case "address.postal_code":
+		return u.Address.PostalCode, true
+	case "address.country":
+		return u.Address.Country, true
+	case "created_at":
+		return u.CreatedAt, true
+	case "last_login_at":
+		return u.LastLoginAt, true
+	}
+	return nil, false
+}
+
+// parseUserFields parses a comma-separated /users ?fields= param into a list
+// of field paths, rejecting unknown fields.
+func parseUserFields(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var fields []string
+	for _, path := range strings.Split(raw, ",") {
+		path = strings.TrimSpace(path)
+		if _, ok := (userRecord{}).field(path); !ok {
+			return nil, fmt.Errorf("unknown field %q", path)
+		}
+		fields = append(fields, path)
+	}
+	return fields, nil
+}
+
+// selectUserFields returns the full record if no fields are given, or
+// otherwise a sparse record containing only the given fields, nested
+// according to their paths.
+func selectUserFields(u userRecord, fields []string) interface{} {
+	if len(fields) == 0 {
+		return u
+	}
+	sparse := make(map[string]interface{}, len(fields))
+	for _, path := range fields {
+		v, _ := u.field(path)
+		setFieldPath(sparse, strings.Split(path, "."), v)
+	}
+	return sparse
+}
+
+// setFieldPath sets the value at the given path of nested maps, creating
+// intermediate maps as necessary. A value set for an ancestor path takes
+// precedence over values for its descendants, since it already includes
+// them.
+func setFieldPath(m map[string]interface{}, path []string, v interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			if _, exists := m[key]; exists {
+				return
+			}
+			next = make(map[string]interface{})
+			m[key] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = v
+}
+
+// userSortKey is one field of a /users ?sort= param.
+type userSortKey struct {
+	path string
+	desc bool
+}
+
+// parseUserSort parses a comma-separated /users ?sort= param, where each
+// field may be prefixed with - for descending order.
+func parseUserSort(raw string) ([]userSortKey, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var keys []userSortKey
+	for _, path := range strings.Split(raw, ",") {
+		key := userSortKey{path: strings.TrimSpace(path)}
+		if strings.HasPrefix(key.path, "-") {
+			key.path, key.desc = key.path[1:], true
+		}
+		v, ok := (userRecord{}).field(key.path)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", key.path)
+		}
+		if _, isObject := v.(userAddress); isObject {
+			return nil, fmt.Errorf("cannot sort by object field %q", key.path)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortUsers sorts users by the given keys in order, breaking any remaining
+// ties by id. Null values sort after all others, in either direction.
+func sortUsers(users []userRecord, keys []userSortKey) {
+	sort.SliceStable(users, func(i, j int) bool {
+		for _, key := range keys {
+			a, _ := users[i].field(key.path)
+			b, _ := users[j].field(key.path)
+			c, nulls := compareUserValues(a, b)
+			if c == 0 {
+				continue
+			}
+			if key.desc && !nulls {
+				c = -c
+			}
+			return c < 0
+		}
+		return users[i].ID < users[j].ID
+	})
+}
+
+// compareUserValues compares two values of the same userRecord field,
+// returning -1, 0, or 1, and whether the result was decided by one of the
+// values being null.
+func compareUserValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case int:
+		return compareInts(a, b.(int)), false
+	case bool:
+		return compareInts(boolToInt(a), boolToInt(b.(bool))), false
+	case string:
+		return strings.Compare(a, b.(string)), false
+	case *string:
+		b := b.(*string)
+		switch {
+		case a == nil && b == nil:
+			return 0, false
+		case a == nil:
+			return 1, true
+		case b == nil:
+			return -1, true
+		}
+		return strings.Compare(*a, *b), false
+	}
+	return 0, false
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Categories of the /naughty corpus, in the order they are served when no
+// ?category= is given, and its latest version. Each version of the corpus is
+// embedded under static/naughty/v{n}/{category}.json and must never change
+// once released, so that clients can rely on it for stable fixtures.
+var naughtyCategories = []string{"unicode", "injection", "numbers", "paths"}
+
+const latestNaughtyVersion = 1
+
+// naughtyStrings loads the given category of the given version of the
+// embedded /naughty corpus.
+func naughtyStrings(version int, category string) ([]string, error) {
+	raw, err := staticAsset(fmt.Sprintf("naughty/v%d/%s.json", version, category))
+	if err != nil {
+		return nil, err
+	}
+	var corpus []string
+	if err := json.Unmarshal(raw, &corpus); err != nil {
+		return nil, err
+	}
+	return corpus, nil
+}
+
+// encodeNaughtyStrings encodes as many of the given strings as fit within
+// maxSize bytes as a JSON array or, if lines is true, as newline-terminated
+// lines, omitting any string containing a line break since it cannot be
+// represented. It returns the encoded body along with the number of strings
+// written and omitted, and whether the list was truncated to fit.
+func encodeNaughtyStrings(corpus []string, lines bool, maxSize int64) (body []byte, written, omitted int, truncated bool) {
+	var entry []byte
+	if !lines {
+		body = append(body, "[\n"...)
+	}
+	for _, s := range corpus {
+		entry = entry[:0]
+		if lines {
+			if strings.ContainsAny(s, "\r\n") {
+				omitted++
+				continue
+			}
+			entry = append(append(entry, s...), '\n')
+		} else {
+			if written > 0 {
+				entry = append(entry, ",\n"...)
+			}
+			entry = appendJSONString(append(entry, "  "...), s)
+		}
+		// Leave room for the closing "\n]\n" of a JSON array
+		if int64(len(body)+len(entry)+3) > maxSize {
+			truncated = true
+			break
+		}
+		body = append(body, entry...)
+		written++
+	}
+	if !lines {
+		if written > 0 {
+			body = append(body, '\n')
+		}
+		body = append(body, "]\n"...)
+	}
+	return body, written, omitted, truncated
+}
+
+// maxBufferedZstdPayload is the largest /zstd payload that is compressed in
+// full before responding, which is the size of a single zstd block.
+const maxBufferedZstdPayload = 128 << 10
+
+// maxDiffContext limits the number of bytes of context /diff will dump on
+// either side of the first difference.
+const maxDiffContext = 256
+
+// firstDifference returns the offset of the first byte at which a and b
+// differ, which is the length of the shorter one if it is a prefix of the
+// other.
+func firstDifference(a, b []byte) int64 {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return int64(i)
+		}
+	}
+	return int64(n)
+}
+
+// byteWindow returns b[start:end], clamped to the bounds of b.
+func byteWindow(b []byte, start, end int64) []byte {
+	if start > int64(len(b)) {
+		start = int64(len(b))
+	}
+	if end > int64(len(b)) {
+		end = int64(len(b))
+	}
+	return b[start:end]
+}
+
+// Limits on the state kept by /fanout
+const (
+	maxFanoutChannels    = 100
+	maxFanoutMessageSize = 64 * 1024
+	fanoutBufferSize     = 64
+	fanoutQueueSize      = 16
+	fanoutIdleTTL        = 5 * time.Minute
+)
+
+var errTooManyFanoutChannels = fmt.Errorf("too many active channels, at most %d allowed", maxFanoutChannels)
+
+type fanoutMessage struct {
+	id   int64
+	data []byte
+}
+
+// fanoutSubscriber receives the messages published to a /fanout channel
+// through a bounded queue, so that a slow subscriber cannot block
+// publishers. Messages that do not fit in the queue are counted as dropped.
+type fanoutSubscriber struct {
+	queue   chan fanoutMessage
+	dropped int64 // accessed atomically
+	closed  chan struct{}
+}
+
+// takeDropped returns the number of messages dropped since the last call.
+func (s *fanoutSubscriber) takeDropped() int64 {
+	return atomic.SwapInt64(&s.dropped, 0)
+}
+
+type fanoutChannel struct {
+	lastID     int64
+	buffer     []fanoutMessage
+	subs       map[*fanoutSubscriber]struct{}
+	lastActive time.Time
+}
+
+// fanoutBroker holds the channels used by /fanout. Each channel keeps a
+// small buffer of recent messages for replay to reconnecting subscribers,
+// and expires once it has been idle with no subscribers for fanoutIdleTTL.
+type fanoutBroker struct {
+	mu       sync.Mutex
+	channels map[string]*fanoutChannel
+	now      func() time.Time
+}
+
+func newFanoutBroker(now func() time.Time) *fanoutBroker {
+	return &fanoutBroker{
+		channels: make(map[string]*fanoutChannel),
+		now:      now,
+	}
+}
+
+// channelLocked returns the named channel, creating it if necessary. The
+// broker's lock must be held.
+func (b *fanoutBroker) channelLocked(name string) (*fanoutChannel, error) {
+	now := b.now()
+	for n, c := range b.channels {
+		if len(c.subs) == 0 && now.Sub(c.lastActive) > fanoutIdleTTL {
+			delete(b.channels, n)
+		}
+	}
+	c, ok := b.channels[name]
+	if !ok {
+		if len(b.channels) >= maxFanoutChannels {
+			return nil, errTooManyFanoutChannels
+		}
+		c = &fanoutChannel{subs: make(map[*fanoutSubscriber]struct{})}
+		b.channels[name] = c
+	}
+	c.lastActive = now
+	return c, nil
+}
+
+// publish sends data to every current subscriber of the named channel,
+// returning the message's id, the number of subscribers, and how many of
+// them had to drop it.
+func (b *fanoutBroker) publish(name string, data []byte) (id int64, subscribers int, dropped int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.channelLocked(name)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	c.lastID++
+	msg := fanoutMessage{id: c.lastID, data: data}
+	c.buffer = append(c.buffer, msg)
+	if len(c.buffer) > fanoutBufferSize {
+		c.buffer = c.buffer[len(c.buffer)-fanoutBufferSize:]
+	}
+	for sub := range c.subs {
+		select {
+		case sub.queue <- msg:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+			dropped++
+		}
+	}
+	return msg.id, len(c.subs), dropped, nil
+}
+
+// subscribe adds a subscriber to the named channel, returning it along with
+// the buffered messages published after lastEventID, which the caller must
+// deliver before anything from the subscriber's queue.
+func (b *fanoutBroker) subscribe(name string, lastEventID int64) (*fanoutSubscriber, []fanoutMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, err := b.channelLocked(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var replay []fanoutMessage
+	if lastEventID > 0 {
+		for _, msg := range c.buffer {
+			if msg.id > lastEventID {
+				replay = append(replay, msg)
+			}
+		}
+	}
+	sub := &fanoutSubscriber{
+		queue:  make(chan fanoutMessage, fanoutQueueSize),
+		closed: make(chan struct{}),
+	}
+	c.subs[sub] = struct{}{}
+	return sub, replay, nil
+}
+
+func (b *fanoutBroker) unsubscribe(name string, sub *fanoutSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.channels[name]; ok {
+		delete(c.subs, sub)
+		c.lastActive = b.now()
+	}
+}
+
+// reset removes every channel, disconnecting their subscribers.
+func (b *fanoutBroker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.channels {
+		for sub := range c.subs {
+			close(sub.closed)
+		}
+	}
+	b.channels = make(map[string]*fanoutChannel)
+}
+
+// formatSSEEvent formats a server-sent event with the given id, splitting
+// multi-line data across multiple data fields.
+func formatSSEEvent(id int64, data []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %d\n", id)
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// Defaults and limits for /sse streams
+const (
+	defaultSSECount = 10
+	maxSSECount     = 1000
+	defaultSSEDelay = time.Second
+	maxSSERetryMS   = 3600 * 1000
+)
+
+// Limits on the state kept by each set of keyCounters
+const (
+	maxCounterKeys = 1000
+	keyCounterTTL  = 10 * time.Minute
+)
+
+// maxUnstablePatternLength limits the length of /unstable?pattern=
+const maxUnstablePatternLength = 100
+
+// maxRetryFailures limits the number of failures /retry may be asked for
+const maxRetryFailures = 1000
+
+var errTooManyCounterKeys = fmt.Errorf("too many active keys, at most %d allowed", maxCounterKeys)
+
+type keyCounter struct {
+	requests int64
+	lastSeen time.Time
+}
+
+// keyCounters holds per-key request counters, as used by /cache/sequence and
+// /unstable. Keys expire once they have not been requested for keyCounterTTL.
+type keyCounters struct {
+	mu      sync.Mutex
+	entries map[string]*keyCounter
+	now     func() time.Time
+}
+
+func newKeyCounters(now func() time.Time) *keyCounters {
+	return &keyCounters{
+		entries: make(map[string]*keyCounter),
+		now:     now,
+	}
+}
+
+// next counts a request for the given key, returning the number of requests
+// made for it so far.
+func (c *keyCounters) next(key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	seq, ok := c.entries[key]
+	if ok && now.Sub(seq.lastSeen) > keyCounterTTL {
+		ok = false
+	}
+	if !ok {
+		if len(c.entries) >= maxCounterKeys {
+			for k, e := range c.entries {
+				if now.Sub(e.lastSeen) > keyCounterTTL {
+					delete(c.entries, k)
+				}
+			}
+			if len(c.entries) >= maxCounterKeys {
+				return 0, errTooManyCounterKeys
+			}
+		}
+		seq = &keyCounter{}
+		c.entries[key] = seq
+	}
+	seq.requests++
+	seq.lastSeen = now
+	return seq.requests, nil
+}
+
+func (c *keyCounters) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// reset removes every key.
+func (c *keyCounters) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*keyCounter)
+}
+
+// Limits on /cdn-sim
+const (
+	defaultCDNSimTTL = 60 * time.Second
+	maxCDNSimTTL     = 24 * time.Hour
+	maxCDNSimKeys    = 1000
+)
+
+var errTooManyCDNSimKeys = fmt.Errorf("too many cached keys, at most %d allowed", maxCDNSimKeys)
+
+type cdnSimEntry struct {
+	storedAt time.Time
+	ttl      time.Duration
+}
+
+// cdnSimCache holds the per-key entries of the shared cache emulated by
+// /cdn-sim. Entries expire once their TTL has elapsed.
+type cdnSimCache struct {
+	mu      sync.Mutex
+	entries map[string]*cdnSimEntry
+	now     func() time.Time
+}
+
+func newCDNSimCache(now func() time.Time) *cdnSimCache {
+	return &cdnSimCache{
+		entries: make(map[string]*cdnSimEntry),
+		now:     now,
+	}
+}
+
+// get looks up the given key, returning its cached entry and hit=true if it
+// is fresh. Otherwise, or if bypass is true, the request is a miss and a new
+// entry with the given TTL is stored in its place.
+func (c *cdnSimCache) get(key string, ttl time.Duration, bypass bool) (entry cdnSimEntry, age time.Duration, hit bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if e, ok := c.entries[key]; ok && !bypass && now.Sub(e.storedAt) < e.ttl {
+		return *e, now.Sub(e.storedAt), true, nil
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCDNSimKeys {
+		for k, e := range c.entries {
+			if now.Sub(e.storedAt) >= e.ttl {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCDNSimKeys {
+			return cdnSimEntry{}, 0, false, errTooManyCDNSimKeys
+		}
+	}
+	e := &cdnSimEntry{storedAt: now, ttl: ttl}
+	c.entries[key] = e
+	return *e, 0, false, nil
+}
+
+// reset removes every entry.
+func (c *cdnSimCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*cdnSimEntry)
+}
+
+// hasCacheDirective reports whether a Cache-Control header contains the
+// given directive, ignoring any directive arguments.
+func hasCacheDirective(cacheControl string, directive string) bool {
+	for _, d := range strings.Split(cacheControl, ",") {
+		if i := strings.IndexByte(d, '='); i >= 0 {
+			d = d[:i]
+		}
+		if strings.EqualFold(strings.TrimSpace(d), directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseETagList parses the comma-separated entity-tags in an If-Match or
+// If-None-Match header, e.g. "a", W/"b,c", returning each with its quotes
+// and any W/ prefix. A * is returned as is. Parsing stops at the first
+// malformed element, as the remainder of the list cannot be trusted.
+func parseETagList(header string) []string {
+	var tags []string
+	s := header
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return tags
+		}
+		if s[0] == '*' {
+			tags = append(tags, "*")
+			s = s[1:]
+			continue
+		}
+		start := 0
+		if strings.HasPrefix(s, "W/") {
+			start = 2
+		}
+		if len(s) <= start || s[start] != '"' {
+			return tags
+		}
+		end := strings.IndexByte(s[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, s[:end])
+		s = s[end:]
+	}
+}
+
+// etagListMatches reports whether an If-Match or If-None-Match header
+// lists etag or *, using the strong comparison function from RFC 7232
+// section 2.3.2, under which weak tags never match, or the weak one.
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, tag := range parseETagList(header) {
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if tag == etag && !strings.HasPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDigestStaleAfter parses the stale_after param of /digest-auth, given
+// as a duration or number of seconds, e.g. 30s or 1.5, or as a number of
+// uses, e.g. 3uses. An empty value imposes no limit.
+func parseDigestStaleAfter(raw string) (digest.Staleness, error) {
+	if raw == "" {
+		return digest.Staleness{}, nil
+	}
+	if strings.HasSuffix(raw, "uses") {
+		n, err := strconv.ParseUint(strings.TrimSuffix(raw, "uses"), 10, 64)
+		if err != nil || n == 0 {
+			return digest.Staleness{}, errors.New("number of uses must be a positive integer")
+		}
+		return digest.Staleness{MaxUses: n}, nil
+	}
+	d, err := parseDuration(raw)
+	if err != nil || d <= 0 {
+		return digest.Staleness{}, errors.New("must be a positive number of seconds, a duration, or a number of uses like 3uses")
+	}
+	return digest.Staleness{MaxAge: d}, nil
+}
+
+// parseLastModified parses the last_modified param of /cache, given as an
+// HTTP date, e.g. Mon, 02 Jan 2006 15:04:05 GMT, or as Unix seconds.
+func parseLastModified(raw string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	t, err := http.ParseTime(raw)
+	if err != nil {
+		return time.Time{}, errors.New("must be an HTTP date or Unix seconds")
+	}
+	return t, nil
+}
+
+// verifyHashes maps the algorithms supported by /verify to their hashes.
+var verifyHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"md5":    md5.New,
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+// Patch media types accepted by /patch-target
+const (
+	jsonPatchContentType  = "application/json-patch+json"
+	mergePatchContentType = "application/merge-patch+json"
+	acceptPatch           = jsonPatchContentType + ", " + mergePatchContentType
+)
+
+// Limits on the state kept by /patch-target
+const (
+	maxPatchTargetKeys   = 1000
+	maxPatchTargetSize   = 64 * 1024
+	patchTargetTTL       = 10 * time.Minute
+	initialPatchDocument = `{"name":"httpbin","tags":["http","testing"],"version":1}`
+)
+
+var errTooManyPatchTargetKeys = fmt.Errorf("too many active keys, at most %d allowed", maxPatchTargetKeys)
+
+// errPatchConflict is returned when a patch is well-formed but cannot be
+// applied to the current document, including when a json-patch test
+// operation fails.
+var errPatchConflict = errors.New("patch cannot be applied")
+
+var errPatchTooLarge = fmt.Errorf("patched document larger than %d bytes", maxPatchTargetSize)
+
+// checkPatchedSize returns errPatchTooLarge if doc is too large to store.
+func checkPatchedSize(doc interface{}) error {
+	if encoded, _ := json.Marshal(doc); len(encoded) > maxPatchTargetSize {
+		return errPatchTooLarge
+	}
+	return nil
+}
+
+type patchTarget struct {
+	doc      interface{}
+	lastSeen time.Time
+}
+
+// patchTargets holds the per-key JSON documents modified by /patch-target.
+// Keys expire once they have not been requested for patchTargetTTL.
+type patchTargets struct {
+	mu      sync.Mutex
+	entries map[string]*patchTarget
+	now     func() time.Time
+}
+
+func newPatchTargets(now func() time.Time) *patchTargets {
+	return &patchTargets{
+		entries: make(map[string]*patchTarget),
+		now:     now,
+	}
+}
+
+// get returns a copy of the document for the given key, creating it if
+// necessary.
+func (p *patchTargets) get(key string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	target, err := p.targetLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	return copyJSONValue(target.doc), nil
+}
+
+// update replaces the document for the given key with the result of
+// applying patch to a copy of it, leaving the document unchanged if patch
+// fails.
+func (p *patchTargets) update(key string, patch func(doc interface{}) (interface{}, error)) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	target, err := p.targetLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := patch(copyJSONValue(target.doc))
+	if err != nil {
+		return nil, err
+	}
+	target.doc = doc
+	return copyJSONValue(doc), nil
+}
+
+func (p *patchTargets) targetLocked(key string) (*patchTarget, error) {
+	now := p.now()
+	target, ok := p.entries[key]
+	if ok && now.Sub(target.lastSeen) > patchTargetTTL {
+		ok = false
+	}
+	if !ok {
+		if len(p.entries) >= maxPatchTargetKeys {
+			for k, e := range p.entries {
+				if now.Sub(e.lastSeen) > patchTargetTTL {
+					delete(p.entries, k)
+				}
+			}
+			if len(p.entries) >= maxPatchTargetKeys {
+				return nil, errTooManyPatchTargetKeys
+			}
+		}
+		var doc interface{}
+		_ = json.Unmarshal([]byte(initialPatchDocument), &doc)
+		target = &patchTarget{doc: doc}
+		p.entries[key] = target
+	}
+	target.lastSeen = now
+	return target, nil
+}
+
+func (p *patchTargets) delete(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.entries, key)
+}
+
+// reset removes every key.
+func (p *patchTargets) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries = make(map[string]*patchTarget)
+}
+
+// copyJSONValue deep copies a value decoded by encoding/json.
+func copyJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = copyJSONValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = copyJSONValue(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// jsonPatchOp is a single operation in an RFC 6902 JSON Patch document.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+
+	path, from []string
+	value      interface{}
+}
+
+// parseJSONPatch parses and validates an RFC 6902 JSON Patch document.
+func parseJSONPatch(body []byte) ([]jsonPatchOp, error) {
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return nil, fmt.Errorf("invalid json-patch document: %w", err)
+	}
+	for i := range ops {
+		op := &ops[i]
+		var err error
+		if op.path, err = parseJSONPointer(op.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: invalid path: %w", i, err)
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d: %s requires a value", i, op.Op)
+			}
+			if err := json.Unmarshal(op.Value, &op.value); err != nil {
+				return nil, fmt.Errorf("operation %d: invalid value: %w", i, err)
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, fmt.Errorf("operation %d: %s requires from", i, op.Op)
+			}
+			if op.from, err = parseJSONPointer(*op.From); err != nil {
+				return nil, fmt.Errorf("operation %d: invalid from: %w", i, err)
+			}
+			if op.Op == "move" && len(op.from) < len(op.path) && isPointerPrefix(op.from, op.path) {
+				return nil, fmt.Errorf("operation %d: cannot move a value into one of its children", i)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+	}
+	return ops, nil
+}
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into its unescaped
+// reference tokens. The empty pointer refers to the whole document.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("pointer %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		if strings.Contains(strings.NewReplacer("~0", "", "~1", "").Replace(token), "~") {
+			return nil, fmt.Errorf("pointer %q has an invalid escape", pointer)
+		}
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func isPointerPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// applyJSONPatch applies the operations to doc in order, modifying it in
+// place where possible and returning the result. The whole patch fails if
+// any operation does.
+func applyJSONPatch(doc interface{}, ops []jsonPatchOp) (interface{}, error) {
+	var err error
+	for i, op := range ops {
+		switch op.Op {
+		case "add":
+			doc, err = jsonPatchAdd(doc, op.path, copyJSONValue(op.value))
+		case "remove":
+			doc, _, err = jsonPatchRemove(doc, op.path)
+		case "replace":
+			if len(op.path) == 0 {
+				doc = copyJSONValue(op.value)
+			} else if doc, _, err = jsonPatchRemove(doc, op.path); err == nil {
+				doc, err = jsonPatchAdd(doc, op.path, copyJSONValue(op.value))
+			}
+		case "move":
+			var v interface{}
+			if doc, v, err = jsonPatchRemove(doc, op.from); err == nil {
+				doc, err = jsonPatchAdd(doc, op.path, v)
+			}
+		case "copy":
+			var v interface{}
+			if v, err = jsonPatchGet(doc, op.from); err == nil {
+				doc, err = jsonPatchAdd(doc, op.path, copyJSONValue(v))
+			}
+			// Repeated copies can grow the document exponentially, so
+			// check its size as we go rather than only at the end
+			if err == nil {
+				if err := checkPatchedSize(doc); err != nil {
+					return nil, err
+				}
+			}
+		case "test":
+			var v interface{}
+			if v, err = jsonPatchGet(doc, op.path); err == nil && !reflect.DeepEqual(v, op.value) {
+				err = fmt.Errorf("value at %q does not match", op.Path)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: operation %d (%s): %s", errPatchConflict, i, op.Op, err)
+		}
+	}
+	return doc, nil
+}
+
+// jsonPatchIndex parses an array index reference token. When appending is
+// allowed, "-" refers to the index just past the end of the array.
+func jsonPatchIndex(token string, length int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return length, nil
+	}
+	limit := length - 1
+	if appending {
+		limit = length
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') || token[0] == '+' {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > limit {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+func jsonPatchGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			v, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q not found", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := jsonPatchIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = container[i]
+		default:
+			return nil, fmt.Errorf("cannot index into scalar value with %q", token)
+		}
+	}
+	return doc, nil
+}
+
+func jsonPatchAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token := path[0]
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			container[token] = value
+			return container, nil
+		}
+		child, ok := container[token]
+		if !ok {
+			return nil, fmt.Errorf("member %q not found", token)
+		}
+		child, err := jsonPatchAdd(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		container[token] = child
+		return container, nil
+	case []interface{}:
+		i, err := jsonPatchIndex(token, len(container), len(path) == 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 1 {
+			container = append(container, nil)
+			copy(container[i+1:], container[i:])
+			container[i] = value
+			return container, nil
+		}
+		child, err := jsonPatchAdd(container[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		container[i] = child
+		return container, nil
+	default:
+		return nil, fmt.Errorf("cannot index into scalar value with %q", token)
+	}
+}
+
+func jsonPatchRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	token := path[0]
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("member %q not found", token)
+		}
+		if len(path) == 1 {
+			delete(container, token)
+			return container, child, nil
+		}
+		child, removed, err := jsonPatchRemove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		container[token] = child
+		return container, removed, nil
+	case []interface{}:
+		i, err := jsonPatchIndex(token, len(container), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := container[i]
+			return append(container[:i], container[i+1:]...), removed, nil
+		}
+		child, removed, err := jsonPatchRemove(container[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		container[i] = child
+		return container, removed, nil
+	default:
+		return nil, nil, fmt.Errorf("cannot index into scalar value with %q", token)
+	}
+}
+
+// applyMergePatch applies an RFC 7386 JSON Merge Patch to doc, modifying it
+// in place where possible and returning the result.
+func applyMergePatch(doc, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	docObj, ok := doc.(map[string]interface{})
+	if !ok {
+		docObj = make(map[string]interface{}, len(patchObj))
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(docObj, k)
+		} else {
+			docObj[k] = applyMergePatch(docObj[k], v)
+		}
+	}
+	return docObj
+}
+
+// Component states accepted by /degraded
+const (
+	degradedUp   = "up"
+	degradedSlow = "slow"
+	degradedDown = "down"
+)
+
+// maxDegradedComponents limits the number of components /degraded reports
+const maxDegradedComponents = 32
+
+func isDegradedState(s string) bool {
+	return s == degradedUp || s == degradedSlow || s == degradedDown
+}
+
+// parseDegradedComponents parses a comma-separated list of name:state pairs
+// into a map of component names to components, which remember their
+// position in the list.
+func parseDegradedComponents(raw string) (map[string]degradedComponent, error) {
+	components := make(map[string]degradedComponent)
+	if raw == "" {
+		return components, nil
+	}
+	for i, entry := range strings.Split(raw, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || !isSlug(parts[0]) || !isDegradedState(parts[1]) {
+			return nil, fmt.Errorf("%q must be name:state, where state is up, slow, or down", entry)
+		}
+		name, state := parts[0], parts[1]
+		if _, dup := components[name]; dup {
+			return nil, fmt.Errorf("component %q given more than once", name)
+		}
+		if len(components) >= maxDegradedComponents {
+			return nil, fmt.Errorf("at most %d components allowed", maxDegradedComponents)
+		}
+		components[name] = degradedComponent{Name: name, Status: state, index: i}
+	}
+	return components, nil
+}
+
+// degradedStatusRule maps a component being in a given state to a response
+// status.
+type degradedStatusRule struct {
+	component string
+	state     string
+	status    int
+}
+
+// parseDegradedStatusRules parses a comma-separated list of
+// name:state=status rules, each of which must refer to one of the given
+// components.
+func parseDegradedStatusRules(raw string, components map[string]degradedComponent) ([]degradedStatusRule, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var rules []degradedStatusRule
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q must be name:state=status", entry)
+		}
+		spec, rawStatus := strings.SplitN(parts[0], ":", 2), parts[1]
+		if len(spec) != 2 || !isDegradedState(spec[1]) {
+			return nil, fmt.Errorf("%q must be name:state=status, where state is up, slow, or down", entry)
+		}
+		name, state := spec[0], spec[1]
+		if _, known := components[name]; !known {
+			return nil, fmt.Errorf("%q refers to unknown component %q", entry, name)
+		}
+		status, err := strconv.Atoi(rawStatus)
+		if err != nil || status < 200 || status > 599 {
+			return nil, fmt.Errorf("%q has invalid status, must be between 200 and 599", entry)
+		}
+		rules = append(rules, degradedStatusRule{component: name, state: state, status: status})
+	}
+	return rules, nil
+}
+
+// The range of status codes accepted by /status
+const (
+	minStatusCode = 100
+	maxStatusCode = 599
+)
+
+func isAcceptedStatus(code int) bool {
+	return code >= minStatusCode && code <= maxStatusCode
+}
+
+// statusBodyAllowed reports whether a response with the given status may
+// include a body, per RFC 9110.
+func statusBodyAllowed(code int) bool {
+	return code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// statusCatalog describes how /status handles every status code it accepts.
+func statusCatalog() []statusCatalogEntry {
+	entries := make([]statusCatalogEntry, 0, maxStatusCode-minStatusCode+1)
+	for code := minStatusCode; code <= maxStatusCode; code++ {
+		if !isAcceptedStatus(code) {
+			continue
+		}
+		entry := statusCatalogEntry{
+			Code:        code,
+			Reason:      http.StatusText(code),
+			BodyAllowed: statusBodyAllowed(code),
+			URL:         fmt.Sprintf("/status/%d", code),
+		}
+		var notes []string
+		switch {
+		case code == http.StatusSwitchingProtocols:
+			notes = append(notes, "sent as a final response without switching protocols")
+		case code < 200:
+			notes = append(notes, "sent as an interim response, followed by a final 200 response")
+		case !entry.BodyAllowed:
+			notes = append(notes, "sent without a body")
+		}
+		if specialCase, ok := statusSpecialCases[code]; ok {
+			entry.Headers = specialCase.headers
+			if specialCase.body != nil {
+				notes = append(notes, "sent with a canned body")
+			}
+			if len(specialCase.headers) > 0 {
+				names := make([]string, 0, len(specialCase.headers))
+				for name := range specialCase.headers {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				notes = append(notes, "sets "+strings.Join(names, ", "))
+			}
+		}
+		entry.SpecialHandling = len(notes) > 0
+		entry.Note = strings.Join(notes, "; ")
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// oidcKey is a keypair used by the OIDC simulator to sign tokens.
+type oidcKey struct {
+	id      string
+	private *ecdsa.PrivateKey
+	// When a retired key stops being published, zero for the current key
+	expires time.Time
+}
+
+// newOIDCKey generates a P-256 keypair identified by its RFC 7638 JWK
+// thumbprint.
+func newOIDCKey() *oidcKey {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), crypto_rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("httpbin: failed to generate OIDC signing key: %s", err))
+	}
+	key := &oidcKey{private: private}
+	jwk := key.jwk()
+	thumbprint := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)))
+	key.id = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	return key
+}
+
+// jwk returns the public half of the key as a JSON Web Key.
+func (k *oidcKey) jwk() jsonWebKey {
+	x, y := make([]byte, 32), make([]byte, 32)
+	k.private.X.FillBytes(x)
+	k.private.Y.FillBytes(y)
+	return jsonWebKey{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Y:   base64.RawURLEncoding.EncodeToString(y),
+		Kid: k.id,
+		Use: "sig",
+		Alg: oidcSigningAlg,
+	}
+}
+
+// sign returns a compact JWS signed with the key, whose payload is the JSON
+// encoding of claims.
+func (k *oidcKey) sign(claims interface{}) string {
+	header := mustMarshalCompactJSON(map[string]string{"alg": oidcSigningAlg, "typ": "JWT", "kid": k.id})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(mustMarshalCompactJSON(claims))
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(crypto_rand.Reader, k.private, digest[:])
+	if err != nil {
+		panic(fmt.Sprintf("httpbin: failed to sign token: %s", err))
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// oidcKeySet holds the OIDC simulator's current signing key, along with
+// any retired keys that are still published so that tokens they signed
+// remain verifiable until they expire.
+type oidcKeySet struct {
+	mu      sync.Mutex
+	current *oidcKey
+	retired []*oidcKey
+}
+
+func newOIDCKeySet() *oidcKeySet {
+	return &oidcKeySet{current: newOIDCKey()}
+}
+
+// signingKey returns the key with which new tokens are signed.
+func (s *oidcKeySet) signingKey() *oidcKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// published returns the current key followed by every retired key whose
+// grace period has not yet ended, discarding the rest.
+func (s *oidcKeySet) published(now time.Time) []*oidcKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	retired := s.retired[:0]
+	for _, key := range s.retired {
+		if now.Before(key.expires) {
+			retired = append(retired, key)
+		}
+	}
+	s.retired = retired
+	return append([]*oidcKey{s.current}, retired...)
+}
+
+// rotate replaces the current key with a newly generated one, retiring the
+// old key at now plus grace, and returns the new key.
+func (s *oidcKeySet) rotate(now time.Time, grace time.Duration) *oidcKey {
+	key := newOIDCKey()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := *s.current
+	old.expires = now.Add(grace)
+	s.retired = append([]*oidcKey{&old}, s.retired...)
+	s.current = key
+	return key
+}
+
+// defaultSlowReaderRate is the rate in bytes per second at which
+// /upload/slow-reader reads by default
+const defaultSlowReaderRate = 1024
+
+// slowReaderChunkSize returns how much /upload/slow-reader reads at a time,
+// giving about ten reads per second up to a chunk size of 32 KiB.
+func slowReaderChunkSize(rate int) int {
+	size := rate / 10
+	if size < 1 {
+		return 1
+	}
+	if size > 32<<10 {
+		return 32 << 10
+	}
+	return size
+}
+
+// defaultCoalesceWork is how long /coalesce's simulated work takes by default
+const defaultCoalesceWork = 500 * time.Millisecond
+
+// coalesceCall is an in-flight /coalesce computation, shared by every
+// concurrent request for its key.
+type coalesceCall struct {
+	done    chan struct{}
+	waiters int
+	// Set before done is closed
+	result coalesceResponse
+}
+
+// coalescer deduplicates concurrent /coalesce computations by key,
+// forgetting each computation as soon as it completes.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalesceCall
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*coalesceCall)}
+}
+
+// join returns the in-flight computation for key, starting one if there is
+// none, and whether the caller started it and so must perform its work.
+func (c *coalescer) join(key string) (*coalesceCall, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		return call, false
+	}
+	call := &coalesceCall{done: make(chan struct{}), waiters: 1}
+	c.calls[key] = call
+	return call, true
+}
+
+// leave withdraws a caller that stopped waiting for call, returning false
+// if it was too late because call had already completed.
+func (c *coalescer) leave(call *coalesceCall) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-call.done:
+		return false
+	default:
+		call.waiters--
+		return true
+	}
+}
+
+// finish completes call with the given result, recording the number of
+// waiters it served, forgets its key, and wakes its waiters.
+func (c *coalescer) finish(key string, call *coalesceCall, result coalesceResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result.Waiters = call.waiters
+	call.result = result
+	delete(c.calls, key)
+	close(call.done)
+}
+
+// inflight returns the number of keys with a computation in progress.
+func (c *coalescer) inflight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.calls)
+}
+
+// parseTagFilter returns the tags given in the tag query parameter, which
+// may be repeated, or an error if any of them is not a known route tag.
+func parseTagFilter(q url.Values) ([]string, error) {
+	tags := q["tag"]
+	for _, tag := range tags {
+		if _, ok := routeTags[tag]; !ok {
+			return nil, fmt.Errorf("unknown tag %q", tag)
+		}
+	}
+	return tags, nil
+}
+
+// ValidateRouteTag returns an error if tag is not one of the categories
+// routes are tagged with, as listed by /index.json.
+func ValidateRouteTag(tag string) error {
+	if _, ok := routeTags[tag]; !ok {
+		return fmt.Errorf("unknown route tag %q", tag)
+	}
+	return nil
+}
+
+// hasTags reports whether the route has every one of the given tags.
+func (rt route) hasTags(tags []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range rt.tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// routeForPath returns the route that would serve the given path: the one
+// whose pattern matches it exactly or, failing that, the one with the
+// longest subtree pattern containing it. The "/" index route only matches
+// itself, since it serves nothing but 404s beneath it.
+func routeForPath(routes []route, path string) (route, bool) {
+	var (
+		best  route
+		found bool
+	)
+	for _, rt := range routes {
+		p := rt.pattern
+		if p == path {
+			return rt, true
+		}
+		if p == "/" || !strings.HasSuffix(p, "/") || !strings.HasPrefix(path, p) {
+			continue
+		}
+		if !found || len(p) > len(best.pattern) {
+			best, found = rt, true
+		}
+	}
+	return best, found
+}
+
+// indexEntryPath matches an endpoint entry in the index page, capturing its
+// path up to the first query string or path parameter.
+var indexEntryPath = regexp.MustCompile(`^<li>(?:<a [^>]*>)?<code>([^<?:]*)`)
+
+// filterIndexPage removes from the index page the entries for endpoints
+// that are not among the given routes or lack any of the given tags.
+func filterIndexPage(page []byte, routes []route, tags []string) []byte {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(page, []byte("\n")) {
+		if m := indexEntryPath.FindSubmatch(bytes.TrimSpace(line)); m != nil {
+			rt, ok := routeForPath(routes, html.UnescapeString(string(m[1])))
+			if !ok || !rt.hasTags(tags) {
+				continue
+			}
+		}
+		buf.Write(line)
+	}
+	return buf.Bytes()
+}
+
+// routeParams describes the parameters accepted by the route with the given
+// pattern, with the defaults and limits currently in effect, or returns nil
+// if they are not described.
+func (h *HTTPBin) routeParams(pattern string) []routeParam {
+	maxDuration := h.MaxDuration.String()
+	maxBodySize := strconv.FormatInt(h.MaxBodySize, 10)
+	switch pattern {
+	case "/drip":
+		defaults := h.currentSettings().DefaultParams
+		return []routeParam{
+			{Name: "duration", In: "query", Type: "duration", Default: defaults.DripDuration.String(), Min: "0s", Max: maxDuration, Description: "Time over which to drip the body"},
+			{Name: "delay", In: "query", Type: "duration", Default: defaults.DripDelay.String(), Min: "0s", Max: maxDuration, Description: "Time to wait before the first byte"},
+			{Name: "numbytes", In: "query", Type: "integer", Default: strconv.FormatInt(defaults.DripNumBytes, 10), Min: "0", Max: maxBodySize, Description: "Number of bytes to drip"},
+			{Name: "code", In: "query", Type: "integer", Default: "200", Min: "100", Max: "599", Description: "Status code of the response"},
+			{Name: "delay_before_headers", In: "query", Type: "boolean", Default: "false", Description: "Whether to wait before sending the response headers rather than after"},
+		}
+	case "/delay/":
+		return []routeParam{
+			{Name: "duration", In: "path", Type: "duration", Min: "0s", Max: maxDuration, Description: "Time to wait before responding, or a low-high range to sample from; longer delays are clamped"},
+		}
+	case "/bytes/":
+		return []routeParam{
+			{Name: "n", In: "path", Type: "integer", Min: "0", Max: "102400", Description: "Number of bytes; larger values are clamped"},
+			{Name: "pattern", In: "query", Type: "string", Default: bytesPatternRandom, Description: "Content of the bytes: random, zero, text or cycle"},
+			{Name: "seed", In: "query", Type: "integer", Description: "Seed for the random pattern"},
+		}
+	case "/stream-bytes/":
+		return []routeParam{
+			{Name: "n", In: "path", Type: "integer", Min: "0", Max: "102400", Description: "Number of bytes; larger values are clamped"},
+			{Name: "chunk_size", In: "query", Type: "integer", Default: "10240", Description: "Number of bytes in each chunk"},
+			{Name: "delay", In: "query", Type: "duration", Default: "0s", Min: "0s", Max: maxDuration, Description: "Time to wait between chunks; clamped so that the waits add up to no more than the maximum"},
+			{Name: "pattern", In: "query", Type: "string", Default: bytesPatternRandom, Description: "Content of the bytes: random, zero, text or cycle"},
+			{Name: "seed", In: "query", Type: "integer", Description: "Seed for the random pattern"},
+		}
+	case "/range/":
+		return []routeParam{
+			{Name: "n", In: "path", Type: "integer", Min: "1", Max: maxBodySize, Description: "Size of the resource"},
+		}
+	case "/image/":
+		return []routeParam{
+			{Name: "format", In: "path", Type: "string", Description: "Image format: png, jpeg, webp, avif or svg"},
+			{Name: "width", In: "query", Type: "integer", Default: strconv.Itoa(defaultImageDimension), Min: "1", Max: strconv.Itoa(maxImageDimension), Description: "Width of a generated png or jpeg image"},
+			{Name: "height", In: "query", Type: "integer", Default: strconv.Itoa(defaultImageDimension), Min: "1", Max: strconv.Itoa(maxImageDimension), Description: "Height of a generated png or jpeg image; width times height may not exceed " + maxBodySize + " pixels"},
+		}
+	case "/digest-auth/":
+		return []routeParam{
+			{Name: "qop", In: "path", Type: "string", Description: "Quality of protection: auth or auth-int"},
+			{Name: "algorithm", In: "path", Type: "string", Default: "MD5", Description: "Algorithm: MD5, SHA-256, MD5-sess or SHA-256-sess"},
+			{Name: "stale_after", In: "query", Type: "string", Description: "Seconds, or a number of uses like 3uses, after which a nonce is stale"},
+		}
+	case "/bearer":
+		return []routeParam{
+			{Name: "jwt", In: "query", Type: "boolean", Default: "false", Description: "Whether to validate the token as a JWT signed with HMAC-SHA256"},
+			{Name: "secret", In: "query", Type: "string", Description: "Secret with which a validated JWT must be signed"},
+		}
+	case "/cookies/set":
+		return []routeParam{
+			{Name: "__path", In: "query", Type: "string", Description: "Path attribute of every cookie"},
+			{Name: "__domain", In: "query", Type: "string", Description: "Domain attribute of every cookie"},
+			{Name: "__max_age", In: "query", Type: "integer", Min: "0", Description: "Max-Age attribute of every cookie"},
+			{Name: "__secure", In: "query", Type: "boolean", Default: "false", Description: "Whether every cookie is Secure"},
+			{Name: "__httponly", In: "query", Type: "boolean", Default: "true", Description: "Whether every cookie is HttpOnly"},
+			{Name: "__samesite", In: "query", Type: "string", Description: "SameSite attribute of every cookie: strict, lax or none"},
+		}
+	case "/cookies/delete":
+		return []routeParam{
+			{Name: "all", In: "query", Type: "boolean", Default: "false", Description: "Whether to delete every cookie in the request"},
+			{Name: "__path", In: "query", Type: "string", Description: "Path attribute of the cookies to delete"},
+			{Name: "__domain", In: "query", Type: "string", Description: "Domain attribute of the cookies to delete"},
+		}
+	case "/unstable":
+		return []routeParam{
+			{Name: "failure_rate", In: "query", Type: "number", Default: "0.5", Min: "0", Max: "1", Description: "Probability that a request fails"},
+			{Name: "seed", In: "query", Type: "integer", Description: "Seed for the random failures"},
+			{Name: "pattern", In: "query", Type: "string", Description: "Deterministic sequence of failures (F) and successes (S), at most " + strconv.Itoa(maxUnstablePatternLength) + " long"},
+			{Name: "key", In: "query", Type: "string", Default: "default", Description: "Key whose requests follow the pattern"},
+			{Name: "repeat", In: "query", Type: "boolean", Default: "false", Description: "Whether to cycle through the pattern rather than hold on its last state"},
+		}
+	case "/churn":
+		return []routeParam{
+			{Name: "close_every", In: "query", Type: "integer", Default: "10", Min: "1", Description: "Number of requests after which each connection is closed"},
+		}
+	case "/retry/":
+		return []routeParam{
+			{Name: "key", In: "path", Type: "string", Description: "Key whose attempts are counted, forgotten after " + keyCounterTTL.String() + " without requests"},
+			{Name: "n", In: "path", Type: "integer", Min: "0", Max: strconv.Itoa(maxRetryFailures), Description: "Number of attempts that fail"},
+			{Name: "status_code", In: "query", Type: "integer", Default: "503", Min: "400", Max: "599", Description: "Status code of the failed attempts"},
+		}
+	case "/stream/":
+		return []routeParam{
+			{Name: "n", In: "path", Type: "integer", Min: "1", Max: "100", Description: "Number of JSON lines; values outside the range are clamped"},
+		}
+	}
+	return nil
+}
+
+// indexDescription returns the plain text description of the route with the
+// given pattern from its entry in the index page, or an empty string if it
+// has none.
+func indexDescription(page []byte, routes []route, pattern string) string {
+	for _, line := range bytes.Split(page, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		m := indexEntryPath.FindSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if rt, ok := routeForPath(routes, html.UnescapeString(string(m[1]))); !ok || rt.pattern != pattern {
+			continue
+		}
+		i := bytes.Index(line, []byte("</code>"))
+		text := bytes.TrimPrefix(line[i+len("</code>"):], []byte("</a>"))
+		text = htmlTag.ReplaceAll(text, nil)
+		return strings.TrimSpace(html.UnescapeString(string(text)))
+	}
+	return ""
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// helpBaseURL returns the URL at which the instance is being served to r,
+// including any path prefix of the canonical base URL.
+func (h *HTTPBin) helpBaseURL(r *http.Request) string {
+	if h.canonicalBaseURL != nil {
+		return strings.TrimSuffix(h.canonicalBaseURL.String(), "/")
+	}
+	u := getURL(r)
+	return u.Scheme + "://" + u.Host
+}
+
+// helpCurlCommand returns a curl command line making a request to u.
+func helpCurlCommand(method, u string) string {
+	if method == "GET" {
+		return fmt.Sprintf("curl -i '%s'", u)
+	}
+	return fmt.Sprintf("curl -i -X %s '%s'", method, u)
+}
+
+// renderHelp renders the description of an endpoint given by /help as HTML.
+func renderHelp(resp helpResponse) []byte {
+	var buf bytes.Buffer
+	usage := html.EscapeString(resp.Usage)
+	fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>go-httpbin: %s</title>\n</head>\n<body>\n", usage)
+	fmt.Fprintf(&buf, "<h1><code>%s</code></h1>\n<p>%s</p>\n", usage, html.EscapeString(resp.Description))
+	if len(resp.Methods) > 0 {
+		fmt.Fprintf(&buf, "<p>Methods: <code>%s</code></p>\n", html.EscapeString(strings.Join(resp.Methods, ", ")))
+	}
+	if len(resp.Params) > 0 {
+		buf.WriteString("<h2>Parameters</h2>\n<table>\n<tr><th>Name</th><th>In</th><th>Type</th><th>Default</th><th>Min</th><th>Max</th><th>Description</th></tr>\n")
+		for _, p := range resp.Params {
+			buf.WriteString("<tr>")
+			for _, v := range []string{p.Name, p.In, p.Type, p.Default, p.Min, p.Max, p.Description} {
+				fmt.Fprintf(&buf, "<td>%s</td>", html.EscapeString(v))
+			}
+			buf.WriteString("</tr>\n")
+		}
+		buf.WriteString("</table>\n")
+	}
+	if len(resp.Examples) > 0 {
+		buf.WriteString("<h2>Examples</h2>\n")
+		for _, e := range resp.Examples {
+			fmt.Fprintf(&buf, "<pre>%s</pre>\n", html.EscapeString(e))
+		}
+	}
+	fmt.Fprintf(&buf, "<h2>Instance limits</h2>\n<ul>\n<li>Max body size: %d bytes</li>\n<li>Max duration: %s</li>\n</ul>\n", resp.Limits.MaxBodySize, html.EscapeString(resp.Limits.MaxDuration))
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes()
+}
+
+// Defaults and limits for /page
+const (
+	defaultPageAssets  = 10
+	maxPageAssets      = 100
+	defaultPageSizes   = "5k-200k"
+	defaultPageLatency = "10-80ms"
+)
+
+// pageParams are the parameters shared by /page, /page/manifest, and
+// /page/asset/{id}, from which every asset of a page is derived.
+type pageParams struct {
+	assets     int
+	minSize    int64
+	maxSize    int64
+	minLatency time.Duration
+	maxLatency time.Duration
+	cacheable  string
+	seed       int64
+}
+
+// splitUnitRange splits a range like "5k-200k" or "10-80ms" into its lower
+// and upper bounds, giving a unitless lower bound the unit of the upper one,
+// so that "10-80ms" means 10ms to 80ms. A single value is both bounds.
+func splitUnitRange(raw string) (lo, hi string) {
+	i := strings.IndexByte(raw, '-')
+	if i <= 0 {
+		return raw, raw
+	}
+	lo, hi = raw[:i], raw[i+1:]
+	if strings.Trim(lo, "0123456789.") == "" {
+		lo += strings.TrimLeft(hi, "0123456789.")
+	}
+	return lo, hi
+}
+
+// parsePageParams parses and validates the /page query params, which bound
+// asset sizes by maxBodySize and asset latencies by maxDuration. A page
+// without a seed is given one based on the current time, which it passes on
+// to its asset URLs so that they agree with the page.
+func parsePageParams(q url.Values, maxBodySize int64, maxDuration time.Duration) (pageParams, error) {
+	var (
+		p   pageParams
+		err error
+	)
+
+	p.assets, err = parseBoundedInt(q.Get("assets"), defaultPageAssets, 1, maxPageAssets)
+	if err != nil {
+		return p, fmt.Errorf("invalid assets: %w", err)
+	}
+
+	rawSizes := q.Get("sizes")
+	if rawSizes == "" {
+		rawSizes = defaultPageSizes
+	}
+	lo, hi := splitUnitRange(rawSizes)
+	if p.minSize, err = parseByteSize(lo); err == nil {
+		p.maxSize, err = parseByteSize(hi)
+	}
+	if err != nil {
+		return p, fmt.Errorf("invalid sizes: %w", err)
+	}
+
+	rawLatency := q.Get("latency")
+	if rawLatency == "" {
+		rawLatency = defaultPageLatency
+	}
+	lo, hi = splitUnitRange(rawLatency)
+	if p.minLatency, err = parseDuration(lo); err == nil {
+		p.maxLatency, err = parseDuration(hi)
+	}
+	if err != nil {
+		return p, fmt.Errorf("invalid latency: %w", err)
+	}
+
+	// The defaults shrink to fit the instance's limits, but explicit ranges
+	// must fit within them
+	if q.Get("sizes") == "" && p.maxSize > maxBodySize {
+		p.maxSize = maxBodySize
+		if p.minSize > p.maxSize {
+			p.minSize = p.maxSize
+		}
+	}
+	if q.Get("latency") == "" && p.maxLatency > maxDuration {
+		p.maxLatency = maxDuration
+		if p.minLatency > p.maxLatency {
+			p.minLatency = p.maxLatency
+		}
+	}
+	switch {
+	case p.minSize > p.maxSize:
+		return p, fmt.Errorf("invalid sizes: minimum %d greater than maximum %d", p.minSize, p.maxSize)
+	case p.maxSize > maxBodySize:
+		return p, fmt.Errorf("invalid sizes: maximum %d greater than the limit of %d bytes", p.maxSize, maxBodySize)
+	case p.minLatency < 0:
+		return p, errors.New("invalid latency: must not be negative")
+	case p.minLatency > p.maxLatency:
+		return p, fmt.Errorf("invalid latency: minimum %s greater than maximum %s", p.minLatency, p.maxLatency)
+	case p.maxLatency > maxDuration:
+		return p, fmt.Errorf("invalid latency: maximum %s longer than %s", p.maxLatency, maxDuration)
+	}
+
+	p.cacheable = q.Get("cacheable")
+	switch p.cacheable {
+	case "":
+		p.cacheable = "all"
+	case "all", "half", "none":
+	default:
+		return p, fmt.Errorf("invalid cacheable %q: must be all, half, or none", p.cacheable)
+	}
+
+	if rawSeed := q.Get("seed"); rawSeed != "" {
+		p.seed, err = strconv.ParseInt(rawSeed, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid seed: %w", err)
+		}
+	} else {
+		p.seed = time.Now().UnixNano()
+	}
+	return p, nil
+}
+
+// query returns the query params that reproduce p.
+func (p pageParams) query() url.Values {
+	return url.Values{
+		"assets":    {strconv.Itoa(p.assets)},
+		"sizes":     {fmt.Sprintf("%d-%d", p.minSize, p.maxSize)},
+		"latency":   {fmt.Sprintf("%s-%s", p.minLatency, p.maxLatency)},
+		"cacheable": {p.cacheable},
+		"seed":      {strconv.FormatInt(p.seed, 10)},
+	}
+}
+
+// pageAssetKinds are the kinds of asset a page references, in rotation.
+var pageAssetKinds = []struct {
+	kind, contentType, prefix, suffix string
+}{
+	{"stylesheet", "text/css", "/*", "*/\n"},
+	{"script", "text/javascript", "/*", "*/\n"},
+	{"image", "image/svg+xml", `<svg xmlns="http://www.w3.org/2000/svg" width="1" height="1"><!--`, "--></svg>\n"},
+}
+
+// asset derives the asset with the given id from p. Each asset draws its
+// size and latency from its own random source, seeded by p's seed and its
+// id, so that it may be derived without deriving the others.
+func (p pageParams) asset(id int) pageAsset {
+	rng := rand.New(rand.NewSource(p.seed ^ int64(uint64(id+1)*0x9E3779B97F4A7C15)))
+	kind := pageAssetKinds[id%len(pageAssetKinds)]
+	return pageAsset{
+		ID:          id,
+		URL:         fmt.Sprintf("/page/asset/%d?%s", id, p.query().Encode()),
+		Kind:        kind.kind,
+		ContentType: kind.contentType,
+		Size:        p.minSize + rng.Int63n(p.maxSize-p.minSize+1),
+		LatencyMS:   float64(p.minLatency+time.Duration(rng.Int63n(int64(p.maxLatency-p.minLatency)+1))) / float64(time.Millisecond),
+		Cacheable:   p.cacheable == "all" || (p.cacheable == "half" && id%2 == 0),
+	}
+}
+
+// pageAssetBody returns a body of exactly a.Size bytes that is valid for the
+// asset's kind, as long as the size leaves room for the kind's markup.
+func pageAssetBody(a pageAsset) []byte {
+	kind := pageAssetKinds[a.ID%len(pageAssetKinds)]
+	body := make([]byte, 0, a.Size)
+	filler := a.Size
+	if wrap := int64(len(kind.prefix) + len(kind.suffix)); filler >= wrap {
+		body = append(body, kind.prefix...)
+		filler -= wrap
+	}
+	const pattern = "go-httpbin page asset "
+	for i := int64(0); i < filler; i++ {
+		body = append(body, pattern[i%int64(len(pattern))])
+	}
+	if int64(len(body)) < a.Size {
+		body = append(body, kind.suffix...)
+	}
+	return body
+}
+
+// renderPage returns an HTML page referencing the given assets.
+func renderPage(assets []pageAsset) []byte {
+	var head, body bytes.Buffer
+	for _, a := range assets {
+		u := html.EscapeString(a.URL)
+		switch a.Kind {
+		case "stylesheet":
+			fmt.Fprintf(&head, "<link rel=\"stylesheet\" href=\"%s\">\n", u)
+		case "script":
+			fmt.Fprintf(&body, "<script src=\"%s\" async></script>\n", u)
+		case "image":
+			fmt.Fprintf(&body, "<img src=\"%s\" alt=\"asset %d\" width=\"1\" height=\"1\">\n", u, a.ID)
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>go-httpbin page with %d assets</title>\n", len(assets))
+	buf.Write(head.Bytes())
+	fmt.Fprintf(&buf, "</head>\n<body>\n<h1>go-httpbin page with %d assets</h1>\n", len(assets))
+	buf.Write(body.Bytes())
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes()
+}
+
+// ValidateRedirectDomain returns an error if pattern cannot be used as an
+// AllowedRedirectDomains entry: it must be a host, optionally with a port,
+// which may start with "*." or "." to match subdomains. A bare "*", which
+// would allow every host, is rejected along with wildcards anywhere else.
+func ValidateRedirectDomain(pattern string) error {
+	host, _ := splitRedirectHost(pattern)
+	name := strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+	switch {
+	case name == "":
+		return fmt.Errorf("invalid redirect domain %q: must name a host", pattern)
+	case strings.Contains(name, "*"):
+		return fmt.Errorf("invalid redirect domain %q: wildcards are only allowed as a leading \"*.\"", pattern)
+	case strings.HasPrefix(host, "*") && !strings.HasPrefix(host, "*."):
+		return fmt.Errorf("invalid redirect domain %q: wildcards are only allowed as a leading \"*.\"", pattern)
+	case name != host && net.ParseIP(name) != nil:
+		return fmt.Errorf("invalid redirect domain %q: IP addresses have no subdomains", pattern)
+	}
+	return nil
+}
+
+// MatchRedirectDomain reports whether host, which may include a port,
+// matches an AllowedRedirectDomains pattern:
+//
+//   - "example.com" matches only example.com
+//   - "*.example.com" matches any subdomain of example.com, but not
+//     example.com itself
+//   - ".example.com" matches example.com and any of its subdomains
+//
+// Patterns without a port match host on any port, while patterns with one
+// match only that port. Matching ignores case and a trailing dot, and IP
+// addresses only match patterns for the same address. Internationalized
+// names are compared as given, so a Unicode pattern does not match the
+// punycode form of the same name.
+func MatchRedirectDomain(pattern, host string) bool {
+	patternHost, patternPort := splitRedirectHost(strings.ToLower(pattern))
+	name, port := splitRedirectHost(strings.ToLower(host))
+	if patternPort != "" && patternPort != port {
+		return false
+	}
+	name = strings.TrimSuffix(name, ".")
+	patternHost = strings.TrimSuffix(patternHost, ".")
+
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.Equal(net.ParseIP(patternHost))
+	}
+	switch {
+	case strings.HasPrefix(patternHost, "*."):
+		suffix := patternHost[1:]
+		return len(name) > len(suffix) && strings.HasSuffix(name, suffix)
+	case strings.HasPrefix(patternHost, "."):
+		return name == patternHost[1:] || strings.HasSuffix(name, patternHost)
+	default:
+		return name == patternHost
+	}
+}
+
+// splitRedirectHost splits a host with an optional port, which may be an
+// IPv6 literal with or without brackets.
+func splitRedirectHost(hostport string) (host, port string) {
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		return host, port
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), ""
+}
+
+// redirectDomainAllowed reports whether host matches any of the
+// AllowedRedirectDomains patterns.
+func (h *HTTPBin) redirectDomainAllowed(host string) bool {
+	for pattern := range h.AllowedRedirectDomains {
+		if MatchRedirectDomain(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultExpectContinueWait is how long /expect-continue-auth waits after an
+// auth challenge for a client to send the body it should have withheld.
+const defaultExpectContinueWait = 250 * time.Millisecond
+
+// Defaults and limits for images generated by /image/{format}
+const (
+	defaultImageDimension = 256
+	maxImageDimension     = 4096
+	imageCheckerSize      = 32
+)
+
+// imageEncoders maps the formats /image/{format} can generate at a requested
+// size to their encoders.
+var imageEncoders = map[string]func(io.Writer, image.Image) error{
+	"png": png.Encode,
+	"jpeg": func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, img, nil)
+	},
+}
+
+// generateImage draws a deterministic test pattern of the given size: a
+// red-green gradient across and down the image, overlaid with a checkerboard
+// of two shades of blue.
+func generateImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: 96,
+				A: 255,
+			}
+			if (x/imageCheckerSize+y/imageCheckerSize)%2 == 1 {
+				c.B = 160
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// imageContentTypes lists the content types /image can serve, in the order
+// of preference used to break ties between equally acceptable types.
+var imageContentTypes = []string{
+	"image/png",
+	"image/avif",
+	"image/webp",
+	"image/jpeg",
+	"image/svg+xml",
+}
+
+// imageKind returns the /image/{format} name of an image content type.
+func imageKind(contentType string) string {
+	if contentType == "image/svg+xml" {
+		return "svg"
+	}
+	return strings.TrimPrefix(contentType, "image/")
+}
+
+// mediaRange is a single media range from an Accept header, e.g. image/* or
+// text/html, with its quality value.
+type mediaRange struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+// parseAccept parses the media ranges in an Accept header, skipping any that
+// are malformed or have an invalid q-value. Ranges without a q-value have a
+// quality of 1.
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		typeParts := strings.Split(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if len(typeParts) != 2 || typeParts[0] == "" || typeParts[1] == "" || (typeParts[0] == "*" && typeParts[1] != "*") {
+			continue
+		}
+		mr := mediaRange{typ: typeParts[0], subtype: typeParts[1], q: 1}
+		valid := true
+		for _, param := range params[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "q") {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			if err != nil || q < 0 || q > 1 {
+				valid = false
+			}
+			mr.q = q
+			break
+		}
+		if valid {
+			ranges = append(ranges, mr)
+		}
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality the given media ranges assign to a
+// content type, taken from the most specific range that matches it, along
+// with that range's specificity: 2 for an exact match, 1 for type/* and 0
+// for */*. If no range matches, the specificity is -1.
+func acceptQuality(ranges []mediaRange, contentType string) (float64, int) {
+	typeParts := strings.SplitN(contentType, "/", 2)
+	typ, subtype := typeParts[0], typeParts[1]
+	q, specificity := 0.0, -1
+	for _, mr := range ranges {
+		s := -1
+		switch {
+		case mr.typ == typ && mr.subtype == subtype:
+			s = 2
+		case mr.typ == typ && mr.subtype == "*":
+			s = 1
+		case mr.typ == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = mr.q, s
+		}
+	}
+	return q, specificity
+}
+
+// negotiateContentType returns the offered content type with the highest
+// quality in the given Accept header, preferring those matched by more
+// specific media ranges and then those offered first, or an empty string if
+// none is acceptable. An empty Accept header accepts the first offer.
+func negotiateContentType(header string, offers []string) string {
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+	ranges := parseAccept(header)
+	best, bestQ, bestSpecificity := "", 0.0, -1
+	for _, offer := range offers {
+		q, specificity := acceptQuality(ranges, offer)
+		if q > bestQ || (q > 0 && q == bestQ && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+	return best
+}
+
+// maxByteRanges limits the number of ranges /range serves in a single
+// multipart/byteranges response.
+const maxByteRanges = 100
+
+// rangeContentType is the content type of the bytes served by /range.
+const rangeContentType = "text/plain; charset=utf-8"
+
+// byteRange is a satisfiable range of bytes from a Range header, with an
+// inclusive end.
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// parseByteRanges parses a Range header for a resource of the given size,
+// returning its satisfiable ranges in the order requested, without merging
+// overlapping ones. Ranges starting beyond the end of the resource are
+// dropped and ranges ending beyond it are truncated, per RFC 7233 section
+// 2.1.
+func parseByteRanges(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errors.New("invalid range unit")
+	}
+	var ranges []byteRange
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid range %q", spec)
+		}
+		first, last := spec[:i], spec[i+1:]
+		if first == "" {
+			// a suffix range, e.g. -500 for the last 500 bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid range %q", spec)
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ranges = append(ranges, byteRange{start: size - n, end: size - 1})
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid range %q", spec)
+		}
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid range %q", spec)
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, end: end})
+	}
+	return ranges, nil
+}
+
+// sumByteRanges returns the total number of bytes in the given ranges,
+// counting overlapping bytes once per range.
+func sumByteRanges(ranges []byteRange) int64 {
+	var total int64
+	for _, br := range ranges {
+		total += br.end - br.start + 1
+	}
+	return total
+}
+
+// isConditionalRequest reports whether r has any of the precondition
+// headers that http.ServeContent evaluates before serving ranges.
+func isConditionalRequest(r *http.Request) bool {
+	for _, key := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"} {
+		if r.Header.Get(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// multipartByteRanges renders the given ranges of a resource of the given
+// size and content type as a multipart/byteranges body, per RFC 7233
+// appendix A, returning the body and its content type, which carries a
+// random boundary.
+func multipartByteRanges(ranges []byteRange, size int64, contentType string, factory func(int64) byte) ([]byte, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, br := range ranges {
+		part, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)},
+			"Content-Type":  {contentType},
+		})
+		chunk := make([]byte, 0, br.end-br.start+1)
+		for offset := br.start; offset <= br.end; offset++ {
+			chunk = append(chunk, factory(offset))
+		}
+		part.Write(chunk)
+	}
+	mw.Close()
+	return buf.Bytes(), "multipart/byteranges; boundary=" + mw.Boundary()
+}
+
+// Content patterns that /bytes and /stream-bytes may generate
+const (
+	bytesPatternRandom = "random"
+	bytesPatternZero   = "zero"
+	bytesPatternText   = "text"
+	bytesPatternCycle  = "cycle"
+)
+
+// bytesPatternLorem is the ASCII text repeated by the text pattern of /bytes
+// and /stream-bytes.
+const bytesPatternLorem = "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. "
+
+// bytesPatternGenerator returns a function generating the byte at each
+// offset, called in order from 0, of the given /bytes content pattern. Only
+// the random pattern uses the seed.
+func bytesPatternGenerator(pattern string, seed int64) (func(int) byte, error) {
+	switch pattern {
+	case bytesPatternRandom:
+		rng := rand.New(rand.NewSource(seed))
+		return func(int) byte { return byte(rng.Intn(256)) }, nil
+	case bytesPatternZero:
+		return func(int) byte { return 0 }, nil
+	case bytesPatternText:
+		return func(i int) byte { return bytesPatternLorem[i%len(bytesPatternLorem)] }, nil
+	case bytesPatternCycle:
+		return func(i int) byte { return byte(i) }, nil
+	}
+	return nil, fmt.Errorf("must be one of %s, %s, %s or %s", bytesPatternRandom, bytesPatternZero, bytesPatternText, bytesPatternCycle)
 }
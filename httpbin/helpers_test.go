@@ -1,9 +1,14 @@
 package httpbin
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"testing"
 	"time"
@@ -215,3 +220,486 @@ func Test_getClientIP(t *testing.T) {
 		})
 	}
 }
+
+func TestApplyJSONPatch(t *testing.T) {
+	t.Parallel()
+
+	// Most cases are taken from the examples in RFC 6902 Appendix A
+	testCases := map[string]struct {
+		doc      string
+		patch    string
+		want     string
+		conflict bool
+	}{
+		"add object member": {
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/baz","value":"qux"}]`,
+			want:  `{"baz":"qux","foo":"bar"}`,
+		},
+		"add array element": {
+			doc:   `{"foo":["bar","baz"]}`,
+			patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			want:  `{"foo":["bar","qux","baz"]}`,
+		},
+		"add appends with dash": {
+			doc:   `{"foo":["bar"]}`,
+			patch: `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			want:  `{"foo":["bar",["abc","def"]]}`,
+		},
+		"add replaces existing member": {
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/foo","value":null}]`,
+			want:  `{"foo":null}`,
+		},
+		"add nested member": {
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			want:  `{"foo":"bar","child":{"grandchild":{}}}`,
+		},
+		"add to nonexistent target": {
+			doc:      `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+			conflict: true,
+		},
+		"add past end of array": {
+			doc:      `{"foo":["bar"]}`,
+			patch:    `[{"op":"add","path":"/foo/2","value":"qux"}]`,
+			conflict: true,
+		},
+		"add with leading zero index": {
+			doc:      `{"foo":["bar","baz"]}`,
+			patch:    `[{"op":"add","path":"/foo/01","value":"qux"}]`,
+			conflict: true,
+		},
+		"add whole document": {
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"add","path":"","value":[1,2]}]`,
+			want:  `[1,2]`,
+		},
+		"remove object member": {
+			doc:   `{"baz":"qux","foo":"bar"}`,
+			patch: `[{"op":"remove","path":"/baz"}]`,
+			want:  `{"foo":"bar"}`,
+		},
+		"remove array element": {
+			doc:   `{"foo":["bar","qux","baz"]}`,
+			patch: `[{"op":"remove","path":"/foo/1"}]`,
+			want:  `{"foo":["bar","baz"]}`,
+		},
+		"remove missing member": {
+			doc:      `{"foo":"bar"}`,
+			patch:    `[{"op":"remove","path":"/baz"}]`,
+			conflict: true,
+		},
+		"replace value": {
+			doc:   `{"baz":"qux","foo":"bar"}`,
+			patch: `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			want:  `{"baz":"boo","foo":"bar"}`,
+		},
+		"replace last array element": {
+			doc:   `{"foo":[1,2]}`,
+			patch: `[{"op":"replace","path":"/foo/1","value":3}]`,
+			want:  `{"foo":[1,3]}`,
+		},
+		"replace whole document": {
+			doc:   `{"foo":"bar"}`,
+			patch: `[{"op":"replace","path":"","value":{"baz":1}}]`,
+			want:  `{"baz":1}`,
+		},
+		"replace missing member": {
+			doc:      `{"foo":"bar"}`,
+			patch:    `[{"op":"replace","path":"/baz","value":"boo"}]`,
+			conflict: true,
+		},
+		"move value": {
+			doc:   `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			want:  `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		"move array element": {
+			doc:   `{"foo":["all","grass","cows","eat"]}`,
+			patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			want:  `{"foo":["all","cows","eat","grass"]}`,
+		},
+		"move missing value": {
+			doc:      `{"foo":"bar"}`,
+			patch:    `[{"op":"move","from":"/baz","path":"/qux"}]`,
+			conflict: true,
+		},
+		"copy value": {
+			doc:   `{"foo":{"bar":[1]}}`,
+			patch: `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"add","path":"/baz/bar/-","value":2}]`,
+			want:  `{"foo":{"bar":[1]},"baz":{"bar":[1,2]}}`,
+		},
+		"test success": {
+			doc:   `{"baz":"qux","foo":["a",2,"c"]}`,
+			patch: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			want:  `{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		"test failure": {
+			doc:      `{"baz":"qux"}`,
+			patch:    `[{"op":"test","path":"/baz","value":"bar"}]`,
+			conflict: true,
+		},
+		"test compares numbers by value": {
+			doc:   `{"n":1}`,
+			patch: `[{"op":"test","path":"/n","value":1.0}]`,
+			want:  `{"n":1}`,
+		},
+		"test null": {
+			doc:   `{"foo":null}`,
+			patch: `[{"op":"test","path":"/foo","value":null}]`,
+			want:  `{"foo":null}`,
+		},
+		"test escaped pointer": {
+			doc:   `{"/":9,"~1":10}`,
+			patch: `[{"op":"test","path":"/~01","value":10},{"op":"test","path":"/~1","value":9}]`,
+			want:  `{"/":9,"~1":10}`,
+		},
+		"test missing value": {
+			doc:      `{"foo":"bar"}`,
+			patch:    `[{"op":"test","path":"/baz","value":null}]`,
+			conflict: true,
+		},
+		"index into scalar": {
+			doc:      `{"foo":"bar"}`,
+			patch:    `[{"op":"add","path":"/foo/bar","value":1}]`,
+			conflict: true,
+		},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var doc, want interface{}
+			assertNil(t, json.Unmarshal([]byte(tc.doc), &doc))
+			ops, err := parseJSONPatch([]byte(tc.patch))
+			assertNil(t, err)
+
+			got, err := applyJSONPatch(doc, ops)
+			if tc.conflict {
+				if !errors.Is(err, errPatchConflict) {
+					t.Fatalf("expected conflict error, got %v", err)
+				}
+				return
+			}
+			assertNil(t, err)
+			assertNil(t, json.Unmarshal([]byte(tc.want), &want))
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected %#v, got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestParseJSONPatch(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]string{
+		"not json":              `[`,
+		"not an array":          `{"op":"add","path":"/foo","value":1}`,
+		"unknown op":            `[{"op":"frobnicate","path":"/foo"}]`,
+		"missing op":            `[{"path":"/foo"}]`,
+		"missing value":         `[{"op":"add","path":"/foo"}]`,
+		"relative path":         `[{"op":"remove","path":"foo"}]`,
+		"bad escape":            `[{"op":"remove","path":"/foo~2"}]`,
+		"missing from":          `[{"op":"copy","path":"/foo"}]`,
+		"move into own child":   `[{"op":"move","from":"/foo","path":"/foo/bar"}]`,
+		"second op is invalid":  `[{"op":"remove","path":"/foo"},{"op":"test","path":"/bar"}]`,
+		"trailing tilde escape": `[{"op":"remove","path":"/foo~"}]`,
+	}
+	for name, patch := range testCases {
+		patch := patch
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := parseJSONPatch([]byte(patch)); err == nil {
+				t.Fatalf("expected error parsing %s", patch)
+			}
+		})
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	t.Parallel()
+
+	// Test cases taken from RFC 7386 Appendix A
+	testCases := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.doc+" + "+tc.patch, func(t *testing.T) {
+			t.Parallel()
+			var doc, patch, want interface{}
+			assertNil(t, json.Unmarshal([]byte(tc.doc), &doc))
+			assertNil(t, json.Unmarshal([]byte(tc.patch), &patch))
+			assertNil(t, json.Unmarshal([]byte(tc.want), &want))
+			if got := applyMergePatch(doc, patch); !reflect.DeepEqual(got, want) {
+				t.Fatalf("expected %#v, got %#v", want, got)
+			}
+		})
+	}
+}
+
+func TestResponseMarshalersMatchDefaultEncoding(t *testing.T) {
+	t.Parallel()
+
+	// Method-less copies of the response types, to get the default encoding
+	type plainNoBodyResponse noBodyResponse
+	type plainHeadersResponse headersResponse
+
+	encode := func(v interface{}) string {
+		w := httptest.NewRecorder()
+		writeJSON(http.StatusOK, w, v)
+		return w.Body.String()
+	}
+
+	valueSets := map[string]map[string][]string{
+		"nil":          nil,
+		"empty":        {},
+		"single":       {"Foo": {"bar"}},
+		"multi":        {"b": {"1", "2"}, "a": {""}, "c": {}, "d": nil, "Z": {"z"}},
+		"html":         {"q": {"<a href=\"x\">&</a>"}},
+		"escapes":      {"k": {"tab\there", "nl\n", "back\\slash", "\b\f\x00\x7f"}},
+		"unicode":      {"é": {"ü", "  "}, "e": {"x"}, "日本": {"語"}},
+		"invalid utf8": {"k": {"\xff\xfe"}},
+		"many keys": func() map[string][]string {
+			m := map[string][]string{}
+			for i := 0; i < 50; i++ {
+				m[fmt.Sprintf("key-%02d", 49-i)] = []string{fmt.Sprint(i)}
+			}
+			return m
+		}(),
+	}
+	for name, values := range valueSets {
+		values := values
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for _, resp := range []noBodyResponse{
+				{Args: url.Values(values), Headers: http.Header(values), Origin: "192.0.2.1", URL: "http://example.com/get?x=<y>"},
+				{Headers: http.Header(values), Origin: "\"quoted\"", URL: "é", Deflated: true},
+				{Args: url.Values{}, Headers: http.Header(values), Gzipped: true},
+				{Args: url.Values{}, Headers: http.Header(values), Zstd: true},
+				{Args: url.Values(values), Headers: http.Header(values), URLLength: 1234},
+				{Args: url.Values(values), Proto: "HTTP/2.0", Route: "/get", TLS: &tlsInfo{Version: "TLS 1.3", CipherSuite: "TLS_AES_128_GCM_SHA256", ALPN: "h2", ServerName: "<é>"}},
+			} {
+				if got, want := encode(resp), encode(plainNoBodyResponse(resp)); got != want {
+					t.Errorf("noBodyResponse encoding mismatch\ngot:  %s\nwant: %s", got, want)
+				}
+				if got, want := encode(&resp), encode(plainNoBodyResponse(resp)); got != want {
+					t.Errorf("*noBodyResponse encoding mismatch\ngot:  %s\nwant: %s", got, want)
+				}
+			}
+			resp := headersResponse{Headers: http.Header(values)}
+			if got, want := encode(resp), encode(plainHeadersResponse(resp)); got != want {
+				t.Errorf("headersResponse encoding mismatch\ngot:  %s\nwant: %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSampleDelay(t *testing.T) {
+	t.Parallel()
+	base, jitter := 100*time.Millisecond, 10*time.Millisecond
+	for distribution := range delayJitterSpread {
+		distribution := distribution
+		t.Run(distribution, func(t *testing.T) {
+			t.Parallel()
+			max := maxJitteredDelay(distribution, base, jitter)
+			min := base - (max - base)
+			if distribution == delayDistributionExponential {
+				min = base
+			}
+			rng := rand.New(rand.NewSource(1))
+			var sum time.Duration
+			const n = 10000
+			for i := 0; i < n; i++ {
+				d := sampleDelay(rng, distribution, base, jitter)
+				if d < min || d > max {
+					t.Fatalf("sample %s outside [%s, %s]", d, min, max)
+				}
+				sum += d
+			}
+			wantMean := base
+			if distribution == delayDistributionExponential {
+				wantMean = base + jitter
+			}
+			if mean := sum / n; mean < wantMean-time.Millisecond || mean > wantMean+time.Millisecond {
+				t.Errorf("expected mean near %s, got %s", wantMean, mean)
+			}
+		})
+	}
+
+	t.Run("never negative", func(t *testing.T) {
+		t.Parallel()
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 1000; i++ {
+			if d := sampleDelay(rng, delayDistributionNormal, 0, time.Second); d < 0 {
+				t.Fatalf("expected non-negative sample, got %s", d)
+			}
+		}
+	})
+}
+
+func TestReflectHeaders(t *testing.T) {
+	t.Parallel()
+
+	hdr := http.Header{
+		"X-Foo": {"bar", "baz"}, // 2 * len("X-Foo: bar\r\n") = 24
+		"Etag":  {`"abc"`},      // len("Etag: \"abc\"\r\n") = 13
+	}
+	assertIntEqual(t, reflectedHeaderSize(hdr), 37)
+	assertIntEqual(t, reflectedHeaderSize(nil), 0)
+
+	for _, tc := range []struct {
+		limit    int
+		wantOK   bool
+		wantCode int
+	}{
+		{0, true, http.StatusOK},
+		{37, true, http.StatusOK},
+		{36, false, http.StatusBadRequest},
+	} {
+		h := New(WithMaxReflectedHeaderBytes(tc.limit))
+		w := httptest.NewRecorder()
+		if ok := h.reflectHeaders(w, hdr); ok != tc.wantOK {
+			t.Fatalf("limit %d: expected ok=%v, got %v", tc.limit, tc.wantOK, ok)
+		}
+		if w.Code != tc.wantCode {
+			t.Fatalf("limit %d: expected status %d, got %d", tc.limit, tc.wantCode, w.Code)
+		}
+		if tc.wantOK {
+			if got := w.Header().Values("X-Foo"); !reflect.DeepEqual(got, []string{"bar", "baz"}) {
+				t.Fatalf("limit %d: expected reflected X-Foo header, got %q", tc.limit, got)
+			}
+			continue
+		}
+		if w.Header().Get("X-Foo") != "" || w.Header().Get("Etag") != "" {
+			t.Fatalf("limit %d: expected no reflected headers, got %v", tc.limit, w.Header())
+		}
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if want := "reflected response headers total 37 bytes, exceeding the limit of 36 bytes"; resp.Detail != want {
+			t.Fatalf("expected detail %q, got %q", want, resp.Detail)
+		}
+	}
+
+	t.Run("cookies", func(t *testing.T) {
+		t.Parallel()
+		h := New(WithMaxReflectedHeaderBytes(40))
+		w := httptest.NewRecorder()
+		ok := h.reflectCookies(w, []*http.Cookie{
+			{Name: "k", Value: "v", HttpOnly: true}, // "Set-Cookie: k=v; HttpOnly\r\n" = 27
+			{Name: "", Value: "invalid"},            // skipped, like http.SetCookie
+		})
+		if !ok {
+			t.Fatalf("expected cookies within budget, got %d %s", w.Code, w.Body.String())
+		}
+		if got := w.Header().Values("Set-Cookie"); !reflect.DeepEqual(got, []string{"k=v; HttpOnly"}) {
+			t.Fatalf("unexpected Set-Cookie headers %q", got)
+		}
+
+		w = httptest.NewRecorder()
+		if h.reflectCookies(w, []*http.Cookie{{Name: "k", Value: "v"}, {Name: "k2", Value: "v2"}, {Name: "k3", Value: "v3"}}) {
+			t.Fatalf("expected cookies over budget to be rejected")
+		}
+		assertIntEqual(t, w.Code, http.StatusBadRequest)
+	})
+}
+
+func TestMatchRedirectDomain(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"example.com", "example.com.", true},
+		{"example.com", "www.example.com", false},
+		{"example.com", "example.com:8080", true},
+		{"example.com:8443", "example.com:8443", true},
+		{"example.com:8443", "example.com:8080", false},
+		{"example.com:8443", "example.com", false},
+
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "www.example.com:443", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{"*.example.com", "example.com.evil.com", false},
+
+		{".example.com", "example.com", true},
+		{".example.com", "www.example.com", true},
+		{".example.com", "badexample.com", false},
+
+		// IDNs are compared in the form given
+		{"*.bücher.example", "www.bücher.example", true},
+		{"bücher.example", "BÜCHER.example", true},
+		{"bücher.example", "xn--bcher-kva.example", false},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", true},
+
+		// IP literals only match the same address
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.1:8080", true},
+		{"192.0.2.1", "192.0.2.10", false},
+		{".0.2.1", "192.0.2.1", false},
+		{"::1", "[::1]:8080", true},
+		{"[::1]", "[0:0::1]", true},
+		{"[::1]:8080", "[::1]:9090", false},
+	} {
+		if got := MatchRedirectDomain(tc.pattern, tc.host); got != tc.want {
+			t.Errorf("MatchRedirectDomain(%q, %q) = %v, want %v", tc.pattern, tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestValidateRedirectDomain(t *testing.T) {
+	t.Parallel()
+	for _, pattern := range []string{"example.com", "*.example.com", ".example.com", "example.com:8443", "192.0.2.1", "[::1]:80", "bücher.example"} {
+		if err := ValidateRedirectDomain(pattern); err != nil {
+			t.Errorf("ValidateRedirectDomain(%q) = %s, want nil", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"", "*", "*.", ".", "*example.com", "www.*.example.com", "*.*.example.com", "*.192.0.2.1", ":8080"} {
+		if err := ValidateRedirectDomain(pattern); err == nil {
+			t.Errorf("ValidateRedirectDomain(%q) = nil, want error", pattern)
+		}
+	}
+}
+
+func TestAsJWTError(t *testing.T) {
+	t.Parallel()
+
+	expired := &jwtError{jwtExpired, "token expired"}
+	for _, tc := range []struct {
+		err  error
+		want *jwtError
+	}{
+		{expired, expired},
+		{fmt.Errorf("verifying token: %w", expired), expired},
+		{errors.New("unexpected failure"), &jwtError{jwtInvalid, "token is invalid"}},
+	} {
+		if got := asJWTError(tc.err); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("asJWTError(%q) = %#v, want %#v", tc.err, got, tc.want)
+		}
+	}
+}
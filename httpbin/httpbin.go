@@ -1,8 +1,21 @@
 package httpbin
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/mccutchen/go-httpbin/v2/httpbin/digest"
 )
 
 // Default configuration values
@@ -10,6 +23,8 @@ const (
 	DefaultMaxBodySize int64 = 1024 * 1024
 	DefaultMaxDuration       = 10 * time.Second
 	DefaultHostname          = "go-httpbin"
+
+	DefaultMaxEgressConcurrency = 10
 )
 
 // DefaultParams defines default parameter values
@@ -27,6 +42,12 @@ var DefaultDefaultParams = DefaultParams{
 	DripNumBytes: 10,
 }
 
+// runtimeSettings holds the subset of an HTTPBin instance's configuration
+// that may be changed at runtime via the /admin API.
+type runtimeSettings struct {
+	DefaultParams DefaultParams
+}
+
 // HTTPBin contains the business logic
 type HTTPBin struct {
 	// Max size of an incoming request generated response body, in bytes
@@ -39,15 +60,175 @@ type HTTPBin struct {
 	// Observer called with the result of each handled request
 	Observer Observer
 
-	// Default parameter values
+	// Default parameter values. Once they are changed via the /admin API,
+	// later changes to this field have no effect.
 	DefaultParams DefaultParams
 
-	// Set of hosts to which the /redirect-to endpoint will allow redirects
+	// Set of host patterns to which the /redirect-to endpoint will allow
+	// redirects, matched by MatchRedirectDomain
 	AllowedRedirectDomains map[string]struct{}
 
 	// The hostname to expose via /hostname.
 	hostname string
 
+	// Token required to use the /admin API, which is only enabled when a
+	// token is configured
+	adminToken string
+
+	// The runtimeSettings set via the /admin API, if any, which take
+	// precedence over the exported fields. Writers must hold settingsMu.
+	settings   atomic.Value
+	settingsMu sync.Mutex
+
+	// Functions that clear the instance's stateful stores, called by
+	// POST /admin/reset
+	resetters []func()
+
+	// Token required to run /selftest, which is only enabled when a token is
+	// configured
+	selfTestToken string
+
+	// Base URL at which this instance is publicly reachable, used to build
+	// Content-Location and canonical Link headers. Its path is the prefix at
+	// which the instance is mounted.
+	canonicalBaseURL *url.URL
+
+	// Key used to sign and verify /signed URLs. The /sign and /signed
+	// endpoints are only enabled when a key is configured.
+	signedURLKey []byte
+
+	// Maximum clock skew tolerance a client may request when verifying a
+	// signed URL via the ?skew= query param.
+	signedURLMaxSkew time.Duration
+
+	// Whether to report the phases of request handling via the Server-Timing
+	// response header
+	serverTiming bool
+
+	// Whether to report load signals (in-flight requests and queue wait time)
+	// via response headers
+	loadSignals bool
+
+	// Number of requests currently being handled, tracked when load signals
+	// are enabled
+	inflight int64
+
+	// Limits the number of concurrent outbound requests made by /egress
+	egressSem chan struct{}
+
+	// Decides whether /egress may connect to a resolved IP address,
+	// overridable in tests
+	egressAllowIP func(net.IP) bool
+
+	// Resolves hostnames for /resolve, overridable in tests
+	resolver hostResolver
+
+	// Sequence number of the most recently accepted connection, see
+	// ConnContext
+	connSeq int64
+
+	// Whether to report the error class of 5xx responses in an X-Error-Class
+	// header
+	errorClassHeader bool
+
+	// Whether JSON responses are rendered in canonical form unless a request
+	// asks otherwise via ?canonical=false
+	canonicalJSON bool
+
+	// Whether to report request arrival, handler, and write timing
+	requestTiming bool
+
+	// Server and X-Powered-By headers added to every response, where a nil
+	// value suppresses the header
+	identityHeaders http.Header
+
+	// Maximum total size of response headers reflected from client input, or
+	// zero for no limit
+	maxReflectedHeaderBytes int
+
+	// Prefixes of the names of the environment variables exposed by /env
+	envPrefixes []string
+
+	// Maximum length of a request's URL, as sent by the client, or zero for
+	// no limit
+	maxURLLength int
+
+	// Routes with any of these tags are disabled
+	excludedTags map[string]bool
+
+	// How long /dualstack delays its responses over each address family
+	familyDelays map[string]time.Duration
+
+	// Issuer identifier of the OIDC simulator, which is only enabled when an
+	// issuer is configured, and the keys with which it signs tokens
+	oidcIssuer string
+	oidcKeys   *oidcKeySet
+
+	// Methods allowed by each route pattern given to WithMethodPolicy,
+	// overriding the defaults, and any problems with those options, which
+	// are reported when New validates them
+	methodPolicies   map[string][]string
+	methodPolicyErrs []error
+
+	// Certificate authorities used to verify client certificates, or nil to
+	// use the system roots, and the route patterns that require one
+	clientCAs    *x509.CertPool
+	mtlsRequired []string
+
+	// Decides whether each request is reported as sampled for tracing, or
+	// nil if sampling decisions are not reported
+	traceDecision func(*http.Request) bool
+
+	// Per-route traffic reported by /stats
+	traffic *routeTraffic
+
+	// Size of the queue used to deliver results to the Observer from a
+	// separate goroutine, or 0 to call it synchronously, and the resulting
+	// asynchronous observer
+	asyncObserverBuffer int
+	asyncObserver       *asyncObserver
+
+	// Request counts and latencies exposed at /metrics, or nil if the
+	// endpoint is disabled
+	metrics *requestMetrics
+
+	// Request counters used by /cache/sequence
+	cacheSequences *keyCounters
+
+	// Request counters used by /unstable?pattern=
+	unstableCounters *keyCounters
+
+	// Attempt counters used by /retry
+	retryCounters *keyCounters
+
+	// Entries of the shared cache emulated by /cdn-sim
+	cdnSim *cdnSimCache
+
+	// Documents modified by /patch-target
+	patchTargets *patchTargets
+
+	// Channels used by /fanout
+	fanout *fanoutBroker
+
+	// In-flight computations shared by concurrent /coalesce requests
+	coalescer *coalescer
+
+	// Key used to sign /paginate cursors so that tampering is detectable
+	paginationKey []byte
+
+	// Key used to sign /digest-auth nonces, random unless configured so
+	// that replicas may share it
+	digestNonceKey []byte
+
+	// Issues and verifies the signed nonces used by /digest-auth
+	digestAuth *digest.Authenticator
+
+	// Returns the current time, overridable in tests
+	now func() time.Time
+
+	// Returns a random number in [0, 1), overridable in tests
+	randFloat func() float64
+
 	// The app's http handler
 	handler http.Handler
 }
@@ -59,121 +240,650 @@ func New(opts ...OptionFunc) *HTTPBin {
 		MaxDuration:   DefaultMaxDuration,
 		DefaultParams: DefaultDefaultParams,
 		hostname:      DefaultHostname,
+		egressAllowIP: isPublicIP,
+		resolver:      net.DefaultResolver,
+		paginationKey: randomKey(),
+		now:           time.Now,
+		randFloat:     rand.Float64,
 	}
 	for _, opt := range opts {
 		opt(h)
 	}
+	if err := h.validateMethodPolicies(); err != nil {
+		panic("httpbin: " + err.Error())
+	}
+	h.fanout = newFanoutBroker(func() time.Time { return h.now() })
+	h.resetters = append(h.resetters, h.fanout.reset)
+	h.cacheSequences = newKeyCounters(func() time.Time { return h.now() })
+	h.resetters = append(h.resetters, h.cacheSequences.reset)
+	h.unstableCounters = newKeyCounters(func() time.Time { return h.now() })
+	h.resetters = append(h.resetters, h.unstableCounters.reset)
+	h.retryCounters = newKeyCounters(func() time.Time { return h.now() })
+	h.resetters = append(h.resetters, h.retryCounters.reset)
+	h.cdnSim = newCDNSimCache(func() time.Time { return h.now() })
+	h.resetters = append(h.resetters, h.cdnSim.reset)
+	h.patchTargets = newPatchTargets(func() time.Time { return h.now() })
+	h.resetters = append(h.resetters, h.patchTargets.reset)
+	h.coalescer = newCoalescer()
+	if h.digestNonceKey == nil {
+		h.digestNonceKey = randomKey()
+	}
+	h.digestAuth = digest.NewAuthenticator(h.digestNonceKey, func() time.Time { return h.now() })
+	if h.egressSem == nil {
+		h.egressSem = make(chan struct{}, DefaultMaxEgressConcurrency)
+	}
+	h.traffic = newRouteTraffic(h.routes())
+	h.resetters = append(h.resetters, h.traffic.reset)
+	if h.Observer != nil && h.asyncObserverBuffer > 0 {
+		h.asyncObserver = newAsyncObserver(h.Observer, h.asyncObserverBuffer)
+		h.resetters = append(h.resetters, h.asyncObserver.reset)
+	}
+	if h.metrics != nil {
+		h.resetters = append(h.resetters, h.metrics.reset)
+	}
 	h.handler = h.Handler()
 	return h
 }
 
+// Validate returns an error describing the first problem with the given
+// options that would make New panic, if any, so that options built from user
+// input can be reported rather than crashing. Options that panic when they
+// are created, like WithExcludedTags, must be checked before calling them.
+func Validate(opts ...OptionFunc) error {
+	h := &HTTPBin{}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h.validateMethodPolicies()
+}
+
+// Close stops the goroutine delivering results to an Observer configured via
+// WithAsyncObserver, once every result already queued has been delivered.
+// The results of requests handled after Close are dropped, so servers should
+// be shut down first. Close may be called more than once, and does nothing
+// for instances whose Observer is called synchronously.
+func (h *HTTPBin) Close() error {
+	if h.asyncObserver != nil {
+		h.asyncObserver.close()
+	}
+	return nil
+}
+
 // ServeHTTP implememnts the http.Handler interface.
 func (h *HTTPBin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.handler.ServeHTTP(w, r)
 }
 
+// ConnContext may be used as an http.Server's ConnContext hook to give
+// HTTPBin visibility into the underlying connection of each request, which is
+// required by connection-aware endpoints like /churn:
+//
+//	srv := &http.Server{
+//		Handler:     app,
+//		ConnContext: app.ConnContext,
+//	}
+func (h *HTTPBin) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, &connInfo{
+		id:       atomic.AddInt64(&h.connSeq, 1),
+		accepted: time.Now(),
+	})
+}
+
+// ListenerContext returns a hook for an http.Server's BaseContext that names
+// the listener each request arrived on, which /dualstack reports. Servers
+// listening separately for IPv4 and IPv6 can use it to tell clients which of
+// them handled a request:
+//
+//	srv4 := &http.Server{
+//		Handler:     app,
+//		BaseContext: app.ListenerContext("ipv4"),
+//	}
+func (h *HTTPBin) ListenerContext(name string) func(net.Listener) context.Context {
+	return func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), listenerNameKey{}, name)
+	}
+}
+
+// TLSConfig returns a TLS config for an http.Server that requests, but does
+// not require, a client certificate, and fails the handshake if one is
+// presented that cannot be verified against the CAs given to WithClientCAs.
+// Clients without a certificate may still use routes other than those given
+// to WithMTLSRequired. The server's own certificate must be added by the
+// caller, e.g. via ListenAndServeTLS:
+//
+//	srv := &http.Server{
+//		Handler:   app,
+//		TLSConfig: app.TLSConfig(),
+//	}
+//	srv.ListenAndServeTLS(certFile, keyFile)
+func (h *HTTPBin) TLSConfig() *tls.Config {
+	return &tls.Config{
+		ClientAuth: tls.RequestClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return nil
+			}
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			return h.verifyClientCert(certs)
+		},
+	}
+}
+
+// verifyClientCert verifies a client's certificate chain, leaf first,
+// against the instance's client CAs.
+func (h *HTTPBin) verifyClientCert(certs []*x509.Certificate) error {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         h.clientCAs,
+		Intermediates: intermediates,
+		CurrentTime:   h.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// currentSettings returns a snapshot of the instance's runtime settings:
+// those last set via the /admin API or, until then, the exported fields.
+func (h *HTTPBin) currentSettings() *runtimeSettings {
+	if settings, ok := h.settings.Load().(*runtimeSettings); ok {
+		return settings
+	}
+	return &runtimeSettings{DefaultParams: h.DefaultParams}
+}
+
 // Assert that HTTPBin implements http.Handler interface
 var _ http.Handler = &HTTPBin{}
 
+// route describes a single endpoint exposed by HTTPBin.
+type route struct {
+	// The ServeMux pattern the endpoint is registered under
+	pattern string
+
+	// A human-readable description of the URL form the endpoint expects,
+	// e.g. "/delay/{duration}". Defaults to the pattern.
+	usage string
+
+	// The HTTP methods the endpoint allows, or nil if it allows any method.
+	// GET implies support for HEAD, unless exactMethods is set because the
+	// methods were overridden by WithMethodPolicy.
+	methods      []string
+	exactMethods bool
+
+	// A representative request path used by /selftest and ExampleRequests to
+	// exercise the endpoint, along with the status it is expected to respond
+	// with (defaulting to 200). Endpoints without an example are not
+	// exercised.
+	example       string
+	exampleStatus int
+
+	// Headers the preflight middleware adds when answering OPTIONS requests
+	// for the endpoint's exact path, beyond the CORS headers it always sets
+	optionsHeaders http.Header
+
+	// Categories the endpoint belongs to, drawn from routeTags, by which
+	// the index may be filtered and whole categories disabled via
+	// WithExcludedTags
+	tags []string
+
+	handler http.HandlerFunc
+}
+
+// ExampleRequest is a canonical request for one of HTTPBin's endpoints,
+// along with the status a healthy instance responds to it with.
+type ExampleRequest struct {
+	// The ServeMux pattern of the endpoint, e.g. "/status/"
+	Route string
+	// The request method, e.g. "GET"
+	Method string
+	// The request path and query, relative to the instance's base URL
+	Path string
+	// The expected response status
+	ExpectedStatus int
+}
+
+// ExampleRequests returns one canonical request for each endpoint that has
+// one, in route table order. The same requests are made by /selftest.
+//
+// Endpoints that are only enabled by options (e.g. /sign) are included, so a
+// remote instance without those options enabled will respond to their example
+// requests with 404 Not Found.
+func ExampleRequests() []ExampleRequest {
+	h := New(WithSignedURLKey("example", 0), WithAdminAPI("example"), WithSelfTestToken("example"))
+	return h.exampleRequests()
+}
+
+func (h *HTTPBin) exampleRequests() []ExampleRequest {
+	var examples []ExampleRequest
+	for _, rt := range h.routes() {
+		if rt.example == "" {
+			continue
+		}
+		method := "GET"
+		if rt.methods != nil {
+			method = rt.methods[0]
+		}
+		expected := rt.exampleStatus
+		if expected == 0 {
+			expected = http.StatusOK
+		}
+		examples = append(examples, ExampleRequest{
+			Route:          rt.pattern,
+			Method:         method,
+			Path:           rt.example,
+			ExpectedStatus: expected,
+		})
+	}
+	return examples
+}
+
+// routeTags describes the tags that may be given to routes.
+var routeTags = map[string]string{
+	"auth":               "Requires or simulates authentication",
+	"caching":            "Exercises HTTP caching and conditional requests",
+	"chaos":              "Injects latency, failures, or misbehavior",
+	"cookies":            "Reads or sets cookies",
+	"destructive":        "Changes state shared by every client of the instance",
+	"dynamic-data":       "Generates data from request parameters",
+	"formats":            "Serves a particular content type or encoding",
+	"hijacks-connection": "Takes over the underlying connection, e.g. to write raw HTTP/1.x",
+	"inspection":         "Reflects the request back to the client",
+	"meta":               "Describes or manages the instance itself",
+	"methods":            "Accepts a particular HTTP method",
+	"network":            "Makes outbound network requests",
+	"redirects":          "Responds with redirects",
+	"stateful":           "Keeps state across requests",
+	"status-codes":       "Responds with a chosen status code",
+	"streaming":          "Streams its response over time",
+}
+
+// routes returns the table of endpoints exposed by HTTPBin, which drives both
+// request routing and the hints given to clients that request an endpoint
+// incorrectly.
+func (h *HTTPBin) routes() []route {
+	routes := []route{
+		{pattern: "/", methods: []string{"GET"}, example: "/", tags: []string{"meta"}, handler: h.Index},
+		{pattern: "/index.json", usage: "/index.json?tag={tag}", methods: []string{"GET"}, example: "/index.json", tags: []string{"meta"}, handler: h.IndexJSON},
+		{pattern: "/help/", usage: "/help/{endpoint}", methods: []string{"GET"}, example: "/help/drip", tags: []string{"meta"}, handler: h.Help},
+		{pattern: "/fanout/", usage: "/fanout/{channel}[/sse|/ws]", example: "/fanout/selftest", exampleStatus: http.StatusMethodNotAllowed, tags: []string{"streaming", "stateful", "hijacks-connection"}, handler: h.Fanout},
+		{pattern: "/forms/post", methods: []string{"GET"}, example: "/forms/post", tags: []string{"formats"}, handler: h.FormsPost},
+		{pattern: "/encoding/utf8", methods: []string{"GET"}, example: "/encoding/utf8", tags: []string{"formats"}, handler: h.UTF8},
+
+		{pattern: "/delete", methods: []string{"DELETE"}, example: "/delete", tags: []string{"methods", "inspection"}, handler: h.RequestWithBody},
+		{pattern: "/get", methods: []string{"GET"}, example: "/get", tags: []string{"methods", "inspection"}, handler: h.Get},
+		{pattern: "/head", methods: []string{"HEAD"}, example: "/head", tags: []string{"methods", "inspection"}, handler: h.Get},
+		{pattern: "/patch", methods: []string{"PATCH"}, example: "/patch", tags: []string{"methods", "inspection"}, handler: h.RequestWithBody},
+		{pattern: "/post", methods: []string{"POST"}, example: "/post", tags: []string{"methods", "inspection"}, handler: h.RequestWithBody},
+		{pattern: "/put", methods: []string{"PUT"}, example: "/put", tags: []string{"methods", "inspection"}, handler: h.RequestWithBody},
+
+		{pattern: "/anything", example: "/anything", tags: []string{"methods", "inspection"}, handler: h.Anything},
+		{pattern: "/anything/", usage: "/anything/{anything}", example: "/anything/selftest", tags: []string{"methods", "inspection"}, handler: h.Anything},
+
+		{pattern: "/ip", example: "/ip", tags: []string{"inspection"}, handler: h.IP},
+		{pattern: "/user-agent", example: "/user-agent", tags: []string{"inspection"}, handler: h.UserAgent},
+		{pattern: "/headers", example: "/headers", tags: []string{"inspection"}, handler: h.Headers},
+		{pattern: "/response-headers", example: "/response-headers?X-Selftest=1", tags: []string{"inspection"}, handler: h.ResponseHeaders},
+		{pattern: "/header-case", example: "/header-case?format=json", tags: []string{"inspection", "hijacks-connection"}, handler: h.HeaderCase},
+		{pattern: "/hostname", example: "/hostname", tags: []string{"meta"}, handler: h.Hostname},
+		{pattern: "/env", example: "/env", tags: []string{"meta"}, handler: h.Env},
+
+		{pattern: "/stats", example: "/stats", tags: []string{"meta", "stateful"}, handler: h.Stats},
+		{pattern: "/statuses", methods: []string{"GET"}, example: "/statuses", tags: []string{"status-codes", "meta"}, handler: h.Statuses},
+		{pattern: "/status/", usage: "/status/{code}", example: "/status/418", exampleStatus: 418, tags: []string{"status-codes"}, handler: h.Status},
+		{pattern: "/unstable", example: "/unstable?failure_rate=0", tags: []string{"status-codes", "chaos"}, handler: h.Unstable},
+		{pattern: "/unstable/schedule", example: "/unstable/schedule?down_for=0", tags: []string{"status-codes", "chaos"}, handler: h.UnstableSchedule},
+		{pattern: "/retry/", usage: "/retry/{key}/{n}", example: "/retry/selftest/0", tags: []string{"status-codes", "chaos", "stateful"}, handler: h.Retry},
+
+		{pattern: "/redirect/", usage: "/redirect/{n}", example: "/redirect/1", exampleStatus: 302, tags: []string{"redirects"}, handler: h.Redirect},
+		{pattern: "/relative-redirect/", usage: "/relative-redirect/{n}", example: "/relative-redirect/1", exampleStatus: 302, tags: []string{"redirects"}, handler: h.RelativeRedirect},
+		{pattern: "/absolute-redirect/", usage: "/absolute-redirect/{n}", example: "/absolute-redirect/1", exampleStatus: 302, tags: []string{"redirects"}, handler: h.AbsoluteRedirect},
+		{pattern: "/redirect-loop", example: "/redirect-loop", exampleStatus: 302, tags: []string{"redirects"}, handler: h.RedirectLoop},
+		{pattern: "/redirect-loop/", usage: "/redirect-loop/{hop}?via=a,b,c&hop={n}", example: "/redirect-loop/a?hop=1", exampleStatus: 302, tags: []string{"redirects"}, handler: h.RedirectLoop},
+		{pattern: "/redirect-to", example: "/redirect-to?url=/get", exampleStatus: 302, tags: []string{"redirects"}, handler: h.RedirectTo},
+
+		{pattern: "/cookies", example: "/cookies", tags: []string{"cookies"}, handler: h.Cookies},
+		{pattern: "/cookies/set", example: "/cookies/set?k=v", exampleStatus: 302, tags: []string{"cookies"}, handler: h.SetCookies},
+		{pattern: "/cookies/delete", example: "/cookies/delete?k=", exampleStatus: 302, tags: []string{"cookies"}, handler: h.DeleteCookies},
+
+		{pattern: "/basic-auth/", usage: "/basic-auth/{user}/{password}", example: "/basic-auth/user/pass", exampleStatus: 401, tags: []string{"auth"}, handler: h.BasicAuth},
+		{pattern: "/hidden-basic-auth/", usage: "/hidden-basic-auth/{user}/{password}", example: "/hidden-basic-auth/user/pass", exampleStatus: 404, tags: []string{"auth"}, handler: h.HiddenBasicAuth},
+		{pattern: "/expect-continue-auth/", usage: "/expect-continue-auth/{user}/{password}", methods: []string{"POST", "PUT"}, tags: []string{"auth", "hijacks-connection"}, handler: h.ExpectContinueAuth},
+		{pattern: "/diff", methods: []string{"POST"}, example: "/diff", exampleStatus: http.StatusBadRequest, tags: []string{"inspection"}, handler: h.Diff},
+		{pattern: "/digest-auth/", usage: "/digest-auth/{qop}/{user}/{password}/{algorithm}", example: "/digest-auth/auth/user/pass/MD5", exampleStatus: 401, tags: []string{"auth"}, handler: h.DigestAuth},
+		{pattern: "/bearer", example: "/bearer", exampleStatus: 401, tags: []string{"auth"}, handler: h.Bearer},
+		{pattern: "/challenge", example: "/challenge", exampleStatus: 401, tags: []string{"auth"}, handler: h.Challenge},
+
+		{pattern: "/deflate", example: "/deflate", tags: []string{"formats"}, handler: h.Deflate},
+		{pattern: "/gzip", example: "/gzip", tags: []string{"formats"}, handler: h.Gzip},
+		{pattern: "/zstd", example: "/zstd", tags: []string{"formats"}, handler: h.Zstd},
+
+		{pattern: "/stream/", usage: "/stream/{n}", example: "/stream/1", tags: []string{"streaming"}, handler: h.Stream},
+		{pattern: "/date-skew", example: "/date-skew?offset=-300s", tags: []string{"chaos"}, handler: h.DateSkew},
+		{pattern: "/degraded", example: "/degraded?components=db:down,cache:slow", tags: []string{"chaos", "status-codes"}, handler: h.Degraded},
+		{pattern: "/delay/", usage: "/delay/{duration}", example: "/delay/0", tags: []string{"chaos"}, handler: h.Delay},
+		{pattern: "/drip", example: "/drip?duration=0&delay=0&numbytes=1", tags: []string{"streaming", "chaos"}, handler: h.Drip},
+		{pattern: "/header-timing", example: "/header-timing?duration=0&numbytes=1", tags: []string{"streaming", "chaos", "hijacks-connection"}, handler: h.HeaderTiming},
+		{pattern: "/sse", methods: []string{"GET"}, example: "/sse?count=2&delay=0", tags: []string{"streaming"}, handler: h.SSE},
+
+		{pattern: "/naughty", example: "/naughty?category=numbers&count=5", tags: []string{"formats", "chaos"}, handler: h.Naughty},
+		{pattern: "/paginate", example: "/paginate?total=50&page_size=10&page=2", tags: []string{"dynamic-data"}, handler: h.Paginate},
+		{pattern: "/users", example: "/users?page_size=2&fields=id,email,address.city&sort=-created_at", tags: []string{"dynamic-data"}, handler: h.Users},
+		{pattern: "/users/", example: "/users/1", tags: []string{"dynamic-data"}, handler: h.Users},
+		{pattern: "/range/", usage: "/range/{n}", example: "/range/10", tags: []string{"dynamic-data"}, handler: h.Range},
+		{pattern: "/bytes/", usage: "/bytes/{n}", example: "/bytes/10", tags: []string{"dynamic-data"}, handler: h.Bytes},
+		{pattern: "/stream-bytes/", usage: "/stream-bytes/{n}", example: "/stream-bytes/10", tags: []string{"dynamic-data", "streaming"}, handler: h.StreamBytes},
+		{pattern: "/framing", example: "/framing?mode=content-length", tags: []string{"formats", "hijacks-connection"}, handler: h.Framing},
+		{pattern: "/probe", methods: []string{"GET"}, tags: []string{"chaos", "hijacks-connection"}, handler: h.Probe},
+		{pattern: "/truncate", methods: []string{"GET"}, tags: []string{"chaos", "hijacks-connection"}, handler: h.Truncate},
+		{pattern: "/websocket/echo", methods: []string{"GET"}, example: "/websocket/echo", exampleStatus: http.StatusUpgradeRequired, tags: []string{"streaming", "hijacks-connection"}, handler: h.WebSocketEcho},
+		{pattern: "/archive", example: "/archive?files=1&file_size=1", tags: []string{"formats", "dynamic-data"}, handler: h.Archive},
+
+		{pattern: "/html", example: "/html", tags: []string{"formats"}, handler: h.HTML},
+		{pattern: "/robots.txt", example: "/robots.txt", tags: []string{"formats"}, handler: h.Robots},
+		{pattern: "/deny", example: "/deny", tags: []string{"formats"}, handler: h.Deny},
+
+		{pattern: "/cache", example: "/cache", tags: []string{"caching"}, handler: h.Cache},
+		{pattern: "/cache/sequence", methods: []string{"GET", "DELETE"}, example: "/cache/sequence?key=selftest", tags: []string{"caching", "stateful"}, handler: h.CacheSequence},
+		{pattern: "/upload/slow-reader", usage: "/upload/slow-reader?rate={bytes per second}", methods: []string{"POST", "PUT"}, tags: []string{"chaos"}, handler: h.SlowReader},
+		{pattern: "/coalesce", usage: "/coalesce?key={key}&work={duration}", methods: []string{"GET"}, example: "/coalesce?key=selftest&work=0", tags: []string{"stateful"}, handler: h.Coalesce},
+		{pattern: "/cdn-sim", example: "/cdn-sim?key=selftest&ttl=1", tags: []string{"caching", "stateful"}, handler: h.CDNSim},
+		{pattern: "/cache/", usage: "/cache/{seconds}", example: "/cache/60", tags: []string{"caching"}, handler: h.CacheControl},
+		{pattern: "/etag/", usage: "/etag/{etag}", example: "/etag/selftest", tags: []string{"caching"}, handler: h.ETag},
+
+		{pattern: "/patch-target", methods: []string{"GET", "PATCH", "DELETE"}, optionsHeaders: http.Header{"Accept-Patch": {acceptPatch}}, example: "/patch-target?key=selftest", tags: []string{"stateful"}, handler: h.PatchTarget},
+
+		{pattern: "/links/", usage: "/links/{n}/{offset}", example: "/links/1/0", tags: []string{"dynamic-data"}, handler: h.Links},
+
+		{pattern: "/image", example: "/image", tags: []string{"formats"}, handler: h.ImageAccept},
+		{pattern: "/image/", usage: "/image/{format}", example: "/image/png", tags: []string{"formats"}, handler: h.Image},
+		{pattern: "/verify", methods: []string{"POST", "PUT"}, example: "/verify?sha256=e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", tags: []string{"inspection"}, handler: h.Verify},
+		{pattern: "/xml", example: "/xml", tags: []string{"formats"}, handler: h.XML},
+		{pattern: "/sizes", example: "/sizes?buckets=1k,10k:0.5&seed=1", tags: []string{"dynamic-data"}, handler: h.Sizes},
+		{pattern: "/page", methods: []string{"GET"}, example: "/page?assets=3&sizes=16-64&latency=0&seed=1", tags: []string{"dynamic-data", "caching"}, handler: h.Page},
+		{pattern: "/page/manifest", methods: []string{"GET"}, example: "/page/manifest?assets=3&sizes=16-64&latency=0&seed=1", tags: []string{"dynamic-data", "caching"}, handler: h.PageManifest},
+		{pattern: "/page/asset/", usage: "/page/asset/{id}", methods: []string{"GET"}, example: "/page/asset/0?assets=3&sizes=16-64&latency=0&seed=1", tags: []string{"dynamic-data", "caching"}, handler: h.PageAsset},
+		{pattern: "/soap", methods: []string{"POST"}, example: "/soap", exampleStatus: http.StatusUnsupportedMediaType, tags: []string{"formats"}, handler: h.SOAP},
+		{pattern: "/json", example: "/json", tags: []string{"formats"}, handler: h.JSON},
+
+		{pattern: "/uuid", usage: "/uuid?version={1|4|7}&count={n}", example: "/uuid", tags: []string{"dynamic-data"}, handler: h.UUID},
+		{pattern: "/base64/", usage: "/base64/{value}", example: "/base64/c2VsZnRlc3Q=", tags: []string{"formats"}, handler: h.Base64},
+
+		{pattern: "/dump/request", usage: "/dump/request?format=text|json", example: "/dump/request", tags: []string{"inspection"}, handler: h.DumpRequest},
+
+		// These endpoints depend on outbound network access or on the
+		// underlying connection, so /selftest does not exercise them
+		{pattern: "/egress", usage: "/egress?target={url}", methods: []string{"GET"}, tags: []string{"network"}, handler: h.Egress},
+		{pattern: "/churn", tags: []string{"chaos"}, handler: h.Churn},
+		{pattern: "/dualstack", methods: []string{"GET"}, tags: []string{"network", "inspection"}, handler: h.DualStack},
+		{pattern: "/resolve", usage: "/resolve?host={host}", methods: []string{"GET"}, tags: []string{"network"}, handler: h.Resolve},
+
+		{pattern: "/memento", methods: []string{"GET"}, example: "/memento", tags: []string{"dynamic-data"}, handler: h.Memento},
+		{pattern: "/memento/", usage: "/memento/{version}", methods: []string{"GET"}, example: "/memento/1", tags: []string{"dynamic-data"}, handler: h.MementoVersion},
+		{pattern: "/memento/timegate", methods: []string{"GET"}, example: "/memento/timegate", exampleStatus: 302, tags: []string{"dynamic-data", "redirects"}, handler: h.MementoTimeGate},
+		{pattern: "/memento/timemap", methods: []string{"GET"}, example: "/memento/timemap", tags: []string{"dynamic-data"}, handler: h.MementoTimeMap},
+
+		// existing httpbin endpoints that we do not support
+		{pattern: "/brotli", example: "/brotli", exampleStatus: 501, tags: []string{"formats"}, handler: notImplementedHandler},
+	}
+
+	if h.signedURLKey != nil {
+		routes = append(routes,
+			route{pattern: "/sign", usage: "/sign?target={path}&ttl={duration}", methods: []string{"POST"}, example: "/sign?target=/get", tags: []string{"auth"}, handler: h.Sign},
+			route{pattern: "/signed/", usage: "/signed/{expiry}/{signature}/{target}", tags: []string{"auth"}, handler: h.Signed},
+		)
+	}
+
+	if h.adminToken != "" {
+		routes = append(routes,
+			route{pattern: "/admin/settings", methods: []string{"GET", "PUT"}, tags: []string{"meta", "auth", "destructive"}, handler: h.AdminSettings},
+			route{pattern: "/admin/reset", methods: []string{"POST"}, tags: []string{"meta", "auth", "destructive"}, handler: h.AdminReset},
+		)
+	}
+
+	if h.oidcIssuer != "" {
+		routes = append(routes,
+			route{pattern: "/.well-known/openid-configuration", methods: []string{"GET"}, example: "/.well-known/openid-configuration", tags: []string{"auth"}, handler: h.OIDCDiscovery},
+			route{pattern: "/jwks.json", methods: []string{"GET"}, example: "/jwks.json", tags: []string{"auth"}, handler: h.JWKS},
+			route{pattern: "/oauth/token", methods: []string{"POST"}, tags: []string{"auth"}, handler: h.OAuthToken},
+		)
+		if h.adminToken != "" {
+			routes = append(routes,
+				route{pattern: "/admin/oidc/rotate-keys", methods: []string{"POST"}, tags: []string{"auth", "destructive"}, handler: h.AdminOIDCRotateKeys},
+			)
+		}
+	}
+
+	if h.metrics != nil {
+		routes = append(routes,
+			route{pattern: "/metrics", methods: []string{"GET"}, example: "/metrics", tags: []string{"meta", "stateful"}, handler: h.Metrics},
+		)
+	}
+
+	if h.selfTestToken != "" {
+		routes = append(routes,
+			route{pattern: "/selftest", methods: []string{"POST"}, tags: []string{"meta", "auth"}, handler: h.SelfTest},
+		)
+	}
+
+	for i, rt := range routes {
+		if policy, ok := h.methodPolicies[rt.pattern]; ok {
+			routes[i].methods = policy
+			routes[i].exactMethods = true
+		}
+	}
+
+	if len(h.excludedTags) > 0 {
+		included := routes[:0]
+		for _, rt := range routes {
+			if !h.isExcluded(rt) {
+				included = append(included, rt)
+			}
+		}
+		routes = included
+	}
+
+	return routes
+}
+
+// isExcluded reports whether the route has any of the tags given to
+// WithExcludedTags.
+func (h *HTTPBin) isExcluded(rt route) bool {
+	for _, tag := range rt.tags {
+		if h.excludedTags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMethodPolicies returns an error describing the first problem with
+// the WithMethodPolicy options given to New, if any.
+func (h *HTTPBin) validateMethodPolicies() error {
+	if len(h.methodPolicyErrs) > 0 {
+		return h.methodPolicyErrs[0]
+	}
+	known := make(map[string]bool)
+	for _, rt := range h.routes() {
+		known[rt.pattern] = true
+	}
+	patterns := make([]string, 0, len(h.methodPolicies))
+	for pattern := range h.methodPolicies {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if !known[pattern] {
+			return fmt.Errorf("method policy for unknown route pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// capabilities lists the optional features enabled on this instance, as
+// reported in response to OPTIONS * requests.
+func (h *HTTPBin) capabilities() []string {
+	var caps []string
+	if h.adminToken != "" {
+		caps = append(caps, "admin-api")
+	}
+	if h.canonicalBaseURL != nil {
+		caps = append(caps, "canonical-base-url")
+	}
+	if h.canonicalJSON {
+		caps = append(caps, "canonical-json")
+	}
+	if h.loadSignals {
+		caps = append(caps, "load-signals")
+	}
+	if len(h.mtlsRequired) > 0 {
+		caps = append(caps, "mtls")
+	}
+	if h.Observer != nil {
+		caps = append(caps, "observer")
+	}
+	if h.oidcIssuer != "" {
+		caps = append(caps, "oidc")
+	}
+	if h.metrics != nil {
+		caps = append(caps, "prometheus-metrics")
+	}
+	if len(h.AllowedRedirectDomains) > 0 {
+		caps = append(caps, "redirect-allowlist")
+	}
+	if h.requestTiming {
+		caps = append(caps, "request-timing")
+	}
+	if h.selfTestToken != "" {
+		caps = append(caps, "selftest")
+	}
+	if h.serverTiming {
+		caps = append(caps, "server-timing")
+	}
+	if h.traceDecision != nil {
+		caps = append(caps, "trace-decision")
+	}
+	if h.signedURLKey != nil {
+		caps = append(caps, "signed-urls")
+	}
+	return caps
+}
+
+// featureDefaults gives the instance-wide state of the feature flags that
+// clients may override per request via the X-Httpbin-Features header.
+func (h *HTTPBin) featureDefaults() map[string]bool {
+	return map[string]bool{
+		featureErrorClassHeader: h.errorClassHeader,
+		featureLoadSignals:      h.loadSignals,
+		featureServerTiming:     h.serverTiming,
+	}
+}
+
+// setIdentityHeader configures a header added to every response, where an
+// empty value suppresses the header. Invalid values are ignored.
+func (h *HTTPBin) setIdentityHeader(key, value string) {
+	if !isValidHeaderValue(value) {
+		return
+	}
+	if h.identityHeaders == nil {
+		h.identityHeaders = make(http.Header)
+	}
+	h.identityHeaders[key] = identityHeaderValue(value)
+}
+
 // Handler returns an http.Handler that exposes all HTTPBin endpoints
 func (h *HTTPBin) Handler() http.Handler {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/", methods(h.Index, "GET"))
-	mux.HandleFunc("/forms/post", methods(h.FormsPost, "GET"))
-	mux.HandleFunc("/encoding/utf8", methods(h.UTF8, "GET"))
-
-	mux.HandleFunc("/delete", methods(h.RequestWithBody, "DELETE"))
-	mux.HandleFunc("/get", methods(h.Get, "GET"))
-	mux.HandleFunc("/head", methods(h.Get, "HEAD"))
-	mux.HandleFunc("/patch", methods(h.RequestWithBody, "PATCH"))
-	mux.HandleFunc("/post", methods(h.RequestWithBody, "POST"))
-	mux.HandleFunc("/put", methods(h.RequestWithBody, "PUT"))
-
-	mux.HandleFunc("/anything", h.Anything)
-	mux.HandleFunc("/anything/", h.Anything)
-
-	mux.HandleFunc("/ip", h.IP)
-	mux.HandleFunc("/user-agent", h.UserAgent)
-	mux.HandleFunc("/headers", h.Headers)
-	mux.HandleFunc("/response-headers", h.ResponseHeaders)
-	mux.HandleFunc("/hostname", h.Hostname)
-
-	mux.HandleFunc("/status/", h.Status)
-	mux.HandleFunc("/unstable", h.Unstable)
-
-	mux.HandleFunc("/redirect/", h.Redirect)
-	mux.HandleFunc("/relative-redirect/", h.RelativeRedirect)
-	mux.HandleFunc("/absolute-redirect/", h.AbsoluteRedirect)
-	mux.HandleFunc("/redirect-to", h.RedirectTo)
-
-	mux.HandleFunc("/cookies", h.Cookies)
-	mux.HandleFunc("/cookies/set", h.SetCookies)
-	mux.HandleFunc("/cookies/delete", h.DeleteCookies)
-
-	mux.HandleFunc("/basic-auth/", h.BasicAuth)
-	mux.HandleFunc("/hidden-basic-auth/", h.HiddenBasicAuth)
-	mux.HandleFunc("/digest-auth/", h.DigestAuth)
-	mux.HandleFunc("/bearer", h.Bearer)
-
-	mux.HandleFunc("/deflate", h.Deflate)
-	mux.HandleFunc("/gzip", h.Gzip)
-
-	mux.HandleFunc("/stream/", h.Stream)
-	mux.HandleFunc("/delay/", h.Delay)
-	mux.HandleFunc("/drip", h.Drip)
-
-	mux.HandleFunc("/range/", h.Range)
-	mux.HandleFunc("/bytes/", h.Bytes)
-	mux.HandleFunc("/stream-bytes/", h.StreamBytes)
-
-	mux.HandleFunc("/html", h.HTML)
-	mux.HandleFunc("/robots.txt", h.Robots)
-	mux.HandleFunc("/deny", h.Deny)
-
-	mux.HandleFunc("/cache", h.Cache)
-	mux.HandleFunc("/cache/", h.CacheControl)
-	mux.HandleFunc("/etag/", h.ETag)
-
-	mux.HandleFunc("/links/", h.Links)
-
-	mux.HandleFunc("/image", h.ImageAccept)
-	mux.HandleFunc("/image/", h.Image)
-	mux.HandleFunc("/xml", h.XML)
-	mux.HandleFunc("/json", h.JSON)
-
-	mux.HandleFunc("/uuid", h.UUID)
-	mux.HandleFunc("/base64/", h.Base64)
-
-	mux.HandleFunc("/dump/request", h.DumpRequest)
-
-	// existing httpbin endpoints that we do not support
-	mux.HandleFunc("/brotli", notImplementedHandler)
-
-	// Make sure our ServeMux doesn't "helpfully" redirect these invalid
-	// endpoints by adding a trailing slash. See the ServeMux docs for more
-	// info: https://golang.org/pkg/net/http/#ServeMux
-	mux.HandleFunc("/absolute-redirect", http.NotFound)
-	mux.HandleFunc("/basic-auth", http.NotFound)
-	mux.HandleFunc("/delay", http.NotFound)
-	mux.HandleFunc("/digest-auth", http.NotFound)
-	mux.HandleFunc("/hidden-basic-auth", http.NotFound)
-	mux.HandleFunc("/redirect", http.NotFound)
-	mux.HandleFunc("/relative-redirect", http.NotFound)
-	mux.HandleFunc("/status", http.NotFound)
-	mux.HandleFunc("/stream", http.NotFound)
-	mux.HandleFunc("/bytes", http.NotFound)
-	mux.HandleFunc("/stream-bytes", http.NotFound)
-	mux.HandleFunc("/links", http.NotFound)
+	routes := h.routes()
+	registered := make(map[string]bool, len(routes))
+	optionsHeaders := make(map[string]http.Header)
+	for _, rt := range routes {
+		registered[rt.pattern] = true
+		// Every pattern is recorded, so that preflight can find the route
+		// serving a path the way ServeMux would
+		hdr := rt.optionsHeaders
+		if rt.exactMethods {
+			hdr = hdr.Clone()
+			if hdr == nil {
+				hdr = make(http.Header, 2)
+			}
+			allowed := strings.Join(allowedMethods(rt.methods), ", ")
+			hdr.Set("Access-Control-Allow-Methods", allowed)
+			hdr.Set("Allow", allowed)
+		}
+		optionsHeaders[rt.pattern] = hdr
+	}
+
+	for _, rt := range routes {
+		handler := rt.handler
+		if rt.exactMethods {
+			handler = exactMethods(handler, rt.methods...)
+		} else if rt.methods != nil {
+			handler = methods(handler, rt.methods...)
+		}
+		mux.HandleFunc(rt.pattern, withRoutePattern(rt.pattern, handler))
+
+		// Make sure our ServeMux doesn't "helpfully" redirect the invalid
+		// bare form of an endpoint by adding a trailing slash, and instead
+		// tell the client how the endpoint should be used. See the ServeMux
+		// docs for more info: https://golang.org/pkg/net/http/#ServeMux
+		if bare := strings.TrimSuffix(rt.pattern, "/"); bare != "" && bare != rt.pattern && !registered[bare] {
+			mux.HandleFunc(bare, usageNotFound(rt.usage))
+		}
+	}
 
 	// Apply global middleware
 	var handler http.Handler
-	handler = mux
+	handler = canonicalJSON(h.canonicalJSON, mux)
+	if h.requestTiming {
+		handler = markHandlerStart(handler)
+	}
+	if len(h.mtlsRequired) > 0 {
+		handler = requireClientCert(h.mtlsRequired, h.verifyClientCert, handler)
+	}
 	handler = limitRequestSize(h.MaxBodySize, handler)
-	handler = preflight(handler)
+	if h.maxURLLength > 0 {
+		handler = limitURLLength(h.maxURLLength, handler)
+	}
+	handler = preflight(optionsHeaders, handler)
+	handler = serverOptions(h.capabilities(), handler)
+	if h.identityHeaders != nil {
+		handler = identityHeaders(h.identityHeaders, handler)
+	}
 	handler = autohead(handler)
+	featureDefaults := h.featureDefaults()
+	handler = featureGate(featureServerTiming, featureDefaults, serverTiming(handler), handler)
+	handler = featureGate(featureLoadSignals, featureDefaults, loadSignals(&h.inflight, handler), handler)
+	handler = countTraffic(h.traffic, mux, handler)
+	handler = featureGate(featureErrorClassHeader, featureDefaults, errorClasses(true, handler), errorClasses(false, handler))
+	handler = features(featureDefaults, handler)
+	if h.traceDecision != nil {
+		handler = traceDecision(h.traceDecision, mux, handler)
+	}
+	var o Observer
 	if h.Observer != nil {
-		handler = observe(h.Observer, handler)
+		o = h.Observer
+		if h.asyncObserver != nil {
+			o = h.asyncObserver.observe
+		}
+	}
+	if h.metrics != nil {
+		o = h.metrics.observer(o)
+	}
+	if o != nil {
+		handler = observe(o, mux, handler)
+	}
+	if h.requestTiming {
+		handler = requestTiming(handler)
 	}
 
 	return handler
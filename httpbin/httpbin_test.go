@@ -1,9 +1,23 @@
 package httpbin
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -67,3 +81,1029 @@ func TestNewObserver(t *testing.T) {
 		t.Fatalf("observer never called")
 	}
 }
+
+func TestObserverResult(t *testing.T) {
+	t.Parallel()
+
+	t.Run("request_details", func(t *testing.T) {
+		t.Parallel()
+
+		var result Result
+		h := New(WithObserver(func(r Result) { result = r }))
+
+		body := "hello world"
+		r, _ := http.NewRequest("POST", "/anything/foo", strings.NewReader(body))
+		r.Header.Set("User-Agent", "observer-test/1.0")
+		r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+		w := httptest.NewRecorder()
+		h.Handler().ServeHTTP(w, r)
+
+		if result.Route != "/anything/" {
+			t.Fatalf("expected route %q, got %q", "/anything/", result.Route)
+		}
+		if result.RequestSize != int64(len(body)) {
+			t.Fatalf("expected request size %d, got %d", len(body), result.RequestSize)
+		}
+		if result.Size != int64(w.Body.Len()) {
+			t.Fatalf("expected size %d, got %d", w.Body.Len(), result.Size)
+		}
+		if result.ClientIP != "203.0.113.7" {
+			t.Fatalf("expected client ip %q, got %q", "203.0.113.7", result.ClientIP)
+		}
+		if result.UserAgent != "observer-test/1.0" {
+			t.Fatalf("expected user agent %q, got %q", "observer-test/1.0", result.UserAgent)
+		}
+	})
+
+	t.Run("unmatched_route", func(t *testing.T) {
+		t.Parallel()
+
+		var result Result
+		h := New(WithObserver(func(r Result) { result = r }))
+
+		r, _ := http.NewRequest("GET", "/does-not-exist", nil)
+		w := httptest.NewRecorder()
+		h.Handler().ServeHTTP(w, r)
+
+		if result.Status != http.StatusNotFound {
+			t.Fatalf("expected status %d, got %d", http.StatusNotFound, result.Status)
+		}
+		if result.Route != "" {
+			t.Fatalf("expected empty route, got %q", result.Route)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		t.Parallel()
+
+		results := make(chan Result, 1)
+		h := New(WithObserver(func(r Result) { results <- r }))
+		srv := httptest.NewServer(h.Handler())
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL + "/drip?numbytes=5&duration=0&delay=0")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		result := <-results
+		if result.Route != "/drip" {
+			t.Fatalf("expected route %q, got %q", "/drip", result.Route)
+		}
+		if result.Size != int64(len(respBody)) || result.Size != 5 {
+			t.Fatalf("expected size 5, got %d (read %d bytes)", result.Size, len(respBody))
+		}
+	})
+}
+
+func TestAsyncObserver(t *testing.T) {
+	t.Parallel()
+
+	serve := func(h *HTTPBin, path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("slow_observer_and_drops", func(t *testing.T) {
+		t.Parallel()
+
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		var uris []string
+		h := New(
+			WithAsyncObserver(1),
+			WithObserver(func(r Result) {
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+				<-release
+				uris = append(uris, r.URI)
+			}),
+		)
+
+		// The first result is handed to the observer, which blocks, the
+		// second fills the queue and the third is dropped, all without
+		// holding up the requests themselves.
+		start := time.Now()
+		serve(h, "/get?n=1")
+		<-started
+		serve(h, "/get?n=2")
+		serve(h, "/get?n=3")
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("requests were held up by the observer for %s", elapsed)
+		}
+
+		w := serve(h, "/stats")
+		var stats statsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatalf("failed to unmarshal body %q: %s", w.Body.String(), err)
+		}
+		want := observerStats{Buffer: 1, Queued: 1, Dropped: 1}
+		if stats.Observer == nil || *stats.Observer != want {
+			t.Fatalf("expected observer stats %+v, got %+v", want, stats.Observer)
+		}
+
+		close(release)
+		assertNil(t, h.Close())
+		if !reflect.DeepEqual(uris, []string{"/get?n=1", "/get?n=2"}) {
+			t.Fatalf("unexpected results delivered: %v", uris)
+		}
+		// The result of the /stats request was dropped too
+		if dropped := h.asyncObserver.stats().Dropped; dropped != 2 {
+			t.Fatalf("expected 2 dropped results, got %d", dropped)
+		}
+	})
+
+	t.Run("close_flushes_in_order", func(t *testing.T) {
+		t.Parallel()
+
+		var uris []string
+		h := New(
+			WithAsyncObserver(10),
+			WithObserver(func(r Result) {
+				time.Sleep(time.Millisecond)
+				uris = append(uris, r.URI)
+			}),
+		)
+		want := make([]string, 0, 5)
+		for i := 0; i < 5; i++ {
+			path := fmt.Sprintf("/get?n=%d", i)
+			serve(h, path)
+			want = append(want, path)
+		}
+		assertNil(t, h.Close())
+		assertNil(t, h.Close())
+		if !reflect.DeepEqual(uris, want) {
+			t.Fatalf("expected results %v, got %v", want, uris)
+		}
+
+		// Later results are dropped rather than panicking
+		serve(h, "/get")
+		if dropped := h.asyncObserver.stats().Dropped; dropped != 1 {
+			t.Fatalf("expected 1 dropped result, got %d", dropped)
+		}
+	})
+
+	t.Run("sync_observer", func(t *testing.T) {
+		t.Parallel()
+
+		h := New(WithObserver(func(Result) {}))
+		w := serve(h, "/stats")
+		if strings.Contains(w.Body.String(), `"observer"`) {
+			t.Fatalf("expected no observer stats, got %s", w.Body.String())
+		}
+		assertNil(t, h.Close())
+	})
+
+	t.Run("invalid_buffer", func(t *testing.T) {
+		t.Parallel()
+
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("expected panic for non-positive buffer")
+			}
+		}()
+		WithAsyncObserver(0)
+	})
+}
+
+func TestObserverAnnotations(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		path     string
+		setup    func(r *http.Request)
+		expected map[string]string
+	}{
+		{
+			path:     "/status/418",
+			expected: map[string]string{"status_code": "418"},
+		},
+		{
+			path:     "/redirect/3",
+			expected: map[string]string{"redirects_remaining": "2"},
+		},
+		{
+			path:     "/basic-auth/user/pass",
+			setup:    func(r *http.Request) { r.SetBasicAuth("user", "pass") },
+			expected: map[string]string{"authorized": "true", "auth_user": "user"},
+		},
+		{
+			path:     "/hidden-basic-auth/user/pass",
+			setup:    func(r *http.Request) { r.SetBasicAuth("user", "wrong") },
+			expected: map[string]string{"authorized": "false", "auth_user": "user"},
+		},
+		{
+			path:     "/bearer",
+			expected: map[string]string{"authorized": "false"},
+		},
+		{
+			path:     "/get",
+			expected: nil,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.path, func(t *testing.T) {
+			t.Parallel()
+
+			var result Result
+			h := New(WithObserver(func(r Result) { result = r }))
+
+			r, _ := http.NewRequest("GET", test.path, nil)
+			if test.setup != nil {
+				test.setup(r)
+			}
+			w := httptest.NewRecorder()
+			h.Handler().ServeHTTP(w, r)
+
+			if !reflect.DeepEqual(result.Annotations, test.expected) {
+				t.Fatalf("expected annotations %v, got %v", test.expected, result.Annotations)
+			}
+		})
+	}
+
+	t.Run("delay", func(t *testing.T) {
+		t.Parallel()
+
+		var result Result
+		h := New(WithObserver(func(r Result) { result = r }))
+
+		r, _ := http.NewRequest("GET", "/delay/10ms", nil)
+		w := httptest.NewRecorder()
+		h.Handler().ServeHTTP(w, r)
+
+		if result.Annotations["delay_requested"] != "10ms" {
+			t.Fatalf("expected delay_requested=10ms, got %v", result.Annotations)
+		}
+		actual, err := time.ParseDuration(result.Annotations["delay_actual"])
+		if err != nil || actual < 10*time.Millisecond {
+			t.Fatalf("expected delay_actual >= 10ms, got %v", result.Annotations)
+		}
+	})
+
+	t.Run("delay_clamped", func(t *testing.T) {
+		t.Parallel()
+
+		var result Result
+		h := New(WithObserver(func(r Result) { result = r }), WithMaxDuration(time.Second))
+
+		r, _ := http.NewRequest("GET", "/delay/5s", nil)
+		w := httptest.NewRecorder()
+		h.Handler().ServeHTTP(w, r)
+
+		if result.Annotations["delay_requested"] != "5s" {
+			t.Fatalf("expected delay_requested=5s, got %v", result.Annotations)
+		}
+		actual, err := time.ParseDuration(result.Annotations["delay_actual"])
+		if err != nil || actual < time.Second || actual >= 5*time.Second {
+			t.Fatalf("expected delay_actual clamped to about 1s, got %v", result.Annotations)
+		}
+	})
+
+	t.Run("std_log_observer", func(t *testing.T) {
+		t.Parallel()
+
+		buf := &bytes.Buffer{}
+		StdLogObserver(log.New(buf, "", 0))(Result{
+			Status:      200,
+			Annotations: map[string]string{"b": "2", "a": "1"},
+		})
+		if !strings.HasSuffix(buf.String(), ` a="1" b="2"`+"\n") {
+			t.Fatalf("expected sorted annotations at end of log line, got %q", buf.String())
+		}
+	})
+}
+
+func TestErrorClasses(t *testing.T) {
+	t.Parallel()
+
+	// Handlers exercising the classes that no endpoint produces on demand
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	})
+	canceled := func(r *http.Request) *http.Request {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Millisecond)
+		t.Cleanup(cancel)
+		return r.WithContext(ctx)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		handler    http.Handler
+		setup      func(r *http.Request) *http.Request
+		wantStatus int
+		wantClass  string
+	}{
+		{name: "requested", path: "/status/503", wantStatus: 503, wantClass: ErrorClassRequested},
+		{name: "injected", path: "/unstable?failure_rate=1", wantStatus: 500, wantClass: ErrorClassInjected},
+		{name: "injected_schedule", path: "/unstable/schedule?period=1m&down_for=1m", wantStatus: 503, wantClass: ErrorClassInjected},
+		{name: "panic", path: "/", handler: panicking, wantStatus: 500, wantClass: ErrorClassPanic},
+		{name: "timeout", path: "/", handler: slow, setup: canceled, wantStatus: 503, wantClass: ErrorClassTimeout},
+		{name: "internal", path: "/", handler: failing, wantStatus: 500, wantClass: ErrorClassInternal},
+		{name: "not_5xx", path: "/status/404", wantStatus: 404, wantClass: ""},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var result Result
+			observer := func(r Result) { result = r }
+
+			var h http.Handler
+			if test.handler != nil {
+				h = observe(observer, nil, errorClasses(true, test.handler))
+			} else {
+				h = New(WithObserver(observer), WithErrorClassHeader())
+			}
+
+			r, _ := http.NewRequest("GET", test.path, nil)
+			if test.setup != nil {
+				r = test.setup(r)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("expected status %d, got %d", test.wantStatus, w.Code)
+			}
+			if result.ErrorClass != test.wantClass {
+				t.Fatalf("expected observed error class %q, got %q", test.wantClass, result.ErrorClass)
+			}
+			if got := w.Header().Get("X-Error-Class"); got != test.wantClass {
+				t.Fatalf("expected X-Error-Class %q, got %q", test.wantClass, got)
+			}
+		})
+	}
+
+	t.Run("panic_value_not_sent_to_client", func(t *testing.T) {
+		t.Parallel()
+
+		h := errorClasses(false, panicking)
+		r, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "boom") {
+			t.Fatalf("expected panic value to be withheld from the response, got %q", w.Body.String())
+		}
+	})
+
+	t.Run("header_disabled_by_default", func(t *testing.T) {
+		t.Parallel()
+
+		var result Result
+		h := New(WithObserver(func(r Result) { result = r }))
+		r, _ := http.NewRequest("GET", "/status/500", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if got := w.Header().Get("X-Error-Class"); got != "" {
+			t.Fatalf("expected no X-Error-Class header, got %q", got)
+		}
+		if result.ErrorClass != ErrorClassRequested {
+			t.Fatalf("expected observed error class %q, got %q", ErrorClassRequested, result.ErrorClass)
+		}
+	})
+
+	t.Run("std_log_observer", func(t *testing.T) {
+		t.Parallel()
+
+		buf := &bytes.Buffer{}
+		StdLogObserver(log.New(buf, "", 0))(Result{Status: 500, ErrorClass: ErrorClassPanic})
+		if !strings.HasSuffix(buf.String(), ` error_class="panic"`+"\n") {
+			t.Fatalf("expected error class at end of log line, got %q", buf.String())
+		}
+	})
+}
+
+func TestFeatureFlags(t *testing.T) {
+	t.Parallel()
+
+	doRequest := func(h *HTTPBin, path, features string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		if features != "" {
+			r.Header.Set("X-Httpbin-Features", features)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("instance defaults", func(t *testing.T) {
+		t.Parallel()
+		h := New(WithFeatureFlags(map[string]bool{"server-timing": true, "load-signals": true, "bogus": true}))
+		w := doRequest(h, "/bytes/10", "")
+		if w.Header().Get("Server-Timing") == "" {
+			t.Fatalf("expected Server-Timing header")
+		}
+		assertHeader(t, w, "X-Inflight-Requests", "1")
+		assertHeader(t, w, "X-Httpbin-Features-Applied", "")
+	})
+
+	t.Run("flags take precedence over earlier options", func(t *testing.T) {
+		t.Parallel()
+		h := New(WithServerTiming(), WithFeatureFlags(map[string]bool{"server-timing": false}))
+		w := doRequest(h, "/bytes/10", "")
+		assertHeader(t, w, "Server-Timing", "")
+	})
+
+	tests := []struct {
+		name        string
+		defaults    map[string]bool
+		features    string
+		wantApplied string
+		wantTiming  bool
+		wantClass   bool
+	}{
+		{
+			name:        "enable per request",
+			features:    "server-timing, error-class-header=1",
+			wantApplied: "error-class-header=true, load-signals=false, server-timing=true",
+			wantTiming:  true,
+			wantClass:   true,
+		},
+		{
+			name:        "disable per request",
+			defaults:    map[string]bool{"server-timing": true, "error-class-header": true},
+			features:    "server-timing=false,error-class-header=off",
+			wantApplied: "error-class-header=false, load-signals=false, server-timing=false",
+		},
+		{
+			name:        "invalid values and unknown flags are ignored",
+			defaults:    map[string]bool{"server-timing": true},
+			features:    "server-timing=maybe, Error-Class-Header, verbose",
+			wantApplied: "error-class-header=true, load-signals=false, server-timing=true",
+			wantTiming:  true,
+			wantClass:   true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			h := New(WithFeatureFlags(test.defaults))
+
+			w := doRequest(h, "/bytes/10", test.features)
+			assertHeader(t, w, "X-Httpbin-Features-Applied", test.wantApplied)
+			if got := w.Header().Get("Server-Timing") != ""; got != test.wantTiming {
+				t.Fatalf("expected Server-Timing present=%v, got %v", test.wantTiming, got)
+			}
+
+			w = doRequest(h, "/status/503", test.features)
+			if got := w.Header().Get("X-Error-Class") != ""; got != test.wantClass {
+				t.Fatalf("expected X-Error-Class present=%v, got %v", test.wantClass, got)
+			}
+		})
+	}
+
+	t.Run("security options cannot be overridden", func(t *testing.T) {
+		t.Parallel()
+		h := New(WithAllowedRedirectDomains([]string{"example.org"}))
+		features := "admin-api, redirect-allowlist=false, AllowedRedirectDomains=false, selftest, signed-urls"
+
+		w := doRequest(h, "/redirect-to?url=http://evil.com", features)
+		assertStatusCode(t, w, http.StatusForbidden)
+		assertHeader(t, w, "X-Httpbin-Features-Applied", "error-class-header=false, load-signals=false, server-timing=false")
+
+		for _, path := range []string{"/admin/settings", "/selftest", "/sign?path=/get"} {
+			w := doRequest(h, path, features)
+			assertStatusCode(t, w, http.StatusNotFound)
+		}
+	})
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	t.Parallel()
+
+	// Make requests over the wire, since suppressed headers are only
+	// dropped when net/http writes the response
+	doRequest := func(t *testing.T, h *HTTPBin, path string) *http.Response {
+		t.Helper()
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		resp, err := srv.Client().Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	tests := []struct {
+		name          string
+		opts          []OptionFunc
+		path          string
+		wantStatus    int
+		wantServer    []string
+		wantPoweredBy []string
+	}{
+		{
+			name:       "unset by default",
+			path:       "/get",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:          "configured",
+			opts:          []OptionFunc{WithServerHeader("nginx/1.25.3"), WithPoweredByHeader("PHP/8.2")},
+			path:          "/status/404",
+			wantStatus:    http.StatusNotFound,
+			wantServer:    []string{"nginx/1.25.3"},
+			wantPoweredBy: []string{"PHP/8.2"},
+		},
+		{
+			name:       "empty value suppresses header",
+			opts:       []OptionFunc{WithServerHeader(""), WithPoweredByHeader("")},
+			path:       "/get",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "handler may still set suppressed header",
+			opts:       []OptionFunc{WithServerHeader("")},
+			path:       "/response-headers?Server=explicit",
+			wantStatus: http.StatusOK,
+			wantServer: []string{"explicit"},
+		},
+		{
+			name:       "per-request override",
+			opts:       []OptionFunc{WithServerHeader("nginx")},
+			path:       "/response-headers?server_header=Microsoft-IIS/10.0",
+			wantStatus: http.StatusOK,
+			wantServer: []string{"Microsoft-IIS/10.0"},
+		},
+		{
+			name:       "per-request override takes precedence over Server param",
+			path:       "/response-headers?server_header=nginx&Server=other",
+			wantStatus: http.StatusOK,
+			wantServer: []string{"nginx"},
+		},
+		{
+			name:          "per-request suppression",
+			opts:          []OptionFunc{WithServerHeader("nginx"), WithPoweredByHeader("ASP.NET")},
+			path:          "/response-headers?server_header=",
+			wantStatus:    http.StatusOK,
+			wantPoweredBy: []string{"ASP.NET"},
+		},
+		{
+			name:       "invalid option values are ignored",
+			opts:       []OptionFunc{WithServerHeader("nginx\r\nSet-Cookie: x=y"), WithPoweredByHeader("PHP\x00")},
+			path:       "/get",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid option value keeps earlier value",
+			opts:       []OptionFunc{WithServerHeader("nginx"), WithServerHeader("bad\nvalue")},
+			path:       "/get",
+			wantStatus: http.StatusOK,
+			wantServer: []string{"nginx"},
+		},
+		{
+			name:       "per-request override rejects header injection",
+			opts:       []OptionFunc{WithServerHeader("nginx")},
+			path:       "/response-headers?server_header=nginx%0d%0aSet-Cookie:%20x=y",
+			wantStatus: http.StatusBadRequest,
+			wantServer: []string{"nginx"},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			resp := doRequest(t, New(tc.opts...), tc.path)
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d", tc.wantStatus, resp.StatusCode)
+			}
+			if got := resp.Header.Values("Server"); !reflect.DeepEqual(got, tc.wantServer) {
+				t.Errorf("expected Server header %q, got %q", tc.wantServer, got)
+			}
+			if got := resp.Header.Values("X-Powered-By"); !reflect.DeepEqual(got, tc.wantPoweredBy) {
+				t.Errorf("expected X-Powered-By header %q, got %q", tc.wantPoweredBy, got)
+			}
+			if resp.Header.Get("Set-Cookie") != "" {
+				t.Errorf("unexpected Set-Cookie header")
+			}
+		})
+	}
+
+}
+
+func TestMethodPolicy(t *testing.T) {
+	t.Parallel()
+
+	app := New(
+		// tighten: /get rejects HEAD, /headers (any method by default) only
+		// allows GET and HEAD, /status/ only allows DELETE
+		WithMethodPolicy("/get", "GET"),
+		WithMethodPolicy("/headers", "GET", "HEAD"),
+		WithMethodPolicy("/status/", "DELETE"),
+		// loosen: /statuses (GET by default) allows POST
+		WithMethodPolicy("/statuses", "GET", "HEAD", "POST"),
+		// repeating an identical policy is not a conflict
+		WithMethodPolicy("/statuses", "GET", "HEAD", "POST"),
+	)
+
+	doRequest := func(method, path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		method    string
+		path      string
+		wantCode  int
+		wantAllow string
+	}{
+		{"GET", "/get", http.StatusOK, ""},
+		{"HEAD", "/get", http.StatusMethodNotAllowed, "GET, OPTIONS"},
+		{"POST", "/get", http.StatusMethodNotAllowed, "GET, OPTIONS"},
+		{"HEAD", "/headers", http.StatusOK, ""},
+		{"POST", "/headers", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"DELETE", "/status/418", 418, ""},
+		{"GET", "/status/418", http.StatusMethodNotAllowed, "DELETE, OPTIONS"},
+		{"POST", "/statuses", http.StatusOK, ""},
+		{"PUT", "/statuses", http.StatusMethodNotAllowed, "GET, HEAD, POST, OPTIONS"},
+
+		// routes without a policy keep their defaults
+		{"HEAD", "/encoding/utf8", http.StatusOK, ""},
+		{"POST", "/encoding/utf8", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"POST", "/anything", http.StatusOK, ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			t.Parallel()
+			w := doRequest(tc.method, tc.path)
+			if w.Code != tc.wantCode {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantCode, w.Code, w.Body.String())
+			}
+			if tc.wantCode != http.StatusMethodNotAllowed {
+				return
+			}
+			if got := w.Header().Get("Allow"); got != tc.wantAllow {
+				t.Errorf("expected Allow %q, got %q", tc.wantAllow, got)
+			}
+			if tc.method == "HEAD" {
+				return
+			}
+			var resp errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(resp.AllowedMethods, ", "); got != tc.wantAllow {
+				t.Errorf("expected allowed_methods %q, got %q", tc.wantAllow, got)
+			}
+		})
+	}
+
+	t.Run("OPTIONS", func(t *testing.T) {
+		t.Parallel()
+		for path, want := range map[string]string{
+			"/get":        "GET, OPTIONS",
+			"/status/200": "DELETE, OPTIONS",
+			"/statuses":   "GET, HEAD, POST, OPTIONS",
+			"/user-agent": serverMethods,
+		} {
+			w := doRequest("OPTIONS", path)
+			if w.Code != http.StatusOK {
+				t.Fatalf("OPTIONS %s: expected 200, got %d", path, w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != want {
+				t.Errorf("OPTIONS %s: expected Access-Control-Allow-Methods %q, got %q", path, want, got)
+			}
+		}
+	})
+
+	t.Run("example requests", func(t *testing.T) {
+		t.Parallel()
+		for _, ex := range app.exampleRequests() {
+			if ex.Route == "/status/" && ex.Method != "DELETE" {
+				t.Errorf("expected /status/ example to use DELETE, got %s", ex.Method)
+			}
+		}
+	})
+
+	t.Run("invalid policies", func(t *testing.T) {
+		t.Parallel()
+		for name, opts := range map[string][]OptionFunc{
+			"unknown pattern":  {WithMethodPolicy("/nope", "GET")},
+			"missing slash":    {WithMethodPolicy("/status", "GET")},
+			"no methods":       {WithMethodPolicy("/get")},
+			"invalid method":   {WithMethodPolicy("/get", "GET, POST")},
+			"conflict":         {WithMethodPolicy("/get", "GET"), WithMethodPolicy("/get", "POST")},
+			"optional, absent": {WithMethodPolicy("/sign", "POST")},
+		} {
+			if err := Validate(opts...); err == nil {
+				t.Errorf("%s: expected Validate to return an error", name)
+			}
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("%s: expected New to panic", name)
+					}
+				}()
+				New(opts...)
+			}()
+		}
+	})
+
+	t.Run("valid policies", func(t *testing.T) {
+		t.Parallel()
+		assertNil(t, Validate(WithSignedURLKey("key", 0), WithMethodPolicy("/sign", "POST")))
+	})
+}
+
+func TestMTLSRequired(t *testing.T) {
+	t.Parallel()
+
+	newCA := func(name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assertNil(t, err)
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		assertNil(t, err)
+		cert, err := x509.ParseCertificate(der)
+		assertNil(t, err)
+		return cert, key
+	}
+	newClientCert := func(ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assertNil(t, err)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "client"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		assertNil(t, err)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	ca, caKey := newCA("trusted")
+	untrustedCA, untrustedKey := newCA("untrusted")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	app := New(WithClientCAs(pool), WithMTLSRequired("/get", "/status/"))
+	srv := httptest.NewUnstartedServer(app)
+	srv.TLS = app.TLSConfig()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		tr := srv.Client().Transport.(*http.Transport).Clone()
+		tr.TLSClientConfig.Certificates = certs
+		return &http.Client{Transport: tr}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		client     *http.Client
+		path       string
+		wantStatus int
+	}{
+		{"no cert, exact route", newClient(), "/get", http.StatusForbidden},
+		{"no cert, prefix route", newClient(), "/status/204", http.StatusForbidden},
+		{"no cert, open route", newClient(), "/headers", http.StatusOK},
+		{"no cert, similar route is open", newClient(), "/get/", http.StatusNotFound},
+		{"trusted cert, exact route", newClient(newClientCert(ca, caKey)), "/get", http.StatusOK},
+		{"trusted cert, prefix route", newClient(newClientCert(ca, caKey)), "/status/204", http.StatusNoContent},
+		{"trusted cert, open route", newClient(newClientCert(ca, caKey)), "/headers", http.StatusOK},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			resp, err := tc.client.Get(srv.URL + tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d", tc.wantStatus, resp.StatusCode)
+			}
+			if tc.wantStatus == http.StatusForbidden {
+				var errResp errorResponse
+				assertNil(t, json.NewDecoder(resp.Body).Decode(&errResp))
+				if !strings.Contains(errResp.Detail, "none was presented") {
+					t.Fatalf("expected explanation of missing certificate, got %q", errResp.Detail)
+				}
+			}
+		})
+	}
+
+	t.Run("untrusted cert fails handshake", func(t *testing.T) {
+		t.Parallel()
+		resp, err := newClient(newClientCert(untrustedCA, untrustedKey)).Get(srv.URL + "/headers")
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("expected handshake to fail, got status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("untrusted cert presented without handshake verification", func(t *testing.T) {
+		t.Parallel()
+		cert, err := x509.ParseCertificate(newClientCert(untrustedCA, untrustedKey).Certificate[0])
+		assertNil(t, err)
+		r, _ := http.NewRequest("GET", "/get", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusForbidden)
+		assertBodyContains(t, w, "requires a verified TLS client certificate")
+	})
+
+	t.Run("plain http", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/get", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusForbidden)
+		assertBodyContains(t, w, "not made over TLS")
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		t.Parallel()
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("expected panic for pattern without leading slash")
+			}
+		}()
+		WithMTLSRequired("get")
+	})
+}
+
+func TestTraceDecision(t *testing.T) {
+	t.Parallel()
+
+	t.Run("default decision", func(t *testing.T) {
+		t.Parallel()
+		var result Result
+		app := New(WithTraceDecision(nil), WithObserver(func(r Result) { result = r }))
+		for _, tc := range []struct {
+			headers map[string]string
+			want    string
+		}{
+			{nil, "false"},
+			{map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, "true"},
+			{map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}, "false"},
+			{map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz"}, "false"},
+			{map[string]string{"Traceparent": "garbage"}, "false"},
+			// traceparent takes precedence over B3 headers
+			{map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "X-B3-Sampled": "1"}, "false"},
+			{map[string]string{"X-B3-Sampled": "1"}, "true"},
+			{map[string]string{"X-B3-Sampled": "true"}, "true"},
+			{map[string]string{"X-B3-Sampled": "0"}, "false"},
+			{map[string]string{"X-B3-Flags": "1"}, "true"},
+		} {
+			r, _ := http.NewRequest("GET", "/get", nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			if got := w.Header().Get("X-Trace-Sampled"); got != tc.want {
+				t.Errorf("headers %v: expected X-Trace-Sampled %q, got %q", tc.headers, tc.want, got)
+			}
+			if got := result.Annotations["trace_sampled"]; got != tc.want {
+				t.Errorf("headers %v: expected trace_sampled annotation %q, got %q", tc.headers, tc.want, got)
+			}
+		}
+	})
+
+	t.Run("custom decision sees route", func(t *testing.T) {
+		t.Parallel()
+		var routes []string
+		app := New(WithTraceDecision(func(r *http.Request) bool {
+			routes = append(routes, RoutePattern(r))
+			return RoutePattern(r) == "/status/" && r.Header.Get("X-Sample-Me") != ""
+		}))
+		for _, tc := range []struct {
+			path   string
+			header string
+			want   string
+		}{
+			{"/status/200", "yes", "true"},
+			{"/status/200", "", "false"},
+			{"/get", "yes", "false"},
+			{"/", "yes", "false"},
+			{"/nonexistent", "yes", "false"},
+		} {
+			r, _ := http.NewRequest("GET", tc.path, nil)
+			if tc.header != "" {
+				r.Header.Set("X-Sample-Me", tc.header)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			assertHeader(t, w, "X-Trace-Sampled", tc.want)
+		}
+		want := []string{"/status/", "/status/", "/get", "/", ""}
+		if !reflect.DeepEqual(routes, want) {
+			t.Fatalf("expected decision function to see routes %q, got %q", want, routes)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/get", nil)
+		r.Header.Set("X-B3-Sampled", "1")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if _, ok := w.Header()["X-Trace-Sampled"]; ok {
+			t.Fatalf("expected no X-Trace-Sampled header without WithTraceDecision")
+		}
+	})
+}
+
+func TestRouteTags(t *testing.T) {
+	t.Parallel()
+	app := New(
+		WithSignedURLKey("key", 0),
+		WithAdminAPI("admin"),
+		WithSelfTestToken("selftest"),
+		WithOIDCSimulator("https://issuer.example"),
+	)
+	for _, rt := range app.routes() {
+		if len(rt.tags) == 0 {
+			t.Errorf("route %s has no tags", rt.pattern)
+		}
+		for _, tag := range rt.tags {
+			if _, ok := routeTags[tag]; !ok {
+				t.Errorf("route %s has unknown tag %q", rt.pattern, tag)
+			}
+		}
+	}
+}
+
+func TestExcludedTags(t *testing.T) {
+	t.Parallel()
+	app := New(WithExcludedTags("hijacks-connection"))
+
+	for _, path := range []string{"/truncate", "/header-case"} {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusNotFound)
+	}
+
+	r, _ := http.NewRequest("GET", "/get", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	assertStatusCode(t, w, http.StatusOK)
+
+	for _, rt := range app.routes() {
+		if app.isExcluded(rt) {
+			t.Errorf("excluded route %s is still registered", rt.pattern)
+		}
+	}
+
+	t.Run("index omits excluded endpoints", func(t *testing.T) {
+		t.Parallel()
+		r, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		assertStatusCode(t, w, http.StatusOK)
+		if strings.Contains(w.Body.String(), "<code>/header-case") {
+			t.Errorf("expected index to omit /header-case")
+		}
+		assertBodyContains(t, w, "<code>/get</code>")
+	})
+
+	t.Run("unknown tag", func(t *testing.T) {
+		t.Parallel()
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatalf("expected panic for unknown tag")
+			}
+		}()
+		WithExcludedTags("nope")
+	})
+}
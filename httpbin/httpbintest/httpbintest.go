@@ -0,0 +1,166 @@
+// Package httpbintest smoke tests a deployed go-httpbin instance over the
+// network, by making the canonical example request for each of its endpoints
+// and checking that each responds with the expected status.
+//
+// The example requests come from the same route table that drives the
+// instance itself (see httpbin.ExampleRequests), so the smoke test stays in
+// sync with the endpoints a given build of go-httpbin exposes.
+package httpbintest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mccutchen/go-httpbin/v2/httpbin"
+)
+
+// Result reports the outcome of a single endpoint's example request.
+type Result struct {
+	// The ServeMux pattern of the endpoint, e.g. "/status/"
+	Route string
+	// The request method and absolute URL
+	Method string
+	URL    string
+
+	// The expected and actual response status, where Status is zero if no
+	// response was received
+	ExpectedStatus int
+	Status         int
+
+	// How long it took to receive and read the complete response
+	Duration time.Duration
+
+	// Whether the endpoint responded as expected. Endpoints that respond with
+	// an unexpected 404 Not Found are assumed to be disabled on the remote
+	// instance (e.g. /sign without a signing key) and are skipped rather than
+	// failed. So are those that respond with an unexpected 405 Method Not
+	// Allowed and are missing from the instance's /index.json, since requests
+	// to disabled endpoints fall through to the index page, which only allows
+	// GET.
+	Passed  bool
+	Skipped bool
+
+	// The transport error, if the request failed
+	Err error
+}
+
+// Failed reports whether the endpoint neither passed nor was skipped.
+func (r Result) Failed() bool {
+	return !r.Passed && !r.Skipped
+}
+
+// VerifyAll makes the example request for every endpoint against the
+// go-httpbin instance at baseURL, which may include a path prefix if the
+// instance is not mounted at the root, and reports one Result per endpoint.
+//
+// Requests are made one at a time and redirects are not followed. An error is
+// returned only if baseURL is invalid or ctx is done before every endpoint
+// has been verified; individual request failures are reported in the
+// results.
+func VerifyAll(ctx context.Context, baseURL string) ([]Result, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q: must be an absolute http or https URL", baseURL)
+	}
+	prefix := strings.TrimSuffix(base.String(), "/")
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	enabled := enabledRoutes(ctx, client, prefix)
+	var results []Result
+	for _, ex := range httpbin.ExampleRequests() {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		results = append(results, verify(ctx, client, prefix, ex, enabled))
+	}
+	return results, nil
+}
+
+// enabledRoutes returns the set of route patterns listed by the remote
+// instance's /index.json, or nil if they cannot be fetched.
+func enabledRoutes(ctx context.Context, client *http.Client, prefix string) map[string]bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", prefix+"/index.json", nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("User-Agent", "go-httpbin-verify")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var index struct {
+		Endpoints []struct {
+			Pattern string `json:"pattern"`
+		} `json:"endpoints"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil
+	}
+	enabled := make(map[string]bool, len(index.Endpoints))
+	for _, endpoint := range index.Endpoints {
+		enabled[endpoint.Pattern] = true
+	}
+	return enabled
+}
+
+func verify(ctx context.Context, client *http.Client, prefix string, ex httpbin.ExampleRequest, enabled map[string]bool) Result {
+	result := Result{
+		Route:          ex.Route,
+		Method:         ex.Method,
+		URL:            prefix + ex.Path,
+		ExpectedStatus: ex.ExpectedStatus,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, ex.Method, result.URL, http.NoBody)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("User-Agent", "go-httpbin-verify")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	result.Duration = time.Since(start)
+	if resp != nil {
+		result.Status = resp.StatusCode
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Passed = result.Status == result.ExpectedStatus
+	switch {
+	case result.Passed:
+	case result.Status == http.StatusNotFound:
+		result.Skipped = true
+	case result.Status == http.StatusMethodNotAllowed:
+		// Only trust a 405 to mean the endpoint is disabled if the instance
+		// says so, since an enabled endpoint could be rejecting the method
+		result.Skipped = enabled != nil && !enabled[ex.Route]
+	}
+	return result
+}
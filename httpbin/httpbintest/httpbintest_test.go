@@ -0,0 +1,161 @@
+package httpbintest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mccutchen/go-httpbin/v2/httpbin"
+)
+
+func TestVerifyAll(t *testing.T) {
+	t.Parallel()
+
+	checkResults := func(t *testing.T, results []Result, wantFailed map[string]bool) {
+		t.Helper()
+		if len(results) != len(httpbin.ExampleRequests()) {
+			t.Fatalf("expected %d results, got %d", len(httpbin.ExampleRequests()), len(results))
+		}
+		for _, result := range results {
+			if result.Failed() != wantFailed[result.Route] {
+				t.Errorf("%s %s: expected failed=%v, got result %+v", result.Method, result.URL, wantFailed[result.Route], result)
+			}
+		}
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(httpbin.New())
+		defer srv.Close()
+
+		results, err := VerifyAll(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkResults(t, results, nil)
+
+		var sawSkipped bool
+		for _, result := range results {
+			if result.Route == "/sign" {
+				sawSkipped = true
+				if !result.Skipped {
+					t.Errorf("expected disabled /sign endpoint to be skipped, got %+v", result)
+				}
+			}
+			if result.Passed && result.Duration <= 0 {
+				t.Errorf("expected positive duration for %s, got %s", result.URL, result.Duration)
+			}
+		}
+		if !sawSkipped {
+			t.Errorf("expected a result for /sign")
+		}
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		t.Parallel()
+		mux := http.NewServeMux()
+		mux.Handle("/httpbin/", http.StripPrefix("/httpbin", httpbin.New()))
+		srv := httptest.NewServer(mux)
+		defer srv.Close()
+
+		results, err := VerifyAll(context.Background(), srv.URL+"/httpbin/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkResults(t, results, nil)
+		if want := srv.URL + "/httpbin/get"; !hasURL(results, want) {
+			t.Errorf("expected a request to %s", want)
+		}
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		t.Parallel()
+		app := httpbin.New()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/get":
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			case "/post":
+				// an enabled endpoint rejecting its example's method
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			app.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+
+		results, err := VerifyAll(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkResults(t, results, map[string]bool{"/get": true, "/post": true})
+	})
+
+	t.Run("405 without index", func(t *testing.T) {
+		t.Parallel()
+		app := httpbin.New()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/index.json" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			app.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+
+		results, err := VerifyAll(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkResults(t, results, map[string]bool{"/sign": true})
+	})
+
+	t.Run("connection refused", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(httpbin.New())
+		srv.Close()
+
+		results, err := VerifyAll(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, result := range results {
+			if result.Err == nil || !result.Failed() || result.Status != 0 {
+				t.Fatalf("expected transport error, got %+v", result)
+			}
+		}
+	})
+
+	t.Run("invalid base URL", func(t *testing.T) {
+		t.Parallel()
+		for _, baseURL := range []string{"", "/httpbin", "ftp://example.com", "http://%zz"} {
+			if _, err := VerifyAll(context.Background(), baseURL); err == nil {
+				t.Errorf("expected error for base URL %q", baseURL)
+			}
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		results, err := VerifyAll(ctx, "http://example.com")
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		if len(results) != 0 {
+			t.Fatalf("expected no results, got %d", len(results))
+		}
+	})
+}
+
+func hasURL(results []Result, u string) bool {
+	for _, result := range results {
+		if result.URL == u {
+			return true
+		}
+	}
+	return false
+}
@@ -1,28 +1,51 @@
 package httpbin
 
 import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func preflight(h http.Handler) http.Handler {
+// Header values shared by every response to avoid allocating new ones for
+// each. Header.Set and Header.Add both replace rather than modify them.
+var (
+	anyOriginHeader        = []string{"*"}
+	allowCredentialsHeader = []string{"true"}
+)
+
+func preflight(optionsHeaders map[string]http.Header, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		if origin == "" {
-			origin = "*"
-		}
 		respHeader := w.Header()
-		respHeader.Set("Access-Control-Allow-Origin", origin)
-		respHeader.Set("Access-Control-Allow-Credentials", "true")
+		if origin := r.Header.Get("Origin"); origin != "" {
+			respHeader.Set("Access-Control-Allow-Origin", origin)
+		} else {
+			respHeader["Access-Control-Allow-Origin"] = anyOriginHeader
+		}
+		respHeader["Access-Control-Allow-Credentials"] = allowCredentialsHeader
 
 		if r.Method == "OPTIONS" {
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, HEAD, PUT, DELETE, PATCH, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Methods", serverMethods)
 			w.Header().Set("Access-Control-Max-Age", "3600")
 			if r.Header.Get("Access-Control-Request-Headers") != "" {
 				w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
 			}
+			for k, v := range routeOptionsHeaders(optionsHeaders, r.URL.Path) {
+				w.Header()[k] = v
+			}
 			w.WriteHeader(200)
 			return
 		}
@@ -31,24 +54,170 @@ func preflight(h http.Handler) http.Handler {
 	})
 }
 
+// routeOptionsHeaders finds the OPTIONS headers for the route that would
+// serve path, matching patterns the way ServeMux does: exactly, or by the
+// longest pattern ending in a slash that prefixes path.
+func routeOptionsHeaders(optionsHeaders map[string]http.Header, path string) http.Header {
+	if hdr, ok := optionsHeaders[path]; ok {
+		return hdr
+	}
+	var match string
+	for pattern := range optionsHeaders {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > len(match) {
+			match = pattern
+		}
+	}
+	return optionsHeaders[match]
+}
+
+// requireClientCert rejects requests to paths matching any of the given
+// ServeMux patterns with 403 Forbidden unless they were made over TLS with a
+// client certificate chain that passes verify.
+func requireClientCert(patterns []string, verify func([]*x509.Certificate) error, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !matchesPattern(patterns, r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var err error
+		switch {
+		case r.TLS == nil:
+			err = fmt.Errorf("%s requires a TLS client certificate, but the request was not made over TLS", r.URL.Path)
+		case len(r.TLS.PeerCertificates) == 0:
+			err = fmt.Errorf("%s requires a TLS client certificate, but none was presented", r.URL.Path)
+		default:
+			if verr := verify(r.TLS.PeerCertificates); verr != nil {
+				err = fmt.Errorf("%s requires a verified TLS client certificate: %w", r.URL.Path, verr)
+			}
+		}
+		if err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// matchesPattern reports whether any of the given ServeMux patterns would
+// match path, either exactly or as a prefix ending in a slash.
+func matchesPattern(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if path == pattern || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverMethods summarizes the methods supported across all endpoints.
+const serverMethods = "GET, POST, HEAD, PUT, DELETE, PATCH, OPTIONS"
+
+// serverOptions answers asterisk-form OPTIONS requests (OPTIONS * HTTP/1.1),
+// which apply to the server as a whole and cannot be routed by ServeMux,
+// with the server-wide methods and enabled capabilities.
+func serverOptions(capabilities []string, h http.Handler) http.Handler {
+	capabilitiesHeader := strings.Join(capabilities, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "OPTIONS" || r.RequestURI != "*" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", serverMethods)
+		if capabilitiesHeader != "" {
+			w.Header().Set("X-Server-Capabilities", capabilitiesHeader)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// identityHeaders presets the configured Server and X-Powered-By headers on
+// every response, before handlers (e.g. /response-headers) get a chance to
+// override them. Suppressed headers are preset to nil, which keeps net/http
+// from writing them.
+func identityHeaders(headers http.Header, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header()[k] = v
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func methods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
-	methodMap := make(map[string]struct{}, len(methods))
+	var allowed []string
 	for _, m := range methods {
-		methodMap[m] = struct{}{}
+		allowed = append(allowed, m)
 		// GET implies support for HEAD
 		if m == "GET" {
-			methodMap["HEAD"] = struct{}{}
+			allowed = append(allowed, "HEAD")
 		}
 	}
+	return exactMethods(h, allowed...)
+}
+
+// exactMethods is like methods, except that GET does not imply HEAD, so that
+// WithMethodPolicy may reject HEAD requests.
+func exactMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allowed := allowedMethods(methods)
+	methodMap := make(map[string]struct{}, len(allowed))
+	for _, m := range allowed {
+		methodMap[m] = struct{}{}
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		if _, ok := methodMap[r.Method]; !ok {
-			http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeJSON(http.StatusMethodNotAllowed, w, errorResponse{
+				StatusCode:     http.StatusMethodNotAllowed,
+				Error:          http.StatusText(http.StatusMethodNotAllowed),
+				Detail:         fmt.Sprintf("method %s not allowed", r.Method),
+				AllowedMethods: allowed,
+			})
 			return
 		}
 		h.ServeHTTP(w, r)
 	}
 }
 
+// allowedMethods returns the given methods plus OPTIONS, which is always
+// handled by the preflight middleware.
+func allowedMethods(methods []string) []string {
+	allowed := make([]string, 0, len(methods)+1)
+	for _, m := range methods {
+		if m != "OPTIONS" {
+			allowed = append(allowed, m)
+		}
+	}
+	return append(allowed, "OPTIONS")
+}
+
+// usageNotFound returns a handler that responds with a 404 explaining the
+// correct URL form for an endpoint, for requests that omit its required path
+// parameters (e.g. /delay instead of /delay/{duration}).
+func usageNotFound(usage string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("go-httpbin does not handle the path %s, use %s", r.URL.Path, usage))
+	}
+}
+
+// limitURLLength rejects requests whose URLs, as sent by the client, are
+// longer than maxLength with 414 URI Too Long, before their bodies are read.
+func limitURLLength(maxLength int, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if length := requestURLLength(r); length > maxLength {
+			writeJSON(http.StatusRequestURITooLong, w, errorResponse{
+				StatusCode:   http.StatusRequestURITooLong,
+				Error:        http.StatusText(http.StatusRequestURITooLong),
+				Detail:       fmt.Sprintf("URL length of %d exceeds the limit of %d", length, maxLength),
+				URLLength:    length,
+				MaxURLLength: maxLength,
+			})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func limitRequestSize(maxSize int64, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Body != nil {
@@ -102,6 +271,10 @@ func (mw *metaResponseWriter) Flush() {
 	f.Flush()
 }
 
+func (mw *metaResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(mw.w)
+}
+
 func (mw *metaResponseWriter) Header() http.Header {
 	return mw.w.Header()
 }
@@ -117,32 +290,587 @@ func (mw *metaResponseWriter) Size() int64 {
 	return mw.size
 }
 
-func observe(o Observer, h http.Handler) http.Handler {
+// hijack hijacks the connection underlying w, if it supports doing so.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+// canonicalJSONResponseWriter implements http.ResponseWriter, http.Flusher,
+// and http.Hijacker in order to mark responses whose JSON bodies writeJSON
+// should render in canonical form.
+type canonicalJSONResponseWriter struct {
+	w http.ResponseWriter
+}
+
+func (cw *canonicalJSONResponseWriter) Write(b []byte) (int, error) {
+	return cw.w.Write(b)
+}
+
+func (cw *canonicalJSONResponseWriter) WriteHeader(s int) {
+	cw.w.WriteHeader(s)
+}
+
+func (cw *canonicalJSONResponseWriter) Flush() {
+	f := cw.w.(http.Flusher)
+	f.Flush()
+}
+
+func (cw *canonicalJSONResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(cw.w)
+}
+
+func (cw *canonicalJSONResponseWriter) Header() http.Header {
+	return cw.w.Header()
+}
+
+// canonicalJSON renders JSON responses in canonical form when requested via
+// a ?canonical= query param, or by default if enabledByDefault is true. It
+// must wrap the handlers themselves, so that writeJSON sees its marker.
+func canonicalJSON(enabledByDefault bool, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enabled := enabledByDefault
+		if raw := r.URL.Query().Get("canonical"); raw != "" {
+			var err error
+			enabled, err = strconv.ParseBool(raw)
+			if err != nil {
+				writeParamError(w, "canonical", errors.New("must be true or false"))
+				return
+			}
+		}
+		if enabled {
+			w = &canonicalJSONResponseWriter{w: w}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serverTimingResponseWriter implements http.ResponseWriter and http.Flusher
+// in order to add a Server-Timing header containing the phases a handler
+// recorded before writing its response.
+type serverTimingResponseWriter struct {
+	w      http.ResponseWriter
+	timing *timingRecorder
+
+	wroteHeader bool
+	sent        int
+}
+
+func (tw *serverTimingResponseWriter) WriteHeader(s int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		var value string
+		value, tw.sent = tw.timing.serverTiming(0)
+		if value != "" {
+			tw.w.Header().Set("Server-Timing", value)
+		}
+	}
+	tw.w.WriteHeader(s)
+}
+
+func (tw *serverTimingResponseWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+func (tw *serverTimingResponseWriter) Flush() {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	f := tw.w.(http.Flusher)
+	f.Flush()
+}
+
+func (tw *serverTimingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(tw.w)
+}
+
+func (tw *serverTimingResponseWriter) Header() http.Header {
+	return tw.w.Header()
+}
+
+// serverTiming attaches a timingRecorder to each request, reporting phases
+// recorded before the response headers are written in a Server-Timing header
+// and any phases recorded afterwards in a Server-Timing trailer (which will
+// only be delivered to clients if the response is chunked or sent over
+// HTTP/2).
+func serverTiming(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing := &timingRecorder{}
+		r = r.WithContext(context.WithValue(r.Context(), timingRecorderKey{}, timing))
+		tw := &serverTimingResponseWriter{w: w, timing: timing}
+		h.ServeHTTP(tw, r)
+
+		if !tw.wroteHeader {
+			tw.WriteHeader(http.StatusOK)
+			return
+		}
+		if value, _ := timing.serverTiming(tw.sent); value != "" {
+			w.Header().Set(http.TrailerPrefix+"Server-Timing", value)
+		}
+	})
+}
+
+// loadSignals tracks the number of in-flight requests and reports it, along
+// with the time a request spent queued before handling began, via response
+// headers.
+func loadSignals(inflight *int64, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		n := atomic.AddInt64(inflight, 1)
+		defer atomic.AddInt64(inflight, -1)
+
+		w.Header().Set("X-Inflight-Requests", strconv.FormatInt(n, 10))
+		if conn := getConnInfo(r); conn != nil {
+			wait := conn.queueWait(start)
+			w.Header().Set("X-Queue-Wait-Ms", strconv.FormatFloat(wait.Seconds()*1e3, 'f', 3, 64))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type requestTimesKey struct{}
+
+// requestTimes records the monotonic clock readings that divide a request's
+// lifetime into the phases reported by RequestTiming.
+type requestTimes struct {
+	mu           sync.Mutex
+	arrival      time.Time
+	handlerStart time.Time
+	headerWrite  time.Time
+}
+
+func getRequestTimes(r *http.Request) *requestTimes {
+	t, _ := r.Context().Value(requestTimesKey{}).(*requestTimes)
+	return t
+}
+
+func (t *requestTimes) markHandlerStart(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlerStart = now
+}
+
+func (t *requestTimes) markHeaderWrite(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.headerWrite.IsZero() {
+		t.headerWrite = now
+	}
+}
+
+// phases divides the time from arrival until end into phases. Phases that
+// have not begun by end, or that were skipped because a middleware responded
+// without invoking any handler, have zero duration.
+func (t *requestTimes) phases(end time.Time) RequestTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	handlerStart, headerWrite := t.handlerStart, t.headerWrite
+	if handlerStart.IsZero() {
+		handlerStart = t.arrival
+	}
+	if headerWrite.IsZero() {
+		headerWrite = end
+	}
+	return RequestTiming{
+		Queue:   handlerStart.Sub(t.arrival),
+		Handler: headerWrite.Sub(handlerStart),
+		Write:   end.Sub(headerWrite),
+	}
+}
+
+// formatRequestTiming formats timing in the style of a Server-Timing header,
+// omitting the write phase if it is incomplete.
+func formatRequestTiming(timing RequestTiming, complete bool) string {
+	format := func(name string, d time.Duration) string {
+		return name + ";dur=" + strconv.FormatFloat(d.Seconds()*1e3, 'f', 3, 64)
+	}
+	value := format("queue", timing.Queue) + ", " + format("handler", timing.Handler)
+	if complete {
+		value += ", " + format("write", timing.Write)
+	}
+	return value
+}
+
+// requestTiming stamps each request with its arrival time, as early as
+// possible, and reports the time it spent queued, in its handler, and writing
+// its response via an X-Timing header (with the write phase, which is only
+// known once the handler returns, in an X-Timing trailer) and to the
+// Observer. markHandlerStart must wrap the handler itself.
+func requestTiming(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		times := &requestTimes{arrival: time.Now()}
+		if conn := getConnInfo(r); conn != nil {
+			if accepted, ok := conn.firstArrival(); ok {
+				times.arrival = accepted
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestTimesKey{}, times))
+		tw := &requestTimingResponseWriter{w: w, times: times}
+		h.ServeHTTP(tw, r)
+
+		if tw.hijacked {
+			return
+		}
+		if !tw.wroteHeader {
+			tw.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set(http.TrailerPrefix+"X-Timing", formatRequestTiming(times.phases(time.Now()), true))
+	})
+}
+
+// markHandlerStart records when handling of a request proper begins, for
+// requestTiming.
+func markHandlerStart(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if times := getRequestTimes(r); times != nil {
+			times.markHandlerStart(time.Now())
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestTimingResponseWriter implements http.ResponseWriter, http.Flusher,
+// and http.Hijacker in order to record when the response headers are written
+// and report the phases up to that point in an X-Timing header.
+type requestTimingResponseWriter struct {
+	w     http.ResponseWriter
+	times *requestTimes
+
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (tw *requestTimingResponseWriter) WriteHeader(s int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		now := time.Now()
+		tw.times.markHeaderWrite(now)
+		tw.w.Header().Set("X-Timing", formatRequestTiming(tw.times.phases(now), false))
+	}
+	tw.w.WriteHeader(s)
+}
+
+func (tw *requestTimingResponseWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+func (tw *requestTimingResponseWriter) Flush() {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	f := tw.w.(http.Flusher)
+	f.Flush()
+}
+
+func (tw *requestTimingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.hijacked = true
+	return hijack(tw.w)
+}
+
+func (tw *requestTimingResponseWriter) Header() http.Header {
+	return tw.w.Header()
+}
+
+// Feature flags that clients may toggle per request
+const (
+	featureErrorClassHeader = "error-class-header"
+	featureLoadSignals      = "load-signals"
+	featureServerTiming     = "server-timing"
+)
+
+type featuresKey struct{}
+
+// features applies any per-request overrides of the instance-wide feature
+// flags given in the X-Httpbin-Features request header. Only flags present in
+// defaults may be overridden; anything else in the header is ignored. When
+// overrides are requested, the effective flags are reported in the
+// X-Httpbin-Features-Applied response header.
+func features(defaults map[string]bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.Header.Get("X-Httpbin-Features")
+		if raw == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		flags := parseFeatureOverrides(defaults, raw)
+		w.Header().Set("X-Httpbin-Features-Applied", formatFeatures(flags))
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), featuresKey{}, flags)))
+	})
+}
+
+// parseFeatureOverrides applies a comma-separated list of "name" or
+// "name=value" overrides to a copy of defaults, where value is a boolean or
+// on/off.
+func parseFeatureOverrides(defaults map[string]bool, raw string) map[string]bool {
+	flags := make(map[string]bool, len(defaults))
+	for name, enabled := range defaults {
+		flags[name] = enabled
+	}
+	for _, entry := range strings.Split(raw, ",") {
+		name, value := strings.TrimSpace(entry), "true"
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+		}
+		name = strings.ToLower(name)
+		if _, ok := defaults[name]; !ok {
+			continue
+		}
+		switch value = strings.ToLower(value); value {
+		case "on":
+			flags[name] = true
+		case "off":
+			flags[name] = false
+		default:
+			if enabled, err := strconv.ParseBool(value); err == nil {
+				flags[name] = enabled
+			}
+		}
+	}
+	return flags
+}
+
+// formatFeatures lists every flag and its state, sorted by name.
+func formatFeatures(flags map[string]bool) string {
+	entries := make([]string, 0, len(flags))
+	for name, enabled := range flags {
+		entries = append(entries, name+"="+strconv.FormatBool(enabled))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ", ")
+}
+
+// featureEnabled reports whether the named feature flag is in effect for the
+// request, given whether it is enabled instance-wide.
+func featureEnabled(r *http.Request, name string, enabledByDefault bool) bool {
+	if flags, ok := r.Context().Value(featuresKey{}).(map[string]bool); ok {
+		return flags[name]
+	}
+	return enabledByDefault
+}
+
+// featureGate routes each request to on or off depending on whether the
+// named feature flag is in effect for it.
+func featureGate(name string, defaults map[string]bool, on, off http.Handler) http.Handler {
+	enabledByDefault := defaults[name]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if featureEnabled(r, name, enabledByDefault) {
+			on.ServeHTTP(w, r)
+		} else {
+			off.ServeHTTP(w, r)
+		}
+	})
+}
+
+func observe(o Observer, mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		if mux != nil {
+			route = matchedPattern(mux, r)
+		}
 		mw := &metaResponseWriter{w: w}
+		body := countBody(r)
+		a := &annotations{}
+		ec := &errorClassHolder{}
+		ctx := context.WithValue(r.Context(), annotationsKey{}, a)
+		r = r.WithContext(context.WithValue(ctx, errorClassKey{}, ec))
 		t := time.Now()
 		h.ServeHTTP(mw, r)
+		var errorClass string
+		if mw.Status() >= 500 {
+			errorClass = ec.get()
+		}
+		var timing *RequestTiming
+		if times := getRequestTimes(r); times != nil {
+			phases := times.phases(time.Now())
+			timing = &phases
+		}
 		o(Result{
-			Status:    mw.Status(),
-			Method:    r.Method,
-			URI:       r.URL.RequestURI(),
-			Size:      mw.Size(),
-			Duration:  time.Since(t),
-			UserAgent: r.Header.Get("User-Agent"),
-			ClientIP:  getClientIP(r),
+			Status:      mw.Status(),
+			Method:      r.Method,
+			URI:         r.URL.RequestURI(),
+			Size:        mw.Size(),
+			RequestSize: body.n,
+			Duration:    time.Since(t),
+			UserAgent:   r.Header.Get("User-Agent"),
+			ClientIP:    getClientIP(r),
+			Route:       route,
+			ErrorClass:  errorClass,
+			Annotations: a.snapshot(),
+			Timing:      timing,
 		})
 	})
 }
 
 // Result is the result of handling a request, used for instrumentation
 type Result struct {
-	Status    int
-	Method    string
-	URI       string
-	Size      int64
-	Duration  time.Duration
+	Status   int
+	Method   string
+	URI      string
+	Size     int64
+	Duration time.Duration
+
+	// RequestSize is the number of request body bytes read by the handler
+	RequestSize int64
+
 	UserAgent string
 	ClientIP  string
+
+	// Route is the pattern of the route that handled the request (e.g.
+	// "/status/"), or empty if the request matched no route.
+	Route string
+
+	// ErrorClass explains why a 5xx response was returned (one of the
+	// ErrorClass* constants), or is empty for other responses.
+	ErrorClass string
+
+	// Annotations holds any key/value pairs attached to the request by its
+	// handler via Annotate, or nil if there were none.
+	Annotations map[string]string
+
+	// Timing breaks the request's lifetime down into phases, or is nil
+	// unless the instance was created with WithRequestTiming.
+	Timing *RequestTiming
+}
+
+// RequestTiming divides the time between a request's arrival and the end of
+// its handling into consecutive phases.
+type RequestTiming struct {
+	// Queue is the time between the request's arrival and its handler
+	// starting. The first request on a connection arrives when the
+	// connection is accepted if the server uses HTTPBin.ConnContext, so that
+	// time spent waiting in the accept loop is included.
+	Queue time.Duration
+
+	// Handler is the time between the handler starting and the response
+	// headers being written.
+	Handler time.Duration
+
+	// Write is the time between the response headers being written and the
+	// handler returning.
+	Write time.Duration
+}
+
+type annotationsKey struct{}
+
+// annotations collects the key/value pairs attached to a single request.
+type annotations struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (a *annotations) set(key, value string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.values == nil {
+		a.values = make(map[string]string)
+	}
+	a.values[key] = value
+}
+
+func (a *annotations) snapshot() map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.values) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(a.values))
+	for k, v := range a.values {
+		values[k] = v
+	}
+	return values
+}
+
+// Annotate attaches a key/value pair to the request associated with ctx,
+// which will be reported to the Observer in the request's Result. Annotating
+// a key more than once keeps the last value. It is a no-op if no Observer is
+// configured.
+func Annotate(ctx context.Context, key, value string) {
+	if a, ok := ctx.Value(annotationsKey{}).(*annotations); ok {
+		a.set(key, value)
+	}
+}
+
+type routePatternKey struct{}
+
+// RoutePattern returns the ServeMux pattern of the route that will handle r
+// (e.g. "/status/"), or an empty string if r matches no route or its route
+// is unknown. The route is known to route handlers and to decision functions
+// given to WithTraceDecision.
+func RoutePattern(r *http.Request) string {
+	pattern, _ := r.Context().Value(routePatternKey{}).(string)
+	return pattern
+}
+
+// withRoutePattern makes the pattern h is registered under available to it
+// via RoutePattern.
+func withRoutePattern(pattern string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RoutePattern(r) != pattern {
+			r = r.WithContext(context.WithValue(r.Context(), routePatternKey{}, pattern))
+		}
+		h(w, r)
+	}
+}
+
+// matchedPattern returns the pattern of the route in mux that will handle r,
+// treating requests that only fall through to the index route as unmatched.
+func matchedPattern(mux *http.ServeMux, r *http.Request) string {
+	_, pattern := mux.Handler(r)
+	if pattern == "/" && r.URL.Path != "/" {
+		return ""
+	}
+	return pattern
+}
+
+// DefaultTraceDecision is the sampling decision used by WithTraceDecision
+// when no decision function is given. It samples requests whose W3C
+// traceparent header has the sampled flag set, or, absent a traceparent,
+// whose X-B3-Sampled header is "1" or "true" or whose X-B3-Flags header
+// requests debug tracing.
+func DefaultTraceDecision(r *http.Request) bool {
+	if tp := r.Header.Get("Traceparent"); tp != "" {
+		// version-traceid-parentid-flags, e.g.
+		// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+		parts := strings.Split(tp, "-")
+		if len(parts) < 4 || len(parts[3]) != 2 {
+			return false
+		}
+		flags, err := strconv.ParseUint(parts[3], 16, 8)
+		return err == nil && flags&1 == 1
+	}
+	if r.Header.Get("X-B3-Flags") == "1" {
+		return true
+	}
+	switch strings.ToLower(r.Header.Get("X-B3-Sampled")) {
+	case "1", "true":
+		return true
+	}
+	return false
+}
+
+// traceDecision reports the sampling decision made by decide for each
+// request in an X-Trace-Sampled response header and a trace_sampled
+// annotation. The request's route pattern is available to decide via
+// RoutePattern.
+func traceDecision(decide func(*http.Request) bool, mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pattern := matchedPattern(mux, r)
+		r = r.WithContext(context.WithValue(r.Context(), routePatternKey{}, pattern))
+		sampled := strconv.FormatBool(decide(r))
+		w.Header().Set("X-Trace-Sampled", sampled)
+		Annotate(r.Context(), "trace_sampled", sampled)
+		h.ServeHTTP(w, r)
+	})
 }
 
 // Observer is a function that will be called with the details of a handled
@@ -157,8 +885,25 @@ func StdLogObserver(l *log.Logger) Observer {
 		dateFmt = "2006-01-02T15:04:05.9999"
 	)
 	return func(result Result) {
+		var extra strings.Builder
+		if result.ErrorClass != "" {
+			fmt.Fprintf(&extra, " error_class=%q", result.ErrorClass)
+		}
+		if t := result.Timing; t != nil {
+			fmt.Fprintf(&extra, " queue_ms=%0.03f handler_ms=%0.03f write_ms=%0.03f", t.Queue.Seconds()*1e3, t.Handler.Seconds()*1e3, t.Write.Seconds()*1e3)
+		}
+
+		keys := make([]string, 0, len(result.Annotations))
+		for k := range result.Annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&extra, " %s=%q", k, result.Annotations[k])
+		}
+
 		l.Printf(
-			logFmt,
+			logFmt+"%s",
 			time.Now().Format(dateFmt),
 			result.Status,
 			result.Method,
@@ -167,6 +912,525 @@ func StdLogObserver(l *log.Logger) Observer {
 			result.Duration.Seconds()*1e3, // https://github.com/golang/go/issues/5491#issuecomment-66079585
 			result.UserAgent,
 			result.ClientIP,
+			extra.String(),
 		)
 	}
 }
+
+// asyncObserver delivers results to an Observer from a single goroutine, in
+// the order they were queued, so that a slow Observer does not hold up the
+// requests it is observing. Results that arrive while the queue is full, or
+// after the asyncObserver is closed, are dropped and counted.
+type asyncObserver struct {
+	o       Observer
+	results chan Result
+	done    chan struct{}
+	dropped byteCounter
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newAsyncObserver(o Observer, buffer int) *asyncObserver {
+	a := &asyncObserver{
+		o:       o,
+		results: make(chan Result, buffer),
+		done:    make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncObserver) run() {
+	defer close(a.done)
+	for result := range a.results {
+		a.o(result)
+	}
+}
+
+// observe queues result for delivery without blocking.
+func (a *asyncObserver) observe(result Result) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.dropped.add(1)
+		return
+	}
+	select {
+	case a.results <- result:
+	default:
+		a.dropped.add(1)
+	}
+}
+
+// close stops accepting results and waits for those already queued to be
+// delivered.
+func (a *asyncObserver) close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.results)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+func (a *asyncObserver) stats() *observerStats {
+	return &observerStats{
+		Buffer:  cap(a.results),
+		Queued:  len(a.results),
+		Dropped: a.dropped.load(),
+	}
+}
+
+func (a *asyncObserver) reset() {
+	atomic.StoreUint64(&a.dropped.n, 0)
+}
+
+// metricsBuckets are the upper bounds, in seconds, of the buckets of the
+// request latency histograms exposed at /metrics, matching the default
+// buckets of the Prometheus client libraries.
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsMethods are the request methods given their own label value in
+// /metrics; any other method is counted as "OTHER", so that clients cannot
+// create an unbounded number of series.
+var metricsMethods = map[string]bool{
+	"CONNECT": true, "DELETE": true, "GET": true, "HEAD": true, "OPTIONS": true,
+	"PATCH": true, "POST": true, "PUT": true, "TRACE": true,
+}
+
+type metricsLabels struct {
+	route  string
+	method string
+	code   string
+}
+
+type metricsSeries struct {
+	buckets []uint64 // not cumulative; the last counts values above every bound
+	count   uint64
+	sum     float64
+}
+
+// metricsBytes counts the body bytes transferred by a single route.
+type metricsBytes struct {
+	request  int64
+	response int64
+}
+
+// requestMetrics accumulates the request counts, latency histograms and
+// byte counts exposed at /metrics in the Prometheus text exposition format.
+type requestMetrics struct {
+	mu     sync.Mutex
+	series map[metricsLabels]*metricsSeries
+	bytes  map[string]*metricsBytes // by route
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		series: make(map[metricsLabels]*metricsSeries),
+		bytes:  make(map[string]*metricsBytes),
+	}
+}
+
+// observer returns an Observer that records each result before passing it
+// on to next, if next is not nil.
+func (m *requestMetrics) observer(next Observer) Observer {
+	return func(result Result) {
+		m.record(result)
+		if next != nil {
+			next(result)
+		}
+	}
+}
+
+func (m *requestMetrics) record(result Result) {
+	labels := metricsLabels{
+		route:  result.Route,
+		method: result.Method,
+		code:   strconv.Itoa(result.Status),
+	}
+	if labels.route == "" {
+		labels.route = unmatchedRoute
+	}
+	if !metricsMethods[labels.method] {
+		labels.method = "OTHER"
+	}
+	seconds := result.Duration.Seconds()
+	bucket := sort.SearchFloat64s(metricsBuckets, seconds)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[labels]
+	if !ok {
+		s = &metricsSeries{buckets: make([]uint64, len(metricsBuckets)+1)}
+		m.series[labels] = s
+	}
+	s.buckets[bucket]++
+	s.count++
+	s.sum += seconds
+
+	b, ok := m.bytes[labels.route]
+	if !ok {
+		b = &metricsBytes{}
+		m.bytes[labels.route] = b
+	}
+	b.request += result.RequestSize
+	b.response += result.Size
+}
+
+func (m *requestMetrics) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series = make(map[metricsLabels]*metricsSeries)
+	m.bytes = make(map[string]*metricsBytes)
+}
+
+// writeTo writes every series to w in the Prometheus text exposition format,
+// in a stable order.
+func (m *requestMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	labels := make([]metricsLabels, 0, len(m.series))
+	series := make(map[metricsLabels]metricsSeries, len(m.series))
+	for l, s := range m.series {
+		labels = append(labels, l)
+		snapshot := *s
+		snapshot.buckets = append([]uint64(nil), s.buckets...)
+		series[l] = snapshot
+	}
+	routes := make([]string, 0, len(m.bytes))
+	transferred := make(map[string]metricsBytes, len(m.bytes))
+	for route, b := range m.bytes {
+		routes = append(routes, route)
+		transferred[route] = *b
+	}
+	m.mu.Unlock()
+
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	sort.Strings(routes)
+
+	fmt.Fprint(w, "# HELP httpbin_requests_total Requests handled, by route pattern, method and status code.\n")
+	fmt.Fprint(w, "# TYPE httpbin_requests_total counter\n")
+	for _, l := range labels {
+		fmt.Fprintf(w, "httpbin_requests_total{%s} %d\n", l.format(), series[l].count)
+	}
+	fmt.Fprint(w, "# HELP httpbin_request_duration_seconds Time taken to handle requests, by route pattern, method and status code.\n")
+	fmt.Fprint(w, "# TYPE httpbin_request_duration_seconds histogram\n")
+	for _, l := range labels {
+		s := series[l]
+		var cumulative uint64
+		for i, bound := range metricsBuckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "httpbin_request_duration_seconds_bucket{%s,le=%q} %d\n", l.format(), strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "httpbin_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l.format(), s.count)
+		fmt.Fprintf(w, "httpbin_request_duration_seconds_sum{%s} %s\n", l.format(), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "httpbin_request_duration_seconds_count{%s} %d\n", l.format(), s.count)
+	}
+	fmt.Fprint(w, "# HELP httpbin_request_bytes_total Request body bytes read, by route pattern.\n")
+	fmt.Fprint(w, "# TYPE httpbin_request_bytes_total counter\n")
+	for _, route := range routes {
+		fmt.Fprintf(w, "httpbin_request_bytes_total{route=\"%s\"} %d\n", metricsLabelEscaper.Replace(route), transferred[route].request)
+	}
+	fmt.Fprint(w, "# HELP httpbin_response_bytes_total Response body bytes written, by route pattern.\n")
+	fmt.Fprint(w, "# TYPE httpbin_response_bytes_total counter\n")
+	for _, route := range routes {
+		fmt.Fprintf(w, "httpbin_response_bytes_total{route=\"%s\"} %d\n", metricsLabelEscaper.Replace(route), transferred[route].response)
+	}
+}
+
+// metricsLabelEscaper escapes label values as required by the Prometheus
+// text exposition format.
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (l metricsLabels) format() string {
+	return fmt.Sprintf(`route="%s",method="%s",code="%s"`,
+		metricsLabelEscaper.Replace(l.route),
+		metricsLabelEscaper.Replace(l.method),
+		metricsLabelEscaper.Replace(l.code))
+}
+
+// Error classes explaining why a request resulted in a 5xx response.
+const (
+	// ErrorClassRequested means the client explicitly asked for the error,
+	// e.g. via /status/500.
+	ErrorClassRequested = "requested"
+	// ErrorClassInjected means the error was a fault injected by the
+	// server, e.g. by /unstable.
+	ErrorClassInjected = "injected"
+	// ErrorClassPanic means the handler panicked.
+	ErrorClassPanic = "panic"
+	// ErrorClassTimeout means the request or an operation it depends on
+	// timed out.
+	ErrorClassTimeout = "timeout"
+	// ErrorClassInternal means the handler failed for any other reason.
+	ErrorClassInternal = "internal"
+)
+
+type errorClassKey struct{}
+
+// errorClassHolder records the error class of a single request.
+type errorClassHolder struct {
+	mu    sync.Mutex
+	class string
+}
+
+func (ec *errorClassHolder) get() string {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.class
+}
+
+func (ec *errorClassHolder) set(class string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.class = class
+}
+
+// classifyError records why the request is about to receive a 5xx response.
+// It must be called before the response status is written.
+func classifyError(r *http.Request, class string) {
+	if ec, ok := r.Context().Value(errorClassKey{}).(*errorClassHolder); ok {
+		ec.set(class)
+	}
+}
+
+// errorClasses makes sure that every 5xx response has an error class,
+// defaulting to ErrorClassTimeout or ErrorClassInternal for responses whose
+// handler did not classify them, and turns handler panics into 500 responses
+// classified as ErrorClassPanic. Like net/http, it logs the panic and its
+// stack trace via the standard logger, but it does not send the panic value
+// to the client. If header is true, the class is reported in an
+// X-Error-Class response header.
+func errorClasses(header bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorClassResponseWriter{w: w, header: header}
+		ec, ok := r.Context().Value(errorClassKey{}).(*errorClassHolder)
+		if !ok {
+			ec = &ew.holder
+			r = r.WithContext(context.WithValue(r.Context(), errorClassKey{}, ec))
+		}
+		ew.r, ew.ec = r, ec
+
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// Let net/http handle deliberate aborts, and abort responses
+			// that are already underway since they cannot be replaced
+			if p == http.ErrAbortHandler || ew.wroteHeader {
+				panic(p)
+			}
+			log.Printf("httpbin: panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+			ec.set(ErrorClassPanic)
+			writeError(ew, http.StatusInternalServerError, errors.New("internal server error"))
+		}()
+
+		h.ServeHTTP(ew, r)
+	})
+}
+
+// errorClassResponseWriter implements http.ResponseWriter, http.Flusher, and
+// http.Hijacker in order to classify 5xx responses as they are written.
+type errorClassResponseWriter struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	ec     *errorClassHolder
+	header bool
+
+	// holds the error class when no outer middleware has provided a holder,
+	// saving a separate allocation
+	holder errorClassHolder
+
+	wroteHeader bool
+}
+
+func (ew *errorClassResponseWriter) Header() http.Header {
+	return ew.w.Header()
+}
+
+func (ew *errorClassResponseWriter) WriteHeader(code int) {
+	if !ew.wroteHeader && code >= 500 {
+		class := ew.ec.get()
+		if class == "" {
+			class = ErrorClassInternal
+			if errors.Is(ew.r.Context().Err(), context.DeadlineExceeded) {
+				class = ErrorClassTimeout
+			}
+			ew.ec.set(class)
+		}
+		if ew.header {
+			ew.w.Header().Set("X-Error-Class", class)
+		}
+	}
+	ew.wroteHeader = true
+	ew.w.WriteHeader(code)
+}
+
+func (ew *errorClassResponseWriter) Write(b []byte) (int, error) {
+	ew.wroteHeader = true
+	return ew.w.Write(b)
+}
+
+func (ew *errorClassResponseWriter) Flush() {
+	if f, ok := ew.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (ew *errorClassResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(ew.w)
+}
+
+// countingReadCloser counts the bytes read from a request body.
+type countingReadCloser struct {
+	rc io.ReadCloser
+	n  int64
+}
+
+// countBody replaces the request's body, if any, with one that counts the
+// bytes read from it.
+func countBody(r *http.Request) *countingReadCloser {
+	c := &countingReadCloser{rc: r.Body}
+	if r.Body != nil {
+		r.Body = c
+	}
+	return c
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReadCloser) Close() error {
+	return c.rc.Close()
+}
+
+// byteCounter is a counter that saturates at math.MaxUint64 instead of
+// wrapping around, so that a long-lived instance never reports a total that
+// went backwards.
+type byteCounter struct {
+	n uint64
+}
+
+func (c *byteCounter) add(n int64) {
+	if n <= 0 {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&c.n)
+		sum := old + uint64(n)
+		if sum < old {
+			sum = math.MaxUint64
+		}
+		if atomic.CompareAndSwapUint64(&c.n, old, sum) {
+			return
+		}
+	}
+}
+
+func (c *byteCounter) load() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// trafficCounters accumulates the traffic handled by a single route.
+type trafficCounters struct {
+	requests      byteCounter
+	requestBytes  byteCounter
+	responseBytes byteCounter
+}
+
+func (c *trafficCounters) reset() {
+	atomic.StoreUint64(&c.requests.n, 0)
+	atomic.StoreUint64(&c.requestBytes.n, 0)
+	atomic.StoreUint64(&c.responseBytes.n, 0)
+}
+
+func (c *trafficCounters) snapshot() trafficStats {
+	return trafficStats{
+		Requests:      c.requests.load(),
+		RequestBytes:  c.requestBytes.load(),
+		ResponseBytes: c.responseBytes.load(),
+	}
+}
+
+// unmatchedRoute is the name under which requests that did not match any
+// route are counted.
+const unmatchedRoute = "unmatched"
+
+// routeTraffic accumulates per-route and total traffic. Its set of routes is
+// fixed when it is created, so it may be read without locking.
+type routeTraffic struct {
+	total  trafficCounters
+	routes map[string]*trafficCounters
+}
+
+func newRouteTraffic(routes []route) *routeTraffic {
+	t := &routeTraffic{routes: make(map[string]*trafficCounters, len(routes)+1)}
+	for _, rt := range routes {
+		t.routes[rt.pattern] = &trafficCounters{}
+	}
+	t.routes[unmatchedRoute] = &trafficCounters{}
+	return t
+}
+
+func (t *routeTraffic) record(pattern string, requestBytes, responseBytes int64) {
+	c, ok := t.routes[pattern]
+	if !ok {
+		c = t.routes[unmatchedRoute]
+	}
+	for _, c := range []*trafficCounters{c, &t.total} {
+		c.requests.add(1)
+		c.requestBytes.add(requestBytes)
+		c.responseBytes.add(responseBytes)
+	}
+}
+
+// reset zeroes every counter.
+func (t *routeTraffic) reset() {
+	for _, c := range t.routes {
+		c.reset()
+	}
+	t.total.reset()
+}
+
+// trafficRecorder measures the request and response bodies of a single
+// request for countTraffic.
+type trafficRecorder struct {
+	mw   metaResponseWriter
+	body countingReadCloser
+}
+
+// countTraffic records the request body bytes read and response body bytes
+// written for every request, attributed to the mux route that handles it.
+func countTraffic(traffic *routeTraffic, mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "/" && r.URL.Path != "/" {
+			// The index route is the mux's catch-all, and 404s anything
+			// other than the root itself
+			pattern = unmatchedRoute
+		}
+		// Allocate the response writer and body counter together, since
+		// this runs for every request
+		rec := &trafficRecorder{mw: metaResponseWriter{w: w}}
+		rec.body.rc = r.Body
+		if r.Body != nil {
+			r.Body = &rec.body
+		}
+		h.ServeHTTP(&rec.mw, r)
+		traffic.record(pattern, rec.body.n, rec.mw.Size())
+	})
+}
@@ -1,6 +1,13 @@
 package httpbin
 
-import "time"
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
 
 // OptionFunc uses the "functional options" pattern to customize an HTTPBin
 // instance
@@ -41,9 +48,32 @@ func WithObserver(o Observer) OptionFunc {
 	}
 }
 
+// WithAsyncObserver delivers results to the Observer from a dedicated
+// goroutine through a queue of the given size instead of calling it before
+// each response completes, so that a slow Observer does not add latency to
+// requests. Results that arrive while the queue is full are dropped, and the
+// number dropped is reported by /stats. The instance's Close method must be
+// called to deliver the results still queued and stop the goroutine. It
+// panics if buffer is not positive.
+func WithAsyncObserver(buffer int) OptionFunc {
+	if buffer < 1 {
+		panic("httpbin: async observer buffer must be positive")
+	}
+	return func(h *HTTPBin) {
+		h.asyncObserverBuffer = buffer
+	}
+}
+
 // WithAllowedRedirectDomains limits the domains to which the /redirect-to
-// endpoint will redirect traffic.
+// endpoint will redirect traffic. Each entry is matched as described by
+// MatchRedirectDomain, so "*.example.com" and ".example.com" allow
+// subdomains. It panics if an entry is invalid per ValidateRedirectDomain.
 func WithAllowedRedirectDomains(hosts []string) OptionFunc {
+	for _, host := range hosts {
+		if err := ValidateRedirectDomain(host); err != nil {
+			panic(fmt.Sprintf("httpbin: %s", err))
+		}
+	}
 	return func(h *HTTPBin) {
 		hostSet := make(map[string]struct{}, len(hosts))
 		for _, host := range hosts {
@@ -52,3 +82,360 @@ func WithAllowedRedirectDomains(hosts []string) OptionFunc {
 		h.AllowedRedirectDomains = hostSet
 	}
 }
+
+// WithCanonicalJSON renders every JSON response in canonical form, with
+// object keys sorted lexicographically, fixed indentation and numbers as
+// encoded by encoding/json, so that responses may be compared byte for byte
+// against golden files. Requests may opt out via ?canonical=false; without
+// this option, they may opt in via ?canonical=true.
+func WithCanonicalJSON() OptionFunc {
+	return func(h *HTTPBin) {
+		h.canonicalJSON = true
+	}
+}
+
+// WithServerTiming makes handlers report the durations of the phases of
+// request handling (e.g. reading and parsing the request body, or sleeping in
+// /delay) via the Server-Timing response header.
+func WithServerTiming() OptionFunc {
+	return func(h *HTTPBin) {
+		h.serverTiming = true
+	}
+}
+
+// WithPrometheusMetrics enables the /metrics endpoint, which exposes the
+// number of requests handled and a histogram of their latencies, labeled by
+// route pattern, method and status code, along with the request and response
+// body bytes transferred by each route pattern, in the Prometheus text
+// exposition format. The metrics are recorded independently of any Observer.
+func WithPrometheusMetrics() OptionFunc {
+	return func(h *HTTPBin) {
+		h.metrics = newRequestMetrics()
+	}
+}
+
+// WithLoadSignals adds X-Inflight-Requests and X-Queue-Wait-Ms headers to
+// every response, so that clients with adaptive concurrency controls have a
+// truthful signal of server load to react to.
+//
+// Queue wait times are only reported when the server is configured to use
+// HTTPBin.ConnContext.
+func WithLoadSignals() OptionFunc {
+	return func(h *HTTPBin) {
+		h.loadSignals = true
+	}
+}
+
+// WithMaxEgressConcurrency limits the number of outbound requests the /egress
+// endpoint may have in flight at once. Values below 1 use
+// DefaultMaxEgressConcurrency.
+func WithMaxEgressConcurrency(n int) OptionFunc {
+	return func(h *HTTPBin) {
+		if n < 1 {
+			h.egressSem = nil
+			return
+		}
+		h.egressSem = make(chan struct{}, n)
+	}
+}
+
+// WithSignedURLKey enables the /sign and /signed endpoints, which generate and
+// verify URLs signed with an HMAC of the given key. Clients verifying a signed
+// URL may tolerate up to maxSkew of clock skew via the ?skew= query param.
+// An empty key leaves the endpoints disabled.
+func WithSignedURLKey(key string, maxSkew time.Duration) OptionFunc {
+	return func(h *HTTPBin) {
+		if key == "" {
+			h.signedURLKey = nil
+			return
+		}
+		h.signedURLKey = []byte(key)
+		h.signedURLMaxSkew = maxSkew
+	}
+}
+
+// WithDigestNonceKey sets the key used to sign the nonces issued by
+// /digest-auth. By default each instance generates a random key at startup,
+// so a nonce issued by one replica is rejected by the others and restarting
+// an instance invalidates every outstanding nonce. Replicas behind a load
+// balancer should share a key. An empty key keeps the random default.
+func WithDigestNonceKey(key string) OptionFunc {
+	return func(h *HTTPBin) {
+		if key == "" {
+			h.digestNonceKey = nil
+			return
+		}
+		h.digestNonceKey = []byte(key)
+	}
+}
+
+// WithCanonicalBaseURL makes /get, /anything, and the redirect endpoints emit
+// Content-Location and canonical Link headers giving the absolute URL of the
+// request relative to the given base URL, whose path should be the prefix at
+// which the instance is mounted.
+func WithCanonicalBaseURL(u *url.URL) OptionFunc {
+	return func(h *HTTPBin) {
+		h.canonicalBaseURL = u
+	}
+}
+
+// WithSelfTestToken enables the /selftest endpoint, which exercises every
+// other endpoint and reports the results. Requests to /selftest must present
+// the given token as a bearer token.
+func WithSelfTestToken(token string) OptionFunc {
+	return func(h *HTTPBin) {
+		h.selfTestToken = token
+	}
+}
+
+// WithAdminAPI enables the /admin API, which allows runtime settings to be
+// inspected and changed and stateful stores to be reset without restarting
+// the instance. Requests to the API must present the given token as a bearer
+// token.
+func WithAdminAPI(token string) OptionFunc {
+	return func(h *HTTPBin) {
+		h.adminToken = token
+	}
+}
+
+// WithExcludedTags disables every route with any of the given tags, e.g.
+// "destructive" or "hijacks-connection", so that whole categories of
+// endpoints can be turned off at once. It panics if a tag is invalid per
+// ValidateRouteTag.
+func WithExcludedTags(tags ...string) OptionFunc {
+	for _, tag := range tags {
+		if err := ValidateRouteTag(tag); err != nil {
+			panic(fmt.Sprintf("httpbin: %s", err))
+		}
+	}
+	return func(h *HTTPBin) {
+		if h.excludedTags == nil {
+			h.excludedTags = make(map[string]bool, len(tags))
+		}
+		for _, tag := range tags {
+			h.excludedTags[tag] = true
+		}
+	}
+}
+
+// WithAddressFamilyDelay delays /dualstack responses to requests arriving
+// over the given address family, "ipv4" or "ipv6", so that clients racing
+// both families can be made to observe the other one winning. It panics if
+// the family is unknown or the delay is negative.
+func WithAddressFamilyDelay(family string, delay time.Duration) OptionFunc {
+	if family != "ipv4" && family != "ipv6" {
+		panic(fmt.Sprintf("httpbin: unknown address family %q", family))
+	}
+	if delay < 0 {
+		panic(fmt.Sprintf("httpbin: negative delay %s for address family %s", delay, family))
+	}
+	return func(h *HTTPBin) {
+		if h.familyDelays == nil {
+			h.familyDelays = make(map[string]time.Duration, 2)
+		}
+		h.familyDelays[family] = delay
+	}
+}
+
+// WithOIDCSimulator enables a minimal OpenID Connect provider with the given
+// issuer identifier, which should be the base URL at which the instance is
+// reachable. It serves discovery metadata at
+// /.well-known/openid-configuration, publishes a signing key generated at
+// startup via /jwks.json, and issues tokens signed with it via the client
+// credentials grant at /oauth/token. When the /admin API is also enabled,
+// POST /admin/oidc/rotate-keys replaces the signing key.
+func WithOIDCSimulator(issuer string) OptionFunc {
+	return func(h *HTTPBin) {
+		h.oidcIssuer = strings.TrimSuffix(issuer, "/")
+		h.oidcKeys = newOIDCKeySet()
+	}
+}
+
+// WithErrorClassHeader adds an X-Error-Class header to every 5xx response,
+// explaining whether the error was requested by the client, injected by the
+// server, or caused by a panic, a timeout, or some other internal failure.
+// The same classification is always reported to the Observer.
+func WithErrorClassHeader() OptionFunc {
+	return func(h *HTTPBin) {
+		h.errorClassHeader = true
+	}
+}
+
+// WithRequestTiming stamps each request with its arrival time and reports how
+// long it spent queued before its handler started, in its handler, and
+// writing its response, via the X-Timing response header and trailer and to
+// the Observer as Result.Timing.
+//
+// Arrival times are most accurate when the server is configured to use
+// HTTPBin.ConnContext, in which case time spent waiting to be accepted is
+// attributed to the first request on each connection.
+func WithRequestTiming() OptionFunc {
+	return func(h *HTTPBin) {
+		h.requestTiming = true
+	}
+}
+
+// WithFeatureFlags sets the instance-wide state of the named feature flags,
+// taking precedence over any earlier options that enable the same features.
+// The supported flags are "error-class-header", "load-signals", and
+// "server-timing", equivalent to WithErrorClassHeader, WithLoadSignals, and
+// WithServerTiming; unknown flags are ignored.
+//
+// Clients may override these flags for a single request via the
+// X-Httpbin-Features request header, e.g. "server-timing, load-signals=false",
+// and the effective flags are reported in the X-Httpbin-Features-Applied
+// response header. Options affecting the instance's security posture, such as
+// the admin API or the redirect allow-list, are not feature flags and cannot
+// be overridden.
+func WithFeatureFlags(flags map[string]bool) OptionFunc {
+	return func(h *HTTPBin) {
+		for name, enabled := range flags {
+			switch name {
+			case featureErrorClassHeader:
+				h.errorClassHeader = enabled
+			case featureLoadSignals:
+				h.loadSignals = enabled
+			case featureServerTiming:
+				h.serverTiming = enabled
+			}
+		}
+	}
+}
+
+// WithServerHeader adds a Server header with the given value to every
+// response, to simulate origins that identify themselves (e.g. "nginx" or
+// "Microsoft-IIS/10.0"). An empty value explicitly suppresses the header.
+// Clients may override the value for a single request via the
+// ?server_header= query param of /response-headers.
+//
+// A value that is not a valid header value, e.g. because it contains a CR
+// or LF, is ignored.
+func WithServerHeader(value string) OptionFunc {
+	return func(h *HTTPBin) {
+		h.setIdentityHeader("Server", value)
+	}
+}
+
+// WithPoweredByHeader adds an X-Powered-By header with the given value to
+// every response, as a companion to WithServerHeader (e.g. "ASP.NET" or
+// "PHP/8.2"). An empty value explicitly suppresses the header.
+// Invalid values are ignored, as for WithServerHeader.
+func WithPoweredByHeader(value string) OptionFunc {
+	return func(h *HTTPBin) {
+		h.setIdentityHeader("X-Powered-By", value)
+	}
+}
+
+// WithMaxReflectedHeaderBytes limits the total size of the response headers
+// that endpoints like /response-headers and /cookies/set derive from client
+// input, measured as they would be written on the wire. Requests that would
+// exceed the limit are rejected with 400 Bad Request rather than answered
+// with a bloated header block. A limit of zero, the default, means no limit.
+func WithMaxReflectedHeaderBytes(n int) OptionFunc {
+	return func(h *HTTPBin) {
+		h.maxReflectedHeaderBytes = n
+	}
+}
+
+// WithEnvPrefixes exposes the server's environment variables whose names
+// begin with any of the given case-sensitive prefixes (e.g. "HTTPBIN_") at
+// /env. Without any prefixes, /env exposes nothing, so that secrets in the
+// environment are not leaked.
+func WithEnvPrefixes(prefixes ...string) OptionFunc {
+	return func(h *HTTPBin) {
+		h.envPrefixes = append(h.envPrefixes, prefixes...)
+	}
+}
+
+// WithMaxURLLength limits the length of request URLs, as sent on the request
+// line, to n bytes. Longer requests are rejected with 414 URI Too Long before
+// their bodies are read, and echo endpoints like /get and /anything report
+// each URL's length so clients can see how close they are to the limit. This
+// is independent of the server's MaxHeaderBytes, which must leave room for
+// URLs of the allowed length. It panics if n is not positive.
+func WithMaxURLLength(n int) OptionFunc {
+	if n < 1 {
+		panic("httpbin: max URL length must be positive")
+	}
+	return func(h *HTTPBin) {
+		h.maxURLLength = n
+	}
+}
+
+// WithMethodPolicy overrides the HTTP methods allowed by the route with the
+// given ServeMux pattern (e.g. "/get" or "/status/"), tightening or loosening
+// its defaults. Unlike the defaults, GET does not imply HEAD, so HEAD must be
+// listed to be allowed. OPTIONS is always allowed. The policy is reflected in
+// the Allow header and body of 405 responses, in answers to OPTIONS requests,
+// and in the route's example request as reported by ExampleRequests and
+// /selftest.
+//
+// New panics if the pattern is not a known route, if no methods are given,
+// or if the same pattern is given conflicting policies. Validate reports the
+// same problems as an error.
+func WithMethodPolicy(pattern string, allowed ...string) OptionFunc {
+	return func(h *HTTPBin) {
+		if len(allowed) == 0 {
+			h.methodPolicyErrs = append(h.methodPolicyErrs, fmt.Errorf("method policy for %q allows no methods", pattern))
+			return
+		}
+		for _, m := range allowed {
+			if !isHTTPToken(m) {
+				h.methodPolicyErrs = append(h.methodPolicyErrs, fmt.Errorf("method policy for %q has invalid method %q", pattern, m))
+				return
+			}
+		}
+		if existing, ok := h.methodPolicies[pattern]; ok && strings.Join(existing, ",") != strings.Join(allowed, ",") {
+			h.methodPolicyErrs = append(h.methodPolicyErrs, fmt.Errorf("conflicting method policies for %q: %s and %s", pattern, strings.Join(existing, ", "), strings.Join(allowed, ", ")))
+			return
+		}
+		if h.methodPolicies == nil {
+			h.methodPolicies = make(map[string][]string)
+		}
+		h.methodPolicies[pattern] = append([]string(nil), allowed...)
+	}
+}
+
+// WithClientCAs sets the certificate authorities against which TLS client
+// certificates are verified, both during the handshake (see TLSConfig) and
+// for routes given to WithMTLSRequired. By default, the system roots are
+// used.
+func WithClientCAs(pool *x509.CertPool) OptionFunc {
+	return func(h *HTTPBin) {
+		h.clientCAs = pool
+	}
+}
+
+// WithMTLSRequired requires a verified TLS client certificate on requests to
+// the routes matching any of the given ServeMux patterns (e.g. "/certs" or
+// "/admin/"), which are answered with 403 Forbidden and a JSON explanation
+// otherwise. Other routes remain open to clients without a certificate. The
+// server must request client certificates for this to be useful, e.g. by
+// using the config returned by TLSConfig.
+//
+// WithMTLSRequired panics if a pattern does not begin with a slash.
+func WithMTLSRequired(patterns ...string) OptionFunc {
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			panic(fmt.Sprintf("httpbin: mTLS pattern %q must begin with a slash", pattern))
+		}
+	}
+	return func(h *HTTPBin) {
+		h.mtlsRequired = append(h.mtlsRequired, patterns...)
+	}
+}
+
+// WithTraceDecision makes a sampling decision for every request using fn,
+// which may inspect the request's headers and its route via RoutePattern,
+// and reports it in an X-Trace-Sampled response header of "true" or "false"
+// and a trace_sampled annotation for the Observer. This lets clients that
+// propagate trace context check that their sampling flags arrive intact
+// without a tracing backend. If fn is nil, DefaultTraceDecision is used.
+func WithTraceDecision(fn func(r *http.Request) bool) OptionFunc {
+	return func(h *HTTPBin) {
+		if fn == nil {
+			fn = DefaultTraceDecision
+		}
+		h.traceDecision = fn
+	}
+}
@@ -0,0 +1,13 @@
+//go:build go1.20
+// +build go1.20
+
+package httpbin
+
+import "net/http"
+
+// canServeAsteriskOptions configures srv to pass OPTIONS * requests through
+// to its handler, reporting whether that is possible in this Go version.
+func canServeAsteriskOptions(srv *http.Server) bool {
+	srv.DisableGeneralOptionsHandler = true
+	return true
+}
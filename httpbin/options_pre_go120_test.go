@@ -0,0 +1,12 @@
+//go:build !go1.20
+// +build !go1.20
+
+package httpbin
+
+import "net/http"
+
+// canServeAsteriskOptions reports false before Go 1.20, where net/http
+// always answers OPTIONS * requests itself.
+func canServeAsteriskOptions(srv *http.Server) bool {
+	return false
+}
@@ -3,6 +3,8 @@ package httpbin
 import (
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 )
 
 const (
@@ -10,10 +12,30 @@ const (
 	htmlContentType = "text/html; charset=utf-8"
 )
 
+// A generic error response, used to give clients machine-readable details
+// about why a request failed.
+type errorResponse struct {
+	StatusCode     int      `json:"status_code"`
+	Error          string   `json:"error"`
+	Detail         string   `json:"detail,omitempty"`
+	Param          string   `json:"param,omitempty"`
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	URLLength      int      `json:"url_length,omitempty"`
+	MaxURLLength   int      `json:"max_url_length,omitempty"`
+}
+
 type headersResponse struct {
 	Headers http.Header `json:"headers"`
 }
 
+// MarshalJSON encodes the response without reflection, like noBodyResponse.
+func (resp headersResponse) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, 16+jsonValuesSizeHint(resp.Headers))
+	b = append(b, `{"headers":`...)
+	b = appendJSONValues(b, resp.Headers)
+	return append(b, '}'), nil
+}
+
 type ipResponse struct {
 	Origin string `json:"origin"`
 }
@@ -30,8 +52,75 @@ type noBodyResponse struct {
 	Origin  string      `json:"origin"`
 	URL     string      `json:"url"`
 
+	// How the request arrived, for the echo endpoints
+	Proto string   `json:"proto,omitempty"`
+	Route string   `json:"route,omitempty"`
+	TLS   *tlsInfo `json:"tls"`
+
 	Deflated bool `json:"deflated,omitempty"`
 	Gzipped  bool `json:"gzipped,omitempty"`
+	Zstd     bool `json:"zstd,omitempty"`
+
+	// The length of the request's URL as sent, when a limit is configured
+	URLLength int `json:"url_length,omitempty"`
+}
+
+// MarshalJSON encodes the response without reflection, since it backs the
+// busiest endpoints. The output is identical to the default encoding.
+func (resp noBodyResponse) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, 64+jsonValuesSizeHint(resp.Args)+jsonValuesSizeHint(resp.Headers)+len(resp.Origin)+len(resp.URL))
+	b = append(b, `{"args":`...)
+	b = appendJSONValues(b, resp.Args)
+	b = append(b, `,"headers":`...)
+	b = appendJSONValues(b, resp.Headers)
+	b = append(b, `,"origin":`...)
+	b = appendJSONString(b, resp.Origin)
+	b = append(b, `,"url":`...)
+	b = appendJSONString(b, resp.URL)
+	if resp.Proto != "" {
+		b = append(b, `,"proto":`...)
+		b = appendJSONString(b, resp.Proto)
+	}
+	if resp.Route != "" {
+		b = append(b, `,"route":`...)
+		b = appendJSONString(b, resp.Route)
+	}
+	b = append(b, `,"tls":`...)
+	if t := resp.TLS; t != nil {
+		b = append(b, `{"version":`...)
+		b = appendJSONString(b, t.Version)
+		b = append(b, `,"cipher_suite":`...)
+		b = appendJSONString(b, t.CipherSuite)
+		b = append(b, `,"alpn":`...)
+		b = appendJSONString(b, t.ALPN)
+		b = append(b, `,"server_name":`...)
+		b = appendJSONString(b, t.ServerName)
+		b = append(b, '}')
+	} else {
+		b = append(b, `null`...)
+	}
+	if resp.Deflated {
+		b = append(b, `,"deflated":true`...)
+	}
+	if resp.Gzipped {
+		b = append(b, `,"gzipped":true`...)
+	}
+	if resp.Zstd {
+		b = append(b, `,"zstd":true`...)
+	}
+	if resp.URLLength != 0 {
+		b = append(b, `,"url_length":`...)
+		b = strconv.AppendInt(b, int64(resp.URLLength), 10)
+	}
+	return append(b, '}'), nil
+}
+
+// tlsInfo describes the TLS connection a request arrived on.
+type tlsInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ALPN        string `json:"alpn"`
+	ServerName  string `json:"server_name"`
 }
 
 // A generic response for any incoming request that might contain a body (POST,
@@ -42,10 +131,72 @@ type bodyResponse struct {
 	Origin  string      `json:"origin"`
 	URL     string      `json:"url"`
 
+	// How the request arrived
+	Proto string   `json:"proto"`
+	Route string   `json:"route"`
+	TLS   *tlsInfo `json:"tls"`
+
 	Data  string              `json:"data"`
 	Files map[string][]string `json:"files"`
 	Form  map[string][]string `json:"form"`
 	JSON  interface{}         `json:"json"`
+
+	// How the request body was framed
+	Body *bodyDescriptor `json:"body"`
+
+	// The Content-Encoding of the request body, if it was transparently
+	// decoded before populating the fields above
+	Encoding string `json:"encoding,omitempty"`
+
+	// The length of the request's URL as sent, when a limit is configured
+	URLLength int `json:"url_length,omitempty"`
+
+	// The sampled delay, for /delay requests with jitter
+	Delay *delaySample `json:"delay,omitempty"`
+
+	// The delay actually applied, for /delay requests
+	AppliedDelay *appliedDelay `json:"applied_delay,omitempty"`
+}
+
+// bodyDescriptor lets clients distinguish request bodies that echo the same
+// way: an empty body is always echoed as a data of "" with a null json, form,
+// and files, whether it had a Content-Length of 0, no Content-Length at all,
+// or an empty chunked encoding.
+type bodyDescriptor struct {
+	// Whether the body contained at least one byte
+	Present bool `json:"present"`
+	// The Content-Length the client sent, or nil if it sent none
+	DeclaredLength *int64 `json:"declared_length"`
+	// Whether the body used the chunked transfer encoding
+	Chunked bool `json:"chunked"`
+}
+
+// delayRange is an inclusive range of delays requested via /delay/{min}-{max}.
+type delayRange struct {
+	MinMS float64 `json:"min_ms"`
+	MaxMS float64 `json:"max_ms"`
+}
+
+// appliedDelay describes the delay a /delay request actually waited for,
+// which may have been clamped to MaxDuration.
+type appliedDelay struct {
+	// The range requested, if any, from which RequestedMS was sampled
+	Range       *delayRange `json:"range,omitempty"`
+	RequestedMS float64     `json:"requested_ms"`
+	AppliedMS   float64     `json:"applied_ms"`
+	Clamped     bool        `json:"clamped"`
+}
+
+// delaySample describes how a jittered /delay was chosen.
+type delaySample struct {
+	Distribution string  `json:"distribution"`
+	BaseMS       float64 `json:"base_ms"`
+	JitterMS     float64 `json:"jitter_ms"`
+	MaxMS        float64 `json:"max_ms"`
+	SampledMS    float64 `json:"sampled_ms"`
+	Clamped      bool    `json:"clamped"`
+
+	sampled time.Duration
 }
 
 type cookiesResponse map[string]string
@@ -65,15 +216,499 @@ type streamResponse struct {
 	URL     string      `json:"url"`
 }
 
+type dumpHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type dumpRequestResponse struct {
+	Method        string       `json:"method"`
+	URL           string       `json:"url"`
+	Proto         string       `json:"proto"`
+	Headers       []dumpHeader `json:"headers"`
+	Trailers      []dumpHeader `json:"trailers"`
+	ContentLength int64        `json:"content_length"`
+	Body          string       `json:"body"`
+	BodyEncoding  string       `json:"body_encoding"`
+	Truncated     bool         `json:"truncated"`
+}
+
 type uuidResponse struct {
 	UUID string `json:"uuid"`
 }
 
+type uuidsResponse struct {
+	UUIDs []string `json:"uuids"`
+}
+
 type bearerResponse struct {
-	Authenticated bool   `json:"authenticated"`
-	Token         string `json:"token"`
+	Authenticated bool                   `json:"authenticated"`
+	Token         string                 `json:"token"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+}
+
+type bearerErrorResponse struct {
+	Authenticated    bool   `json:"authenticated"`
+	Error            string `json:"error"`
+	Reason           string `json:"reason"`
+	ErrorDescription string `json:"error_description"`
 }
 
 type hostnameResponse struct {
 	Hostname string `json:"hostname"`
 }
+
+type envResponse map[string]string
+
+type signResponse struct {
+	Path    string `json:"path"`
+	URL     string `json:"url"`
+	Expires int64  `json:"expires"`
+}
+
+type egressResponse struct {
+	Target     string  `json:"target"`
+	SourceIP   string  `json:"source_ip"`
+	SourcePort int     `json:"source_port"`
+	RemoteAddr string  `json:"remote_addr"`
+	Status     int     `json:"status"`
+	LatencyMS  float64 `json:"latency_ms"`
+}
+
+type adminSettingsResponse struct {
+	DripDuration string `json:"drip_duration"`
+	DripDelay    string `json:"drip_delay"`
+	DripNumBytes int64  `json:"drip_numbytes"`
+}
+
+func newAdminSettingsResponse(s *runtimeSettings) adminSettingsResponse {
+	return adminSettingsResponse{
+		DripDuration: s.DefaultParams.DripDuration.String(),
+		DripDelay:    s.DefaultParams.DripDelay.String(),
+		DripNumBytes: s.DefaultParams.DripNumBytes,
+	}
+}
+
+type adminResetResponse struct {
+	Reset int `json:"reset"`
+}
+
+type adminOIDCRotateResponse struct {
+	Kid     string           `json:"kid"`
+	Retired []oidcRetiredKey `json:"retired"`
+}
+
+type oidcRetiredKey struct {
+	Kid     string    `json:"kid"`
+	Expires time.Time `json:"expires"`
+}
+
+type oidcDiscoveryResponse struct {
+	Issuer                            string   `json:"issuer"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// jsonWebKey is the public half of an EC key, as described by RFC 7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+type jwksResponse struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// oauthTokenClaims are the claims of the access tokens issued by
+// /oauth/token
+type oauthTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	Expires   int64  `json:"exp"`
+	ID        string `json:"jti"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope,omitempty"`
+}
+
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// oauthErrorResponse is an RFC 6749 error response, which OAuth clients
+// expect in place of our usual errorResponse
+type oauthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type selfTestResult struct {
+	Route          string  `json:"route"`
+	Method         string  `json:"method"`
+	URL            string  `json:"url"`
+	Status         int     `json:"status,omitempty"`
+	ExpectedStatus int     `json:"expected_status"`
+	DurationMS     float64 `json:"duration_ms"`
+	Passed         bool    `json:"passed"`
+	Error          string  `json:"error,omitempty"`
+}
+
+type selfTestResponse struct {
+	Passed     bool             `json:"passed"`
+	DurationMS float64          `json:"duration_ms"`
+	Results    []selfTestResult `json:"results"`
+}
+
+type headerLine struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type headerCaseResponse struct {
+	Headers []headerLine `json:"headers"`
+	Raw     string       `json:"raw"`
+}
+
+type resolveResponse struct {
+	Host          string   `json:"host"`
+	CanonicalName string   `json:"canonical_name,omitempty"`
+	A             []string `json:"a"`
+	AAAA          []string `json:"aaaa"`
+	LatencyMS     float64  `json:"latency_ms"`
+	Error         string   `json:"error,omitempty"`
+	ErrorDetail   string   `json:"error_detail,omitempty"`
+}
+
+type unstablePatternResponse struct {
+	Key      string `json:"key"`
+	Pattern  string `json:"pattern"`
+	Repeat   bool   `json:"repeat"`
+	Requests int64  `json:"requests"`
+	Position int    `json:"position"`
+	Outcome  string `json:"outcome"`
+	Status   int    `json:"status"`
+}
+
+type retryResponse struct {
+	Key               string `json:"key"`
+	Attempt           int64  `json:"attempt"`
+	Failures          int    `json:"failures"`
+	RemainingFailures int64  `json:"remaining_failures"`
+	Succeeded         bool   `json:"succeeded"`
+	Status            int    `json:"status"`
+}
+
+type unstableScheduleResponse struct {
+	Phase            string `json:"phase"`
+	Status           int    `json:"status"`
+	Period           string `json:"period"`
+	DownFor          string `json:"down_for"`
+	NextTransitionIn string `json:"next_transition_in"`
+	NextTransitionAt string `json:"next_transition_at"`
+}
+
+type challengeResponse struct {
+	Challenges []string `json:"challenges"`
+}
+
+type mementoResponse struct {
+	AcceptDatetime  string `json:"accept_datetime,omitempty"`
+	MementoDatetime string `json:"memento_datetime"`
+	Version         int    `json:"version"`
+	Versions        int    `json:"versions"`
+}
+
+type dualStackResponse struct {
+	Family     string  `json:"family"`
+	IPv4Mapped bool    `json:"ipv4_mapped"`
+	LocalAddr  string  `json:"local_addr,omitempty"`
+	RemoteAddr string  `json:"remote_addr"`
+	Listener   string  `json:"listener,omitempty"`
+	DelayMS    float64 `json:"delay_ms"`
+}
+
+type churnResponse struct {
+	Connection int64 `json:"connection"`
+	Request    int64 `json:"request"`
+	CloseEvery int64 `json:"close_every"`
+	Closing    bool  `json:"closing"`
+}
+
+type paginateItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// paginationMeta describes one page of a paginated list and is shared by all
+// pagination styles, each of which only populates the fields that make sense
+// for it.
+type paginationMeta struct {
+	Style      string `json:"style"`
+	Total      *int   `json:"total,omitempty"`
+	Page       int    `json:"page,omitempty"`
+	PageSize   int    `json:"page_size,omitempty"`
+	TotalPages *int   `json:"total_pages,omitempty"`
+	Offset     *int   `json:"offset,omitempty"`
+	Limit      int    `json:"limit,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type paginateResponse struct {
+	paginationMeta
+	Items []paginateItem `json:"items"`
+}
+
+type userAddress struct {
+	Street     string  `json:"street"`
+	Unit       *string `json:"unit"`
+	City       string  `json:"city"`
+	PostalCode string  `json:"postal_code"`
+	Country    string  `json:"country"`
+}
+
+// userRecord is a synthetic /users record. Nullable fields are pointers so
+// that they are always present in the JSON, as null when unset.
+type userRecord struct {
+	ID          int         `json:"id"`
+	Username    string      `json:"username"`
+	FirstName   string      `json:"first_name"`
+	LastName    string      `json:"last_name"`
+	Email       string      `json:"email"`
+	Phone       *string     `json:"phone"`
+	Active      bool        `json:"active"`
+	Address     userAddress `json:"address"`
+	CreatedAt   string      `json:"created_at"`
+	LastLoginAt *string     `json:"last_login_at"`
+}
+
+// usersResponse holds either full userRecords or, when ?fields= is given,
+// sparse records built from the selected fields.
+type usersResponse struct {
+	paginationMeta
+	Seed  int64         `json:"seed"`
+	Items []interface{} `json:"items"`
+}
+
+type diffContext struct {
+	Offset int64  `json:"offset"`
+	A      string `json:"a"`
+	B      string `json:"b"`
+}
+
+type diffResponse struct {
+	Identical            bool         `json:"identical"`
+	LengthA              int64        `json:"length_a"`
+	LengthB              int64        `json:"length_b"`
+	SHA256A              string       `json:"sha256_a"`
+	SHA256B              string       `json:"sha256_b"`
+	FirstDifferentOffset *int64       `json:"first_different_offset,omitempty"`
+	Context              *diffContext `json:"context,omitempty"`
+}
+
+type fanoutPublishResponse struct {
+	Channel     string `json:"channel"`
+	ID          int64  `json:"id"`
+	Subscribers int    `json:"subscribers"`
+	Dropped     int    `json:"dropped"`
+}
+
+// fanoutWebSocketMessage is sent to /fanout WebSocket subscribers for each
+// published message, or to report messages dropped since the last one.
+type fanoutWebSocketMessage struct {
+	ID      int64  `json:"id,omitempty"`
+	Data    string `json:"data,omitempty"`
+	Dropped int64  `json:"dropped,omitempty"`
+}
+
+type cacheSequenceResponse struct {
+	Key          string `json:"key"`
+	Generation   int64  `json:"generation"`
+	Requests     int64  `json:"requests"`
+	ChangesEvery int    `json:"changes_every"`
+	ETag         string `json:"etag"`
+}
+
+type cdnSimResponse struct {
+	Key      string `json:"key"`
+	Cache    string `json:"cache"`
+	Age      int64  `json:"age"`
+	TTL      int64  `json:"ttl"`
+	StoredAt string `json:"stored_at"`
+}
+
+type verifyResponse struct {
+	Match     bool   `json:"match"`
+	Algorithm string `json:"algorithm"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+}
+
+type trafficStats struct {
+	Requests      uint64 `json:"requests"`
+	RequestBytes  uint64 `json:"request_bytes"`
+	ResponseBytes uint64 `json:"response_bytes"`
+}
+
+type observerStats struct {
+	Buffer  int    `json:"buffer"`
+	Queued  int    `json:"queued"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type statsResponse struct {
+	Total    trafficStats            `json:"total"`
+	Routes   map[string]trafficStats `json:"routes"`
+	Observer *observerStats          `json:"observer,omitempty"`
+}
+
+type dateSkewResponse struct {
+	Args    url.Values  `json:"args"`
+	Headers http.Header `json:"headers"`
+	Origin  string      `json:"origin"`
+	URL     string      `json:"url"`
+
+	ServerDate    string `json:"server_date"`
+	SkewedDate    string `json:"skewed_date"`
+	OffsetSeconds int64  `json:"offset_seconds"`
+}
+
+type degradedComponent struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+
+	index int
+}
+
+type degradedResponse struct {
+	Degraded   bool                `json:"degraded"`
+	Components []degradedComponent `json:"components"`
+	LatencyMS  int64               `json:"latency_ms"`
+}
+
+type statusCatalogEntry struct {
+	Code            int               `json:"code"`
+	Reason          string            `json:"reason"`
+	BodyAllowed     bool              `json:"body_allowed"`
+	SpecialHandling bool              `json:"special_handling"`
+	Note            string            `json:"note,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	URL             string            `json:"url"`
+}
+
+type statusesResponse struct {
+	Statuses []statusCatalogEntry `json:"statuses"`
+}
+
+// sseEventData is the data of each event sent by /sse.
+type sseEventData struct {
+	ID        int    `json:"id"`
+	Count     int    `json:"count"`
+	Timestamp string `json:"timestamp"`
+}
+
+// sseDoneData is the data of the done event that ends each /sse stream.
+type sseDoneData struct {
+	Count int `json:"count"`
+}
+
+type coalesceResponse struct {
+	Key           string    `json:"key"`
+	ComputationID string    `json:"computation_id"`
+	Waiters       int       `json:"waiters"`
+	WorkMS        float64   `json:"work_ms"`
+	Started       time.Time `json:"started"`
+	Completed     time.Time `json:"completed"`
+}
+
+type slowReaderResponse struct {
+	BytesReceived int64   `json:"bytes_received"`
+	ElapsedMS     float64 `json:"elapsed_ms"`
+	Rate          int     `json:"rate"`
+	TimedOut      bool    `json:"timed_out"`
+}
+
+// indexResponse is the machine-readable form of the index page returned by
+// /index.json.
+type indexResponse struct {
+	Endpoints []indexEndpoint   `json:"endpoints"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type indexEndpoint struct {
+	Pattern string `json:"pattern"`
+	Usage   string `json:"usage"`
+	// Omitted when the endpoint accepts any method
+	Methods []string `json:"methods,omitempty"`
+	Tags    []string `json:"tags"`
+	Example string   `json:"example,omitempty"`
+	// Omitted for endpoints whose parameters are not described
+	Params []routeParam `json:"params,omitempty"`
+}
+
+// routeParam describes a parameter accepted by an endpoint, with its default
+// and limits as configured on the instance.
+type routeParam struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Type        string `json:"type"`
+	Default     string `json:"default,omitempty"`
+	Min         string `json:"min,omitempty"`
+	Max         string `json:"max,omitempty"`
+	Description string `json:"description"`
+}
+
+type helpLimits struct {
+	MaxBodySize int64  `json:"max_body_size"`
+	MaxDuration string `json:"max_duration"`
+}
+
+type helpResponse struct {
+	Pattern     string       `json:"pattern"`
+	Usage       string       `json:"usage"`
+	Description string       `json:"description"`
+	Methods     []string     `json:"methods,omitempty"`
+	Tags        []string     `json:"tags"`
+	Params      []routeParam `json:"params"`
+	Examples    []string     `json:"examples"`
+	Limits      helpLimits   `json:"limits"`
+}
+
+type pageAsset struct {
+	ID          int     `json:"id"`
+	URL         string  `json:"url"`
+	Kind        string  `json:"kind"`
+	ContentType string  `json:"content_type"`
+	Size        int64   `json:"size"`
+	LatencyMS   float64 `json:"latency_ms"`
+	Cacheable   bool    `json:"cacheable"`
+}
+
+type pageManifestResponse struct {
+	Seed    int64       `json:"seed"`
+	PageURL string      `json:"page_url"`
+	Assets  []pageAsset `json:"assets"`
+}
+
+type expectContinueAuthResponse struct {
+	Authorized        bool   `json:"authorized"`
+	User              string `json:"user"`
+	ExpectContinue    bool   `json:"expect_continue"`
+	ContinueSent      bool   `json:"continue_sent"`
+	DeclaredLength    *int64 `json:"declared_length"`
+	BodyBytesReceived int64  `json:"body_bytes_received"`
+}
@@ -0,0 +1,411 @@
+// Package websocket provides a minimal implementation of the server side of
+// the WebSocket protocol, as defined in RFC 6455.
+//
+// Only what go-httpbin's own endpoints need is implemented: the opening
+// handshake, reading of (possibly fragmented) messages, writing of unfragmented
+// messages, and the ping and close control frames. Extensions and
+// subprotocols are not supported.
+//
+// For more info, see:
+// https://datatracker.ietf.org/doc/html/rfc6455
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Opcode identifies the type of a WebSocket frame
+type Opcode byte
+
+// Opcodes defined by RFC 6455
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+// Status codes for close frames, as defined in RFC 6455 section 7.4.1
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseInvalidPayload   = 1007
+	CloseMessageTooBig    = 1009
+)
+
+// DefaultMaxMessageSize is the default limit on the size of messages read
+// from a Conn.
+const DefaultMaxMessageSize = 1024 * 1024
+
+// handshakeGUID is appended to the client's key to compute the
+// Sec-WebSocket-Accept header, per RFC 6455 section 1.3.
+const handshakeGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxControlPayload is the largest payload allowed in a control frame.
+const maxControlPayload = 125
+
+// CloseError is returned by ReadMessage when the connection has been closed,
+// either by the client or because the client violated the protocol.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+// Conn is a server-side WebSocket connection. Messages may be written
+// concurrently with reads, but only one goroutine may read at a time.
+type Conn struct {
+	// MaxMessageSize limits the size of messages read from the connection.
+	// Larger messages cause the connection to be closed with
+	// CloseMessageTooBig.
+	MaxMessageSize int64
+
+	// MaxFrameSize, if positive, limits the size of each frame of the
+	// messages read from the connection, so that clients can be made to
+	// fragment large messages. Larger frames cause the connection to be
+	// closed with CloseMessageTooBig.
+	MaxFrameSize int64
+
+	conn net.Conn
+	br   *bufio.Reader
+
+	writeMu sync.Mutex
+	bw      *bufio.Writer
+	closed  bool
+}
+
+// IsHandshake reports whether the request asks to be upgraded to a WebSocket
+// connection, i.e. whether it has Connection: Upgrade and Upgrade: websocket
+// headers. It does not check that the rest of the handshake is valid.
+func IsHandshake(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") && headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+// Upgrade performs the WebSocket opening handshake for the given request and
+// takes over its underlying connection. If the request is not a valid
+// handshake, Upgrade responds with an HTTP error and returns an error.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "WebSocket handshake must use GET", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: handshake method is not GET")
+	}
+	if !IsHandshake(r) {
+		http.Error(w, "WebSocket handshake requires Connection: Upgrade and Upgrade: websocket headers", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: invalid key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported by this connection", http.StatusInternalServerError)
+		return nil, http.ErrNotSupported
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to hijack connection: %s", err), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	// Clear any deadlines set by the http.Server for the original request
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		MaxMessageSize: DefaultMaxMessageSize,
+		conn:           conn,
+		br:             brw.Reader,
+		bw:             brw.Writer,
+	}, nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept header for a client's
+// Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + handshakeGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken reports whether the comma-separated values of the
+// given header contain token, ignoring case.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage reads the next text or binary message from the connection,
+// reassembling fragmented messages. Pings are answered automatically and
+// pongs are discarded. When the client closes the connection or violates the
+// protocol, the close handshake is completed and a *CloseError is returned.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	var (
+		msgOp  Opcode
+		msg    []byte
+		inFrag bool
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			if err := c.writeFrame(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			return 0, nil, c.handleClose(payload)
+		case OpText, OpBinary:
+			if inFrag {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			msgOp = op
+			inFrag = true
+		case OpContinuation:
+			if !inFrag {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+
+		if int64(len(msg))+int64(len(payload)) > c.MaxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		msg = append(msg, payload...)
+		if !fin {
+			continue
+		}
+		if msgOp == OpText && !utf8.Valid(msg) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8 in text message")
+		}
+		if msg == nil {
+			msg = []byte{}
+		}
+		return msgOp, msg, nil
+	}
+}
+
+// readFrame reads a single frame, enforcing the framing rules that apply to
+// every frame sent by a client.
+func (c *Conn) readFrame() (fin bool, op Opcode, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	op = Opcode(header[0] & 0x0F)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "client frames must be masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if op >= OpClose {
+		if !fin {
+			return false, 0, nil, c.fail(CloseProtocolError, "fragmented control frame")
+		}
+		if length > maxControlPayload {
+			return false, 0, nil, c.fail(CloseProtocolError, "control frame too big")
+		}
+	}
+	if length > uint64(c.MaxMessageSize) {
+		return false, 0, nil, c.fail(CloseMessageTooBig, "message too big")
+	}
+	if op < OpClose && c.MaxFrameSize > 0 && length > uint64(c.MaxFrameSize) {
+		return false, 0, nil, c.fail(CloseMessageTooBig, "frame too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// handleClose completes the close handshake initiated by the client.
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close payload")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(CloseInvalidPayload, "invalid UTF-8 in close reason")
+		}
+	}
+
+	// Echo the client's status code back, per RFC 6455 section 5.5.1
+	var reply []byte
+	if closeErr.Code != CloseNoStatusReceived {
+		reply = payload[:2]
+	}
+	c.writeClose(reply)
+	return closeErr
+}
+
+// validCloseCode reports whether code may be sent in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// fail closes the connection with the given status code after the client
+// violated the protocol.
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// WriteMessage writes a single unfragmented text or binary message.
+func (c *Conn) WriteMessage(op Opcode, data []byte) error {
+	return c.writeFrame(op, data)
+}
+
+// Close sends a close frame with the given status code and reason, and then
+// closes the underlying connection.
+func (c *Conn) Close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeClose(payload)
+}
+
+// writeClose sends a close frame with the given payload, if one has not
+// already been sent, and closes the underlying connection.
+func (c *Conn) writeClose(payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrameLocked(OpClose, payload)
+	return c.conn.Close()
+}
+
+// SetReadDeadline sets the deadline for future reads from the connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for future writes to the connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) writeFrame(op Opcode, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.writeFrameLocked(op, payload)
+}
+
+func (c *Conn) writeFrameLocked(op Opcode, payload []byte) error {
+	// Server frames are never masked or fragmented
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | byte(op)
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := c.bw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.bw.Write(payload); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
@@ -0,0 +1,411 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example handshake from RFC 6455 section 1.3
+const (
+	exampleKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	exampleAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+func TestAcceptKey(t *testing.T) {
+	if got := acceptKey(exampleKey); got != exampleAccept {
+		t.Fatalf("expected %q, got %q", exampleAccept, got)
+	}
+}
+
+// testClient is a bare-bones WebSocket client that writes raw frames, so that
+// tests can exercise both valid and invalid client behavior.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialTestServer(t *testing.T, handler http.HandlerFunc, headers map[string]string) (*testClient, *http.Response) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n"
+	for k, v := range headers {
+		req += fmt.Sprintf("%s: %s\r\n", k, v)
+	}
+	fmt.Fprint(conn, req+"\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, conn: conn, br: br}, resp
+}
+
+var handshakeHeaders = map[string]string{
+	"Connection":            "keep-alive, Upgrade",
+	"Upgrade":               "websocket",
+	"Sec-WebSocket-Version": "13",
+	"Sec-WebSocket-Key":     exampleKey,
+}
+
+// writeFrame writes a single masked frame.
+func (c *testClient) writeFrame(fin bool, op Opcode, payload []byte) {
+	c.t.Helper()
+	var buf bytes.Buffer
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	buf.WriteByte(b0)
+	switch n := len(payload); {
+	case n <= 125:
+		buf.WriteByte(0x80 | byte(n))
+	case n <= 0xFFFF:
+		buf.WriteByte(0x80 | 126)
+		binary.Write(&buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0x80 | 127)
+		binary.Write(&buf, binary.BigEndian, uint64(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	buf.Write(mask)
+	for i, b := range payload {
+		buf.WriteByte(b ^ mask[i%4])
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// readFrame reads a single unmasked frame written by the server.
+func (c *testClient) readFrame() (Opcode, []byte) {
+	c.t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		c.t.Fatalf("error reading frame: %s", err)
+	}
+	if header[0]&0x80 == 0 {
+		c.t.Fatalf("expected unfragmented frame")
+	}
+	if header[1]&0x80 != 0 {
+		c.t.Fatalf("expected unmasked frame")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext uint16
+		binary.Read(c.br, binary.BigEndian, &ext)
+		length = uint64(ext)
+	case 127:
+		binary.Read(c.br, binary.BigEndian, &length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatalf("error reading payload: %s", err)
+	}
+	return Opcode(header[0] & 0x0F), payload
+}
+
+func (c *testClient) expectClose(code int) {
+	c.t.Helper()
+	op, payload := c.readFrame()
+	if op != OpClose {
+		c.t.Fatalf("expected close frame, got opcode %d", op)
+	}
+	if len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != code {
+		c.t.Fatalf("expected close code %d, got payload %q", code, payload)
+	}
+}
+
+func closePayload(code int, reason string) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return append(payload, reason...)
+}
+
+// echoHandler echoes messages until the connection is closed, reporting the
+// error that ended the connection on errc.
+func echoHandler(errc chan error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			errc <- err
+			return
+		}
+		for {
+			op, msg, err := conn.ReadMessage()
+			if err != nil {
+				errc <- err
+				return
+			}
+			conn.WriteMessage(op, msg)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+		errc := make(chan error, 1)
+		_, resp := dialTestServer(t, echoHandler(errc), handshakeHeaders)
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("expected status 101, got %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Sec-WebSocket-Accept"); got != exampleAccept {
+			t.Fatalf("expected Sec-WebSocket-Accept %q, got %q", exampleAccept, got)
+		}
+	})
+
+	badTests := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"missing_upgrade", map[string]string{"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": exampleKey}, http.StatusBadRequest},
+		{"bad_version", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": exampleKey}, http.StatusUpgradeRequired},
+		{"bad_key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+	}
+	for _, test := range badTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			errc := make(chan error, 1)
+			_, resp := dialTestServer(t, echoHandler(errc), test.headers)
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("expected status %d, got %d", test.wantStatus, resp.StatusCode)
+			}
+			if err := <-errc; err == nil {
+				t.Fatalf("expected handshake error")
+			}
+		})
+	}
+}
+
+func TestReadWriteMessages(t *testing.T) {
+	t.Parallel()
+
+	t.Run("echo", func(t *testing.T) {
+		t.Parallel()
+		errc := make(chan error, 1)
+		c, _ := dialTestServer(t, echoHandler(errc), handshakeHeaders)
+
+		c.writeFrame(true, OpText, []byte("hello"))
+		if op, payload := c.readFrame(); op != OpText || string(payload) != "hello" {
+			t.Fatalf("expected text echo, got opcode %d payload %q", op, payload)
+		}
+
+		big := bytes.Repeat([]byte{0xFF}, 70000)
+		c.writeFrame(true, OpBinary, big)
+		if op, payload := c.readFrame(); op != OpBinary || !bytes.Equal(payload, big) {
+			t.Fatalf("expected binary echo of %d bytes, got opcode %d and %d bytes", len(big), op, len(payload))
+		}
+
+		c.writeFrame(true, OpText, nil)
+		if op, payload := c.readFrame(); op != OpText || len(payload) != 0 {
+			t.Fatalf("expected empty text echo, got opcode %d payload %q", op, payload)
+		}
+	})
+
+	t.Run("fragmented_with_interleaved_ping", func(t *testing.T) {
+		t.Parallel()
+		errc := make(chan error, 1)
+		c, _ := dialTestServer(t, echoHandler(errc), handshakeHeaders)
+
+		c.writeFrame(false, OpText, []byte("hel"))
+		c.writeFrame(true, OpPing, []byte("ping!"))
+		c.writeFrame(true, OpContinuation, []byte("lo"))
+
+		if op, payload := c.readFrame(); op != OpPong || string(payload) != "ping!" {
+			t.Fatalf("expected pong, got opcode %d payload %q", op, payload)
+		}
+		if op, payload := c.readFrame(); op != OpText || string(payload) != "hello" {
+			t.Fatalf("expected reassembled message, got opcode %d payload %q", op, payload)
+		}
+	})
+
+	t.Run("close_handshake", func(t *testing.T) {
+		t.Parallel()
+		errc := make(chan error, 1)
+		c, _ := dialTestServer(t, echoHandler(errc), handshakeHeaders)
+
+		c.writeFrame(true, OpClose, closePayload(CloseGoingAway, "bye"))
+		c.expectClose(CloseGoingAway)
+
+		var closeErr *CloseError
+		if err := <-errc; !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway || closeErr.Reason != "bye" {
+			t.Fatalf("expected CloseError with code %d, got %v", CloseGoingAway, err)
+		}
+	})
+
+	t.Run("max_frame_size", func(t *testing.T) {
+		t.Parallel()
+		errc := make(chan error, 1)
+		c, _ := dialTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+			conn, err := Upgrade(w, r)
+			if err != nil {
+				errc <- err
+				return
+			}
+			conn.MaxFrameSize = 4
+			for {
+				op, msg, err := conn.ReadMessage()
+				if err != nil {
+					errc <- err
+					return
+				}
+				conn.WriteMessage(op, msg)
+			}
+		}, handshakeHeaders)
+
+		// Messages larger than a frame are fine, as long as they are
+		// fragmented, and control frames are not limited
+		c.writeFrame(false, OpText, []byte("hell"))
+		c.writeFrame(true, OpContinuation, []byte("o"))
+		if op, payload := c.readFrame(); op != OpText || string(payload) != "hello" {
+			t.Fatalf("expected reassembled message, got opcode %d payload %q", op, payload)
+		}
+		c.writeFrame(true, OpPing, []byte("ping!"))
+		if op, payload := c.readFrame(); op != OpPong || string(payload) != "ping!" {
+			t.Fatalf("expected pong, got opcode %d payload %q", op, payload)
+		}
+
+		c.writeFrame(true, OpText, []byte("hello"))
+		c.expectClose(CloseMessageTooBig)
+		var closeErr *CloseError
+		if err := <-errc; !errors.As(err, &closeErr) || closeErr.Reason != "frame too big" {
+			t.Fatalf("expected frame too big CloseError, got %v", err)
+		}
+	})
+
+	protocolErrors := []struct {
+		name     string
+		write    func(c *testClient)
+		wantCode int
+	}{
+		{
+			name: "unmasked_frame",
+			write: func(c *testClient) {
+				c.conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "reserved_bits",
+			write: func(c *testClient) {
+				c.writeFrame(true, OpText|0x40, []byte("hi"))
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "unexpected_continuation",
+			write: func(c *testClient) {
+				c.writeFrame(true, OpContinuation, []byte("hi"))
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "interrupted_fragment",
+			write: func(c *testClient) {
+				c.writeFrame(false, OpText, []byte("hi"))
+				c.writeFrame(true, OpText, []byte("hi"))
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "fragmented_control",
+			write: func(c *testClient) {
+				c.writeFrame(false, OpPing, []byte("hi"))
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "oversized_control",
+			write: func(c *testClient) {
+				c.writeFrame(true, OpPing, bytes.Repeat([]byte("x"), 126))
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "unknown_opcode",
+			write: func(c *testClient) {
+				c.writeFrame(true, Opcode(0x3), []byte("hi"))
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "invalid_utf8",
+			write: func(c *testClient) {
+				c.writeFrame(true, OpText, []byte{0xFF, 0xFE})
+			},
+			wantCode: CloseInvalidPayload,
+		},
+		{
+			name: "invalid_close_code",
+			write: func(c *testClient) {
+				c.writeFrame(true, OpClose, closePayload(999, ""))
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "too_big",
+			write: func(c *testClient) {
+				// Only the header is needed for the server to reject the frame
+				header := []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+				binary.BigEndian.PutUint64(header[2:10], DefaultMaxMessageSize+1)
+				c.conn.Write(header)
+			},
+			wantCode: CloseMessageTooBig,
+		},
+	}
+	for _, test := range protocolErrors {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			errc := make(chan error, 1)
+			c, _ := dialTestServer(t, echoHandler(errc), handshakeHeaders)
+
+			test.write(c)
+			c.expectClose(test.wantCode)
+
+			var closeErr *CloseError
+			if err := <-errc; !errors.As(err, &closeErr) || closeErr.Code != test.wantCode {
+				t.Fatalf("expected CloseError with code %d, got %v", test.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestHeaderContainsToken(t *testing.T) {
+	h := http.Header{"Connection": {"keep-alive", "foo, UPGRADE"}}
+	if !headerContainsToken(h, "Connection", "upgrade") {
+		t.Fatalf("expected to find upgrade token in %v", h)
+	}
+	if headerContainsToken(h, "Connection", "close") {
+		t.Fatalf("did not expect to find close token in %v", h)
+	}
+	if headerContainsToken(http.Header{"Upgrade": {strings.Repeat("websocket", 2)}}, "Upgrade", "websocket") {
+		t.Fatalf("expected only exact token matches")
+	}
+}
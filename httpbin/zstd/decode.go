@@ -0,0 +1,942 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	skippableMagicMask = 0xFFFFFFF0
+	skippableMagic     = 0x184D2A50
+
+	literalsTypeRaw        = 0
+	literalsTypeRLE        = 1
+	literalsTypeCompressed = 2
+	literalsTypeTreeless   = 3
+
+	sequenceModePredefined = 0
+	sequenceModeRLE        = 1
+	sequenceModeCompressed = 2
+	sequenceModeRepeat     = 3
+
+	// Limits on the tables a frame may describe, RFC 8878 3.1.1.3.2.2 and
+	// 4.2.1
+	maxHuffmanBits      = 11
+	maxWeightsLog       = 6
+	maxLiteralLengthLog = 9
+	maxMatchLengthLog   = 9
+	maxOffsetLog        = 8
+	maxOffsetCode       = 31
+)
+
+var (
+	errMagic      = errors.New("zstd: invalid magic number")
+	errChecksum   = errors.New("zstd: content checksum mismatch")
+	errDictionary = errors.New("zstd: dictionaries are not supported")
+)
+
+func corrupt(format string, args ...interface{}) error {
+	return fmt.Errorf("zstd: corrupt input: "+format, args...)
+}
+
+// Predefined FSE tables, for decoding
+var (
+	literalLengthDecoder = newFSEDecoder(6, literalLengthDefaultNorm)
+	matchLengthDecoder   = newFSEDecoder(6, matchLengthDefaultNorm)
+	offsetDecoder        = newFSEDecoder(5, offsetDefaultNorm)
+)
+
+// Reader is an io.Reader that decompresses the zstd frames read from an
+// underlying reader. Concatenated frames are decoded one after the other,
+// and skippable frames are ignored. Frames that depend on a dictionary are
+// rejected.
+type Reader struct {
+	r       io.Reader
+	err     error
+	scratch [16]byte
+
+	// Per-frame state
+	inFrame        bool
+	windowSize     uint64
+	blockMax       int
+	hasChecksum    bool
+	hasContentSize bool
+	contentSize    uint64
+	produced       uint64
+	checksum       xxhash64
+	reps           [3]uint32
+	huffman        *huffmanTable
+	llTable        *fseDecoder
+	ofTable        *fseDecoder
+	mlTable        *fseDecoder
+
+	// hist holds the decoded data that matches may still refer to, ending
+	// with the current block, and out is the part of it not yet returned
+	// by Read
+	hist []byte
+	out  []byte
+
+	// Scratch space reused across blocks
+	block []byte
+	lits  []byte
+}
+
+// NewReader returns a new Reader that decompresses the data read from r. It
+// reads the header of the first frame, and returns an error if it is not a
+// valid zstd frame.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{r: r}
+	if err := z.nextFrame(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return z, nil
+}
+
+// Read reads decompressed data into p, decoding one block at a time.
+func (z *Reader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.step()
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// step decodes the next block, moving on to the next frame if the current
+// one is complete.
+func (z *Reader) step() error {
+	if !z.inFrame {
+		if err := z.nextFrame(); err != nil {
+			return err
+		}
+	}
+	last, err := z.readBlock()
+	if err != nil {
+		return err
+	}
+
+	z.produced += uint64(len(z.out))
+	z.checksum.write(z.out)
+	if z.hasContentSize && z.produced > z.contentSize {
+		return corrupt("content size exceeds frame header")
+	}
+	if !last {
+		return nil
+	}
+
+	z.inFrame = false
+	if z.hasContentSize && z.produced != z.contentSize {
+		return corrupt("content size does not match frame header")
+	}
+	if z.hasChecksum {
+		if err := z.readFull(z.scratch[:4]); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(z.scratch[:4]) != uint32(z.checksum.sum()) {
+			return errChecksum
+		}
+	}
+	return nil
+}
+
+// readFull reads exactly len(p) bytes, treating the end of the input as
+// unexpected.
+func (z *Reader) readFull(p []byte) error {
+	if _, err := io.ReadFull(z.r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// nextFrame skips any skippable frames and reads the next frame header,
+// RFC 8878 3.1.1.1. It returns io.EOF if the input ends cleanly before a
+// frame.
+func (z *Reader) nextFrame() error {
+	for {
+		if _, err := io.ReadFull(z.r, z.scratch[:4]); err != nil {
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(z.scratch[:4])
+		if magic == magicNumber {
+			break
+		}
+		if magic&skippableMagicMask != skippableMagic {
+			return errMagic
+		}
+		if err := z.readFull(z.scratch[:4]); err != nil {
+			return err
+		}
+		size := int64(binary.LittleEndian.Uint32(z.scratch[:4]))
+		if n, err := io.CopyN(io.Discard, z.r, size); n < size {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	if err := z.readFull(z.scratch[:1]); err != nil {
+		return err
+	}
+	descriptor := z.scratch[0]
+	if descriptor&(1<<3) != 0 {
+		return corrupt("reserved frame header bit is set")
+	}
+	singleSegment := descriptor&(1<<5) != 0
+	dictSize := [4]int{0, 1, 2, 4}[descriptor&3]
+	contentSizeSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeSize == 0 && singleSegment {
+		contentSizeSize = 1
+	}
+	windowDescriptorSize := 1
+	if singleSegment {
+		windowDescriptorSize = 0
+	}
+
+	hdr := z.scratch[:windowDescriptorSize+dictSize+contentSizeSize]
+	if err := z.readFull(hdr); err != nil {
+		return err
+	}
+	if !singleSegment {
+		exponent, mantissa := hdr[0]>>3, hdr[0]&7
+		base := uint64(1) << (10 + exponent)
+		z.windowSize = base + base/8*uint64(mantissa)
+		hdr = hdr[1:]
+	}
+	var dictID uint32
+	for i := dictSize - 1; i >= 0; i-- {
+		dictID = dictID<<8 | uint32(hdr[i])
+	}
+	if dictID != 0 {
+		return errDictionary
+	}
+	hdr = hdr[dictSize:]
+
+	z.hasContentSize = contentSizeSize > 0
+	switch contentSizeSize {
+	case 1:
+		z.contentSize = uint64(hdr[0])
+	case 2:
+		z.contentSize = uint64(binary.LittleEndian.Uint16(hdr)) + 256
+	case 4:
+		z.contentSize = uint64(binary.LittleEndian.Uint32(hdr))
+	case 8:
+		z.contentSize = binary.LittleEndian.Uint64(hdr)
+	}
+	if singleSegment {
+		z.windowSize = z.contentSize
+	}
+	z.blockMax = maxBlockSize
+	if z.windowSize < maxBlockSize {
+		z.blockMax = int(z.windowSize)
+	}
+
+	z.inFrame = true
+	z.hasChecksum = descriptor&(1<<2) != 0
+	z.produced = 0
+	z.checksum.reset()
+	z.reps = [3]uint32{1, 4, 8}
+	z.huffman = nil
+	z.llTable, z.ofTable, z.mlTable = nil, nil, nil
+	z.hist = z.hist[:0]
+	return nil
+}
+
+// readBlock decodes the next block of the current frame, RFC 8878
+// 3.1.1.2, leaving its content in z.out.
+func (z *Reader) readBlock() (last bool, err error) {
+	if err := z.readFull(z.scratch[:3]); err != nil {
+		return false, err
+	}
+	hdr := uint32(z.scratch[0]) | uint32(z.scratch[1])<<8 | uint32(z.scratch[2])<<16
+	last = hdr&1 == 1
+	size := int(hdr >> 3)
+	if size > z.blockMax {
+		return false, corrupt("block size %d exceeds maximum %d", size, z.blockMax)
+	}
+
+	// Discard history that matches can no longer refer to, before it has
+	// to be reallocated to make room for another block
+	if uint64(len(z.hist)) > z.windowSize && len(z.hist)+maxBlockSize > cap(z.hist) {
+		n := copy(z.hist, z.hist[uint64(len(z.hist))-z.windowSize:])
+		z.hist = z.hist[:n]
+	}
+	start := len(z.hist)
+
+	switch blockType := (hdr >> 1) & 3; blockType {
+	case blockTypeRaw:
+		z.hist = grow(z.hist, size)
+		if err := z.readFull(z.hist[start:]); err != nil {
+			return false, err
+		}
+	case blockTypeRLE:
+		if err := z.readFull(z.scratch[:1]); err != nil {
+			return false, err
+		}
+		z.hist = grow(z.hist, size)
+		for i := start; i < len(z.hist); i++ {
+			z.hist[i] = z.scratch[0]
+		}
+	case blockTypeCompressed:
+		z.block = grow(z.block[:0], size)
+		if err := z.readFull(z.block); err != nil {
+			return false, err
+		}
+		if err := z.decodeCompressedBlock(z.block); err != nil {
+			return false, err
+		}
+	default:
+		return false, corrupt("reserved block type")
+	}
+	z.out = z.hist[start:]
+	return last, nil
+}
+
+// decodeCompressedBlock appends the content of a compressed block to
+// z.hist, RFC 8878 3.1.1.3.
+func (z *Reader) decodeCompressedBlock(src []byte) error {
+	lits, n, err := z.decodeLiterals(src)
+	if err != nil {
+		return err
+	}
+	return z.decodeSequences(src[n:], lits)
+}
+
+// decodeLiterals decodes the literals section at the start of src, RFC
+// 8878 3.1.1.3.1, returning the literals and the size of the section.
+func (z *Reader) decodeLiterals(src []byte) ([]byte, int, error) {
+	if len(src) < 1 {
+		return nil, 0, corrupt("missing literals section")
+	}
+	litType, sizeFormat := src[0]&3, (src[0]>>2)&3
+
+	if litType == literalsTypeRaw || litType == literalsTypeRLE {
+		var regenSize, hdrSize int
+		switch sizeFormat {
+		case 0, 2:
+			regenSize, hdrSize = int(src[0]>>3), 1
+		case 1:
+			if len(src) < 2 {
+				return nil, 0, corrupt("truncated literals header")
+			}
+			regenSize, hdrSize = int(src[0]>>4)|int(src[1])<<4, 2
+		case 3:
+			if len(src) < 3 {
+				return nil, 0, corrupt("truncated literals header")
+			}
+			regenSize, hdrSize = int(src[0]>>4)|int(src[1])<<4|int(src[2])<<12, 3
+		}
+		if regenSize > maxBlockSize {
+			return nil, 0, corrupt("literals size %d exceeds maximum", regenSize)
+		}
+		if litType == literalsTypeRaw {
+			if len(src) < hdrSize+regenSize {
+				return nil, 0, corrupt("truncated literals")
+			}
+			return src[hdrSize : hdrSize+regenSize], hdrSize + regenSize, nil
+		}
+		if len(src) < hdrSize+1 {
+			return nil, 0, corrupt("truncated literals")
+		}
+		z.lits = grow(z.lits[:0], regenSize)
+		for i := range z.lits {
+			z.lits[i] = src[hdrSize]
+		}
+		return z.lits, hdrSize + 1, nil
+	}
+
+	streams, hdrSize, sizeBits := 4, 3, uint(10)
+	switch sizeFormat {
+	case 0:
+		streams = 1
+	case 2:
+		hdrSize, sizeBits = 4, 14
+	case 3:
+		hdrSize, sizeBits = 5, 18
+	}
+	if len(src) < hdrSize {
+		return nil, 0, corrupt("truncated literals header")
+	}
+	var hdr uint64
+	for i := hdrSize - 1; i >= 0; i-- {
+		hdr = hdr<<8 | uint64(src[i])
+	}
+	regenSize := int(hdr>>4) & (1<<sizeBits - 1)
+	compressedSize := int(hdr>>(4+sizeBits)) & (1<<sizeBits - 1)
+	if regenSize > maxBlockSize {
+		return nil, 0, corrupt("literals size %d exceeds maximum", regenSize)
+	}
+	if len(src) < hdrSize+compressedSize {
+		return nil, 0, corrupt("truncated literals")
+	}
+	data := src[hdrSize : hdrSize+compressedSize]
+
+	if litType == literalsTypeCompressed {
+		n, err := z.readHuffmanTable(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		data = data[n:]
+	} else if z.huffman == nil {
+		return nil, 0, corrupt("treeless literals without a previous Huffman table")
+	}
+
+	z.lits = grow(z.lits[:0], regenSize)
+	if streams == 1 {
+		if err := z.huffman.decode(z.lits, data); err != nil {
+			return nil, 0, err
+		}
+		return z.lits, hdrSize + compressedSize, nil
+	}
+
+	// Four streams, preceded by a jump table with the size of the first
+	// three, RFC 8878 3.1.1.3.1.6
+	if len(data) < 6 {
+		return nil, 0, corrupt("truncated literals jump table")
+	}
+	var sizes [4]int
+	total := 6
+	for i := 0; i < 3; i++ {
+		sizes[i] = int(binary.LittleEndian.Uint16(data[2*i:]))
+		total += sizes[i]
+	}
+	if total > len(data) {
+		return nil, 0, corrupt("literals streams exceed their section")
+	}
+	sizes[3] = len(data) - total
+	segment := (regenSize + 3) / 4
+	if 3*segment > regenSize {
+		return nil, 0, corrupt("too few literals for four streams")
+	}
+	data = data[6:]
+	for i, size := range sizes {
+		dst := z.lits[i*segment:]
+		if i < 3 {
+			dst = dst[:segment]
+		}
+		if err := z.huffman.decode(dst, data[:size]); err != nil {
+			return nil, 0, err
+		}
+		data = data[size:]
+	}
+	return z.lits, hdrSize + compressedSize, nil
+}
+
+// readHuffmanTable reads the Huffman tree description at the start of
+// src, RFC 8878 4.2.1, returning its size.
+func (z *Reader) readHuffmanTable(src []byte) (int, error) {
+	if len(src) < 1 {
+		return 0, corrupt("missing Huffman tree description")
+	}
+	var (
+		weights [255]uint8
+		count   int
+		size    int
+	)
+	if hdr := int(src[0]); hdr >= 128 {
+		// Weights stored directly as 4-bit values
+		count = hdr - 127
+		size = 1 + (count+1)/2
+		if len(src) < size {
+			return 0, corrupt("truncated Huffman weights")
+		}
+		for i := 0; i < count; i++ {
+			b := src[1+i/2]
+			if i%2 == 0 {
+				weights[i] = b >> 4
+			} else {
+				weights[i] = b & 15
+			}
+		}
+	} else {
+		size = 1 + hdr
+		if len(src) < size {
+			return 0, corrupt("truncated Huffman weights")
+		}
+		var err error
+		if count, err = decodeWeights(weights[:], src[1:size]); err != nil {
+			return 0, err
+		}
+	}
+
+	table, err := newHuffmanTable(weights[:count])
+	if err != nil {
+		return 0, err
+	}
+	z.huffman = table
+	return size, nil
+}
+
+// decodeWeights decodes FSE compressed Huffman weights into dst, returning
+// the number of weights, RFC 8878 4.2.1.2.
+func decodeWeights(dst []uint8, src []byte) (int, error) {
+	norm, tableLog, n, err := readNormalizedCounts(src, 255, maxWeightsLog)
+	if err != nil {
+		return 0, err
+	}
+	table := newFSEDecoder(tableLog, norm)
+	br, err := newBackwardBitReader(src[n:])
+	if err != nil {
+		return 0, err
+	}
+
+	// Two interleaved states share the bitstream, and decoding stops once
+	// it has been overrun, with the other state holding the last symbol
+	states := [2]uint32{
+		uint32(br.readBits(tableLog)),
+		uint32(br.readBits(tableLog)),
+	}
+	var count int
+	for i := 0; ; i ^= 1 {
+		if count+2 > len(dst) {
+			return 0, corrupt("too many Huffman weights")
+		}
+		dst[count] = table.entries[states[i]].symbol
+		count++
+		states[i] = table.next(states[i], br)
+		if br.pos < 0 {
+			dst[count] = table.entries[states[i^1]].symbol
+			return count + 1, nil
+		}
+	}
+}
+
+// decodeSequences decodes the sequences section in src and executes the
+// sequences against lits, appending the result to z.hist, RFC 8878
+// 3.1.1.3.2 and 3.1.1.4.
+func (z *Reader) decodeSequences(src, lits []byte) error {
+	if len(src) < 1 {
+		return corrupt("missing sequences section")
+	}
+	numSeqs := int(src[0])
+	src = src[1:]
+	switch {
+	case numSeqs == 0:
+		if len(src) != 0 {
+			return corrupt("unexpected data after empty sequences section")
+		}
+		z.hist = append(z.hist, lits...)
+		return nil
+	case numSeqs < 128:
+	case numSeqs < 255:
+		if len(src) < 1 {
+			return corrupt("truncated sequences header")
+		}
+		numSeqs = (numSeqs-128)<<8 + int(src[0])
+		src = src[1:]
+	default:
+		if len(src) < 2 {
+			return corrupt("truncated sequences header")
+		}
+		numSeqs = int(binary.LittleEndian.Uint16(src)) + 0x7F00
+		src = src[2:]
+	}
+
+	if len(src) < 1 {
+		return corrupt("truncated sequences header")
+	}
+	modes := src[0]
+	src = src[1:]
+	if modes&3 != 0 {
+		return corrupt("reserved sequence compression mode bits are set")
+	}
+	for _, t := range []struct {
+		mode       uint8
+		table      **fseDecoder
+		predefined *fseDecoder
+		maxSymbol  int
+		maxLog     uint
+	}{
+		{modes >> 6, &z.llTable, literalLengthDecoder, len(literalLengthBaselines) - 1, maxLiteralLengthLog},
+		{(modes >> 4) & 3, &z.ofTable, offsetDecoder, maxOffsetCode, maxOffsetLog},
+		{(modes >> 2) & 3, &z.mlTable, matchLengthDecoder, len(matchLengthBaselines) - 1, maxMatchLengthLog},
+	} {
+		switch t.mode {
+		case sequenceModePredefined:
+			*t.table = t.predefined
+		case sequenceModeRLE:
+			if len(src) < 1 || int(src[0]) > t.maxSymbol {
+				return corrupt("invalid RLE sequence code")
+			}
+			*t.table = &fseDecoder{entries: []fseEntry{{symbol: src[0]}}}
+			src = src[1:]
+		case sequenceModeCompressed:
+			norm, tableLog, n, err := readNormalizedCounts(src, t.maxSymbol, t.maxLog)
+			if err != nil {
+				return err
+			}
+			*t.table = newFSEDecoder(tableLog, norm)
+			src = src[n:]
+		case sequenceModeRepeat:
+			if *t.table == nil {
+				return corrupt("repeated sequence table without a previous table")
+			}
+		}
+	}
+
+	br, err := newBackwardBitReader(src)
+	if err != nil {
+		return err
+	}
+	ll, of, ml := z.llTable, z.ofTable, z.mlTable
+	llState := uint32(br.readBits(ll.tableLog))
+	ofState := uint32(br.readBits(of.tableLog))
+	mlState := uint32(br.readBits(ml.tableLog))
+
+	start := len(z.hist)
+	for i := 0; i < numSeqs; i++ {
+		llCode := ll.entries[llState].symbol
+		ofCode := of.entries[ofState].symbol
+		mlCode := ml.entries[mlState].symbol
+
+		offsetValue := uint32(1)<<ofCode + uint32(br.readBits(uint(ofCode)))
+		matchLen := matchLengthBaselines[mlCode] + uint32(br.readBits(uint(matchLengthExtraBits[mlCode])))
+		litLen := literalLengthBaselines[llCode] + uint32(br.readBits(uint(literalLengthExtraBits[llCode])))
+		if i < numSeqs-1 {
+			llState = ll.next(llState, br)
+			mlState = ml.next(mlState, br)
+			ofState = of.next(ofState, br)
+		}
+
+		if int(litLen) > len(lits) {
+			return corrupt("sequence literals exceed literals section")
+		}
+		if len(z.hist)-start+int(litLen)+int(matchLen) > z.blockMax {
+			return corrupt("block content exceeds maximum size %d", z.blockMax)
+		}
+		z.hist = append(z.hist, lits[:litLen]...)
+		lits = lits[litLen:]
+
+		offset := z.offset(offsetValue, litLen)
+		if offset == 0 || uint64(offset) > uint64(len(z.hist)) || uint64(offset) > z.windowSize {
+			return corrupt("invalid match offset %d", offset)
+		}
+		pos := len(z.hist) - int(offset)
+		for remaining := int(matchLen); remaining > 0; {
+			n := len(z.hist) - pos
+			if n > remaining {
+				n = remaining
+			}
+			z.hist = append(z.hist, z.hist[pos:pos+n]...)
+			pos += n
+			remaining -= n
+		}
+	}
+	if br.pos != 0 {
+		return corrupt("sequences bitstream not fully consumed")
+	}
+	if len(z.hist)-start+len(lits) > z.blockMax {
+		return corrupt("block content exceeds maximum size %d", z.blockMax)
+	}
+	z.hist = append(z.hist, lits...)
+	return nil
+}
+
+// offset returns the match offset for an offset value, keeping track of
+// the repeat offsets, RFC 8878 3.1.1.5. It returns 0 for an invalid
+// repeat offset.
+func (z *Reader) offset(value, litLen uint32) uint32 {
+	if value > 3 {
+		offset := value - 3
+		z.reps = [3]uint32{offset, z.reps[0], z.reps[1]}
+		return offset
+	}
+	if litLen == 0 {
+		value++
+	}
+	var offset uint32
+	switch value {
+	case 1:
+		return z.reps[0]
+	case 2:
+		offset = z.reps[1]
+		z.reps = [3]uint32{offset, z.reps[0], z.reps[2]}
+	case 3:
+		offset = z.reps[2]
+		z.reps = [3]uint32{offset, z.reps[0], z.reps[1]}
+	default:
+		offset = z.reps[0] - 1
+		z.reps = [3]uint32{offset, z.reps[0], z.reps[1]}
+	}
+	return offset
+}
+
+// readNormalizedCounts reads the description of an FSE table from the start
+// of src, RFC 8878 4.1.1, returning its normalized distribution, its
+// accuracy log and the size of the description.
+func readNormalizedCounts(src []byte, maxSymbol int, maxLog uint) ([]int16, uint, int, error) {
+	br := &forwardBitReader{src: src}
+	tableLog := uint(br.readBits(4)) + 5
+	if tableLog > maxLog {
+		return nil, 0, 0, corrupt("FSE accuracy log %d exceeds maximum %d", tableLog, maxLog)
+	}
+
+	var (
+		norm      []int16
+		remaining = int32(1)<<tableLog + 1
+		threshold = int32(1) << tableLog
+		nbBits    = tableLog + 1
+		prevZero  bool
+	)
+	for remaining > 1 {
+		if prevZero {
+			// A zero probability is followed by the number of further
+			// zeros, in 2-bit repeat flags
+			for {
+				repeat := int(br.readBits(2))
+				for i := 0; i < repeat; i++ {
+					norm = append(norm, 0)
+				}
+				if repeat != 3 || len(norm) > maxSymbol {
+					break
+				}
+			}
+		}
+		if len(norm) > maxSymbol || br.overrun() {
+			return nil, 0, 0, corrupt("invalid FSE table description")
+		}
+
+		limit := 2*threshold - 1 - remaining
+		count := int32(br.peekBits(nbBits - 1))
+		if count < limit {
+			br.pos += int(nbBits - 1)
+		} else {
+			count = int32(br.peekBits(nbBits))
+			if count >= threshold {
+				count -= limit
+			}
+			br.pos += int(nbBits)
+		}
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		if remaining < 1 {
+			return nil, 0, 0, corrupt("invalid FSE table description")
+		}
+		norm = append(norm, int16(count))
+		prevZero = count == 0
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if br.overrun() {
+		return nil, 0, 0, corrupt("truncated FSE table description")
+	}
+	return norm, tableLog, (br.pos + 7) / 8, nil
+}
+
+// fseDecoder decodes symbols with a finite state entropy table.
+type fseDecoder struct {
+	tableLog uint
+	entries  []fseEntry
+}
+
+// fseEntry is the symbol decoded by a state, along with the number of bits
+// to read and add to base to find the next state.
+type fseEntry struct {
+	symbol uint8
+	nbBits uint8
+	base   uint16
+}
+
+func newFSEDecoder(tableLog uint, norm []int16) *fseDecoder {
+	tableSize := 1 << tableLog
+	next := make([]uint32, len(norm))
+	for s, n := range norm {
+		if n == -1 {
+			next[s] = 1
+		} else {
+			next[s] = uint32(n)
+		}
+	}
+	d := &fseDecoder{
+		tableLog: tableLog,
+		entries:  make([]fseEntry, tableSize),
+	}
+	for u, s := range spreadSymbols(tableLog, norm) {
+		x := next[s]
+		next[s]++
+		nbBits := tableLog - uint(bits.Len32(x)-1)
+		d.entries[u] = fseEntry{
+			symbol: s,
+			nbBits: uint8(nbBits),
+			base:   uint16(x<<nbBits) - uint16(tableSize),
+		}
+	}
+	return d
+}
+
+// next reads the bits that lead from state to the next state.
+func (d *fseDecoder) next(state uint32, br *backwardBitReader) uint32 {
+	e := d.entries[state]
+	return uint32(e.base) + uint32(br.readBits(uint(e.nbBits)))
+}
+
+// huffmanTable decodes Huffman coded literals by looking up the next
+// maxBits bits of the stream.
+type huffmanTable struct {
+	maxBits uint
+	entries []huffmanEntry
+}
+
+type huffmanEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+// newHuffmanTable builds a decoding table from the weights of all but the
+// last symbol, whose weight is implied, RFC 8878 4.2.1.3.
+func newHuffmanTable(weights []uint8) (*huffmanTable, error) {
+	var total uint32
+	for _, w := range weights {
+		if w > maxHuffmanBits {
+			return nil, corrupt("Huffman weight %d exceeds maximum", w)
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, corrupt("Huffman weights are all zero")
+	}
+	maxBits := uint(bits.Len32(total))
+	if maxBits > maxHuffmanBits {
+		return nil, corrupt("Huffman code length %d exceeds maximum", maxBits)
+	}
+	left := uint32(1)<<maxBits - total
+	if left&(left-1) != 0 {
+		return nil, corrupt("Huffman weights do not form a complete tree")
+	}
+	weights = append(weights[:len(weights):len(weights)], uint8(bits.Len32(left)))
+
+	// Codes are assigned in order of increasing weight, then symbol, so
+	// each symbol fills a run of table entries in that order
+	t := &huffmanTable{
+		maxBits: maxBits,
+		entries: make([]huffmanEntry, 1<<maxBits),
+	}
+	var pos int
+	for w := uint8(1); w <= uint8(maxBits); w++ {
+		for s, sw := range weights {
+			if sw != w {
+				continue
+			}
+			e := huffmanEntry{symbol: uint8(s), nbBits: uint8(maxBits) + 1 - w}
+			for end := pos + 1<<(w-1); pos < end; pos++ {
+				t.entries[pos] = e
+			}
+		}
+	}
+	return t, nil
+}
+
+// decode fills dst with symbols decoded from a single Huffman stream, which
+// must be consumed exactly.
+func (t *huffmanTable) decode(dst []byte, src []byte) error {
+	br, err := newBackwardBitReader(src)
+	if err != nil {
+		return err
+	}
+	for i := range dst {
+		e := t.entries[br.peekBits(t.maxBits)]
+		dst[i] = e.symbol
+		br.pos -= int(e.nbBits)
+	}
+	if br.pos != 0 {
+		return corrupt("Huffman stream not fully consumed")
+	}
+	return nil
+}
+
+// backwardBitReader reads the bitstreams written by bitWriter, starting
+// from their final bit. Reading past the start yields zeros, leaving pos
+// negative.
+type backwardBitReader struct {
+	src []byte
+	pos int // number of unread bits
+}
+
+func newBackwardBitReader(src []byte) (*backwardBitReader, error) {
+	if len(src) == 0 || src[len(src)-1] == 0 {
+		return nil, corrupt("missing bitstream padding")
+	}
+	return &backwardBitReader{
+		src: src,
+		pos: 8*(len(src)-1) + bits.Len8(src[len(src)-1]) - 1,
+	}, nil
+}
+
+// peekBits returns the next n <= 56 bits without consuming them.
+func (br *backwardBitReader) peekBits(n uint) uint64 {
+	if br.pos <= 0 {
+		return 0
+	}
+	if start := br.pos - int(n); start >= 0 {
+		return loadBits(br.src, start, n)
+	}
+	return loadBits(br.src, 0, uint(br.pos)) << (n - uint(br.pos))
+}
+
+func (br *backwardBitReader) readBits(n uint) uint64 {
+	v := br.peekBits(n)
+	br.pos -= int(n)
+	return v
+}
+
+// forwardBitReader reads a little-endian bitstream from its first bit.
+// Reading past the end yields zeros.
+type forwardBitReader struct {
+	src []byte
+	pos int // number of bits read
+}
+
+func (br *forwardBitReader) peekBits(n uint) uint64 {
+	if br.pos >= 8*len(br.src) {
+		return 0
+	}
+	return loadBits(br.src, br.pos, n)
+}
+
+func (br *forwardBitReader) readBits(n uint) uint64 {
+	v := br.peekBits(n)
+	br.pos += int(n)
+	return v
+}
+
+func (br *forwardBitReader) overrun() bool {
+	return br.pos > 8*len(br.src)
+}
+
+// loadBits returns the n <= 56 bits of src starting at bit offset off,
+// with any bits past the end of src read as zeros.
+func loadBits(src []byte, off int, n uint) uint64 {
+	var buf [8]byte
+	copy(buf[:], src[off/8:])
+	return binary.LittleEndian.Uint64(buf[:]) >> uint(off%8) & (1<<n - 1)
+}
+
+// grow extends b by n bytes, reallocating if needed.
+func grow(b []byte, n int) []byte {
+	if cap(b)-len(b) < n {
+		nb := make([]byte, len(b), 2*cap(b)+n)
+		copy(nb, b)
+		b = nb
+	}
+	return b[:len(b)+n]
+}
@@ -0,0 +1,223 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func decompress(t *testing.T, frame []byte) []byte {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// records returns n lines of JSON-like text, which compresses to Huffman
+// coded literals and FSE compressed sequence tables.
+func records(n int) []byte {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "{\"id\": %d, \"name\": \"item-%d\", \"tags\": [\"alpha\", \"beta\"]}\n", i, i*i)
+	}
+	return []byte(b.String())
+}
+
+// bases returns n pseudo-random letters from a four letter alphabet, which
+// compresses to Huffman coded literals split into four streams, without any
+// matches.
+func bases(n int) []byte {
+	b := make([]byte, n)
+	x := uint32(1)
+	for i := range b {
+		x = x*1103515245 + 12345
+		b[i] = "acgt"[x>>16&3]
+	}
+	return b
+}
+
+// The frames were produced by the reference implementation's command line
+// tool, with zstd -19.
+func TestReaderGolden(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name  string
+		input []byte
+		frame string
+	}{
+		{
+			"huffman literals",
+			records(40)[:300],
+			"28b52ffd04689d020022840e11907d36423cf6227597c206e1eed5fd810e22a982d641a614d0ddbf2de107f18f66fbbe05f67abefd413c1957eefa81bdbc0f7f1024b08ff5790a20a0330f74d87e10c23c829c0f43c47321763afb7bfc3e7ae7",
+		},
+		{
+			"compressed sequence tables",
+			records(40),
+			"28b52ffd640008ad0600c20b2016804d07aa9015c866942121f7a77025d9677023678c13c9bfbbfeadab3f9b3391951157fd50350f131beffe14d77fdd3fd7ead59ccdbdf693753d71f16e2fb17f53fd7d35376772ff7eeb6e62e21d1ea2ffb6ffaed6e6e4c67ddd44042ac38e49410e26720e2b02c2a4e5982c10ec8647991a0b08539e03b240b880b0a4312a50a811e0d536edbf01c0a3160e12601068107c242ef86708f303db41e1832d08bd2f6b7db1c32222db7d74af3ab396753229be991a2390becc9a6f4cfb42ef4ee59291bc565ed9a76fa4ef139a98ea0ad0aad9f43f07",
+		},
+		{
+			"four literals streams",
+			bases(1100),
+			"28b52ffd644c03350900ca44840406e00f6525c13a450045004500a6d7a41dab352b0f7c1bb8f40c262fb816733ad9453b7de0439f82ae7d15f5776c1d43a0e55b4a88196b6e6e6c53440fb985a25aac7fad0ee9f901e56b60fbabddc1c9fe6990a2e9c0ca9bee506b573033d50987925e08c9c5c9bc96b62c12d795df5f7925dd185afccd6316a16a4323a19f97a161c2eabd3944cf450f55b23d4f1c609b6f857e726770c3ca183c3e5701551b74ce34ceffd15c092d518e845b2de12ddd2cb86cf2c507f7b13773bb8cf5da60af6ba83855357edff55ea21261f27050124a796b65d7c75b67d26167527d3289ce414a04617196f660adf28e383e3473a66529ab5bb4d80254276de7ee2b4a75aaa5e265280a0ace67d8620bcf23f466890cf40046f5805142d9509b38434eaf70009264c85e",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			frame, err := hex.DecodeString(tc.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := decompress(t, frame); !bytes.Equal(got, tc.input) {
+				t.Fatalf("expected %q, got %q", tc.input, got)
+			}
+		})
+	}
+}
+
+// TestReaderWithZstdCLI decodes frames produced by the reference
+// implementation's command line tool at a range of levels, when it is
+// installed.
+func TestReaderWithZstdCLI(t *testing.T) {
+	t.Parallel()
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd command line tool not installed")
+	}
+
+	// Large enough for several blocks, so that later blocks repeat
+	// earlier tables
+	input := append(records(4000), bases(200000)...)
+	for _, args := range [][]string{
+		{"-1"},
+		{"-3"},
+		{"-19"},
+		{"--fast=5"},
+		{"--no-check"},
+		{"--long", "-19"},
+	} {
+		args := args
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			t.Parallel()
+			cmd := exec.Command(path, append(args, "-c", "-q")...)
+			cmd.Stdin = bytes.NewReader(input)
+			frame, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("zstd failed: %s", err)
+			}
+			if got := decompress(t, frame); !bytes.Equal(got, input) {
+				t.Fatalf("decoded %d bytes that do not match input", len(got))
+			}
+		})
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	t.Parallel()
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, tc := range []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"raw block", []byte("hello, world")},
+		{"rle block", bytes.Repeat([]byte("a"), 1000)},
+		{"sequences", records(100)},
+		{"several blocks", append(records(5000), random...)},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := decompress(t, compress(t, tc.input)); !bytes.Equal(got, tc.input) {
+				t.Fatalf("decoded %d bytes that do not match input", len(got))
+			}
+		})
+	}
+
+	t.Run("concatenated and skippable frames", func(t *testing.T) {
+		t.Parallel()
+		var frames []byte
+		frames = append(frames, compress(t, []byte("hello, "))...)
+		frames = append(frames, 0x52, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 1, 2, 3)
+		frames = append(frames, compress(t, []byte("world"))...)
+		if got := decompress(t, frames); string(got) != "hello, world" {
+			t.Fatalf("expected %q, got %q", "hello, world", got)
+		}
+	})
+}
+
+func TestReaderErrors(t *testing.T) {
+	t.Parallel()
+	valid := compress(t, records(100))
+
+	// frame returns a frame with the given header descriptor, followed by
+	// the rest of its content
+	frame := func(descriptor byte, rest ...byte) []byte {
+		frame := make([]byte, 4, 5+len(rest))
+		binary.LittleEndian.PutUint32(frame, magicNumber)
+		return append(append(frame, descriptor), rest...)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		input   []byte
+		wantErr string
+	}{
+		{"empty", nil, "unexpected EOF"},
+		{"bad magic", []byte("not a zstd frame"), "invalid magic number"},
+		{"truncated header", valid[:5], "unexpected EOF"},
+		{"truncated block", valid[:len(valid)/2], "unexpected EOF"},
+		{"truncated checksum", valid[:len(valid)-2], "unexpected EOF"},
+		{"checksum mismatch", append(valid[:len(valid)-4:len(valid)-4], 0, 0, 0, 0), "checksum mismatch"},
+		{"dictionary", frame(0x01, 0x38, 0x07), "dictionaries are not supported"},
+		{"reserved bit", frame(0x08, 0x38), "reserved frame header bit"},
+		{"reserved block type", frame(0x00, 0x38, 0x07, 0x00, 0x00), "reserved block type"},
+		{"block too large", frame(0x20, 0x04, 0x29, 0, 0, 0, 0, 0), "block size 5 exceeds maximum 4"},
+		{"content size mismatch", frame(0x20, 0x04, 0x11, 0x00, 0x00, 'a', 'b'), "content size does not match"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			r, err := NewReader(bytes.NewReader(tc.input))
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %q", tc.wantErr, err)
+			}
+		})
+	}
+
+	// Corrupt frames may or may not be detected before the checksum, but
+	// must never cause a panic
+	t.Run("corrupt frames", func(t *testing.T) {
+		t.Parallel()
+		frame, _ := hex.DecodeString("28b52ffd644c03350900ca44840406e00f6525c13a450045004500a6d7a41dab352b0f7c1bb8f40c262fb816733ad9453b7de0439f82ae7d15f5776c1d43a0e55b4a88196b6e6e6c53440fb985a25aac7fad0ee9f901e56b60fbabddc1c9fe6990a2e9c0ca9bee506b573033d50987925e08c9c5c9bc96b62c12d795df5f7925dd185afccd6316a16a4323a19f97a161c2eabd3944cf450f55b23d4f1c609b6f857e726770c3ca183c3e5701551b74ce34ceffd15c092d518e845b2de12ddd2cb86cf2c507f7b13773bb8cf5da60af6ba83855357edff55ea21261f27050124a796b65d7c75b67d26167527d3289ce414a04617196f660adf28e383e3473a66529ab5bb4d80254276de7ee2b4a75aaa5e265280a0ace67d8620bcf23f466890cf40046f5805142d9509b38434eaf70009264c85e")
+		frame = append(frame, valid...)
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 2000; i++ {
+			corrupt := append([]byte(nil), frame...)
+			corrupt[rng.Intn(len(corrupt))] ^= byte(1 << uint(rng.Intn(8)))
+			if r, err := NewReader(bytes.NewReader(corrupt)); err == nil {
+				io.Copy(io.Discard, r)
+			}
+		}
+	})
+}
@@ -0,0 +1,611 @@
+// Package zstd provides streaming implementations of a Zstandard decoder and
+// a limited Zstandard encoder, as defined in RFC 8878.
+//
+// The decoder handles any frame that does not depend on a dictionary. The
+// encoder implements only what is needed to serve zstd-encoded responses:
+// compressed blocks are built with a simple greedy match finder, literals are
+// stored uncompressed rather than Huffman coded, and sequences are encoded
+// with the predefined FSE tables. The output is a valid zstd frame that any
+// conforming decoder can read, but it will not compress as well as the
+// reference implementation.
+//
+// For more info, see:
+// https://www.rfc-editor.org/rfc/rfc8878
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	magicNumber = 0xFD2FB528
+
+	// Each block holds at most 128 KiB of data, which is also the window
+	// size advertised in the frame header, so that matches never need to
+	// reach back beyond the current block
+	maxBlockSize     = 128 << 10
+	windowDescriptor = (17 - 10) << 3
+
+	// Frame_Header_Descriptor with only the Content_Checksum_flag set
+	frameHeaderDescriptor = 1 << 2
+
+	blockTypeRaw        = 0
+	blockTypeRLE        = 1
+	blockTypeCompressed = 2
+
+	minMatch = 4
+	hashLog  = 14
+)
+
+var errClosed = errors.New("zstd: write to closed Writer")
+
+// Writer is an io.WriteCloser that compresses data written to it into a
+// single zstd frame. Data is emitted one block at a time, as each block of
+// up to 128 KiB fills up and when Flush or Close is called.
+type Writer struct {
+	w           io.Writer
+	buf         []byte
+	wroteHeader bool
+	closed      bool
+	err         error
+	checksum    xxhash64
+
+	// Scratch space reused across blocks
+	table [1 << hashLog]int32
+	lits  []byte
+	seqs  []sequence
+	out   []byte
+}
+
+// NewWriter returns a new Writer. Writes to the returned Writer are
+// compressed and written to w. It is the caller's responsibility to call
+// Close on the Writer when done.
+func NewWriter(w io.Writer) *Writer {
+	z := &Writer{w: w}
+	z.checksum.reset()
+	return z
+}
+
+// Write compresses p, writing complete blocks to the underlying writer as
+// they fill up.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.closed {
+		return 0, errClosed
+	}
+	var n int
+	for len(p) > 0 {
+		if len(z.buf) == maxBlockSize {
+			if err := z.writeBlock(false); err != nil {
+				return n, err
+			}
+		}
+		k := maxBlockSize - len(z.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		z.buf = append(z.buf, p[:k]...)
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Flush writes any pending data to the underlying writer as a complete
+// block, so that a decoder can decompress everything written so far.
+func (z *Writer) Flush() error {
+	if z.err != nil {
+		return z.err
+	}
+	if z.closed {
+		return errClosed
+	}
+	if len(z.buf) == 0 && z.wroteHeader {
+		return nil
+	}
+	return z.writeBlock(false)
+}
+
+// Close writes any pending data as the frame's last block, followed by the
+// frame's content checksum. It does not close the underlying writer.
+func (z *Writer) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	if z.closed {
+		return nil
+	}
+	z.closed = true
+	if err := z.writeBlock(true); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(z.checksum.sum()))
+	return z.write(sum[:])
+}
+
+func (z *Writer) write(p []byte) error {
+	if _, err := z.w.Write(p); err != nil {
+		z.err = err
+	}
+	return z.err
+}
+
+// writeBlock writes the pending data as a single block, preceded by the
+// frame header if this is the first block.
+func (z *Writer) writeBlock(last bool) error {
+	if !z.wroteHeader {
+		z.wroteHeader = true
+		var hdr [6]byte
+		binary.LittleEndian.PutUint32(hdr[:], magicNumber)
+		hdr[4] = frameHeaderDescriptor
+		hdr[5] = windowDescriptor
+		if err := z.write(hdr[:]); err != nil {
+			return err
+		}
+	}
+
+	src := z.buf
+	z.buf = z.buf[:0]
+	z.checksum.write(src)
+
+	blockType, size, content := blockTypeRaw, len(src), src
+	if isRun(src) {
+		blockType, content = blockTypeRLE, src[:1]
+	} else if compressed := z.compressBlock(src); compressed != nil && len(compressed) < len(src) {
+		blockType, size, content = blockTypeCompressed, len(compressed), compressed
+	}
+
+	hdr := uint32(size)<<3 | uint32(blockType)<<1
+	if last {
+		hdr |= 1
+	}
+	if err := z.write([]byte{byte(hdr), byte(hdr >> 8), byte(hdr >> 16)}); err != nil {
+		return err
+	}
+	return z.write(content)
+}
+
+// isRun reports whether b is a non-empty run of a single repeated byte,
+// which is best encoded as an RLE block.
+func isRun(b []byte) bool {
+	if len(b) < 2 {
+		return false
+	}
+	for _, c := range b[1:] {
+		if c != b[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// sequence is a run of literals followed by a match, in terms of the actual
+// lengths and offset rather than their encoded values.
+type sequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32
+}
+
+// compressBlock returns the content of a compressed block holding src, or
+// nil if no matches were found, in which case a raw block is smaller.
+func (z *Writer) compressBlock(src []byte) []byte {
+	z.findSequences(src)
+	if len(z.seqs) == 0 {
+		return nil
+	}
+
+	// Literals_Section_Header for Raw_Literals_Block, RFC 8878 3.1.1.3.1.1
+	out := z.out[:0]
+	switch n := len(z.lits); {
+	case n < 1<<5:
+		out = append(out, byte(n<<3))
+	case n < 1<<12:
+		out = append(out, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		out = append(out, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	out = append(out, z.lits...)
+
+	// Sequences_Section_Header, RFC 8878 3.1.1.3.2.1, using
+	// Predefined_Mode for every symbol type
+	switch n := len(z.seqs); {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	out = append(out, 0)
+	out = encodeSequences(out, z.seqs)
+
+	z.out = out
+	return out
+}
+
+// findSequences splits src into literals and matches within src, using a
+// greedy single-entry hash table match finder.
+func (z *Writer) findSequences(src []byte) {
+	z.lits, z.seqs = z.lits[:0], z.seqs[:0]
+	for i := range z.table {
+		z.table[i] = 0
+	}
+
+	var litStart int
+	for i := 0; i+minMatch <= len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := (v * 2654435761) >> (32 - hashLog)
+		// Table entries are offset by one so that zero means empty
+		candidate := int(z.table[h]) - 1
+		z.table[h] = int32(i + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != v {
+			i++
+			continue
+		}
+
+		matchLen := minMatch
+		for i+matchLen < len(src) && src[candidate+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+		z.lits = append(z.lits, src[litStart:i]...)
+		z.seqs = append(z.seqs, sequence{
+			litLen:   uint32(i - litStart),
+			matchLen: uint32(matchLen),
+			offset:   uint32(i - candidate),
+		})
+		i += matchLen
+		litStart = i
+	}
+	z.lits = append(z.lits, src[litStart:]...)
+}
+
+// encodeSequences appends the FSE bitstream encoding seqs to out. The
+// bitstream is read backwards, so sequences are written last to first, and
+// each sequence's fields are written in the reverse of the order in which
+// they are read, RFC 8878 3.1.1.3.2.2.
+func encodeSequences(out []byte, seqs []sequence) []byte {
+	bw := bitWriter{out: out}
+	codes := make([]sequenceCodes, len(seqs))
+	for i, seq := range seqs {
+		codes[i] = newSequenceCodes(seq)
+	}
+
+	last := codes[len(codes)-1]
+	llState := literalLengthTable.initState(last.ll)
+	mlState := matchLengthTable.initState(last.ml)
+	ofState := offsetTable.initState(last.of)
+	last.writeExtraBits(&bw)
+
+	for i := len(codes) - 2; i >= 0; i-- {
+		c := codes[i]
+		offsetTable.encode(&bw, &ofState, c.of)
+		matchLengthTable.encode(&bw, &mlState, c.ml)
+		literalLengthTable.encode(&bw, &llState, c.ll)
+		c.writeExtraBits(&bw)
+	}
+
+	bw.addBits(uint64(mlState), matchLengthTable.tableLog)
+	bw.addBits(uint64(ofState), offsetTable.tableLog)
+	bw.addBits(uint64(llState), literalLengthTable.tableLog)
+	return bw.close()
+}
+
+// sequenceCodes holds the symbol codes and extra bits encoding one sequence.
+type sequenceCodes struct {
+	ll, ml, of             uint8
+	llExtra, mlExtra       uint32
+	ofExtra                uint32
+	llBits, mlBits, ofBits uint
+}
+
+func newSequenceCodes(seq sequence) sequenceCodes {
+	var c sequenceCodes
+	c.ll = lengthCode(literalLengthBaselines[:], seq.litLen)
+	c.llExtra = seq.litLen - literalLengthBaselines[c.ll]
+	c.llBits = uint(literalLengthExtraBits[c.ll])
+
+	c.ml = lengthCode(matchLengthBaselines[:], seq.matchLen)
+	c.mlExtra = seq.matchLen - matchLengthBaselines[c.ml]
+	c.mlBits = uint(matchLengthExtraBits[c.ml])
+
+	// Offset values 1-3 refer to repeated offsets, which are never used
+	// here, so every offset is encoded as a new one
+	offsetValue := seq.offset + 3
+	c.of = uint8(bits.Len32(offsetValue) - 1)
+	c.ofExtra = offsetValue - 1<<c.of
+	c.ofBits = uint(c.of)
+	return c
+}
+
+func (c sequenceCodes) writeExtraBits(bw *bitWriter) {
+	bw.addBits(uint64(c.llExtra), c.llBits)
+	bw.addBits(uint64(c.mlExtra), c.mlBits)
+	bw.addBits(uint64(c.ofExtra), c.ofBits)
+}
+
+// lengthCode returns the code for the largest baseline no greater than n.
+func lengthCode(baselines []uint32, n uint32) uint8 {
+	code := len(baselines) - 1
+	for baselines[code] > n {
+		code--
+	}
+	return uint8(code)
+}
+
+// Literals length and match length codes, RFC 8878 3.1.1.3.2.1.1
+var (
+	literalLengthBaselines = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	literalLengthExtraBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	matchLengthBaselines = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	matchLengthExtraBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// Predefined distributions, RFC 8878 3.1.1.3.2.2
+var (
+	literalLengthDefaultNorm = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	matchLengthDefaultNorm = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	offsetDefaultNorm = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+)
+
+// Predefined FSE tables
+var (
+	literalLengthTable = newFSEEncoder(6, literalLengthDefaultNorm)
+	matchLengthTable   = newFSEEncoder(6, matchLengthDefaultNorm)
+	offsetTable        = newFSEEncoder(5, offsetDefaultNorm)
+)
+
+// fseEncoder encodes symbols with a finite state entropy table built from a
+// normalized distribution, where -1 marks a "less than 1" probability.
+type fseEncoder struct {
+	tableLog   uint
+	stateTable []uint32
+	transforms []fseTransform
+}
+
+type fseTransform struct {
+	deltaFindState int
+	deltaNbBits    uint32
+}
+
+func newFSEEncoder(tableLog uint, norm []int16) *fseEncoder {
+	tableSize := 1 << tableLog
+
+	symbols := spreadSymbols(tableLog, norm)
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			cumul[s+1] = cumul[s] + 1
+		} else {
+			cumul[s+1] = cumul[s] + int(n)
+		}
+	}
+
+	e := &fseEncoder{
+		tableLog:   tableLog,
+		stateTable: make([]uint32, tableSize),
+		transforms: make([]fseTransform, len(norm)),
+	}
+	for u, s := range symbols {
+		e.stateTable[cumul[s]] = uint32(tableSize + u)
+		cumul[s]++
+	}
+
+	var total int
+	for s, n := range norm {
+		switch n {
+		case 0:
+		case -1, 1:
+			e.transforms[s] = fseTransform{
+				deltaFindState: total - 1,
+				deltaNbBits:    uint32(tableLog<<16) - uint32(tableSize),
+			}
+			total++
+		default:
+			maxBitsOut := tableLog - uint(bits.Len(uint(n-1))-1)
+			e.transforms[s] = fseTransform{
+				deltaFindState: total - int(n),
+				deltaNbBits:    uint32(maxBitsOut<<16) - uint32(int(n)<<maxBitsOut),
+			}
+			total += int(n)
+		}
+	}
+	return e
+}
+
+// spreadSymbols returns the symbol decoded by each state of an FSE table
+// built from norm, spread across the table as described by RFC 8878 4.1.1,
+// with "less than 1" symbols at the end.
+func spreadSymbols(tableLog uint, norm []int16) []uint8 {
+	tableSize := 1 << tableLog
+	symbols := make([]uint8, tableSize)
+	high := tableSize - 1
+	for s, n := range norm {
+		if n == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	step := tableSize>>1 + tableSize>>3 + 3
+	var pos int
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & (tableSize - 1)
+			for pos > high {
+				pos = (pos + step) & (tableSize - 1)
+			}
+		}
+	}
+	return symbols
+}
+
+// initState returns the state from which symbol is the first to be
+// decoded, without writing any bits.
+func (e *fseEncoder) initState(symbol uint8) uint32 {
+	tt := e.transforms[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - tt.deltaNbBits
+	return e.stateTable[int(value>>nbBitsOut)+tt.deltaFindState]
+}
+
+// encode writes the bits that lead a decoder from the state that decodes
+// symbol to the current state, and moves to the former.
+func (e *fseEncoder) encode(bw *bitWriter, state *uint32, symbol uint8) {
+	tt := e.transforms[symbol]
+	nbBitsOut := (*state + tt.deltaNbBits) >> 16
+	bw.addBits(uint64(*state), uint(nbBitsOut))
+	*state = e.stateTable[int(*state>>nbBitsOut)+tt.deltaFindState]
+}
+
+// bitWriter writes a little-endian bitstream that is read starting from its
+// final bit, as used by FSE, RFC 8878 4.1.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (bw *bitWriter) addBits(v uint64, n uint) {
+	bw.acc |= (v & (1<<n - 1)) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.out = append(bw.out, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nbits -= 8
+	}
+}
+
+// close terminates the bitstream with the padding bit that marks its end.
+func (bw *bitWriter) close() []byte {
+	bw.addBits(1, 1)
+	if bw.nbits > 0 {
+		bw.out = append(bw.out, byte(bw.acc))
+	}
+	return bw.out
+}
+
+// xxhash64 is a streaming implementation of the XXH64 hash with a seed of
+// zero, whose low 32 bits are used as a zstd frame's content checksum.
+type xxhash64 struct {
+	v     [4]uint64
+	mem   [32]byte
+	n     int
+	total uint64
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func (x *xxhash64) reset() {
+	// Variables rather than constants, since these additions overflow
+	p1, p2 := xxPrime1, xxPrime2
+	*x = xxhash64{v: [4]uint64{p1 + p2, p2, 0, -p1}}
+}
+
+func (x *xxhash64) write(p []byte) {
+	x.total += uint64(len(p))
+	if x.n > 0 {
+		k := copy(x.mem[x.n:], p)
+		x.n += k
+		p = p[k:]
+		if x.n < len(x.mem) {
+			return
+		}
+		x.stripe(x.mem[:])
+		x.n = 0
+	}
+	for len(p) >= len(x.mem) {
+		x.stripe(p)
+		p = p[len(x.mem):]
+	}
+	x.n = copy(x.mem[:], p)
+}
+
+func (x *xxhash64) stripe(p []byte) {
+	for i := range x.v {
+		x.v[i] = xxRound(x.v[i], binary.LittleEndian.Uint64(p[i*8:]))
+	}
+}
+
+func (x *xxhash64) sum() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v[0], 1) + bits.RotateLeft64(x.v[1], 7) +
+			bits.RotateLeft64(x.v[2], 12) + bits.RotateLeft64(x.v[3], 18)
+		for _, v := range x.v {
+			h = (h^xxRound(0, v))*xxPrime1 + xxPrime4
+		}
+	} else {
+		h = xxPrime5
+	}
+	h += x.total
+
+	p := x.mem[:x.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
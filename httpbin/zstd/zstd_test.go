@@ -0,0 +1,267 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func compress(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The expected frames were verified to decode to their inputs with a
+// reference zstd decoder.
+func TestWriterGolden(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", "28b52ffd043801000099e9d851"},
+		{"raw block", "hello, world", "28b52ffd043861000068656c6c6f2c20776f726c6442121b6d"},
+		{"rle block", strings.Repeat("a", 1000), "28b52ffd0438431f00612342da2e"},
+		{"single sequence", "hello hello hello hello hello!", "28b52ffd04386d00003868656c6c6f20210100a94b115f599ac8"},
+		{
+			"several sequences",
+			`{"args": {}, "headers": {"Accept": ["*/*"], "Accept-Encoding": ["zstd"]}, "args2": {}}`,
+			"28b52ffd04385d020084037b2261726773223a207b7d2c202268656164657222416363657074223a205b222a2f2a225d2c202d456e636f64696e677a737464225d327d06004d8830110008517eded36606d2ce3b4438e49f",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			if got := hex.EncodeToString(compress(t, []byte(tc.input))); got != tc.want {
+				t.Fatalf("expected frame\n%s\ngot\n%s", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestDecodeWithZstdCLI round-trips data through the reference
+// implementation's command line tool, when it is installed.
+func TestDecodeWithZstdCLI(t *testing.T) {
+	t.Parallel()
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd command not found")
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 300<<10)
+	rng.Read(random)
+	var mixed []byte
+	words := []string{`"headers": {`, `"Accept": `, `["*/*"]`, "}, ", "\n  "}
+	for len(mixed) < 500<<10 {
+		mixed = append(mixed, words[rng.Intn(len(words))]...)
+		if rng.Intn(10) == 0 {
+			mixed = append(mixed, byte(rng.Intn(256)))
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":  nil,
+		"run":    bytes.Repeat([]byte("z"), 200<<10),
+		"random": random,
+		"mixed":  mixed,
+	} {
+		cmd := exec.Command(path, "-d", "-c")
+		cmd.Stdin = bytes.NewReader(compress(t, data))
+		got, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: zstd -d failed: %s", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: decoded %d bytes that differ from the %d bytes written", name, len(got), len(data))
+		}
+	}
+}
+
+// blockHeaders parses the headers of the blocks in a frame written by
+// Writer, returning their types and sizes and whether each is the last.
+func blockHeaders(t *testing.T, frame []byte) (types []int, sizes []int, last []bool) {
+	t.Helper()
+	if len(frame) < 6 || binary.LittleEndian.Uint32(frame) != magicNumber {
+		t.Fatalf("missing frame header in %x", frame)
+	}
+	for p := frame[6:]; ; {
+		hdr := uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16
+		blockType, size := int(hdr>>1&3), int(hdr>>3)
+		types, sizes, last = append(types, blockType), append(sizes, size), append(last, hdr&1 == 1)
+		p = p[3:]
+		if blockType == blockTypeRLE {
+			p = p[1:]
+		} else {
+			p = p[size:]
+		}
+		if hdr&1 == 1 {
+			if len(p) != 4 {
+				t.Fatalf("expected 4 byte checksum after last block, got %d bytes", len(p))
+			}
+			return types, sizes, last
+		}
+	}
+}
+
+func TestWriterBlocks(t *testing.T) {
+	t.Parallel()
+
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	types, sizes, last := blockHeaders(t, compress(t, random))
+	if want := []int{maxBlockSize, maxBlockSize, 44 << 10}; !equalInts(sizes, want) {
+		t.Fatalf("expected incompressible block sizes %v, got %v", want, sizes)
+	}
+	if !equalInts(types, []int{blockTypeRaw, blockTypeRaw, blockTypeRaw}) {
+		t.Fatalf("expected raw blocks, got types %v", types)
+	}
+	if last[0] || last[1] || !last[2] {
+		t.Fatalf("expected only the final block to be last, got %v", last)
+	}
+
+	types, sizes, _ = blockHeaders(t, compress(t, bytes.Repeat([]byte("z"), 200<<10)))
+	if !equalInts(types, []int{blockTypeRLE, blockTypeRLE}) || !equalInts(sizes, []int{maxBlockSize, 72 << 10}) {
+		t.Fatalf("expected two RLE blocks, got types %v and sizes %v", types, sizes)
+	}
+
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog. ", 1000))
+	frame := compress(t, text)
+	types, _, _ = blockHeaders(t, frame)
+	if !equalInts(types, []int{blockTypeCompressed}) || len(frame) > len(text)/10 {
+		t.Fatalf("expected one compressed block much smaller than %d bytes, got types %v in %d bytes", len(text), types, len(frame))
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Write([]byte("hello, "))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Frame header plus one complete raw block
+	if buf.Len() != 6+3+len("hello, ") {
+		t.Fatalf("expected flushed block, got %x", buf.Bytes())
+	}
+	if err := w.Flush(); err != nil || buf.Len() != 16 {
+		t.Fatalf("expected redundant flush to write nothing, got %x, %v", buf.Bytes(), err)
+	}
+	w.Write([]byte("world"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected second close to succeed, got %v", err)
+	}
+	if _, sizes, _ := blockHeaders(t, buf.Bytes()); !equalInts(sizes, []int{7, 5}) {
+		t.Fatalf("expected blocks of 7 and 5 bytes, got %v", sizes)
+	}
+	got, want := buf.Bytes(), compress(t, []byte("hello, world"))
+	if !bytes.Equal(got[len(got)-4:], want[len(want)-4:]) {
+		t.Fatalf("expected checksum to cover the whole frame")
+	}
+
+	if _, err := w.Write([]byte("!")); err != errClosed {
+		t.Fatalf("expected errClosed writing after close, got %v", err)
+	}
+	if err := w.Flush(); err != errClosed {
+		t.Fatalf("expected errClosed flushing after close, got %v", err)
+	}
+}
+
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestWriterErrors(t *testing.T) {
+	t.Parallel()
+	wantErr := errors.New("write failed")
+	w := NewWriter(errWriter{wantErr})
+	if _, err := w.Write([]byte("buffered")); err != nil {
+		t.Fatalf("expected buffered write to succeed, got %v", err)
+	}
+	if err := w.Close(); err != wantErr {
+		t.Fatalf("expected %v, got %v", wantErr, err)
+	}
+	if _, err := w.Write([]byte("more")); err != wantErr {
+		t.Fatalf("expected sticky error %v, got %v", wantErr, err)
+	}
+}
+
+func TestFSETables(t *testing.T) {
+	t.Parallel()
+	for name, e := range map[string]*fseEncoder{
+		"literal length": literalLengthTable,
+		"match length":   matchLengthTable,
+		"offset":         offsetTable,
+	} {
+		tableSize := 1 << e.tableLog
+		seen := make(map[uint32]bool, tableSize)
+		for _, state := range e.stateTable {
+			if state < uint32(tableSize) || state >= uint32(2*tableSize) || seen[state] {
+				t.Fatalf("%s: invalid or duplicate state %d", name, state)
+			}
+			seen[state] = true
+		}
+	}
+}
+
+func TestXXHash64(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		input string
+		want  uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	} {
+		// Frames only include the low 32 bits, so check the full hash,
+		// both in one write and split across several
+		var x xxhash64
+		x.reset()
+		x.write([]byte(tc.input))
+		if got := x.sum(); got != tc.want {
+			t.Errorf("xxhash64(%q): expected %x, got %x", tc.input, tc.want, got)
+		}
+		x.reset()
+		for i := 0; i < len(tc.input); i += 5 {
+			end := i + 5
+			if end > len(tc.input) {
+				end = len(tc.input)
+			}
+			x.write([]byte(tc.input[i:end]))
+		}
+		if got := x.sum(); got != tc.want {
+			t.Errorf("xxhash64(%q) in pieces: expected %x, got %x", tc.input, tc.want, got)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}